@@ -16,7 +16,7 @@ import (
 
 var _ = fmt.Print
 
-func get_line(o *Options) (result string, err error) {
+func GetLine(o *Options) (result string, err error) {
 	lp, err := loop.New(loop.NoAlternateScreen, loop.NoRestoreColors)
 	if err != nil {
 		return
@@ -50,7 +50,7 @@ func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
 		result.Response = pw
 	case "line":
 		show_message(o.Message)
-		result.Response, err = get_line(o)
+		result.Response, err = GetLine(o)
 		if err != nil {
 			return 1, err
 		}
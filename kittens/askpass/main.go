@@ -0,0 +1,249 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package askpass
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"kitty/kittens/ask"
+	"kitty/tools/cli"
+	"kitty/tools/tty"
+	"kitty/tools/tui"
+	"kitty/tools/utils/shm"
+)
+
+var _ = fmt.Print
+
+var ErrCanceled = errors.New("Canceled by user")
+
+func fatal(err error) {
+	cli.ShowError(err)
+	os.Exit(1)
+}
+
+func is_fingerprint_check(msg string) bool {
+	return strings.Contains(msg, "(yes/no/[fingerprint])")
+}
+
+func detect_type(msg string) string {
+	if os.Getenv("SSH_ASKPASS_PROMPT") == "confirm" {
+		return "confirm"
+	}
+	if is_fingerprint_check(msg) {
+		return "fingerprint"
+	}
+	return "password"
+}
+
+// kitty {{{
+
+func trigger_ask(name string) error {
+	term, err := tty.OpenControllingTerm()
+	if err != nil {
+		return err
+	}
+	defer term.Close()
+	_, err = term.WriteString("\x1bP@kitty-ask|" + name + "\x1b\\")
+	return err
+}
+
+// Ask kitty to show the question in an overlay window, the response is
+// written by kitty into the shared memory
+func ask_kitty(q map[string]any, response any) (err error) {
+	data, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	data_shm, err := shm.CreateTemp("askpass-*", uint64(len(data)+32))
+	if err != nil {
+		return fmt.Errorf("Failed to create SHM file with error: %w", err)
+	}
+	defer data_shm.Close()
+	defer func() { _ = data_shm.Unlink() }()
+
+	data_shm.Slice()[0] = 0
+	if err = shm.WriteWithSize(data_shm, data, 1); err != nil {
+		return fmt.Errorf("Failed to write to SHM file with error: %w", err)
+	}
+	if err = data_shm.Flush(); err != nil {
+		return fmt.Errorf("Failed to flush SHM file with error: %w", err)
+	}
+	if err = trigger_ask(data_shm.Name()); err != nil {
+		return err
+	}
+	for {
+		time.Sleep(50 * time.Millisecond)
+		if data_shm.Slice()[0] == 1 {
+			break
+		}
+	}
+	data, err = shm.ReadWithSize(data_shm, 1)
+	if err != nil {
+		return fmt.Errorf("Failed to read from SHM file with error: %w", err)
+	}
+	if err = json.Unmarshal(data, response); err != nil {
+		return fmt.Errorf("Failed to parse response data: %#v with error: %w", string(data), err)
+	}
+	return
+}
+
+func kitty_get_line(msg string, is_password bool) (ans string, err error) {
+	q := map[string]any{"message": msg, "type": "get_line", "is_password": is_password}
+	if err = ask_kitty(q, &ans); err == nil && ans == "" {
+		err = ErrCanceled
+	}
+	return
+}
+
+func kitty_confirm(msg string) (ans bool, err error) {
+	err = ask_kitty(map[string]any{"message": msg, "type": "confirm"}, &ans)
+	return
+}
+
+func kitty_choose(msg string, choices ...string) (ans string, err error) {
+	if err = ask_kitty(map[string]any{"message": msg, "type": "choose", "choices": choices}, &ans); err == nil && ans == "" {
+		err = ErrCanceled
+	}
+	return
+}
+
+// }}}
+
+// terminal {{{
+
+func terminal_get_line(msg string, is_password bool) (ans string, err error) {
+	if is_password {
+		ans, err = tui.ReadPassword(msg, false)
+		if errors.Is(err, tui.Canceled) {
+			err = ErrCanceled
+		}
+	} else {
+		ans, err = ask.GetLine(&ask.Options{Prompt: msg})
+	}
+	if err == nil && ans == "" {
+		err = ErrCanceled
+	}
+	return
+}
+
+func terminal_confirm(msg string) (bool, error) {
+	ans, err := ask.GetChoices(&ask.Options{Type: "yesno", Message: msg, Default: "y"})
+	return ans == "y", err
+}
+
+func terminal_choose(msg string, choices ...string) (ans string, err error) {
+	if ans, err = ask.GetChoices(&ask.Options{Type: "choices", Message: msg, Choices: choices}); err == nil && ans == "" {
+		err = ErrCanceled
+	}
+	return
+}
+
+// }}}
+
+type ui struct {
+	get_line func(msg string, is_password bool) (string, error)
+	confirm  func(msg string) (bool, error)
+	choose   func(msg string, choices ...string) (string, error)
+}
+
+func ui_for(use string) (*ui, error) {
+	if use == "auto" {
+		use = "terminal"
+		if os.Getenv("KITTY_WINDOW_ID") != "" {
+			use = "kitty"
+		}
+	}
+	if use == "kitty" {
+		return &ui{kitty_get_line, kitty_confirm, kitty_choose}, nil
+	}
+	if term, err := tty.OpenControllingTerm(); err != nil {
+		return nil, fmt.Errorf("No terminal is available to ask for the password in")
+	} else {
+		term.Close()
+	}
+	return &ui{terminal_get_line, terminal_confirm, terminal_choose}, nil
+}
+
+// Ask the question returning the response to output
+func ask_question(u *ui, q_type, msg string) (response string, err error) {
+	switch q_type {
+	case "password", "line":
+		return u.get_line(msg, q_type == "password")
+	case "confirm":
+		ok, err := u.confirm(msg)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			// the response is also written for SSH, which checks it
+			return "no", ErrCanceled
+		}
+		return "yes", nil
+	case "fingerprint":
+		msg = strings.TrimSpace(strings.Replace(msg, "(yes/no/[fingerprint])", "", 1))
+		choice, err := u.choose(msg, "y;green:Yes", "n;red:No", "f:Enter fingerprint")
+		if err != nil {
+			return "", err
+		}
+		switch choice {
+		case "y":
+			return "yes", nil
+		case "n":
+			return "no", nil
+		}
+		return u.get_line("Fingerprint: ", false)
+	}
+	return "", fmt.Errorf("Unknown type: %s", q_type)
+}
+
+func run(q_type, use, msg string) (rc int, err error) {
+	if q_type == "auto" {
+		q_type = detect_type(msg)
+	}
+	u, err := ui_for(use)
+	if err != nil {
+		return 1, err
+	}
+	response, err := ask_question(u, q_type, msg)
+	if response != "" {
+		fmt.Println(response)
+	}
+	if err != nil {
+		if errors.Is(err, ErrCanceled) {
+			return 1, nil
+		}
+		return 1, err
+	}
+	return 0, nil
+}
+
+func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
+	msg := "Password: "
+	if len(args) > 0 {
+		msg = strings.Join(args, " ")
+	}
+	return run(o.Type, o.Use, msg)
+}
+
+// Run as SSH_ASKPASS by the ssh kitten, which cannot pass command line
+// arguments to select the askpass kitten
+func RunSSHAskpass() {
+	msg := "Password: "
+	if len(os.Args) > 1 {
+		msg = os.Args[len(os.Args)-1]
+	}
+	rc, err := run("auto", "kitty", msg)
+	if err != nil {
+		fatal(err)
+	}
+	os.Exit(rc)
+}
+
+func EntryPoint(parent *cli.Command) {
+	create_cmd(parent, main)
+}
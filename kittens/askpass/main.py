@@ -0,0 +1,50 @@
+#!/usr/bin/env python
+# License: GPLv3 Copyright: 2023, Kovid Goyal <kovid at kovidgoyal.net>
+
+
+import sys
+from typing import List
+
+OPTIONS = r'''
+--type -t
+default=auto
+choices=auto,password,line,confirm,fingerprint
+The type of prompt. :code:`password` asks for hidden input, :code:`line` for
+visible input, :code:`confirm` asks for a yes or no answer and
+:code:`fingerprint` is for confirming SSH host keys, asking for either a yes or
+no answer or a host key fingerprint. The default of :code:`auto` detects the
+type from the prompt and the environment variables set by SSH.
+
+
+--use -u
+default=auto
+choices=auto,kitty,terminal
+Where to show the prompt. :code:`kitty` shows it in an overlay window in kitty,
+which works only when running inside kitty. :code:`terminal` shows it in the
+controlling terminal. The default of :code:`auto` uses kitty when possible,
+falling back to the terminal.
+'''.format
+help_text = '''\
+Ask for passwords and confirmations. Suitable for use as :envvar:`SSH_ASKPASS`
+or :envvar:`SUDO_ASKPASS`. The prompt is read from the command line, as passed
+by SSH and sudo. The answer is written to STDOUT. The exit code is zero if an
+answer was provided and one otherwise. Since :envvar:`SSH_ASKPASS` and
+:envvar:`SUDO_ASKPASS` must be programs, not command lines, use a small wrapper
+script, for example: :code:`#!/bin/sh` followed by :code:`exec kitten askpass "$@"`.
+The ssh kitten uses this automatically, see :opt:`kitten-ssh.askpass`.
+'''
+usage = '[prompt]'
+
+
+def main(args: List[str]) -> None:
+    raise SystemExit('This should be run as kitten askpass')
+
+
+if __name__ == '__main__':
+    main(sys.argv)
+elif __name__ == '__doc__':
+    cd = sys.cli_docs  # type: ignore
+    cd['usage'] = usage
+    cd['options'] = OPTIONS
+    cd['help_text'] = help_text
+    cd['short_desc'] = 'Ask for passwords for SSH and sudo'
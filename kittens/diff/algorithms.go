@@ -0,0 +1,251 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The line matching algorithms used by the builtin differ. Each finds pairs of
+// indices of matching lines in the old and new lines, in increasing order,
+// which Diff uses to anchor the diff.
+
+// Lines that occur more often than this are not used as anchors by the
+// histogram algorithm, the same limit as used by git
+const MAX_HISTOGRAM_CHAIN = 64
+
+var all_diff_algorithms = []Diff_algorithm_Choice_Type{
+	Diff_algorithm_default, Diff_algorithm_myers, Diff_algorithm_patience, Diff_algorithm_histogram}
+
+// Command line flags to use the algorithm with the specified diff program.
+// ok is false if the program does not support the algorithm.
+func diff_algorithm_flags(exe string, algorithm Diff_algorithm_Choice_Type) (flags []string, ok bool) {
+	if algorithm == Diff_algorithm_default {
+		return nil, true
+	}
+	switch filepath.Base(exe) {
+	case "git":
+		return []string{"--diff-algorithm=" + algorithm.String()}, true
+	case "diff":
+		if algorithm == Diff_algorithm_myers {
+			// diff uses a variant of the Myers algorithm that trades
+			// minimality for speed, unless asked not to
+			return []string{"-d"}, true
+		}
+	}
+	return nil, false
+}
+
+type line_matcher func(a, b []int, aoff, boff int, ans []pair) []pair
+
+// Match the common prefix and suffix of a and b, using f to match the lines
+// in between
+func with_common_affixes(a, b []int, aoff, boff int, ans []pair, f line_matcher) []pair {
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		ans = append(ans, pair{aoff, boff})
+		a, b, aoff, boff = a[1:], b[1:], aoff+1, boff+1
+	}
+	n := 0
+	for n < len(a) && n < len(b) && a[len(a)-1-n] == b[len(b)-1-n] {
+		n++
+	}
+	a, b = a[:len(a)-n], b[:len(b)-n]
+	if len(a) > 0 && len(b) > 0 {
+		ans = f(a, b, aoff, boff, ans)
+	}
+	for i := 0; i < n; i++ {
+		ans = append(ans, pair{aoff + len(a) + i, boff + len(b) + i})
+	}
+	return ans
+}
+
+// The point at which the forward and reverse shortest edit paths through a
+// and b overlap, found using the linear space variant of the Myers
+// algorithm. found is false if a and b have nothing in common.
+func middle_snake(a, b []int) (x, y int, found bool) {
+	n, m := len(a), len(b)
+	max_d := (n + m + 1) / 2
+	v_offset, v_length := max_d, 2*max_d+2
+	v1, v2 := make([]int, v_length), make([]int, v_length)
+	for i := range v1 {
+		v1[i], v2[i] = -1, -1
+	}
+	v1[v_offset+1], v2[v_offset+1] = 0, 0
+	delta := n - m
+	// if the difference in lengths is odd, the forward path will collide
+	// with the reverse path
+	front := delta%2 != 0
+	k1start, k1end, k2start, k2end := 0, 0, 0, 0
+	for d := 0; d < max_d; d++ {
+		for k1 := -d + k1start; k1 <= d-k1end; k1 += 2 {
+			k1_offset := v_offset + k1
+			var x1 int
+			if k1 == -d || (k1 != d && v1[k1_offset-1] < v1[k1_offset+1]) {
+				x1 = v1[k1_offset+1]
+			} else {
+				x1 = v1[k1_offset-1] + 1
+			}
+			y1 := x1 - k1
+			for x1 < n && y1 < m && a[x1] == b[y1] {
+				x1++
+				y1++
+			}
+			v1[k1_offset] = x1
+			if x1 > n {
+				k1end += 2
+			} else if y1 > m {
+				k1start += 2
+			} else if front {
+				if k2_offset := v_offset + delta - k1; k2_offset >= 0 && k2_offset < v_length && v2[k2_offset] != -1 {
+					if x1 >= n-v2[k2_offset] {
+						return x1, y1, true
+					}
+				}
+			}
+		}
+		for k2 := -d + k2start; k2 <= d-k2end; k2 += 2 {
+			k2_offset := v_offset + k2
+			var x2 int
+			if k2 == -d || (k2 != d && v2[k2_offset-1] < v2[k2_offset+1]) {
+				x2 = v2[k2_offset+1]
+			} else {
+				x2 = v2[k2_offset-1] + 1
+			}
+			y2 := x2 - k2
+			for x2 < n && y2 < m && a[n-x2-1] == b[m-y2-1] {
+				x2++
+				y2++
+			}
+			v2[k2_offset] = x2
+			if x2 > n {
+				k2end += 2
+			} else if y2 > m {
+				k2start += 2
+			} else if !front {
+				if k1_offset := v_offset + delta - k2; k1_offset >= 0 && k1_offset < v_length && v1[k1_offset] != -1 {
+					x1 := v1[k1_offset]
+					if x1 >= n-x2 {
+						return x1, v_offset + x1 - k1_offset, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// The longest common subsequence of a and b, giving the smallest number of
+// lines added and removed
+func myers_matches(a, b []int, aoff, boff int, ans []pair) []pair {
+	x, y, found := middle_snake(a, b)
+	if !found {
+		return ans
+	}
+	ans = with_common_affixes(a[:x], b[:y], aoff, boff, ans, myers_matches)
+	return with_common_affixes(a[x:], b[y:], aoff+x, boff+y, ans, myers_matches)
+}
+
+// Anchor on the longest common subsequence of the lines that are unique in
+// both a and b, then recurse into the regions between the anchors, falling
+// back to the Myers algorithm for regions with no unique lines
+func patience_matches(a, b []int, aoff, boff int, ans []pair) []pair {
+	seq := tgs(a, b)
+	// remove the sentinels
+	anchors := seq[1 : len(seq)-1]
+	if len(anchors) == 0 {
+		return myers_matches(a, b, aoff, boff, ans)
+	}
+	prev := pair{}
+	for _, p := range anchors {
+		ans = with_common_affixes(a[prev.x:p.x], b[prev.y:p.y], aoff+prev.x, boff+prev.y, ans, patience_matches)
+		ans = append(ans, pair{aoff + p.x, boff + p.y})
+		prev = pair{p.x + 1, p.y + 1}
+	}
+	return with_common_affixes(a[prev.x:], b[prev.y:], aoff+prev.x, boff+prev.y, ans, patience_matches)
+}
+
+// Anchor on the longest common region containing the lines that occur least
+// often in a, then recurse into the regions before and after it. This is like
+// the patience algorithm, but can also anchor on lines that are not unique.
+func histogram_matches(a, b []int, aoff, boff int, ans []pair) []pair {
+	positions := make(map[int][]int, len(a))
+	for i, x := range a {
+		positions[x] = append(positions[x], i)
+	}
+	best_start, best_len, best_count := pair{}, 0, MAX_HISTOGRAM_CHAIN+1
+	for j := 0; j < len(b); {
+		candidates := positions[b[j]]
+		next_j := j + 1
+		if len(candidates) > MAX_HISTOGRAM_CHAIN {
+			candidates = nil
+		}
+		for _, i := range candidates {
+			start, end := pair{i, j}, pair{i + 1, j + 1}
+			for start.x > 0 && start.y > 0 && a[start.x-1] == b[start.y-1] {
+				start.x--
+				start.y--
+			}
+			for end.x < len(a) && end.y < len(b) && a[end.x] == b[end.y] {
+				end.x++
+				end.y++
+			}
+			count := MAX_HISTOGRAM_CHAIN + 1
+			for k := start.x; k < end.x; k++ {
+				count = utils.Min(count, len(positions[a[k]]))
+			}
+			if l := end.x - start.x; count < best_count || (count == best_count && l > best_len) {
+				best_start, best_len, best_count = start, l, count
+			}
+			next_j = utils.Max(next_j, end.y)
+		}
+		j = next_j
+	}
+	if best_len == 0 {
+		return myers_matches(a, b, aoff, boff, ans)
+	}
+	s := best_start
+	ans = with_common_affixes(a[:s.x], b[:s.y], aoff, boff, ans, histogram_matches)
+	for i := 0; i < best_len; i++ {
+		ans = append(ans, pair{aoff + s.x + i, boff + s.y + i})
+	}
+	return with_common_affixes(a[s.x+best_len:], b[s.y+best_len:], aoff+s.x+best_len, boff+s.y+best_len, ans, histogram_matches)
+}
+
+// The pairs of matching lines to anchor the diff of x and y on, including the
+// sentinels {0, 0} and {len(x), len(y)}
+func anchors(x, y []string, algorithm Diff_algorithm_Choice_Type) []pair {
+	var matcher line_matcher
+	switch algorithm {
+	case Diff_algorithm_myers:
+		matcher = myers_matches
+	case Diff_algorithm_patience:
+		matcher = patience_matches
+	case Diff_algorithm_histogram:
+		matcher = histogram_matches
+	default:
+		return tgs(x, y)
+	}
+	// compare integers rather than strings
+	ids := make(map[string]int, len(x))
+	intern := func(lines []string) []int {
+		ans := make([]int, len(lines))
+		for i, l := range lines {
+			id, found := ids[l]
+			if !found {
+				id = len(ids)
+				ids[l] = id
+			}
+			ans[i] = id
+		}
+		return ans
+	}
+	a, b := intern(x), intern(y)
+	ans := make([]pair, 1, utils.Min(len(x), len(y))+2)
+	ans = with_common_affixes(a, b, 0, 0, ans, matcher)
+	return append(ans, pair{len(x), len(y)})
+}
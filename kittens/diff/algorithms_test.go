@@ -0,0 +1,103 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"kitty/tools/utils"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestDiffAlgorithms(t *testing.T) {
+	lcs_len := func(x, y []string) int {
+		dp := make([][]int, len(x)+1)
+		for i := range dp {
+			dp[i] = make([]int, len(y)+1)
+		}
+		for i := len(x) - 1; i >= 0; i-- {
+			for j := len(y) - 1; j >= 0; j-- {
+				if x[i] == y[j] {
+					dp[i][j] = dp[i+1][j+1] + 1
+				} else {
+					dp[i][j] = max(dp[i+1][j], dp[i][j+1])
+				}
+			}
+		}
+		return dp[0][0]
+	}
+	check := func(x, y []string, algorithm Diff_algorithm_Choice_Type) []pair {
+		seq := anchors(x, y, algorithm)
+		if seq[0] != (pair{}) || seq[len(seq)-1] != (pair{len(x), len(y)}) {
+			t.Fatalf("%s: missing sentinels in: %v", algorithm, seq)
+		}
+		matches := seq[1 : len(seq)-1]
+		for i, p := range matches {
+			if x[p.x] != y[p.y] {
+				t.Fatalf("%s: lines do not match at: %v", algorithm, p)
+			}
+			if i > 0 && (p.x <= matches[i-1].x || p.y <= matches[i-1].y) {
+				t.Fatalf("%s: matches not increasing: %v", algorithm, matches)
+			}
+		}
+		return matches
+	}
+	r := rand.New(rand.NewSource(1))
+	random_lines := func() []string {
+		ans := make([]string, r.Intn(30))
+		for i := range ans {
+			ans[i] = string(rune('a' + r.Intn(5)))
+		}
+		return ans
+	}
+	for i := 0; i < 200; i++ {
+		x, y := random_lines(), random_lines()
+		for _, algorithm := range all_diff_algorithms {
+			matches := check(x, y, algorithm)
+			if algorithm == Diff_algorithm_myers {
+				if expected := lcs_len(x, y); len(matches) != expected {
+					t.Fatalf("myers did not find the longest common subsequence of %v and %v: %d != %d", x, y, len(matches), expected)
+				}
+			}
+		}
+	}
+
+	// patience and histogram anchor on the unique function definition rather
+	// than matching the common braces
+	x := strings.Split("func a() {|a|}|func b() {|b1|b2|}", "|")
+	y := strings.Split("func b() {|b1|b2|}|func c() {|c|}|func a() {|a|}", "|")
+	as_text := func(matches []pair) string {
+		return strings.Join(utils.Map(func(p pair) string { return x[p.x] }, matches), ",")
+	}
+	if actual := as_text(check(x, y, Diff_algorithm_myers)); len(strings.Split(actual, ",")) != lcs_len(x, y) {
+		t.Fatalf("myers did not find the longest common subsequence: %s", actual)
+	}
+	for _, algorithm := range []Diff_algorithm_Choice_Type{Diff_algorithm_patience, Diff_algorithm_histogram} {
+		if diff := cmp.Diff("func b() {,b1,b2,}", as_text(check(x, y, algorithm))); diff != "" {
+			t.Fatalf("%s produced incorrect matches:\n%s", algorithm, diff)
+		}
+	}
+
+	for _, q := range []struct {
+		exe       string
+		algorithm Diff_algorithm_Choice_Type
+		expected  string
+		ok        bool
+	}{
+		{"/usr/bin/git", Diff_algorithm_histogram, "--diff-algorithm=histogram", true},
+		{"diff", Diff_algorithm_myers, "-d", true},
+		{"diff", Diff_algorithm_patience, "", false},
+		{"colordiff", Diff_algorithm_default, "", true},
+	} {
+		flags, ok := diff_algorithm_flags(q.exe, q.algorithm)
+		if actual := strings.Join(flags, " "); actual != q.expected || ok != q.ok {
+			t.Fatalf("Incorrect flags for %s with %s: %#v %v", q.exe, q.algorithm, actual, ok)
+		}
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"unicode/utf8"
 
 	"kitty/tools/utils"
+
+	"github.com/bmatcuk/doublestar/v4"
 )
 
 var _ = fmt.Print
@@ -36,6 +38,17 @@ func init_caches() {
 	hash_cache = utils.NewLRUCache[string, string](sz)
 }
 
+// Remove all cached data for the specified path, so that it is re-read
+func forget_path(path string) {
+	size_cache.Delete(path)
+	mimetypes_cache.Delete(path)
+	data_cache.Delete(path)
+	is_text_cache.Delete(path)
+	lines_cache.Delete(path)
+	highlighted_lines_cache.Delete(path)
+	hash_cache.Delete(path)
+}
+
 func add_remote_dir(val string) {
 	x := filepath.Base(val)
 	idx := strings.LastIndex(x, "-")
@@ -116,7 +129,16 @@ func hash_for_path(path string) (string, error) {
 }
 
 // Remove all control codes except newlines
+func is_control_code(r rune) bool {
+	return (r < 0x20 && r != '\n') || (r >= 0x7f && r <= 0x9f)
+}
+
 func sanitize_control_codes(x string) string {
+	// matching the regular expression is slow for large files, which rarely
+	// have any control codes
+	if strings.IndexFunc(x, is_control_code) < 0 {
+		return x
+	}
 	pat := utils.MustCompile("[\x00-\x09\x0b-\x1f\x7f\u0080-\u009f]")
 	return pat.ReplaceAllLiteralString(x, "░")
 }
@@ -159,6 +181,7 @@ func highlighted_lines_for_path(path string) ([]string, error) {
 type Collection struct {
 	changes, renames, type_map map[string]string
 	adds, removes              *utils.Set[string]
+	similar                    map[string]similar_file
 	all_paths                  []string
 	paths_to_highlight         *utils.Set[string]
 	added_count, removed_count int
@@ -172,6 +195,20 @@ func (self *Collection) add_change(left, right string) {
 	self.type_map[left] = `diff`
 }
 
+// A file that was renamed or copied and also changed
+func (self *Collection) add_similar(left, right string, s similar_file) {
+	self.add_change(left, right)
+	self.similar[left] = s
+}
+
+// A note describing the change to the file, if it was renamed or copied
+func (self *Collection) note_for(path string) string {
+	if s, found := self.similar[path]; found {
+		return s.String()
+	}
+	return ""
+}
+
 func (self *Collection) add_rename(left, right string) {
 	self.renames[left] = right
 	self.all_paths = append(self.all_paths, left)
@@ -237,6 +274,38 @@ func allowed(path string, patterns ...string) bool {
 	return true
 }
 
+// Glob patterns without a slash are matched against the file name, others
+// against the path relative to the directory being diffed
+func glob_matches(pattern, rel_path string) bool {
+	if !strings.ContainsRune(pattern, '/') {
+		rel_path = filepath.Base(rel_path)
+	}
+	matched, err := doublestar.Match(pattern, rel_path)
+	return err == nil && matched
+}
+
+type walk_filter struct {
+	ignore_names, include, exclude []string
+	use_gitignore                  bool
+}
+
+func (self *walk_filter) allowed(rel_path string, is_dir bool) bool {
+	for _, pat := range self.exclude {
+		if glob_matches(pat, rel_path) {
+			return false
+		}
+	}
+	if is_dir || len(self.include) == 0 {
+		return true
+	}
+	for _, pat := range self.include {
+		if glob_matches(pat, rel_path) {
+			return true
+		}
+	}
+	return false
+}
+
 func remote_hostname(path string) (string, string) {
 	for q, val := range remote_dirs {
 		if strings.HasPrefix(path, q) {
@@ -257,16 +326,28 @@ func resolve_remote_name(path, defval string) string {
 	return defval
 }
 
-func walk(base string, patterns []string, names *utils.Set[string], pmap, path_name_map map[string]string) error {
+func walk(base string, filter *walk_filter, names *utils.Set[string], pmap, path_name_map map[string]string) error {
 	base, err := filepath.Abs(base)
 	if err != nil {
 		return err
 	}
+	gi := gitignore{}
 	return filepath.WalkDir(base, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		is_allowed := allowed(path, patterns...)
+		is_allowed := allowed(path, filter.ignore_names...)
+		rel_path := ""
+		if is_allowed && path != base {
+			if rel_path, err = filepath.Rel(base, path); err != nil {
+				return err
+			}
+			rel_path = filepath.ToSlash(rel_path)
+			is_allowed = filter.allowed(rel_path, d.IsDir())
+			if is_allowed && filter.use_gitignore {
+				is_allowed = !(d.IsDir() && d.Name() == ".git") && !gi.is_ignored(rel_path, d.IsDir())
+			}
+		}
 		if !is_allowed {
 			if d.IsDir() {
 				return fs.SkipDir
@@ -274,6 +355,9 @@ func walk(base string, patterns []string, names *utils.Set[string], pmap, path_n
 			return nil
 		}
 		if d.IsDir() {
+			if filter.use_gitignore {
+				gi.load(path, rel_path)
+			}
 			return nil
 		}
 		path, err = filepath.Abs(path)
@@ -296,15 +380,20 @@ func walk(base string, patterns []string, names *utils.Set[string], pmap, path_n
 func (self *Collection) collect_files(left, right string) error {
 	left_names, right_names := utils.NewSet[string](16), utils.NewSet[string](16)
 	left_path_map, right_path_map := make(map[string]string, 16), make(map[string]string, 16)
-	err := walk(left, conf.Ignore_name, left_names, left_path_map, path_name_map)
+	filter := walk_filter{ignore_names: conf.Ignore_name, use_gitignore: conf.Respect_gitignore}
+	if opts != nil {
+		filter.include, filter.exclude = opts.Include, opts.Exclude
+	}
+	err := walk(left, &filter, left_names, left_path_map, path_name_map)
 	if err != nil {
 		return err
 	}
-	if err = walk(right, conf.Ignore_name, right_names, right_path_map, path_name_map); err != nil {
+	if err = walk(right, &filter, right_names, right_path_map, path_name_map); err != nil {
 		return err
 	}
 	common_names := left_names.Intersect(right_names)
 	changed_names := utils.NewSet[string](common_names.Len())
+	unchanged := make([]string, 0, common_names.Len())
 	for n := range common_names.Iterable() {
 		ld, err := data_for_path(left_path_map[n])
 		var rd string
@@ -328,6 +417,9 @@ func (self *Collection) collect_files(left, right string) error {
 				}
 			}
 		}
+		if !changed_names.Has(n) {
+			unchanged = append(unchanged, left_path_map[n])
+		}
 	}
 	removed := left_names.Subtract(common_names)
 	added := right_names.Subtract(common_names)
@@ -344,6 +436,7 @@ func (self *Collection) collect_files(left, right string) error {
 			return err
 		}
 	}
+	unmatched := make([]string, 0, removed.Len())
 	for name, rh := range rhash {
 		found := false
 		for n, ah := range ahash {
@@ -359,25 +452,48 @@ func (self *Collection) collect_files(left, right string) error {
 			}
 		}
 		if !found {
-			self.add_removal(left_path_map[name])
+			unmatched = append(unmatched, left_path_map[name])
 		}
 	}
+	added_paths := make([]string, 0, added.Len())
 	for name := range added.Iterable() {
-		self.add_add(right_path_map[name])
+		added_paths = append(added_paths, right_path_map[name])
+	}
+	paired := utils.NewSet[string](len(unmatched))
+	if threshold := rename_threshold(); threshold < 100 || conf.Detect_copies {
+		for _, p := range find_similar_files(unmatched, added_paths, unchanged, threshold, conf.Detect_copies) {
+			self.add_similar(p.left, p.right, p.similar_file)
+			paired.AddItems(p.left, p.right)
+		}
+	}
+	for _, path := range unmatched {
+		if !paired.Has(path) {
+			self.add_removal(path)
+		}
+	}
+	for _, path := range added_paths {
+		if !paired.Has(path) {
+			self.add_add(path)
+		}
 	}
 	return nil
 }
 
-func create_collection(left, right string) (ans *Collection, err error) {
-	ans = &Collection{
+func new_collection() *Collection {
+	return &Collection{
 		changes:            make(map[string]string),
 		renames:            make(map[string]string),
+		similar:            make(map[string]similar_file),
 		type_map:           make(map[string]string),
 		adds:               utils.NewSet[string](32),
 		removes:            utils.NewSet[string](32),
 		paths_to_highlight: utils.NewSet[string](32),
 		all_paths:          make([]string, 0, 32),
 	}
+}
+
+func create_collection(left, right string) (ans *Collection, err error) {
+	ans = new_collection()
 	left_stat, err := os.Stat(left)
 	if err != nil {
 		return nil, err
@@ -396,8 +512,8 @@ func create_collection(left, right string) (ans *Collection, err error) {
 		if err != nil {
 			return nil, err
 		}
-		path_name_map[pl] = resolve_remote_name(pl, left)
-		path_name_map[pr] = resolve_remote_name(pr, right)
+		path_name_map[pl] = resolve_remote_name(pl, display_name(left))
+		path_name_map[pr] = resolve_remote_name(pr, display_name(right))
 		ans.add_change(pl, pr)
 	}
 	ans.finalize()
@@ -39,7 +39,7 @@ func TestDiffCollectWalk(t *testing.T) {
 	}
 	names := utils.NewSet[string](16)
 	pmap := make(map[string]string, 16)
-	if err := walk(tdir, []string{"*~", "#*#", "b"}, names, pmap, map[string]string{}); err != nil {
+	if err := walk(tdir, &walk_filter{ignore_names: []string{"*~", "#*#", "b"}}, names, pmap, map[string]string{}); err != nil {
 		t.Fatal(err)
 	}
 	if diff := cmp.Diff(
@@ -52,3 +52,35 @@ func TestDiffCollectWalk(t *testing.T) {
 		t.Fatal(diff)
 	}
 }
+
+func TestDiffCollectWalkFilters(t *testing.T) {
+	tdir := t.TempDir()
+	j := func(x ...string) string { return filepath.Join(append([]string{tdir}, x...)...) }
+	for _, d := range []string{".git", "src/sub", "vendor/x", "build"} {
+		_ = os.MkdirAll(j(d), 0o700)
+	}
+	for _, f := range []string{".git/HEAD", "a.go", "a.txt", "src/b.go", "src/sub/c.go", "src/sub/gen.go", "vendor/x/v.go", "build/out.o", "keep.log", "drop.log"} {
+		_ = os.WriteFile(j(f), nil, 0o600)
+	}
+	_ = os.WriteFile(j(".gitignore"), []byte("# comment\n/build/\n*.log\n!keep.log\n"), 0o600)
+	_ = os.WriteFile(j("src", ".gitignore"), []byte("sub/gen.go\n"), 0o600)
+
+	tc := func(filter walk_filter, expected ...string) {
+		t.Helper()
+		names := utils.NewSet[string](16)
+		if err := walk(tdir, &filter, names, map[string]string{}, map[string]string{}); err != nil {
+			t.Fatal(err)
+		}
+		actual := utils.Map(filepath.ToSlash, utils.Sort(names.AsSlice(), strings.Compare))
+		if diff := cmp.Diff(utils.Sort(expected, strings.Compare), actual); diff != "" {
+			t.Fatalf("Incorrect files for filter: %#v\n%s", filter, diff)
+		}
+	}
+	tc(walk_filter{ignore_names: []string{".*"}, include: []string{"*.go"}, exclude: []string{"vendor"}},
+		"a.go", "src/b.go", "src/sub/c.go", "src/sub/gen.go")
+	tc(walk_filter{include: []string{"src/**/*.go"}}, "src/b.go", "src/sub/c.go", "src/sub/gen.go")
+	tc(walk_filter{exclude: []string{"src/sub", "*.o", ".git*", "*.log"}},
+		"a.go", "a.txt", "src/b.go", "vendor/x/v.go")
+	tc(walk_filter{use_gitignore: true},
+		".gitignore", "a.go", "a.txt", "keep.log", "src/.gitignore", "src/b.go", "src/sub/c.go", "vendor/x/v.go")
+}
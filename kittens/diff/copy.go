@@ -0,0 +1,158 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"strings"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The unsanitized lines of the file, numbered the same as by lines_for_path
+func raw_text_lines(path string) ([]string, error) {
+	data, err := data_for_path(path)
+	if err != nil || data == "" {
+		return nil, err
+	}
+	// any carriage returns are kept so that line endings are preserved exactly
+	return strings.Split(strings.TrimSuffix(data, "\n"), "\n"), nil
+}
+
+// The hunk containing the start of the mouse selection, if any, otherwise the
+// first line on screen. If that line is not in a hunk, the next hunk in the
+// same file is used.
+func (self *Handler) current_hunk() (left_path, right_path string, hunk *Hunk) {
+	if self.logical_lines == nil || self.diff_map == nil {
+		return
+	}
+	pos := self.scroll_pos.logical_line
+	if !self.mouse_selection.IsEmpty() {
+		pos = self.mouse_selection.StartLine().(*line_pos).y.logical_line
+	}
+	hunk_at := func(i int) *Hunk {
+		ll := self.logical_lines.At(i)
+		if ll.line_type != HUNK_TITLE_LINE {
+			return nil
+		}
+		if patch := self.diff_map[ll.left_reference.path]; patch != nil {
+			for _, h := range patch.all_hunks {
+				if h.left_start+1 == ll.left_reference.linenum && h.right_start+1 == ll.right_reference.linenum {
+					left_path, right_path = ll.left_reference.path, ll.right_reference.path
+					return h
+				}
+			}
+		}
+		return nil
+	}
+	for i := utils.Min(pos, self.logical_lines.Len()-1); i >= 0 && self.logical_lines.At(i).line_type != TITLE_LINE; i-- {
+		if hunk = hunk_at(i); hunk != nil {
+			return
+		}
+	}
+	for i := pos + 1; i < self.logical_lines.Len() && self.logical_lines.At(i).line_type != TITLE_LINE; i++ {
+		if hunk = hunk_at(i); hunk != nil {
+			return
+		}
+	}
+	return
+}
+
+func missing_final_newline(path string) bool {
+	data, err := data_for_path(path)
+	return err == nil && data != "" && !strings.HasSuffix(data, "\n")
+}
+
+// The lines of the hunk in unified diff format, with a marker after the last
+// line of a file that does not end with a newline, as git does
+func hunk_diff_lines(left_path, right_path string, left_lines, right_lines []string, hunk *Hunk, ans []string) []string {
+	ans = append(ans, strings.TrimRight(hunk_title(hunk), " "))
+	left_no_eol, right_no_eol := missing_final_newline(left_path), missing_final_newline(right_path)
+	add := func(prefix string, lines []string, start, count int, no_eol bool) {
+		for i := start; i < start+count && i < len(lines); i++ {
+			ans = append(ans, prefix+lines[i])
+			if no_eol && i == len(lines)-1 {
+				ans = append(ans, `\ No newline at end of file`)
+			}
+		}
+	}
+	for _, chunk := range hunk.chunks {
+		if chunk.is_context {
+			add(" ", left_lines, chunk.left_start, chunk.left_count, left_no_eol && right_no_eol)
+		} else {
+			add("-", left_lines, chunk.left_start, chunk.left_count, left_no_eol)
+			add("+", right_lines, chunk.right_start, chunk.right_count, right_no_eol)
+		}
+	}
+	return ans
+}
+
+// The text of the hunk. which is diff for the hunk in unified diff format,
+// left for the old version of its lines and right for the new version.
+func hunk_text(left_path, right_path string, hunk *Hunk, which string) (string, error) {
+	left_lines, err := raw_text_lines(left_path)
+	if err != nil {
+		return "", err
+	}
+	right_lines, err := raw_text_lines(right_path)
+	if err != nil {
+		return "", err
+	}
+	ans := make([]string, 0, hunk.left_count+hunk.right_count+1)
+	add := func(lines []string, start, count int) {
+		for i := start; i < start+count && i < len(lines); i++ {
+			ans = append(ans, lines[i])
+		}
+	}
+	switch which {
+	case `diff`:
+		ans = hunk_diff_lines(left_path, right_path, left_lines, right_lines, hunk, ans)
+	case `left`:
+		add(left_lines, hunk.left_start, hunk.left_count)
+	default:
+		add(right_lines, hunk.right_start, hunk.right_count)
+	}
+	return strings.Join(ans, "\n") + "\n", nil
+}
+
+func (self *Handler) copy_hunk(which string) error {
+	if self.merge != nil || !self.has_content() {
+		self.lp.Beep()
+		return nil
+	}
+	left_path, right_path, hunk := self.current_hunk()
+	if hunk == nil {
+		self.lp.Beep()
+		return nil
+	}
+	text, err := hunk_text(left_path, right_path, hunk, which)
+	if err != nil {
+		return err
+	}
+	self.lp.CopyTextToClipboard(text)
+	return nil
+}
+
+func (self *Handler) copy_line(right bool) error {
+	if self.merge != nil || !self.has_content() {
+		self.lp.Beep()
+		return nil
+	}
+	path, linenum := self.current_location(right)
+	if path == "" || linenum < 1 {
+		self.lp.Beep()
+		return nil
+	}
+	lines, err := raw_text_lines(path)
+	if err != nil {
+		return err
+	}
+	if linenum > len(lines) {
+		self.lp.Beep()
+		return nil
+	}
+	self.lp.CopyTextToClipboard(lines[linenum-1])
+	return nil
+}
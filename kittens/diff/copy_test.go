@@ -0,0 +1,57 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestDiffCopyHunk(t *testing.T) {
+	conf = NewConfig()
+	init_caches()
+	diff_cmd = []string{}
+	tdir := t.TempDir()
+	left, right := filepath.Join(tdir, "left"), filepath.Join(tdir, "right")
+	_ = os.WriteFile(left, []byte("a\n\tb\nc\n"), 0o600)
+	_ = os.WriteFile(right, []byte("a\n\tB\nc\nd\n"), 0o600)
+	diff_map, err := diff([]diff_job{{left, right}}, 3, ignore_whitespace{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hunk := diff_map[left].all_hunks[0]
+	for which, expected := range map[string]string{
+		`diff`:  "@@ -1,3 +1,4 @@\n a\n-\tb\n+\tB\n c\n+d\n",
+		`left`:  "a\n\tb\nc\n",
+		`right`: "a\n\tB\nc\nd\n",
+	} {
+		actual, err := hunk_text(left, right, hunk, which)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Fatalf("Incorrect %s text for hunk:\n%s", which, diff)
+		}
+	}
+	// line endings are preserved
+	_ = os.WriteFile(left, []byte("a\r\nb\r\n"), 0o600)
+	_ = os.WriteFile(right, []byte("a\r\nB\r\n"), 0o600)
+	init_caches()
+	diff_map, err = diff([]diff_job{{left, right}}, 3, ignore_whitespace{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := hunk_text(left, right, diff_map[left].all_hunks[0], `right`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("a\r\nB\r\n", actual); diff != "" {
+		t.Fatalf("Incorrect text for hunk with CRLF line endings:\n%s", diff)
+	}
+}
@@ -46,7 +46,10 @@ type pair struct{ x, y int }
 // Second, the name is frequently interpreted as meaning that you have
 // to wait longer (to be patient) for the diff, meaning that it is a slower algorithm,
 // when in fact the algorithm is faster than the standard one.
-func Diff(oldName, old, newName, new string, num_of_context_lines int) []byte {
+//
+// The anchored diff is used for the default algorithm, the other
+// algorithms are implemented in algorithms.go.
+func Diff(oldName, old, newName, new string, num_of_context_lines int, algorithm Diff_algorithm_Choice_Type) []byte {
 	if old == new {
 		return nil
 	}
@@ -63,7 +66,7 @@ func Diff(oldName, old, newName, new string, num_of_context_lines int) []byte {
 	// expanding each match to include surrounding lines,
 	// and then printing diff chunks.
 	// To avoid setup/teardown cases outside the loop,
-	// tgs returns a leading {0,0} and trailing {len(x), len(y)} pair
+	// anchors returns a leading {0,0} and trailing {len(x), len(y)} pair
 	// in the sequence of matches.
 	var (
 		done  pair     // printed up to x[:done.x] and y[:done.y]
@@ -71,8 +74,8 @@ func Diff(oldName, old, newName, new string, num_of_context_lines int) []byte {
 		count pair     // number of lines from each side in current chunk
 		ctext []string // lines for current chunk
 	)
-	for _, m := range tgs(x, y) {
-		if m.x < done.x {
+	for _, m := range anchors(x, y, algorithm) {
+		if m.x < done.x || m.y < done.y {
 			// Already handled scanning forward from earlier match.
 			continue
 		}
@@ -189,12 +192,12 @@ func lines(x string) []string {
 // Thomas G. Szymanski, “A Special Case of the Maximal Common
 // Subsequence Problem,” Princeton TR #170 (January 1975),
 // available at https://research.swtch.com/tgs170.pdf.
-func tgs(x, y []string) []pair {
+func tgs[S comparable](x, y []S) []pair {
 	// Count the number of times each string appears in a and b.
 	// We only care about 0, 1, many, counted as 0, -1, -2
 	// for the x side and 0, -4, -8 for the y side.
 	// Using negative numbers now lets us distinguish positive line numbers later.
-	m := make(map[string]int)
+	m := make(map[S]int)
 	for _, s := range x {
 		if c := m[s]; c > -2 {
 			m[s] = c - 1
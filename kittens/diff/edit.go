@@ -0,0 +1,128 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/shlex"
+)
+
+var _ = fmt.Print
+
+// The command to edit the specified file at the specified line
+func editor_command(path string, linenum int) ([]string, error) {
+	line := strconv.Itoa(linenum)
+	if conf.Editor != "" {
+		cmd, err := shlex.Split(conf.Editor)
+		if err != nil {
+			return nil, fmt.Errorf("The editor command %#v is invalid with error: %w", conf.Editor, err)
+		}
+		has_path := false
+		for i, x := range cmd {
+			if strings.Contains(x, "_PATH_") {
+				has_path = true
+			}
+			cmd[i] = strings.ReplaceAll(strings.ReplaceAll(x, "_LINE_", line), "_PATH_", path)
+		}
+		if !has_path {
+			cmd = append(cmd, path)
+		}
+		return cmd, nil
+	}
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vim"
+	}
+	cmd, err := shlex.Split(editor)
+	if err != nil || len(cmd) == 0 {
+		cmd = []string{"vim"}
+	}
+	// the +LINE syntax is understood by almost all terminal editors
+	return append(cmd, "+"+line, path), nil
+}
+
+// The current file and line number. This is the start of the mouse selection,
+// if any, otherwise the first line on screen from the specified side.
+func (self *Handler) current_location(right bool) (path string, linenum int) {
+	if self.logical_lines == nil {
+		return
+	}
+	pos := self.scroll_pos
+	if !self.mouse_selection.IsEmpty() {
+		start := self.mouse_selection.StartLine().(*line_pos)
+		pos = start.y
+		right = start.min_x != self.logical_lines.margin_size
+	}
+	bottom := pos
+	self.logical_lines.IncrementScrollPosBy(&bottom, self.screen_size.num_lines-1)
+	ref_for := func(ll *LogicalLine) Reference {
+		if right {
+			return ll.right_reference
+		}
+		return ll.left_reference
+	}
+	for i := pos.logical_line; i <= bottom.logical_line && i < self.logical_lines.Len(); i++ {
+		if ref := ref_for(self.logical_lines.At(i)); ref.path != "" && ref.linenum > 0 {
+			return ref.path, ref.linenum
+		}
+	}
+	for i := pos.logical_line; i <= bottom.logical_line && i < self.logical_lines.Len(); i++ {
+		if ref := ref_for(self.logical_lines.At(i)); ref.path != "" {
+			return ref.path, 1
+		}
+	}
+	return
+}
+
+// Edit the file under the cursor and refresh the diff when the editor exits
+func (self *Handler) edit_file(right bool) error {
+	if self.merge != nil || !self.has_content() {
+		self.lp.Beep()
+		return nil
+	}
+	path, linenum := self.current_location(right)
+	if path == "" {
+		self.lp.Beep()
+		return nil
+	}
+	cmd, err := editor_command(path, linenum)
+	if err != nil {
+		self.statusline_message = err.Error()
+		self.draw_status_line()
+		return nil
+	}
+	var run_err error
+	err = self.lp.SuspendAndRun(func() error {
+		c := exec.Command(utils.FindExe(cmd[0]), cmd[1:]...)
+		c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+		run_err = c.Run()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if run_err != nil {
+		self.statusline_message = fmt.Sprintf("Running the editor %s failed with error: %s", cmd[0], run_err)
+	}
+	forget_path(path)
+	p := self.scroll_pos
+	self.restore_position = &p
+	self.clear_mouse_selection()
+	self.generate_diff()
+	go func() {
+		highlight_all([]string{path})
+		self.async_results <- AsyncResult{rtype: HIGHLIGHT}
+		self.lp.WakeupMainThread()
+	}()
+	self.draw_screen()
+	return nil
+}
@@ -0,0 +1,169 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Exporting the diff as a patch in the format used by git, that can be applied
+// with git apply or patch -p1
+
+func git_name(prefix, path string) string {
+	return prefix + strings.TrimPrefix(filepath.ToSlash(path_name_map[path]), "/")
+}
+
+func git_file_mode(path string) string {
+	if s, err := os.Stat(path); err == nil && s.Mode().Perm()&0o111 != 0 {
+		return "100755"
+	}
+	return "100644"
+}
+
+// All lines of the file as a single hunk of added or removed lines
+func whole_file_diff_lines(path string, added bool, ans []string) ([]string, error) {
+	lines, err := raw_text_lines(path)
+	if err != nil || len(lines) == 0 {
+		return ans, err
+	}
+	prefix, header := "-", fmt.Sprintf("@@ -1,%d +0,0 @@", len(lines))
+	if added {
+		prefix, header = "+", fmt.Sprintf("@@ -0,0 +1,%d @@", len(lines))
+	}
+	ans = append(ans, header)
+	for _, line := range lines {
+		ans = append(ans, prefix+line)
+	}
+	if missing_final_newline(path) {
+		ans = append(ans, `\ No newline at end of file`)
+	}
+	return ans, nil
+}
+
+// The patch for all files in the collection, using the already computed
+// diffs, so that the current context and whitespace settings are respected.
+// Returns the patch and the number of files in it.
+func patch_for_collection(collection *Collection, diff_map map[string]*Patch) (string, int, error) {
+	ans := make([]string, 0, 1024)
+	num_files := 0
+	err := collection.Apply(func(path, item_type, changed_path string) (err error) {
+		before := len(ans)
+		switch item_type {
+		case `add`:
+			a, b := git_name("a/", path), git_name("b/", path)
+			ans = append(ans, fmt.Sprintf("diff --git %s %s", a, b), "new file mode "+git_file_mode(path))
+			if is_path_text(path) {
+				ans = append(ans, "--- /dev/null", "+++ "+b)
+				ans, err = whole_file_diff_lines(path, true, ans)
+			} else {
+				ans = append(ans, fmt.Sprintf("Binary files /dev/null and %s differ", b))
+			}
+		case `removal`:
+			a, b := git_name("a/", path), git_name("b/", path)
+			ans = append(ans, fmt.Sprintf("diff --git %s %s", a, b), "deleted file mode "+git_file_mode(path))
+			if is_path_text(path) {
+				ans = append(ans, "--- "+a, "+++ /dev/null")
+				ans, err = whole_file_diff_lines(path, false, ans)
+			} else {
+				ans = append(ans, fmt.Sprintf("Binary files %s and /dev/null differ", a))
+			}
+		case `rename`:
+			ans = append(ans, fmt.Sprintf("diff --git %s %s", git_name("a/", path), git_name("b/", changed_path)),
+				"similarity index 100%", "rename from "+path_name_map[path], "rename to "+path_name_map[changed_path])
+		case `diff`:
+			a, b := git_name("a/", path), git_name("b/", changed_path)
+			ans = append(ans, fmt.Sprintf("diff --git %s %s", a, b))
+			if s, found := collection.similar[path]; found {
+				verb := "rename"
+				if s.copied {
+					verb = "copy"
+				}
+				ans = append(ans, fmt.Sprintf("similarity index %d%%", s.score),
+					verb+" from "+path_name_map[path], verb+" to "+path_name_map[changed_path])
+			}
+			if lm, rm := git_file_mode(path), git_file_mode(changed_path); lm != rm {
+				ans = append(ans, "old mode "+lm, "new mode "+rm)
+			}
+			if !is_path_text(path) || !is_path_text(changed_path) {
+				ans = append(ans, fmt.Sprintf("Binary files %s and %s differ", a, b))
+				break
+			}
+			patch := diff_map[path]
+			if patch == nil || patch.Len() == 0 {
+				break
+			}
+			left_lines, err := raw_text_lines(path)
+			if err != nil {
+				return err
+			}
+			right_lines, err := raw_text_lines(changed_path)
+			if err != nil {
+				return err
+			}
+			ans = append(ans, "--- "+a, "+++ "+b)
+			for _, hunk := range patch.all_hunks {
+				ans = hunk_diff_lines(path, changed_path, left_lines, right_lines, hunk, ans)
+			}
+		}
+		if len(ans) == before+1 {
+			// only the diff --git line, nothing changed
+			ans = ans[:before]
+		} else {
+			num_files++
+		}
+		return
+	})
+	if err != nil || len(ans) == 0 {
+		return "", num_files, err
+	}
+	return strings.Join(ans, "\n") + "\n", num_files, nil
+}
+
+func (self *Handler) start_export() {
+	if self.inputting_command || self.merge != nil || !self.has_content() {
+		self.lp.Beep()
+		return
+	}
+	self.inputting_command = true
+	self.input_type = EXPORT_INPUT
+	self.rl.SetPrompt("Save patch to: ")
+	self.rl.SetText(``)
+	self.draw_status_line()
+}
+
+// Write the patch for the diff to the specified file
+func (self *Handler) export_patch(path string) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return
+	}
+	if self.num_diffs_pending > 0 {
+		self.statusline_message = "Cannot export the patch until all diffs have been computed"
+		self.lp.Beep()
+		return
+	}
+	text, num_files, err := patch_for_collection(self.collection, self.diff_map)
+	if err == nil && num_files == 0 {
+		err = fmt.Errorf("there are no changes")
+	}
+	if err == nil {
+		path = utils.Expanduser(path)
+		err = os.WriteFile(path, utils.UnsafeStringToBytes(text), 0o644)
+	}
+	if err != nil {
+		self.statusline_message = fmt.Sprintf("Failed to export the patch: %s", err)
+		self.lp.Beep()
+		return
+	}
+	self.statusline_message = fmt.Sprintf("Wrote the patch for %d files to: %s", num_files, path)
+	if num_files == 1 {
+		self.statusline_message = fmt.Sprintf("Wrote the patch for 1 file to: %s", path)
+	}
+}
@@ -0,0 +1,129 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestDiffExportPatch(t *testing.T) {
+	conf = NewConfig()
+	init_caches()
+	diff_cmd = []string{}
+	tdir := t.TempDir()
+	write := func(path, data string) {
+		path = filepath.Join(tdir, path)
+		_ = os.MkdirAll(filepath.Dir(path), 0o700)
+		_ = os.WriteFile(path, []byte(data), 0o644)
+	}
+	write("left/a", "1\n2\n3\n4\n5\n6\n7\n8\n")
+	write("left/b", "removed\n")
+	write("left/same", "same\n")
+	write("right/a", "1\n2\nthree\n4\n5\n6\n7\n8")
+	write("right/c", "added\nno newline")
+	write("right/same", "same\n")
+	left, right := filepath.Join(tdir, "left"), filepath.Join(tdir, "right")
+	collection, err := create_collection(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff_map, err := diff([]diff_job{{filepath.Join(left, "a"), filepath.Join(right, "a")}}, 1, ignore_whitespace{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, num_files, err := patch_for_collection(collection, diff_map)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `diff --git a/a b/a
+--- a/a
++++ b/a
+@@ -2,3 +2,3 @@
+ 2
+-3
++three
+ 4
+@@ -7,2 +7,2 @@
+ 7
+-8
++8
+\ No newline at end of file
+diff --git a/b b/b
+deleted file mode 100644
+--- a/b
++++ /dev/null
+@@ -1,1 +0,0 @@
+-removed
+diff --git a/c b/c
+new file mode 100644
+--- /dev/null
++++ b/c
+@@ -0,0 +1,2 @@
++added
++no newline
+\ No newline at end of file
+`
+	if num_files != 3 {
+		t.Fatalf("Incorrect number of files in patch: %d", num_files)
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Fatalf("Incorrect patch:\n%s", diff)
+	}
+}
+
+func TestDiffExportPatchCRLF(t *testing.T) {
+	git, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not available")
+	}
+	conf = NewConfig()
+	init_caches()
+	diff_cmd = []string{}
+	tdir := t.TempDir()
+	write := func(path, data string) {
+		path = filepath.Join(tdir, path)
+		_ = os.MkdirAll(filepath.Dir(path), 0o700)
+		_ = os.WriteFile(path, []byte(data), 0o644)
+	}
+	left_data, right_data := "1\r\n2\r\n3\r\n4\r\n", "1\r\ntwo\r\n3\r\n4\r\n5"
+	write("left/a", left_data)
+	write("right/a", right_data)
+	write("right/b", "added\r\n")
+	write("work/a", left_data)
+	left, right := filepath.Join(tdir, "left"), filepath.Join(tdir, "right")
+	collection, err := create_collection(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff_map, err := diff([]diff_job{{filepath.Join(left, "a"), filepath.Join(right, "a")}}, 1, ignore_whitespace{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, _, err := patch_for_collection(collection, diff_map)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("patch", patch)
+	cmd := exec.Command(git, "apply", "--whitespace=nowarn", filepath.Join(tdir, "patch"))
+	cmd.Dir = filepath.Join(tdir, "work")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Applying the patch failed with error: %s\n%s\n%q", err, output, patch)
+	}
+	for name, expected := range map[string]string{"a": right_data, "b": "added\r\n"} {
+		actual, err := os.ReadFile(filepath.Join(tdir, "work", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(expected, string(actual)); diff != "" {
+			t.Fatalf("Incorrect contents of %s after applying the patch:\n%s", name, diff)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Folding of the unchanged regions before, between and after the hunks of a
+// diff. The lines of a region are hidden behind a marker showing how many
+// lines are hidden, which can be expanded to reveal lines above or below it.
+
+type unchanged_region struct {
+	left_path               string
+	left_start, right_start int // the indices of the first lines of the region
+	count                   int
+}
+
+// The number of lines revealed at the top and bottom of an unchanged region
+type fold_expansion struct{ above, below int }
+
+// The unchanged regions of the diff, one before each hunk and a final one
+// after the last hunk. Regions can be empty.
+func unchanged_regions(data *DiffData, patch *Patch) []unchanged_region {
+	ans := make([]unchanged_region, 0, patch.Len()+1)
+	left, right := 0, 0
+	for _, h := range patch.all_hunks {
+		ls, rs := h.left_start, h.right_start
+		// for hunks that only add or remove lines, the start is the line
+		// before the hunk
+		if h.left_count == 0 {
+			ls++
+		}
+		if h.right_count == 0 {
+			rs++
+		}
+		ans = append(ans, unchanged_region{left_path: data.left_path, left_start: left, right_start: right, count: utils.Max(0, ls-left)})
+		left, right = ls+h.left_count, rs+h.right_count
+	}
+	count := utils.Max(0, utils.Min(len(data.left_lines)-left, len(data.right_lines)-right))
+	return append(ans, unchanged_region{left_path: data.left_path, left_start: left, right_start: right, count: count})
+}
+
+// The lines for an unchanged region: the lines revealed at its top, a marker
+// for the hidden lines and the lines revealed at its bottom
+func fold_lines(data *DiffData, region unchanged_region, expansion fold_expansion, unified bool, width int, ans []*LogicalLine) []*LogicalLine {
+	if region.count == 0 {
+		return ans
+	}
+	above := utils.Min(expansion.above, region.count)
+	below := utils.Min(expansion.below, region.count-above)
+	hidden := region.count - above - below
+	show := func(offset, count int) {
+		if count > 0 {
+			c := Chunk{is_context: true, left_start: region.left_start + offset, right_start: region.right_start + offset, left_count: count, right_count: count}
+			if unified {
+				ans = unified_lines_for_context_chunk(data, &c, ans)
+			} else {
+				ans = lines_for_context_chunk(data, 0, &c, 0, ans)
+			}
+		}
+	}
+	show(0, above)
+	if hidden > 0 {
+		ll := LogicalLine{
+			line_type: FOLD_LINE, is_full_width: true, fold: region,
+			left_reference:  Reference{path: data.left_path, linenum: region.left_start + above + 1},
+			right_reference: Reference{path: data.right_path, linenum: region.right_start + above + 1},
+		}
+		text := fmt.Sprintf("⋯ %d unchanged lines", hidden)
+		if hidden == 1 {
+			text = "⋯ 1 unchanged line"
+		}
+		for _, line := range splitlines(text, width) {
+			sl := ScreenLine{}
+			sl.left.marked_up_text = line
+			ll.screen_lines = append(ll.screen_lines, &sl)
+		}
+		ans = append(ans, &ll)
+	}
+	show(region.count-below, below)
+	return ans
+}
+
+// Expand the first fold visible on screen
+func (self *Handler) expand_fold(which string) error {
+	if self.merge != nil || self.logical_lines == nil {
+		self.lp.Beep()
+		return nil
+	}
+	bottom := self.scroll_pos
+	self.logical_lines.IncrementScrollPosBy(&bottom, self.screen_size.num_lines-1)
+	var region *unchanged_region
+	for i := self.scroll_pos.logical_line; i <= bottom.logical_line && i < self.logical_lines.Len(); i++ {
+		if ll := self.logical_lines.At(i); ll.line_type == FOLD_LINE {
+			region = &ll.fold
+			break
+		}
+	}
+	if region == nil {
+		self.lp.Beep()
+		return nil
+	}
+	e := self.folds[*region]
+	amt := int(conf.Fold_expand_lines)
+	switch which {
+	case `above`:
+		e.above += amt
+	case `below`:
+		e.below += amt
+	case `all`:
+		e.above = region.count
+	default:
+		return fmt.Errorf("Unknown direction to expand the fold in: %#v", which)
+	}
+	self.folds[*region] = e
+	return self.relayout()
+}
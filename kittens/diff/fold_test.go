@@ -0,0 +1,90 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kitty/tools/tui/graphics"
+)
+
+var _ = fmt.Print
+
+func TestDiffFolding(t *testing.T) {
+	conf = NewConfig()
+	init_caches()
+	create_formatters()
+	diff_cmd = []string{}
+	tdir := t.TempDir()
+	left, right := filepath.Join(tdir, "left"), filepath.Join(tdir, "right")
+	lines := make([]string, 30)
+	for i := range lines {
+		lines[i] = fmt.Sprint(i + 1)
+	}
+	_ = os.WriteFile(left, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+	// change line 15 and insert a line after line 25
+	_ = os.WriteFile(right, []byte(strings.Join(lines[:14], "\n")+"\nX\n"+strings.Join(lines[15:25], "\n")+"\nY\n"+strings.Join(lines[25:], "\n")+"\n"), 0o600)
+	collection, err := create_collection(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	regions := func(context_count int) string {
+		patch, err := do_diff(left, right, context_count, ignore_whitespace{}, Diff_algorithm_default)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := DiffData{left_path: left, right_path: right}
+		data.left_lines, _ = lines_for_path(left)
+		data.right_lines, _ = lines_for_path(right)
+		ans := []string{}
+		for _, r := range unchanged_regions(&data, patch) {
+			ans = append(ans, fmt.Sprintf("%d:%d:%d", r.left_start, r.right_start, r.count))
+		}
+		return strings.Join(ans, " ")
+	}
+	for context_count, expected := range map[int]string{0: "0:0:14 15:15:10 25:26:5", 3: "0:0:11 18:18:4 28:29:2", 5: "0:0:9 20:20:0 30:31:0"} {
+		if actual := regions(context_count); actual != expected {
+			t.Fatalf("Incorrect unchanged regions with %d lines of context: %s != %s", context_count, expected, actual)
+		}
+	}
+
+	diff_map, err := diff([]diff_job{{left, right}}, 3, ignore_whitespace{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := unchanged_region{left_path: left, count: 11}
+	for _, unified := range []bool{false, true} {
+		render_folds := func(e fold_expansion) (ans []string) {
+			ll, err := render(collection, diff_map, screen_size{rows: 24, columns: 80, num_lines: 23}, 31, graphics.Size{}, unified, image_comparison{}, map[unchanged_region]fold_expansion{first: e}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range ll.lines {
+				switch l.line_type {
+				case FOLD_LINE:
+					ans = append(ans, fmt.Sprintf("%s@%d", strings.TrimSpace(l.screen_lines[0].left.marked_up_text), l.left_reference.linenum))
+				case CONTEXT_LINE:
+					ans = append(ans, fmt.Sprint(l.left_reference.linenum))
+				case HUNK_TITLE_LINE:
+					ans = append(ans, "@@")
+				}
+			}
+			return ans[:5]
+		}
+		for e, expected := range map[fold_expansion]string{
+			{}:                    "⋯ 11 unchanged lines@1 @@ 12 13 14",
+			{above: 2}:            "1 2 ⋯ 9 unchanged lines@3 @@ 12",
+			{above: 1, below: 2}:  "1 ⋯ 8 unchanged lines@2 10 11 @@",
+			{above: 3, below: 20}: "1 2 3 4 5",
+		} {
+			if actual := strings.Join(render_folds(e), " "); actual != expected {
+				t.Fatalf("Incorrect folding with %v and unified=%v: %#v != %#v", e, unified, expected, actual)
+			}
+		}
+	}
+}
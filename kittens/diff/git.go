@@ -0,0 +1,236 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var _ = fmt.Print
+
+// Diffing of git revisions, with the file contents read directly from the
+// git object database
+
+const NULL_SHA = "0000000000000000000000000000000000000000"
+
+type GitDiff struct {
+	revision_range string
+	staged         bool
+	paths          []string
+}
+
+type git_change struct {
+	old_mode, new_mode string
+	old_sha, new_sha   string
+	status             byte
+	score              int
+	old_path, new_path string
+}
+
+// Whether x is a git revision range such as HEAD~3..HEAD rather than a path
+func is_revision_range(x string) bool {
+	return strings.Contains(x, "..") && !exists(x)
+}
+
+func new_git_diff(staged bool, args []string) *GitDiff {
+	ans := GitDiff{staged: staged}
+	if len(args) > 0 && is_revision_range(args[0]) {
+		ans.revision_range = args[0]
+		args = args[1:]
+	}
+	ans.paths = args
+	return &ans
+}
+
+func (self *GitDiff) String() string {
+	ans := self.revision_range
+	if self.staged {
+		ans = strings.TrimSpace("--staged " + ans)
+	}
+	return ans
+}
+
+func run_git(stdin io.Reader, args ...string) ([]byte, error) {
+	c := exec.Command(GitExe(), args...)
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+	c.Stdin, c.Stdout, c.Stderr = stdin, &stdout, &stderr
+	if err := c.Run(); err != nil {
+		return nil, fmt.Errorf("Running git %s failed with error: %w and output:\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// Parse the output of git diff --raw -z
+func parse_raw_diff(raw []byte) (ans []git_change, err error) {
+	fields := strings.Split(strings.TrimSuffix(string(raw), "\x00"), "\x00")
+	for i := 0; i < len(fields); i++ {
+		meta := fields[i]
+		if meta == "" {
+			continue
+		}
+		parts := strings.Fields(strings.TrimPrefix(meta, ":"))
+		if !strings.HasPrefix(meta, ":") || len(parts) != 5 || len(parts[4]) == 0 {
+			return nil, fmt.Errorf("Unrecognized line in the output of git diff: %#v", meta)
+		}
+		c := git_change{old_mode: parts[0], new_mode: parts[1], old_sha: parts[2], new_sha: parts[3], status: parts[4][0]}
+		if len(parts[4]) > 1 {
+			c.score, _ = strconv.Atoi(parts[4][1:])
+		}
+		num_paths := 1
+		if c.status == 'R' || c.status == 'C' {
+			num_paths = 2
+		}
+		if i+num_paths >= len(fields) {
+			return nil, fmt.Errorf("Truncated output from git diff")
+		}
+		c.old_path, c.new_path = fields[i+1], fields[i+num_paths]
+		i += num_paths
+		ans = append(ans, c)
+	}
+	return
+}
+
+// Read the contents of the specified blobs using a single git cat-file process
+func read_blobs(shas []string) (map[string][]byte, error) {
+	ans := make(map[string][]byte, len(shas))
+	if len(shas) == 0 {
+		return ans, nil
+	}
+	raw, err := run_git(strings.NewReader(strings.Join(shas, "\n")+"\n"), "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(bytes.NewReader(raw))
+	for range shas {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("Truncated output from git cat-file: %w", err)
+		}
+		parts := strings.Fields(header)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("Failed to read the git object: %s", strings.TrimSpace(header))
+		}
+		size, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid header in the output of git cat-file: %#v", header)
+		}
+		data := make([]byte, size+1) // the contents are followed by a newline
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("Truncated output from git cat-file: %w", err)
+		}
+		ans[parts[0]] = data[:size]
+	}
+	return ans, nil
+}
+
+func (self *GitDiff) changes() (toplevel string, ans []git_change, err error) {
+	raw, err := run_git(nil, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return
+	}
+	toplevel = strings.TrimSpace(string(raw))
+	args := []string{"diff", "--raw", "-z", "--no-abbrev", "--no-color", "--no-ext-diff", fmt.Sprintf("--find-renames=%d%%", rename_threshold())}
+	if conf.Detect_copies {
+		args = append(args, fmt.Sprintf("--find-copies=%d%%", rename_threshold()))
+	}
+	if self.staged {
+		args = append(args, "--cached")
+	}
+	if self.revision_range != "" {
+		args = append(args, self.revision_range)
+	}
+	args = append(args, "--")
+	args = append(args, self.paths...)
+	if raw, err = run_git(nil, args...); err != nil {
+		return
+	}
+	ans, err = parse_raw_diff(raw)
+	return
+}
+
+// Create a collection from the changes in git, writing the contents of
+// changed files into a temporary directory
+func (self *GitDiff) Collection() (*Collection, error) {
+	toplevel, changes, err := self.changes()
+	if err != nil {
+		return nil, err
+	}
+	tdir, err := os.MkdirTemp("", "kitty-diff-git-*")
+	if err != nil {
+		return nil, err
+	}
+	// ensure the temporary directory is removed on exit
+	remote_dirs[tdir] = ""
+	shas := make([]string, 0, 2*len(changes))
+	for _, c := range changes {
+		for _, x := range []struct{ sha, mode string }{{c.old_sha, c.old_mode}, {c.new_sha, c.new_mode}} {
+			// gitlinks are submodule commits, not blobs
+			if x.sha != NULL_SHA && x.mode != "160000" {
+				shas = append(shas, x.sha)
+			}
+		}
+	}
+	blobs, err := read_blobs(shas)
+	if err != nil {
+		return nil, err
+	}
+	materialize := func(side, sha, mode, path string) (string, error) {
+		if sha == NULL_SHA {
+			// the file in the working tree
+			return filepath.Abs(filepath.Join(toplevel, path))
+		}
+		data := blobs[sha]
+		if mode == "160000" {
+			data = []byte("Subproject commit " + sha + "\n")
+		}
+		dest := filepath.Join(tdir, side, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(dest), 0o700); err != nil {
+			return "", err
+		}
+		return dest, os.WriteFile(dest, data, 0o600)
+	}
+	ans := new_collection()
+	for i, c := range changes {
+		var left, right string
+		if c.status != 'A' {
+			side := "a"
+			if c.status == 'C' {
+				// the source of a copy can also be changed, so it needs its own
+				// path to be a separate entry in the collection
+				side = fmt.Sprintf("copy-%d", i)
+			}
+			if left, err = materialize(side, c.old_sha, c.old_mode, c.old_path); err != nil {
+				return nil, err
+			}
+			path_name_map[left] = c.old_path
+		}
+		if c.status != 'D' {
+			if right, err = materialize("b", c.new_sha, c.new_mode, c.new_path); err != nil {
+				return nil, err
+			}
+			path_name_map[right] = c.new_path
+		}
+		switch {
+		case c.status == 'A':
+			ans.add_add(right)
+		case c.status == 'D':
+			ans.add_removal(left)
+		case c.status == 'R' && c.score == 100:
+			ans.add_rename(left, right)
+		case c.status == 'R' || c.status == 'C':
+			ans.add_similar(left, right, similar_file{copied: c.status == 'C', score: c.score})
+		default:
+			ans.add_change(left, right)
+		}
+	}
+	ans.finalize()
+	return ans, nil
+}
@@ -0,0 +1,49 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestDiffParseGitRaw(t *testing.T) {
+	a, b := strings.Repeat("a", 40), strings.Repeat("b", 40)
+	raw := strings.Join([]string{
+		":100644 100644 " + a + " " + b + " M", "m.txt",
+		":000000 100644 " + NULL_SHA + " " + b + " A", "new file.txt",
+		":100644 000000 " + a + " " + NULL_SHA + " D", "gone.txt",
+		":100644 100644 " + a + " " + a + " R100", "old.txt", "dir/renamed.txt",
+		":100644 100644 " + a + " " + b + " R087", "x.txt", "y.txt",
+	}, "\x00") + "\x00"
+	changes, err := parse_raw_diff([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []git_change{
+		{"100644", "100644", a, b, 'M', 0, "m.txt", "m.txt"},
+		{"000000", "100644", NULL_SHA, b, 'A', 0, "new file.txt", "new file.txt"},
+		{"100644", "000000", a, NULL_SHA, 'D', 0, "gone.txt", "gone.txt"},
+		{"100644", "100644", a, a, 'R', 100, "old.txt", "dir/renamed.txt"},
+		{"100644", "100644", a, b, 'R', 87, "x.txt", "y.txt"},
+	}
+	if diff := cmp.Diff(expected, changes, cmp.AllowUnexported(git_change{})); diff != "" {
+		t.Fatalf("Failed to parse git diff --raw output:\n%s", diff)
+	}
+	if _, err = parse_raw_diff([]byte(":100644 100644 " + a + " " + b + " R100\x00old.txt\x00")); err == nil {
+		t.Fatalf("No error for truncated git diff --raw output")
+	}
+	for _, x := range []string{"HEAD~3..HEAD", "main...topic"} {
+		if !is_revision_range(x) {
+			t.Fatalf("%#v not recognized as a revision range", x)
+		}
+	}
+	if is_revision_range("..") || is_revision_range("a.txt") {
+		t.Fatalf("Path recognized as a revision range")
+	}
+}
@@ -0,0 +1,97 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+var _ = fmt.Print
+
+type gitignore_rule struct {
+	// the directory containing the .gitignore file, relative to the root
+	// being walked, empty for the root itself
+	dir                            string
+	pattern                        string
+	is_negated, dir_only, anchored bool
+}
+
+func parse_gitignore(dir, text string) (ans []gitignore_rule) {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		// trailing spaces are ignored unless escaped
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+			line = line[:len(line)-1]
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := gitignore_rule{dir: dir}
+		if strings.HasPrefix(line, "!") {
+			r.is_negated = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dir_only = true
+			line = strings.TrimRight(line, "/")
+		}
+		// a slash anywhere other than at the end anchors the pattern to the
+		// directory containing the .gitignore file
+		if strings.Contains(line, "/") {
+			r.anchored = true
+			line = strings.TrimLeft(line, "/")
+		}
+		if line != "" {
+			r.pattern = line
+			ans = append(ans, r)
+		}
+	}
+	return
+}
+
+func (self gitignore_rule) matches(rel_path string, is_dir bool) bool {
+	if self.dir_only && !is_dir {
+		return false
+	}
+	if self.dir != "" {
+		if !strings.HasPrefix(rel_path, self.dir+"/") {
+			return false
+		}
+		rel_path = rel_path[len(self.dir)+1:]
+	}
+	if !self.anchored {
+		rel_path = path.Base(rel_path)
+	}
+	matched, err := doublestar.Match(self.pattern, rel_path)
+	return err == nil && matched
+}
+
+type gitignore struct {
+	rules []gitignore_rule
+}
+
+// Add the rules from the .gitignore file, if any, in the specified directory
+func (self *gitignore) load(abspath, rel_dir string) {
+	if raw, err := os.ReadFile(filepath.Join(abspath, ".gitignore")); err == nil {
+		self.rules = append(self.rules, parse_gitignore(rel_dir, string(raw))...)
+	}
+}
+
+// Whether the path relative to the root is ignored, later rules override
+// earlier ones and rules from deeper directories are loaded later
+func (self *gitignore) is_ignored(rel_path string, is_dir bool) (ans bool) {
+	for _, r := range self.rules {
+		if r.matches(rel_path, is_dir) {
+			ans = !r.is_negated
+		}
+	}
+	return
+}
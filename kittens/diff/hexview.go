@@ -0,0 +1,143 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"strings"
+
+	"kitty/tools/tui/sgr"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Side-by-side hex dumps of the parts of binary files that differ, with the
+// rows aligned by offset. The text of the rows is rendered only when they are
+// displayed, as there can be very many of them for large files.
+
+const HEX_CONTEXT_ROWS = 2
+
+// The number of bytes per row that fit in the specified width. Each row is the
+// offset, followed by three cells per byte for the hex and one cell per byte
+// for the text.
+func bytes_per_hex_row(available_cols int) int {
+	n := (available_cols - 11) / 4
+	if n >= 8 {
+		n -= n % 8
+	}
+	return utils.Max(1, n)
+}
+
+func hex_byte_differs(data, other string, i int) bool {
+	return i >= len(other) || data[i] != other[i]
+}
+
+// The text of the row of n bytes at the specified offset, with the bytes that
+// differ from other highlighted
+func hex_row(data, other string, offset, n int, ltype string) string {
+	buf := strings.Builder{}
+	text := strings.Builder{}
+	fmt.Fprintf(&buf, "%08x  ", offset)
+	spans := make([]*sgr.Span, 0, 8)
+	text_start := 10 + 3*n + 1
+	for i := 0; i < n; i++ {
+		pos := offset + i
+		if pos >= len(data) {
+			buf.WriteString("   ")
+			continue
+		}
+		b := data[pos]
+		fmt.Fprintf(&buf, "%02x ", b)
+		if b >= 0x20 && b < 0x7f {
+			text.WriteByte(b)
+		} else {
+			text.WriteByte('.')
+		}
+		if hex_byte_differs(data, other, pos) {
+			spans = append(spans, center_span(ltype, 10+3*i, 2), center_span(ltype, text_start+i, 1))
+		}
+	}
+	buf.WriteString(" ")
+	buf.WriteString(text.String())
+	return sgr.InsertFormatting(buf.String(), spans...)
+}
+
+func hex_row_differs(left, right string, offset, n int) bool {
+	end := offset + n
+	l, r := left[utils.Min(offset, len(left)):utils.Min(end, len(left))], right[utils.Min(offset, len(right)):utils.Min(end, len(right))]
+	return l != r
+}
+
+type hex_row_range struct{ start, end int }
+
+// The ranges of rows to show, that is rows that differ and the rows around them
+func hex_row_ranges(left, right string, n int) (ans []hex_row_range) {
+	num_rows := (utils.Max(len(left), len(right)) + n - 1) / n
+	for row := 0; row < num_rows; row++ {
+		if !hex_row_differs(left, right, row*n, n) {
+			continue
+		}
+		start, end := utils.Max(0, row-HEX_CONTEXT_ROWS), utils.Min(num_rows, row+HEX_CONTEXT_ROWS+1)
+		if len(ans) > 0 && start <= ans[len(ans)-1].end {
+			ans[len(ans)-1].end = end
+		} else {
+			ans = append(ans, hex_row_range{start, end})
+		}
+	}
+	return
+}
+
+func hex_lines(left_path, right_path string, columns, margin_size int, ans []*LogicalLine) ([]*LogicalLine, error) {
+	left, err := data_for_path(left_path)
+	if err != nil {
+		return nil, err
+	}
+	right, err := data_for_path(right_path)
+	if err != nil {
+		return nil, err
+	}
+	available_cols := columns/2 - margin_size
+	n := bytes_per_hex_row(available_cols)
+	refs := func(ll *LogicalLine) *LogicalLine {
+		ll.left_reference, ll.right_reference = Reference{path: left_path}, Reference{path: right_path}
+		return ll
+	}
+	title_line := func(text string) *LogicalLine {
+		ll := refs(&LogicalLine{line_type: HUNK_TITLE_LINE, is_full_width: true})
+		for _, line := range splitlines(text, columns-margin_size) {
+			sl := ScreenLine{}
+			sl.left.marked_up_text = line
+			ll.screen_lines = append(ll.screen_lines, &sl)
+		}
+		return ll
+	}
+	for _, r := range hex_row_ranges(left, right, n) {
+		last := utils.Min(r.end*n, utils.Max(len(left), len(right))) - 1
+		ans = append(ans, title_line(fmt.Sprintf("@@ 0x%08x-0x%08x @@", r.start*n, last)))
+		is_change_start := true
+		for row := r.start; row < r.end; row++ {
+			offset := row * n
+			ll := refs(&LogicalLine{line_type: CONTEXT_LINE})
+			if hex_row_differs(left, right, offset, n) {
+				ll.line_type = CHANGE_LINE
+				ll.is_change_start, is_change_start = is_change_start, false
+			} else {
+				is_change_start = true
+			}
+			sl := &ScreenLine{}
+			sl.left.is_filler, sl.right.is_filler = offset >= len(left), offset >= len(right)
+			ll.render_lazily = func() {
+				if !sl.left.is_filler {
+					sl.left.marked_up_text = hex_row(left, right, offset, n, "remove")
+				}
+				if !sl.right.is_filler {
+					sl.right.marked_up_text = hex_row(right, left, offset, n, "add")
+				}
+			}
+			ll.screen_lines = append(ll.screen_lines, sl)
+			ans = append(ans, ll)
+		}
+	}
+	return ans, nil
+}
@@ -0,0 +1,61 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kitty/tools/wcswidth"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestDiffHexView(t *testing.T) {
+	conf = NewConfig()
+	for cols, expected := range map[int]int{10: 1, 27: 4, 43: 8, 80: 16} {
+		if actual := bytes_per_hex_row(cols); actual != expected {
+			t.Fatalf("Incorrect bytes per row for %d columns: %d != %d", cols, expected, actual)
+		}
+	}
+	if diff := cmp.Diff("00000004  41 0a        A.", wcswidth.StripEscapeCodes(hex_row("abcdA\n", "abcd", 4, 4, "add"))); diff != "" {
+		t.Fatalf("Incorrect hex row:\n%s", diff)
+	}
+	left := strings.Repeat("x", 100)
+	right := left[:20] + "y" + left[21:90] + "z" + left[91:] + "extra"
+	if actual := fmt.Sprint(hex_row_ranges(left, right, 4)); actual != "[{3 8} {20 27}]" {
+		t.Fatalf("Incorrect row ranges: %s", actual)
+	}
+
+	// all rows of large files are shown, rendered only when needed
+	tdir := t.TempDir()
+	lpath, rpath := filepath.Join(tdir, "left"), filepath.Join(tdir, "right")
+	if err := os.WriteFile(lpath, bytes.Repeat([]byte{0}, 100000), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(rpath, bytes.Repeat([]byte{1}, 100000), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := hex_lines(lpath, rpath, 96, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a title line followed by a row for every 8 bytes
+	if len(lines) != 1+100000/8 {
+		t.Fatalf("Incorrect number of hex lines: %d", len(lines))
+	}
+	last := lines[len(lines)-1]
+	if last.render_lazily == nil || last.screen_lines[0].left.marked_up_text != "" {
+		t.Fatalf("Hex row rendered before it is needed")
+	}
+	last.ensure_rendered()
+	if diff := cmp.Diff("00018698  00 00 00 00 00 00 00 00  ........", wcswidth.StripEscapeCodes(last.screen_lines[0].left.marked_up_text)); diff != "" {
+		t.Fatalf("Incorrect lazily rendered hex row:\n%s", diff)
+	}
+}
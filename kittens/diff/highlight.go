@@ -7,12 +7,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
 
 	"kitty/tools/utils"
 	"kitty/tools/utils/images"
+	"kitty/tools/utils/shlex"
 
 	"github.com/alecthomas/chroma/v2"
 	"github.com/alecthomas/chroma/v2/lexers"
@@ -158,6 +160,42 @@ func ansi_formatter(w io.Writer, style *chroma.Style, it chroma.Iterator) (err e
 	return nil
 }
 
+// The external command configured to highlight files with the specified
+// extension, later definitions override earlier ones
+func external_highlighter(ext string) (ans []string) {
+	for _, x := range conf.External_highlighter {
+		q, cmd, found := strings.Cut(strings.TrimSpace(x), " ")
+		if found && strings.ToLower(q) == ext {
+			if c, err := shlex.Split(cmd); err == nil && len(c) > 0 {
+				ans = c
+			}
+		}
+	}
+	return
+}
+
+func run_external_highlighter(cmd []string, path, text string) (string, error) {
+	args := make([]string, len(cmd)-1)
+	for i, x := range cmd[1:] {
+		args[i] = strings.ReplaceAll(x, "_PATH_", path)
+	}
+	c := exec.Command(utils.FindExe(cmd[0]), args...)
+	c.Stdin = strings.NewReader(text)
+	output, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("Running the highlighter %s for %#v failed with error: %w", cmd[0], path, err)
+	}
+	ans := utils.UnsafeBytesToString(output)
+	// highlighted lines are matched to the lines of the file by index, so a
+	// highlighter that adds or removes lines would misalign all of them
+	if a, b := len(text_to_lines(ans)), len(text_to_lines(text)); a != b {
+		return "", fmt.Errorf("The highlighter %s for %#v output %d lines instead of %d", cmd[0], path, a, b)
+	}
+	return ans, nil
+}
+
+// Highlight using the builtin chroma based highlighter, falling back to, or
+// overridden by, any configured external highlighter
 func highlight_file(path string) (highlighted string, err error) {
 	filename_for_detection := filepath.Base(path)
 	ext := filepath.Ext(filename_for_detection)
@@ -172,6 +210,11 @@ func highlight_file(path string) (highlighted string, err error) {
 	if err != nil {
 		return "", err
 	}
+	if cmd := external_highlighter(ext); ext != "" && cmd != nil {
+		if ans, herr := run_external_highlighter(cmd, path, text); herr == nil {
+			return ans, nil
+		}
+	}
 	lexer := lexers.Match(filename_for_detection)
 	if lexer == nil {
 		if err == nil {
@@ -179,6 +222,9 @@ func highlight_file(path string) (highlighted string, err error) {
 		}
 	}
 	if lexer == nil {
+		if cmd := external_highlighter("*"); cmd != nil {
+			return run_external_highlighter(cmd, path, text)
+		}
 		return "", fmt.Errorf("Cannot highlight %#v: %w", path, ErrNoLexer)
 	}
 	lexer = chroma.Coalesce(lexer)
@@ -0,0 +1,52 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestDiffExternalHighlighter(t *testing.T) {
+	tdir := t.TempDir()
+	src := filepath.Join(tdir, "src.go")
+	_ = os.WriteFile(src, []byte("package main\n\nfunc main() {}\n"), 0o600)
+	stub := func(name, script string) string {
+		ans := filepath.Join(tdir, name)
+		if err := os.WriteFile(ans, []byte("#!/bin/sh\n"+script+"\n"), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		return ans
+	}
+	good := stub("good", `while IFS= read -r l; do printf '\033[31m%s\033[m\n' "$l"; done`)
+	bad := stub("bad", `cat; echo extra`)
+	failing := stub("failing", `exit 1`)
+
+	highlight := func(cmd string) string {
+		conf = NewConfig()
+		init_caches()
+		if cmd != "" {
+			conf.External_highlighter = []string{"go " + cmd}
+		}
+		ans, err := highlight_file(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ans
+	}
+	builtin := highlight("")
+	if diff := cmp.Diff("\x1b[31mpackage main\x1b[m\n\x1b[31m\x1b[m\n\x1b[31mfunc main() {}\x1b[m\n", highlight(good)); diff != "" {
+		t.Fatalf("Incorrect output from external highlighter:\n%s", diff)
+	}
+	for _, cmd := range []string{bad, failing} {
+		if actual := highlight(cmd); actual != builtin {
+			t.Fatalf("The builtin highlighter was not used when %s failed, got: %#v", filepath.Base(cmd), actual)
+		}
+	}
+}
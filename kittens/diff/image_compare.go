@@ -0,0 +1,242 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+
+	"kitty/tools/tui/graphics"
+	"kitty/tools/utils"
+	"kitty/tools/utils/images"
+
+	"github.com/kovidgoyal/imaging"
+)
+
+var _ = fmt.Print
+
+// Comparison of changed images by combining them into a single image
+
+type image_comparison struct {
+	mode           Image_compare_mode_Choice_Type
+	swipe_position int // percentage of the width taken by the left image
+}
+
+var all_image_compare_modes = []Image_compare_mode_Choice_Type{
+	Image_compare_mode_split, Image_compare_mode_onion, Image_compare_mode_swipe, Image_compare_mode_difference}
+
+// The key in image_collection for the combined image
+func (self image_comparison) key(left_path, right_path string) string {
+	return fmt.Sprintf("%s:%d\x00%s\x00%s", self.mode, self.swipe_position, left_path, right_path)
+}
+
+func (self image_comparison) is_active(left_path, right_path string) bool {
+	return self.mode != Image_compare_mode_split && left_path != "" && right_path != "" && is_image(left_path) && is_image(right_path)
+}
+
+// Notes describing each combined image, written by the goroutine creating the
+// images and read when rendering. Only the most recently created combined image
+// for each pair of images is kept, as a new one is created every time the
+// mode or swipe position changes.
+var image_comparison_notes = struct {
+	sync.Mutex
+	notes        map[string]image_comparison_note
+	key_for_pair map[[2]string]string
+}{notes: make(map[string]image_comparison_note), key_for_pair: make(map[[2]string]string)}
+
+type image_comparison_note struct {
+	text   string
+	failed bool
+}
+
+func image_comparison_note_for(key string) (image_comparison_note, bool) {
+	image_comparison_notes.Lock()
+	defer image_comparison_notes.Unlock()
+	ans, found := image_comparison_notes.notes[key]
+	return ans, found
+}
+
+// Set the note for the combined image of the specified pair, returning the key
+// of the previous combined image for the pair, which is no longer needed
+func set_image_comparison_note(left_path, right_path, key, text string, failed bool) (prev_key string) {
+	image_comparison_notes.Lock()
+	defer image_comparison_notes.Unlock()
+	pair := [2]string{left_path, right_path}
+	if prev_key = image_comparison_notes.key_for_pair[pair]; prev_key == key {
+		prev_key = ""
+	} else if prev_key != "" {
+		delete(image_comparison_notes.notes, prev_key)
+	}
+	image_comparison_notes.key_for_pair[pair] = key
+	image_comparison_notes.notes[key] = image_comparison_note{text, failed}
+	return
+}
+
+// The first frame of the image drawn onto a canvas of the full image size
+func flatten_image(img *images.ImageData) *image.NRGBA {
+	ans := image.NewNRGBA(image.Rect(0, 0, img.Width, img.Height))
+	if len(img.Frames) > 0 {
+		f := img.Frames[0]
+		draw.Draw(ans, image.Rect(f.Left, f.Top, f.Left+f.Width, f.Top+f.Height), f.Img, f.Img.Bounds().Min, draw.Src)
+	}
+	return ans
+}
+
+func abs_diff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// Combine the two images, which must be the same size. Returns the number of
+// pixels that differ.
+func combine_images(left, right *image.NRGBA, cmp image_comparison) (ans *image.NRGBA, num_different int) {
+	b := left.Bounds()
+	ans = image.NewNRGBA(b)
+	split := b.Dx() * cmp.swipe_position / 100
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			l, r := left.NRGBAAt(x, y), right.NRGBAAt(x, y)
+			if l != r {
+				num_different++
+			}
+			var c color.NRGBA
+			switch cmp.mode {
+			case Image_compare_mode_onion:
+				c = color.NRGBA{
+					uint8((int(l.R) + int(r.R)) / 2), uint8((int(l.G) + int(r.G)) / 2),
+					uint8((int(l.B) + int(r.B)) / 2), uint8((int(l.A) + int(r.A)) / 2)}
+			case Image_compare_mode_swipe:
+				switch {
+				case x == split || x == split-1:
+					c = color.NRGBA{255, 0, 0, 255}
+				case x < split:
+					c = l
+				default:
+					c = r
+				}
+			case Image_compare_mode_difference:
+				delta := utils.Max(abs_diff(l.R, r.R), abs_diff(l.G, r.G), abs_diff(l.B, r.B), abs_diff(l.A, r.A))
+				if delta == 0 {
+					// unchanged pixels are shown as a dimmed grayscale of the original
+					gray := (299*int(l.R) + 587*int(l.G) + 114*int(l.B)) * int(l.A) / (1000 * 255 * 3)
+					c = color.NRGBA{uint8(gray), uint8(gray), uint8(gray), 255}
+				} else {
+					// from yellow for small differences to red for large ones
+					c = color.NRGBA{255, 255 - delta, 0, 255}
+				}
+			}
+			ans.SetNRGBA(x, y, c)
+		}
+	}
+	return
+}
+
+func create_image_comparison(left, right *images.ImageData, cmp image_comparison) (*images.ImageData, string) {
+	l, r := flatten_image(left), flatten_image(right)
+	note := ""
+	if left.Width != right.Width || left.Height != right.Height {
+		r = imaging.Resize(r, left.Width, left.Height, imaging.Lanczos)
+		note = fmt.Sprintf(" The new image was scaled from %dx%d to the size of the old one.", right.Width, right.Height)
+	}
+	combined, num_different := combine_images(l, r, cmp)
+	switch cmp.mode {
+	case Image_compare_mode_onion:
+		note = "Onion skin: the two images blended together." + note
+	case Image_compare_mode_swipe:
+		note = fmt.Sprintf("Swipe: the old image is to the left of the red line and the new image to its right, the line is at %d%%.", cmp.swipe_position) + note
+	case Image_compare_mode_difference:
+		if num_different == 0 {
+			note = "Difference: the images are identical pixel for pixel." + note
+		} else {
+			total := left.Width * left.Height
+			note = fmt.Sprintf("Difference: %d of %d pixels (%.2f%%) differ, brighter colors mean larger differences.", num_different, total, 100*float64(num_different)/float64(total)) + note
+		}
+	}
+	frame := images.ImageFrame{Width: left.Width, Height: left.Height, Number: 1, Img: combined}
+	return &images.ImageData{Width: left.Width, Height: left.Height, Format_uppercase: "PNG", Frames: []*images.ImageFrame{&frame}}, note
+}
+
+// Create the combined images for all changed image pairs in the collection
+// that have not yet been created, in the background
+func (self *Handler) create_image_comparisons() {
+	cmp := self.image_comparison
+	if self.collection == nil || self.image_count == 0 || cmp.mode == Image_compare_mode_split {
+		return
+	}
+	type pair struct{ left, right string }
+	pairs := []pair{}
+	_ = self.collection.Apply(func(path, item_type, changed_path string) error {
+		if item_type == `diff` && cmp.is_active(path, changed_path) {
+			if _, found := image_comparison_note_for(cmp.key(path, changed_path)); !found {
+				pairs = append(pairs, pair{path, changed_path})
+			}
+		}
+		return nil
+	})
+	if len(pairs) == 0 {
+		return
+	}
+	page_size := self.images_resized_to
+	go func() {
+		ctx := images.Context{}
+		ctx.Parallel(0, len(pairs), func(nums <-chan int) {
+			for i := range nums {
+				p := pairs[i]
+				key := cmp.key(p.left, p.right)
+				left, lloaded, lerr := image_collection.SourceImage(p.left)
+				right, rloaded, rerr := image_collection.SourceImage(p.right)
+				if lerr != nil || rerr != nil {
+					if prev_key := set_image_comparison_note(p.left, p.right, key, "Cannot compare images that failed to load", true); prev_key != "" {
+						image_collection.RemoveImage(prev_key)
+					}
+					continue
+				}
+				if !lloaded || !rloaded {
+					// will be created once the images have been loaded
+					continue
+				}
+				combined, note := create_image_comparison(left, right, cmp)
+				image_collection.AddImage(key, combined)
+				if prev_key := set_image_comparison_note(p.left, p.right, key, note, false); prev_key != "" {
+					image_collection.RemoveImage(prev_key)
+				}
+			}
+		})
+		r := AsyncResult{rtype: IMAGE_COMPARE}
+		if page_size != (graphics.Size{}) {
+			image_collection.ResizeForPageSize(page_size.Width, page_size.Height)
+			r = AsyncResult{rtype: IMAGE_RESIZE, page_size: page_size}
+		}
+		self.async_results <- r
+		self.lp.WakeupMainThread()
+	}()
+}
+
+func (self *Handler) cycle_image_mode() {
+	idx := 0
+	for i, m := range all_image_compare_modes {
+		if m == self.image_comparison.mode {
+			idx = i
+		}
+	}
+	self.image_comparison.mode = all_image_compare_modes[(idx+1)%len(all_image_compare_modes)]
+	self.create_image_comparisons()
+}
+
+func (self *Handler) move_swipe(amt int) bool {
+	if self.image_comparison.mode != Image_compare_mode_swipe {
+		return false
+	}
+	pos := utils.Max(10, utils.Min(self.image_comparison.swipe_position+amt, 90))
+	if pos == self.image_comparison.swipe_position {
+		return false
+	}
+	self.image_comparison.swipe_position = pos
+	self.create_image_comparisons()
+	return true
+}
@@ -0,0 +1,69 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestDiffImageComparison(t *testing.T) {
+	img := func(pixels ...color.NRGBA) *image.NRGBA {
+		ans := image.NewNRGBA(image.Rect(0, 0, len(pixels), 1))
+		for x, c := range pixels {
+			ans.SetNRGBA(x, 0, c)
+		}
+		return ans
+	}
+	pixels := func(img *image.NRGBA) (ans []color.NRGBA) {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			ans = append(ans, img.NRGBAAt(x, 0))
+		}
+		return
+	}
+	white, black, gray := color.NRGBA{255, 255, 255, 255}, color.NRGBA{0, 0, 0, 255}, color.NRGBA{127, 127, 127, 255}
+	red := color.NRGBA{255, 0, 0, 255}
+	left := img(white, white, white, white, black, white, white, white, white, white)
+	right := img(white, white, white, white, white, white, white, white, white, black)
+	tc := func(mode Image_compare_mode_Choice_Type, swipe_position int, expected ...color.NRGBA) {
+		t.Helper()
+		actual, num_different := combine_images(left, right, image_comparison{mode, swipe_position})
+		if num_different != 2 {
+			t.Fatalf("Incorrect number of different pixels for %s: %d", mode, num_different)
+		}
+		if diff := cmp.Diff(expected, pixels(actual)); diff != "" {
+			t.Fatalf("Incorrect combined image for %s:\n%s", mode, diff)
+		}
+	}
+	tc(Image_compare_mode_onion, 50, white, white, white, white, gray, white, white, white, white, gray)
+	tc(Image_compare_mode_swipe, 50, white, white, white, white, red, red, white, white, white, black)
+	dim := color.NRGBA{85, 85, 85, 255}
+	tc(Image_compare_mode_difference, 50, dim, dim, dim, dim, red, dim, dim, dim, dim, red)
+}
+
+func TestDiffImageComparisonReplacement(t *testing.T) {
+	a := image_comparison{Image_compare_mode_swipe, 50}
+	b := image_comparison{Image_compare_mode_swipe, 60}
+	ka, kb := a.key("l", "r"), b.key("l", "r")
+	if prev := set_image_comparison_note("l", "r", ka, "a", false); prev != "" {
+		t.Fatalf("Unexpected previous key: %#v", prev)
+	}
+	if prev := set_image_comparison_note("l", "r", ka, "a", false); prev != "" {
+		t.Fatalf("Recreating the same comparison should not remove it: %#v", prev)
+	}
+	if prev := set_image_comparison_note("l", "r", kb, "b", false); prev != ka {
+		t.Fatalf("The previous comparison was not replaced: %#v", prev)
+	}
+	if _, found := image_comparison_note_for(ka); found {
+		t.Fatalf("The note for the replaced comparison was not removed")
+	}
+	if note, found := image_comparison_note_for(kb); !found || note.text != "b" {
+		t.Fatalf("The note for the new comparison is incorrect: %#v", note)
+	}
+}
@@ -0,0 +1,166 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"unicode"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// A changed region of a line, in bytes
+type Region struct{ offset, size int }
+
+// The changed regions of a pair of lines
+type IntralineChanges struct{ left, right []Region }
+
+// Limit on the number of token pairs compared, beyond which we fall back to
+// highlighting the single region between the common prefix and suffix
+const MAX_INTRALINE_COMPARISONS = 1024 * 1024
+
+type token_class int
+
+const (
+	SPACE_CLASS token_class = iota
+	WORD_CLASS
+	PUNCTUATION_CLASS
+)
+
+func class_of(r rune, granularity Intraline_granularity_Choice_Type) token_class {
+	if unicode.IsSpace(r) {
+		return SPACE_CLASS
+	}
+	if granularity == Intraline_granularity_word || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+		return WORD_CLASS
+	}
+	return PUNCTUATION_CLASS
+}
+
+// Split a line into tokens, returning the byte offsets at which tokens end.
+// For word granularity, tokens are runs of whitespace and runs of
+// non-whitespace. For token granularity, identifiers and numbers are split
+// from punctuation, with every punctuation character a separate token. For
+// character granularity, every character is a token.
+func tokenize(line string, granularity Intraline_granularity_Choice_Type) (ends []int) {
+	ends = make([]int, 0, len(line))
+	var prev token_class
+	for i, r := range line {
+		if i > 0 {
+			c := class_of(r, granularity)
+			if granularity == Intraline_granularity_character || c != prev || c == PUNCTUATION_CLASS {
+				ends = append(ends, i)
+			}
+			prev = c
+		} else {
+			prev = class_of(r, granularity)
+		}
+	}
+	if len(line) > 0 {
+		ends = append(ends, len(line))
+	}
+	return
+}
+
+type token_list struct {
+	line string
+	ends []int
+}
+
+func (self token_list) start(i int) int {
+	if i == 0 {
+		return 0
+	}
+	return self.ends[i-1]
+}
+
+func (self token_list) at(i int) string { return self.line[self.start(i):self.ends[i]] }
+
+// Return the regions of a that are not part of the longest common
+// subsequence of tokens in a and b, and vice versa
+func changed_regions(a, b token_list) (left, right []Region, ok bool) {
+	n, m := len(a.ends), len(b.ends)
+	prefix := 0
+	for prefix < n && prefix < m && a.at(prefix) == b.at(prefix) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < n-prefix && suffix < m-prefix && a.at(n-1-suffix) == b.at(m-1-suffix) {
+		suffix++
+	}
+	an, bm := n-prefix-suffix, m-prefix-suffix
+	if an*bm > MAX_INTRALINE_COMPARISONS {
+		return nil, nil, false
+	}
+	// lcs[i][j] is the length of the LCS of the tokens a[prefix+i:] and b[prefix+j:]
+	lcs := make([][]int32, an+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, bm+1)
+	}
+	for i := an - 1; i >= 0; i-- {
+		for j := bm - 1; j >= 0; j-- {
+			if a.at(prefix+i) == b.at(prefix+j) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = utils.Max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	add := func(regions []Region, t token_list, i int) []Region {
+		start, end := t.start(i), t.ends[i]
+		if len(regions) > 0 {
+			if last := &regions[len(regions)-1]; last.offset+last.size == start {
+				last.size += end - start
+				return regions
+			}
+		}
+		return append(regions, Region{start, end - start})
+	}
+	i, j := 0, 0
+	for i < an || j < bm {
+		switch {
+		case i < an && j < bm && a.at(prefix+i) == b.at(prefix+j):
+			i++
+			j++
+		case j >= bm || (i < an && lcs[i+1][j] >= lcs[i][j+1]):
+			left = add(left, a, prefix+i)
+			i++
+		default:
+			right = add(right, b, prefix+j)
+			j++
+		}
+	}
+	return left, right, true
+}
+
+// The single changed region between the common prefix and suffix of the lines
+func changed_center(left, right string) (ans IntralineChanges) {
+	if len(left) > 0 && len(right) > 0 {
+		ll, rl := len(left), len(right)
+		ml := utils.Min(ll, rl)
+		offset := 0
+		for ; offset < ml && left[offset] == right[offset]; offset++ {
+		}
+		suffix_count := 0
+		for ; suffix_count < ml && left[ll-1-suffix_count] == right[rl-1-suffix_count]; suffix_count++ {
+		}
+		if size := ll - suffix_count - offset; size > 0 {
+			ans.left = []Region{{offset, size}}
+		}
+		if size := rl - suffix_count - offset; size > 0 {
+			ans.right = []Region{{offset, size}}
+		}
+	}
+	return
+}
+
+func intraline_changes(left, right string, granularity Intraline_granularity_Choice_Type) IntralineChanges {
+	if granularity != Intraline_granularity_span && len(left) > 0 && len(right) > 0 {
+		if l, r, ok := changed_regions(token_list{left, tokenize(left, granularity)}, token_list{right, tokenize(right, granularity)}); ok {
+			return IntralineChanges{l, r}
+		}
+	}
+	return changed_center(left, right)
+}
@@ -0,0 +1,40 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestDiffIntralineChanges(t *testing.T) {
+	text := func(line string, regions []Region) (ans []string) {
+		for _, r := range regions {
+			ans = append(ans, line[r.offset:r.offset+r.size])
+		}
+		return
+	}
+	tc := func(left, right string, granularity Intraline_granularity_Choice_Type, el, er []string) {
+		t.Helper()
+		c := intraline_changes(left, right, granularity)
+		if diff := cmp.Diff(el, text(left, c.left)); diff != "" {
+			t.Fatalf("Left changes incorrect for: %#v -> %#v with granularity: %s\n%s", left, right, granularity, diff)
+		}
+		if diff := cmp.Diff(er, text(right, c.right)); diff != "" {
+			t.Fatalf("Right changes incorrect for: %#v -> %#v with granularity: %s\n%s", left, right, granularity, diff)
+		}
+	}
+	tc("one two three", "one 2 three", Intraline_granularity_span, []string{"two"}, []string{"2"})
+	tc("a b c d", "a x c y", Intraline_granularity_span, []string{"b c d"}, []string{"x c y"})
+	tc("a b c d", "a x c y", Intraline_granularity_word, []string{"b", "d"}, []string{"x", "y"})
+	tc("foo(a, b)", "foo(a, c)", Intraline_granularity_word, []string{"b)"}, []string{"c)"})
+	tc("foo(a, b)", "foo(a, c)", Intraline_granularity_token, []string{"b"}, []string{"c"})
+	tc("some_name = x", "some_game = y", Intraline_granularity_token, []string{"some_name", "x"}, []string{"some_game", "y"})
+	tc("some_name = x", "some_game = y", Intraline_granularity_character, []string{"n", "x"}, []string{"g", "y"})
+	tc("abc", "abXc", Intraline_granularity_character, nil, []string{"X"})
+	tc("", "abc", Intraline_granularity_character, nil, nil)
+}
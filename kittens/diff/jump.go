@@ -0,0 +1,115 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var _ = fmt.Print
+
+// Jumping to a line number in the old or new version of the file at the top
+// of the screen. The line on the other side that is aligned with it is shown
+// alongside it, as both sides scroll together.
+
+// Parse the line to jump to. Line numbers prefixed by - or l are in the old
+// version of the file, those prefixed by + or r or without a prefix are in the
+// new version, matching the notation used in hunk headers.
+func parse_line_target(text string) (line_number int, left bool, err error) {
+	text = strings.TrimSpace(text)
+	if text != "" {
+		switch text[0] {
+		case '-', 'l', 'L':
+			left = true
+			text = text[1:]
+		case '+', 'r', 'R':
+			text = text[1:]
+		}
+	}
+	line_number, err = strconv.Atoi(strings.TrimSpace(text))
+	if err != nil || line_number < 1 {
+		return 0, false, fmt.Errorf("Not a valid line number: %#v", text)
+	}
+	return
+}
+
+// The index of the logical line, from start to end, that shows the specified
+// line of the old (left) or new version of the file. If that line is not in
+// the diff, the closest line that is is returned, with exact set to false. If
+// no line of that version of the file is in the diff, -1 is returned.
+func find_line(lines *LogicalLines, start, end, line_number int, left bool) (idx int, exact bool) {
+	idx, distance := -1, 0
+	for i := start; i < end; i++ {
+		ll := lines.At(i)
+		switch ll.line_type {
+		case CONTEXT_LINE, CHANGE_LINE, ADDED_LINE:
+		default:
+			continue
+		}
+		ref := ll.right_reference
+		if left {
+			ref = ll.left_reference
+		}
+		if ref.linenum < 1 {
+			continue
+		}
+		d := ref.linenum - line_number
+		if d < 0 {
+			d = -d
+		}
+		if d == 0 {
+			return i, true
+		}
+		if idx < 0 || d < distance {
+			idx, distance = i, d
+		}
+	}
+	return idx, false
+}
+
+func (self *Handler) start_line_jump() {
+	if self.inputting_command || self.merge != nil || len(self.overview) == 0 {
+		self.lp.Beep()
+		return
+	}
+	self.inputting_command = true
+	self.input_type = LINE_JUMP_INPUT
+	self.rl.SetPrompt(":")
+	self.rl.SetText(``)
+	self.draw_status_line()
+}
+
+// Scroll to the specified line of the file at the top of the screen
+func (self *Handler) jump_to_line(text string) {
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	line_number, left, err := parse_line_target(text)
+	if err != nil {
+		self.statusline_message = err.Error()
+		self.lp.Beep()
+		return
+	}
+	side := "new"
+	if left {
+		side = "old"
+	}
+	_, start, end := self.current_file_range()
+	idx, exact := find_line(self.logical_lines, start, end, line_number, left)
+	if idx < 0 {
+		self.statusline_message = fmt.Sprintf("The %s version of this file has no lines in the diff", side)
+		self.lp.Beep()
+		return
+	}
+	if !exact {
+		ll := self.logical_lines.At(idx)
+		ref := ll.right_reference
+		if left {
+			ref = ll.left_reference
+		}
+		self.statusline_message = fmt.Sprintf("Line %d of the %s version is not in the diff, showing line %d instead", line_number, side, ref.linenum)
+	}
+	self.scroll_to_logical_line(idx)
+}
@@ -0,0 +1,86 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kitty/tools/tui/graphics"
+)
+
+var _ = fmt.Print
+
+func TestDiffJumpToLine(t *testing.T) {
+	for text, expected := range map[string]string{"12": "12 false", " -3": "3 true", "l7": "7 true", "+5": "5 false", "r 9": "9 false"} {
+		n, left, err := parse_line_target(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := fmt.Sprintf("%d %v", n, left); actual != expected {
+			t.Fatalf("Incorrect line target for %#v: %s != %s", text, expected, actual)
+		}
+	}
+	for _, text := range []string{"", "x", "0", "-"} {
+		if _, _, err := parse_line_target(text); err == nil {
+			t.Fatalf("No error for invalid line target: %#v", text)
+		}
+	}
+
+	conf = NewConfig()
+	init_caches()
+	create_formatters()
+	diff_cmd = []string{}
+	tdir := t.TempDir()
+	left, right := filepath.Join(tdir, "left"), filepath.Join(tdir, "right")
+	lines := make([]string, 20)
+	for i := range lines {
+		lines[i] = fmt.Sprint(i + 1)
+	}
+	_ = os.WriteFile(left, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+	// remove line 10 and add two lines after line 11
+	_ = os.WriteFile(right, []byte(strings.Join(lines[:9], "\n")+"\n11\nx\ny\n"+strings.Join(lines[11:], "\n")+"\n"), 0o600)
+	collection, err := create_collection(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff_map, err := diff([]diff_job{{left, right}}, 3, ignore_whitespace{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, unified := range []bool{false, true} {
+		ll, err := render(collection, diff_map, screen_size{rows: 24, columns: 80, num_lines: 23}, 21, graphics.Size{}, unified, image_comparison{}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range []struct {
+			line_number    int
+			left           bool
+			expected_line  int
+			expected_exact bool
+			aligned_with   int
+		}{
+			{10, true, 10, true, 0},
+			{12, true, 12, true, 13},
+			{12, false, 12, true, 0},
+			{13, false, 13, true, 12},
+			{2, false, 7, false, 7},
+			{20, true, 14, false, 15},
+		} {
+			idx, exact := find_line(ll, 0, ll.Len(), q.line_number, q.left)
+			if idx < 0 {
+				t.Fatalf("Line %d not found with unified=%v", q.line_number, unified)
+			}
+			found, other := ll.At(idx).right_reference.linenum, ll.At(idx).left_reference.linenum
+			if q.left {
+				found, other = other, found
+			}
+			if found != q.expected_line || exact != q.expected_exact || (!unified && other != q.aligned_with) {
+				t.Fatalf("Incorrect line found for %d (left: %v) with unified=%v: %d %v %d", q.line_number, q.left, unified, found, exact, other)
+			}
+		}
+	}
+}
@@ -99,14 +99,50 @@ func get_remote_file(path string) (string, error) {
 	return path, nil
 }
 
+// Resolve the files/directories to be compared, fetching remote ones
+func resolve_args(args []string) (left, right, base string, err error) {
+	resolved := make([]string, len(args))
+	for i, x := range args {
+		if resolved[i], err = get_remote_file(x); err != nil {
+			return
+		}
+	}
+	left, right = resolved[0], resolved[len(resolved)-1]
+	if len(args) == 3 {
+		// merging ours base theirs
+		base = resolved[1]
+		for _, x := range []string{left, base, right} {
+			if !exists(x) {
+				return "", "", "", fmt.Errorf("%s does not exist", x)
+			}
+			if isdir(x) {
+				return "", "", "", fmt.Errorf("Only files can be merged, %s is a directory", x)
+			}
+		}
+	}
+	if isdir(left) != isdir(right) {
+		return "", "", "", fmt.Errorf("The items to be diffed should both be either directories or files. Comparing a directory to a file is not valid.'")
+	}
+	if !exists(left) {
+		return "", "", "", fmt.Errorf("%s does not exist", left)
+	}
+	if !exists(right) {
+		return "", "", "", fmt.Errorf("%s does not exist", right)
+	}
+	return
+}
+
 func main(_ *cli.Command, opts_ *Options, args []string) (rc int, err error) {
 	opts = opts_
 	conf, err = load_config(opts)
 	if err != nil {
 		return 1, err
 	}
-	if len(args) != 2 {
-		return 1, fmt.Errorf("You must specify exactly two files/directories to compare")
+	var git_diff *GitDiff
+	if len(opts.FromFd) == 0 && (opts.Staged || (len(args) > 0 && is_revision_range(args[0]))) {
+		git_diff = new_git_diff(opts.Staged, args)
+	} else if n := len(args) + len(opts.FromFd); n != 2 && n != 3 {
+		return 1, fmt.Errorf("You must specify exactly two files/directories to compare or three files to merge")
 	}
 	if err = set_diff_command(conf.Diff_cmd); err != nil {
 		return 1, err
@@ -118,34 +154,32 @@ func main(_ *cli.Command, opts_ *Options, args []string) (rc int, err error) {
 			os.RemoveAll(tdir)
 		}
 	}()
-	left, err := get_remote_file(args[0])
-	if err != nil {
-		return 1, err
-	}
-	right, err := get_remote_file(args[1])
-	if err != nil {
-		return 1, err
-	}
-	if isdir(left) != isdir(right) {
-		return 1, fmt.Errorf("The items to be diffed should both be either directories or files. Comparing a directory to a file is not valid.'")
-	}
-	if !exists(left) {
-		return 1, fmt.Errorf("%s does not exist", left)
-	}
-	if !exists(right) {
-		return 1, fmt.Errorf("%s does not exist", right)
+	left, right, base := "", "", ""
+	if git_diff == nil {
+		if args, err = resolve_streams(opts.FromFd, args, opts.Label); err != nil {
+			return 1, err
+		}
+		if left, right, base, err = resolve_args(args); err != nil {
+			return 1, err
+		}
 	}
 	lp, err = loop.New()
 	loop.MouseTrackingMode(lp, loop.BUTTONS_AND_DRAG_MOUSE_TRACKING)
 	if err != nil {
 		return 1, err
 	}
-	h := Handler{left: left, right: right, lp: lp}
+	h := Handler{left: left, right: right, base: base, git_diff: git_diff, lp: lp}
 	lp.OnInitialize = func() (string, error) {
 		lp.SetCursorVisible(false)
 		lp.SetCursorShape(loop.BAR_CURSOR, true)
 		lp.AllowLineWrapping(false)
-		lp.SetWindowTitle(fmt.Sprintf("%s vs. %s", left, right))
+		if git_diff != nil {
+			lp.SetWindowTitle(strings.TrimSpace("git diff " + git_diff.String()))
+		} else if base != "" {
+			lp.SetWindowTitle(fmt.Sprintf("Merging %s and %s", display_name(left), display_name(right)))
+		} else {
+			lp.SetWindowTitle(fmt.Sprintf("%s vs. %s", display_name(left), display_name(right)))
+		}
 		h.initialize()
 		return "", nil
 	}
@@ -170,10 +204,35 @@ func main(_ *cli.Command, opts_ *Options, args []string) (rc int, err error) {
 		lp.KillIfSignalled()
 		return 1, nil
 	}
-
+	if h.merge != nil {
+		return write_merge_result(&h)
+	}
 	return
 }
 
+// Write the merged result, if the user asked for it. The exit code is
+// non-zero when nothing is written or conflicts remain unresolved, so that
+// git can tell whether the merge succeeded.
+func write_merge_result(h *Handler) (rc int, err error) {
+	if !h.merge_written {
+		return 1, nil
+	}
+	result := h.merge.Result()
+	if opts.Output == "" {
+		_, err = os.Stdout.WriteString(result)
+	} else {
+		err = os.WriteFile(opts.Output, utils.UnsafeStringToBytes(result), 0o666)
+	}
+	if err != nil {
+		return 1, err
+	}
+	if n := h.merge.NumUnresolved(); n > 0 {
+		fmt.Fprintf(os.Stderr, "%d conflicts were left unresolved\n", n)
+		return 1, nil
+	}
+	return 0, nil
+}
+
 func EntryPoint(parent *cli.Command) {
 	create_cmd(parent, main)
 }
@@ -34,6 +34,24 @@ def main(args: List[str]) -> None:
 '''
     )
 
+opt('+external_highlighter', '', ctype='string',
+    add_to_default=False,
+    long_text='''
+Use an external program to syntax highlight files with the specified extension,
+instead of the builtin highlighter. The first word is the file extension, the
+rest is the command to run. The command is given the contents of the file on
+STDIN and must write the contents, highlighted using SGR escape codes, to
+STDOUT, without changing the number of lines. The placeholder :code:`_PATH_`
+in the command is replaced by the path to the file. An extension of :code:`*`
+applies to all files the builtin highlighter does not support. If the command
+fails or changes the number of lines, the builtin highlighter is used. Can be specified multiple times.
+For example::
+
+    external_highlighter rst pygmentize -f terminal256 -l rst
+    external_highlighter * bat --color=always --style=plain --file-name=_PATH_
+'''
+    )
+
 opt('num_context_lines', '3', option_type='positive_int',
     long_text='The number of lines of context to show around each change.'
     )
@@ -49,6 +67,95 @@ def main(args: List[str]) -> None:
 '''
     )
 
+opt('diff_algorithm', 'default', choices=('default', 'myers', 'patience', 'histogram'),
+    long_text='''
+The algorithm used to match lines when diffing. :code:`default` uses the
+default algorithm of the diff command. :code:`myers` finds the smallest number
+of added and removed lines. :code:`patience` and :code:`histogram` anchor the
+diff on lines that occur rarely, such as function definitions, which often gives
+more readable diffs of source code when code is moved around. The builtin
+differ and :program:`git` support all algorithms, for other diff commands the
+builtin differ is used when the command does not support the algorithm, see
+:opt:`kitten-diff.diff_cmd`. You can cycle through the algorithms while the
+kitten is running by pressing :kbd:`Shift+A`.
+'''
+    )
+
+opt('fold_expand_lines', '20', option_type='positive_int',
+    long_text='''
+Unchanged lines further than :opt:`kitten-diff.num_context_lines` from a change
+are hidden behind a marker showing how many lines are hidden. This is the
+number of lines revealed each time the lines above or below the marker are
+expanded.
+'''
+    )
+
+opt('layout', 'split', choices=('split', 'unified'),
+    long_text='''
+The layout to use for showing diffs. :code:`split` shows the two sides of the
+diff side-by-side. :code:`unified` shows them in a single column, with removed
+lines followed by added lines, which is more readable in narrow windows. You can
+switch between the layouts while the kitten is running by pressing :kbd:`l`.
+'''
+    )
+
+opt('show_overview', 'no', option_type='to_bool',
+    long_text='''
+Show a sidebar to the right of the diff listing all the files in the diff, with
+the number of lines added and removed in each. The file at the top of the screen
+is highlighted, click on a file to scroll to it. You can show and hide the
+sidebar while the kitten is running by pressing :kbd:`Shift+O`.
+'''
+    )
+
+opt('show_minimap', 'no', option_type='to_bool',
+    long_text='''
+Show a minimap of the file at the top of the screen in a column to the right of
+the diff, marking where in the file lines were added and removed and which part
+of the file is on screen. Click on the minimap to scroll to that part of the
+file. You can show and hide the minimap while the kitten is running by pressing
+:kbd:`m`.
+'''
+    )
+
+opt('image_compare_mode', 'split', choices=('split', 'onion', 'swipe', 'difference'),
+    long_text='''
+How to show changed images. :code:`split` shows the two images side-by-side.
+:code:`onion` shows the two images blended together, so that shifted content
+appears as a double image. :code:`swipe` shows the left part of the old image
+and the right part of the new image, separated by a red line that can be moved
+with the :kbd:`[` and :kbd:`]` keys. :code:`difference` shows a heatmap of the
+pixels that differ, brighter colors meaning larger differences. If the images
+have different sizes, the new image is scaled to the size of the old one. You
+can cycle through the modes while the kitten is running by pressing :kbd:`i`.
+'''
+    )
+
+opt('intraline_granularity', 'span', choices=('span', 'word', 'token', 'character'),
+    long_text='''
+How to highlight the changes within a changed line. :code:`span` highlights the
+single region from the first to the last changed character. :code:`word`
+highlights changed words, where words are separated by whitespace.
+:code:`token` is like :code:`word` except that identifiers, numbers and
+individual punctuation characters are treated as separate tokens, useful for
+source code. :code:`character` highlights every changed character, useful to spot
+small changes inside long identifiers. For very long lines, :code:`span` is
+always used, for performance.
+'''
+    )
+
+opt('editor', '',
+    long_text='''
+The command used to edit files from the diff, by pressing :kbd:`e`. The
+placeholders :code:`_PATH_` and :code:`_LINE_` are replaced by the path of the
+file and the line number to edit. If :code:`_PATH_` is not present, the path is
+appended to the command. For example, :code:`code --goto _PATH_:_LINE_`. When
+not set, the :envvar:`VISUAL` or :envvar:`EDITOR` environment variables are
+used, with the line number specified as :code:`+_LINE_`, which is understood by
+most terminal editors.
+'''
+    )
+
 opt('replace_tab_by', '\\x20\\x20\\x20\\x20', option_type='python_string',
     long_text='The string to replace tabs with. Default is to use four spaces.'
     )
@@ -66,6 +173,35 @@ def main(args: List[str]) -> None:
 ''',
     )
 
+opt('rename_similarity', '50', option_type='positive_int',
+    long_text='''
+When diffing directories, a file that was removed and a file that was added are
+shown as a rename, with the differences between them, if at least this percentage
+of their lines are the same. A value of :code:`100` detects only renames of
+files that are identical. Binary files are detected as renamed only if they are
+identical. Also used as the similarity threshold for renames when diffing
+with git.
+'''
+    )
+
+opt('detect_copies', 'no', option_type='to_bool',
+    long_text='''
+When diffing directories, detect files that were added as copies of files that
+are otherwise unchanged, using the similarity threshold from
+:opt:`kitten-diff.rename_similarity`, and show them as copies with the
+differences between them. When diffing with git, copies of changed files are
+detected as well.
+'''
+    )
+
+opt('respect_gitignore', 'no', option_type='to_bool',
+    long_text='''
+When scanning directories for files to diff, ignore files and directories that
+are ignored by :file:`.gitignore` files in the directories being diffed. The
+:file:`.git` directory is also ignored.
+'''
+    )
+
 egr()  # }}}
 
 # colors {{{
@@ -267,9 +403,163 @@ def main(args: List[str]) -> None:
     'search_backward_simple b start_search substring backward',
     )
 
+map('Search forward in added lines',
+    'search_forward_added alt+/ start_search regex forward added',
+    long_text='Search only in the lines that were added, including the lines of added files.'
+    )
+
+map('Search forward in removed lines',
+    'search_forward_removed alt+? start_search regex forward removed',
+    long_text='Search only in the lines that were removed, including the lines of removed files.'
+    )
+
+map('Resolve conflict using ours',
+    'pick_ours o resolve_conflict ours',
+    long_text='When merging, resolve the first conflict visible on screen by using the changes from ours.'
+    )
+
+map('Resolve conflict using theirs',
+    'pick_theirs t resolve_conflict theirs',
+    long_text='When merging, resolve the first conflict visible on screen by using the changes from theirs.'
+    )
+
+map('Resolve conflict using both',
+    'pick_both shift+b resolve_conflict both',
+    long_text='When merging, resolve the first conflict visible on screen by using the changes from ours followed by the changes from theirs.'
+    )
+
+map('Unresolve conflict',
+    'unresolve u resolve_conflict none',
+    long_text='When merging, mark the first conflict visible on screen as unresolved. You can also use :code:`resolve_conflict base`'
+    ' to resolve a conflict by discarding the changes from both sides.'
+    )
+
+map('Write merged result and quit',
+    'write_merge w write_merge',
+    long_text='When merging, write the merged result and quit. Conflicts that are still unresolved are written with conflict markers.'
+    )
+
+map('Edit the file on the right',
+    'edit_right e edit_file right',
+    long_text='''
+Edit the file on the right side of the diff, at the first line visible on
+screen, or at the start of the selection, if any, in which case the file on the
+side of the selection is edited. The diff is refreshed when the editor exits.
+See :opt:`kitten-diff.editor` for the command used.
+'''
+    )
+
+map('Edit the file on the left',
+    'edit_left shift+e edit_file left',
+    )
+
+map('Toggle ignoring all whitespace',
+    'ignore_all_whitespace shift+w toggle_ignore_whitespace all',
+    long_text='''
+Toggle ignoring all changes in whitespace when diffing. Use
+:code:`toggle_ignore_whitespace trailing` to ignore only changes in trailing
+whitespace and :code:`toggle_ignore_whitespace blank_lines` to ignore changes
+that only add or remove blank lines. The types of whitespace being ignored are
+shown in the status line. Other diff commands do not support ignoring
+whitespace, so the builtin differ is used instead of them while whitespace is
+being ignored, see :opt:`kitten-diff.diff_cmd`.
+'''
+    )
+
+map('Toggle ignoring trailing whitespace', 'ignore_trailing_whitespace shift+t toggle_ignore_whitespace trailing')
+map('Toggle ignoring blank lines', 'ignore_blank_lines shift+l toggle_ignore_whitespace blank_lines')
+
+map('Cycle diff algorithm',
+    'cycle_diff_algorithm shift+a cycle_diff_algorithm',
+    long_text='Cycle through the algorithms used for diffing, see :opt:`kitten-diff.diff_algorithm`.'
+    )
+
+map('Expand fold above',
+    'expand_fold_above shift+up expand_fold above',
+    long_text='''
+Reveal hidden unchanged lines at the top of the first fold on screen, see
+:opt:`kitten-diff.fold_expand_lines`. Use :code:`expand_fold below` to reveal
+lines at the bottom of the fold and :code:`expand_fold all` to reveal all its
+lines.
+'''
+    )
+map('Expand fold below', 'expand_fold_below shift+down expand_fold below')
+map('Expand fold', 'expand_fold z expand_fold all')
+
+map('Toggle layout',
+    'toggle_layout l toggle_layout',
+    long_text='Switch between the side-by-side and unified layouts, see :opt:`kitten-diff.layout`.'
+    )
+
+map('Toggle file overview',
+    'toggle_overview shift+o toggle_sidebar overview',
+    long_text='Show or hide the sidebar listing all files in the diff, see :opt:`kitten-diff.show_overview`.'
+    )
+map('Toggle minimap',
+    'toggle_minimap m toggle_sidebar minimap',
+    long_text='Show or hide the minimap of the current file, see :opt:`kitten-diff.show_minimap`.'
+    )
+map('Jump to file',
+    'jump_to_file shift+f jump_to_file',
+    long_text='''
+Scroll to a file by typing part of its name. The characters typed need only
+appear in the name in the same order, for example, :code:`rdgo` matches
+:file:`render.go`. The file whose name best matches is chosen.
+'''
+    )
+map('Jump to line',
+    'jump_to_line : jump_to_line',
+    long_text='''
+Scroll to a line of the file at the top of the screen by typing its line number.
+Line numbers are in the new version of the file, prefix them with :code:`-` to
+use the old version instead, as in hunk headers. The aligned line in the other
+version is shown alongside it. If the line is not in the diff, the closest line
+that is, is shown. Increase the context to see more lines.
+'''
+    )
+map('Export patch',
+    'export_patch x export_patch',
+    long_text='''
+Write the diff of all files, in the unified diff format used by git, to a file.
+You are asked for the path to write to, alternately, specify it in the mapping,
+for example: :code:`map ctrl+s export_patch ~/changes.patch`. The current
+settings for context and ignoring whitespace are used. The patch can be applied
+with :code:`git apply` or :code:`patch -p1`.
+'''
+    )
+map('Cycle image comparison mode',
+    'cycle_image_mode i cycle_image_mode',
+    long_text='Cycle through the modes for showing changed images, see :opt:`kitten-diff.image_compare_mode`.'
+    )
+
+map('Move swipe line left', 'swipe_left [ move_swipe -10')
+map('Move swipe line right', 'swipe_right ] move_swipe 10')
+
 map('Copy selection to clipboard', 'copy_to_clipboard y copy_to_clipboard')
 map('Copy selection to clipboard or exit if no selection is present', 'copy_to_clipboard_or_exit ctrl+c copy_to_clipboard_or_exit')
 
+map('Copy hunk to clipboard',
+    'copy_hunk c copy_hunk diff',
+    long_text='''
+Copy the current hunk to the clipboard in unified diff format, that is, with the
+hunk header and the lines prefixed by :code:`+`, :code:`-` or a space. The
+current hunk is the one containing the start of the selection, if any, otherwise
+the first line on screen. Use :code:`copy_hunk right` or :code:`copy_hunk left`
+to copy only the new or old version of the lines in the hunk, without prefixes.
+'''
+    )
+
+map('Copy new version of hunk to clipboard', 'copy_hunk_right shift+c copy_hunk right')
+
+map('Copy current line to clipboard',
+    'copy_line shift+y copy_line right',
+    long_text='''
+Copy the current line, from the right side, to the clipboard. The current line
+is the start of the selection, if any, otherwise the first line on screen. Use
+:code:`copy_line left` to copy the line from the left side.
+'''
+    )
+
 egr()  # }}}
 
 OPTIONS = partial('''\
@@ -291,9 +581,65 @@ def main(args: List[str]) -> None:
 Override individual configuration options, can be specified multiple times.
 Syntax: :italic:`name=value`. For example: :italic:`-o background=gray`
 
+
+--include
+type=list
+Only diff files that match the specified glob pattern, when diffing directories.
+Patterns without a slash are matched against file names, other patterns are
+matched against the path relative to the directories being diffed, with
+:code:`**` matching any number of directories. Can be specified multiple times,
+in which case files matching any of the patterns are diffed.
+
+
+--exclude
+type=list
+Do not diff files and directories that match the specified glob pattern, when
+diffing directories. Patterns are matched in the same way as for
+:option:`--include`. Can be specified multiple times.
+
+
+--staged
+type=bool-set
+Diff the changes staged in the git repository in the current directory, that
+is, the changes between :code:`HEAD` and the index, optionally limited to the
+specified paths.
+
+
+--from-fd
+type=list
+Read one of the files to diff from the specified file descriptor, can be
+specified twice to read both files from file descriptors, for example:
+:code:`kitten diff --from-fd 3 --from-fd 4 3<file1 4<file2`. The files read
+from file descriptors come before any files specified as arguments. Note that
+you can also use :file:`-` as an argument to read from STDIN and process
+substitution, for example: :code:`kitten diff <(cmd1) <(cmd2)`.
+
+
+--label
+type=list
+The name to show for a file being diffed, instead of its path. Can be specified
+twice, the first time for the file on the left and the second time for the file
+on the right. Useful when diffing the output of commands, read from STDIN,
+file descriptors or process substitution. The extension of the label is used to
+choose the syntax highlighting.
+
+
+--output
+completion=type:file group:"Files"
+When merging three files, write the merged result to the specified file,
+instead of to STDOUT. The result is written only when you press :kbd:`w`
+to write the merged result and quit.
+
 '''.format, config_help=CONFIG_HELP.format(conf_name='diff', appname=appname))
-help_text = 'Show a side-by-side diff of the specified files/directories. You can also use :italic:`ssh:hostname:remote-file-path` to diff remote files.'
-usage = 'file_or_directory_left file_or_directory_right'
+help_text = (
+    'Show a side-by-side diff of the specified files/directories. You can also use :italic:`ssh:hostname:remote-file-path` to diff remote files.'
+    ' If three files are specified, they are treated as :italic:`ours`, :italic:`base` and :italic:`theirs` and are'
+    ' shown in a three-way merge view, where you can resolve conflicts and write out the merged result.'
+    ' If the first argument is a git revision range, such as :italic:`HEAD~3..HEAD`, the changes in that range'
+    ' in the git repository in the current directory are shown, optionally limited to the specified paths.'
+    ' Use :italic:`-` to read a file from STDIN.'
+)
+usage = 'file_or_directory_left file_or_directory_right | ours base theirs | revision_range [paths...]'
 
 
 
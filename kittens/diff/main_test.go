@@ -0,0 +1,60 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestDiffResolveRemoteArgs(t *testing.T) {
+	init_caches()
+	tdir := t.TempDir()
+	log := filepath.Join(tdir, "log")
+	bin := filepath.Join(tdir, "bin")
+	src := filepath.Join(tdir, "src")
+	for _, d := range []string{bin, src} {
+		if err := os.Mkdir(d, 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"ours", "base", "theirs"} {
+		_ = os.WriteFile(filepath.Join(src, name), []byte(name+"\n"), 0o600)
+	}
+	// a stub ssh that logs the fetched path and runs the command locally, in
+	// src, which stands in for the home directory on the remote host
+	script := fmt.Sprintf("#!/bin/sh\nshift\neval \"echo \\\"\\${$#}\\\"\" >> '%s'\ncd '%s' && exec \"$@\"\n", log, src)
+	if err := os.WriteFile(filepath.Join(bin, "ssh"), []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	t.Cleanup(func() {
+		for tdir := range remote_dirs {
+			os.RemoveAll(tdir)
+		}
+	})
+
+	r := func(name string) string { return "ssh:host:" + name }
+	left, right, base, err := resolve_args([]string{r("ours"), r("base"), r("theirs")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{left: "ours", base: "base", right: "theirs"} {
+		if filepath.Base(path) != expected {
+			t.Fatalf("Incorrectly resolved %s to: %s", expected, path)
+		}
+	}
+	raw, _ := os.ReadFile(log)
+	fetched := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if diff := cmp.Diff([]string{"ours", "base", "theirs"}, fetched); diff != "" {
+		t.Fatalf("Remote files not fetched exactly once each:\n%s", diff)
+	}
+}
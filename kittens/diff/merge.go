@@ -0,0 +1,415 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+type MergeResolution int
+
+const (
+	UNRESOLVED MergeResolution = iota
+	RESOLVED_OURS
+	RESOLVED_THEIRS
+	RESOLVED_BOTH
+	RESOLVED_BASE
+)
+
+type line_range struct{ start, count int }
+
+func (self line_range) end() int { return self.start + self.count }
+
+type MergeChunk struct {
+	ours, base, theirs line_range
+	is_stable          bool
+	is_conflict        bool
+	resolution         MergeResolution
+	// the range of rendered logical lines for this chunk
+	first_logical_line, num_logical_lines int
+}
+
+type Merge struct {
+	ours_path, base_path, theirs_path string
+	// the lines of each file including their line endings
+	ours, base, theirs []string
+	chunks             []*MergeChunk
+	conflicts          []*MergeChunk
+}
+
+// Split text into lines, keeping the line endings, so that the merged result
+// can be written out byte for byte
+func raw_lines(text string) []string {
+	ans := strings.SplitAfter(text, "\n")
+	if ans[len(ans)-1] == "" {
+		ans = ans[:len(ans)-1]
+	}
+	return ans
+}
+
+// Return the pairs of matching lines between x and y, using the same anchored
+// algorithm as Diff
+func matching_lines(x, y []string) (ans []pair) {
+	done := pair{}
+	for _, m := range tgs(x, y) {
+		if m.x < done.x {
+			continue
+		}
+		start := m
+		for start.x > done.x && start.y > done.y && x[start.x-1] == y[start.y-1] {
+			start.x--
+			start.y--
+		}
+		end := m
+		for end.x < len(x) && end.y < len(y) && x[end.x] == y[end.y] {
+			end.x++
+			end.y++
+		}
+		for i := 0; start.x+i < end.x; i++ {
+			ans = append(ans, pair{start.x + i, start.y + i})
+		}
+		done = end
+	}
+	return
+}
+
+func lines_equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, x := range a {
+		if x != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Split the three files into chunks that are either unchanged in all three,
+// or changed in one or both of ours and theirs, as done by diff3
+func merge_chunks(ours, base, theirs []string) (ans []*MergeChunk) {
+	mo, mt := make(map[int]int, len(base)), make(map[int]int, len(base))
+	for _, p := range matching_lines(base, ours) {
+		mo[p.x] = p.y
+	}
+	for _, p := range matching_lines(base, theirs) {
+		mt[p.x] = p.y
+	}
+	lo, lb, lt := 0, 0, 0
+	add_unstable := func(eo, eb, et int) {
+		c := &MergeChunk{ours: line_range{lo, eo - lo}, base: line_range{lb, eb - lb}, theirs: line_range{lt, et - lt}}
+		o, b, t := ours[lo:eo], base[lb:eb], theirs[lt:et]
+		switch {
+		case lines_equal(o, b):
+			c.resolution = RESOLVED_THEIRS
+		case lines_equal(t, b), lines_equal(o, t):
+			c.resolution = RESOLVED_OURS
+		default:
+			c.is_conflict = true
+		}
+		ans = append(ans, c)
+		lo, lb, lt = eo, eb, et
+	}
+	for lo < len(ours) || lb < len(base) || lt < len(theirs) {
+		i := 0
+		for lb+i < len(base) && lo+i < len(ours) && lt+i < len(theirs) {
+			if o, found := mo[lb+i]; !found || o != lo+i {
+				break
+			}
+			if t, found := mt[lb+i]; !found || t != lt+i {
+				break
+			}
+			i++
+		}
+		if i > 0 {
+			ans = append(ans, &MergeChunk{ours: line_range{lo, i}, base: line_range{lb, i}, theirs: line_range{lt, i}, is_stable: true, resolution: RESOLVED_BASE})
+			lo, lb, lt = lo+i, lb+i, lt+i
+			continue
+		}
+		j := lb
+		for ; j < len(base); j++ {
+			_, in_ours := mo[j]
+			_, in_theirs := mt[j]
+			if in_ours && in_theirs {
+				break
+			}
+		}
+		if j >= len(base) {
+			add_unstable(len(ours), len(base), len(theirs))
+			break
+		}
+		add_unstable(mo[j], j, mt[j])
+	}
+	return
+}
+
+func create_merge(ours_path, base_path, theirs_path string) (*Merge, error) {
+	ans := &Merge{ours_path: ours_path, base_path: base_path, theirs_path: theirs_path}
+	for _, x := range []struct {
+		path  string
+		lines *[]string
+	}{{ours_path, &ans.ours}, {base_path, &ans.base}, {theirs_path, &ans.theirs}} {
+		if !is_path_text(x.path) {
+			return nil, fmt.Errorf("Merging is only supported for text files, %s is not a text file", x.path)
+		}
+		data, err := data_for_path(x.path)
+		if err != nil {
+			return nil, err
+		}
+		*x.lines = raw_lines(data)
+		path_name_map[x.path] = x.path
+	}
+	ans.chunks = merge_chunks(ans.ours, ans.base, ans.theirs)
+	ans.conflicts = utils.Filter(ans.chunks, func(c *MergeChunk) bool { return c.is_conflict })
+	return ans, nil
+}
+
+func (self *Merge) NumUnresolved() (ans int) {
+	for _, c := range self.conflicts {
+		if c.resolution == UNRESOLVED {
+			ans++
+		}
+	}
+	return
+}
+
+// The merged text, with conflict markers around unresolved conflicts
+func (self *Merge) Result() string {
+	buf := strings.Builder{}
+	write := func(lines []string) {
+		for _, line := range lines {
+			buf.WriteString(line)
+		}
+	}
+	marker := func(prefix, path string) {
+		if s := buf.String(); len(s) > 0 && !strings.HasSuffix(s, "\n") {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(prefix)
+		if path != "" {
+			buf.WriteString(" " + filepath.Base(path))
+		}
+		buf.WriteString("\n")
+	}
+	for _, c := range self.chunks {
+		ours, base, theirs := self.ours[c.ours.start:c.ours.end()], self.base[c.base.start:c.base.end()], self.theirs[c.theirs.start:c.theirs.end()]
+		switch c.resolution {
+		case RESOLVED_OURS:
+			write(ours)
+		case RESOLVED_THEIRS:
+			write(theirs)
+		case RESOLVED_BOTH:
+			write(ours)
+			write(theirs)
+		case RESOLVED_BASE:
+			write(base)
+		default:
+			marker("<<<<<<<", self.ours_path)
+			write(ours)
+			marker("=======", "")
+			write(theirs)
+			marker(">>>>>>>", self.theirs_path)
+		}
+	}
+	return buf.String()
+}
+
+func (self *Merge) render_title(columns, margin_size int, ans []*LogicalLine) []*LogicalLine {
+	pane_width := (columns - margin_size - 2) / 3
+	title := func(label, path string, width int) string {
+		return format_as_sgr.title + place_in(" "+label+": "+sanitize(path_name_map[path]), width) + "\x1b[m"
+	}
+	sl := ScreenLine{}
+	sl.left.marked_up_text = title("Ours", self.ours_path, pane_width) + " " + title("Base", self.base_path, pane_width) + " " + title("Theirs", self.theirs_path, columns-margin_size-2*pane_width-2)
+	sl2 := ScreenLine{}
+	sl2.left.marked_up_margin_text = "\x1b[m" + strings.Repeat("━", margin_size)
+	sl2.left.marked_up_text = strings.Repeat("━", columns-margin_size)
+	return append(ans,
+		&LogicalLine{line_type: TITLE_LINE, is_full_width: true, screen_lines: []*ScreenLine{&sl}},
+		&LogicalLine{line_type: EMPTY_LINE, is_full_width: true, screen_lines: []*ScreenLine{&sl2}},
+	)
+}
+
+func (self *Merge) margin_text(c *MergeChunk) string {
+	switch c.resolution {
+	case UNRESOLVED:
+		return removed_count_format("!")
+	case RESOLVED_OURS:
+		return added_count_format("<")
+	case RESOLVED_THEIRS:
+		return added_count_format(">")
+	case RESOLVED_BOTH:
+		return added_count_format("<>")
+	case RESOLVED_BASE:
+		if !c.is_stable {
+			return added_count_format("=")
+		}
+	}
+	return ""
+}
+
+// Render the three files side-by-side as full width lines, showing at most
+// context_count unchanged lines around every change
+func (self *Merge) Render(screen_size screen_size, context_count int) (*LogicalLines, error) {
+	paths := []string{self.ours_path, self.base_path, self.theirs_path}
+	var hlines [3][]string
+	largest_line_number := 0
+	for i, path := range paths {
+		lines, err := highlighted_lines_for_path(path)
+		if err != nil {
+			return nil, err
+		}
+		hlines[i] = lines
+		largest_line_number = utils.Max(largest_line_number, len(lines))
+	}
+	columns := screen_size.columns
+	margin_size := 3
+	lnum_width := len(strconv.Itoa(largest_line_number)) + 1
+	pane_width := (columns - margin_size - 2) / 3
+	widths := [3]int{pane_width, pane_width, columns - margin_size - 2*pane_width - 2}
+	ans := self.render_title(columns, margin_size, make([]*LogicalLine, 0, 1024))
+	separator := format_as_sgr.margin + "│\x1b[m"
+
+	render_row := func(margin string, line_numbers [3]int, formats [3]string) *LogicalLine {
+		var panes [3][]string
+		num_rows := 0
+		for i := range panes {
+			if line_numbers[i] < 0 || line_numbers[i] >= len(hlines[i]) {
+				continue
+			}
+			lnum := strconv.Itoa(line_numbers[i] + 1)
+			text_width := utils.Max(1, widths[i]-lnum_width)
+			for _, text := range splitlines(hlines[i][line_numbers[i]], text_width) {
+				panes[i] = append(panes[i], format_as_sgr.margin+place_in(lnum, lnum_width)+"\x1b[m"+formats[i]+place_in(text, text_width)+"\x1b[m")
+				lnum = ""
+			}
+			num_rows = utils.Max(num_rows, len(panes[i]))
+		}
+		ll := LogicalLine{
+			line_type: CONTEXT_LINE, is_full_width: true,
+			left_reference: Reference{path: self.ours_path, linenum: line_numbers[0] + 1}, right_reference: Reference{path: self.theirs_path, linenum: line_numbers[2] + 1},
+		}
+		for r := 0; r < num_rows; r++ {
+			parts := make([]string, 3)
+			for i, pane := range panes {
+				if r < len(pane) {
+					parts[i] = pane[r]
+				} else {
+					parts[i] = format_as_sgr.filler + strings.Repeat(" ", widths[i]) + "\x1b[m"
+				}
+			}
+			sl := ScreenLine{}
+			sl.left.marked_up_margin_text = margin
+			sl.left.marked_up_text = strings.Join(parts, separator)
+			ll.screen_lines = append(ll.screen_lines, &sl)
+			margin = ""
+		}
+		return &ll
+	}
+
+	hidden_lines := func(count int) *LogicalLine {
+		ll := LogicalLine{line_type: HUNK_TITLE_LINE, is_full_width: true}
+		for _, line := range splitlines(fmt.Sprintf("⋯ %d unchanged lines", count), columns-margin_size) {
+			sl := ScreenLine{}
+			sl.left.marked_up_text = line
+			ll.screen_lines = append(ll.screen_lines, &sl)
+		}
+		return &ll
+	}
+
+	for cnum, c := range self.chunks {
+		c.first_logical_line = len(ans)
+		if c.is_stable {
+			show := func(i int) {
+				ans = append(ans, render_row("", [3]int{c.ours.start + i, c.base.start + i, c.theirs.start + i}, [3]string{}))
+			}
+			leading, trailing := context_count, context_count
+			if cnum == 0 {
+				leading = 0
+			}
+			if cnum == len(self.chunks)-1 {
+				trailing = 0
+			}
+			if leading+trailing >= c.base.count {
+				for i := 0; i < c.base.count; i++ {
+					show(i)
+				}
+			} else {
+				for i := 0; i < leading; i++ {
+					show(i)
+				}
+				ans = append(ans, hidden_lines(c.base.count-leading-trailing))
+				for i := c.base.count - trailing; i < c.base.count; i++ {
+					show(i)
+				}
+			}
+		} else {
+			var formats [3]string
+			taken := func(i int) bool {
+				switch c.resolution {
+				case RESOLVED_OURS:
+					return i == 0
+				case RESOLVED_THEIRS:
+					return i == 2
+				case RESOLVED_BOTH:
+					return i != 1
+				case RESOLVED_BASE:
+					return i == 1
+				}
+				return false
+			}
+			for i := range formats {
+				switch {
+				case c.resolution == UNRESOLVED && i != 1:
+					formats[i] = format_as_sgr.conflict
+				case taken(i):
+					formats[i] = format_as_sgr.added
+				default:
+					formats[i] = format_as_sgr.removed
+				}
+			}
+			margin := self.margin_text(c)
+			for i := 0; i < utils.Max(c.ours.count, c.base.count, c.theirs.count); i++ {
+				line_numbers := [3]int{-1, -1, -1}
+				for p, r := range [3]line_range{c.ours, c.base, c.theirs} {
+					if i < r.count {
+						line_numbers[p] = r.start + i
+					}
+				}
+				ll := render_row(margin, line_numbers, formats)
+				ll.is_change_start = i == 0
+				ans = append(ans, ll)
+			}
+		}
+		c.num_logical_lines = len(ans) - c.first_logical_line
+	}
+	if len(ans) == 2 {
+		// All three files are empty
+		ans = append(ans, &LogicalLine{line_type: EMPTY_LINE, screen_lines: []*ScreenLine{{}}})
+	}
+	return &LogicalLines{lines: ans, margin_size: margin_size, columns: columns}, nil
+}
+
+// The first conflict that is at least partially visible on screen
+func (self *Merge) ConflictAt(top, bottom int) *MergeChunk {
+	for _, c := range self.conflicts {
+		if c.first_logical_line+c.num_logical_lines > top && c.first_logical_line <= bottom {
+			return c
+		}
+	}
+	return nil
+}
+
+func (self *Merge) StatusText() string {
+	if len(self.conflicts) == 0 {
+		return "No conflicts"
+	}
+	return fmt.Sprintf("%d of %d conflicts resolved", len(self.conflicts)-self.NumUnresolved(), len(self.conflicts))
+}
@@ -0,0 +1,75 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestDiffThreeWayMerge(t *testing.T) {
+	lines := func(x string) []string {
+		if x == "" {
+			return []string{}
+		}
+		return raw_lines(strings.ReplaceAll(x, " ", "\n") + "\n")
+	}
+	merge := func(ours, base, theirs string) *Merge {
+		m := &Merge{ours_path: "ours", base_path: "base", theirs_path: "theirs", ours: lines(ours), base: lines(base), theirs: lines(theirs)}
+		m.chunks = merge_chunks(m.ours, m.base, m.theirs)
+		for _, c := range m.chunks {
+			if c.is_conflict {
+				m.conflicts = append(m.conflicts, c)
+			}
+		}
+		return m
+	}
+	tc := func(ours, base, theirs string, num_conflicts int, expected string) {
+		t.Helper()
+		m := merge(ours, base, theirs)
+		if len(m.conflicts) != num_conflicts {
+			t.Fatalf("Incorrect number of conflicts for %#v %#v %#v: %d != %d", ours, base, theirs, num_conflicts, len(m.conflicts))
+		}
+		expected = strings.ReplaceAll(strings.ReplaceAll(expected, " ", "\n"), "\x00", " ") + "\n"
+		if diff := cmp.Diff(expected, m.Result()); diff != "" {
+			t.Fatalf("Incorrect merge result for %#v %#v %#v:\n%s", ours, base, theirs, diff)
+		}
+	}
+	tc("a b c", "a b c", "a b c", 0, "a b c")
+	tc("a X c", "a b c", "a b c", 0, "a X c")
+	tc("a b c", "a b c", "a b Y", 0, "a b Y")
+	tc("a X c d", "a b c d", "a b c Y", 0, "a X c Y")
+	tc("a X c", "a b c", "a X c", 0, "a X c")
+	tc("a c", "a b c", "a b c d", 0, "a c d")
+	tc("x a b c", "a b c", "a b c y", 0, "x a b c y")
+	tc("a X c", "a b c", "a Y c", 1, "a <<<<<<<\x00ours X ======= Y >>>>>>>\x00theirs c")
+
+	m := merge("a X c", "a b c", "a Y c")
+	for _, q := range []struct {
+		r        MergeResolution
+		expected string
+	}{
+		{RESOLVED_OURS, "a X c"}, {RESOLVED_THEIRS, "a Y c"}, {RESOLVED_BOTH, "a X Y c"}, {RESOLVED_BASE, "a b c"},
+	} {
+		m.conflicts[0].resolution = q.r
+		if diff := cmp.Diff(strings.ReplaceAll(q.expected, " ", "\n")+"\n", m.Result()); diff != "" {
+			t.Fatalf("Incorrect merge result for resolution: %d\n%s", q.r, diff)
+		}
+	}
+	if m.NumUnresolved() != 0 {
+		t.Fatalf("Resolved conflict counted as unresolved")
+	}
+
+	// conflict markers must start on a new line even if the
+	// conflicting lines have no trailing newline
+	m = &Merge{ours_path: "ours", theirs_path: "theirs", ours: []string{"a\n", "X"}, base: []string{"a\n", "b"}, theirs: []string{"a\n", "Y"}}
+	m.chunks = merge_chunks(m.ours, m.base, m.theirs)
+	if diff := cmp.Diff("a\n<<<<<<< ours\nX\n=======\nY\n>>>>>>> theirs\n", m.Result()); diff != "" {
+		t.Fatalf("Incorrect merge result without trailing newline:\n%s", diff)
+	}
+}
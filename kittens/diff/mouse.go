@@ -79,7 +79,9 @@ func (self *line_pos) LessThan(other tui.LinePos) bool {
 func (self *Handler) line_pos_from_pos(x int, pos ScrollPos) *line_pos {
 	ans := line_pos{min_x: self.logical_lines.margin_size, y: pos}
 	available_cols := self.logical_lines.columns / 2
-	if x >= available_cols {
+	if self.logical_lines.At(pos.logical_line).is_full_width {
+		ans.max_x = utils.Max(ans.min_x, ans.min_x+self.logical_lines.ScreenLineAt(pos).left.wcswidth()-1)
+	} else if x >= available_cols {
 		ans.min_x += available_cols
 		ans.max_x = utils.Max(ans.min_x, ans.min_x+self.logical_lines.ScreenLineAt(pos).right.wcswidth()-1)
 	} else {
@@ -90,7 +92,7 @@ func (self *Handler) line_pos_from_pos(x int, pos ScrollPos) *line_pos {
 
 func (self *Handler) start_mouse_selection(ev *loop.MouseEvent) {
 	available_cols := self.logical_lines.columns / 2
-	if ev.Cell.Y >= self.screen_size.num_lines || ev.Cell.X < self.logical_lines.margin_size || (ev.Cell.X >= available_cols && ev.Cell.X < available_cols+self.logical_lines.margin_size) {
+	if ev.Cell.Y >= self.screen_size.num_lines || ev.Cell.X < self.logical_lines.margin_size {
 		return
 	}
 	pos := self.scroll_pos
@@ -99,6 +101,9 @@ func (self *Handler) start_mouse_selection(ev *loop.MouseEvent) {
 	if ll.line_type == EMPTY_LINE || ll.line_type == IMAGE_LINE {
 		return
 	}
+	if !ll.is_full_width && ev.Cell.X >= available_cols && ev.Cell.X < available_cols+self.logical_lines.margin_size {
+		return
+	}
 	self.mouse_selection.StartNewSelection(ev, self.line_pos_from_pos(ev.Cell.X, pos), 0, self.screen_size.num_lines-1, self.screen_size.cell_width, self.screen_size.cell_height)
 }
 
@@ -0,0 +1,304 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"kitty/tools/tui/subseq"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The overview sidebar listing all files in the diff and the minimap showing
+// where the changes are in the file at the top of the screen. Both are drawn
+// to the right of the diff, which is rendered narrower to make room for them.
+
+const MINIMAP_WIDTH = 1
+
+// The overview is not shown if it would leave fewer columns than this for
+// the diff
+const MIN_COLUMNS_FOR_DIFF = 60
+
+type overview_entry struct {
+	path, name     string
+	added, removed int
+	title_line     int // the index of the title line of the file in the logical lines
+}
+
+func overview_width(columns int) int {
+	return utils.Max(16, utils.Min(40, columns/4))
+}
+
+func overview_entries(collection *Collection, diff_map map[string]*Patch, lines *LogicalLines) []overview_entry {
+	title_line_map := make(map[string]int, collection.Len())
+	for i := 0; i < lines.Len(); i++ {
+		if ll := lines.At(i); ll.line_type == TITLE_LINE {
+			if _, found := title_line_map[ll.left_reference.path]; !found {
+				title_line_map[ll.left_reference.path] = i
+			}
+		}
+	}
+	num_lines := func(path string) int {
+		if !is_path_text(path) {
+			return 0
+		}
+		lines, _ := lines_for_path(path)
+		return len(lines)
+	}
+	ans := make([]overview_entry, 0, collection.Len())
+	_ = collection.Apply(func(path, item_type, changed_path string) error {
+		e := overview_entry{path: path, name: path_name_map[path], title_line: title_line_map[path]}
+		switch item_type {
+		case `diff`:
+			if patch := diff_map[path]; patch != nil {
+				e.added, e.removed = patch.added_count, patch.removed_count
+			}
+		case `add`:
+			e.added = num_lines(path)
+		case `removal`:
+			e.removed = num_lines(path)
+		}
+		if changed_path != "" && path_name_map[changed_path] != e.name {
+			e.name += " → " + path_name_map[changed_path]
+		}
+		ans = append(ans, e)
+		return nil
+	})
+	return ans
+}
+
+// The index of the entry for the file containing the specified logical line
+func overview_entry_for_line(entries []overview_entry, logical_line int) int {
+	ans := 0
+	for i, e := range entries {
+		if e.title_line > logical_line {
+			break
+		}
+		ans = i
+	}
+	return ans
+}
+
+// The index of the name that best matches query, or -1 if none match
+func best_fuzzy_match(query string, names []string) int {
+	ans, best := -1, 0.
+	for i, m := range subseq.ScoreItems(query, names, subseq.Options{}) {
+		if m.Score > best {
+			ans, best = i, m.Score
+		}
+	}
+	return ans
+}
+
+func changes_in_line(ll *LogicalLine) (added, removed bool) {
+	switch ll.line_type {
+	case ADDED_LINE:
+		return true, false
+	case CHANGE_LINE, IMAGE_LINE:
+		if ll.is_full_width {
+			// removed lines in the unified layout
+			return false, true
+		}
+		for _, sl := range ll.screen_lines {
+			added = added || !sl.right.is_filler
+			removed = removed || !sl.left.is_filler
+		}
+	}
+	return
+}
+
+type minimap_cell struct{ added, removed, visible bool }
+
+// The minimap for the logical lines from start to end, with each row covering
+// an equal share of the lines
+func minimap(lines *LogicalLines, start, end, first_visible, last_visible, rows int) []minimap_cell {
+	ans := make([]minimap_cell, rows)
+	n := end - start
+	for i := start; i < end; i++ {
+		added, removed := changes_in_line(lines.At(i))
+		visible := i >= first_visible && i <= last_visible
+		first_row := (i - start) * rows / n
+		for r := first_row; r < utils.Max(first_row+1, (i-start+1)*rows/n); r++ {
+			c := &ans[r]
+			c.added, c.removed, c.visible = c.added || added, c.removed || removed, c.visible || visible
+		}
+	}
+	return ans
+}
+
+func (self *Handler) overview_visible() bool {
+	return self.show_overview && self.merge == nil && self.screen_size.columns-overview_width(self.screen_size.columns)-MINIMAP_WIDTH >= MIN_COLUMNS_FOR_DIFF
+}
+
+func (self *Handler) minimap_visible() bool {
+	return self.show_minimap && self.merge == nil && self.screen_size.columns-MINIMAP_WIDTH >= MIN_COLUMNS_FOR_DIFF
+}
+
+// The number of columns available for the diff itself
+func (self *Handler) diff_columns() int {
+	ans := self.screen_size.columns
+	if self.minimap_visible() {
+		ans -= MINIMAP_WIDTH
+	}
+	if self.overview_visible() {
+		ans -= overview_width(self.screen_size.columns)
+	}
+	return ans
+}
+
+// The range of logical lines of the file at the top of the screen
+func (self *Handler) current_file_range() (idx, start, end int) {
+	idx = overview_entry_for_line(self.overview, self.scroll_pos.logical_line)
+	start, end = 0, self.logical_lines.Len()
+	if idx < len(self.overview) {
+		start = self.overview[idx].title_line
+		if idx+1 < len(self.overview) {
+			end = self.overview[idx+1].title_line
+		}
+	}
+	return
+}
+
+func (self *Handler) draw_minimap() {
+	_, start, end := self.current_file_range()
+	bottom := self.scroll_pos
+	self.logical_lines.IncrementScrollPosBy(&bottom, self.screen_size.num_lines-1)
+	x := self.logical_lines.columns + 1
+	for y, c := range minimap(self.logical_lines, start, end, self.scroll_pos.logical_line, bottom.logical_line, self.screen_size.num_lines) {
+		self.lp.MoveCursorTo(x, y+1)
+		f := format_as_sgr.margin
+		switch {
+		case c.added && c.removed:
+			f = format_as_sgr.hunk_margin
+		case c.added:
+			f = format_as_sgr.added_margin
+		case c.removed:
+			f = format_as_sgr.removed_margin
+		}
+		ch := " "
+		if c.visible {
+			ch = "┃"
+		}
+		self.lp.QueueWriteString(f + ch + "\x1b[m")
+	}
+}
+
+func overview_line(e overview_entry, width int, is_current bool) string {
+	counts, counts_width := "", 0
+	add_count := func(x string, f func(...any) string) {
+		if counts != "" {
+			counts += " "
+			counts_width++
+		}
+		counts += f(x)
+		counts_width += len(x)
+	}
+	if e.added > 0 {
+		add_count("+"+strconv.Itoa(e.added), added_count_format)
+	}
+	if e.removed > 0 {
+		add_count("-"+strconv.Itoa(e.removed), removed_count_format)
+	}
+	prefix := ""
+	if is_current {
+		prefix = format_as_sgr.selection
+	}
+	return prefix + place_in(" "+sanitize(e.name), utils.Max(1, width-counts_width-1)) + counts + " "
+}
+
+func (self *Handler) draw_overview() {
+	width := overview_width(self.screen_size.columns)
+	current, _, _ := self.current_file_range()
+	rows := self.screen_size.num_lines
+	self.overview_offset = utils.Max(0, utils.Min(current-(rows-1)/2, len(self.overview)-(rows-1)))
+	header := fmt.Sprintf(" %d files", len(self.overview))
+	if len(self.overview) == 1 {
+		header = " 1 file"
+	}
+	x := self.screen_size.columns - width + 1
+	for y := 0; y < rows; y++ {
+		self.lp.MoveCursorTo(x, y+1)
+		line := ""
+		if y == 0 {
+			line = format_as_sgr.title + place_in(header, width-1)
+		} else if idx := self.overview_offset + y - 1; idx < len(self.overview) {
+			line = overview_line(self.overview[idx], width-1, idx == current)
+		}
+		self.lp.QueueWriteString(format_as_sgr.margin + "│\x1b[m" + line + "\x1b[m")
+	}
+}
+
+// Handle clicks on the minimap or overview, returning true if the click was on either
+func (self *Handler) handle_sidebar_click(x, y int) bool {
+	if x < self.logical_lines.columns || self.logical_lines.Len() == 0 || len(self.overview) == 0 {
+		return false
+	}
+	if y >= self.screen_size.num_lines {
+		return true
+	}
+	if self.minimap_visible() && x < self.logical_lines.columns+MINIMAP_WIDTH {
+		// scroll to the part of the current file corresponding to the row clicked on
+		_, start, end := self.current_file_range()
+		self.scroll_to_logical_line(start + (end-start)*y/self.screen_size.num_lines)
+		return true
+	}
+	if idx := self.overview_offset + y - 1; y > 0 && idx < len(self.overview) {
+		self.scroll_to_logical_line(self.overview[idx].title_line)
+	}
+	return true
+}
+
+func (self *Handler) scroll_to_logical_line(idx int) {
+	self.scroll_pos = ScrollPos{logical_line: idx}
+	if self.max_scroll_pos.Less(self.scroll_pos) {
+		self.scroll_pos = self.max_scroll_pos
+	}
+	self.draw_screen()
+}
+
+func (self *Handler) start_file_jump() {
+	if self.inputting_command || self.merge != nil || len(self.overview) == 0 {
+		self.lp.Beep()
+		return
+	}
+	self.inputting_command = true
+	self.input_type = FILE_JUMP_INPUT
+	self.rl.SetPrompt("file: ")
+	self.rl.SetText(``)
+	self.draw_status_line()
+}
+
+// Scroll to the file whose name best matches query
+func (self *Handler) jump_to_file(query string) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return
+	}
+	idx := best_fuzzy_match(query, utils.Map(func(e overview_entry) string { return e.name }, self.overview))
+	if idx < 0 {
+		self.statusline_message = fmt.Sprintf("No file matches: %#v", query)
+		self.lp.Beep()
+		return
+	}
+	self.scroll_to_logical_line(self.overview[idx].title_line)
+}
+
+func (self *Handler) toggle_sidebar(which string) error {
+	if self.merge != nil || !self.has_content() || self.logical_lines == nil {
+		self.lp.Beep()
+		return nil
+	}
+	switch which {
+	case `overview`:
+		self.show_overview = !self.show_overview
+	case `minimap`:
+		self.show_minimap = !self.show_minimap
+	default:
+		return fmt.Errorf("Unknown sidebar: %#v", which)
+	}
+	return self.relayout()
+}
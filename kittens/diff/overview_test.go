@@ -0,0 +1,91 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kitty/tools/tui/graphics"
+)
+
+var _ = fmt.Print
+
+func TestDiffOverview(t *testing.T) {
+	conf = NewConfig()
+	init_caches()
+	create_formatters()
+	diff_cmd = []string{}
+	tdir := t.TempDir()
+	write := func(path, data string) {
+		path = filepath.Join(tdir, path)
+		_ = os.MkdirAll(filepath.Dir(path), 0o700)
+		_ = os.WriteFile(path, []byte(data), 0o600)
+	}
+	write("left/a", "a\nb\nc\nd\ne\n")
+	write("left/b", "x\ny\n")
+	write("right/a", "a\nB\nc\nd\ne\nf\n")
+	write("right/c", "1\n2\n3\n")
+	collection, err := create_collection(filepath.Join(tdir, "left"), filepath.Join(tdir, "right"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff_map, err := diff([]diff_job{{filepath.Join(tdir, "left", "a"), filepath.Join(tdir, "right", "a")}}, 3, ignore_whitespace{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, err := render(collection, diff_map, screen_size{rows: 24, columns: 80, num_lines: 23}, 6, graphics.Size{}, true, image_comparison{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := overview_entries(collection, diff_map, lines)
+	summary := []string{}
+	for _, e := range entries {
+		summary = append(summary, fmt.Sprintf("%s +%d -%d", e.name, e.added, e.removed))
+		if ll := lines.At(e.title_line); ll.line_type != TITLE_LINE || ll.left_reference.path != e.path {
+			t.Fatalf("The title line for %s is incorrect", e.name)
+		}
+		if overview_entry_for_line(entries, e.title_line+1) != overview_entry_for_line(entries, e.title_line) {
+			t.Fatalf("The line after the title of %s is not in the same file", e.name)
+		}
+	}
+	if actual := strings.Join(summary, ", "); actual != "a +2 -1, b +0 -2, c +3 -0" {
+		t.Fatalf("Incorrect overview: %s", actual)
+	}
+
+	render_minimap := func(rows int) string {
+		cells := minimap(lines, entries[0].title_line, entries[1].title_line, 0, 3, rows)
+		ans := make([]byte, len(cells))
+		for i, c := range cells {
+			switch {
+			case c.added && c.removed:
+				ans[i] = '*'
+			case c.added:
+				ans[i] = '+'
+			case c.removed:
+				ans[i] = '-'
+			default:
+				ans[i] = ' '
+			}
+			if c.visible {
+				ans[i] = "VARB"[strings.IndexByte(" +-*", ans[i])]
+			}
+		}
+		return string(ans)
+	}
+	for rows, expected := range map[int]string{11: "VVVV-+   + ", 5: "VR+ +", 1: "B"} {
+		if actual := render_minimap(rows); actual != expected {
+			t.Fatalf("Incorrect minimap with %d rows: %#v != %#v", rows, expected, actual)
+		}
+	}
+
+	names := []string{"a.txt", "render.go", "unified.go"}
+	for query, expected := range map[string]int{"rdgo": 1, "ufg": 2, "zzz": -1} {
+		if actual := best_fuzzy_match(query, names); actual != expected {
+			t.Fatalf("Incorrect match for %#v: %d != %d", query, expected, actual)
+		}
+	}
+}
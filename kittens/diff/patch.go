@@ -14,6 +14,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/exp/maps"
 )
 
 var _ = fmt.Print
@@ -61,13 +64,11 @@ func set_diff_command(q string) error {
 	return nil
 }
 
-type Center struct{ offset, left_size, right_size int }
-
 type Chunk struct {
 	is_context              bool
 	left_start, right_start int
 	left_count, right_count int
-	centers                 []Center
+	changes                 []IntralineChanges
 }
 
 func (self *Chunk) add_line() {
@@ -83,25 +84,14 @@ func (self *Chunk) context_line() {
 	self.right_count++
 }
 
-func changed_center(left, right string) (ans Center) {
-	if len(left) > 0 && len(right) > 0 {
-		ll, rl := len(left), len(right)
-		ml := utils.Min(ll, rl)
-		for ; ans.offset < ml && left[ans.offset] == right[ans.offset]; ans.offset++ {
-		}
-		suffix_count := 0
-		for ; suffix_count < ml && left[ll-1-suffix_count] == right[rl-1-suffix_count]; suffix_count++ {
-		}
-		ans.left_size = ll - suffix_count - ans.offset
-		ans.right_size = rl - suffix_count - ans.offset
-	}
-	return
-}
-
 func (self *Chunk) finalize(left_lines, right_lines []string) {
 	if !self.is_context && self.left_count == self.right_count {
+		granularity := Intraline_granularity_span
+		if conf != nil {
+			granularity = conf.Intraline_granularity
+		}
 		for i := 0; i < self.left_count; i++ {
-			self.centers = append(self.centers, changed_center(left_lines[self.left_start+i], right_lines[self.right_start+i]))
+			self.changes = append(self.changes, intraline_changes(left_lines[self.left_start+i], right_lines[self.right_start+i], granularity))
 		}
 	}
 }
@@ -279,7 +269,38 @@ func parse_patch(raw string, left_lines, right_lines []string) (ans *Patch, err
 	return
 }
 
-func run_diff(file1, file2 string, num_of_context_lines int) (ok, is_different bool, patch string, err error) {
+// Insert the flags into the diff command, before the -- that separates the paths
+func insert_flags(cmd, flags []string) []string {
+	if len(flags) == 0 {
+		return cmd
+	}
+	idx := len(cmd)
+	for i, x := range cmd {
+		if x == "--" {
+			idx = i
+			break
+		}
+	}
+	ans := make([]string, 0, len(cmd)+len(flags))
+	ans = append(ans, cmd[:idx]...)
+	ans = append(ans, flags...)
+	return append(ans, cmd[idx:]...)
+}
+
+// The builtin differ is used if no diff command is configured or the diff
+// command does not support the algorithm or ignoring whitespace
+func use_builtin_differ(algorithm Diff_algorithm_Choice_Type, ws ignore_whitespace) bool {
+	if len(diff_cmd) == 0 {
+		return true
+	}
+	if ws.is_set() && !ws.is_supported_by(diff_cmd[0]) {
+		return true
+	}
+	_, ok := diff_algorithm_flags(diff_cmd[0], algorithm)
+	return !ok
+}
+
+func run_diff(file1, file2 string, num_of_context_lines int, ws ignore_whitespace, algorithm Diff_algorithm_Choice_Type) (ok, is_different bool, patch string, err error) {
 	// we resolve symlinks because git diff does not follow symlinks, while diff
 	// does. We want consistent behavior, also for integration with git difftool
 	// we always want symlinks to be followed.
@@ -291,7 +312,7 @@ func run_diff(file1, file2 string, num_of_context_lines int) (ok, is_different b
 	if err != nil {
 		return
 	}
-	if len(diff_cmd) == 0 {
+	if use_builtin_differ(algorithm, ws) {
 		data1, err := data_for_path(path1)
 		if err != nil {
 			return false, false, "", err
@@ -300,7 +321,7 @@ func run_diff(file1, file2 string, num_of_context_lines int) (ok, is_different b
 		if err != nil {
 			return false, false, "", err
 		}
-		patchb := Diff(path1, data1, path2, data2, num_of_context_lines)
+		patchb := Diff(path1, ws.normalize(data1), path2, ws.normalize(data2), num_of_context_lines, algorithm)
 		if patchb == nil {
 			return true, false, "", nil
 		}
@@ -311,7 +332,8 @@ func run_diff(file1, file2 string, num_of_context_lines int) (ok, is_different b
 			return strings.ReplaceAll(x, "_CONTEXT_", context)
 		}, diff_cmd)
 
-		cmd = append(cmd, path1, path2)
+		algorithm_flags, _ := diff_algorithm_flags(cmd[0], algorithm)
+		cmd = append(insert_flags(ws.add_flags(cmd), algorithm_flags), path1, path2)
 		c := exec.Command(cmd[0], cmd[1:]...)
 		stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
 		c.Stdout, c.Stderr = &stdout, &stderr
@@ -327,8 +349,8 @@ func run_diff(file1, file2 string, num_of_context_lines int) (ok, is_different b
 	}
 }
 
-func do_diff(file1, file2 string, context_count int) (ans *Patch, err error) {
-	ok, _, raw, err := run_diff(file1, file2, context_count)
+func do_diff(file1, file2 string, context_count int, ws ignore_whitespace, algorithm Diff_algorithm_Choice_Type) (ans *Patch, err error) {
+	ok, _, raw, err := run_diff(file1, file2, context_count, ws, algorithm)
 	if !ok {
 		return nil, fmt.Errorf("Failed to diff %s vs. %s with errors:\n%s", file1, file2, raw)
 	}
@@ -343,13 +365,24 @@ func do_diff(file1, file2 string, context_count int) (ans *Patch, err error) {
 	if err != nil {
 		return
 	}
-	ans, err = parse_patch(raw, left_lines, right_lines)
+	if ans, err = parse_patch(raw, left_lines, right_lines); err == nil && ws.blank_lines && use_builtin_differ(algorithm, ws) {
+		ans.remove_blank_line_hunks(left_lines, right_lines)
+	}
 	return
 }
 
 type diff_job struct{ file1, file2 string }
 
-func diff(jobs []diff_job, context_count int) (ans map[string]*Patch, err error) {
+func diff(jobs []diff_job, context_count int, ws ignore_whitespace) (ans map[string]*Patch, err error) {
+	return diff_incrementally(jobs, context_count, ws, Diff_algorithm_default, 0, nil)
+}
+
+// Diff the jobs in parallel. If report is not nil, it is called at the
+// specified interval with the patches completed so far, while some jobs are
+// still pending. The patch for each job is reported only once it is complete,
+// as the differs match lines over the whole of both files before producing
+// any hunks.
+func diff_incrementally(jobs []diff_job, context_count int, ws ignore_whitespace, algorithm Diff_algorithm_Choice_Type, interval time.Duration, report func(map[string]*Patch)) (ans map[string]*Patch, err error) {
 	ans = make(map[string]*Patch)
 	ctx := images.Context{}
 	type result struct {
@@ -358,20 +391,39 @@ func diff(jobs []diff_job, context_count int) (ans map[string]*Patch, err error)
 		patch        *Patch
 	}
 	results := make(chan result, len(jobs))
-	ctx.Parallel(0, len(jobs), func(nums <-chan int) {
-		for i := range nums {
-			job := jobs[i]
-			r := result{file1: job.file1, file2: job.file2}
-			r.patch, r.err = do_diff(job.file1, job.file2, context_count)
-			results <- r
-		}
-	})
-	close(results)
-	for r := range results {
-		if r.err != nil {
-			return nil, r.err
+	go func() {
+		ctx.Parallel(0, len(jobs), func(nums <-chan int) {
+			for i := range nums {
+				job := jobs[i]
+				r := result{file1: job.file1, file2: job.file2}
+				r.patch, r.err = do_diff(job.file1, job.file2, context_count, ws, algorithm)
+				results <- r
+			}
+		})
+		close(results)
+	}()
+	var ticks <-chan time.Time
+	if report != nil {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	num_reported := 0
+	for {
+		select {
+		case r, more := <-results:
+			if !more {
+				return ans, nil
+			}
+			if r.err != nil {
+				return nil, r.err
+			}
+			ans[r.file1] = r.patch
+		case <-ticks:
+			if len(ans) > num_reported && len(ans) < len(jobs) {
+				num_reported = len(ans)
+				report(maps.Clone(ans))
+			}
 		}
-		ans[r.file1] = r.patch
 	}
-	return ans, nil
 }
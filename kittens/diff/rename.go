@@ -0,0 +1,135 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Detection of files that were renamed or copied and also changed, by
+// comparing the lines in the files
+
+// Inexact detection is skipped when there are more pairs of files than this
+// to compare, as it would take too long
+const MAX_SIMILARITY_CHECKS = 1000 * 1000
+
+// The configured similarity threshold as a percentage
+func rename_threshold() int {
+	return utils.Max(1, utils.Min(int(conf.Rename_similarity), 100))
+}
+
+type similar_file struct {
+	copied bool
+	score  int
+}
+
+func (self similar_file) String() string {
+	verb := "renamed"
+	if self.copied {
+		verb = "copied"
+	}
+	return fmt.Sprintf("%s, %d%% similar", verb, self.score)
+}
+
+type similar_pair struct {
+	left, right string
+	similar_file
+}
+
+// The percentage of lines in the two files that are common to both. Returns
+// zero if the similarity is less than threshold. Files that are not text are
+// similar only if they are identical.
+func similarity(left, right string, threshold int) int {
+	if !is_path_text(left) || !is_path_text(right) {
+		ld, lerr := data_for_path(left)
+		rd, rerr := data_for_path(right)
+		if lerr == nil && rerr == nil && ld == rd {
+			return 100
+		}
+		return 0
+	}
+	l, err := lines_for_path(left)
+	if err != nil {
+		return 0
+	}
+	r, err := lines_for_path(right)
+	if err != nil {
+		return 0
+	}
+	total := len(l) + len(r)
+	if total == 0 {
+		return 100
+	}
+	// the best possible similarity given the number of lines
+	if 200*utils.Min(len(l), len(r))/total < threshold {
+		return 0
+	}
+	counts := make(map[string]int, len(l))
+	for _, x := range l {
+		counts[x]++
+	}
+	common := 0
+	for _, x := range r {
+		if counts[x] > 0 {
+			counts[x]--
+			common++
+		}
+	}
+	if ans := 200 * common / total; ans >= threshold {
+		return ans
+	}
+	return 0
+}
+
+// Find pairs of files that are at least threshold percent similar. Removed
+// files are matched with added files as renames, and if detect_copies is true
+// unchanged files are matched with added files as copies. Every file is used
+// in at most one pair, with the most similar pairs preferred.
+func find_similar_files(removed, added, unchanged []string, threshold int, detect_copies bool) (ans []similar_pair) {
+	sources := removed
+	if detect_copies {
+		sources = append(slices.Clone(removed), unchanged...)
+	}
+	if len(sources)*len(added) > MAX_SIMILARITY_CHECKS {
+		return
+	}
+	candidates := make([]similar_pair, 0, len(added))
+	for i, left := range sources {
+		for _, right := range added {
+			if score := similarity(left, right, threshold); score > 0 {
+				candidates = append(candidates, similar_pair{left, right, similar_file{copied: i >= len(removed), score: score}})
+			}
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b similar_pair) int {
+		if a.score != b.score {
+			return b.score - a.score
+		}
+		if a.copied != b.copied {
+			// prefer renames to copies
+			if a.copied {
+				return 1
+			}
+			return -1
+		}
+		if c := strings.Compare(path_name_map[a.left], path_name_map[b.left]); c != 0 {
+			return c
+		}
+		return strings.Compare(path_name_map[a.right], path_name_map[b.right])
+	})
+	used := utils.NewSet[string](2 * len(candidates))
+	for _, c := range candidates {
+		if !used.Has(c.left) && !used.Has(c.right) {
+			used.Add(c.left)
+			used.Add(c.right)
+			ans = append(ans, c)
+		}
+	}
+	return
+}
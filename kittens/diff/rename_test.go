@@ -0,0 +1,75 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestDiffRenameDetection(t *testing.T) {
+	conf = NewConfig()
+	init_caches()
+	tdir := t.TempDir()
+	lines := func(changed ...int) string {
+		ans := make([]string, 10)
+		for i := range ans {
+			ans[i] = fmt.Sprintf("line %d", i)
+		}
+		for _, i := range changed {
+			ans[i] = "changed"
+		}
+		return strings.Join(ans, "\n") + "\n"
+	}
+	write := func(path, data string) {
+		path = filepath.Join(tdir, path)
+		_ = os.MkdirAll(filepath.Dir(path), 0o700)
+		_ = os.WriteFile(path, []byte(data), 0o600)
+	}
+	write("left/renamed", lines())
+	write("left/unrelated", "a\nb\nc\nd\n")
+	write("left/same", "same\n"+lines())
+	write("right/after-rename", lines(3))
+	write("right/new", "a\nx\ny\nz\n")
+	write("right/same", "same\n"+lines())
+	write("right/copy", "same\n"+lines(1, 2))
+
+	summary := func() (ans []string) {
+		c, err := create_collection(filepath.Join(tdir, "left"), filepath.Join(tdir, "right"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.Apply(func(path, typ, changed_path string) error {
+			x := typ + " " + path_name_map[path]
+			if changed_path != "" {
+				x += " " + path_name_map[changed_path]
+			}
+			if note := c.note_for(path); note != "" {
+				x += " " + note
+			}
+			ans = append(ans, x)
+			return nil
+		})
+		return
+	}
+	tc := func(expected ...string) {
+		t.Helper()
+		if diff := cmp.Diff(expected, summary()); diff != "" {
+			t.Fatalf("Incorrect collection with rename_similarity=%d detect_copies=%v:\n%s", conf.Rename_similarity, conf.Detect_copies, diff)
+		}
+	}
+	tc("add copy", "add new", "diff renamed after-rename renamed, 90% similar", "removal unrelated")
+	conf.Rename_similarity = 100
+	tc("add after-rename", "add copy", "add new", "removal renamed", "removal unrelated")
+	conf.Rename_similarity = 20
+	tc("add copy", "diff renamed after-rename renamed, 90% similar", "diff unrelated new renamed, 25% similar")
+	conf.Rename_similarity, conf.Detect_copies = 50, true
+	tc("add new", "diff renamed after-rename renamed, 90% similar", "diff same copy copied, 81% similar", "removal unrelated")
+}
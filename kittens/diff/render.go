@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -29,6 +30,10 @@ const (
 	HUNK_TITLE_LINE
 	IMAGE_LINE
 	EMPTY_LINE
+	// added lines in the unified layout, where there is no right side
+	ADDED_LINE
+	// the marker for hidden unchanged lines
+	FOLD_LINE
 )
 
 type Reference struct {
@@ -65,12 +70,26 @@ type LogicalLine struct {
 		count int
 	}
 	image_lines_offset int
+	fold               unchanged_region
+	// Renders the text of the screen lines when it is first needed, for lines
+	// that are numerous and whose text is not needed until they are displayed,
+	// such as the rows of hex dumps
+	render_lazily func()
+}
+
+func (self *LogicalLine) ensure_rendered() {
+	if self.render_lazily != nil {
+		f := self.render_lazily
+		self.render_lazily = nil
+		f()
+	}
 }
 
 func (self *LogicalLine) render_screen_line(n int, lp *loop.Loop, margin_size, columns int) {
 	if n >= len(self.screen_lines) || n < 0 {
 		return
 	}
+	self.ensure_rendered()
 	sl := self.screen_lines[n]
 	available_cols := columns/2 - margin_size
 	if self.is_full_width {
@@ -86,7 +105,10 @@ func (self *LogicalLine) render_screen_line(n int, lp *loop.Loop, margin_size, c
 		case CHANGE_LINE, IMAGE_LINE:
 			left_margin = format_as_sgr.removed_margin + left_margin
 			left_text = format_as_sgr.removed + left_text
-		case HUNK_TITLE_LINE:
+		case ADDED_LINE:
+			left_margin = format_as_sgr.added_margin + left_margin
+			left_text = format_as_sgr.added + left_text
+		case HUNK_TITLE_LINE, FOLD_LINE:
 			left_margin = format_as_sgr.hunk_margin + left_margin
 			left_text = format_as_sgr.hunk + left_text
 		case TITLE_LINE:
@@ -156,7 +178,7 @@ func place_in(text string, sz int) string {
 }
 
 var format_as_sgr struct {
-	title, margin, added, removed, added_margin, removed_margin, filler, margin_filler, hunk_margin, hunk, selection, search string
+	title, margin, added, removed, added_margin, removed_margin, filler, margin_filler, hunk_margin, hunk, selection, search, conflict string
 }
 
 var statusline_format, added_count_format, removed_count_format, message_format func(...any) string
@@ -177,6 +199,7 @@ func create_formatters() {
 	format_as_sgr.added = only_open("bg=" + conf.Added_bg.AsRGBSharp())
 	format_as_sgr.added_margin = only_open(fmt.Sprintf("fg=%s bg=%s", conf.Margin_fg.AsRGBSharp(), conf.Added_margin_bg.AsRGBSharp()))
 	format_as_sgr.removed = only_open("bg=" + conf.Removed_bg.AsRGBSharp())
+	format_as_sgr.conflict = only_open("bg=" + conf.Highlight_removed_bg.AsRGBSharp())
 	format_as_sgr.removed_margin = only_open(fmt.Sprintf("fg=%s bg=%s", conf.Margin_fg.AsRGBSharp(), conf.Removed_margin_bg.AsRGBSharp()))
 	format_as_sgr.title = only_open(fmt.Sprintf("fg=%s bg=%s bold", conf.Title_fg.AsRGBSharp(), conf.Title_bg.AsRGBSharp()))
 	format_as_sgr.margin = only_open(fmt.Sprintf("fg=%s bg=%s", conf.Margin_fg.AsRGBSharp(), conf.Margin_bg.AsRGBSharp()))
@@ -205,8 +228,11 @@ func center_span(ltype string, offset, size int) *sgr.Span {
 	return ans
 }
 
-func title_lines(left_path, right_path string, columns, margin_size int, ans []*LogicalLine) []*LogicalLine {
+func title_lines(left_path, right_path, note string, columns, margin_size int, ans []*LogicalLine) []*LogicalLine {
 	left_name, right_name := path_name_map[left_path], path_name_map[right_path]
+	if note != "" {
+		right_name += " (" + note + ")"
+	}
 	available_cols := columns/2 - margin_size
 	ll := LogicalLine{
 		line_type:      TITLE_LINE,
@@ -242,13 +268,36 @@ func (self *LogicalLines) ScreenLineAt(pos ScrollPos) *ScreenLine {
 	if pos.logical_line < len(self.lines) && pos.logical_line >= 0 {
 		line := self.lines[pos.logical_line]
 		if pos.screen_line < len(line.screen_lines) && pos.screen_line >= 0 {
-			return self.lines[pos.logical_line].screen_lines[pos.screen_line]
+			line.ensure_rendered()
+			return line.screen_lines[pos.screen_line]
 		}
 	}
 	return nil
 }
 func (self *LogicalLines) Len() int { return len(self.lines) }
 
+// The index of the line corresponding to q, which is a line from a different
+// rendering of the same diff
+func (self *LogicalLines) Find(q *LogicalLine) int {
+	refs_match := func(ll *LogicalLine) bool {
+		return (q.left_reference.linenum > 0 && ll.left_reference == q.left_reference) || (q.right_reference.linenum > 0 && ll.right_reference == q.right_reference)
+	}
+	for _, matches := range []func(*LogicalLine) bool{
+		func(ll *LogicalLine) bool { return ll.line_type == q.line_type && refs_match(ll) },
+		refs_match,
+		func(ll *LogicalLine) bool {
+			return ll.line_type == q.line_type && ll.left_reference == q.left_reference && ll.right_reference == q.right_reference
+		},
+	} {
+		for i, ll := range self.lines {
+			if matches(ll) {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
 func (self *LogicalLines) NumScreenLinesTo(a ScrollPos) (ans int) {
 	return self.Minus(a, ScrollPos{})
 }
@@ -330,7 +379,7 @@ func human_readable(size int64) string {
 	return s + " " + suffix
 }
 
-func image_lines(left_path, right_path string, screen_size screen_size, margin_size int, image_size graphics.Size, ans []*LogicalLine) ([]*LogicalLine, error) {
+func image_lines(left_path, right_path string, screen_size screen_size, margin_size int, image_size graphics.Size, image_cmp image_comparison, ans []*LogicalLine) ([]*LogicalLine, error) {
 	columns := screen_size.columns
 	available_cols := columns/2 - margin_size
 	ll, err := first_binary_line(left_path, right_path, columns, margin_size, func(path string) (string, error) {
@@ -365,13 +414,30 @@ func image_lines(left_path, right_path string, screen_size screen_size, margin_s
 		}
 		return splitlines(fmt.Sprintf("%s", err), available_cols)
 	}
-	left_lines := do_side(left_path)
-	if ll.left_image.count = len(left_lines); ll.left_image.count > 0 {
-		ll.left_image.key = left_path
-	}
-	right_lines := do_side(right_path)
-	if ll.right_image.count = len(right_lines); ll.right_image.count > 0 {
-		ll.right_image.key = right_path
+	var left_lines, right_lines []string
+	if image_cmp.is_active(left_path, right_path) {
+		// the combined image is shown on the left with a description on the right
+		key := image_cmp.key(left_path, right_path)
+		note, found := image_comparison_note_for(key)
+		if found && note.failed {
+			left_lines = splitlines(note.text, available_cols)
+		} else {
+			if left_lines = do_side(key); found {
+				right_lines = splitlines(note.text, available_cols)
+			}
+			if _, err := image_collection.GetSizeIfAvailable(key, image_size); err == nil {
+				ll.left_image.key, ll.left_image.count = key, len(left_lines)
+			}
+		}
+	} else {
+		left_lines = do_side(left_path)
+		if ll.left_image.count = len(left_lines); ll.left_image.count > 0 {
+			ll.left_image.key = left_path
+		}
+		right_lines = do_side(right_path)
+		if ll.right_image.count = len(right_lines); ll.right_image.count > 0 {
+			ll.right_image.key = right_path
+		}
 	}
 	for i := 0; i < utils.Max(len(left_lines), len(right_lines)); i++ {
 		sl := ScreenLine{}
@@ -455,7 +521,11 @@ func binary_lines(left_path, right_path string, columns, margin_size int, ans []
 	if err != nil {
 		return nil, err
 	}
-	return append(ans, ll), nil
+	ans = append(ans, ll)
+	if left_path != "" && right_path != "" {
+		return hex_lines(left_path, right_path, columns, margin_size, ans)
+	}
+	return ans, nil
 }
 
 type DiffData struct {
@@ -497,14 +567,13 @@ func splitlines(text string, width int) []string {
 	return style.WrapTextAsLines(text, width, style.WrapOptions{})
 }
 
-func render_half_line(line_number int, line, ltype string, available_cols int, center Center, ans []HalfScreenLine) []HalfScreenLine {
-	size := center.left_size
-	if ltype != "remove" {
-		size = center.right_size
-	}
-	if size > 0 {
-		span := center_span(ltype, center.offset, size)
-		line = sgr.InsertFormatting(line, span)
+func render_half_line(line_number int, line, ltype string, available_cols int, changes []Region, ans []HalfScreenLine) []HalfScreenLine {
+	if len(changes) > 0 {
+		spans := make([]*sgr.Span, len(changes))
+		for i, r := range changes {
+			spans[i] = center_span(ltype, r.offset, r.size)
+		}
+		line = sgr.InsertFormatting(line, spans...)
 	}
 	lnum := strconv.Itoa(line_number + 1)
 	for _, sc := range splitlines(line, available_cols) {
@@ -519,20 +588,20 @@ func lines_for_diff_chunk(data *DiffData, hunk_num int, chunk *Chunk, chunk_num
 	ll, rl := make([]HalfScreenLine, 0, 32), make([]HalfScreenLine, 0, 32)
 	for i := 0; i < utils.Max(chunk.left_count, chunk.right_count); i++ {
 		ll, rl = ll[:0], rl[:0]
-		var center Center
+		var changes IntralineChanges
 		left_lnum, right_lnum := 0, 0
-		if i < len(chunk.centers) {
-			center = chunk.centers[i]
+		if i < len(chunk.changes) {
+			changes = chunk.changes[i]
 		}
 		if i < chunk.left_count {
 			left_lnum = chunk.left_start + i
-			ll = render_half_line(left_lnum, data.left_lines[left_lnum], "remove", data.available_cols, center, ll)
+			ll = render_half_line(left_lnum, data.left_lines[left_lnum], "remove", data.available_cols, changes.left, ll)
 			left_lnum++
 		}
 
 		if i < chunk.right_count {
 			right_lnum = chunk.right_start + i
-			rl = render_half_line(right_lnum, data.right_lines[right_lnum], "add", data.available_cols, center, rl)
+			rl = render_half_line(right_lnum, data.right_lines[right_lnum], "add", data.available_cols, changes.right, rl)
 			right_lnum++
 		}
 
@@ -553,7 +622,7 @@ func lines_for_diff_chunk(data *DiffData, hunk_num int, chunk *Chunk, chunk_num
 		logline := LogicalLine{
 			line_type: CHANGE_LINE, is_change_start: i == 0,
 			left_reference:  Reference{path: data.left_path, linenum: left_lnum},
-			right_reference: Reference{path: data.left_path, linenum: right_lnum},
+			right_reference: Reference{path: data.right_path, linenum: right_lnum},
 		}
 		for l := 0; l < len(ll); l++ {
 			logline.screen_lines = append(logline.screen_lines, &ScreenLine{left: ll[l], right: rl[l]})
@@ -563,15 +632,18 @@ func lines_for_diff_chunk(data *DiffData, hunk_num int, chunk *Chunk, chunk_num
 	return ans
 }
 
-func lines_for_diff(left_path string, right_path string, patch *Patch, columns, margin_size int, ans []*LogicalLine) (result []*LogicalLine, err error) {
+func lines_for_diff(left_path string, right_path string, patch *Patch, columns, margin_size int, folds map[unchanged_region]fold_expansion, ans []*LogicalLine) (result []*LogicalLine, err error) {
 	ht := LogicalLine{
 		line_type:      HUNK_TITLE_LINE,
 		left_reference: Reference{path: left_path}, right_reference: Reference{path: right_path},
 		is_full_width: true,
 	}
-	if patch.Len() == 0 {
+	if patch == nil || patch.Len() == 0 {
 		txt := "The files are identical"
-		if lstat, err := os.Stat(left_path); err == nil {
+		if patch == nil {
+			// the diff for these files is still being computed
+			txt = "Computing diff, please wait..."
+		} else if lstat, err := os.Stat(left_path); err == nil {
 			if rstat, err := os.Stat(right_path); err == nil {
 				if lstat.Mode() != rstat.Mode() {
 					txt = fmt.Sprintf("Mode changed: %s to %s", lstat.Mode(), rstat.Mode())
@@ -602,7 +674,9 @@ func lines_for_diff(left_path string, right_path string, patch *Patch, columns,
 		}
 	}
 
+	regions := unchanged_regions(&data, patch)
 	for hunk_num, hunk := range patch.all_hunks {
+		ans = fold_lines(&data, regions[hunk_num], folds[regions[hunk_num]], false, columns-margin_size, ans)
 		htl := ht
 		htl.left_reference.linenum = hunk.left_start + 1
 		htl.right_reference.linenum = hunk.right_start + 1
@@ -620,7 +694,8 @@ func lines_for_diff(left_path string, right_path string, patch *Patch, columns,
 			}
 		}
 	}
-	return ans, nil
+	last := regions[len(regions)-1]
+	return fold_lines(&data, last, folds[last], false, columns-margin_size, ans), nil
 }
 
 func all_lines(path string, columns, margin_size int, is_add bool, ans []*LogicalLine) ([]*LogicalLine, error) {
@@ -645,7 +720,7 @@ func all_lines(path string, columns, margin_size int, is_add bool, ans []*Logica
 	}
 	for line_number, line := range lines {
 		hlines := make([]HalfScreenLine, 0, 8)
-		hlines = render_half_line(line_number, line, ltype, available_cols, Center{}, hlines)
+		hlines = render_half_line(line_number, line, ltype, available_cols, nil, hlines)
 		l := ll
 		if is_add {
 			l.right_reference.linenum = line_number + 1
@@ -693,12 +768,50 @@ func rename_lines(path, other_path string, columns, margin_size int, ans []*Logi
 	return append(ans, &ll), nil
 }
 
-func render(collection *Collection, diff_map map[string]*Patch, screen_size screen_size, largest_line_number int, image_size graphics.Size) (result *LogicalLines, err error) {
+// The lines rendered for each file, re-used when rendering again after only
+// the diffs of other files have changed, as happens when showing the diffs
+// computed so far while diffing
+type render_cache struct {
+	columns, margin_size int
+	unified              bool
+	files                map[string]rendered_file
+}
+
+type rendered_file struct {
+	patch *Patch
+	lines []*LogicalLine
+}
+
+func render(collection *Collection, diff_map map[string]*Patch, screen_size screen_size, largest_line_number int, image_size graphics.Size, unified bool, image_cmp image_comparison, folds map[unchanged_region]fold_expansion, cache *render_cache) (result *LogicalLines, err error) {
 	margin_size := utils.Max(3, len(strconv.Itoa(largest_line_number))+1)
+	if unified {
+		// room for the line numbers of both sides
+		margin_size *= 2
+	}
 	ans := make([]*LogicalLine, 0, 1024)
 	columns := screen_size.columns
-	err = collection.Apply(func(path, item_type, changed_path string) error {
-		ans = title_lines(path, changed_path, columns, margin_size, ans)
+	if cache != nil && (cache.files == nil || cache.columns != columns || cache.margin_size != margin_size || cache.unified != unified) {
+		*cache = render_cache{columns: columns, margin_size: margin_size, unified: unified, files: make(map[string]rendered_file)}
+	}
+	err = collection.Apply(func(path, item_type, changed_path string) (err error) {
+		if cache != nil {
+			if f, found := cache.files[path]; found && f.patch == diff_map[path] {
+				ans = append(ans, f.lines...)
+				return nil
+			}
+			start := len(ans)
+			defer func() {
+				if err == nil {
+					cache.files[path] = rendered_file{patch: diff_map[path], lines: slices.Clone(ans[start:])}
+				}
+			}()
+		}
+		note := collection.note_for(path)
+		if unified {
+			ans = unified_title_lines(path, changed_path, note, columns, margin_size, ans)
+		} else {
+			ans = title_lines(path, changed_path, note, columns, margin_size, ans)
+		}
 		defer func() {
 			ans = append(ans, &LogicalLine{line_type: EMPTY_LINE, screen_lines: []*ScreenLine{{}}})
 		}()
@@ -713,12 +826,14 @@ func render(collection *Collection, diff_map map[string]*Patch, screen_size scre
 		case "diff":
 			if is_binary {
 				if is_img {
-					ans, err = image_lines(path, changed_path, screen_size, margin_size, image_size, ans)
+					ans, err = image_lines(path, changed_path, screen_size, margin_size, image_size, image_cmp, ans)
 				} else {
 					ans, err = binary_lines(path, changed_path, columns, margin_size, ans)
 				}
+			} else if unified {
+				ans, err = unified_lines_for_diff(path, changed_path, diff_map[path], columns, margin_size, folds, ans)
 			} else {
-				ans, err = lines_for_diff(path, changed_path, diff_map[path], columns, margin_size, ans)
+				ans, err = lines_for_diff(path, changed_path, diff_map[path], columns, margin_size, folds, ans)
 			}
 			if err != nil {
 				return err
@@ -726,10 +841,12 @@ func render(collection *Collection, diff_map map[string]*Patch, screen_size scre
 		case "add":
 			if is_binary {
 				if is_img {
-					ans, err = image_lines("", path, screen_size, margin_size, image_size, ans)
+					ans, err = image_lines("", path, screen_size, margin_size, image_size, image_cmp, ans)
 				} else {
 					ans, err = binary_lines("", path, columns, margin_size, ans)
 				}
+			} else if unified {
+				ans, err = unified_all_lines(path, columns, margin_size, true, ans)
 			} else {
 				ans, err = all_lines(path, columns, margin_size, true, ans)
 			}
@@ -739,10 +856,12 @@ func render(collection *Collection, diff_map map[string]*Patch, screen_size scre
 		case "removal":
 			if is_binary {
 				if is_img {
-					ans, err = image_lines(path, "", screen_size, margin_size, image_size, ans)
+					ans, err = image_lines(path, "", screen_size, margin_size, image_size, image_cmp, ans)
 				} else {
 					ans, err = binary_lines(path, "", columns, margin_size, ans)
 				}
+			} else if unified {
+				ans, err = unified_all_lines(path, columns, margin_size, false, ans)
 			} else {
 				ans, err = all_lines(path, columns, margin_size, false, ans)
 			}
@@ -0,0 +1,138 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kitty/tools/tui/graphics"
+)
+
+var _ = fmt.Print
+
+func TestDiffUnifiedLayout(t *testing.T) {
+	conf = NewConfig()
+	init_caches()
+	create_formatters()
+	diff_cmd = []string{}
+	tdir := t.TempDir()
+	left, right := filepath.Join(tdir, "left"), filepath.Join(tdir, "right")
+	_ = os.WriteFile(left, []byte("a\nb\nc\nd\ne\n"), 0o600)
+	_ = os.WriteFile(right, []byte("a\nB\nc\nd\ne\nf\n"), 0o600)
+	collection, err := create_collection(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff_map, err := diff([]diff_job{{left, right}}, 3, ignore_whitespace{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sz := screen_size{rows: 24, columns: 80, num_lines: 23}
+	render_layout := func(unified bool) *LogicalLines {
+		ans, err := render(collection, diff_map, sz, 6, graphics.Size{}, unified, image_comparison{}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ans
+	}
+	split, unified := render_layout(false), render_layout(true)
+	texts := func(ll *LogicalLine) (ans []string) {
+		for _, sl := range ll.screen_lines {
+			ans = append(ans, strings.TrimSpace(sl.left.marked_up_text), strings.TrimSpace(sl.right.marked_up_text))
+		}
+		return
+	}
+	types := []LineType{}
+	for _, ll := range unified.lines {
+		if !ll.is_full_width {
+			t.Fatalf("Line in the unified layout is not full width: %#v", texts(ll))
+		}
+		types = append(types, ll.line_type)
+	}
+	expected := []LineType{TITLE_LINE, EMPTY_LINE, HUNK_TITLE_LINE, CONTEXT_LINE, CHANGE_LINE, ADDED_LINE, CONTEXT_LINE, CONTEXT_LINE, CONTEXT_LINE, ADDED_LINE}
+	if fmt.Sprint(expected) != fmt.Sprint(types) {
+		t.Fatalf("Incorrect line types in unified layout: %v != %v", expected, types)
+	}
+	// the unified layout shows the line numbers of both sides
+	margins := []string{}
+	for _, ll := range unified.lines[3:6] {
+		margins = append(margins, ll.screen_lines[0].left.marked_up_margin_text)
+	}
+	if actual := strings.Join(margins, "|"); actual != "1  1|2  |   2" {
+		t.Fatalf("Incorrect line numbers in unified layout: %#v", actual)
+	}
+	// every line must map to the corresponding line in the other layout
+	for i, ll := range split.lines {
+		j := unified.Find(ll)
+		if split.Find(unified.At(j)) != i {
+			t.Fatalf("Line %d %#v of the split layout maps to line %d %#v of the unified layout which maps back to %d", i, texts(ll), j, texts(unified.At(j)), split.Find(unified.At(j)))
+		}
+	}
+	// files whose diff is still being computed are shown as pending
+	for _, unified := range []bool{false, true} {
+		ans, err := render(collection, map[string]*Patch{}, sz, 6, graphics.Size{}, unified, image_comparison{}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q := texts(ans.At(2)); q[0] != "Computing diff, please wait..." {
+			t.Fatalf("Pending diff not rendered correctly with unified=%v: %#v", unified, q)
+		}
+	}
+}
+
+func TestDiffRenderCache(t *testing.T) {
+	conf = NewConfig()
+	init_caches()
+	create_formatters()
+	diff_cmd = []string{}
+	tdir := t.TempDir()
+	left, right := filepath.Join(tdir, "left"), filepath.Join(tdir, "right")
+	_ = os.WriteFile(left, []byte("a\nb\nc\n"), 0o600)
+	_ = os.WriteFile(right, []byte("a\nB\nc\n"), 0o600)
+	collection, err := create_collection(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff_map, err := diff([]diff_job{{left, right}}, 3, ignore_whitespace{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := render_cache{}
+	render_lines := func(diff_map map[string]*Patch, columns int) *LogicalLines {
+		ans, err := render(collection, diff_map, screen_size{rows: 24, columns: columns, num_lines: 23}, 3, graphics.Size{}, false, image_comparison{}, nil, &cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ans
+	}
+	// the lines of files whose diffs have not changed are re-used
+	pending := render_lines(map[string]*Patch{}, 80)
+	if q := render_lines(map[string]*Patch{}, 80); q.At(2) != pending.At(2) {
+		t.Fatalf("Rendered lines not re-used")
+	}
+	first := render_lines(diff_map, 80)
+	if first.At(2) == pending.At(2) || first.Len() == pending.Len() {
+		t.Fatalf("Rendered lines re-used for a changed diff")
+	}
+	if q := render_lines(diff_map, 80); q.At(3) != first.At(3) {
+		t.Fatalf("Rendered lines not re-used")
+	}
+	if q := render_lines(diff_map, 60); q.At(3) == first.At(3) {
+		t.Fatalf("Rendered lines re-used for a different width")
+	}
+}
+
+func TestDiffSanitize(t *testing.T) {
+	conf = NewConfig()
+	for text, expected := range map[string]string{
+		"plain text\nline": "plain text\nline", "a\x1bb\x7f\u0085c": "a░b░░c", "tab\tcr\r": "tab    cr⏎",
+	} {
+		if actual := sanitize(text); actual != expected {
+			t.Fatalf("Incorrect sanitization of %#v: %#v != %#v", text, actual, expected)
+		}
+	}
+}
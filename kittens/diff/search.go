@@ -18,8 +18,41 @@ import (
 
 var _ = fmt.Print
 
+// The lines to search in
+type SearchScope int
+
+const (
+	SEARCH_ALL SearchScope = iota
+	SEARCH_ADDED
+	SEARCH_REMOVED
+)
+
+func (self SearchScope) String() string {
+	switch self {
+	case SEARCH_ADDED:
+		return "added"
+	case SEARCH_REMOVED:
+		return "removed"
+	}
+	return "all"
+}
+
+// Whether the specified half of the line is in the search scope. Removed
+// lines are on the left in the side-by-side layout and have type CHANGE_LINE
+// in the unified layout.
+func (self SearchScope) includes(line *LogicalLine, half *HalfScreenLine, is_right bool) bool {
+	switch self {
+	case SEARCH_ADDED:
+		return !half.is_filler && (line.line_type == ADDED_LINE || (line.line_type == CHANGE_LINE && is_right))
+	case SEARCH_REMOVED:
+		return !half.is_filler && line.line_type == CHANGE_LINE && !is_right
+	}
+	return true
+}
+
 type Search struct {
 	pat     *regexp.Regexp
+	scope   SearchScope
 	matches map[ScrollPos][]Span
 }
 
@@ -58,7 +91,8 @@ func (self *Search) find_matches_in_lines(clean_lines []string, origin int, send
 		}
 		start_line := find_pos(start)
 		if start_line > -1 {
-			end_line := find_pos(end)
+			// use the last byte of the match, as end is one past it
+			end_line := find_pos(end - 1)
 			if end_line > -1 {
 				for i := start_line; i <= end_line; i++ {
 					cell_start := 0
@@ -82,12 +116,13 @@ func (self *Search) find_matches_in_lines(clean_lines []string, origin int, send
 func (self *Search) find_matches_in_line(line *LogicalLine, margin_size, cols int, send_result func(screen_line, offset, size int)) {
 	half_width := cols / 2
 	right_offset := half_width + margin_size
+	line.ensure_rendered()
 	left_clean_lines, right_clean_lines := make([]string, len(line.screen_lines)), make([]string, len(line.screen_lines))
 	for i, sl := range line.screen_lines {
-		if line.is_full_width {
-			left_clean_lines[i] = wcswidth.StripEscapeCodes(sl.left.marked_up_text)
-		} else {
+		if self.scope.includes(line, &sl.left, false) {
 			left_clean_lines[i] = wcswidth.StripEscapeCodes(sl.left.marked_up_text)
+		}
+		if !line.is_full_width && self.scope.includes(line, &sl.right, true) {
 			right_clean_lines[i] = wcswidth.StripEscapeCodes(sl.right.marked_up_text)
 		}
 	}
@@ -142,8 +177,8 @@ func (self *Search) markup_line(pos ScrollPos, y int) string {
 	return utils.UnsafeBytesToString(ans)
 }
 
-func do_search(pat *regexp.Regexp, logical_lines *LogicalLines) *Search {
-	ans := &Search{pat: pat, matches: make(map[ScrollPos][]Span)}
+func do_search(pat *regexp.Regexp, scope SearchScope, logical_lines *LogicalLines) *Search {
+	ans := &Search{pat: pat, scope: scope, matches: make(map[ScrollPos][]Span)}
 	ans.search(logical_lines)
 	return ans
 }
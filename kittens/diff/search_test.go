@@ -0,0 +1,59 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"kitty/tools/tui/graphics"
+)
+
+var _ = fmt.Print
+
+func TestDiffSearchScope(t *testing.T) {
+	conf = NewConfig()
+	init_caches()
+	create_formatters()
+	diff_cmd = []string{}
+	tdir := t.TempDir()
+	left, right := filepath.Join(tdir, "left"), filepath.Join(tdir, "right")
+	_ = os.WriteFile(left, []byte("x1\nx2\nold x\nx3\n"), 0o600)
+	_ = os.WriteFile(right, []byte("x1\nx2\nnew x\nx3\nx4\n"), 0o600)
+	collection, err := create_collection(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff_map, err := diff([]diff_job{{left, right}}, 3, ignore_whitespace{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sz := screen_size{rows: 24, columns: 80, num_lines: 23}
+	for _, unified := range []bool{false, true} {
+		logical_lines, err := render(collection, diff_map, sz, 6, graphics.Size{}, unified, image_comparison{}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pat := regexp.MustCompile(`x\d?`)
+		for _, q := range []struct {
+			scope    SearchScope
+			expected int
+		}{{SEARCH_ALL, 9}, {SEARCH_ADDED, 2}, {SEARCH_REMOVED, 1}} {
+			s := do_search(pat, q.scope, logical_lines)
+			num := 0
+			for _, spans := range s.matches {
+				num += len(spans)
+			}
+			if unified && q.scope == SEARCH_ALL {
+				// context lines are shown once in the unified layout
+				q.expected = 6
+			}
+			if num != q.expected {
+				t.Fatalf("Incorrect number of matches in %s lines with unified=%v: %d != %d", q.scope, unified, q.expected, num)
+			}
+		}
+	}
+}
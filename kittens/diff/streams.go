@@ -0,0 +1,133 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+var _ = fmt.Print
+
+// Diffing of streams, such as STDIN, file descriptors and the pipes created by
+// process substitution. Streams can only be read once, so they are copied into
+// temporary files.
+
+// The names shown for the items being diffed, from --label, keyed by the
+// item as specified on the command line
+var labels map[string]string
+
+// Whether path is a stream, such as /dev/fd/63, rather than a regular file or
+// directory. /dev/null is not a stream, as it is used to diff added or
+// removed files.
+func is_stream(path string) bool {
+	s, err := os.Stat(path)
+	if err != nil || s.Mode().IsRegular() || s.IsDir() {
+		return false
+	}
+	if dn, err := os.Stat(os.DevNull); err == nil && os.SameFile(s, dn) {
+		return false
+	}
+	return true
+}
+
+// Copy the contents of the stream into a temporary file, whose name ends with
+// name so that the syntax highlighting is correct
+func read_stream(r io.Reader, name string) (string, error) {
+	tdir, err := os.MkdirTemp("", "kitty-diff-stream-*")
+	if err != nil {
+		return "", err
+	}
+	// ensure the temporary directory is removed on exit
+	remote_dirs[tdir] = ""
+	name = filepath.Base(name)
+	if name == "." || name == string(filepath.Separator) || name == "-" {
+		name = "stdin"
+	}
+	f, err := os.Create(filepath.Join(tdir, name))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, r); err != nil {
+		return "", fmt.Errorf("Failed to read from %s with error: %w", name, err)
+	}
+	return f.Name(), nil
+}
+
+// The items to diff, with the specified file descriptors first, followed by
+// args. Streams are copied into temporary files and the display names of the
+// items are set from the specified labels.
+func resolve_streams(fds, args, label_list []string) (ans []string, err error) {
+	labels = make(map[string]string, len(label_list))
+	label_for := func(idx int, defval string) string {
+		if idx < len(label_list) {
+			return label_list[idx]
+		}
+		return defval
+	}
+	stdin_used := false
+	for _, x := range fds {
+		fd, err := strconv.Atoi(x)
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("Invalid file descriptor: %#v", x)
+		}
+		label := label_for(len(ans), "fd:"+x)
+		var path string
+		if fd == 0 {
+			stdin_used = true
+			path, err = read_stream(os.Stdin, label)
+		} else {
+			f := os.NewFile(uintptr(fd), "fd:"+x)
+			path, err = read_stream(f, label)
+			f.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		labels[path] = label
+		ans = append(ans, path)
+	}
+	for _, x := range args {
+		path := x
+		switch {
+		case x == "-":
+			if stdin_used {
+				return nil, fmt.Errorf("STDIN can only be diffed once")
+			}
+			stdin_used = true
+			if path, err = read_stream(os.Stdin, label_for(len(ans), "stdin")); err != nil {
+				return nil, err
+			}
+			labels[path] = label_for(len(ans), "STDIN")
+		case is_stream(x):
+			f, err := os.Open(x)
+			if err != nil {
+				return nil, err
+			}
+			path, err = read_stream(f, label_for(len(ans), x))
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			labels[path] = label_for(len(ans), x)
+		default:
+			if len(ans) < len(label_list) {
+				labels[path] = label_list[len(ans)]
+			}
+		}
+		ans = append(ans, path)
+	}
+	return
+}
+
+// The name to show for an item specified on the command line
+func display_name(item string) string {
+	if ans, found := labels[item]; found {
+		return ans
+	}
+	return item
+}
@@ -0,0 +1,55 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestDiffStreams(t *testing.T) {
+	init_caches()
+	defer func() {
+		for tdir := range remote_dirs {
+			os.RemoveAll(tdir)
+		}
+	}()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		_, _ = w.WriteString("from a pipe\n")
+		w.Close()
+	}()
+	if !is_stream(fmt.Sprintf("/dev/fd/%d", r.Fd())) {
+		t.Fatalf("A pipe was not recognized as a stream")
+	}
+	if is_stream(os.DevNull) {
+		t.Fatalf("%s was recognized as a stream", os.DevNull)
+	}
+	regular := filepath.Join(t.TempDir(), "regular")
+	_ = os.WriteFile(regular, []byte("regular\n"), 0o600)
+	if is_stream(regular) {
+		t.Fatalf("A regular file was recognized as a stream")
+	}
+	paths, err := resolve_streams([]string{strconv.Itoa(int(r.Fd()))}, []string{regular}, []string{"old.py", "new.py"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || paths[1] != regular || filepath.Base(paths[0]) != "old.py" {
+		t.Fatalf("Incorrect paths for streams: %#v", paths)
+	}
+	if data, err := os.ReadFile(paths[0]); err != nil || string(data) != "from a pipe\n" {
+		t.Fatalf("Incorrect data read from stream: %#v %v", string(data), err)
+	}
+	if display_name(paths[0]) != "old.py" || display_name(paths[1]) != "new.py" {
+		t.Fatalf("Incorrect labels: %#v %#v", display_name(paths[0]), display_name(paths[1]))
+	}
+}
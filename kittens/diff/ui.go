@@ -7,6 +7,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"kitty/tools/config"
 	"kitty/tools/tui"
@@ -24,9 +25,22 @@ type ResultType int
 const (
 	COLLECTION ResultType = iota
 	DIFF
+	DIFF_PROGRESS
 	HIGHLIGHT
 	IMAGE_LOAD
 	IMAGE_RESIZE
+	IMAGE_COMPARE
+	MERGE
+)
+
+// What the text being input in the status line is for
+type InputType int
+
+const (
+	SEARCH_INPUT InputType = iota
+	FILE_JUMP_INPUT
+	LINE_JUMP_INPUT
+	EXPORT_INPUT
 )
 
 type ScrollPos struct {
@@ -47,6 +61,8 @@ type AsyncResult struct {
 	collection *Collection
 	diff_map   map[string]*Patch
 	page_size  graphics.Size
+	merge      *Merge
+	generation int
 }
 
 var image_collection *graphics.ImageCollection
@@ -57,9 +73,18 @@ type Handler struct {
 	mouse_selection                                     tui.MouseSelection
 	image_count                                         int
 	shortcut_tracker                                    config.ShortcutTracker
-	left, right                                         string
+	left, right, base                                   string
+	merge                                               *Merge
+	git_diff                                            *GitDiff
+	merge_written                                       bool
+	unified                                             bool
+	image_comparison                                    image_comparison
 	collection                                          *Collection
 	diff_map                                            map[string]*Patch
+	diff_generation, num_diffs_pending, num_diffs       int
+	ignore_whitespace                                   ignore_whitespace
+	diff_algorithm                                      Diff_algorithm_Choice_Type
+	folds                                               map[unchanged_region]fold_expansion
 	logical_lines                                       *LogicalLines
 	lp                                                  *loop.Loop
 	current_context_count, original_context_count       int
@@ -68,12 +93,18 @@ type Handler struct {
 	scroll_pos, max_scroll_pos                          ScrollPos
 	restore_position                                    *ScrollPos
 	inputting_command                                   bool
+	input_type                                          InputType
+	show_overview, show_minimap                         bool
+	overview                                            []overview_entry
+	overview_offset                                     int
 	statusline_message                                  string
 	rl                                                  *readline.Readline
 	current_search                                      *Search
 	current_search_is_regex, current_search_is_backward bool
+	current_search_scope                                SearchScope
 	largest_line_number                                 int
 	images_resized_to                                   graphics.Size
+	progress_render_cache                               *render_cache
 }
 
 func (self *Handler) calculate_statistics() {
@@ -122,6 +153,11 @@ func (self *Handler) initialize() {
 	sz, _ := self.lp.ScreenSize()
 	self.update_screen_size(sz)
 	self.original_context_count = self.current_context_count
+	self.unified = conf.Layout == Layout_unified
+	self.show_overview, self.show_minimap = conf.Show_overview, conf.Show_minimap
+	self.diff_algorithm = conf.Diff_algorithm
+	self.folds = make(map[unchanged_region]fold_expansion)
+	self.image_comparison = image_comparison{mode: conf.Image_compare_mode, swipe_position: 50}
 	self.lp.SetDefaultColor(loop.FOREGROUND, conf.Foreground)
 	self.lp.SetDefaultColor(loop.CURSOR, conf.Foreground)
 	self.lp.SetDefaultColor(loop.BACKGROUND, conf.Background)
@@ -132,7 +168,14 @@ func (self *Handler) initialize() {
 	self.async_results = make(chan AsyncResult, 32)
 	go func() {
 		r := AsyncResult{}
-		r.collection, r.err = create_collection(self.left, self.right)
+		if self.base != "" {
+			r.rtype = MERGE
+			r.merge, r.err = create_merge(self.left, self.base, self.right)
+		} else if self.git_diff != nil {
+			r.collection, r.err = self.git_diff.Collection()
+		} else {
+			r.collection, r.err = create_collection(self.left, self.right)
+		}
 		self.async_results <- r
 		self.lp.WakeupMainThread()
 	}()
@@ -141,6 +184,11 @@ func (self *Handler) initialize() {
 
 func (self *Handler) generate_diff() {
 	self.diff_map = nil
+	self.progress_render_cache = nil
+	// the unchanged regions depend on the hunks
+	clear(self.folds)
+	self.diff_generation++
+	generation := self.diff_generation
 	jobs := make([]diff_job, 0, 32)
 	_ = self.collection.Apply(func(path, typ, changed_path string) error {
 		if typ == "diff" {
@@ -150,9 +198,15 @@ func (self *Handler) generate_diff() {
 		}
 		return nil
 	})
+	self.num_diffs = len(jobs)
 	go func() {
-		r := AsyncResult{rtype: DIFF}
-		r.diff_map, r.err = diff(jobs, self.current_context_count)
+		// show the diffs computed so far while waiting for the rest, so that
+		// large numbers of files can be viewed without waiting for all of them
+		r := AsyncResult{rtype: DIFF, generation: generation}
+		r.diff_map, r.err = diff_incrementally(jobs, self.current_context_count, self.ignore_whitespace, self.diff_algorithm, 250*time.Millisecond, func(partial map[string]*Patch) {
+			self.async_results <- AsyncResult{rtype: DIFF_PROGRESS, diff_map: partial, generation: generation}
+			self.lp.WakeupMainThread()
+		})
 		self.async_results <- r
 		self.lp.WakeupMainThread()
 	}()
@@ -231,8 +285,12 @@ func (self *Handler) resize_all_images_if_needed() {
 	}
 }
 
+func (self *Handler) has_content() bool {
+	return self.merge != nil || (self.diff_map != nil && self.collection != nil)
+}
+
 func (self *Handler) rerender_diff() error {
-	if self.diff_map != nil && self.collection != nil {
+	if self.has_content() {
 		err := self.render_diff()
 		if err != nil {
 			return err
@@ -249,27 +307,62 @@ func (self *Handler) handle_async_result(r AsyncResult) error {
 		self.generate_diff()
 		self.highlight_all()
 		self.load_all_images()
-	case DIFF:
+	case DIFF, DIFF_PROGRESS:
+		if r.generation != self.diff_generation {
+			// results from a diff that has since been superseded
+			return nil
+		}
+		// keep the scroll position if the partial diff was already shown
+		keep_position := self.diff_map != nil
 		self.diff_map = r.diff_map
+		self.num_diffs_pending = 0
+		var cache *render_cache
+		if r.rtype == DIFF {
+			self.progress_render_cache = nil
+		} else {
+			self.num_diffs_pending = self.num_diffs - len(r.diff_map)
+			// only the files whose diffs have changed need to be rendered again
+			if self.progress_render_cache == nil {
+				self.progress_render_cache = &render_cache{}
+			}
+			cache = self.progress_render_cache
+		}
 		self.calculate_statistics()
 		self.clear_mouse_selection()
-		err := self.render_diff()
+		err := self.render_diff_using(cache)
 		if err != nil {
 			return err
 		}
-		self.scroll_pos = ScrollPos{}
+		if !keep_position {
+			self.scroll_pos = ScrollPos{}
+		}
 		if self.restore_position != nil {
 			self.scroll_pos = *self.restore_position
-			if self.max_scroll_pos.Less(self.scroll_pos) {
-				self.scroll_pos = self.max_scroll_pos
-			}
 			self.restore_position = nil
 		}
+		if self.max_scroll_pos.Less(self.scroll_pos) {
+			self.scroll_pos = self.max_scroll_pos
+		}
+		self.draw_screen()
+	case MERGE:
+		self.merge = r.merge
+		paths := []string{self.left, self.base, self.right}
+		go func() {
+			highlight_all(paths)
+			self.async_results <- AsyncResult{rtype: HIGHLIGHT}
+			self.lp.WakeupMainThread()
+		}()
+		if err := self.render_diff(); err != nil {
+			return err
+		}
 		self.draw_screen()
 	case IMAGE_RESIZE:
 		self.images_resized_to = r.page_size
 		return self.rerender_diff()
-	case IMAGE_LOAD, HIGHLIGHT:
+	case IMAGE_LOAD:
+		self.create_image_comparisons()
+		return self.rerender_diff()
+	case IMAGE_COMPARE, HIGHLIGHT:
 		return self.rerender_diff()
 	}
 	return nil
@@ -278,7 +371,7 @@ func (self *Handler) handle_async_result(r AsyncResult) error {
 func (self *Handler) on_resize(old_size, new_size loop.ScreenSize) error {
 	self.clear_mouse_selection()
 	self.update_screen_size(new_size)
-	if self.diff_map != nil && self.collection != nil {
+	if self.has_content() {
 		err := self.render_diff()
 		if err != nil {
 			return err
@@ -292,16 +385,32 @@ func (self *Handler) on_resize(old_size, new_size loop.ScreenSize) error {
 }
 
 func (self *Handler) render_diff() (err error) {
-	if self.screen_size.columns < 8 {
+	// the rendering of any of the files may have changed
+	self.progress_render_cache = nil
+	return self.render_diff_using(nil)
+}
+
+func (self *Handler) render_diff_using(cache *render_cache) (err error) {
+	sz := self.screen_size
+	sz.columns = self.diff_columns()
+	if sz.columns < 8 {
 		return fmt.Errorf("Screen too narrow, need at least 8 columns")
 	}
 	if self.screen_size.rows < 2 {
 		return fmt.Errorf("Screen too short, need at least 2 rows")
 	}
-	self.logical_lines, err = render(self.collection, self.diff_map, self.screen_size, self.largest_line_number, self.images_resized_to)
+	if self.merge != nil {
+		self.logical_lines, err = self.merge.Render(sz, self.current_context_count)
+	} else {
+		self.logical_lines, err = render(self.collection, self.diff_map, sz, self.largest_line_number, self.images_resized_to, self.unified, self.image_comparison, self.folds, cache)
+	}
 	if err != nil {
 		return err
 	}
+	self.overview = nil
+	if self.merge == nil {
+		self.overview = overview_entries(self.collection, self.diff_map, self.logical_lines)
+	}
 	last := self.logical_lines.Len() - 1
 	self.max_scroll_pos.logical_line = last
 	if last > -1 {
@@ -346,7 +455,7 @@ func (self *Handler) draw_screen() {
 	}
 	lp.MoveCursorTo(1, 1)
 	lp.ClearToEndOfScreen()
-	if self.logical_lines == nil || self.diff_map == nil || self.collection == nil {
+	if self.logical_lines == nil || !self.has_content() {
 		lp.Println(`Calculating diff, please wait...`)
 		return
 	}
@@ -378,11 +487,17 @@ func (self *Handler) draw_screen() {
 			break
 		}
 	}
+	if self.minimap_visible() {
+		self.draw_minimap()
+	}
+	if self.overview_visible() {
+		self.draw_overview()
+	}
 	self.draw_status_line()
 }
 
 func (self *Handler) draw_status_line() {
-	if self.logical_lines == nil || self.diff_map == nil {
+	if self.logical_lines == nil || !self.has_content() {
 		return
 	}
 	self.lp.MoveCursorTo(1, self.screen_size.rows)
@@ -401,13 +516,23 @@ func (self *Handler) draw_status_line() {
 		}
 		sp := statusline_format(fmt.Sprintf("%d%%", frac))
 		var counts string
-		if self.current_search == nil {
-			counts = added_count_format(strconv.Itoa(self.added_count)) + statusline_format(`,`) + removed_count_format(strconv.Itoa(self.removed_count))
-		} else {
+		if self.current_search != nil {
 			counts = statusline_format(fmt.Sprintf("%d matches", self.current_search.Len()))
+		} else if self.merge != nil {
+			counts = statusline_format(self.merge.StatusText())
+		} else if self.num_diffs_pending > 0 {
+			counts = statusline_format(fmt.Sprintf("Diffing: %d of %d files done", self.num_diffs-self.num_diffs_pending, self.num_diffs))
+		} else {
+			counts = added_count_format(strconv.Itoa(self.added_count)) + statusline_format(`,`) + removed_count_format(strconv.Itoa(self.removed_count))
 		}
 		suffix := counts + "  " + sp
 		prefix := statusline_format(":")
+		if self.ignore_whitespace.is_set() {
+			prefix += statusline_format(" ignoring " + self.ignore_whitespace.String())
+		}
+		if self.diff_algorithm != Diff_algorithm_default {
+			prefix += statusline_format(" algorithm: " + self.diff_algorithm.String())
+		}
 		filler := strings.Repeat(" ", utils.Max(0, self.screen_size.columns-wcswidth.Stringwidth(prefix)-wcswidth.Stringwidth(suffix)))
 		self.lp.QueueWriteString(prefix + filler + suffix)
 	}
@@ -440,10 +565,14 @@ func (self *Handler) do_search(query string) {
 		self.lp.Beep()
 		return
 	}
-	self.current_search = do_search(pat, self.logical_lines)
+	self.current_search = do_search(pat, self.current_search_scope, self.logical_lines)
 	if self.current_search.Len() == 0 {
 		self.current_search = nil
-		self.statusline_message = fmt.Sprintf("No matches for: %#v", query)
+		if self.current_search_scope == SEARCH_ALL {
+			self.statusline_message = fmt.Sprintf("No matches for: %#v", query)
+		} else {
+			self.statusline_message = fmt.Sprintf("No matches in %s lines for: %#v", self.current_search_scope, query)
+		}
 		self.lp.Beep()
 	} else {
 		if self.scroll_to_next_match(false, true) {
@@ -465,7 +594,16 @@ func (self *Handler) on_key_event(ev *loop.KeyEvent) error {
 		if ev.MatchesPressOrRepeat("enter") {
 			self.inputting_command = false
 			ev.Handled = true
-			self.do_search(self.rl.AllText())
+			switch self.input_type {
+			case FILE_JUMP_INPUT:
+				self.jump_to_file(self.rl.AllText())
+			case LINE_JUMP_INPUT:
+				self.jump_to_line(self.rl.AllText())
+			case EXPORT_INPUT:
+				self.export_patch(self.rl.AllText())
+			default:
+				self.do_search(self.rl.AllText())
+			}
 			self.draw_screen()
 			return nil
 		}
@@ -562,21 +700,123 @@ func (self *Handler) change_context_count(val int) bool {
 	}
 	self.current_context_count = val
 	p := self.scroll_pos
+	self.clear_mouse_selection()
+	if self.merge != nil {
+		// merges are rendered synchronously
+		if self.render_diff() == nil {
+			if self.max_scroll_pos.Less(p) {
+				p = self.max_scroll_pos
+			}
+			self.scroll_pos = p
+		}
+	} else {
+		self.restore_position = &p
+		self.generate_diff()
+	}
+	self.draw_screen()
+	return true
+}
+
+func (self *Handler) toggle_ignore_whitespace(which string) error {
+	if self.merge != nil || !self.has_content() {
+		self.lp.Beep()
+		return nil
+	}
+	switch which {
+	case `all`:
+		self.ignore_whitespace.all = !self.ignore_whitespace.all
+	case `trailing`:
+		self.ignore_whitespace.trailing = !self.ignore_whitespace.trailing
+	case `blank_lines`:
+		self.ignore_whitespace.blank_lines = !self.ignore_whitespace.blank_lines
+	default:
+		return fmt.Errorf("Unknown type of whitespace to ignore: %#v", which)
+	}
+	p := self.scroll_pos
+	self.restore_position = &p
+	self.clear_mouse_selection()
+	self.generate_diff()
+	self.draw_screen()
+	return nil
+}
+
+func (self *Handler) cycle_diff_algorithm() {
+	if self.merge != nil || !self.has_content() {
+		self.lp.Beep()
+		return
+	}
+	idx := 0
+	for i, a := range all_diff_algorithms {
+		if a == self.diff_algorithm {
+			idx = i
+		}
+	}
+	self.diff_algorithm = all_diff_algorithms[(idx+1)%len(all_diff_algorithms)]
+	p := self.scroll_pos
 	self.restore_position = &p
 	self.clear_mouse_selection()
 	self.generate_diff()
 	self.draw_screen()
+}
+
+// Re-render the diff after a change to its layout, keeping the line at the
+// top of the screen in place
+func (self *Handler) relayout() error {
+	anchor := self.logical_lines.At(self.scroll_pos.logical_line)
+	self.clear_mouse_selection()
+	if err := self.render_diff(); err != nil {
+		return err
+	}
+	self.scroll_pos = ScrollPos{logical_line: self.logical_lines.Find(anchor)}
+	if self.max_scroll_pos.Less(self.scroll_pos) {
+		self.scroll_pos = self.max_scroll_pos
+	}
+	self.draw_screen()
+	return nil
+}
+
+// Switch between the side-by-side and unified layouts
+func (self *Handler) toggle_layout() (bool, error) {
+	if self.merge != nil || !self.has_content() || self.logical_lines == nil {
+		return false, nil
+	}
+	self.unified = !self.unified
+	return true, self.relayout()
+}
+
+// Resolve the first conflict visible on screen
+func (self *Handler) resolve_conflict(resolution MergeResolution) bool {
+	if self.merge == nil {
+		return false
+	}
+	bottom := self.scroll_pos
+	self.logical_lines.IncrementScrollPosBy(&bottom, self.screen_size.num_lines-1)
+	c := self.merge.ConflictAt(self.scroll_pos.logical_line, bottom.logical_line)
+	if c == nil {
+		return false
+	}
+	c.resolution = resolution
+	if err := self.rerender_diff(); err != nil {
+		return false
+	}
 	return true
 }
 
-func (self *Handler) start_search(is_regex, is_backward bool) {
+func (self *Handler) start_search(is_regex, is_backward bool, scope SearchScope) {
 	if self.inputting_command {
 		self.lp.Beep()
 		return
 	}
 	self.inputting_command = true
+	self.input_type = SEARCH_INPUT
 	self.current_search_is_regex = is_regex
 	self.current_search_is_backward = is_backward
+	self.current_search_scope = scope
+	prompt := "/"
+	if scope != SEARCH_ALL {
+		prompt = fmt.Sprintf("(%s) /", scope)
+	}
+	self.rl.SetPrompt(prompt)
 	self.rl.SetText(``)
 	self.draw_status_line()
 }
@@ -599,6 +839,14 @@ func (self *Handler) dispatch_action(name, args string) error {
 		} else {
 			self.lp.CopyTextToClipboard(text)
 		}
+	case `toggle_ignore_whitespace`:
+		return self.toggle_ignore_whitespace(args)
+	case `cycle_diff_algorithm`:
+		self.cycle_diff_algorithm()
+	case `copy_hunk`:
+		return self.copy_hunk(args)
+	case `copy_line`:
+		return self.copy_line(args != `left`)
 	case `scroll_by`:
 		if args == "" {
 			args = "1"
@@ -653,10 +901,90 @@ func (self *Handler) dispatch_action(name, args string) error {
 		if !self.change_context_count(new_ctx) {
 			self.lp.Beep()
 		}
+	case `resolve_conflict`:
+		resolution := UNRESOLVED
+		switch args {
+		case `ours`:
+			resolution = RESOLVED_OURS
+		case `theirs`:
+			resolution = RESOLVED_THEIRS
+		case `both`:
+			resolution = RESOLVED_BOTH
+		case `base`:
+			resolution = RESOLVED_BASE
+		}
+		if !self.resolve_conflict(resolution) {
+			self.lp.Beep()
+		}
+	case `edit_file`:
+		return self.edit_file(args != `left`)
+	case `cycle_image_mode`:
+		if self.image_count == 0 {
+			self.lp.Beep()
+			return nil
+		}
+		self.cycle_image_mode()
+		return self.rerender_diff()
+	case `move_swipe`:
+		amt, err := strconv.Atoi(args)
+		if err != nil {
+			return fmt.Errorf("Invalid amount to move the swipe line by: %#v", args)
+		}
+		if !self.move_swipe(amt) {
+			self.lp.Beep()
+			return nil
+		}
+		return self.rerender_diff()
+	case `toggle_sidebar`:
+		return self.toggle_sidebar(args)
+	case `export_patch`:
+		if args != "" {
+			if self.merge != nil || !self.has_content() {
+				self.lp.Beep()
+			} else {
+				self.export_patch(args)
+				self.draw_status_line()
+			}
+		} else {
+			self.start_export()
+		}
+	case `jump_to_file`:
+		if self.has_content() && self.logical_lines != nil {
+			self.start_file_jump()
+		}
+	case `expand_fold`:
+		return self.expand_fold(args)
+	case `jump_to_line`:
+		if self.has_content() && self.logical_lines != nil {
+			self.start_line_jump()
+		}
+	case `toggle_layout`:
+		done, err := self.toggle_layout()
+		if err != nil {
+			return err
+		}
+		if !done {
+			self.lp.Beep()
+		}
+	case `write_merge`:
+		if self.merge == nil {
+			self.lp.Beep()
+		} else {
+			self.merge_written = true
+			self.lp.Quit(0)
+		}
 	case `start_search`:
-		if self.diff_map != nil && self.logical_lines != nil {
-			a, b, _ := strings.Cut(args, " ")
-			self.start_search(config.StringToBool(a), config.StringToBool(b))
+		if self.has_content() && self.logical_lines != nil {
+			a, rest, _ := strings.Cut(args, " ")
+			b, c, _ := strings.Cut(rest, " ")
+			scope := SEARCH_ALL
+			switch c {
+			case `added`:
+				scope = SEARCH_ADDED
+			case `removed`:
+				scope = SEARCH_REMOVED
+			}
+			self.start_search(config.StringToBool(a), config.StringToBool(b), scope)
 		}
 	}
 	return nil
@@ -671,6 +999,9 @@ func (self *Handler) on_mouse_event(ev *loop.MouseEvent) error {
 		return nil
 	}
 	if ev.Event_type == loop.MOUSE_PRESS && ev.Buttons&loop.LEFT_MOUSE_BUTTON != 0 {
+		if self.handle_sidebar_click(ev.Cell.X, ev.Cell.Y) {
+			return nil
+		}
 		self.start_mouse_selection(ev)
 		return nil
 	}
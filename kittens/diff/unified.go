@@ -0,0 +1,171 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var _ = fmt.Print
+
+// Rendering of diffs in a single column, with removed lines followed by added
+// lines, for windows too narrow for the side-by-side layout
+
+func unified_title_lines(left_path, right_path, note string, columns, margin_size int, ans []*LogicalLine) []*LogicalLine {
+	left_name, right_name := path_name_map[left_path], path_name_map[right_path]
+	ll := LogicalLine{
+		line_type: TITLE_LINE, is_full_width: true,
+		left_reference: Reference{path: left_path}, right_reference: Reference{path: right_path},
+	}
+	title := sanitize(left_name)
+	if right_name != "" && right_name != left_name {
+		title += " → " + sanitize(right_name)
+	}
+	if note != "" {
+		title += " (" + note + ")"
+	}
+	sl := ScreenLine{}
+	sl.left.marked_up_text = format_as_sgr.title + fit_in(title, columns-margin_size)
+	ll.screen_lines = append(ll.screen_lines, &sl)
+	l2 := ll
+	l2.line_type = EMPTY_LINE
+	sl2 := ScreenLine{}
+	sl2.left.marked_up_margin_text = "\x1b[m" + strings.Repeat("━", margin_size)
+	sl2.left.marked_up_text = strings.Repeat("━", columns-margin_size)
+	l2.screen_lines = []*ScreenLine{&sl2}
+	return append(ans, &ll, &l2)
+}
+
+// The margin text for the unified layout, with the line numbers of the old
+// and new versions of the line in the two halves of the margin. A line number
+// of zero means the line does not exist in that version.
+func dual_line_numbers(left, right, margin_size int) string {
+	l, r := "", ""
+	if left > 0 {
+		l = strconv.Itoa(left)
+	}
+	if right > 0 {
+		r = strconv.Itoa(right)
+	}
+	return place_in(l, margin_size/2) + r
+}
+
+func unified_line(line_type LineType, hlines []HalfScreenLine, ans *LogicalLine) *LogicalLine {
+	ans.line_type, ans.is_full_width = line_type, true
+	for _, hl := range hlines {
+		ans.screen_lines = append(ans.screen_lines, &ScreenLine{left: hl})
+	}
+	return ans
+}
+
+func unified_lines_for_context_chunk(data *DiffData, chunk *Chunk, ans []*LogicalLine) []*LogicalLine {
+	for i := 0; i < chunk.left_count; i++ {
+		left_line_number, right_line_number := chunk.left_start+i, chunk.right_start+i
+		hlines := render_half_line(right_line_number, data.left_lines[left_line_number], "context", data.available_cols, nil, nil)
+		hlines[0].marked_up_margin_text = dual_line_numbers(left_line_number+1, right_line_number+1, data.margin_size)
+		ans = append(ans, unified_line(CONTEXT_LINE, hlines, &LogicalLine{
+			left_reference:  Reference{path: data.left_path, linenum: left_line_number + 1},
+			right_reference: Reference{path: data.right_path, linenum: right_line_number + 1},
+		}))
+	}
+	return ans
+}
+
+func unified_lines_for_diff_chunk(data *DiffData, chunk *Chunk, ans []*LogicalLine) []*LogicalLine {
+	for i := 0; i < chunk.left_count; i++ {
+		var changes []Region
+		if i < len(chunk.changes) {
+			changes = chunk.changes[i].left
+		}
+		lnum := chunk.left_start + i
+		hlines := render_half_line(lnum, data.left_lines[lnum], "remove", data.available_cols, changes, nil)
+		hlines[0].marked_up_margin_text = dual_line_numbers(lnum+1, 0, data.margin_size)
+		ans = append(ans, unified_line(CHANGE_LINE, hlines, &LogicalLine{
+			is_change_start: i == 0, left_reference: Reference{path: data.left_path, linenum: lnum + 1},
+		}))
+	}
+	for i := 0; i < chunk.right_count; i++ {
+		var changes []Region
+		if i < len(chunk.changes) {
+			changes = chunk.changes[i].right
+		}
+		lnum := chunk.right_start + i
+		hlines := render_half_line(lnum, data.right_lines[lnum], "add", data.available_cols, changes, nil)
+		hlines[0].marked_up_margin_text = dual_line_numbers(0, lnum+1, data.margin_size)
+		ans = append(ans, unified_line(ADDED_LINE, hlines, &LogicalLine{
+			is_change_start: i == 0 && chunk.left_count == 0, right_reference: Reference{path: data.right_path, linenum: lnum + 1},
+		}))
+	}
+	return ans
+}
+
+func unified_lines_for_diff(left_path string, right_path string, patch *Patch, columns, margin_size int, folds map[unchanged_region]fold_expansion, ans []*LogicalLine) (result []*LogicalLine, err error) {
+	if patch == nil || patch.Len() == 0 {
+		return lines_for_diff(left_path, right_path, patch, columns, margin_size, folds, ans)
+	}
+	data := DiffData{left_path: left_path, right_path: right_path, available_cols: columns - margin_size, margin_size: margin_size}
+	if data.left_lines, err = highlighted_lines_for_path(left_path); err != nil {
+		return
+	}
+	if data.right_lines, err = highlighted_lines_for_path(right_path); err != nil {
+		return
+	}
+	regions := unchanged_regions(&data, patch)
+	for hunk_num, hunk := range patch.all_hunks {
+		ans = fold_lines(&data, regions[hunk_num], folds[regions[hunk_num]], true, columns-margin_size, ans)
+		htl := LogicalLine{
+			line_type: HUNK_TITLE_LINE, is_full_width: true,
+			left_reference:  Reference{path: left_path, linenum: hunk.left_start + 1},
+			right_reference: Reference{path: right_path, linenum: hunk.right_start + 1},
+		}
+		for _, line := range splitlines(hunk_title(hunk), columns-margin_size) {
+			sl := ScreenLine{}
+			sl.left.marked_up_text = line
+			htl.screen_lines = append(htl.screen_lines, &sl)
+		}
+		ans = append(ans, &htl)
+		for _, chunk := range hunk.chunks {
+			if chunk.is_context {
+				ans = unified_lines_for_context_chunk(&data, chunk, ans)
+			} else {
+				ans = unified_lines_for_diff_chunk(&data, chunk, ans)
+			}
+		}
+	}
+	last := regions[len(regions)-1]
+	return fold_lines(&data, last, folds[last], true, columns-margin_size, ans), nil
+}
+
+func unified_all_lines(path string, columns, margin_size int, is_add bool, ans []*LogicalLine) ([]*LogicalLine, error) {
+	lines, err := highlighted_lines_for_path(path)
+	if err != nil {
+		return nil, err
+	}
+	msg, ltype, line_type := `This file was removed`, `remove`, CHANGE_LINE
+	if is_add {
+		msg, ltype, line_type = `This file was added`, `add`, ADDED_LINE
+	}
+	ht := LogicalLine{line_type: HUNK_TITLE_LINE, is_full_width: true}
+	for _, line := range splitlines(msg, columns-margin_size) {
+		sl := ScreenLine{}
+		sl.left.marked_up_text = line
+		ht.screen_lines = append(ht.screen_lines, &sl)
+	}
+	ans = append(ans, &ht)
+	for line_number, line := range lines {
+		ll := LogicalLine{is_change_start: line_number == 0}
+		ref := Reference{path: path, linenum: line_number + 1}
+		hlines := render_half_line(line_number, line, ltype, columns-margin_size, nil, nil)
+		if is_add {
+			ll.right_reference = ref
+			hlines[0].marked_up_margin_text = dual_line_numbers(0, line_number+1, margin_size)
+		} else {
+			ll.left_reference = ref
+			hlines[0].marked_up_margin_text = dual_line_numbers(line_number+1, 0, margin_size)
+		}
+		ans = append(ans, unified_line(line_type, hlines, &ll))
+	}
+	return ans, nil
+}
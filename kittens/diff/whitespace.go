@@ -0,0 +1,128 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+var _ = fmt.Print
+
+// The differences in whitespace to ignore when diffing
+type ignore_whitespace struct {
+	all, trailing, blank_lines bool
+}
+
+func (self ignore_whitespace) String() string {
+	ans := make([]string, 0, 3)
+	if self.all {
+		ans = append(ans, "all whitespace")
+	} else if self.trailing {
+		ans = append(ans, "trailing whitespace")
+	}
+	if self.blank_lines {
+		ans = append(ans, "blank lines")
+	}
+	return strings.Join(ans, ", ")
+}
+
+func (self ignore_whitespace) is_set() bool {
+	return self.all || self.trailing || self.blank_lines
+}
+
+// Only git and diff have known flags for ignoring whitespace
+func (self ignore_whitespace) is_supported_by(exe string) bool {
+	switch filepath.Base(exe) {
+	case "git", "diff":
+		return true
+	}
+	return false
+}
+
+// Command line flags for the specified diff program, only git and diff are
+// supported
+func (self ignore_whitespace) flags(exe string) (ans []string) {
+	switch filepath.Base(exe) {
+	case "git":
+		if self.all {
+			ans = append(ans, "--ignore-all-space")
+		} else if self.trailing {
+			ans = append(ans, "--ignore-space-at-eol")
+		}
+		if self.blank_lines {
+			ans = append(ans, "--ignore-blank-lines")
+		}
+	case "diff":
+		if self.all {
+			ans = append(ans, "-w")
+		} else if self.trailing {
+			ans = append(ans, "-Z")
+		}
+		if self.blank_lines {
+			ans = append(ans, "-B")
+		}
+	}
+	return
+}
+
+// Add the flags to the diff command, before the -- that separates the paths
+func (self ignore_whitespace) add_flags(cmd []string) []string {
+	return insert_flags(cmd, self.flags(cmd[0]))
+}
+
+// Remove the whitespace to be ignored from every line of the text, keeping the
+// number of lines unchanged, for use with the builtin differ
+func (self ignore_whitespace) normalize(text string) string {
+	if !self.all && !self.trailing {
+		return text
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if self.all {
+			lines[i] = strings.Map(func(r rune) rune {
+				if unicode.IsSpace(r) {
+					return -1
+				}
+				return r
+			}, line)
+		} else {
+			lines[i] = strings.TrimRightFunc(line, unicode.IsSpace)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func is_blank(lines []string, start, count int) bool {
+	for i := start; i < start+count && i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Remove the hunks that only add or remove blank lines, for use with the
+// builtin differ
+func (self *Patch) remove_blank_line_hunks(left_lines, right_lines []string) {
+	hunks := make([]*Hunk, 0, len(self.all_hunks))
+	self.added_count, self.removed_count, self.largest_line_number = 0, 0, 0
+	for _, h := range self.all_hunks {
+		only_blanks := true
+		for _, c := range h.chunks {
+			if !c.is_context && !(is_blank(left_lines, c.left_start, c.left_count) && is_blank(right_lines, c.right_start, c.right_count)) {
+				only_blanks = false
+				break
+			}
+		}
+		if !only_blanks {
+			hunks = append(hunks, h)
+			self.added_count += h.added_count
+			self.removed_count += h.removed_count
+			self.largest_line_number = h.largest_line_number
+		}
+	}
+	self.all_hunks = hunks
+}
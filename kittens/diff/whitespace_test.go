@@ -0,0 +1,107 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package diff
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kitty/tools/tui/loop"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestDiffIgnoreWhitespace(t *testing.T) {
+	conf = NewConfig()
+	init_caches()
+	diff_cmd = []string{}
+	tdir := t.TempDir()
+	left, right := filepath.Join(tdir, "left"), filepath.Join(tdir, "right")
+	_ = os.WriteFile(left, []byte("a\nb c\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\n"), 0o600)
+	_ = os.WriteFile(right, []byte("a\nb  c\nd \ne\nf\ng\n\nh\ni\nj\nk\nl\nM\n"), 0o600)
+	tc := func(ws ignore_whitespace, expected ...string) {
+		t.Helper()
+		patch, err := do_diff(left, right, 0, ws, Diff_algorithm_default)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := []string{}
+		for _, h := range patch.all_hunks {
+			actual = append(actual, hunk_title(h))
+		}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Fatalf("Incorrect hunks when ignoring %s:\n%s", ws, diff)
+		}
+	}
+	tc(ignore_whitespace{}, "@@ -2,2 +2,2 @@ ", "@@ -6,0 +7,1 @@ ", "@@ -12,1 +13,1 @@ ")
+	tc(ignore_whitespace{trailing: true}, "@@ -2,1 +2,1 @@ ", "@@ -6,0 +7,1 @@ ", "@@ -12,1 +13,1 @@ ")
+	tc(ignore_whitespace{all: true}, "@@ -6,0 +7,1 @@ ", "@@ -12,1 +13,1 @@ ")
+	tc(ignore_whitespace{all: true, blank_lines: true}, "@@ -12,1 +13,1 @@ ")
+	ws := ignore_whitespace{all: true, blank_lines: true}
+	if diff := cmp.Diff([]string{"git", "diff", "--ignore-all-space", "--ignore-blank-lines", "--"}, ws.add_flags([]string{"git", "diff", "--"})); diff != "" {
+		t.Fatalf("Incorrect flags for git:\n%s", diff)
+	}
+}
+
+func TestDiffToggleIgnoreWhitespace(t *testing.T) {
+	conf = NewConfig()
+	init_caches()
+	create_formatters()
+	diff_cmd = []string{}
+	defer func() { diff_cmd = []string{} }()
+	tdir := t.TempDir()
+	left, right := filepath.Join(tdir, "left"), filepath.Join(tdir, "right")
+	_ = os.WriteFile(left, []byte("a\nb c\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\n"), 0o600)
+	_ = os.WriteFile(right, []byte("a\nb  c\nd\ne\nf\ng\nh\ni\nj\nk\nl\nM\n"), 0o600)
+	l, err := loop.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lp = l
+	h := Handler{
+		lp: l, async_results: make(chan AsyncResult, 32), folds: make(map[unchanged_region]fold_expansion), current_context_count: 3,
+		screen_size: screen_size{rows: 24, columns: 80, num_lines: 23},
+	}
+	if h.collection, err = create_collection(left, right); err != nil {
+		t.Fatal(err)
+	}
+	// wait for the diff to be re-run and return the resulting number of changes
+	wait_for_diff := func() int {
+		t.Helper()
+		for {
+			r := <-h.async_results
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if err := h.handle_async_result(r); err != nil {
+				t.Fatal(err)
+			}
+			if r.rtype == DIFF {
+				return h.diff_map[left].added_count
+			}
+		}
+	}
+	h.generate_diff()
+	if n := wait_for_diff(); n != 2 {
+		t.Fatalf("Incorrect number of changes: %d", n)
+	}
+	// diff commands that do not support ignoring whitespace are replaced by
+	// the builtin differ while ignoring whitespace
+	diff_cmd = []string{filepath.Join(tdir, "no-such-differ")}
+	if err = h.toggle_ignore_whitespace("all"); err != nil {
+		t.Fatal(err)
+	}
+	if n := wait_for_diff(); n != 1 {
+		t.Fatalf("Whitespace not ignored: %d changes", n)
+	}
+	if !h.change_context_count(1) {
+		t.Fatalf("Context not changed")
+	}
+	if n := wait_for_diff(); n != 1 || !h.ignore_whitespace.all {
+		t.Fatalf("Whitespace not ignored after changing the context: %d changes", n)
+	}
+}
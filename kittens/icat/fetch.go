@@ -0,0 +1,196 @@
+// License: GPLv3 Copyright: 2024, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Images specified as URLs are all downloaded in parallel, as soon as icat
+// starts, rather than by the workers that decode the images, whose number is
+// limited by the number of CPUs. In the viewer, they are downloaded when they
+// are navigated to. The downloaded data is released once the images using it
+// have been decoded, so in the viewer, images are downloaded again when they
+// are navigated back to. Downloads can be cached on disk, keyed by the URL and
+// the request headers, which is useful when repeatedly displaying images from
+// an API that is being debugged. The request headers are sent only to the
+// host of the URL, not to other hosts it redirects to.
+
+const max_parallel_downloads = 8
+
+type download struct {
+	mutex sync.Mutex
+	done  bool
+	data  []byte
+	err   error
+	// the number of items that have not yet consumed the data
+	num_of_consumers int
+}
+
+// Download the URL, unless it has already been downloaded, waiting for any
+// download of it that is in progress
+func (self *download) prefetch(url string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.done {
+		self.data, self.err = download_url(url)
+		self.done = true
+	}
+}
+
+// Get the data for an item, releasing it once all items using it have it
+func (self *download) get(url string) ([]byte, error) {
+	self.prefetch(url)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	data, err := self.data, self.err
+	if self.num_of_consumers--; self.num_of_consumers <= 0 {
+		self.data, self.err, self.done = nil, nil, false
+	}
+	return data, err
+}
+
+// Created before the workers are started, and only read from afterwards
+var downloads map[string]*download
+var download_slots chan struct{}
+var request_headers http.Header
+
+func parse_headers() error {
+	request_headers = make(http.Header)
+	for _, h := range opts.Header {
+		name, val, found := strings.Cut(h, ":")
+		if name = strings.TrimSpace(name); !found || name == "" {
+			return fmt.Errorf("Invalid --header specification: %s, must be of the form Name: Value", h)
+		}
+		request_headers.Add(name, strings.TrimSpace(val))
+	}
+	return nil
+}
+
+var http_client = sync.OnceValue(func() *http.Client {
+	return &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if opts.MaxRedirects < 1 {
+			// the redirect response is returned, and reported as an error
+			return http.ErrUseLastResponse
+		}
+		if len(via) >= opts.MaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", opts.MaxRedirects)
+		}
+		// headers such as API tokens must not be sent to other hosts, or
+		// over a different scheme, such as plain http after https, Go only
+		// removes the standard authentication headers
+		if req.URL.Host != via[0].URL.Host || req.URL.Scheme != via[0].URL.Scheme {
+			for name := range request_headers {
+				req.Header.Del(name)
+			}
+		}
+		return nil
+	}}
+})
+
+func cache_path_for_url(url string) string {
+	h := sha256.New()
+	h.Write([]byte(url))
+	names := make([]string, 0, len(request_headers))
+	for name := range request_headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		for _, val := range request_headers[name] {
+			fmt.Fprintf(h, "\n%s: %s", name, val)
+		}
+	}
+	return filepath.Join(utils.CacheDir(), "icat", hex.EncodeToString(h.Sum(nil)))
+}
+
+func read_from_cache(path string) []byte {
+	s, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	if opts.CacheAge > 0 && time.Since(s.ModTime()) > time.Duration(opts.CacheAge*float64(time.Minute)) {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func download_url(url string) (data []byte, err error) {
+	cache_path := ""
+	if opts.CacheAge != 0 {
+		cache_path = cache_path_for_url(url)
+		if data = read_from_cache(cache_path); data != nil {
+			return data, nil
+		}
+	}
+	download_slots <- struct{}{}
+	defer func() { <-download_slots }()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = request_headers.Clone()
+	resp, err := http_client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %v", resp.Status)
+	}
+	dest := bytes.Buffer{}
+	dest.Grow(64 * 1024)
+	if _, err = io.Copy(&dest, resp.Body); err != nil {
+		return nil, fmt.Errorf("download failed with error: %w", err)
+	}
+	data = dest.Bytes()
+	if cache_path != "" {
+		// the images could be private, and failing to cache them is not an error
+		if os.MkdirAll(filepath.Dir(cache_path), 0o700) == nil {
+			_ = utils.AtomicWriteFile(cache_path, data, 0o600)
+		}
+	}
+	return data, nil
+}
+
+// Start downloading all the URLs, except in the viewer
+func prefetch_urls(items []input_arg) {
+	downloads = make(map[string]*download)
+	download_slots = make(chan struct{}, max_parallel_downloads)
+	for _, item := range items {
+		if item.is_http_url {
+			d := downloads[item.value]
+			if d == nil {
+				d = &download{}
+				downloads[item.value] = d
+				if !opts.Viewer {
+					go d.prefetch(item.value)
+				}
+			}
+			d.num_of_consumers++
+		}
+	}
+}
+
+func fetch_url(url string) ([]byte, error) {
+	return downloads[url].get(url)
+}
@@ -0,0 +1,144 @@
+// License: GPLv3 Copyright: 2024, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var _ = fmt.Print
+
+func TestIcatFetch(t *testing.T) {
+	opts = &Options{MaxRedirects: 2}
+	download_slots = make(chan struct{}, max_parallel_downloads)
+	set_headers := func(headers ...string) {
+		opts.Header = headers
+		if err := parse_headers(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the cache key depends on the URL and the headers, not their order
+	set_headers("X-A: 1", "X-B: 2")
+	key := cache_path_for_url("https://example.com/a.png")
+	set_headers("X-B: 2", "X-A: 1")
+	if k := cache_path_for_url("https://example.com/a.png"); k != key {
+		t.Fatalf("Cache key depends on the order of headers")
+	}
+	for _, headers := range [][]string{{"X-A: 1", "X-B: 3"}, {"X-A: 1"}} {
+		set_headers(headers...)
+		if cache_path_for_url("https://example.com/a.png") == key {
+			t.Fatalf("Cache key does not depend on the headers: %v", headers)
+		}
+	}
+	if cache_path_for_url("https://example.com/b.png") == cache_path_for_url("https://example.com/a.png") {
+		t.Fatalf("Cache key does not depend on the URL")
+	}
+
+	// cached copies expire after the cache age
+	cached := filepath.Join(t.TempDir(), "cached")
+	if err := os.WriteFile(cached, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	opts.CacheAge = 2
+	if string(read_from_cache(cached)) != "data" {
+		t.Fatalf("Fresh cached copy not used")
+	}
+	old := time.Now().Add(-3 * time.Minute)
+	if err := os.Chtimes(cached, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if read_from_cache(cached) != nil {
+		t.Fatalf("Expired cached copy used")
+	}
+	opts.CacheAge = -1
+	if string(read_from_cache(cached)) != "data" {
+		t.Fatalf("Cached copy that never expires not used")
+	}
+	opts.CacheAge = 0
+
+	// headers are sent only to the host of the URL
+	var other_host_headers http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		other_host_headers = r.Header.Clone()
+		fmt.Fprint(w, "other")
+	}))
+	defer other.Close()
+	var same_host_headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/same":
+			http.Redirect(w, r, "/image", http.StatusFound)
+		case "/image":
+			same_host_headers = r.Header.Clone()
+			fmt.Fprint(w, "image")
+		case "/other":
+			http.Redirect(w, r, other.URL+"/image", http.StatusFound)
+		default:
+			// an endless chain of redirects
+			n := strings.Count(r.URL.Path, "/")
+			http.Redirect(w, r, strings.Repeat("/loop", n+1), http.StatusFound)
+		}
+	}))
+	defer server.Close()
+	set_headers("X-Api-Key: secret")
+	if data, err := download_url(server.URL + "/same"); err != nil || string(data) != "image" {
+		t.Fatalf("Download failed: %#v %v", string(data), err)
+	}
+	if same_host_headers.Get("X-Api-Key") != "secret" {
+		t.Fatalf("Header not sent after redirect to the same host")
+	}
+	if data, err := download_url(server.URL + "/other"); err != nil || string(data) != "other" {
+		t.Fatalf("Download failed: %#v %v", string(data), err)
+	}
+	if other_host_headers.Get("X-Api-Key") != "" {
+		t.Fatalf("Header sent after redirect to a different host")
+	}
+
+	// or after a redirect to a different scheme on the same host
+	for _, scheme := range []string{"https", "http"} {
+		first, _ := http.NewRequest(http.MethodGet, "https://example.com/a.png", nil)
+		req, _ := http.NewRequest(http.MethodGet, scheme+"://example.com/b.png", nil)
+		req.Header.Set("X-Api-Key", "secret")
+		if err := http_client().CheckRedirect(req, []*http.Request{first}); err != nil {
+			t.Fatal(err)
+		}
+		if sent := req.Header.Get("X-Api-Key") != ""; sent != (scheme == "https") {
+			t.Fatalf("Header incorrectly handled after redirect from https to %s, sent: %v", scheme, sent)
+		}
+	}
+
+	// the number of redirects followed is limited
+	if _, err := download_url(server.URL + "/loop"); err == nil || !strings.Contains(err.Error(), "stopped after 2 redirects") {
+		t.Fatalf("Redirect limit not applied: %v", err)
+	}
+	opts.MaxRedirects = 0
+	if _, err := download_url(server.URL + "/same"); err == nil {
+		t.Fatalf("Redirect followed with a limit of zero")
+	}
+	opts.MaxRedirects = 2
+
+	// downloaded data is released once consumed by all items using it
+	items := []input_arg{{value: server.URL + "/image", is_http_url: true}, {value: server.URL + "/image", is_http_url: true}}
+	opts.Viewer = true
+	prefetch_urls(items)
+	d := downloads[items[0].value]
+	for i := range items {
+		if data, err := fetch_url(items[i].value); err != nil || string(data) != "image" {
+			t.Fatalf("Fetch failed: %#v %v", string(data), err)
+		}
+		if i == 0 && d.data == nil {
+			t.Fatalf("Downloaded data released before being consumed by all items")
+		}
+	}
+	if d.data != nil || d.done {
+		t.Fatalf("Downloaded data not released")
+	}
+}
@@ -0,0 +1,217 @@
+// License: GPLv3 Copyright: 2024, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"kitty/tools/tui/graphics"
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+// With --grid, images are shown as thumbnails laid out in a grid, with their
+// file names below them. The grid is sized to the screen, with each thumbnail
+// scaled to fit into its cell of the grid, using the same mechanism as
+// --place, but the images are only transmitted to the terminal as they are
+// processed, and displayed later, with placement commands, so that they can be
+// displayed in order. When there are more images than fit in the grid, an
+// interactive browser is run, that pages through screens of thumbnails.
+
+type grid_layout struct {
+	columns, rows int
+	// the size of the cells of the grid, in cells of the screen
+	cell_width, cell_height int
+}
+
+type grid_item struct {
+	name          string
+	image_id      uint32
+	x_offset      int // in cells of the screen, to align the image in its cell of the grid
+	cell_x_offset int // in pixels
+	failed        bool
+}
+
+var grid *grid_layout
+
+func parse_grid() (err error) {
+	if opts.Grid == "" {
+		return nil
+	}
+	c, r, found := strings.Cut(opts.Grid, "x")
+	g := grid_layout{}
+	if found {
+		g.columns, err = strconv.Atoi(c)
+		if err == nil {
+			g.rows, err = strconv.Atoi(r)
+		}
+	}
+	if !found || err != nil || g.columns < 1 || g.rows < 1 {
+		return fmt.Errorf("Invalid --grid specification: %s", opts.Grid)
+	}
+	switch {
+	case opts.Place != "":
+		return fmt.Errorf("The --grid option cannot be used with --place")
+	case opts.UnicodePlaceholder || opts.Passthrough == "tmux":
+		return fmt.Errorf("The --grid option cannot be used with Unicode placeholders")
+	case opts.Interactive:
+		return fmt.Errorf("The --grid option cannot be used with --interactive")
+	}
+	// one line of the screen is used for the status line when paging
+	g.cell_width, g.cell_height = int(screen_size.Col)/g.columns, (int(screen_size.Row)-1)/g.rows
+	// the thumbnails are separated by a column and have their name below them
+	if g.cell_width < 2 || g.cell_height < 2 {
+		return fmt.Errorf("The screen is too small for a grid of %s", opts.Grid)
+	}
+	grid = &g
+	place = &Place{width: g.cell_width - 1, height: g.cell_height - 1}
+	return nil
+}
+
+func (self *grid_layout) page_size() int { return self.columns * self.rows }
+
+func (self *grid_layout) num_of_pages(num_of_items int) int {
+	return utils.Max(1, (num_of_items+self.page_size()-1)/self.page_size())
+}
+
+func new_grid_item(imgd *image_data) *grid_item {
+	ans := grid_item{name: filepath.Base(imgd.source_name), failed: imgd.err != nil}
+	if imgd.source_name == "" || imgd.source_name == "<stdin>" {
+		ans.name = "<stdin>"
+	}
+	if !ans.failed {
+		ans.image_id = imgd.image_id
+		ans.x_offset = imgd.move_to.x - 1
+		ans.cell_x_offset = imgd.cell_x_offset
+	}
+	return &ans
+}
+
+// The escape codes to draw a page of thumbnails at the cursor position
+func (self *grid_layout) render_page(items []*grid_item, page int) string {
+	b := strings.Builder{}
+	start := page * self.page_size()
+	page_items := items[start:utils.Min(len(items), start+self.page_size())]
+	for r := 0; r*self.columns < len(page_items); r++ {
+		row := page_items[r*self.columns : utils.Min(len(page_items), (r+1)*self.columns)]
+		for c, item := range row {
+			if item.failed {
+				continue
+			}
+			b.WriteString(loop.SAVE_CURSOR)
+			if x := c*self.cell_width + item.x_offset; x > 0 {
+				fmt.Fprintf(&b, "\x1b[%dC", x)
+			}
+			gc := graphics.GraphicsCommand{}
+			gc.SetAction(graphics.GRT_action_display).SetImageId(item.image_id).SetQuiet(graphics.GRT_quiet_silent)
+			gc.SetCursorMovement(graphics.GRT_cursor_static)
+			if item.cell_x_offset > 0 {
+				gc.SetXOffset(uint64(item.cell_x_offset))
+			}
+			if z_index != 0 {
+				gc.SetZIndex(z_index)
+			}
+			_ = gc.WriteWithPayloadTo(&b, nil)
+			b.WriteString(loop.RESTORE_CURSOR)
+		}
+		// use newlines so that the screen scrolls if needed
+		b.WriteString(strings.Repeat("\r\n", self.cell_height-1))
+		for c, item := range row {
+			b.WriteString("\r")
+			if x := c * self.cell_width; x > 0 {
+				fmt.Fprintf(&b, "\x1b[%dC", x)
+			}
+			name := wcswidth.TruncateToVisualLength(item.name, self.cell_width-1)
+			if item.failed {
+				b.WriteString("\x1b[31m" + name + "\x1b[39m")
+			} else {
+				b.WriteString(name)
+			}
+		}
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+func (self *grid_layout) display(items []*grid_item) error {
+	items = utils.Filter(items, func(x *grid_item) bool { return x != nil })
+	if len(items) <= self.page_size() {
+		fmt.Print(self.render_page(items, 0))
+		return nil
+	}
+	return self.browse(items)
+}
+
+// An interactive browser to page through the thumbnails
+func (self *grid_layout) browse(items []*grid_item) (err error) {
+	lp, err := loop.New(loop.NoMouseTracking)
+	if err != nil {
+		return err
+	}
+	page, num_of_pages := 0, self.num_of_pages(len(items))
+	draw_page := func() {
+		lp.StartAtomicUpdate()
+		defer lp.EndAtomicUpdate()
+		lp.ClearScreen()
+		gc := graphics.GraphicsCommand{}
+		gc.SetAction(graphics.GRT_action_delete).SetDelete(graphics.GRT_delete_visible).SetQuiet(graphics.GRT_quiet_silent)
+		_ = gc.WriteWithPayloadToLoop(lp, nil)
+		lp.QueueWriteString(self.render_page(items, page))
+		lp.MoveCursorTo(1, int(screen_size.Row))
+		lp.QueueWriteString(fmt.Sprintf("\x1b[1mPage %d of %d\x1b[m  ", page+1, num_of_pages))
+		lp.QueueWriteString("Right/PgDn: next  Left/PgUp: previous  Esc: exit")
+	}
+	lp.OnInitialize = func() (string, error) {
+		lp.SetCursorVisible(false)
+		draw_page()
+		return "", nil
+	}
+	lp.OnFinalize = func() string {
+		// the images are not displayed once the browser exits, so free them
+		for _, item := range items {
+			if !item.failed {
+				gc := graphics.GraphicsCommand{}
+				gc.SetAction(graphics.GRT_action_delete).SetDelete(graphics.GRT_free_by_id).SetImageId(item.image_id).SetQuiet(graphics.GRT_quiet_silent)
+				_ = gc.WriteWithPayloadToLoop(lp, nil)
+			}
+		}
+		lp.SetCursorVisible(true)
+		return ""
+	}
+	lp.OnResize = func(old_size, new_size loop.ScreenSize) error {
+		draw_page()
+		return nil
+	}
+	lp.OnKeyEvent = func(ev *loop.KeyEvent) error {
+		new_page := page
+		switch {
+		case ev.MatchesPressOrRepeat("right") || ev.MatchesPressOrRepeat("page_down") || ev.MatchesPressOrRepeat("space") || ev.MatchesPressOrRepeat("n"):
+			new_page = utils.Min(page+1, num_of_pages-1)
+		case ev.MatchesPressOrRepeat("left") || ev.MatchesPressOrRepeat("page_up") || ev.MatchesPressOrRepeat("backspace") || ev.MatchesPressOrRepeat("p"):
+			new_page = utils.Max(page-1, 0)
+		case ev.MatchesPressOrRepeat("home"):
+			new_page = 0
+		case ev.MatchesPressOrRepeat("end"):
+			new_page = num_of_pages - 1
+		case ev.MatchesPressOrRepeat("esc") || ev.MatchesPressOrRepeat("q") || ev.MatchesPressOrRepeat("ctrl+c"):
+			ev.Handled = true
+			lp.Quit(0)
+			return nil
+		default:
+			return nil
+		}
+		ev.Handled = true
+		if new_page != page {
+			page = new_page
+			draw_page()
+		}
+		return nil
+	}
+	return lp.Run()
+}
@@ -0,0 +1,88 @@
+// License: GPLv3 Copyright: 2024, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+)
+
+var _ = fmt.Print
+
+func TestIcatGrid(t *testing.T) {
+	defer func() { grid, place = nil, nil }()
+	screen_size = &unix.Winsize{Col: 80, Row: 25, Xpixel: 800, Ypixel: 500}
+	parse := func(spec string, o Options) error {
+		grid, place = nil, nil
+		o.Grid = spec
+		opts = &o
+		return parse_grid()
+	}
+
+	if err := parse("", Options{}); err != nil || grid != nil {
+		t.Fatalf("Grid created without --grid: %v", err)
+	}
+	if err := parse("4x3", Options{}); err != nil {
+		t.Fatal(err)
+	}
+	// the last line of the screen is used for the status line
+	if diff := cmp.Diff(&grid_layout{columns: 4, rows: 3, cell_width: 20, cell_height: 8}, grid, cmp.AllowUnexported(grid_layout{})); diff != "" {
+		t.Fatalf("Incorrect grid:\n%s", diff)
+	}
+	if place == nil || place.width != 19 || place.height != 7 {
+		t.Fatalf("Incorrect placement for thumbnails: %#v", place)
+	}
+	for _, bad := range []string{"4", "x3", "4x", "0x3", "4x-1", "ax3"} {
+		if err := parse(bad, Options{}); err == nil || !strings.Contains(err.Error(), "Invalid --grid") {
+			t.Fatalf("Invalid grid specification not rejected: %#v: %v", bad, err)
+		}
+	}
+	for _, o := range []Options{{Place: "10x10@0x0"}, {UnicodePlaceholder: true}, {Passthrough: "tmux"}, {Interactive: true}} {
+		if err := parse("2x2", o); err == nil {
+			t.Fatalf("Incompatible options not rejected: %#v", o)
+		}
+	}
+	for _, spec := range []string{"41x2", "2x13"} {
+		if err := parse(spec, Options{}); err == nil || !strings.Contains(err.Error(), "too small") {
+			t.Fatalf("Grid too large for the screen not rejected: %s: %v", spec, err)
+		}
+	}
+
+	g := grid_layout{columns: 2, rows: 2, cell_width: 6, cell_height: 3}
+	for n, expected := range map[int]int{0: 1, 1: 1, 4: 1, 5: 2, 8: 2, 9: 3} {
+		if actual := g.num_of_pages(n); actual != expected {
+			t.Fatalf("Incorrect number of pages for %d items: %d != %d", n, actual, expected)
+		}
+	}
+
+	items := []*grid_item{
+		{name: "a.png", image_id: 1}, {name: "long-name.png", image_id: 2, x_offset: 1, cell_x_offset: 3},
+		{name: "bad.png", failed: true}, {name: "d.png", image_id: 4}, {name: "e.png", image_id: 5},
+	}
+	// names are truncated to the width of the cells of the grid, less the separator
+	page := g.render_page(items, 0)
+	for _, x := range []string{"a.png", "long-", "\x1b[31mbad.p\x1b[39m", "d.png"} {
+		if !strings.Contains(page, x) {
+			t.Fatalf("%#v not present in page: %#v", x, page)
+		}
+	}
+	for _, x := range []string{"long-n", "e.png", "i=3"} {
+		if strings.Contains(page, x) {
+			t.Fatalf("%#v present in page: %#v", x, page)
+		}
+	}
+	if !strings.Contains(page, "i=2") || !strings.Contains(page, "X=3") {
+		t.Fatalf("Thumbnail not displayed with its offset: %#v", page)
+	}
+	if n := strings.Count(page, "\r\n"); n != 2*g.cell_height {
+		t.Fatalf("Incorrect number of lines in page: %d", n)
+	}
+	page = g.render_page(items, 1)
+	if !strings.Contains(page, "e.png") || strings.Contains(page, "a.png") || strings.Count(page, "\r\n") != g.cell_height {
+		t.Fatalf("Incorrect last page: %#v", page)
+	}
+}
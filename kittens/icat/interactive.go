@@ -0,0 +1,173 @@
+// License: GPLv3 Copyright: 2024, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"time"
+
+	"kitty/tools/tui"
+	"kitty/tools/tui/loop"
+)
+
+var _ = fmt.Print
+
+// With --interactive, icat keeps running after displaying an animated image
+// and drives the animation itself, by making each frame the current frame in
+// turn, instead of leaving it to the terminal, since the terminal does not
+// report which frame is current, which is needed to step through the frames.
+
+const default_gap = 40 * time.Millisecond // used by the terminal for frames without a gap
+
+type animation_player struct {
+	lp   *loop.Loop
+	imgd *image_data
+	// the terminal numbers frames in the order they are transmitted, starting
+	// from one, gapless frames are skipped as they are never shown
+	frame_numbers []int
+	gaps          []time.Duration
+	current       int
+	plays         int
+	paused        bool
+	finished      bool
+	timer         loop.IdType
+}
+
+func new_animation_player(imgd *image_data) *animation_player {
+	ans := animation_player{imgd: imgd}
+	for i, frame := range imgd.frames {
+		if gap := frame_gap(frame); gap >= 0 {
+			ans.frame_numbers = append(ans.frame_numbers, i+1)
+			ans.gaps = append(ans.gaps, time.Duration(gap)*time.Millisecond)
+			if gap == 0 {
+				ans.gaps[len(ans.gaps)-1] = default_gap
+			}
+		}
+	}
+	return &ans
+}
+
+func (self *animation_player) show(idx int) error {
+	self.current = idx
+	c := animation_control_command(self.imgd)
+	c.SetOverlaidFrame(uint64(self.frame_numbers[idx]))
+	return c.WriteWithPayloadToLoop(self.lp, nil)
+}
+
+func (self *animation_player) schedule() (err error) {
+	self.timer, err = self.lp.AddTimer(self.gaps[self.current], false, self.advance)
+	return
+}
+
+func (self *animation_player) advance(loop.IdType) error {
+	self.timer = 0
+	next := self.current + 1
+	if next >= len(self.frame_numbers) {
+		self.plays++
+		if max_plays := number_of_plays(); max_plays > 0 && self.plays >= max_plays {
+			self.paused, self.finished = true, true
+			self.draw_status()
+			return nil
+		}
+		next = 0
+	}
+	if err := self.show(next); err != nil {
+		return err
+	}
+	return self.schedule()
+}
+
+func (self *animation_player) pause() {
+	self.paused = true
+	if self.timer != 0 {
+		self.lp.RemoveTimer(self.timer)
+		self.timer = 0
+	}
+}
+
+func (self *animation_player) toggle() error {
+	if !self.paused {
+		self.pause()
+		self.draw_status()
+		return nil
+	}
+	self.paused = false
+	if self.finished {
+		// play the animation again from the start
+		self.finished, self.plays = false, 0
+		if err := self.show(0); err != nil {
+			return err
+		}
+	}
+	self.draw_status()
+	return self.schedule()
+}
+
+func (self *animation_player) step(delta int) error {
+	self.pause()
+	self.finished = false
+	n := len(self.frame_numbers)
+	if err := self.show((self.current + delta + n) % n); err != nil {
+		return err
+	}
+	self.draw_status()
+	return nil
+}
+
+func (self *animation_player) draw_status() {
+	self.lp.QueueWriteString("\r\x1b[K")
+	if self.paused {
+		self.lp.QueueWriteString(fmt.Sprintf("\x1b[1;33mPaused at frame %d of %d\x1b[m", self.current+1, len(self.frame_numbers)))
+	} else {
+		self.lp.QueueWriteString("\x1b[1;32mPlaying\x1b[m")
+	}
+	self.lp.QueueWriteString(" Space: pause/resume  Left/Right: step  Esc: exit")
+}
+
+func play_interactively(imgd *image_data) (err error) {
+	self := new_animation_player(imgd)
+	if len(self.frame_numbers) < 2 {
+		// nothing to control
+		tui.HoldTillEnter(false)
+		return nil
+	}
+	if self.lp, err = loop.New(loop.NoAlternateScreen, loop.NoRestoreColors, loop.NoMouseTracking); err != nil {
+		return err
+	}
+	self.lp.OnInitialize = func() (string, error) {
+		self.lp.SetCursorVisible(false)
+		if err := self.show(0); err != nil {
+			return "", err
+		}
+		self.draw_status()
+		return "", self.schedule()
+	}
+	self.lp.OnFinalize = func() string {
+		if !self.paused {
+			// let the terminal continue playing the animation after exit
+			c := animation_control_command(imgd)
+			c.SetAnimationControl(3)
+			_ = c.WriteWithPayloadToLoop(self.lp, nil)
+		}
+		self.lp.SetCursorVisible(true)
+		return "\r\x1b[K"
+	}
+	self.lp.OnKeyEvent = func(ev *loop.KeyEvent) error {
+		switch {
+		case ev.MatchesPressOrRepeat("space"):
+			ev.Handled = true
+			return self.toggle()
+		case ev.MatchesPressOrRepeat("left"):
+			ev.Handled = true
+			return self.step(-1)
+		case ev.MatchesPressOrRepeat("right"):
+			ev.Handled = true
+			return self.step(1)
+		case ev.MatchesPressOrRepeat("esc") || ev.MatchesPressOrRepeat("q") || ev.MatchesPressOrRepeat("ctrl+c") || ev.MatchesPressOrRepeat("enter"):
+			ev.Handled = true
+			self.lp.Quit(0)
+		}
+		return nil
+	}
+	return self.lp.Run()
+}
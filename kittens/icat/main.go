@@ -146,6 +146,10 @@ func main(cmd *cli.Command, o *Options, args []string) (rc int, err error) {
 	if err != nil {
 		return 1, err
 	}
+	err = parse_headers()
+	if err != nil {
+		return 1, err
+	}
 	if opts.UseWindowSize == "" {
 		if tty.IsTerminal(os.Stdout.Fd()) {
 			screen_size, err = tty.GetSize(int(os.Stdout.Fd()))
@@ -204,6 +208,12 @@ func main(cmd *cli.Command, o *Options, args []string) (rc int, err error) {
 	if screen_size.Xpixel == 0 || screen_size.Ypixel == 0 {
 		return 1, fmt.Errorf("Terminal does not support reporting screen sizes in pixels, use a terminal such as kitty, WezTerm, Konsole, etc. that does.")
 	}
+	if err = parse_grid(); err != nil {
+		return 1, err
+	}
+	if err = check_viewer_options(); err != nil {
+		return 1, err
+	}
 
 	items, err := process_dirs(args...)
 	if err != nil {
@@ -212,15 +222,23 @@ func main(cmd *cli.Command, o *Options, args []string) (rc int, err error) {
 	if opts.Place != "" && len(items) > 1 {
 		return 1, fmt.Errorf("The --place option can only be used with a single image, not %d", len(items))
 	}
+	if opts.Interactive && len(items) > 1 {
+		return 1, fmt.Errorf("The --interactive option can only be used with a single image, not %d", len(items))
+	}
 	files_channel = make(chan input_arg, len(items))
-	for _, ia := range items {
+	for i, ia := range items {
+		ia.index = i
 		files_channel <- ia
 	}
 	num_of_items = len(items)
 	output_channel = make(chan *image_data, 1)
 	keep_going = &atomic.Bool{}
 	keep_going.Store(true)
-	if !opts.DetectSupport && num_of_items > 0 {
+	if !opts.DetectSupport {
+		prefetch_urls(items)
+	}
+	if !opts.DetectSupport && num_of_items > 0 && !opts.Viewer {
+		// the viewer loads images when they are navigated to
 		num_workers := utils.Max(1, utils.Min(num_of_items, runtime.NumCPU()))
 		for i := 0; i < num_workers; i++ {
 			go run_worker()
@@ -276,7 +294,23 @@ func main(cmd *cli.Command, o *Options, args []string) (rc int, err error) {
 	if passthrough_mode != no_passthrough {
 		use_unicode_placeholder = true
 	}
+	if opts.Viewer {
+		if passthrough_mode != no_passthrough {
+			return 1, fmt.Errorf("The --viewer option cannot be used inside terminal multiplexers such as tmux")
+		}
+		err = run_viewer(items)
+		keep_going.Store(false)
+		if err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
 	base_id := uint32(opts.ImageId)
+	var displayed *image_data
+	var grid_items []*grid_item
+	if grid != nil {
+		grid_items = make([]*grid_item, len(items))
+	}
 	for num_of_items > 0 {
 		imgd := <-output_channel
 		if base_id != 0 {
@@ -295,16 +329,32 @@ func main(cmd *cli.Command, o *Options, args []string) (rc int, err error) {
 			transmit_image(imgd)
 			if imgd.err != nil {
 				print_error("Failed to transmit \x1b[31m%s\x1b[39m: %s\r\n", imgd.source_name, imgd.err)
+			} else {
+				displayed = imgd
 			}
 		}
+		if grid != nil {
+			grid_items[imgd.index] = new_grid_item(imgd)
+		}
+	}
+	if grid != nil {
+		if err = grid.display(grid_items); err != nil {
+			return 1, err
+		}
 	}
 	keep_going.Store(false)
-	if opts.Hold {
+	if opts.Hold || (opts.Interactive && displayed != nil) {
 		fmt.Print("\r")
 		if opts.Place != "" {
 			fmt.Println()
 		}
-		tui.HoldTillEnter(false)
+		if opts.Interactive && displayed != nil {
+			if err = play_interactively(displayed); err != nil {
+				return 1, err
+			}
+		} else {
+			tui.HoldTillEnter(false)
+		}
 	}
 	return 0, nil
 }
@@ -20,6 +20,51 @@
 be positioned at the top left corner of the image, instead of on the line after the image.
 
 
+--grid
+Display the images as thumbnails, laid out in a grid of the specified number of
+columns and rows, for example: :code:`4x3`, sized to fit the screen, with the name
+of each image below it. If there are more images than fit in the grid, an
+interactive browser is shown, to page through screens of thumbnails, useful to
+quickly look through the images in a directory. Cannot be used with
+:option:`--place`.
+
+
+--viewer
+type=bool-set
+Keep running after displaying the first image, in a viewer that shows one
+image at a time, filling the screen. Use the :kbd:`+` and :kbd:`-` keys or the
+mouse wheel to zoom in and out and :kbd:`0` to reset the zoom. Pan around
+zoomed images with the arrow keys or by dragging with the mouse. Press
+:kbd:`w` or :kbd:`h` to toggle fitting the image to the width or height of the
+screen. Go to the next or previous image with :kbd:`n` and :kbd:`p`, or
+:kbd:`PgDn` and :kbd:`PgUp`, and press :kbd:`q` or :kbd:`Esc` to exit.
+
+
+--header -H
+type=list
+A header to send with the HTTP requests made to download images specified as
+URLs, of the form :code:`Name: Value`. Can be specified multiple times. For
+example, to authenticate with a token: :code:`--header "Authorization: Bearer
+mytoken"`. Note that the headers are not sent when redirected to a different
+host.
+
+
+--cache-age
+type=float
+default=0
+Cache images downloaded from URLs on disk, re-using the cached copies for the
+specified number of minutes, instead of downloading them again. Images are
+cached separately for different values of :option:`--header`. A value of zero
+disables the cache and a negative value means cached copies never expire.
+
+
+--max-redirects
+type=int
+default=10
+The maximum number of HTTP redirects to follow when downloading images from
+URLs. A value of zero means redirects are not followed.
+
+
 --scale-up
 type=bool-set
 When used in combination with :option:`--place` it will cause images that are
@@ -103,8 +148,12 @@
 default=auto
 The engine used for decoding and processing of images. The default is to use
 the most appropriate engine.  The :code:`builtin` engine uses Go's native
-imaging libraries. The :code:`magick` engine uses ImageMagick which requires
-it to be installed on the system.
+imaging libraries and a builtin renderer for SVG images, which supports the
+commonly used subset of SVG, rendering images directly at the size at which
+they are displayed. The :code:`magick` engine uses ImageMagick which requires
+it to be installed on the system. With the default engine, SVG images that use
+features not supported by the builtin renderer, such as text, are rendered with
+ImageMagick, if it is installed.
 
 
 --z-index -z
@@ -122,6 +171,37 @@
 is looped the specified number of times.
 
 
+--fps-override
+type=float
+default=0
+Play animations at the specified number of frames per second, instead of using
+the delays between frames stored in the animation. Values less than or equal to
+zero mean the stored delays are used.
+
+
+--pause-on-last-frame
+type=bool-set
+Stop animations on their last frame, once they have been played, instead of
+looping them forever. Animations are played once, or the number of times
+specified by :option:`--loop`.
+
+
+--interactive
+type=bool-set
+Control the playback of an animated image interactively, instead of exiting
+after displaying it. Press :kbd:`Space` to pause or resume the animation, the
+:kbd:`Left` and :kbd:`Right` arrow keys to step to the previous or next frame
+and :kbd:`Esc` to exit. Can only be used with a single image.
+
+
+--play
+type=bool-set
+Play videos, by displaying all their frames as an animation, instead of only
+displaying a representative frame from them. Displaying videos requires
+:program:`ffmpeg` to be installed. Note that the terminal keeps all the frames
+in memory, to be able to loop the animation, so only short videos should be played.
+
+
 --hold
 type=bool-set
 Wait for a key press before exiting after displaying the images.
@@ -163,7 +243,9 @@
         ' Directories are scanned recursively for image files. If STDIN'
         ' is not a terminal, image data will be read from it as well.'
         ' You can also specify HTTP(S) or FTP URLs which will be'
-        ' automatically downloaded and displayed.'
+        ' automatically downloaded, in parallel, and displayed, see'
+        ' :option:`--header` and :option:`--cache-age`.'
+        ' Video files are displayed using ffmpeg, see :option:`--play`.'
 )
 usage = 'image-file-or-url-or-directory ...'
 
@@ -179,4 +261,4 @@
     cd['options'] = lambda: OPTIONS.format()
     cd['help_text'] = help_text
     cd['short_desc'] = 'Display images in the terminal'
-    cd['args_completion'] = CompletionSpec.from_string('type:file mime:image/* group:Images')
+    cd['args_completion'] = CompletionSpec.from_string('type:file mime:image/* mime:video/* group:"Images and videos"')
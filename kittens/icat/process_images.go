@@ -3,13 +3,11 @@
 package icat
 
 import (
-	"bytes"
 	"fmt"
 	"image"
 	"image/color"
 	"io"
 	"io/fs"
-	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -65,6 +63,8 @@ type input_arg struct {
 	arg         string
 	value       string
 	is_http_url bool
+	// the position of the image in the list of images
+	index int
 }
 
 func is_http_url(arg string) bool {
@@ -191,6 +191,11 @@ type image_data struct {
 	width_cells, height_cells         int
 	use_unicode_placeholder           bool
 	passthrough_mode                  passthrough_type
+	// the source of the remaining frames of videos being played
+	video *video_stream
+
+	// the position of the image in the list of images
+	index int
 
 	// for error reporting
 	err         error
@@ -207,12 +212,18 @@ func set_basic_metadata(imgd *image_data) {
 		imgd.available_width = place.width * int(screen_size.Xpixel) / int(screen_size.Col)
 		imgd.available_height = place.height * int(screen_size.Ypixel) / int(screen_size.Row)
 	}
+	if opts.Viewer {
+		// loaded at a higher resolution than the screen, to be zoomed into
+		imgd.available_width = viewer_resolution * int(screen_size.Xpixel)
+		imgd.available_height = viewer_resolution * int(screen_size.Ypixel)
+	}
 	imgd.needs_scaling = imgd.canvas_width > imgd.available_width || imgd.canvas_height > imgd.available_height || opts.ScaleUp
 	imgd.needs_conversion = imgd.needs_scaling || remove_alpha != nil || flip || flop || imgd.format_uppercase != "PNG"
 }
 
-func report_error(source_name, msg string, err error) {
-	imgd := image_data{source_name: source_name, err: fmt.Errorf("%s: %w", msg, err)}
+func report_error(arg input_arg, msg string, err error) {
+	source_name := utils.IfElse(arg.value == "", "<stdin>", arg.value)
+	imgd := image_data{source_name: source_name, index: arg.index, err: fmt.Errorf("%s: %w", msg, err)}
 	send_output(&imgd)
 }
 
@@ -240,35 +251,23 @@ func make_output_from_input(imgd *image_data, f *opened_input) {
 func process_arg(arg input_arg) {
 	var f opened_input
 	if arg.is_http_url {
-		resp, err := http.Get(arg.value)
-		if err != nil {
-			report_error(arg.value, "Could not get", err)
-			return
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			report_error(arg.value, "Could not get", fmt.Errorf("bad status: %v", resp.Status))
-			return
-		}
-		dest := bytes.Buffer{}
-		dest.Grow(64 * 1024)
-		_, err = io.Copy(&dest, resp.Body)
+		data, err := fetch_url(arg.value)
 		if err != nil {
-			report_error(arg.value, "Could not download", err)
+			report_error(arg, "Could not get", err)
 			return
 		}
-		f.file = &BytesBuf{data: dest.Bytes()}
+		f.file = &BytesBuf{data: data}
 	} else if arg.value == "" {
 		stdin, err := io.ReadAll(os.Stdin)
 		if err != nil {
-			report_error("<stdin>", "Could not read from", err)
+			report_error(arg, "Could not read from", err)
 			return
 		}
 		f.file = &BytesBuf{data: stdin}
 	} else {
 		q, err := os.Open(arg.value)
 		if err != nil {
-			report_error(arg.value, "Could not open", err)
+			report_error(arg, "Could not open", err)
 			return
 		}
 		f.file = q
@@ -278,7 +277,33 @@ func process_arg(arg input_arg) {
 	var c image.Config
 	var format string
 	var err error
-	imgd := image_data{source_name: arg.value}
+	imgd := image_data{source_name: arg.value, index: arg.index}
+	if is_video(arg.value) {
+		if err = render_video(&imgd, &f); err != nil {
+			report_error(arg, "Could not decode video", err)
+			return
+		}
+		if !keep_going.Load() {
+			if imgd.video != nil {
+				imgd.video.close()
+			}
+			return
+		}
+		send_output(&imgd)
+		return
+	}
+	if opts.Engine != "magick" && is_svg(arg.value, &f) {
+		if err = render_svg(&imgd, &f); err == nil {
+			send_output(&imgd)
+			return
+		}
+		if opts.Engine == "builtin" {
+			report_error(arg, "Could not render SVG image", err)
+			return
+		}
+		// fall back to ImageMagick
+		imgd = image_data{source_name: arg.value, index: arg.index}
+	}
 	if opts.Engine == "auto" || opts.Engine == "native" {
 		c, format, err = image.DecodeConfig(f.file)
 		f.Rewind()
@@ -299,13 +324,13 @@ func process_arg(arg input_arg) {
 		}
 		err = render_image_with_go(&imgd, &f)
 		if err != nil {
-			report_error(arg.value, "Could not render image to RGB", err)
+			report_error(arg, "Could not render image to RGB", err)
 			return
 		}
 	} else {
 		err = render_image_with_magick(&imgd, &f)
 		if err != nil {
-			report_error(arg.value, "ImageMagick failed", err)
+			report_error(arg, "ImageMagick failed", err)
 			return
 		}
 	}
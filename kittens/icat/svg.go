@@ -0,0 +1,71 @@
+// License: GPLv3 Copyright: 2024, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/images"
+)
+
+var _ = fmt.Print
+
+// SVG images are rendered natively, directly at the size at which they are
+// displayed, so that they are sharp. Their intrinsic size is in CSS pixels,
+// which are scaled by the device pixel ratio of the screen. Terminals report
+// sizes in device pixels, so the ratio is estimated from the height of the
+// cells, relative to their height on screens with a ratio of one. With the
+// auto engine, images using features the builtin renderer does not support,
+// such as text, are rendered by ImageMagick instead, if it is installed.
+
+const cell_height_at_unit_device_pixel_ratio = 18
+
+func device_pixel_ratio() float64 {
+	if screen_size.Row == 0 {
+		return 1
+	}
+	cell_height := float64(screen_size.Ypixel) / float64(screen_size.Row)
+	return math.Max(1, cell_height/cell_height_at_unit_device_pixel_ratio)
+}
+
+func is_svg(name string, src *opened_input) bool {
+	if strings.HasPrefix(utils.GuessMimeType(name), "image/svg") {
+		return true
+	}
+	buf := make([]byte, 1024)
+	n, _ := io.ReadFull(src.file, buf)
+	src.Rewind()
+	return images.IsSVG(buf[:n])
+}
+
+var svg_needs_magick = errors.New("The SVG image uses features not supported by the builtin renderer")
+
+func render_svg(imgd *image_data, src *opened_input) (err error) {
+	svg, err := images.ParseSVG(src.file)
+	src.Rewind()
+	if err != nil {
+		return err
+	}
+	// with the auto engine, prefer ImageMagick for images that would not be
+	// rendered correctly, when it is available
+	if opts.Engine == "auto" && svg.UsesUnsupportedFeatures() && images.MagickIsAvailable() {
+		return svg_needs_magick
+	}
+	width, height := svg.IntrinsicSize()
+	dpr := device_pixel_ratio()
+	imgd.format_uppercase = "SVG"
+	imgd.canvas_width = utils.Max(1, int(math.Ceil(width*dpr)))
+	imgd.canvas_height = utils.Max(1, int(math.Ceil(height*dpr)))
+	set_basic_metadata(imgd)
+	scale_image(imgd)
+	// the image is rendered at the scaled size, instead of being resized
+	imgd.scaled_frac.x, imgd.scaled_frac.y = 0, 0
+	ctx := images.Context{}
+	add_frame(&ctx, imgd, svg.Render(imgd.canvas_width, imgd.canvas_height))
+	return nil
+}
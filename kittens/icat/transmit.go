@@ -33,6 +33,14 @@ const (
 	tmux_passthrough
 )
 
+// Where the graphics commands to transmit images are written, the viewer
+// queues them in its event loop instead of writing them directly
+var tty_output io.StringWriter = os.Stdout
+
+// Images in a grid or in the viewer are only transmitted, and displayed later,
+// with placement commands
+func is_displayed_later() bool { return grid != nil || opts.Viewer }
+
 func new_graphics_command(imgd *image_data) *graphics.GraphicsCommand {
 	gc := graphics.GraphicsCommand{}
 	switch imgd.passthrough_mode {
@@ -44,6 +52,35 @@ func new_graphics_command(imgd *image_data) *graphics.GraphicsCommand {
 	return &gc
 }
 
+// The command to control the animation of an image
+func animation_control_command(imgd *image_data) *graphics.GraphicsCommand {
+	gc := new_graphics_command(imgd)
+	gc.SetAction(graphics.GRT_action_animate)
+	if imgd.image_id != 0 {
+		gc.SetImageId(imgd.image_id)
+	} else {
+		gc.SetImageNumber(imgd.image_number)
+	}
+	return gc
+}
+
+// The time to wait before showing the next frame of an animation, in
+// milliseconds, negative for gapless frames, which are never shown
+func frame_gap(frame *image_frame) int32 {
+	if opts.FpsOverride > 0 && frame.delay_ms >= 0 {
+		return int32(utils.Max(1, int(math.Round(1000/opts.FpsOverride))))
+	}
+	return int32(frame.delay_ms)
+}
+
+// The number of times animations are played, zero means forever
+func number_of_plays() int {
+	if opts.Loop < 0 {
+		return utils.IfElse(opts.PauseOnLastFrame, 1, 0)
+	}
+	return opts.Loop
+}
+
 func gc_for_image(imgd *image_data, frame_num int, frame *image_frame) *graphics.GraphicsCommand {
 	gc := new_graphics_command(imgd)
 	gc.SetDataWidth(uint64(frame.width)).SetDataHeight(uint64(frame.height))
@@ -56,7 +93,7 @@ func gc_for_image(imgd *image_data, frame_num int, frame *image_frame) *graphics
 		gc.SetImageId(imgd.image_id)
 	}
 	if frame_num == 0 {
-		gc.SetAction(graphics.GRT_action_transmit_and_display)
+		gc.SetAction(utils.IfElse(is_displayed_later(), graphics.GRT_action_transmit, graphics.GRT_action_transmit_and_display))
 		if imgd.use_unicode_placeholder {
 			gc.SetUnicodePlaceholder(graphics.GRT_create_unicode_placeholder)
 			gc.SetColumns(uint64(imgd.width_cells))
@@ -73,7 +110,7 @@ func gc_for_image(imgd *image_data, frame_num int, frame *image_frame) *graphics
 		}
 	} else {
 		gc.SetAction(graphics.GRT_action_frame)
-		gc.SetGap(int32(frame.delay_ms))
+		gc.SetGap(frame_gap(frame))
 		if frame.compose_onto > 0 {
 			gc.SetOverlaidFrame(uint64(frame.compose_onto))
 		} else {
@@ -128,7 +165,7 @@ func transmit_shm(imgd *image_data, frame_num int, frame *image_frame) (err erro
 	gc := gc_for_image(imgd, frame_num, frame)
 	gc.SetTransmission(graphics.GRT_transmission_sharedmem)
 	gc.SetDataSize(uint64(data_size))
-	err = gc.WriteWithPayloadTo(os.Stdout, utils.UnsafeStringToBytes(mmap.Name()))
+	err = gc.WriteWithPayloadTo(tty_output, utils.UnsafeStringToBytes(mmap.Name()))
 	mmap.Close()
 
 	return
@@ -174,7 +211,7 @@ func transmit_file(imgd *image_data, frame_num int, frame *image_frame) (err err
 	if data_size > 0 {
 		gc.SetDataSize(uint64(data_size))
 	}
-	return gc.WriteWithPayloadTo(os.Stdout, utils.UnsafeStringToBytes(fname))
+	return gc.WriteWithPayloadTo(tty_output, utils.UnsafeStringToBytes(fname))
 }
 
 func transmit_stream(imgd *image_data, frame_num int, frame *image_frame) (err error) {
@@ -191,7 +228,7 @@ func transmit_stream(imgd *image_data, frame_num int, frame *image_frame) (err e
 		}
 	}
 	gc := gc_for_image(imgd, frame_num, frame)
-	return gc.WriteWithPayloadTo(os.Stdout, data)
+	return gc.WriteWithPayloadTo(tty_output, data)
 }
 
 func calculate_in_cell_x_offset(width, cell_width int) int {
@@ -278,24 +315,30 @@ func write_unicode_placeholder(imgd *image_data) {
 
 var seen_image_ids *utils.Set[uint32]
 
+// Free the resources used by the frames of an image, once they are transmitted
+func release_frames(imgd *image_data) {
+	if imgd.video != nil {
+		imgd.video.close()
+	}
+	for _, frame := range imgd.frames {
+		if frame.filename_is_temporary && frame.filename != "" {
+			os.Remove(frame.filename)
+			frame.filename = ""
+		}
+		if frame.shm != nil {
+			_ = frame.shm.Unlink()
+			frame.shm.Close()
+			frame.shm = nil
+		}
+		frame.in_memory_bytes = nil
+	}
+}
+
 func transmit_image(imgd *image_data) {
 	if seen_image_ids == nil {
 		seen_image_ids = utils.NewSet[uint32](32)
 	}
-	defer func() {
-		for _, frame := range imgd.frames {
-			if frame.filename_is_temporary && frame.filename != "" {
-				os.Remove(frame.filename)
-				frame.filename = ""
-			}
-			if frame.shm != nil {
-				_ = frame.shm.Unlink()
-				frame.shm.Close()
-				frame.shm = nil
-			}
-			frame.in_memory_bytes = nil
-		}
-	}()
+	defer release_frames(imgd)
 	var f func(*image_data, int, *image_frame) error
 	if opts.TransferMode != "detect" {
 		switch opts.TransferMode {
@@ -327,8 +370,14 @@ func transmit_image(imgd *image_data) {
 				imgd.image_id = next_random()
 			}
 			seen_image_ids.Add(imgd.image_id)
+		} else if is_displayed_later() {
+			// needed to display the image later
+			for imgd.image_id == 0 || seen_image_ids.Has(imgd.image_id) {
+				imgd.image_id = next_random()
+			}
+			seen_image_ids.Add(imgd.image_id)
 		} else {
-			if len(imgd.frames) > 1 {
+			if len(imgd.frames) > 1 || imgd.video != nil {
 				for imgd.image_number == 0 {
 					imgd.image_number = next_random()
 				}
@@ -347,8 +396,8 @@ func transmit_image(imgd *image_data) {
 			return
 		}
 	}
-	fmt.Print("\r")
-	if !imgd.use_unicode_placeholder {
+	_, _ = tty_output.WriteString("\r")
+	if !imgd.use_unicode_placeholder && !is_displayed_later() {
 		if imgd.move_x_by > 0 {
 			fmt.Printf("\x1b[%dC", imgd.move_x_by)
 		}
@@ -356,20 +405,12 @@ func transmit_image(imgd *image_data) {
 			fmt.Printf(loop.MoveCursorToTemplate, imgd.move_to.y, imgd.move_to.x)
 		}
 	}
-	frame_control_cmd := new_graphics_command(imgd)
-	frame_control_cmd.SetAction(graphics.GRT_action_animate)
-	if imgd.image_id != 0 {
-		frame_control_cmd.SetImageId(imgd.image_id)
-	} else {
-		frame_control_cmd.SetImageNumber(imgd.image_number)
-	}
-	is_animated := len(imgd.frames) > 1
+	frame_control_cmd := animation_control_command(imgd)
+	is_animated := len(imgd.frames) > 1 || imgd.video != nil
 
-	for frame_num, frame := range imgd.frames {
-		err := f(imgd, frame_num, frame)
-		if err != nil {
-			imgd.err = err
-			return
+	send_frame := func(frame_num int, frame *image_frame) error {
+		if err := f(imgd, frame_num, frame); err != nil {
+			return err
 		}
 		if is_animated {
 			switch frame_num {
@@ -377,22 +418,41 @@ func transmit_image(imgd *image_data) {
 				// set gap for the first frame and number of loops for the animation
 				c := frame_control_cmd
 				c.SetTargetFrame(uint64(frame.number))
-				c.SetGap(int32(frame.delay_ms))
-				switch {
-				case opts.Loop < 0:
-					c.SetNumberOfLoops(1)
-				case opts.Loop > 0:
-					c.SetNumberOfLoops(uint64(opts.Loop) + 1)
-				}
-				if imgd.err = c.WriteWithPayloadTo(os.Stdout, nil); imgd.err != nil {
-					return
+				c.SetGap(frame_gap(frame))
+				if plays := number_of_plays(); plays > 0 || opts.Loop < 0 {
+					// the terminal stops on the last frame once the loops are done
+					c.SetNumberOfLoops(uint64(plays) + 1)
 				}
+				return c.WriteWithPayloadTo(tty_output, nil)
 			case 1:
 				c := frame_control_cmd
 				c.SetAnimationControl(2) // set animation to loading mode
-				if imgd.err = c.WriteWithPayloadTo(os.Stdout, nil); imgd.err != nil {
-					return
-				}
+				return c.WriteWithPayloadTo(tty_output, nil)
+			}
+		}
+		return nil
+	}
+	for frame_num, frame := range imgd.frames {
+		if imgd.err = send_frame(frame_num, frame); imgd.err != nil {
+			return
+		}
+	}
+	if imgd.video != nil {
+		// transmit the frames of the video as they are decoded
+		for {
+			frame, err := imgd.video.next_frame()
+			if err == nil && frame != nil {
+				err = send_frame(len(imgd.frames), frame)
+				frame.in_memory_bytes = nil
+				// keep the metadata for the animation_player
+				imgd.frames = append(imgd.frames, frame)
+			}
+			if err != nil {
+				imgd.err = err
+				return
+			}
+			if frame == nil {
+				break
 			}
 		}
 	}
@@ -401,12 +461,17 @@ func transmit_image(imgd *image_data) {
 	}
 	if is_animated {
 		c := frame_control_cmd
-		c.SetAnimationControl(3) // set animation to normal mode
-		if imgd.err = c.WriteWithPayloadTo(os.Stdout, nil); imgd.err != nil {
+		if opts.Interactive {
+			// the animation is driven by icat, see animation_player
+			c.SetAnimationControl(1)
+		} else {
+			c.SetAnimationControl(3) // set animation to normal mode
+		}
+		if imgd.err = c.WriteWithPayloadTo(tty_output, nil); imgd.err != nil {
 			return
 		}
 	}
-	if imgd.move_to.x == 0 {
+	if imgd.move_to.x == 0 && !is_displayed_later() {
 		fmt.Println() // ensure cursor is on new line
 	}
 }
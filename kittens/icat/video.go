@@ -0,0 +1,243 @@
+// License: GPLv3 Copyright: 2024, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"kitty/tools/tui/graphics"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Videos are decoded by running ffmpeg, which outputs raw RGB frames scaled to
+// the size at which the video is displayed. By default, a single
+// representative frame is shown, chosen by the thumbnail filter of ffmpeg.
+// With --play, the frames are instead transmitted as an animation, as they
+// are decoded, so that the terminal can start playing the video before it is
+// fully decoded, in the loading mode of animations.
+
+var FFmpegExe = sync.OnceValue(func() string {
+	return utils.FindExe("ffmpeg")
+})
+
+var FFprobeExe = sync.OnceValue(func() string {
+	return utils.FindExe("ffprobe")
+})
+
+func is_video(name string) bool {
+	return strings.HasPrefix(utils.GuessMimeType(name), "video/")
+}
+
+type video_info struct {
+	width, height int
+	fps           float64
+}
+
+func parse_frame_rate(val string) float64 {
+	num, den, found := strings.Cut(val, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d <= 0 {
+		return 0
+	}
+	return n / d
+}
+
+func parse_ffprobe_output(output []byte) (ans video_info, err error) {
+	var data struct {
+		Streams []struct {
+			Width          int    `json:"width"`
+			Height         int    `json:"height"`
+			Avg_frame_rate string `json:"avg_frame_rate"`
+			Tags           struct {
+				Rotate string `json:"rotate"`
+			} `json:"tags"`
+			Side_data_list []struct {
+				Rotation float64 `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+	}
+	if err = json.Unmarshal(output, &data); err != nil {
+		return ans, fmt.Errorf("Failed to parse the output of ffprobe with error: %w", err)
+	}
+	if len(data.Streams) == 0 || data.Streams[0].Width < 1 || data.Streams[0].Height < 1 {
+		return ans, fmt.Errorf("No video stream found")
+	}
+	s := data.Streams[0]
+	ans.width, ans.height = s.Width, s.Height
+	if ans.fps = parse_frame_rate(s.Avg_frame_rate); ans.fps == 0 {
+		ans.fps = 25
+	}
+	rotation, _ := strconv.ParseFloat(s.Tags.Rotate, 64)
+	for _, sd := range s.Side_data_list {
+		if sd.Rotation != 0 {
+			rotation = sd.Rotation
+		}
+	}
+	// ffmpeg rotates the frames when decoding
+	if r := int(math.Abs(rotation)) % 180; r == 90 {
+		ans.width, ans.height = ans.height, ans.width
+	}
+	return
+}
+
+func run_ffprobe(path string) (video_info, error) {
+	c := exec.Command(FFprobeExe(), "-v", "error", "-select_streams", "v:0", "-show_entries",
+		"stream=width,height,avg_frame_rate:stream_tags=rotate:stream_side_data=rotation", "-of", "json", path)
+	output, err := c.Output()
+	if err != nil {
+		var exit_err *exec.ExitError
+		if errors.As(err, &exit_err) {
+			return video_info{}, fmt.Errorf("ffprobe failed with error:\n%s", string(exit_err.Stderr))
+		}
+		return video_info{}, fmt.Errorf("Could not find the program: %#v. Is ffmpeg installed and in your PATH?", c.Path)
+	}
+	return parse_ffprobe_output(output)
+}
+
+func ffmpeg_filters(width, height int, poster bool) string {
+	filters := []string{}
+	if poster {
+		filters = append(filters, "thumbnail")
+	}
+	filters = append(filters, fmt.Sprintf("scale=%d:%d", width, height))
+	if flip {
+		filters = append(filters, "vflip")
+	}
+	if flop {
+		filters = append(filters, "hflip")
+	}
+	return strings.Join(filters, ",")
+}
+
+type video_stream struct {
+	cmd           *exec.Cmd
+	stdout        io.ReadCloser
+	stderr        bytes.Buffer
+	width, height int
+	delay_ms      int
+	count         int
+	done          bool
+	// a temporary file holding the video, deleted once it is decoded
+	name_to_unlink string
+}
+
+func start_video_stream(path string, width, height int, fps float64, poster bool) (ans *video_stream, err error) {
+	ans = &video_stream{width: width, height: height, delay_ms: utils.Max(1, int(math.Round(1000/fps)))}
+	args := []string{"-loglevel", "error", "-nostdin", "-i", path, "-an", "-sn", "-vf", ffmpeg_filters(width, height, poster)}
+	if poster {
+		args = append(args, "-frames:v", "1")
+	}
+	args = append(args, "-f", "rawvideo", "-pix_fmt", "rgb24", "pipe:1")
+	ans.cmd = exec.Command(FFmpegExe(), args...)
+	ans.cmd.Stderr = &ans.stderr
+	if ans.stdout, err = ans.cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err = ans.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Could not run the program: %#v. Is ffmpeg installed and in your PATH?", ans.cmd.Path)
+	}
+	return
+}
+
+// Returns nil when there are no more frames
+func (self *video_stream) next_frame() (*image_frame, error) {
+	if self.done {
+		return nil, nil
+	}
+	buf := make([]byte, self.width*self.height*3)
+	if _, err := io.ReadFull(self.stdout, buf); err != nil {
+		if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			self.close()
+			return nil, err
+		}
+		if err = self.close(); err != nil {
+			return nil, err
+		}
+		if self.count == 0 {
+			return nil, fmt.Errorf("ffmpeg could not decode any frames")
+		}
+		return nil, nil
+	}
+	self.count++
+	return &image_frame{
+		width: self.width, height: self.height, number: self.count, in_memory_bytes: buf,
+		transmission_format: graphics.GRT_format_rgb, delay_ms: self.delay_ms,
+	}, nil
+}
+
+func (self *video_stream) close() error {
+	if self.done {
+		return nil
+	}
+	self.done = true
+	self.stdout.Close()
+	defer func() {
+		if self.name_to_unlink != "" {
+			os.Remove(self.name_to_unlink)
+			self.name_to_unlink = ""
+		}
+	}()
+	if err := self.cmd.Wait(); err != nil && self.count == 0 {
+		return fmt.Errorf("ffmpeg failed with error: %w\n%s", err, self.stderr.String())
+	}
+	return nil
+}
+
+func render_video(imgd *image_data, src *opened_input) (err error) {
+	path := ""
+	if f, ok := src.file.(*os.File); ok && src.name_to_unlink == "" {
+		path = f.Name()
+	} else {
+		if err = src.PutOnFilesystem(); err != nil {
+			return err
+		}
+		path = src.FileSystemName()
+	}
+	info, err := run_ffprobe(path)
+	if err != nil {
+		return err
+	}
+	imgd.format_uppercase = "VIDEO"
+	imgd.canvas_width, imgd.canvas_height = info.width, info.height
+	set_basic_metadata(imgd)
+	scale_image(imgd)
+	stream, err := start_video_stream(path, imgd.canvas_width, imgd.canvas_height, info.fps, !opts.Play)
+	if err != nil {
+		return err
+	}
+	frame, err := stream.next_frame()
+	if err != nil {
+		return err
+	}
+	if frame == nil {
+		return fmt.Errorf("ffmpeg could not decode any frames")
+	}
+	imgd.frames = append(imgd.frames, frame)
+	if opts.Play {
+		// the remaining frames are read as they are transmitted
+		imgd.video = stream
+		stream.name_to_unlink, src.name_to_unlink = src.name_to_unlink, ""
+	} else {
+		stream.close()
+	}
+	return nil
+}
@@ -0,0 +1,410 @@
+// License: GPLv3 Copyright: 2024, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kitty/tools/tui/graphics"
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+// With --viewer, icat keeps running, showing one image at a time, which can be
+// zoomed and panned. Images are loaded when they are navigated to, at a higher
+// resolution than the screen, so that they can be zoomed into, and are
+// transmitted to the terminal only once. Zooming and panning merely re-place
+// the image, with a placement that displays a rectangle from the image
+// scaled to a number of cells, so that the terminal does the scaling. Images
+// that were reduced to the loaded resolution cannot be zoomed beyond one pixel
+// of the screen per pixel of the loaded image, as that would only magnify
+// pixels, without showing more detail.
+
+// The maximum size of loaded images, relative to the size of the screen
+const viewer_resolution = 2
+
+const viewer_zoom_step = 1.25
+const viewer_min_zoom, viewer_max_zoom = 0.1, 32.0
+
+// The fraction of the visible part of the image moved by panning with the keyboard
+const viewer_pan_step = 0.1
+
+type fit_mode int
+
+const (
+	fit_image fit_mode = iota
+	fit_width
+	fit_height
+)
+
+func (f fit_mode) String() string {
+	switch f {
+	case fit_width:
+		return "width"
+	case fit_height:
+		return "height"
+	}
+	return "image"
+}
+
+func check_viewer_options() error {
+	if !opts.Viewer {
+		return nil
+	}
+	switch {
+	case opts.Place != "":
+		return fmt.Errorf("The --viewer option cannot be used with --place")
+	case grid != nil:
+		return fmt.Errorf("The --viewer option cannot be used with --grid")
+	case opts.UnicodePlaceholder || opts.Passthrough == "tmux":
+		return fmt.Errorf("The --viewer option cannot be used with Unicode placeholders")
+	case opts.Interactive:
+		return fmt.Errorf("The --viewer option cannot be used with --interactive")
+	case opts.Play:
+		return fmt.Errorf("The --viewer option cannot be used with --play")
+	}
+	return nil
+}
+
+type viewer_layout struct {
+	// the position and size of the placement, in cells of the screen
+	left, top, columns, rows int
+	// the rectangle of the image that is displayed, in pixels of the image
+	src_x, src_y, src_width, src_height int
+}
+
+type image_viewer struct {
+	lp    *loop.Loop
+	items []input_arg
+	// the item being shown, or being loaded
+	current int
+	// the item to show once the item being loaded is done
+	wanted  int
+	loading bool
+	imgd    *image_data
+	zoom    float64
+	fit     fit_mode
+	// the center of the visible part of the image, in pixels of the image
+	center_x, center_y float64
+	dragging           bool
+	drag_start         struct {
+		x, y               int
+		center_x, center_y float64
+	}
+}
+
+// The size of cells of the screen, in pixels, and of the area used for the
+// image, in cells, the last line is used for the status line
+func viewer_area() (cell_width, cell_height, columns, rows int) {
+	cell_width = utils.Max(int(screen_size.Xpixel)/int(screen_size.Col), 1)
+	cell_height = utils.Max(int(screen_size.Ypixel)/int(screen_size.Row), 1)
+	return cell_width, cell_height, int(screen_size.Col), utils.Max(1, int(screen_size.Row)-1)
+}
+
+// The number of pixels of the screen per pixel of the image, without zoom
+func (self *image_viewer) fit_scale() float64 {
+	cw, ch, cols, rows := viewer_area()
+	sx := float64(cols*cw) / float64(self.imgd.canvas_width)
+	sy := float64(rows*ch) / float64(self.imgd.canvas_height)
+	var ans float64
+	switch self.fit {
+	case fit_width:
+		ans = sx
+	case fit_height:
+		ans = sy
+	default:
+		ans = math.Min(sx, sy)
+		if !opts.ScaleUp {
+			ans = math.Min(ans, 1)
+		}
+	}
+	return ans
+}
+
+// The number of pixels of the screen per pixel of the image
+func (self *image_viewer) scale() float64 {
+	return self.fit_scale() * self.zoom
+}
+
+func (self *image_viewer) max_zoom() float64 {
+	if self.imgd.canvas_width >= self.imgd.available_width || self.imgd.canvas_height >= self.imgd.available_height {
+		// the image was probably reduced when loaded
+		return math.Max(1, math.Min(viewer_max_zoom, 1/self.fit_scale()))
+	}
+	return viewer_max_zoom
+}
+
+func (self *image_viewer) layout() (ans viewer_layout) {
+	cw, ch, cols, rows := viewer_area()
+	width, height := float64(self.imgd.canvas_width), float64(self.imgd.canvas_height)
+	scale := self.scale()
+	ans.columns = utils.Max(1, utils.Min(cols, int(math.Ceil(width*scale/float64(cw)))))
+	ans.rows = utils.Max(1, utils.Min(rows, int(math.Ceil(height*scale/float64(ch)))))
+	ans.left, ans.top = (cols-ans.columns)/2, (rows-ans.rows)/2
+	visible_width := math.Min(width, float64(ans.columns*cw)/scale)
+	visible_height := math.Min(height, float64(ans.rows*ch)/scale)
+	clamp := func(center, visible, total float64) float64 {
+		return math.Max(visible/2, math.Min(center, total-visible/2))
+	}
+	self.center_x = clamp(self.center_x, visible_width, width)
+	self.center_y = clamp(self.center_y, visible_height, height)
+	ans.src_x = utils.Max(0, int(math.Round(self.center_x-visible_width/2)))
+	ans.src_y = utils.Max(0, int(math.Round(self.center_y-visible_height/2)))
+	ans.src_width = utils.Max(1, int(math.Round(visible_width)))
+	ans.src_height = utils.Max(1, int(math.Round(visible_height)))
+	return
+}
+
+func (self *image_viewer) is_showing_image() bool {
+	return !self.loading && self.imgd != nil && self.imgd.err == nil
+}
+
+func (self *image_viewer) draw_image() {
+	l := self.layout()
+	self.lp.MoveCursorTo(l.left+1, l.top+1)
+	gc := new_graphics_command(self.imgd)
+	gc.SetAction(graphics.GRT_action_display).SetImageId(self.imgd.image_id).SetPlacementId(1).SetQuiet(graphics.GRT_quiet_silent)
+	gc.SetCursorMovement(graphics.GRT_cursor_static)
+	gc.SetLeftEdge(uint64(l.src_x)).SetTopEdge(uint64(l.src_y)).SetWidth(uint64(l.src_width)).SetHeight(uint64(l.src_height))
+	gc.SetColumns(uint64(l.columns)).SetRows(uint64(l.rows))
+	if z_index != 0 {
+		gc.SetZIndex(z_index)
+	}
+	_ = gc.WriteWithPayloadToLoop(self.lp, nil)
+}
+
+func (self *image_viewer) draw_status() {
+	self.lp.MoveCursorTo(1, int(screen_size.Row))
+	self.lp.ClearToEndOfLine()
+	arg := self.items[self.current]
+	name := utils.IfElse(arg.value == "", "<stdin>", filepath.Base(arg.value))
+	status := fmt.Sprintf("[%d/%d] %s", self.current+1, len(self.items), name)
+	switch {
+	case self.loading:
+		status += "  Loading..."
+	case self.imgd.err != nil:
+		status += "  \x1b[31m" + self.imgd.err.Error() + "\x1b[39m"
+	default:
+		status += fmt.Sprintf("  %dx%d  %d%%  fit: %s", self.imgd.canvas_width, self.imgd.canvas_height, int(math.Round(self.scale()*100)), self.fit)
+		status += "  \x1b[2m+/-: zoom  0: reset  w/h: fit width/height  Arrows/drag: pan  n/p: next/previous  q: quit\x1b[22m"
+	}
+	self.lp.QueueWriteString(wcswidth.TruncateToVisualLength(strings.ReplaceAll(status, "\n", " "), int(screen_size.Col)) + "\x1b[m")
+}
+
+func (self *image_viewer) draw() {
+	self.lp.StartAtomicUpdate()
+	defer self.lp.EndAtomicUpdate()
+	self.lp.ClearScreen()
+	if self.is_showing_image() {
+		self.draw_image()
+	}
+	self.draw_status()
+}
+
+// Remove the image that is shown from the terminal
+func (self *image_viewer) free_image() {
+	if self.is_showing_image() {
+		gc := new_graphics_command(self.imgd)
+		gc.SetAction(graphics.GRT_action_delete).SetDelete(graphics.GRT_free_by_id).SetImageId(self.imgd.image_id).SetQuiet(graphics.GRT_quiet_silent)
+		_ = gc.WriteWithPayloadToLoop(self.lp, nil)
+	}
+	self.imgd = nil
+}
+
+func (self *image_viewer) load(idx int) {
+	self.wanted = idx
+	if self.loading {
+		// the item is loaded once the item being loaded is done
+		return
+	}
+	self.free_image()
+	self.loading, self.current = true, idx
+	self.draw()
+	arg := self.items[idx]
+	go func() {
+		process_arg(arg)
+		self.lp.WakeupMainThread()
+	}()
+}
+
+func (self *image_viewer) on_wakeup() error {
+	imgd := <-output_channel
+	self.loading = false
+	if self.wanted != self.current {
+		release_frames(imgd)
+		self.load(self.wanted)
+		return nil
+	}
+	self.imgd = imgd
+	self.zoom, self.fit = 1, fit_image
+	if imgd.err == nil {
+		buf := strings.Builder{}
+		tty_output = &buf
+		transmit_image(imgd)
+		tty_output = os.Stdout
+		self.lp.QueueWriteString(buf.String())
+		self.center_x, self.center_y = float64(imgd.canvas_width)/2, float64(imgd.canvas_height)/2
+	}
+	self.draw()
+	return nil
+}
+
+func (self *image_viewer) navigate(delta int) {
+	if idx := utils.Max(0, utils.Min(self.wanted+delta, len(self.items)-1)); idx != self.wanted {
+		self.load(idx)
+	}
+}
+
+func (self *image_viewer) set_zoom(zoom float64) {
+	self.zoom = math.Max(viewer_min_zoom, math.Min(zoom, self.max_zoom()))
+	self.draw()
+}
+
+func (self *image_viewer) toggle_fit(fit fit_mode) {
+	self.fit = utils.IfElse(self.fit == fit, fit_image, fit)
+	self.set_zoom(1)
+}
+
+func (self *image_viewer) pan(dx, dy float64) {
+	l := self.layout()
+	self.center_x += dx * float64(l.src_width)
+	self.center_y += dy * float64(l.src_height)
+	self.draw()
+}
+
+func (self *image_viewer) on_text(text string, from_key_event, in_bracketed_paste bool) error {
+	switch text {
+	case "n":
+		self.navigate(1)
+	case "p":
+		self.navigate(-1)
+	case "q":
+		self.lp.Quit(0)
+	}
+	if !self.is_showing_image() {
+		return nil
+	}
+	switch text {
+	case "+", "=":
+		self.set_zoom(self.zoom * viewer_zoom_step)
+	case "-":
+		self.set_zoom(self.zoom / viewer_zoom_step)
+	case "0":
+		self.fit = fit_image
+		self.set_zoom(1)
+	case "w":
+		self.toggle_fit(fit_width)
+	case "h":
+		self.toggle_fit(fit_height)
+	}
+	return nil
+}
+
+func (self *image_viewer) on_key_event(ev *loop.KeyEvent) error {
+	switch {
+	case ev.MatchesPressOrRepeat("esc") || ev.MatchesPressOrRepeat("ctrl+c"):
+		ev.Handled = true
+		self.lp.Quit(0)
+	case ev.MatchesPressOrRepeat("page_down") || ev.MatchesPressOrRepeat("space"):
+		ev.Handled = true
+		self.navigate(1)
+	case ev.MatchesPressOrRepeat("page_up") || ev.MatchesPressOrRepeat("backspace"):
+		ev.Handled = true
+		self.navigate(-1)
+	case ev.MatchesPressOrRepeat("home"):
+		ev.Handled = true
+		self.navigate(-len(self.items))
+	case ev.MatchesPressOrRepeat("end"):
+		ev.Handled = true
+		self.navigate(len(self.items))
+	}
+	if ev.Handled || !self.is_showing_image() {
+		return nil
+	}
+	switch {
+	case ev.MatchesPressOrRepeat("left"):
+		self.pan(-viewer_pan_step, 0)
+	case ev.MatchesPressOrRepeat("right"):
+		self.pan(viewer_pan_step, 0)
+	case ev.MatchesPressOrRepeat("up"):
+		self.pan(0, -viewer_pan_step)
+	case ev.MatchesPressOrRepeat("down"):
+		self.pan(0, viewer_pan_step)
+	default:
+		return nil
+	}
+	ev.Handled = true
+	return nil
+}
+
+func (self *image_viewer) on_mouse_event(ev *loop.MouseEvent) error {
+	if !self.is_showing_image() {
+		self.dragging = false
+		return nil
+	}
+	switch ev.Event_type {
+	case loop.MOUSE_PRESS:
+		switch {
+		case ev.Buttons&loop.MOUSE_WHEEL_UP != 0:
+			self.set_zoom(self.zoom * viewer_zoom_step)
+		case ev.Buttons&loop.MOUSE_WHEEL_DOWN != 0:
+			self.set_zoom(self.zoom / viewer_zoom_step)
+		case ev.Buttons&loop.LEFT_MOUSE_BUTTON != 0:
+			self.dragging = true
+			self.drag_start.x, self.drag_start.y = ev.Pixel.X, ev.Pixel.Y
+			self.drag_start.center_x, self.drag_start.center_y = self.center_x, self.center_y
+		}
+	case loop.MOUSE_MOVE:
+		if self.dragging {
+			// the image moves with the mouse
+			scale := self.scale()
+			self.center_x = self.drag_start.center_x - float64(ev.Pixel.X-self.drag_start.x)/scale
+			self.center_y = self.drag_start.center_y - float64(ev.Pixel.Y-self.drag_start.y)/scale
+			self.draw()
+		}
+	case loop.MOUSE_RELEASE:
+		self.dragging = false
+	}
+	return nil
+}
+
+func run_viewer(items []input_arg) (err error) {
+	if len(items) == 0 {
+		return fmt.Errorf("No images to view")
+	}
+	self := image_viewer{items: items, zoom: 1}
+	if self.lp, err = loop.New(); err != nil {
+		return err
+	}
+	self.lp.MouseTrackingMode(loop.BUTTONS_AND_DRAG_MOUSE_TRACKING)
+	self.lp.OnInitialize = func() (string, error) {
+		self.lp.SetCursorVisible(false)
+		self.load(0)
+		return "", nil
+	}
+	self.lp.OnFinalize = func() string {
+		self.free_image()
+		self.lp.SetCursorVisible(true)
+		return ""
+	}
+	self.lp.OnResize = func(old_size, new_size loop.ScreenSize) error {
+		if opts.UseWindowSize == "" {
+			screen_size.Col, screen_size.Row = uint16(new_size.WidthCells), uint16(new_size.HeightCells)
+			screen_size.Xpixel, screen_size.Ypixel = uint16(new_size.WidthPx), uint16(new_size.HeightPx)
+		}
+		self.draw()
+		return nil
+	}
+	self.lp.OnWakeup = self.on_wakeup
+	self.lp.OnText = self.on_text
+	self.lp.OnKeyEvent = self.on_key_event
+	self.lp.OnMouseEvent = self.on_mouse_event
+	return self.lp.Run()
+}
@@ -0,0 +1,57 @@
+// License: GPLv3 Copyright: 2024, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+)
+
+var _ = fmt.Print
+
+func TestIcatViewerLayout(t *testing.T) {
+	opts = &Options{Viewer: true}
+	// cells of 10x20 pixels, with an area of 100x40 cells for the image
+	screen_size = &unix.Winsize{Col: 100, Row: 41, Xpixel: 1000, Ypixel: 820}
+	v := image_viewer{zoom: 1, imgd: &image_data{canvas_width: 500, canvas_height: 200}}
+	set_basic_metadata(v.imgd)
+	v.center_x, v.center_y = 250, 100
+	check := func(scale float64, expected viewer_layout) {
+		t.Helper()
+		if s := v.scale(); s != scale {
+			t.Fatalf("Incorrect scale: %v != %v", s, scale)
+		}
+		if diff := cmp.Diff(expected, v.layout(), cmp.AllowUnexported(viewer_layout{})); diff != "" {
+			t.Fatalf("Incorrect layout:\n%s", diff)
+		}
+	}
+
+	// small images are centered and not scaled up
+	check(1, viewer_layout{left: 25, top: 15, columns: 50, rows: 10, src_width: 500, src_height: 200})
+	v.fit = fit_width
+	check(2, viewer_layout{left: 0, top: 10, columns: 100, rows: 20, src_width: 500, src_height: 200})
+	v.fit, v.zoom = fit_image, 4
+	check(4, viewer_layout{left: 0, top: 0, columns: 100, rows: 40, src_x: 125, src_y: 0, src_width: 250, src_height: 200})
+	// images that were not reduced can be magnified to the maximum zoom
+	if z := v.max_zoom(); z != viewer_max_zoom {
+		t.Fatalf("Incorrect maximum zoom for a small image: %v", z)
+	}
+
+	// images reduced to the loaded resolution are not zoomed beyond it
+	v.imgd = &image_data{canvas_width: 2000, canvas_height: 1000}
+	set_basic_metadata(v.imgd)
+	v.zoom = 1
+	check(0.5, viewer_layout{left: 0, top: 7, columns: 100, rows: 25, src_width: 2000, src_height: 1000})
+	if z := v.max_zoom(); z != 2 {
+		t.Fatalf("Incorrect maximum zoom for a reduced image: %v", z)
+	}
+	// the visible part of the image is clamped to the image
+	v.zoom, v.center_x, v.center_y = v.max_zoom(), 0, 5000
+	check(1, viewer_layout{left: 0, top: 0, columns: 100, rows: 40, src_x: 0, src_y: 200, src_width: 1000, src_height: 800})
+	if v.center_x != 500 || v.center_y != 600 {
+		t.Fatalf("Center not clamped: %v, %v", v.center_x, v.center_y)
+	}
+}
@@ -0,0 +1,66 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"fmt"
+	"strings"
+
+	"kitty/kittens/ask"
+	"kitty/tools/tui"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+type ask_env_var struct {
+	name    string
+	visible bool
+}
+
+// The environment variables specified on the command line with --ask-env,
+// whose values are read from the user before connecting. Values are read
+// with hidden input, unless the name has the suffix :visible
+func ask_env_args(found_extra_args []string) (ans []ask_env_var, err error) {
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(found_extra_args); i += 2 {
+		if found_extra_args[i] != "--ask-env" {
+			continue
+		}
+		for _, x := range strings.Split(found_extra_args[i+1], ",") {
+			if x = strings.TrimSpace(x); x == "" {
+				continue
+			}
+			name, visible := strings.CutSuffix(x, ":visible")
+			if !utils.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`).MatchString(name) {
+				return nil, fmt.Errorf("The environment variable name %#v passed to --ask-env is not valid", name)
+			}
+			if !seen[name] {
+				seen[name] = true
+				ans = append(ans, ask_env_var{name, visible})
+			}
+		}
+	}
+	return
+}
+
+// Read the values of the environment variables from the user, adding them to
+// env. Variables for which no value is entered are not set.
+func ask_for_env(hostname string, vars []ask_env_var, env map[string]string) (err error) {
+	for _, v := range vars {
+		prompt := fmt.Sprintf("Value of %s for %s: ", v.name, hostname)
+		var val string
+		if v.visible {
+			val, err = ask.GetLine(&ask.Options{Prompt: prompt})
+		} else {
+			val, err = tui.ReadPassword(prompt, true)
+		}
+		if err != nil {
+			return err
+		}
+		if val != "" {
+			env[v.name] = val
+		}
+	}
+	return
+}
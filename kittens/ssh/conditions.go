@@ -0,0 +1,68 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Conditions on the remote host, used for conditional blocks in ssh.conf such
+// as: if remote_os == linux-musl. They are evaluated on the remote host by the
+// bootstrap script, since the remote host is not known before connecting.
+
+var remote_condition_variables = []string{"remote_os", "remote_kernel", "remote_arch"}
+
+type remote_condition struct {
+	variable, op, value string
+}
+
+// The key used to group instructions with identical conditions
+func (self *remote_condition) String() string {
+	return self.variable + " " + self.op + " " + self.value
+}
+
+func parse_remote_condition(spec string) (*remote_condition, error) {
+	variable, rest, _ := strings.Cut(strings.TrimSpace(spec), " ")
+	op, value, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	ans := &remote_condition{variable: variable, op: op, value: strings.TrimSpace(value)}
+	if ans.variable == "" || ans.op == "" || ans.value == "" {
+		return nil, fmt.Errorf("The condition %#v is not of the form: variable operator value", spec)
+	}
+	found := false
+	for _, x := range remote_condition_variables {
+		if x == ans.variable {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Unknown variable %#v in condition, must be one of: %s", ans.variable, strings.Join(remote_condition_variables, ", "))
+	}
+	switch ans.op {
+	case "==", "!=":
+	case "matches":
+		if _, err := regexp.Compile(ans.value); err != nil {
+			return nil, fmt.Errorf("The regular expression %#v in the condition is invalid with error: %w", ans.value, err)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown operator %#v in condition, must be one of: ==, != or matches", ans.op)
+	}
+	return ans, nil
+}
+
+// Wrap the specified line of data.sh so that it is only executed if the
+// condition is true on the remote host
+func (self *remote_condition) wrap(for_python bool, line string) string {
+	if for_python {
+		ans, _ := json.Marshal([]string{self.variable, self.op, self.value, line})
+		return "if " + utils.UnsafeBytesToString(ans)
+	}
+	return fmt.Sprintf("if remote_matches %s %s %s; then %s; fi", self.variable, utils.QuoteStringForSH(self.op), utils.QuoteStringForSH(self.value), line)
+}
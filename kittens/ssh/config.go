@@ -11,6 +11,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
@@ -20,6 +21,7 @@ import (
 	"kitty/tools/utils/shlex"
 
 	"github.com/bmatcuk/doublestar/v4"
+	"golang.org/x/exp/slices"
 	"golang.org/x/sys/unix"
 )
 
@@ -28,6 +30,11 @@ var _ = fmt.Print
 type EnvInstruction struct {
 	key, val                                         string
 	delete_on_remote, copy_from_local, literal_quote bool
+	// only applies on remote hosts matching the condition, if not nil
+	condition *remote_condition
+	// a shell_integration setting from a conditional block, resolved to the
+	// value of KITTY_SHELL_INTEGRATION when serializing
+	is_shell_integration bool
 }
 
 func quote_for_sh(val string, literal_quote bool) string {
@@ -77,32 +84,56 @@ func (self *EnvInstruction) Serialize(for_python bool, get_local_env func(string
 			return fmt.Sprintf("export %s=%s", kq, quote_for_sh(val, self.literal_quote))
 		}
 	}
+	ans := ""
 	if self.delete_on_remote {
-		return unset()
-	}
-	if self.copy_from_local {
-		val, found := get_local_env(self.key)
-		if !found {
-			return ""
+		ans = unset()
+	} else if self.copy_from_local {
+		if val, found := get_local_env(self.key); found {
+			ans = export(val)
 		}
-		return export(val)
+	} else {
+		ans = export(self.val)
 	}
-	return export(self.val)
+	if ans != "" && self.condition != nil {
+		ans = self.condition.wrap(for_python, ans)
+	}
+	return ans
 }
 
 func final_env_instructions(for_python bool, get_local_env func(string) (string, bool), env ...*EnvInstruction) string {
-	seen := make(map[string]int, len(env))
-	ans := make([]string, 0, len(env))
+	type item struct {
+		key, condition, line string
+	}
+	seen := make(map[item]int, len(env))
+	items := make([]item, 0, len(env))
 	for _, ei := range env {
 		q := ei.Serialize(for_python, get_local_env)
-		if q != "" {
-			if pos, found := seen[ei.key]; found {
-				ans[pos] = q
-			} else {
-				seen[ei.key] = len(ans)
-				ans = append(ans, q)
+		if q == "" {
+			continue
+		}
+		k := item{key: ei.key}
+		if ei.condition != nil {
+			k.condition = ei.condition.String()
+		} else {
+			// an unconditional value overrides all previous conditional ones
+			for i, x := range items {
+				if x.key == ei.key && x.condition != "" {
+					items[i].line = ""
+				}
 			}
 		}
+		if pos, found := seen[k]; found {
+			items[pos].line = q
+		} else {
+			seen[k] = len(items)
+			items = append(items, item{key: k.key, condition: k.condition, line: q})
+		}
+	}
+	ans := make([]string, 0, len(items))
+	for _, x := range items {
+		if x.line != "" {
+			ans = append(ans, x.line)
+		}
 	}
 	return strings.Join(ans, "\n")
 }
@@ -110,6 +141,44 @@ func final_env_instructions(for_python bool, get_local_env func(string) (string,
 type CopyInstruction struct {
 	local_path, arcname string
 	exclude_patterns    []string
+	// the contents of the copied files contain placeholders
+	is_template bool
+	// copy instructions whose paths contain placeholders are resolved when
+	// connecting, if not nil
+	unresolved *copy_spec
+	// only applies on remote hosts matching the condition, if not nil
+	condition *remote_condition
+}
+
+type copy_spec struct {
+	opts *copy_options
+	args []string
+}
+
+// Placeholders in copy instructions, replaced with values from the connection
+func placeholder_pat() *regexp.Regexp {
+	return utils.MustCompile(`\{(hostname|user|env:[a-zA-Z_][a-zA-Z0-9_]*)\}`)
+}
+
+func has_placeholders(text string) bool {
+	return placeholder_pat().MatchString(text)
+}
+
+type placeholder_values struct {
+	hostname, user string
+}
+
+func (self *placeholder_values) expand(text string) string {
+	return placeholder_pat().ReplaceAllStringFunc(text, func(m string) string {
+		switch name := m[1 : len(m)-1]; name {
+		case "hostname":
+			return self.hostname
+		case "user":
+			return self.user
+		default:
+			return os.Getenv(name[len("env:"):])
+		}
+	})
 }
 
 func ParseEnvInstruction(spec string) (ans []*EnvInstruction, err error) {
@@ -192,6 +261,13 @@ func ParseCopyInstruction(spec string) (ans []*CopyInstruction, err error) {
 	if err != nil {
 		return nil, err
 	}
+	if has_placeholders(opts.Dest) || slices.ContainsFunc(args, has_placeholders) {
+		return []*CopyInstruction{{unresolved: &copy_spec{opts, args}}}, nil
+	}
+	return resolve_copy_spec(opts, args)
+}
+
+func resolve_copy_spec(opts *copy_options, args []string) (ans []*CopyInstruction, err error) {
 	locations := make([]string, 0, len(args))
 	for _, arg := range args {
 		locs, err := resolve_file_spec(arg, opts.Glob)
@@ -209,7 +285,7 @@ func ParseCopyInstruction(spec string) (ans []*CopyInstruction, err error) {
 	home := paths_ctx.HomePath()
 	ans = make([]*CopyInstruction, 0, len(locations))
 	for _, loc := range locations {
-		ci := CopyInstruction{local_path: loc, exclude_patterns: opts.Exclude}
+		ci := CopyInstruction{local_path: loc, exclude_patterns: opts.Exclude, is_template: opts.Template}
 		if opts.SymlinkStrategy != "preserve" {
 			ci.local_path, err = filepath.EvalSymlinks(loc)
 			if err != nil {
@@ -339,7 +415,37 @@ func get_file_data(callback func(h *tar.Header, data []byte) error, seen map[fil
 	return nil
 }
 
-func (ci *CopyInstruction) get_file_data(callback func(h *tar.Header, data []byte) error, seen map[file_unique_id]string) (err error) {
+// Resolve the paths of copy instructions that contain placeholders
+func (ci *CopyInstruction) resolve(values *placeholder_values) (ans []*CopyInstruction, err error) {
+	if ci.unresolved == nil {
+		return []*CopyInstruction{ci}, nil
+	}
+	opts := *ci.unresolved.opts
+	opts.Dest = values.expand(opts.Dest)
+	args := make([]string, len(ci.unresolved.args))
+	for i, arg := range ci.unresolved.args {
+		args[i] = values.expand(arg)
+	}
+	if ans, err = resolve_copy_spec(&opts, args); err != nil {
+		return nil, fmt.Errorf("Failed to copy %s with error: %w", strings.Join(ci.unresolved.args, " "), err)
+	}
+	for _, x := range ans {
+		x.condition = ci.condition
+	}
+	return
+}
+
+func (ci *CopyInstruction) get_file_data(callback func(h *tar.Header, data []byte) error, seen map[file_unique_id]string, values *placeholder_values) (err error) {
+	if ci.is_template {
+		orig := callback
+		callback = func(h *tar.Header, data []byte) error {
+			if h.Typeflag == tar.TypeReg {
+				data = utils.UnsafeStringToBytes(values.expand(utils.UnsafeBytesToString(data)))
+				h.Size = int64(len(data))
+			}
+			return orig(h, data)
+		}
+	}
 	ep := ci.exclude_patterns
 	for _, folder_name := range []string{"__pycache__", ".DS_Store"} {
 		ep = append(ep, "**/"+folder_name, "**/"+folder_name+"/**")
@@ -349,6 +455,8 @@ func (ci *CopyInstruction) get_file_data(callback func(h *tar.Header, data []byt
 
 type ConfigSet struct {
 	all_configs []*Config
+	// the condition of the current conditional block, if any
+	condition *remote_condition
 }
 
 func config_for_hostname(hostname_to_match, username_to_match string, cs *ConfigSet) *Config {
@@ -381,13 +489,57 @@ func config_for_hostname(hostname_to_match, username_to_match string, cs *Config
 
 func (self *ConfigSet) line_handler(key, val string) error {
 	c := self.all_configs[len(self.all_configs)-1]
-	if key == "hostname" {
+	switch key {
+	case "hostname":
+		self.condition = nil
 		c = NewConfig()
 		self.all_configs = append(self.all_configs, c)
+	case "if":
+		self.condition = nil
+		if strings.TrimSpace(val) == "always" {
+			return nil
+		}
+		cond, err := parse_remote_condition(val)
+		if err != nil {
+			return err
+		}
+		self.condition = cond
+		return nil
+	}
+	if self.condition != nil {
+		return parse_conditional(c, self.condition, key, val)
 	}
 	return c.Parse(key, val)
 }
 
+func parse_conditional(c *Config, condition *remote_condition, key, val string) error {
+	switch key {
+	case "env":
+		eis, err := ParseEnvInstruction(val)
+		if err != nil {
+			return err
+		}
+		for _, ei := range eis {
+			ei.condition = condition
+		}
+		c.Env = append(c.Env, eis...)
+	case "copy":
+		cis, err := ParseCopyInstruction(val)
+		if err != nil {
+			return err
+		}
+		for _, ci := range cis {
+			ci.condition = condition
+		}
+		c.Copy = append(c.Copy, cis...)
+	case "shell_integration":
+		c.Env = append(c.Env, &EnvInstruction{key: "KITTY_SHELL_INTEGRATION", val: strings.TrimSpace(val), literal_quote: true, condition: condition, is_shell_integration: true})
+	default:
+		return fmt.Errorf("The %s option cannot be used in conditional blocks, only env, copy and shell_integration can", key)
+	}
+	return nil
+}
+
 func load_config(hostname_to_match string, username_to_match string, overrides []string, paths ...string) (*Config, []config.ConfigLine, error) {
 	ans := &ConfigSet{all_configs: []*Config{NewConfig()}}
 	p := config.ConfigParser{LineHandler: ans.line_handler}
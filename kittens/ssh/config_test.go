@@ -3,6 +3,7 @@
 package ssh
 
 import (
+	"archive/tar"
 	"fmt"
 	"kitty/tools/utils"
 	"os"
@@ -111,6 +112,24 @@ func TestSSHConfigParsing(t *testing.T) {
 	conf = "env a=b\nhostname 2\ncolor_scheme xyz"
 	hostname = "2"
 	rt()
+	hostname = "unmatched"
+	conf = "env a=b\nif remote_os == linux-musl\nenv a=c\nenv b\nif remote_kernel matches ^6\\.\nenv a=d\nif always\nenv c=c"
+	rt(`export ["a","b",false]`, `if ["remote_os","==","linux-musl","export [\"a\",\"c\",false]"]`, `if ["remote_os","==","linux-musl","unset [\"b\"]"]`,
+		`if ["remote_kernel","matches","^6\\.","export [\"a\",\"d\",false]"]`, `export ["c","c",false]`)
+	for_python = false
+	rt(`export 'a'="b"`, `if remote_matches remote_os '==' 'linux-musl'; then export 'a'="c"; fi`, `if remote_matches remote_os '==' 'linux-musl'; then unset 'b'; fi`,
+		`if remote_matches remote_kernel 'matches' '^6\.'; then export 'a'="d"; fi`, `export 'c'="c"`)
+	// an unconditional value overrides previous conditional ones
+	conf = "if remote_arch != x86_64\nenv a=c\nif always\nenv a=b"
+	rt(`export 'a'="b"`)
+	for _, bad := range []string{"if remote_os", "if remote_host == x", "if remote_os ~ x", "if remote_kernel matches (", "if remote_os == macos\ncwd /tmp"} {
+		if err := os.WriteFile(cf, []byte(bad), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, bad_lines, err := load_config(hostname, username, nil, cf); err != nil || len(bad_lines) != 1 {
+			t.Fatalf("Invalid conditional config %#v not reported as a bad line", bad)
+		}
+	}
 
 	ci, err := ParseCopyInstruction("--exclude moose --dest=target " + cf)
 	if err != nil {
@@ -139,6 +158,38 @@ func TestSSHConfigParsing(t *testing.T) {
 	if len(ci) != 1 {
 		t.Fatal(ci)
 	}
+	tf := filepath.Join(filepath.Dir(cf), "myhost.gitconfig")
+	if err := os.WriteFile(tf, []byte("email = {user}@{hostname} {env:KSSH_TEST_VAR}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KSSH_TEST_VAR", "x")
+	ci, err = ParseCopyInstruction("--template --dest=.config/{hostname}/gitconfig " + filepath.Join(filepath.Dir(cf), "{hostname}.gitconfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ci) != 1 || ci[0].unresolved == nil {
+		t.Fatalf("Copy instruction with placeholders not left unresolved: %#v", ci)
+	}
+	values := &placeholder_values{hostname: "myhost", user: "me"}
+	ci, err = ci[0].resolve(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff = cmp.Diff([]string{"home/.config/myhost/gitconfig", tf}, []string{ci[0].arcname, ci[0].local_path}); diff != "" {
+		t.Fatalf("Incorrect resolved copy instruction:\n%s", diff)
+	}
+	var rendered string
+	if err = ci[0].get_file_data(func(h *tar.Header, data []byte) error {
+		if h.Typeflag == tar.TypeReg {
+			rendered = string(data)
+		}
+		return nil
+	}, map[file_unique_id]string{}, values); err != nil {
+		t.Fatal(err)
+	}
+	if diff = cmp.Diff("email = me@myhost x", rendered); diff != "" {
+		t.Fatalf("Incorrectly rendered template:\n%s", diff)
+	}
 
 	u, _ := user.Current()
 	un := u.Username
@@ -0,0 +1,287 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/humanize"
+
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
+)
+
+var _ = fmt.Print
+
+// Tracking of the active sessions of the ssh kitten, so that they and the SSH
+// ControlMasters they use can be listed and managed. Every session records
+// itself in a file in the runtime directory, removed when the session ends.
+
+type session struct {
+	Pid       int       `json:"pid"`
+	Kitty_pid int       `json:"kitty_pid"`
+	Hostname  string    `json:"hostname"`
+	Started   time.Time `json:"started"`
+	// The ssh command to control the ControlMaster used by the session,
+	// without the -O operation. Empty if connection sharing is disabled.
+	Control_cmd []string `json:"control_cmd,omitempty"`
+	// The sockets forwarded over the connection, as remote -> local
+	Forwarded []string `json:"forwarded,omitempty"`
+	// Identifies the ControlMaster when there is more than one for the host
+	Slot int `json:"slot,omitempty"`
+}
+
+func sessions_dir() string {
+	return filepath.Join(utils.RuntimeDir(), "kssh-sessions")
+}
+
+func (self *session) path() string {
+	return filepath.Join(sessions_dir(), strconv.Itoa(self.Pid)+".json")
+}
+
+// Record the session, returning a function to remove the record
+func register_session(s *session) (unregister func(), err error) {
+	if err = os.MkdirAll(sessions_dir(), 0o700); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	if err = utils.AtomicWriteFile(s.path(), data, 0o600); err != nil {
+		return nil, err
+	}
+	return func() { os.Remove(s.path()) }, nil
+}
+
+func is_process_alive(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || errors.Is(err, unix.EPERM)
+}
+
+// The active sessions, oldest first, restricted to those in the specified
+// kitty instance, if kitty_pid is not zero. The records of sessions that
+// ended without removing them are removed.
+func active_sessions(kitty_pid int) (ans []*session, err error) {
+	entries, err := os.ReadDir(sessions_dir())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(sessions_dir(), e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		s := session{}
+		if err = json.Unmarshal(data, &s); err != nil || s.Pid == 0 || !is_process_alive(s.Pid) {
+			os.Remove(path)
+			continue
+		}
+		if kitty_pid == 0 || s.Kitty_pid == kitty_pid {
+			ans = append(ans, &s)
+		}
+	}
+	slices.SortStableFunc(ans, func(a, b *session) int { return a.Started.Compare(b.Started) })
+	return
+}
+
+// The slot of the first ControlMaster for the host in the specified kitty
+// instance that has fewer than max_sessions active sessions
+func connection_slot(kitty_pid int, hostname string, max_sessions int) int {
+	sessions, _ := active_sessions(kitty_pid)
+	counts := make(map[int]int, 4)
+	for _, s := range sessions {
+		if s.Hostname == hostname && len(s.Control_cmd) > 0 {
+			counts[s.Slot]++
+		}
+	}
+	slot := 0
+	for counts[slot] >= max_sessions {
+		slot++
+	}
+	return slot
+}
+
+// How long to wait for a ControlMaster to respond, a ControlMaster whose
+// connection has hung can block ssh indefinitely
+var control_timeout = 5 * time.Second
+var control_timed_out = errors.New("The ControlMaster did not respond")
+
+// Run the specified operation, such as check or exit, on the ControlMaster
+// used by the session, returning the output of ssh
+func (self *session) control(op string) (output string, err error) {
+	if len(self.Control_cmd) == 0 {
+		return "", fmt.Errorf("The session %d does not use a shared connection", self.Pid)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), control_timeout)
+	defer cancel()
+	cmd := slices.Insert(slices.Clone(self.Control_cmd), 1, "-O", op)
+	c := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	b := bytes.Buffer{}
+	c.Stdout, c.Stderr = &b, &b
+	// do not wait for any children of ssh that inherited its output
+	c.WaitDelay = time.Second
+	err = c.Run()
+	if ctx.Err() != nil {
+		err = control_timed_out
+	}
+	return strings.TrimSpace(b.String()), err
+}
+
+var master_pid_pat = sync.OnceValue(func() *regexp.Regexp {
+	return regexp.MustCompile(`\(pid=(\d+)\)`)
+})
+
+// The pid of the ControlMaster used by the session or zero if it is not
+// running or did not respond
+func (self *session) master_pid() (pid int, responded bool) {
+	output, err := self.control("check")
+	if err != nil {
+		return 0, !errors.Is(err, control_timed_out)
+	}
+	if m := master_pid_pat().FindStringSubmatch(output); m != nil {
+		pid, _ = strconv.Atoi(m[1])
+	}
+	return pid, true
+}
+
+func list_connections(w io.Writer, kitty_pid int) error {
+	sessions, err := active_sessions(kitty_pid)
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		fmt.Fprintln(w, "There are no active connections")
+		return nil
+	}
+	now := time.Now()
+	// the ControlMasters are checked in parallel so that the listing takes
+	// at most control_timeout even when several of them do not respond
+	masters := make([]string, len(sessions))
+	var wg sync.WaitGroup
+	for i, s := range sessions {
+		masters[i] = "not shared"
+		if len(s.Control_cmd) > 0 {
+			wg.Add(1)
+			go func(i int, s *session) {
+				defer wg.Done()
+				pid, responded := s.master_pid()
+				switch {
+				case !responded:
+					masters[i] = "not responding"
+				case pid > 0:
+					masters[i] = fmt.Sprintf("running (pid %d)", pid)
+				default:
+					masters[i] = "not running"
+				}
+			}(i, s)
+		}
+	}
+	wg.Wait()
+	for i, s := range sessions {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%d: %s (up %s)\n", s.Pid, s.Hostname, strings.TrimSpace(humanize.ShortDuration(now.Sub(s.Started))))
+		fmt.Fprintln(w, "  ControlMaster:", masters[i])
+		for _, f := range s.Forwarded {
+			fmt.Fprintln(w, "  Forwarded:", f)
+		}
+	}
+	return nil
+}
+
+// The sessions matching the specified ids, which are either the process ids of
+// sessions or hostnames
+func sessions_for_ids(kitty_pid int, ids []string) (ans []*session, err error) {
+	sessions, err := active_sessions(kitty_pid)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		found := false
+		for _, s := range sessions {
+			if strconv.Itoa(s.Pid) == id || s.Hostname == id {
+				ans = append(ans, s)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No active connection matches: %s", id)
+		}
+	}
+	return
+}
+
+// Close the connections, terminating all sessions using them, or refresh them
+// by having their ControlMasters stop accepting new sessions, so that the next
+// session creates a new connection, while existing sessions are unaffected.
+func manage_connections(w io.Writer, action string, kitty_pid int, ids []string) error {
+	if len(ids) == 0 {
+		return fmt.Errorf("Must specify the connections to %s", action)
+	}
+	sessions, err := sessions_for_ids(kitty_pid, ids)
+	if err != nil {
+		return err
+	}
+	op, done_msg := "exit", "closed"
+	if action == "refresh" {
+		op, done_msg = "stop", "refreshed"
+	}
+	done := utils.NewSet[string](len(sessions))
+	for _, s := range sessions {
+		key := strings.Join(s.Control_cmd, "\x00")
+		if done.Has(key) {
+			// sessions sharing a ControlMaster
+			continue
+		}
+		done.Add(key)
+		if output, err := s.control(op); err != nil {
+			if output != "" {
+				err = fmt.Errorf("%s", output)
+			}
+			return fmt.Errorf("Failed to %s the connection to %s with error: %w", action, s.Hostname, err)
+		}
+		fmt.Fprintf(w, "The connection to %s was %s\n", s.Hostname, done_msg)
+	}
+	return nil
+}
+
+// Handle the connection management command line arguments, returning false if
+// args are not for connection management
+func handle_connection_management(args []string) (handled bool, err error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	kitty_pid, _ := strconv.Atoi(os.Getenv("KITTY_PID"))
+	switch args[0] {
+	case "--list-connections":
+		return true, list_connections(os.Stdout, kitty_pid)
+	case "--close-connection":
+		return true, manage_connections(os.Stdout, "close", kitty_pid, args[1:])
+	case "--refresh-connection":
+		return true, manage_connections(os.Stdout, "refresh", kitty_pid, args[1:])
+	}
+	return false, nil
+}
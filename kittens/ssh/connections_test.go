@@ -0,0 +1,127 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var _ = fmt.Print
+
+func TestSSHConnections(t *testing.T) {
+	// a kitty pid no other session can have
+	kitty_pid := -os.Getpid()
+	now := time.Now()
+	s := session{Pid: os.Getpid(), Kitty_pid: kitty_pid, Hostname: "myhost", Started: now.Add(-time.Minute), Forwarded: []string{"/r -> /l"}}
+	unregister, err := register_session(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unregister()
+	dead := session{Pid: 1 << 30, Kitty_pid: kitty_pid, Hostname: "dead", Started: now}
+	if _, err = register_session(&dead); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := active_sessions(kitty_pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Hostname != "myhost" {
+		t.Fatalf("Incorrect active sessions: %#v", sessions)
+	}
+	if _, err := os.Stat(dead.path()); err == nil {
+		t.Fatalf("The record of a dead session was not removed")
+	}
+
+	b := bytes.Buffer{}
+	if err = list_connections(&b, kitty_pid); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("%d: myhost (up 00:01:00)\n  ControlMaster: not shared\n  Forwarded: /r -> /l\n", s.Pid)
+	if b.String() != expected {
+		t.Fatalf("Incorrect listing: %#v != %#v", expected, b.String())
+	}
+
+	for _, ids := range [][]string{{"myhost"}, {fmt.Sprint(s.Pid)}} {
+		if q, err := sessions_for_ids(kitty_pid, ids); err != nil || len(q) != 1 {
+			t.Fatalf("Failed to find session for %v: %v", ids, err)
+		}
+	}
+	if _, err = sessions_for_ids(kitty_pid, []string{"nosuchhost"}); err == nil {
+		t.Fatalf("Found a session for a non-existent host")
+	}
+	if err = manage_connections(&b, "close", kitty_pid, []string{"myhost"}); err == nil || !strings.Contains(err.Error(), "shared connection") {
+		t.Fatalf("Closing an unshared connection did not fail: %v", err)
+	}
+	unregister()
+	b.Reset()
+	_ = list_connections(&b, kitty_pid)
+	if b.String() != "There are no active connections\n" {
+		t.Fatalf("Incorrect listing with no sessions: %#v", b.String())
+	}
+}
+
+func TestSSHConnectionSlot(t *testing.T) {
+	kitty_pid := -os.Getpid()
+	for i, pid := range []int{os.Getpid(), os.Getppid(), 1} {
+		s := session{Pid: pid, Kitty_pid: kitty_pid, Hostname: "h", Started: time.Now(), Control_cmd: []string{"ssh"}, Slot: i / 2}
+		unregister, err := register_session(&s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unregister()
+	}
+	for max_sessions, expected := range map[int]int{1: 2, 2: 1, 3: 0} {
+		if actual := connection_slot(kitty_pid, "h", max_sessions); actual != expected {
+			t.Fatalf("Incorrect slot with at most %d sessions: %d != %d", max_sessions, actual, expected)
+		}
+	}
+	if actual := connection_slot(kitty_pid, "other", 1); actual != 0 {
+		t.Fatalf("Incorrect slot for a host with no sessions: %d", actual)
+	}
+}
+
+func TestSSHConnectionsUnresponsiveMaster(t *testing.T) {
+	kitty_pid := -os.Getpid()
+	tdir := t.TempDir()
+	script := func(name, body string) string {
+		path := filepath.Join(tdir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	orig := control_timeout
+	control_timeout = 100 * time.Millisecond
+	defer func() { control_timeout = orig }()
+	now := time.Now()
+	for i, cmd := range []string{script("hung", "exec sleep 10"), script("ok", "echo 'Master running (pid=1234)'")} {
+		pid := []int{os.Getpid(), os.Getppid()}[i]
+		s := session{Pid: pid, Kitty_pid: kitty_pid, Hostname: filepath.Base(cmd), Started: now.Add(time.Duration(i) * time.Second), Control_cmd: []string{cmd}}
+		unregister, err := register_session(&s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unregister()
+	}
+	b := bytes.Buffer{}
+	start := time.Now()
+	if err := list_connections(&b, kitty_pid); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Listing connections waited for the unresponsive ControlMaster")
+	}
+	for _, x := range []string{"hung (up", "ControlMaster: not responding", "ok (up", "ControlMaster: running (pid 1234)"} {
+		if !strings.Contains(b.String(), x) {
+			t.Fatalf("%#v not in listing: %#v", x, b.String())
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"kitty/tools/tui/shell_integration"
+
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+type exec_result struct {
+	Exit_status int    `json:"exit_status"`
+	Stdout      string `json:"stdout"`
+	Stderr      string `json:"stderr"`
+}
+
+// The script that sets up the environment from ssh.conf on the remote host
+// and runs the command in it. The files installed by previous interactive
+// sessions, such as kitten, are used, nothing is copied to the remote host.
+func exec_script(host_opts *Config, command []string) string {
+	env := make([]*EnvInstruction, 0, len(host_opts.Env)+4)
+	for _, ei := range host_opts.Env {
+		if !ei.is_shell_integration {
+			env = append(env, ei)
+		}
+	}
+	add_env := func(key, val string) {
+		if val != "" {
+			env = append(env, &EnvInstruction{key: key, val: val})
+		}
+	}
+	add_env("KITTY_SSH_KITTEN_DATA_DIR", host_opts.Remote_dir)
+	add_env("KITTY_LOGIN_CWD", host_opts.Cwd)
+	if host_opts.Remote_kitty != Remote_kitty_no {
+		env = append(env, &EnvInstruction{key: "KITTY_REMOTE", val: host_opts.Remote_kitty.String(), literal_quote: true})
+	}
+	lines := []string{
+		string(shell_integration.Data()["shell-integration/ssh/bootstrap-utils.sh"].Data),
+		final_env_instructions(false, os.LookupEnv, env...),
+		`case "$KITTY_SSH_KITTEN_DATA_DIR" in`,
+		`    /*) data_dir="$KITTY_SSH_KITTEN_DATA_DIR" ;;`,
+		`    *) data_dir="$HOME/$KITTY_SSH_KITTEN_DATA_DIR"`,
+		`esac`,
+		`kitty_remote="$KITTY_REMOTE"`,
+		`unset KITTY_SSH_KITTEN_DATA_DIR KITTY_REMOTE`,
+		`install_kitty_bootstrap`,
+		`if [ -n "$KITTY_LOGIN_CWD" ]; then cd "$KITTY_LOGIN_CWD" || exit 1; fi`,
+		`unset KITTY_LOGIN_CWD`,
+		// just as with ssh, the command is the arguments joined by spaces
+		strings.Join(command, " "),
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Run a command on the remote host non-interactively, re-using the shared
+// connection, if any. Exits with the exit status of the command.
+func run_exec(args []string) (rc int, err error) {
+	as_json := false
+	if len(args) > 0 && args[0] == "--json" {
+		as_json = true
+		args = args[1:]
+	}
+	ssh_args, server_args, passthrough, found_extra_args, err := ParseSSHArgs(args, "--kitten", "--via")
+	if err != nil {
+		var invargs *ErrInvalidSSHArgs
+		if errors.As(err, &invargs) && invargs.Msg == "" {
+			err = fmt.Errorf("Invalid arguments for ssh")
+		}
+		return 1, err
+	}
+	if passthrough || len(server_args) < 2 {
+		return 1, fmt.Errorf("Usage: kitten ssh exec [--json] [ssh options] destination command [arguments...]")
+	}
+	hostname := server_args[0]
+	uname, hostname_for_match := get_destination(hostname)
+	overrides, _, err := parse_kitten_args(found_extra_args, uname, hostname_for_match)
+	if err != nil {
+		return 1, err
+	}
+	host_opts, bad_lines, err := load_config(hostname_for_match, uname, overrides)
+	if err != nil {
+		return 1, err
+	}
+	for _, x := range bad_lines {
+		fmt.Fprintf(os.Stderr, "Ignoring bad config line: %s:%d with error: %s", filepath.Base(x.Src_file), x.Line_number, x.Err)
+	}
+	cmd := append([]string{SSHExe()}, ssh_args...)
+	jump_hosts, err := jump_hosts_for_connection(hostname, found_extra_args, host_opts)
+	if err != nil {
+		return 1, err
+	}
+	if len(jump_hosts) > 0 {
+		if slices.Contains(ssh_args, "-J") {
+			return 1, fmt.Errorf("Cannot use the -J option of ssh together with --via or the via setting in ssh.conf")
+		}
+		cmd = append(cmd, "-J", strings.Join(jump_hosts, ","))
+	}
+	proxy_args, err := connection_proxy_args(host_opts, jump_hosts)
+	if err != nil {
+		return 1, err
+	}
+	cmd = append(cmd, proxy_args...)
+	// connections are shared only with the interactive sessions in the same
+	// kitty instance
+	if kpid, err := strconv.Atoi(os.Getenv("KITTY_PID")); err == nil && host_opts.Share_connections {
+		control_master_args, err := connection_sharing_args(kpid, host_opts, 0)
+		if err != nil {
+			return 1, err
+		}
+		cmd = append(cmd, control_master_args...)
+	}
+	if os.Getenv("KITTY_WINDOW_ID") != "" && (host_opts.Askpass == Askpass_native || (host_opts.Askpass == Askpass_unless_set && os.Getenv("SSH_ASKPASS") == "")) {
+		set_askpass()
+	}
+	unwrap_script, encoded_script := quote_sh_script(exec_script(host_opts, server_args[1:]))
+	cmd = append(cmd, "-T", "--", hostname, "exec", "sh", "-c", unwrap_script, encoded_script)
+	c := exec.Command(cmd[0], cmd[1:]...)
+	c.Stdin = os.Stdin
+	var stdout, stderr bytes.Buffer
+	if as_json {
+		c.Stdout, c.Stderr = &stdout, &stderr
+	} else {
+		c.Stdout, c.Stderr = os.Stdout, os.Stderr
+	}
+	if err = c.Run(); err != nil {
+		var exit_err *exec.ExitError
+		if !errors.As(err, &exit_err) {
+			return 1, err
+		}
+	}
+	rc = c.ProcessState.ExitCode()
+	if as_json {
+		data, err := json.MarshalIndent(exec_result{Exit_status: rc, Stdout: stdout.String(), Stderr: stderr.String()}, "", "  ")
+		if err != nil {
+			return 1, err
+		}
+		fmt.Println(string(data))
+	}
+	return rc, nil
+}
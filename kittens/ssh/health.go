@@ -0,0 +1,202 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"kitty/tools/tui"
+	"kitty/tools/utils"
+
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+// While a session is running, the shared connection it uses can be checked
+// periodically by asking its ControlMaster, with ssh -O check, which does not
+// open a new session on the server. When the check fails, a warning is shown
+// in the window title, via remote control, the same way as the tab color is
+// changed. The escape codes are written through the same writer as the output
+// of the session, between the escape codes in that output, so as not to
+// corrupt them.
+
+type set_window_title_payload struct {
+	Title string `json:"title,omitempty"`
+	Self  bool   `json:"self"`
+}
+
+// The command to check the ControlMaster, from the command used to control it
+func health_check_cmd(control_cmd []string) []string {
+	return slices.Insert(slices.Clone(control_cmd), 1, "-O", "check")
+}
+
+func connection_is_healthy(ctx context.Context, cmd []string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	return c.Run() == nil
+}
+
+const (
+	output_ground = iota
+	output_escape
+	output_csi
+	output_string
+	output_string_escape
+)
+
+// Writes the output of the session, keeping track of whether it is in the
+// middle of an escape code or UTF-8 character, so that escape codes from the
+// kitten can be inserted only between them
+type session_output struct {
+	mutex           sync.Mutex
+	dest            io.Writer
+	state           int
+	utf8_remaining  int
+	pending_escapes []string
+}
+
+func (self *session_output) at_boundary() bool {
+	return self.state == output_ground && self.utf8_remaining == 0
+}
+
+func (self *session_output) track(data []byte) {
+	for _, b := range data {
+		switch self.state {
+		case output_ground:
+			switch {
+			case b == 0x1b:
+				self.state, self.utf8_remaining = output_escape, 0
+			case b&0xc0 == 0x80:
+				if self.utf8_remaining > 0 {
+					self.utf8_remaining--
+				}
+			case b&0xe0 == 0xc0:
+				self.utf8_remaining = 1
+			case b&0xf0 == 0xe0:
+				self.utf8_remaining = 2
+			case b&0xf8 == 0xf0:
+				self.utf8_remaining = 3
+			default:
+				self.utf8_remaining = 0
+			}
+		case output_escape:
+			switch {
+			case b == '[':
+				self.state = output_csi
+			case b == ']' || b == 'P' || b == '_' || b == '^' || b == 'X':
+				self.state = output_string
+			case b < 0x20 || b > 0x2f: // not an intermediate byte
+				self.state = output_ground
+			}
+		case output_csi:
+			if b >= 0x40 && b <= 0x7e {
+				self.state = output_ground
+			}
+		case output_string:
+			switch b {
+			case 0x07:
+				self.state = output_ground
+			case 0x1b:
+				self.state = output_string_escape
+			}
+		case output_string_escape:
+			self.state = utils.IfElse(b == '\\', output_ground, output_string)
+		}
+	}
+}
+
+func (self *session_output) flush_pending() error {
+	for len(self.pending_escapes) > 0 && self.at_boundary() {
+		if _, err := io.WriteString(self.dest, self.pending_escapes[0]); err != nil {
+			return err
+		}
+		self.pending_escapes = self.pending_escapes[1:]
+	}
+	return nil
+}
+
+func (self *session_output) Write(data []byte) (n int, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if n, err = self.dest.Write(data); err != nil {
+		return
+	}
+	self.track(data)
+	return n, self.flush_pending()
+}
+
+// Write the escape code as soon as the output of the session is not in the
+// middle of an escape code
+func (self *session_output) write_escape_code(ec string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.pending_escapes = append(self.pending_escapes, ec)
+	return self.flush_pending()
+}
+
+type health_monitor struct {
+	unhealthy_title string
+	is_healthy      func(context.Context) bool
+	write           func(string) error
+	interval        time.Duration
+	showing_warning bool
+	done            chan bool
+}
+
+func (self *health_monitor) set_warning(show bool) {
+	if show == self.showing_warning {
+		return
+	}
+	p := set_window_title_payload{Self: true}
+	if show {
+		p.Title = self.unhealthy_title
+	}
+	// without a title kitty goes back to the title set by the remote host
+	if ec, err := tui.RemoteControlEscapeCode("set-window-title", p); err == nil && self.write(ec) == nil {
+		self.showing_warning = show
+	}
+}
+
+func (self *health_monitor) run(ctx context.Context) {
+	defer close(self.done)
+	ticker := time.NewTicker(self.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			self.set_warning(false)
+			return
+		case <-ticker.C:
+			healthy := self.is_healthy(ctx)
+			if ctx.Err() == nil {
+				self.set_warning(!healthy)
+			}
+		}
+	}
+}
+
+// Check the shared connection used by the session periodically until the
+// returned function is called
+func start_health_monitor(hostname string, control_cmd []string, interval time.Duration, output *session_output) (stop func()) {
+	check_cmd := health_check_cmd(control_cmd)
+	m := health_monitor{
+		unhealthy_title: fmt.Sprintf("⚠ The connection to %s is not responding", hostname),
+		is_healthy: func(ctx context.Context) bool {
+			return connection_is_healthy(ctx, check_cmd, interval)
+		},
+		write: output.write_escape_code, interval: interval, done: make(chan bool),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go m.run(ctx)
+	return func() {
+		cancel()
+		<-m.done
+	}
+}
@@ -0,0 +1,349 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"kitty/kittens/ask"
+	"kitty/tools/cli/markup"
+	"kitty/tools/utils"
+
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+// With host_key_verification kitten, the host keys of the remote host are
+// fetched with ssh-keyscan before connecting and compared with the ones in the
+// known hosts files. New and changed keys are shown to the user, who can
+// accept them permanently, by writing them to the known hosts file, or for
+// this connection only, by using a temporary known hosts file. The known
+// hosts files are searched and fingerprints calculated with ssh-keygen, so
+// hashed known hosts files are supported.
+
+type host_key struct {
+	keytype, key string
+}
+
+type known_host_entry struct {
+	host_key
+	file string
+	line int
+}
+
+type host_key_status int
+
+const (
+	host_key_known host_key_status = iota
+	host_key_new
+	host_key_changed
+)
+
+// The output of ssh -G as a map of lowercase keys to values
+func parse_ssh_config_dump(output string) map[string]string {
+	ans := make(map[string]string, 64)
+	for _, line := range utils.Splitlines(output) {
+		if key, val, found := strings.Cut(strings.TrimSpace(line), " "); found {
+			if _, exists := ans[key]; !exists {
+				ans[key] = val
+			}
+		}
+	}
+	return ans
+}
+
+// The name of the host as used in known hosts files
+func known_hosts_name(cfg map[string]string) string {
+	name := cfg["hostname"]
+	if alias := cfg["hostkeyalias"]; alias != "" && alias != "none" {
+		name = alias
+	}
+	if port := cfg["port"]; port != "" && port != "22" {
+		name = "[" + name + "]:" + port
+	}
+	return name
+}
+
+// The host keys from the output of ssh-keyscan
+func parse_keyscan_output(output string) (ans []host_key) {
+	for _, line := range utils.Splitlines(output) {
+		if fields := strings.Fields(line); len(fields) >= 3 && !strings.HasPrefix(fields[0], "#") {
+			ans = append(ans, host_key{fields[1], fields[2]})
+		}
+	}
+	// show the key ssh is most likely to use first
+	order := func(k host_key) int {
+		switch {
+		case strings.Contains(k.keytype, "ed25519"):
+			return 0
+		case strings.Contains(k.keytype, "ecdsa"):
+			return 1
+		}
+		return 2
+	}
+	slices.SortStableFunc(ans, func(a, b host_key) int { return order(a) - order(b) })
+	return
+}
+
+// The entries found in the known hosts file from the output of ssh-keygen -F
+func parse_known_hosts_search(output, file string) (ans []known_host_entry) {
+	line_number := 0
+	for _, line := range utils.Splitlines(output) {
+		if strings.HasPrefix(line, "#") {
+			if _, num, found := strings.Cut(line, "found: line "); found {
+				line_number, _ = strconv.Atoi(strings.TrimSpace(num))
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		// lines with markers such as @cert-authority or @revoked are not host keys
+		if len(fields) >= 3 && !strings.HasPrefix(fields[0], "@") {
+			ans = append(ans, known_host_entry{host_key{fields[1], fields[2]}, file, line_number})
+		}
+	}
+	return
+}
+
+func check_host_keys(offered []host_key, known []known_host_entry) host_key_status {
+	if len(known) == 0 {
+		return host_key_new
+	}
+	for _, k := range known {
+		if slices.Contains(offered, k.host_key) {
+			return host_key_known
+		}
+	}
+	return host_key_changed
+}
+
+func known_hosts_files(cfg map[string]string) (user_files, all_files []string) {
+	for _, key := range []string{"userknownhostsfile", "globalknownhostsfile"} {
+		for _, x := range strings.Fields(cfg[key]) {
+			if x == "none" {
+				continue
+			}
+			x = utils.Expanduser(x)
+			if key == "userknownhostsfile" {
+				user_files = append(user_files, x)
+			}
+			all_files = append(all_files, x)
+		}
+	}
+	return
+}
+
+func find_known_hosts(name string, files []string) (ans []known_host_entry) {
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
+			continue
+		}
+		// exits with a non-zero status if the host is not found
+		output, _ := exec.Command("ssh-keygen", "-F", name, "-f", f).Output()
+		ans = append(ans, parse_known_hosts_search(utils.UnsafeBytesToString(output), f)...)
+	}
+	return
+}
+
+func known_hosts_lines(name string, keys []host_key) []byte {
+	buf := strings.Builder{}
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s %s %s\n", name, k.keytype, k.key)
+	}
+	return utils.UnsafeStringToBytes(buf.String())
+}
+
+// The fingerprints of the keys as output by ssh-keygen -l, with randomart if
+// visual is true
+func key_fingerprints(keys []host_key, hash string, visual bool) (string, error) {
+	f, err := os.CreateTemp("", "kssh-host-keys-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	if _, err = f.Write(known_hosts_lines("host", keys)); err != nil {
+		return "", err
+	}
+	args := []string{"-l", "-E", hash, "-f", f.Name()}
+	if visual {
+		args = append(args, "-v")
+	}
+	output, err := exec.Command("ssh-keygen", args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to calculate the fingerprints of the host keys with error: %w", err)
+	}
+	// remove the dummy hostname
+	return strings.ReplaceAll(utils.UnsafeBytesToString(output), " host (", " ("), nil
+}
+
+func host_key_message(name string, status host_key_status, offered []host_key, known []known_host_entry) (string, error) {
+	m := markup.New(true)
+	lines := []string{}
+	if status == host_key_changed {
+		lines = append(lines,
+			m.Err(fmt.Sprintf("WARNING: THE HOST KEY FOR %s HAS CHANGED!", name)),
+			m.Err("Someone could be eavesdropping on you right now (man-in-the-middle attack)! It is also possible that the host key has just been changed."),
+			"", "The previously known keys are:")
+		for _, k := range known {
+			fp, err := key_fingerprints([]host_key{k.host_key}, "sha256", false)
+			if err != nil {
+				return "", err
+			}
+			lines = append(lines, fmt.Sprintf("%s from %s line %d", strings.TrimSpace(fp), k.file, k.line))
+		}
+		lines = append(lines, "", "The host now offers the key:")
+	} else {
+		lines = append(lines, fmt.Sprintf("The authenticity of the host %s cannot be established, it has never been connected to before. It offers the key:", m.Yellow(name)))
+	}
+	visual, err := key_fingerprints(offered[:1], "sha256", true)
+	if err != nil {
+		return "", err
+	}
+	md5, err := key_fingerprints(offered[:1], "md5", false)
+	if err != nil {
+		return "", err
+	}
+	lines = append(lines, utils.Splitlines(strings.TrimSpace(visual))...)
+	lines = append(lines, strings.TrimSpace(md5))
+	if len(offered) > 1 {
+		others, err := key_fingerprints(offered[1:], "sha256", false)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, "", "Other keys offered by the host:")
+		lines = append(lines, utils.Splitlines(strings.TrimSpace(others))...)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// The name of the host hashed in the same way as ssh-keygen -H does it, so
+// that only the lines added for the host are hashed, rather than the whole
+// known hosts file
+func hashed_known_hosts_name(name string) (string, error) {
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	h := hmac.New(sha1.New, salt)
+	h.Write(utils.UnsafeStringToBytes(name))
+	return "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// Remember the keys for the host in the first user known hosts file,
+// replacing any previous keys for the host
+func remember_host_keys(cfg map[string]string, name string, keys []host_key, known []known_host_entry) error {
+	user_files, _ := known_hosts_files(cfg)
+	if len(user_files) == 0 {
+		return fmt.Errorf("No known hosts file to write the host key to")
+	}
+	for _, k := range known {
+		if slices.Contains(user_files, k.file) {
+			if output, err := exec.Command("ssh-keygen", "-R", name, "-f", k.file).CombinedOutput(); err != nil {
+				return fmt.Errorf("Failed to remove the previous key for %s from %s with error: %w\n%s", name, k.file, err, string(output))
+			}
+			os.Remove(k.file + ".old")
+		}
+	}
+	line_name := name
+	if cfg["hashknownhosts"] == "yes" {
+		var err error
+		if line_name, err = hashed_known_hosts_name(name); err != nil {
+			return err
+		}
+	}
+	dest := user_files[0]
+	if err := os.MkdirAll(filepath.Dir(dest), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(known_hosts_lines(line_name, keys))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+var ErrHostKeyRejected = errors.New("The host key was rejected")
+
+// Verify the host keys of the remote host, returning the ssh options to use
+// for the connection, if any
+func verify_host_keys(ssh_args []string, hostname string) (extra_args []string, cleanup func(), err error) {
+	cleanup = func() {}
+	output, err := exec.Command(SSHExe(), utils.Concat([]string{"-G"}, ssh_args, []string{"--", hostname})...).Output()
+	if err != nil {
+		return nil, cleanup, fmt.Errorf("Failed to get the configuration for %s from ssh with error: %w", hostname, err)
+	}
+	cfg := parse_ssh_config_dump(utils.UnsafeBytesToString(output))
+	for _, key := range []string{"proxyjump", "proxycommand"} {
+		if val := cfg[key]; val != "" && val != "none" {
+			// ssh-keyscan cannot connect via proxies, leave it to ssh
+			return
+		}
+	}
+	strict := cfg["stricthostkeychecking"]
+	switch strict {
+	case "false", "no", "off", "true", "yes":
+		// with yes ssh refuses unknown and changed keys itself, and the user
+		// must not be able to override that by accepting them here
+		return
+	}
+	port := cfg["port"]
+	if port == "" {
+		port = "22"
+	}
+	// failure to fetch the keys is reported by ssh when connecting
+	output, err = exec.Command("ssh-keyscan", "-T", "10", "-p", port, "--", cfg["hostname"]).Output()
+	offered := parse_keyscan_output(utils.UnsafeBytesToString(output))
+	if err != nil || len(offered) == 0 {
+		return nil, cleanup, nil
+	}
+	name := known_hosts_name(cfg)
+	_, all_files := known_hosts_files(cfg)
+	known := find_known_hosts(name, all_files)
+	status := check_host_keys(offered, known)
+	if status == host_key_known || (status == host_key_new && strict == "accept-new") {
+		return
+	}
+	msg, err := host_key_message(name, status, offered, known)
+	if err != nil {
+		return nil, cleanup, err
+	}
+	choice, err := ask.GetChoices(&ask.Options{Type: "choices", Message: msg, Choices: []string{"a;green:Accept and remember", "o:Accept once", "r;red:Reject"}, Default: "r"})
+	if err != nil {
+		return nil, cleanup, err
+	}
+	switch choice {
+	case "a":
+		return nil, cleanup, remember_host_keys(cfg, name, offered, known)
+	case "o":
+		f, err := os.CreateTemp("", "kssh-known-hosts-*")
+		if err != nil {
+			return nil, cleanup, err
+		}
+		_, err = f.Write(known_hosts_lines(name, offered))
+		f.Close()
+		cleanup = func() { os.Remove(f.Name()) }
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		return []string{"-o", "UserKnownHostsFile=" + f.Name(), "-o", "GlobalKnownHostsFile=none"}, cleanup, nil
+	}
+	return nil, cleanup, ErrHostKeyRejected
+}
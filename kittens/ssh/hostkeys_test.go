@@ -0,0 +1,108 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestSSHHostKeys(t *testing.T) {
+	cfg := parse_ssh_config_dump("user me\nhostname example.com\nport 2222\nuserknownhostsfile ~/.ssh/known_hosts /x/kh2\nglobalknownhostsfile /etc/ssh/ssh_known_hosts\nhostkeyalias none\n")
+	if name := known_hosts_name(cfg); name != "[example.com]:2222" {
+		t.Fatalf("Incorrect known hosts name: %#v", name)
+	}
+	cfg["port"], cfg["hostkeyalias"] = "22", "alias"
+	if name := known_hosts_name(cfg); name != "alias" {
+		t.Fatalf("Incorrect known hosts name: %#v", name)
+	}
+	user_files, all_files := known_hosts_files(cfg)
+	if diff := cmp.Diff([]string{filepath.Join(os.Getenv("HOME"), ".ssh/known_hosts"), "/x/kh2"}, user_files); diff != "" {
+		t.Fatalf("Incorrect user known hosts files:\n%s", diff)
+	}
+	if len(all_files) != 3 {
+		t.Fatalf("Incorrect known hosts files: %#v", all_files)
+	}
+
+	offered := parse_keyscan_output("# example.com:22 SSH-2.0-OpenSSH_9.2\nexample.com ssh-rsa RSA\nexample.com ssh-ed25519 ED\nexample.com ecdsa-sha2-nistp256 EC\n")
+	if diff := cmp.Diff([]host_key{{"ssh-ed25519", "ED"}, {"ecdsa-sha2-nistp256", "EC"}, {"ssh-rsa", "RSA"}}, offered, cmp.AllowUnexported(host_key{})); diff != "" {
+		t.Fatalf("Incorrect offered keys:\n%s", diff)
+	}
+	known := parse_known_hosts_search("# Host example.com found: line 3 \nexample.com ssh-rsa RSA\n# Host example.com found: line 7 \n@cert-authority example.com ssh-rsa CA\n", "kh")
+	if diff := cmp.Diff([]known_host_entry{{host_key{"ssh-rsa", "RSA"}, "kh", 3}}, known, cmp.AllowUnexported(known_host_entry{}, host_key{})); diff != "" {
+		t.Fatalf("Incorrect known hosts entries:\n%s", diff)
+	}
+	if s := check_host_keys(offered, known); s != host_key_known {
+		t.Fatalf("Known host key not recognized: %d", s)
+	}
+	if s := check_host_keys(offered, nil); s != host_key_new {
+		t.Fatalf("New host key not recognized: %d", s)
+	}
+	known[0].key = "OLD"
+	if s := check_host_keys(offered, known); s != host_key_changed {
+		t.Fatalf("Changed host key not recognized: %d", s)
+	}
+
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		return
+	}
+	tdir := t.TempDir()
+	key_file := filepath.Join(tdir, "key")
+	if output, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", key_file).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to generate key: %s\n%s", err, output)
+	}
+	data, err := os.ReadFile(key_file + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(string(data))
+	key := host_key{fields[0], fields[1]}
+	kh := filepath.Join(tdir, "ssh", "known_hosts")
+	cfg = map[string]string{"userknownhostsfile": kh}
+	if err = remember_host_keys(cfg, "[h]:2222", []host_key{{"ssh-ed25519", "AAAAC3NzaC1lZDI1NTE5AAAAIGkZCSpc+v1kmq+nsMq6stQpv1fdTT1zbodCJNW11Mnl"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	known = find_known_hosts("[h]:2222", []string{kh})
+	if len(known) != 1 || known[0].line != 1 {
+		t.Fatalf("The remembered host key was not found: %#v", known)
+	}
+	if s := check_host_keys([]host_key{key}, known); s != host_key_changed {
+		t.Fatalf("Changed host key not recognized: %d", s)
+	}
+	msg, err := host_key_message("[h]:2222", host_key_changed, []host_key{key}, known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []string{"HAS CHANGED", "SHA256:bWR/W/M+yrk6b2b9G6nehBKxd6etHixF57CkvR6Je44 (ED25519) from " + kh + " line 1", "[ED25519 256]", "MD5:"} {
+		if !strings.Contains(msg, x) {
+			t.Fatalf("%#v not found in the message:\n%s", x, msg)
+		}
+	}
+	other := "other.example.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGkZCSpc+v1kmq+nsMq6stQpv1fdTT1zbodCJNW11Mnl\n"
+	if f, ferr := os.OpenFile(kh, os.O_WRONLY|os.O_APPEND, 0o600); ferr == nil {
+		_, _ = f.WriteString(other)
+		f.Close()
+	}
+	cfg["hashknownhosts"] = "yes"
+	if err = remember_host_keys(cfg, "[h]:2222", []host_key{key}, known); err != nil {
+		t.Fatal(err)
+	}
+	known = find_known_hosts("[h]:2222", []string{kh})
+	if s := check_host_keys([]host_key{key}, known); s != host_key_known || len(known) != 1 {
+		t.Fatalf("The host key was not replaced: %#v", known)
+	}
+	if data, _ = os.ReadFile(kh); strings.Contains(string(data), "[h]") || !strings.Contains(string(data), "|1|") {
+		t.Fatalf("The added host key was not hashed:\n%s", data)
+	}
+	if !strings.Contains(string(data), other) {
+		t.Fatalf("The entries for other hosts were hashed:\n%s", data)
+	}
+}
@@ -0,0 +1,137 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"kitty/kittens/ask"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// With --choose-identity the keys in the SSH agent of the host are listed and
+// the chosen one is pinned for the connection by using its public key as the
+// IdentityFile, which makes ssh use the corresponding private key from the
+// agent. The public keys are stored in the cache directory so that they remain
+// available for reconnections.
+
+type agent_identity struct {
+	public_key, description string
+}
+
+// The identities from the output of ssh-add -L and ssh-add -l, which list the
+// keys in the same order
+func parse_agent_identities(public_keys, fingerprints string) (ans []agent_identity) {
+	fps := utils.Splitlines(strings.TrimSpace(fingerprints))
+	for i, line := range utils.Splitlines(strings.TrimSpace(public_keys)) {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		desc := line
+		if i < len(fps) {
+			desc = fps[i]
+		}
+		ans = append(ans, agent_identity{line, desc})
+	}
+	return
+}
+
+// The ssh-agent socket for the host, empty to use SSH_AUTH_SOCK
+func agent_socket(ssh_args []string, hostname string) (string, error) {
+	output, err := exec.Command(SSHExe(), utils.Concat([]string{"-G"}, ssh_args, []string{"--", hostname})...).Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the configuration for %s from ssh with error: %w", hostname, err)
+	}
+	switch ans := parse_ssh_config_dump(utils.UnsafeBytesToString(output))["identityagent"]; ans {
+	case "", "SSH_AUTH_SOCK":
+		return "", nil
+	case "none":
+		return "", fmt.Errorf("The use of an SSH agent is disabled for %s", hostname)
+	default:
+		if strings.HasPrefix(ans, "$") {
+			return os.Getenv(ans[1:]), nil
+		}
+		return utils.Expanduser(ans), nil
+	}
+}
+
+func agent_identities(socket string) ([]agent_identity, error) {
+	run := func(arg string) (string, error) {
+		c := exec.Command("ssh-add", arg)
+		if socket != "" {
+			c.Env = append(os.Environ(), "SSH_AUTH_SOCK="+socket)
+		}
+		output, err := c.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("Failed to list the keys in the SSH agent: %s", strings.TrimSpace(string(output)))
+		}
+		return string(output), nil
+	}
+	public_keys, err := run("-L")
+	if err != nil {
+		return nil, err
+	}
+	fingerprints, err := run("-l")
+	if err != nil {
+		return nil, err
+	}
+	return parse_agent_identities(public_keys, fingerprints), nil
+}
+
+// Store the public key for use as an IdentityFile, returning its path
+func identity_file_for(public_key string) (string, error) {
+	h := sha256.Sum256(utils.UnsafeStringToBytes(public_key))
+	dir := filepath.Join(utils.CacheDir(), "ssh-identities")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	ans := filepath.Join(dir, hex.EncodeToString(h[:16])+".pub")
+	return ans, utils.AtomicWriteFile(ans, utils.UnsafeStringToBytes(public_key+"\n"), 0o600)
+}
+
+const identity_choice_letters = "123456789abcdefghijklmnopqrstuvwxyz"
+
+// Ask the user to choose one of the keys in the SSH agent, returning the ssh
+// options to use it for the connection
+func choose_identity(ssh_args []string, hostname string) ([]string, error) {
+	socket, err := agent_socket(ssh_args, hostname)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := agent_identities(socket)
+	if err != nil {
+		return nil, err
+	}
+	if len(identities) > len(identity_choice_letters) {
+		identities = identities[:len(identity_choice_letters)]
+	}
+	choices := make([]string, len(identities))
+	for i, x := range identities {
+		choices[i] = fmt.Sprintf("%c:%c) %s", identity_choice_letters[i], identity_choice_letters[i], x.description)
+	}
+	choice, err := ask.GetChoices(&ask.Options{Type: "choices", Message: fmt.Sprintf("Choose the key to use for %s", hostname), Choices: choices})
+	if err != nil {
+		return nil, err
+	}
+	idx := strings.Index(identity_choice_letters, choice)
+	if choice == "" || idx < 0 {
+		return nil, fmt.Errorf("No key was chosen")
+	}
+	identity_file, err := identity_file_for(identities[idx].public_key)
+	if err != nil {
+		return nil, err
+	}
+	ans := []string{"-o", "IdentityFile=" + identity_file, "-o", "IdentitiesOnly=yes"}
+	if socket != "" {
+		ans = append(ans, "-o", "IdentityAgent="+socket)
+	}
+	return ans, nil
+}
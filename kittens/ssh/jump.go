@@ -0,0 +1,71 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"fmt"
+	"strings"
+)
+
+var _ = fmt.Print
+
+// The jump hosts specified on the command line with --via
+func via_args(found_extra_args []string) (ans []string) {
+	for i := 0; i+1 < len(found_extra_args); i += 2 {
+		if found_extra_args[i] == "--via" {
+			ans = append(ans, found_extra_args[i+1])
+		}
+	}
+	return
+}
+
+// Build the chain of jump hosts needed to reach target via the specified
+// hops. Each hop is itself reached via the jump hosts from its via setting in
+// ssh.conf, which is returned by via_for_host.
+func jump_host_chain(target string, hops []string, via_for_host func(hostname string) (string, error)) (ans []string, err error) {
+	seen := map[string]bool{target: true}
+	var add func(hop string) error
+	add = func(hop string) error {
+		if seen[hop] {
+			return fmt.Errorf("The jump host %s occurs more than once when connecting to %s, check the via settings in ssh.conf for loops", hop, target)
+		}
+		seen[hop] = true
+		via, err := via_for_host(hop)
+		if err != nil {
+			return err
+		}
+		for _, x := range strings.Fields(via) {
+			if err = add(x); err != nil {
+				return err
+			}
+		}
+		ans = append(ans, hop)
+		return nil
+	}
+	for _, hop := range hops {
+		if err = add(hop); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// The jump host chain for the connection, using the hosts from the command
+// line if any, otherwise the via setting for the host from ssh.conf
+func jump_hosts_for_connection(target string, found_extra_args []string, host_opts *Config) ([]string, error) {
+	hops := via_args(found_extra_args)
+	if len(hops) == 0 {
+		hops = strings.Fields(host_opts.Via)
+	}
+	if len(hops) == 0 {
+		return nil, nil
+	}
+	return jump_host_chain(target, hops, func(hostname string) (string, error) {
+		uname, hostname_for_match := get_destination(hostname)
+		opts, _, err := load_config(hostname_for_match, uname, nil)
+		if err != nil {
+			return "", err
+		}
+		return opts.Via, nil
+	})
+}
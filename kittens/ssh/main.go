@@ -35,6 +35,7 @@ import (
 	"kitty/tools/utils/secrets"
 	"kitty/tools/utils/shlex"
 	"kitty/tools/utils/shm"
+	"kitty/tools/utils/style"
 
 	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
@@ -97,7 +98,7 @@ func parse_kitten_args(found_extra_args []string, username, hostname_for_match s
 	literal_env = make(map[string]string)
 	overrides = make([]string, 0, 4)
 	for i, a := range found_extra_args {
-		if i%2 == 0 {
+		if i%2 == 0 || found_extra_args[i-1] != "--kitten" {
 			continue
 		}
 		if key, val, found := strings.Cut(a, "="); found {
@@ -118,7 +119,9 @@ func parse_kitten_args(found_extra_args []string, username, hostname_for_match s
 	return
 }
 
-func connection_sharing_args(kitty_pid int) ([]string, error) {
+// The ssh options to share connections, the connection used is identified by
+// slot, see max_sessions_per_connection
+func connection_sharing_args(kitty_pid int, host_opts *Config, slot int) ([]string, error) {
 	rd := utils.RuntimeDir()
 	// Bloody OpenSSH generates a 40 char hash and in creating the socket
 	// appends a 27 char temp suffix to it. Socket max path length is approx
@@ -133,12 +136,20 @@ func connection_sharing_args(kitty_pid int) ([]string, error) {
 		rd = idiotic_design
 	}
 	cp := strings.Replace(kitty.SSHControlMasterTemplate, "{kitty_pid}", strconv.Itoa(kitty_pid), 1)
-	cp = strings.Replace(cp, "{ssh_placeholder}", "%C", 1)
+	placeholder := "%C"
+	if slot > 0 {
+		placeholder += "-" + strconv.Itoa(slot)
+	}
+	cp = strings.Replace(cp, "{ssh_placeholder}", placeholder, 1)
+	persist := "yes"
+	if host_opts.Connection_idle_timeout > 0 {
+		persist = strconv.FormatUint(host_opts.Connection_idle_timeout, 10)
+	}
 	return []string{
 		"-o", "ControlMaster=auto",
 		"-o", "ControlPath=" + filepath.Join(rd, cp),
-		"-o", "ControlPersist=yes",
-		"-o", "ServerAliveInterval=60",
+		"-o", "ControlPersist=" + persist,
+		"-o", "ServerAliveInterval=" + strconv.FormatUint(host_opts.Keepalive_interval, 10),
 		"-o", "ServerAliveCountMax=5",
 		"-o", "TCPKeepAlive=no",
 	}, nil
@@ -176,9 +187,32 @@ type connection_data struct {
 	echo_on            bool
 	request_data       bool
 	literal_env        map[string]string
+	asked_env          map[string]string
 	listen_on          string
+	forward_spec       string
 	test_script        string
 	dont_create_shm    bool
+	restore_cwd        bool
+	// the kitten binary to install on the remote host, if any, and its digest
+	kitten_binary []byte
+	kitten_digest string
+	// the platform of the remote host needed for upload_kitten is not yet
+	// recorded, so the bootstrap script must install the cached files and
+	// report it
+	platform_unknown bool
+	// the output of mosh-server when using mosh
+	mosh_output *mosh_output_filter
+	// the data uploaded with sftp, if not empty
+	data_file          string
+	data_file_contents []byte
+	// set when the bootstrap script could not read the data from the TTY
+	tty_unavailable bool
+	// the version of the files cached on the remote host, they are sent
+	// only if it differs from remote_cache_version
+	cached_version_on_remote string
+	remote_cache_version     string
+	// the cached files, sent by kitty if they are missing on the remote host
+	remote_cache_tarfile []byte
 
 	shm_name         string
 	script_type      string
@@ -188,6 +222,22 @@ type connection_data struct {
 	bootstrap_script string
 }
 
+// The exit code of the bootstrap scripts when they cannot read the data from
+// the TTY, with bootstrap_via auto, the data is then uploaded with sftp
+const bootstrap_tty_unavailable_exit_code = 97
+
+func (cd *connection_data) bootstrap_via_sftp() bool {
+	return cd.host_opts.Bootstrap_via == Bootstrap_via_sftp || cd.tty_unavailable
+}
+
+func (cd *connection_data) can_fallback_to_sftp() bool {
+	if cd.host_opts.Bootstrap_via != Bootstrap_via_auto || cd.tty_unavailable {
+		return false
+	}
+	_, err := exec.LookPath("sftp")
+	return err == nil
+}
+
 func get_effective_ksi_env_var(x string) string {
 	parts := strings.Split(strings.TrimSpace(strings.ToLower(x)), " ")
 	current := utils.NewSetWithItems(parts...)
@@ -201,12 +251,30 @@ func get_effective_ksi_env_var(x string) string {
 	return x
 }
 
+func effective_ksi(shell_integration string) string {
+	if shell_integration == "inherited" {
+		return get_effective_ksi_env_var(RelevantKittyOpts().Shell_integration)
+	}
+	return get_effective_ksi_env_var(shell_integration)
+}
+
 func serialize_env(cd *connection_data, get_local_env func(string) (string, bool)) (string, string) {
-	ksi := ""
-	if cd.host_opts.Shell_integration == "inherited" {
-		ksi = get_effective_ksi_env_var(RelevantKittyOpts().Shell_integration)
-	} else {
-		ksi = get_effective_ksi_env_var(cd.host_opts.Shell_integration)
+	ksi := effective_ksi(cd.host_opts.Shell_integration)
+	host_env := make([]*EnvInstruction, 0, len(cd.host_opts.Env))
+	conditional_ksi := make([]*EnvInstruction, 0, 2)
+	for _, ei := range cd.host_opts.Env {
+		if ei.is_shell_integration {
+			q := &EnvInstruction{key: ei.key, val: effective_ksi(ei.val), literal_quote: true, condition: ei.condition}
+			if q.val == "" {
+				q.delete_on_remote = true
+			} else if ksi == "" {
+				// ensure the shell integration files are sent
+				ksi = q.val
+			}
+			conditional_ksi = append(conditional_ksi, q)
+		} else {
+			host_env = append(host_env, ei)
+		}
 	}
 	env := make([]*EnvInstruction, 0, 8)
 	add_env := func(key, val string, fallback ...string) *EnvInstruction {
@@ -231,14 +299,19 @@ func serialize_env(cd *connection_data, get_local_env func(string) (string, bool
 	}
 	add_env("TERM", os.Getenv("TERM"), RelevantKittyOpts().Term)
 	add_env("COLORTERM", "truecolor")
-	env = append(env, cd.host_opts.Env...)
+	env = append(env, host_env...)
+	// values entered by the user override the ones from ssh.conf
+	for k, v := range cd.asked_env {
+		add_env(k, v)
+	}
 	add_env("KITTY_WINDOW_ID", os.Getenv("KITTY_WINDOW_ID"))
 	add_env("WINDOWID", os.Getenv("WINDOWID"))
-	if ksi != "" {
-		add_env("KITTY_SHELL_INTEGRATION", ksi)
+	if q := effective_ksi(cd.host_opts.Shell_integration); q != "" {
+		add_env("KITTY_SHELL_INTEGRATION", q)
 	} else {
 		env = append(env, &EnvInstruction{key: "KITTY_SHELL_INTEGRATION", delete_on_remote: true})
 	}
+	env = append(env, conditional_ksi...)
 	add_non_literal_env("KITTY_SSH_KITTEN_DATA_DIR", cd.host_opts.Remote_dir)
 	add_non_literal_env("KITTY_LOGIN_SHELL", cd.host_opts.Login_shell)
 	add_non_literal_env("KITTY_LOGIN_CWD", cd.host_opts.Cwd)
@@ -262,6 +335,25 @@ func make_tarfile(cd *connection_data, get_local_env func(string) (string, bool)
 	}
 	tw := tar.NewWriter(gw)
 	rd := strings.TrimRight(cd.host_opts.Remote_dir, "/")
+	cached_files := remote_cache_files(cd, rd, ksi)
+	cd.remote_cache_version = remote_cache_version(cached_files)
+	// kitty is not involved when bootstrapping via sftp, so it can neither
+	// send the cached files if they are missing nor record that they were sent
+	via_kitty := !cd.bootstrap_via_sftp()
+	use_remote_cache := via_kitty && cd.remote_cache_version == cd.cached_version_on_remote && !cd.platform_unknown
+	cd.remote_cache_tarfile = nil
+	if use_remote_cache {
+		// tell the bootstrap script to check the cached files are present
+		ei := &EnvInstruction{key: "KITTY_SSH_REMOTE_CACHE", val: cd.remote_cache_version, literal_quote: true}
+		env_script += "\n" + ei.Serialize(cd.script_type == "py", get_local_env)
+		if cd.remote_cache_tarfile, err = make_remote_cache_tarfile(cached_files, rd, cd.remote_cache_version); err != nil {
+			return nil, err
+		}
+	} else if via_kitty {
+		// tell the bootstrap script to report when the cached files are installed
+		ei := &EnvInstruction{key: "KITTY_SSH_RECORD_CACHE", val: cd.remote_cache_version, literal_quote: true}
+		env_script += "\n" + ei.Serialize(cd.script_type == "py", get_local_env)
+	}
 	seen := make(map[file_unique_id]string, 32)
 	add := func(h *tar.Header, data []byte) (err error) {
 		// some distro's like nix mess with installed file permissions so ensure
@@ -279,8 +371,32 @@ func make_tarfile(cd *connection_data, get_local_env func(string) (string, bool)
 		}
 		return
 	}
+	// files copied only to hosts matching a condition are placed in a separate
+	// directory per condition and moved into place by the bootstrap script
+	conditional_dirs := map[string]string{}
+	values := &placeholder_values{hostname: cd.hostname_for_match, user: cd.username}
+	var copies []*CopyInstruction
 	for _, ci := range cd.host_opts.Copy {
-		err = ci.get_file_data(add, seen)
+		cis, err := ci.resolve(values)
+		if err != nil {
+			return nil, err
+		}
+		copies = append(copies, cis...)
+	}
+	for _, ci := range copies {
+		if ci.condition != nil {
+			key := ci.condition.String()
+			cdir, found := conditional_dirs[key]
+			if !found {
+				cdir = fmt.Sprintf("conditional/%d", len(conditional_dirs))
+				conditional_dirs[key] = cdir
+				env_script += "\n" + ci.condition.wrap(cd.script_type == "py", "merge_conditional_files "+cdir)
+			}
+			q := *ci
+			q.arcname = path.Join(cdir, ci.arcname)
+			ci = &q
+		}
+		err = ci.get_file_data(add, seen, values)
 		if err != nil {
 			return nil, err
 		}
@@ -303,21 +419,6 @@ func make_tarfile(cd *connection_data, get_local_env func(string) (string, bool)
 		}
 		return nil
 	}
-	add_entries := func(prefix string, items ...shell_integration.Entry) error {
-		for _, item := range items {
-			err := add(
-				&tar.Header{
-					Typeflag: item.Metadata.Typeflag, Name: path.Join(prefix, path.Base(item.Metadata.Name)), Format: tar.FormatPAX,
-					Size: int64(len(item.Data)), Mode: item.Metadata.Mode, ModTime: item.Metadata.ModTime,
-					AccessTime: item.Metadata.AccessTime, ChangeTime: item.Metadata.ChangeTime,
-				}, item.Data)
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-
-	}
 	if err = add_data(fe{"data.sh", utils.UnsafeStringToBytes(env_script)}); err != nil {
 		return nil, err
 	}
@@ -326,35 +427,19 @@ func make_tarfile(cd *connection_data, get_local_env func(string) (string, bool)
 			return nil, err
 		}
 	}
-	if ksi != "" {
-		for _, fname := range shell_integration.Data().FilesMatching(
-			"shell-integration/",
-			"shell-integration/ssh/.+",        // bootstrap files are sent as command line args
-			"shell-integration/zsh/kitty.zsh", // backward compat file not needed by ssh kitten
-		) {
-			arcname := path.Join("home/", rd, "/", path.Dir(fname))
-			err = add_entries(arcname, shell_integration.Data()[fname])
-			if err != nil {
-				return nil, err
-			}
-		}
-	}
-	if cd.host_opts.Remote_kitty != Remote_kitty_no {
-		arcname := path.Join("home/", rd, "/kitty")
-		err = add_data(fe{arcname + "/version", utils.UnsafeStringToBytes(kitty.VersionString)})
+	if cd.host_opts.Terminfo != "" {
+		tfiles, err := extra_terminfo_files(cd.host_opts.Terminfo)
 		if err != nil {
 			return nil, err
 		}
-		for _, x := range []string{"kitty", "kitten"} {
-			err = add_entries(path.Join(arcname, "bin"), shell_integration.Data()[path.Join("shell-integration", "ssh", x)])
-			if err != nil {
+		for _, tf := range tfiles {
+			if err = add_data(fe{path.Join("home", ".terminfo", tf.arcname), tf.data}); err != nil {
 				return nil, err
 			}
 		}
 	}
-	err = add_entries(path.Join("home", ".terminfo"), shell_integration.Data()["terminfo/kitty.terminfo"])
-	if err == nil {
-		err = add_entries(path.Join("home", ".terminfo", "x"), shell_integration.Data()["terminfo/x/"+kitty.DefaultTermName])
+	if !use_remote_cache {
+		err = write_cached_files(tw, cached_files, rd, cd.remote_cache_version)
 	}
 	if err == nil {
 		err = tw.Close()
@@ -369,7 +454,8 @@ func prepare_home_command(cd *connection_data) string {
 	is_python := cd.script_type == "py"
 	homevar := ""
 	for _, ei := range cd.host_opts.Env {
-		if ei.key == "HOME" && !ei.delete_on_remote {
+		// HOME is set before the remote host is detected
+		if ei.key == "HOME" && !ei.delete_on_remote && ei.condition == nil {
 			if ei.copy_from_local {
 				homevar = os.Getenv("HOME")
 			} else {
@@ -436,13 +522,35 @@ func bootstrap_script(cd *connection_data) (err error) {
 	if err != nil {
 		return err
 	}
+	cd.data_file, cd.data_file_contents = "", nil
+	if cd.bootstrap_via_sftp() {
+		// the data is uploaded with sftp instead of being requested over the TTY
+		token, err := secrets.TokenHex()
+		if err != nil {
+			return err
+		}
+		cd.data_file, cd.data_file_contents = ".kitty-ssh-kitten-data-"+token+".tar.gz", tfd
+		cd.request_data = false
+	}
 	data := map[string]string{
 		"tarfile":  base64.StdEncoding.EncodeToString(tfd),
 		"pw":       pw,
 		"hostname": cd.hostname_for_match, "username": cd.username,
 	}
+	if cd.restore_cwd {
+		data["restore_cwd"] = "1"
+	}
+	data["cache_version"] = cd.remote_cache_version
+	if cd.remote_cache_tarfile != nil {
+		data["cache_tarfile"] = base64.StdEncoding.EncodeToString(cd.remote_cache_tarfile)
+	} else {
+		data["cache_record"] = remote_cache_record_path(cd.username, cd.hostname_for_match, cd.host_opts.Remote_dir)
+		if cd.platform_unknown {
+			data["platform_record"] = remote_platform_record_path(cd.username, cd.hostname_for_match, cd.host_opts.Remote_dir)
+		}
+	}
 	encoded_data, err := json.Marshal(data)
-	if err == nil && !cd.dont_create_shm {
+	if err == nil && !cd.dont_create_shm && cd.data_file == "" {
 		data_shm, err = shm.CreateTemp(fmt.Sprintf("kssh-%d-", os.Getpid()), uint64(len(encoded_data)+8))
 		if err == nil {
 			err = shm.WriteWithSize(data_shm, encoded_data, 0)
@@ -454,7 +562,7 @@ func bootstrap_script(cd *connection_data) (err error) {
 	if err != nil {
 		return err
 	}
-	if !cd.dont_create_shm {
+	if !cd.dont_create_shm && cd.data_file == "" {
 		cd.shm_name = data_shm.Name()
 	}
 	sensitive_data := map[string]string{"REQUEST_ID": cd.request_id, "DATA_PASSWORD": pw, "PASSWORD_FILENAME": cd.shm_name}
@@ -462,6 +570,7 @@ func bootstrap_script(cd *connection_data) (err error) {
 		"EXPORT_HOME_CMD": export_home_cmd,
 		"EXEC_CMD":        exec_cmd,
 		"TEST_SCRIPT":     cd.test_script,
+		"DATA_FILE":       cd.data_file,
 	}
 	add_bool := func(ok bool, key string) {
 		if ok {
@@ -498,16 +607,24 @@ func wrap_bootstrap_script(cd *connection_data) {
 		encoded_script = base64.StdEncoding.EncodeToString(utils.UnsafeStringToBytes(cd.bootstrap_script))
 		unwrap_script = `"import base64, sys; eval(compile(base64.standard_b64decode(sys.argv[-1]), 'bootstrap.py', 'exec'))"`
 	} else {
-		// We can't rely on base64 being available on the remote system, so instead
-		// we quote the bootstrap script by replacing ' and \ with \v and \f
-		// also replacing \n and ! with \r and \b for tcsh
-		// finally surrounding with '
-		encoded_script = "'" + strings.NewReplacer("'", "\v", "\\", "\f", "\n", "\r", "!", "\b").Replace(cd.bootstrap_script) + "'"
-		unwrap_script = `'eval "$(echo "$0" | tr \\\v\\\f\\\r\\\b \\\047\\\134\\\n\\\041)"' `
+		unwrap_script, encoded_script = quote_sh_script(cd.bootstrap_script)
 	}
 	cd.rcmd = []string{"exec", cd.host_opts.Interpreter, "-c", unwrap_script, encoded_script}
 }
 
+// Quote a POSIX sh script so that it can be passed safely through the login
+// shell of the remote user, returning the script to unquote and run it and the
+// quoted script
+func quote_sh_script(script string) (unwrap_script, encoded_script string) {
+	// We can't rely on base64 being available on the remote system, so instead
+	// we quote the script by replacing ' and \ with \v and \f
+	// also replacing \n and ! with \r and \b for tcsh
+	// finally surrounding with '
+	encoded_script = "'" + strings.NewReplacer("'", "\v", "\\", "\f", "\n", "\r", "!", "\b").Replace(script) + "'"
+	unwrap_script = `'eval "$(echo "$0" | tr \\\v\\\f\\\r\\\b \\\047\\\134\\\n\\\041)"' `
+	return
+}
+
 func get_remote_command(cd *connection_data) error {
 	interpreter := cd.host_opts.Interpreter
 	q := strings.ToLower(path.Base(interpreter))
@@ -594,7 +711,64 @@ func change_colors(color_scheme string) (ans string, err error) {
 	return
 }
 
-func run_ssh(ssh_args, server_args, found_extra_args []string) (rc int, err error) {
+type set_tab_color_payload struct {
+	Colors map[string]any `json:"colors"`
+	Self   bool           `json:"self"`
+}
+
+var valid_tab_color_names = []string{"active_fg", "active_bg", "inactive_fg", "inactive_bg"}
+
+// Parse the tab_color setting which is either a single color used as the
+// background of the tab or key=color pairs as for kitten @ set-tab-color
+func parse_tab_color(spec string) (ans map[string]any, err error) {
+	ans = make(map[string]any)
+	for _, x := range strings.Fields(spec) {
+		key, val, found := strings.Cut(strings.ToLower(x), "=")
+		if !found {
+			key, val = "", key
+		} else if !slices.Contains(valid_tab_color_names, key) {
+			return nil, fmt.Errorf("%s is not a valid tab color name", key)
+		}
+		c, err := style.ParseColorOrNone(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid tab_color setting: %#v with error: %w", spec, err)
+		}
+		var v any
+		if c.IsSet {
+			v = c.Color.AsRGB()
+		}
+		if key == "" {
+			ans["active_bg"], ans["inactive_bg"] = v, v
+		} else {
+			ans[key] = v
+		}
+	}
+	return
+}
+
+// Returns the escape codes to change the color of the tab the kitten is
+// running in and to revert it to the default colors
+func change_tab_color(spec string) (set_color, reset_color string, err error) {
+	colors, err := parse_tab_color(spec)
+	if err != nil || len(colors) == 0 {
+		return
+	}
+	if set_color, err = tui.RemoteControlEscapeCode("set-tab-color", set_tab_color_payload{Colors: colors, Self: true}); err != nil {
+		return
+	}
+	for k := range colors {
+		colors[k] = nil
+	}
+	reset_color, err = tui.RemoteControlEscapeCode("set-tab-color", set_tab_color_payload{Colors: colors, Self: true})
+	return
+}
+
+// The flags for the kitten that must precede the arguments for ssh
+type kitten_flags struct {
+	refresh_remote_cache, mosh, choose_identity bool
+}
+
+func run_ssh(ssh_args, server_args, found_extra_args []string, flags kitten_flags) (rc int, err error) {
 	go shell_integration.Data()
 	go RelevantKittyOpts()
 	defer func() {
@@ -606,7 +780,17 @@ func run_ssh(ssh_args, server_args, found_extra_args []string) (rc int, err erro
 	cmd := append([]string{SSHExe()}, ssh_args...)
 	cd := connection_data{remote_args: server_args[1:]}
 	hostname := server_args[0]
-	if len(cd.remote_args) == 0 {
+	if flags.mosh {
+		if len(cd.remote_args) > 0 {
+			return 1, fmt.Errorf("Cannot run commands on the remote host with --mosh")
+		}
+		if _, err = exec.LookPath("mosh-client"); err != nil {
+			return 1, fmt.Errorf("The mosh-client program was not found, it is needed for --mosh")
+		}
+		cd.remote_args = mosh_server_cmd(os.Environ())
+		cd.mosh_output = &mosh_output_filter{w: os.Stdout}
+	}
+	if len(server_args) == 1 {
 		cmd = append(cmd, "-t")
 	}
 	insertion_point := len(cmd)
@@ -616,6 +800,10 @@ func run_ssh(ssh_args, server_args, found_extra_args []string) (rc int, err erro
 	if err != nil {
 		return 1, err
 	}
+	ask_env, err := ask_env_args(found_extra_args)
+	if err != nil {
+		return 1, err
+	}
 	host_opts, bad_lines, err := load_config(hostname_for_match, uname, overrides)
 	if err != nil {
 		return 1, err
@@ -625,6 +813,37 @@ func run_ssh(ssh_args, server_args, found_extra_args []string) (rc int, err erro
 			fmt.Fprintf(os.Stderr, "Ignoring bad config line: %s:%d with error: %s", filepath.Base(x.Src_file), x.Line_number, x.Err)
 		}
 	}
+	jump_hosts, err := jump_hosts_for_connection(hostname, found_extra_args, host_opts)
+	if err != nil {
+		return 1, err
+	}
+	if len(jump_hosts) > 0 {
+		if slices.Contains(ssh_args, "-J") {
+			return 1, fmt.Errorf("Cannot use the -J option of ssh together with --via or the via setting in ssh.conf")
+		}
+		jump_args := []string{"-J", strings.Join(jump_hosts, ",")}
+		cmd = slices.Insert(cmd, insertion_point, jump_args...)
+		insertion_point += len(jump_args)
+		ssh_args = append(ssh_args, jump_args...)
+	}
+	proxy_args, err := connection_proxy_args(host_opts, jump_hosts)
+	if err != nil {
+		return 1, err
+	}
+	if len(proxy_args) > 0 {
+		cmd = slices.Insert(cmd, insertion_point, proxy_args...)
+		insertion_point += len(proxy_args)
+		ssh_args = append(ssh_args, proxy_args...)
+	}
+	if flags.choose_identity {
+		identity_args, err := choose_identity(ssh_args, hostname)
+		if err != nil {
+			return 1, err
+		}
+		cmd = slices.Insert(cmd, insertion_point, identity_args...)
+		insertion_point += len(identity_args)
+		ssh_args = append(ssh_args, identity_args...)
+	}
 	if host_opts.Delegate != "" {
 		delegate_cmd, err := shlex.Split(host_opts.Delegate)
 		if err != nil {
@@ -632,23 +851,31 @@ func run_ssh(ssh_args, server_args, found_extra_args []string) (rc int, err erro
 		}
 		return 1, unix.Exec(utils.FindExe(delegate_cmd[0]), utils.Concat(delegate_cmd, ssh_args, server_args), os.Environ())
 	}
+	asked_env := make(map[string]string, len(ask_env))
+	if err = ask_for_env(hostname, ask_env, asked_env); err != nil {
+		return 1, err
+	}
 	master_is_alive, master_checked := false, false
 	var control_master_args []string
+	slot := 0
 	if host_opts.Share_connections {
 		kpid, err := strconv.Atoi(os.Getenv("KITTY_PID"))
 		if err != nil {
 			return 1, fmt.Errorf("Invalid KITTY_PID env var not an integer: %#v", os.Getenv("KITTY_PID"))
 		}
-		control_master_args, err = connection_sharing_args(kpid)
+		if host_opts.Max_sessions_per_connection > 0 {
+			slot = connection_slot(kpid, hostname, int(host_opts.Max_sessions_per_connection))
+		}
+		control_master_args, err = connection_sharing_args(kpid, host_opts, slot)
 		if err != nil {
 			return 1, err
 		}
 		cmd = slices.Insert(cmd, insertion_point, control_master_args...)
 	}
 	use_kitty_askpass := host_opts.Askpass == Askpass_native || (host_opts.Askpass == Askpass_unless_set && os.Getenv("SSH_ASKPASS") == "")
-	need_to_request_data := true
+	askpass_requests_data := true
 	if use_kitty_askpass {
-		need_to_request_data = set_askpass()
+		askpass_requests_data = set_askpass()
 	}
 	master_is_functional := func() bool {
 		if master_checked {
@@ -659,78 +886,92 @@ func run_ssh(ssh_args, server_args, found_extra_args []string) (rc int, err erro
 		master_is_alive = exec.Command(check_cmd[0], check_cmd[1:]...).Run() == nil
 		return master_is_alive
 	}
-
-	if need_to_request_data && host_opts.Share_connections && master_is_functional() {
-		need_to_request_data = false
-	}
-	run_control_master := func() error {
-		cmcmd := slices.Clone(cmd[:insertion_point])
-		cmcmd = append(cmcmd, control_master_args...)
-		cmcmd = append(cmcmd, "-N", "-f")
-		cmcmd = append(cmcmd, "--", hostname)
-		c := exec.Command(cmcmd[0], cmcmd[1:]...)
-		c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
-		err := c.Run()
+	if host_opts.Host_key_verification == Host_key_verification_kitten && !(host_opts.Share_connections && master_is_functional()) {
+		extra_args, cleanup, err := verify_host_keys(ssh_args, hostname)
+		defer cleanup()
 		if err != nil {
-			err = fmt.Errorf("Failed to start SSH ControlMaster with cmdline: %s and error: %w", strings.Join(cmcmd, " "), err)
+			return 1, err
 		}
-		master_checked = false
-		master_is_alive = false
-		return err
+		cmd = slices.Insert(cmd, insertion_point, extra_args...)
 	}
-	if host_opts.Forward_remote_control && os.Getenv("KITTY_LISTEN_ON") != "" {
-		if !host_opts.Share_connections {
-			return 1, fmt.Errorf("Cannot use forward_remote_control=yes without share_connections=yes as it relies on SSH Controlmasters")
+	var proxy *rc_proxy
+	defer func() {
+		if proxy != nil {
+			proxy.Close()
 		}
-		if !master_is_functional() {
-			if err = run_control_master(); err != nil {
-				return 1, err
-			}
-			if !master_is_functional() {
-				return 1, fmt.Errorf("SSH ControlMaster not functional after being started explicitly")
+	}()
+	// run for every connection, including reconnections, as the ControlMaster
+	// may have died along with the connection
+	setup_connection := func() (need_to_request_data bool, err error) {
+		master_checked = false
+		need_to_request_data = askpass_requests_data
+		if need_to_request_data && host_opts.Share_connections && master_is_functional() {
+			need_to_request_data = false
+		}
+		if !host_opts.Forward_remote_control || os.Getenv("KITTY_LISTEN_ON") == "" {
+			return
+		}
+		if proxy == nil {
+			if proxy, err = start_rc_proxy(os.Getenv("KITTY_LISTEN_ON"), host_opts.Forward_remote_control_actions); err != nil {
+				return false, fmt.Errorf("Failed to forward the kitty remote control socket with error: %w", err)
 			}
 		}
-		protocol, listen_on, found := strings.Cut(os.Getenv("KITTY_LISTEN_ON"), ":")
-		if !found {
-			return 1, fmt.Errorf("Invalid KITTY_LISTEN_ON: %#v", os.Getenv("KITTY_LISTEN_ON"))
-		}
-		if protocol == "unix" && strings.HasPrefix(listen_on, "@") {
-			return 1, fmt.Errorf("Cannot forward kitty remote control socket when an abstract UNIX socket (%s) is used, due to limitations in OpenSSH. Use either a path based one or a TCP socket", listen_on)
-		}
-		cmcmd := slices.Clone(cmd[:insertion_point])
-		cmcmd = append(cmcmd, control_master_args...)
-		cmcmd = append(cmcmd, "-R", "0:"+listen_on, "-O", "forward")
-		cmcmd = append(cmcmd, "--", hostname)
-		c := exec.Command(cmcmd[0], cmcmd[1:]...)
-		b := bytes.Buffer{}
-		c.Stdout = &b
-		c.Stderr = os.Stderr
-		if err := c.Run(); err != nil {
-			return 1, fmt.Errorf("%s\nSetup of port forward in SSH ControlMaster failed with error: %w", b.String(), err)
-		}
-		port, err := strconv.Atoi(strings.TrimSpace(b.String()))
+		// The socket on the remote host is accessible only to the remote user.
+		// A new one is used for every connection as SSH does not remove them.
+		token, err := secrets.TokenHex(8)
 		if err != nil {
-			os.Stderr.Write(b.Bytes())
-			return 1, fmt.Errorf("Setup of port forward in SSH ControlMaster failed with error: invalid resolved port returned: %s", b.String())
+			return false, err
+		}
+		remote_socket := "/tmp/kssh-rc-" + token + ".sock"
+		cd.listen_on = "unix:" + remote_socket
+		cd.forward_spec = remote_socket + ":" + proxy.path
+		return
+	}
+	need_to_request_data, err := setup_connection()
+	if err != nil {
+		return 1, err
+	}
+	if host_opts.Upload_kitten && host_opts.Remote_kitty != Remote_kitty_no {
+		if flags.refresh_remote_cache {
+			_ = os.Remove(remote_platform_record_path(uname, hostname_for_match, host_opts.Remote_dir))
+		}
+		platform, err := recorded_remote_platform(uname, hostname_for_match, host_opts.Remote_dir)
+		if err == nil {
+			var kitten_path string
+			if kitten_path, err = kitten_for_platform(platform, host_opts.Kitten_binaries); err == nil {
+				cd.kitten_binary, cd.kitten_digest, err = read_kitten_binary(kitten_path)
+			}
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			// the kitten is uploaded once the bootstrap script reports the platform
+			cd.platform_unknown = true
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Not uploading kitten to the remote host: %s\n", err)
 		}
-		cd.listen_on = "tcp:localhost:" + strconv.Itoa(port)
 	}
 	term, err := tty.OpenControllingTerm(tty.SetNoEcho)
 	if err != nil {
 		return 1, fmt.Errorf("Failed to open controlling terminal with error: %w", err)
 	}
 	cd.echo_on = term.WasEchoOnOriginally()
-	cd.host_opts, cd.literal_env = host_opts, literal_env
+	cd.host_opts, cd.literal_env, cd.asked_env = host_opts, literal_env, asked_env
 	cd.request_data = need_to_request_data
 	cd.hostname_for_match, cd.username = hostname_for_match, uname
+	if !flags.refresh_remote_cache {
+		cd.cached_version_on_remote = cached_version_on_remote(uname, hostname_for_match, host_opts.Remote_dir)
+	}
 	escape_codes_to_set_colors, err := change_colors(cd.host_opts.Color_scheme)
+	if err != nil {
+		return 1, err
+	}
+	escape_code_to_set_tab_color, escape_code_to_reset_tab_color, err := change_tab_color(cd.host_opts.Tab_color)
 	if err == nil {
-		err = term.WriteAllString(escape_codes_to_set_colors + loop.SAVE_PRIVATE_MODE_VALUES + loop.HANDLE_TERMIOS_SIGNALS.EscapeCodeToSet())
+		err = term.WriteAllString(escape_codes_to_set_colors + escape_code_to_set_tab_color + loop.SAVE_PRIVATE_MODE_VALUES + loop.HANDLE_TERMIOS_SIGNALS.EscapeCodeToSet())
 	}
 	if err != nil {
 		return 1, err
 	}
-	restore_escape_codes := loop.RESTORE_PRIVATE_MODE_VALUES + loop.HANDLE_TERMIOS_SIGNALS.EscapeCodeToReset()
+	restore_escape_codes := loop.RESTORE_PRIVATE_MODE_VALUES + loop.HANDLE_TERMIOS_SIGNALS.EscapeCodeToReset() + escape_code_to_reset_tab_color
 	if escape_codes_to_set_colors != "" {
 		restore_escape_codes += "\x1b[#Q"
 	}
@@ -746,19 +987,107 @@ func run_ssh(ssh_args, server_args, found_extra_args []string) (rc int, err erro
 		}
 	}
 	defer cleanup()
-	err = get_remote_command(&cd)
+	go func() {
+		for range sigs {
+			// ignore any interrupt and terminate signals as they will usually be sent to the ssh child process as well
+			// and we are waiting on that.
+		}
+	}()
+	sess := session{Pid: os.Getpid(), Hostname: hostname, Slot: slot}
+	sess.Kitty_pid, _ = strconv.Atoi(os.Getenv("KITTY_PID"))
+	if host_opts.Share_connections {
+		sess.Control_cmd = slices.Clone(cmd)
+	}
+	interrupted := false
+	for attempt := 0; ; attempt++ {
+		session_cmd, cancel_cmd := rc_forward_cmds(cmd, insertion_point, cd.forward_spec, host_opts.Share_connections)
+		rc, interrupted, err = run_session(&cd, session_cmd, term, &sess)
+		if cancel_cmd != nil {
+			_ = exec.Command(cancel_cmd[0], cancel_cmd[1:]...).Run()
+		}
+		if err == nil && !interrupted && rc == bootstrap_tty_unavailable_exit_code && cd.can_fallback_to_sftp() {
+			cd.tty_unavailable = true
+			attempt--
+		} else {
+			// ssh exits with 255 when the connection fails or is lost, mosh
+			// handles reconnection itself
+			if err != nil || interrupted || rc != 255 || host_opts.Reconnect == Reconnect_no || flags.mosh {
+				break
+			}
+			if !should_reconnect(term, hostname, host_opts, attempt) {
+				break
+			}
+			// the remote working directory is restored from the one reported to kitty by shell integration
+			cd.restore_cwd = true
+		}
+		// undo the raw mode set by drain_potential_tty_garbage()
+		_ = term.PopStateWhen(tty.TCSANOW)
+		if cd.request_data, err = setup_connection(); err != nil {
+			break
+		}
+		// kitty records the cache once the bootstrap script has installed the files
+		cd.cached_version_on_remote = cached_version_on_remote(uname, hostname_for_match, host_opts.Remote_dir)
+		if data_shm != nil {
+			data_shm.Close()
+			_ = data_shm.Unlink()
+			data_shm = nil
+		}
+	}
+	if interrupted {
+		cleanup()
+		_ = unix.Kill(os.Getpid(), unix.SIGINT)
+		// Give the signal time to be delivered
+		time.Sleep(20 * time.Millisecond)
+	}
 	if err != nil {
 		return 1, err
 	}
-	cmd = append(cmd, cd.rcmd...)
+	if flags.mosh && rc == 0 {
+		return run_mosh_client(term, ssh_args, hostname, cd.mosh_output)
+	}
+	return rc, nil
+}
+
+// Run a single ssh session, returning the exit code of ssh
+func run_session(cd *connection_data, cmd []string, term *tty.Term, sess *session) (rc int, interrupted bool, err error) {
+	if err = get_remote_command(cd); err != nil {
+		return 1, false, err
+	}
+	sess.Forwarded = nil
+	if cd.listen_on != "" {
+		sess.Forwarded = append(sess.Forwarded, cd.listen_on+" -> "+os.Getenv("KITTY_LISTEN_ON"))
+	}
+	if cd.data_file != "" {
+		if err = upload_via_sftp(cmd, cd.data_file_contents, cd.data_file); err != nil {
+			return 1, false, err
+		}
+	}
+	cmd = append(slices.Clone(cmd), cd.rcmd...)
 	c := exec.Command(cmd[0], cmd[1:]...)
 	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if cd.mosh_output != nil {
+		c.Stdout = cd.mosh_output
+	}
+	var output *session_output
+	if len(sess.Control_cmd) > 0 && cd.host_opts.Warn_when_unresponsive && cd.host_opts.Keepalive_interval > 0 {
+		output = &session_output{dest: c.Stdout}
+		c.Stdout = output
+	}
 	err = c.Start()
 	if err != nil {
-		return 1, err
+		return 1, false, err
+	}
+	sess.Started = time.Now()
+	// failure to record the session must not prevent it from working
+	if unregister, err := register_session(sess); err == nil {
+		defer unregister()
+	}
+	if output != nil {
+		stop := start_health_monitor(sess.Hostname, sess.Control_cmd, time.Duration(cd.host_opts.Keepalive_interval)*time.Second, output)
+		defer stop()
 	}
 
-	if !cd.request_data {
+	if !cd.request_data && cd.data_file == "" {
 		rq := fmt.Sprintf("id=%s:pwfile=%s:pw=%s", cd.replacements["REQUEST_ID"], cd.replacements["PASSWORD_FILENAME"], cd.replacements["DATA_PASSWORD"])
 		err := term.ApplyOperations(tty.TCSANOW, tty.SetNoEcho)
 		if err == nil {
@@ -771,30 +1100,47 @@ func run_ssh(ssh_args, server_args, found_extra_args []string) (rc int, err erro
 		if err != nil {
 			_ = c.Process.Kill()
 			_ = c.Wait()
-			return 1, err
+			return 1, false, err
 		}
 	}
-	go func() {
-		<-sigs
-		// ignore any interrupt and terminate signals as they will usually be sent to the ssh child process as well
-		// and we are waiting on that.
-	}()
 	err = c.Wait()
 	drain_potential_tty_garbage(term)
 	if err != nil {
 		var exit_err *exec.ExitError
 		if errors.As(err, &exit_err) {
-			if state := exit_err.ProcessState.String(); state == "signal: interrupt" {
-				cleanup()
-				_ = unix.Kill(os.Getpid(), unix.SIGINT)
-				// Give the signal time to be delivered
-				time.Sleep(20 * time.Millisecond)
-			}
-			return exit_err.ExitCode(), nil
+			return exit_err.ExitCode(), exit_err.ProcessState.String() == "signal: interrupt", nil
 		}
-		return 1, err
+		return 1, false, err
+	}
+	return 0, false, nil
+}
+
+// Ask whether to reconnect or wait before reconnecting automatically,
+// returning false if no reconnection should be attempted
+func should_reconnect(term *tty.Term, hostname string, host_opts *Config, attempt int) bool {
+	// the terminal is in raw mode after drain_potential_tty_garbage()
+	if host_opts.Reconnect == Reconnect_ask {
+		if term.WriteAllString(fmt.Sprintf("\r\nThe connection to %s was lost. Reconnect? [y/n] ", hostname)) != nil {
+			return false
+		}
+		buf := []byte{0}
+		if n, err := term.Read(buf); err != nil || n == 0 {
+			return false
+		}
+		_ = term.WriteAllString("\r\n")
+		return buf[0] == 'y' || buf[0] == 'Y' || buf[0] == '\r'
+	}
+	if attempt >= int(host_opts.Reconnect_attempts) {
+		return false
 	}
-	return 0, nil
+	delay := time.Second << utils.Min(attempt, 5)
+	if term.WriteAllString(fmt.Sprintf("\r\nThe connection to %s was lost. Reconnecting in %s, press any key to abort...", hostname, delay)) != nil {
+		return false
+	}
+	buf := []byte{0}
+	n, _ := term.ReadWithTimeout(buf, delay)
+	_ = term.WriteAllString("\r\n")
+	return n == 0
 }
 
 func main(cmd *cli.Command, o *Options, args []string) (rc int, err error) {
@@ -802,12 +1148,36 @@ func main(cmd *cli.Command, o *Options, args []string) (rc int, err error) {
 		switch args[0] {
 		case "use-python":
 			args = args[1:] // backwards compat from when we had a python implementation
+		case "exec":
+			return run_exec(args[1:])
 		case "-h", "--help":
 			cmd.ShowHelp()
 			return
 		}
 	}
-	ssh_args, server_args, passthrough, found_extra_args, err := ParseSSHArgs(args, "--kitten")
+	var flags kitten_flags
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		if args[0] == "--refresh-remote-cache" {
+			flags.refresh_remote_cache = true
+			if len(args) == 1 {
+				return 0, forget_remote_caches()
+			}
+		} else if args[0] == "--mosh" {
+			flags.mosh = true
+		} else if args[0] == "--choose-identity" {
+			flags.choose_identity = true
+		} else {
+			break
+		}
+		args = args[1:]
+	}
+	if handled, err := handle_connection_management(args); handled {
+		if err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
+	ssh_args, server_args, passthrough, found_extra_args, err := ParseSSHArgs(args, "--kitten", "--via", "--ask-env")
 	if err != nil {
 		var invargs *ErrInvalidSSHArgs
 		switch {
@@ -820,6 +1190,9 @@ func main(cmd *cli.Command, o *Options, args []string) (rc int, err error) {
 		return 1, err
 	}
 	if passthrough {
+		if hops := via_args(found_extra_args); len(hops) > 0 {
+			ssh_args = append(ssh_args, "-J", strings.Join(hops, ","))
+		}
 		return 1, unix.Exec(SSHExe(), utils.Concat([]string{"ssh"}, ssh_args, server_args), os.Environ())
 	}
 	if os.Getenv("KITTY_WINDOW_ID") == "" || os.Getenv("KITTY_PID") == "" {
@@ -828,7 +1201,7 @@ func main(cmd *cli.Command, o *Options, args []string) (rc int, err error) {
 	if !tty.IsTerminal(os.Stdin.Fd()) {
 		return 1, fmt.Errorf("The SSH kitten is meant for interactive use only, STDIN must be a terminal")
 	}
-	return run_ssh(ssh_args, server_args, found_extra_args)
+	return run_ssh(ssh_args, server_args, found_extra_args, flags)
 }
 
 func EntryPoint(parent *cli.Command) {
@@ -838,7 +1211,7 @@ func EntryPoint(parent *cli.Command) {
 func specialize_command(ssh *cli.Command) {
 	ssh.Usage = "arguments for the ssh command"
 	ssh.ShortDescription = "Truly convenient SSH"
-	ssh.HelpText = "The ssh kitten is a thin wrapper around the ssh command. It automatically enables shell integration on the remote host, re-uses existing connections to reduce latency, makes the kitty terminfo database available, etc. It's invocation is identical to the ssh command. For details on its usage, see :doc:`/kittens/ssh`."
+	ssh.HelpText = "The ssh kitten is a thin wrapper around the ssh command. It automatically enables shell integration on the remote host, re-uses existing connections to reduce latency, makes the kitty terminfo database available, etc. It's invocation is identical to the ssh command. Use :code:`--via` to connect via jump hosts, it can be specified multiple times. Use :code:`--ask-env VAR1,VAR2` to be asked for the values of environment variables to set on the remote host before connecting. Use :code:`--list-connections` to list its active connections and :code:`--close-connection` or :code:`--refresh-connection` to manage them. Use :code:`kitten ssh exec [--json] destination command` to run a command on the remote host non-interactively. Use :code:`--refresh-remote-cache` before the arguments for ssh to send the files cached on the remote host again, without a destination the caches for all hosts are refreshed. Use :code:`--mosh` before the arguments for ssh to use mosh for the session, after setting up the remote host. Use :code:`--choose-identity` before the arguments for ssh to choose the key from the SSH agent to use for the connection. For details on its usage, see :doc:`/kittens/ssh`."
 	ssh.IgnoreAllArgs = true
 	ssh.OnlyArgsAllowed = true
 	ssh.ArgCompleter = cli.CompletionForWrapper("ssh")
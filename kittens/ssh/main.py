@@ -29,7 +29,15 @@ def option_text() -> str:
 relative to HOME on the remote host. When this option is not specified, the
 local file path is used as the remote destination (with the HOME directory
 getting automatically replaced by the remote HOME). Note that environment
-variables and ~ are not expanded.
+variables and ~ are not expanded, but :ref:`placeholders <ssh_copy_templates>` are.
+
+
+--template
+type=bool-set
+Render the copied files as templates, replacing the :ref:`placeholders
+<ssh_copy_templates>` in their contents when connecting. Useful for files that
+need some host specific values, such as the email address in a
+:file:`.gitconfig`.
 
 
 --exclude
@@ -115,6 +123,21 @@ def option_text() -> str:
 Files whose remote name matches the exclude pattern will not be copied.
 For more details, see :ref:`ssh_copy_command`.
 ''')
+
+opt('terminfo', '', long_text='''
+Additional terminfo entries to make available on the remote host, along with
+the kitty terminfo entry. Useful if you run programs such as :program:`tmux` or
+:program:`screen` on the remote host, whose terminfo entries may be missing
+there. A space separated list of entries, each of which is either the name of
+an entry in the local terminfo database or the path to a file containing
+terminfo source, such as a custom :envvar:`TERM` definition. Relative paths are
+resolved with respect to the kitty config directory. For example::
+
+    terminfo tmux-256color screen-256color my-term.terminfo
+
+The entries are compiled on the remote host, if it has :program:`tic`,
+otherwise entries compiled on the local computer are used.
+''')
 egr()  # }}}
 
 agr('shell', 'Login shell environment')  # {{{
@@ -161,6 +184,20 @@ def option_text() -> str:
 in the .conf files/themes are ignored.
 ''')
 
+opt('tab_color', '', long_text='''
+Change the color of the tab in the kitty tab bar when connected to the remote
+host, reverting it to the default colors when the connection ends. Useful to
+make connections to important hosts, such as production servers, unmistakable.
+Either a single color, which is used as the background of the tab, or
+space separated :code:`key=color` pairs as accepted by
+:ref:`kitten @ set-tab-color <at-set-tab-color>`, for example::
+
+    tab_color active_bg=red inactive_bg=#550000
+
+Note that this works only if :opt:`allow_remote_control` is enabled for the
+window in which the ssh kitten is running.
+''')
+
 opt('remote_kitty', 'if-needed', choices=('if-needed', 'no', 'yes'), long_text='''
 Make :program:`kitten` available on the remote host. Useful to run kittens such
 as the :doc:`icat kitten </kittens/icat>` to display images or the
@@ -176,10 +213,67 @@ def option_text() -> str:
 installed kitten can be updated by running: :code:`kitten update-self` on the
 remote host.
 ''')
+
+opt('upload_kitten', 'no', option_type='to_bool', long_text='''
+Upload a :program:`kitten` binary to the remote host instead of the bootstrap
+script that downloads it, for hosts that have no internet access or on which
+nothing can be installed system-wide. The binary is chosen to match the
+operating system and CPU architecture of the remote host, which are reported
+by the bootstrap script when first connecting, so the binary is uploaded from
+the second connection to a host onwards. If they match the local computer,
+the local :program:`kitten` is used, otherwise it is looked for in
+:opt:`kitten_binaries`. The binary is cached on the remote host, so it is
+uploaded only once, but note that the first upload can take a while on slow
+connections. Has no effect when :opt:`remote_kitty` is :code:`no`.
+''')
+
+opt('kitten_binaries', '', long_text='''
+A directory containing :program:`kitten` binaries for other operating systems
+and CPU architectures, used by :opt:`upload_kitten`. The binaries must be named
+as the :link:`pre-compiled kitten binaries
+<https://github.com/kovidgoyal/kitty/releases>`, for example,
+:file:`kitten-linux-arm64`. Relative paths are resolved relative to the home
+directory.
+''')
 egr()  # }}}
 
 agr('ssh', 'SSH configuration')  # {{{
 
+opt('connection_proxy', '', long_text='''
+Connect to the host via the identity-aware proxy of a cloud provider, using the
+command line tool of the provider as the SSH ProxyCommand. The value is the
+type of proxy followed by optional :code:`key=value` settings. The supported
+types and their settings are:
+
+:code:`gcloud-iap [project=P] [zone=Z]`
+    Google Cloud Identity-Aware Proxy TCP forwarding, using :program:`gcloud`.
+    The hostname is the name of the VM instance.
+
+:code:`aws-ssm [profile=P] [region=R]`
+    AWS Systems Manager Session Manager, using :program:`aws`. The hostname is
+    the id of the instance.
+
+:code:`teleport [proxy=P] [cluster=C]`
+    Teleport, using :program:`tsh`.
+
+For example::
+
+    hostname my-instance
+    connection_proxy gcloud-iap project=my-project zone=us-central1-a
+
+Before connecting, the tool is checked to be logged in, and if not, its login
+command is run. The remote host is set up as usual, after connecting.
+Cannot be used together with :opt:`kitten-ssh.via`.
+''')
+
+opt('connection_proxy_auth_cache', '3600', option_type='positive_int', long_text='''
+The number of seconds for which a successful check that the tool used for
+:opt:`kitten-ssh.connection_proxy` is logged in is remembered, so that it is
+not repeated for every connection. The check is never remembered beyond the
+expiry of the credentials of the tool, when the tool reports it. A value of
+zero means the check is done for every connection.
+''')
+
 opt('share_connections', 'yes', option_type='to_bool', long_text='''
 Within a single kitty instance, all connections to a particular server can be
 shared. This reduces startup latency for subsequent connections and means that
@@ -189,9 +283,54 @@ def option_text() -> str:
 active shared connections.
 ''')
 
+opt('connection_idle_timeout', '0', option_type='positive_int', long_text='''
+The number of seconds a shared connection is kept open after its last session
+ends. The default of zero means shared connections are kept open until kitty
+quits. Only used with :opt:`kitten-ssh.share_connections`.
+''')
+
+opt('max_sessions_per_connection', '0', option_type='positive_int', long_text='''
+The maximum number of sessions of the ssh kitten that share a single
+connection. When all connections to a host have this many sessions, a new
+connection is opened for the next session. Useful for servers that limit the
+number of sessions per connection with :code:`MaxSessions` in
+:file:`sshd_config`. The default of zero means there is no limit. Only used with
+:opt:`kitten-ssh.share_connections`.
+''')
+
+opt('keepalive_interval', '60', option_type='positive_int', long_text='''
+The interval in seconds at which keepalive messages are sent to the server over
+shared connections. The connection is closed if the server does not respond to
+five consecutive messages. A value of zero disables keepalive messages. Only
+used with :opt:`kitten-ssh.share_connections`.
+''')
+
+opt('warn_when_unresponsive', 'no', option_type='to_bool', long_text='''
+Check the shared connection at the interval set by
+:opt:`kitten-ssh.keepalive_interval` while a session is running and show a
+warning in the window title when it has stopped working, until it works again.
+Note that this works only if :opt:`allow_remote_control` is enabled for the
+window in which the ssh kitten is running. Only used with
+:opt:`kitten-ssh.share_connections`.
+''')
+
+opt('host_key_verification', 'ssh', choices=('ssh', 'kitten'), long_text='''
+How to verify the host keys of remote hosts. The default of :code:`ssh` leaves
+it to SSH, which asks for confirmation of new host keys and refuses to connect
+to hosts whose keys have changed. With :code:`kitten`, the host keys are fetched
+with :program:`ssh-keyscan` before connecting and new or changed keys are shown
+in detail, with their fingerprints, randomart and, for changed keys, the
+previously known keys. The keys can then be accepted and written to the known
+hosts file, accepted for this connection only or rejected. Note that this adds
+the latency of an extra connection, except when an existing shared connection is
+used. It does not work for hosts connected to via a proxy or jump host, or
+when :code:`StrictHostKeyChecking` is :code:`yes` in the SSH configuration,
+in which cases the keys are verified by SSH.
+''')
+
 opt('askpass', 'unless-set', choices=('unless-set', 'ssh', 'native'), long_text='''
 Control the program SSH uses to ask for passwords or confirmation of host keys
-etc. The default is to use kitty's native :program:`askpass`, unless the
+etc. The default is to use kitty's native :doc:`askpass </kittens/askpass>`, unless the
 :envvar:`SSH_ASKPASS` environment variable is set. Set this option to
 :code:`ssh` to not interfere with the normal ssh askpass mechanism at all, which
 typically means that ssh will prompt at the terminal. Set it to :code:`native`
@@ -202,6 +341,20 @@ def option_text() -> str:
 latency.
 ''')
 
+opt('bootstrap_via', 'auto', choices=('auto', 'tty', 'sftp'), long_text='''
+How to send the data needed to setup the remote host, such as the shell
+integration files and the files to :opt:`copy <kitten-ssh.copy>`. With
+:code:`tty`, it is sent over the TTY, to the bootstrap script running on the
+remote host. Some hardened hosts do not allow this, for example, by not allowing
+the bootstrap script to read from the TTY. For such hosts, use :code:`sftp` to
+upload the data with the SFTP subsystem of SSH before running the bootstrap
+script. Requires the :program:`sftp` program on the local computer. The default,
+:code:`auto`, uses the TTY and if the bootstrap script reports that it cannot
+read from it, connects again, using :code:`sftp`, if it is available. Note that
+the working directory is not restored when :opt:`reconnecting
+<kitten-ssh.reconnect>` when using :code:`sftp`.
+''')
+
 opt('delegate', '', long_text='''
 Do not use the SSH kitten for this host. Instead run the command specified as the delegate.
 For example using :code:`delegate ssh` will run the ssh command with all arguments passed
@@ -209,13 +362,51 @@ def option_text() -> str:
 of supporting the ssh kitten.
 ''')
 
+opt('via', '', long_text='''
+A space separated list of jump hosts to connect to the remote host via, in
+order, like the :code:`-J` option of :program:`ssh`. Each jump host is itself
+connected to via the jump hosts from the value of this setting for it, so
+chains of jump hosts can be built up per host. The jump hosts can also be
+specified on the command line, with :code:`--via`, which overrides this setting.
+See :ref:`ssh_jump_hosts` for details.
+''')
+
 opt('forward_remote_control', 'no', option_type='to_bool', long_text='''
 Forward the kitty remote control socket to the remote host. This allows using the kitty
 remote control facilities from the remote host. WARNING: This allows any software
-on the remote host full access to the local computer, so only do it for trusted remote hosts.
-Note that this does not work with abstract UNIX sockets such as :file:`@mykitty` because of SSH limitations.
-This option uses SSH socket forwarding to forward the socket pointed to by the :envvar:`KITTY_LISTEN_ON`
-environment variable.
+running as your user on the remote host access to the local computer, so only do it for
+trusted remote hosts, and consider restricting the allowed actions with
+:opt:`kitten-ssh.forward_remote_control_actions`. This option uses SSH socket forwarding to
+forward the socket pointed to by the :envvar:`KITTY_LISTEN_ON` environment variable to a
+UNIX socket on the remote host that only the remote user can access, and sets
+:envvar:`KITTY_LISTEN_ON` on the remote host to point to it.
+''')
+
+opt('forward_remote_control_actions', '*', long_text='''
+The remote control actions allowed from the remote host, when using
+:opt:`kitten-ssh.forward_remote_control`. A space separated list of actions, glob
+patterns can be used, as for :opt:`remote_control_password`. For example::
+
+    forward_remote_control_actions get-* ls set-colors
+
+The default of :code:`*` allows all actions. When the actions are restricted,
+remote control commands that use a password are not allowed, as their actions
+cannot be checked. To get a list of available actions, run: :code:`kitten @ --help`.
+''')
+
+opt('reconnect', 'no', choices=('no', 'ask', 'yes'), long_text='''
+What to do when the connection to the remote host is lost. The default of
+:code:`no` means the kitten exits, as :program:`ssh` does. A value of
+:code:`ask` means you are asked whether to reconnect and :code:`yes` means
+reconnection is automatic. Reconnecting runs the bootstrap again, so the
+environment variables and files are setup as for a new connection, and the
+working directory of the shell on the remote host is restored, if it was
+reported by :ref:`shell_integration`.
+''')
+
+opt('reconnect_attempts', '5', option_type='positive_int', long_text='''
+The number of times to try to reconnect automatically, with increasing delays
+between attempts, when :opt:`kitten-ssh.reconnect` is :code:`yes`.
 ''')
 
 egr()  # }}}
@@ -3,11 +3,18 @@
 package ssh
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"kitty"
+	"kitty/tools/utils"
 	"kitty/tools/utils/shm"
 	"os"
 	"os/exec"
@@ -15,13 +22,30 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/exp/slices"
 	"golang.org/x/sys/unix"
 )
 
 var _ = fmt.Print
 
+func TestMain(m *testing.M) {
+	// utils.RuntimeDir() and utils.CacheDir() are computed only once, so use
+	// single private runtime and cache directories for all tests
+	dir, err := os.MkdirTemp("", "kssh-test-runtime-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("KITTY_RUNTIME_DIRECTORY", dir)
+	os.Setenv("KITTY_CACHE_DIRECTORY", filepath.Join(dir, "cache"))
+	rc := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(rc)
+}
+
 func TestCloneEnv(t *testing.T) {
 	env := map[string]string{"a": "1", "b": "2"}
 	data, err := json.Marshal(env)
@@ -154,3 +178,498 @@ func TestSSHTarfile(t *testing.T) {
 		t.Fatalf("Contents of shell-integration/ssh not excluded")
 	}
 }
+
+func TestSSHExtraTerminfo(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "my-term.terminfo")
+	if err := os.WriteFile(src, []byte("my-term|a custom terminal,\n\tam, cols#80, lines#24,\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	files, err := extra_terminfo_files(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, f := range files {
+		seen[f.arcname] = true
+	}
+	if !seen[extra_terminfo_name] {
+		t.Fatalf("The terminfo source is missing from: %v", seen)
+	}
+	if _, err = exec.LookPath("tic"); err == nil {
+		for _, x := range []string{"m/my-term", "6d/my-term"} {
+			if !seen[x] {
+				t.Fatalf("The compiled terminfo entry %s is missing from: %v", x, seen)
+			}
+		}
+	}
+	if _, err = extra_terminfo_files("does-not-exist.terminfo"); err == nil {
+		t.Fatalf("No error for missing terminfo file")
+	}
+}
+
+func TestSSHJumpHostChain(t *testing.T) {
+	via := map[string]string{"j1": "j0", "j0": "", "j2": "j1", "loop": "target", "a": "b", "b": "a"}
+	via_for_host := func(hostname string) (string, error) { return via[hostname], nil }
+	for _, x := range []struct {
+		hops, expected []string
+		fails          bool
+	}{
+		{hops: []string{"j0"}, expected: []string{"j0"}},
+		{hops: []string{"j2"}, expected: []string{"j0", "j1", "j2"}},
+		{hops: []string{"x", "j1"}, expected: []string{"x", "j0", "j1"}},
+		{hops: []string{"loop"}, fails: true},
+		{hops: []string{"a"}, fails: true},
+		{hops: []string{"j1", "j0"}, fails: true},
+	} {
+		actual, err := jump_host_chain("target", x.hops, via_for_host)
+		if x.fails {
+			if err == nil {
+				t.Fatalf("No error for the jump hosts: %v", x.hops)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(x.expected, actual); diff != "" {
+			t.Fatalf("Incorrect jump host chain for: %v\n%s", x.hops, diff)
+		}
+	}
+	if diff := cmp.Diff([]string{"j1", "j2"}, via_args([]string{"--via", "j1", "--kitten", "a=b", "--via", "j2"})); diff != "" {
+		t.Fatalf("Incorrect --via args\n%s", diff)
+	}
+}
+
+func TestSSHTabColor(t *testing.T) {
+	for spec, expected := range map[string]map[string]any{
+		"":                                   {},
+		"red":                                {"active_bg": uint32(0xff0000), "inactive_bg": uint32(0xff0000)},
+		"active_bg=#00ff00 inactive_fg=none": {"active_bg": uint32(0x00ff00), "inactive_fg": nil},
+	} {
+		actual, err := parse_tab_color(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Fatalf("Incorrect tab colors for: %#v\n%s", spec, diff)
+		}
+	}
+	for _, spec := range []string{"notacolor", "bg=red", "active_bg=xyz"} {
+		if _, err := parse_tab_color(spec); err == nil {
+			t.Fatalf("No error for invalid tab color: %#v", spec)
+		}
+	}
+}
+
+func TestSSHExecScript(t *testing.T) {
+	tdir := t.TempDir()
+	host_opts, _, err := load_config("unmatched", "", []string{"env=EXEC_TEST=a b", "cwd=" + tdir}, filepath.Join(tdir, "ssh.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrap_script, encoded_script := quote_sh_script(exec_script(host_opts, []string{`echo "$EXEC_TEST" $PWD`, "'!'", ";", "exit 3"}))
+	// sshd passes the command to the login shell of the user
+	c := exec.Command("sh", "-c", strings.Join([]string{"exec", "sh", "-c", unwrap_script, encoded_script}, " "))
+	c.Env = append(os.Environ(), "HOME="+tdir)
+	output, err := c.Output()
+	if c.ProcessState.ExitCode() != 3 {
+		t.Fatalf("Incorrect exit status for command: %d with error: %v", c.ProcessState.ExitCode(), err)
+	}
+	if diff := cmp.Diff("a b "+tdir+" !\n", string(output)); diff != "" {
+		t.Fatalf("Incorrect output of command:\n%s", diff)
+	}
+}
+
+func TestSSHRemoteCache(t *testing.T) {
+	cd := basic_connection_data()
+	read_tarfile := func(data []byte) map[string]string {
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ans := map[string]string{}
+		tr := tar.NewReader(gr)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, _ := io.ReadAll(tr)
+			ans[h.Name] = string(d)
+		}
+		return ans
+	}
+	names := func() map[string]string {
+		data, err := make_tarfile(cd, func(key string) (val string, found bool) { return })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return read_tarfile(data)
+	}
+	version_file := path.Join("home", cd.host_opts.Remote_dir, remote_cache_version_file)
+	full := names()
+	if full[version_file] == "" || full[version_file] != cd.remote_cache_version {
+		t.Fatalf("The cache version file is missing or incorrect: %#v", full[version_file])
+	}
+	if strings.Contains(full["data.sh"], "KITTY_SSH_REMOTE_CACHE") || cd.remote_cache_tarfile != nil {
+		t.Fatalf("The remote cache is used when it is not populated")
+	}
+	if !strings.Contains(full["data.sh"], "KITTY_SSH_RECORD_CACHE") {
+		t.Fatalf("The bootstrap script is not asked to report that the cache is populated:\n%s", full["data.sh"])
+	}
+	cd.cached_version_on_remote = cd.remote_cache_version
+	cached := names()
+	for _, x := range []string{version_file, "home/.terminfo/kitty.terminfo", path.Join("home", cd.host_opts.Remote_dir, "shell-integration/bash/kitty.bash")} {
+		if _, found := cached[x]; found {
+			t.Fatalf("The cached file %s was sent", x)
+		}
+	}
+	if !strings.Contains(cached["data.sh"], cd.remote_cache_version) {
+		t.Fatalf("The remote cache version is not sent:\n%s", cached["data.sh"])
+	}
+	// the cached files are available to be sent if they are missing on the remote host
+	fallback := read_tarfile(cd.remote_cache_tarfile)
+	for name, data := range full {
+		if _, found := cached[name]; !found && fallback[name] != data {
+			t.Fatalf("The cached file %s is not available to be sent", name)
+		}
+	}
+	if _, found := fallback["data.sh"]; found {
+		t.Fatalf("The cached files include the data for the connection")
+	}
+
+	if v := cached_version_on_remote("u", "h", "d"); v != "" {
+		t.Fatalf("Unexpected remote cache version: %#v", v)
+	}
+	// the record is written by kitty
+	if err := os.MkdirAll(remote_cache_records_dir(), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(remote_cache_record_path("u", "h", "d"), []byte("1"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if v := cached_version_on_remote("u", "h", "d"); v != "1" {
+		t.Fatalf("Incorrect remote cache version: %#v", v)
+	}
+	if err := forget_remote_caches(); err != nil {
+		t.Fatal(err)
+	}
+	if v := cached_version_on_remote("u", "h", "d"); v != "" {
+		t.Fatalf("Remote cache version not forgotten: %#v", v)
+	}
+}
+
+func TestSSHBootstrapViaSFTP(t *testing.T) {
+	cd := basic_connection_data("bootstrap_via=sftp", "env=SFTP_TEST=ok")
+	cd.test_script = `printf "%s" "$SFTP_TEST"; exit 0`
+	if err := get_remote_command(cd); err != nil {
+		t.Fatal(err)
+	}
+	if cd.data_file == "" || len(cd.data_file_contents) == 0 || cd.request_data {
+		t.Fatalf("The data is not uploaded with sftp")
+	}
+	home := t.TempDir()
+	data_file := filepath.Join(home, cd.data_file)
+	if err := os.WriteFile(data_file, cd.data_file_contents, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := exec.Command("sh", "-c", strings.Join(cd.rcmd, " "))
+	c.Env = append(os.Environ(), "HOME="+home)
+	c.Stderr = os.Stderr
+	output, err := c.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("ok", string(output)); diff != "" {
+		t.Fatalf("The environment from the uploaded data was not set:\n%s", diff)
+	}
+	if _, err = os.Stat(data_file); err == nil {
+		t.Fatalf("The uploaded data was not removed")
+	}
+	if _, err = os.Stat(filepath.Join(home, ".terminfo", "kitty.terminfo")); err != nil {
+		t.Fatalf("The files from the uploaded data were not extracted: %s", err)
+	}
+	if diff := cmp.Diff([]string{"ssh", "-p", "22", "-T", "-o", "ClearAllForwardings=yes", "-s", "--", "host", "sftp"}, sftp_ssh_cmd([]string{"ssh", "-p", "22", "--", "host"})); diff != "" {
+		t.Fatalf("Incorrect ssh command for sftp:\n%s", diff)
+	}
+
+	// the bootstrap script reports when it cannot read the data from the TTY
+	cd = basic_connection_data()
+	if err := get_remote_command(cd); err != nil {
+		t.Fatal(err)
+	}
+	if cd.data_file != "" || cd.bootstrap_via_sftp() {
+		t.Fatalf("The data is uploaded with sftp by default")
+	}
+	c = exec.Command("sh", "-c", strings.Join(cd.rcmd, " "))
+	// without a controlling terminal
+	c.SysProcAttr = &unix.SysProcAttr{Setsid: true}
+	c.Env = append(os.Environ(), "HOME="+home)
+	var exit_err *exec.ExitError
+	if err = c.Run(); !errors.As(err, &exit_err) || exit_err.ExitCode() != bootstrap_tty_unavailable_exit_code {
+		t.Fatalf("The bootstrap script did not report that the TTY is unavailable: %v", err)
+	}
+	cd.tty_unavailable = true
+	if err := get_remote_command(cd); err != nil {
+		t.Fatal(err)
+	}
+	if cd.data_file == "" || cd.request_data || cd.can_fallback_to_sftp() {
+		t.Fatalf("The data is not uploaded with sftp after the TTY was unavailable")
+	}
+}
+
+func TestSSHMosh(t *testing.T) {
+	if diff := cmp.Diff([]string{"'mosh-server'", "'new'", "'-s'", "'-c'", "'256'", "'-l'", "'LANG=en_US.UTF-8'", "'-l'", "'LC_CTYPE=C.UTF-8'"},
+		mosh_server_cmd([]string{"HOME=/x", "LANG=en_US.UTF-8", "LC_CTYPE=C.UTF-8"})); diff != "" {
+		t.Fatalf("Incorrect mosh-server command:\n%s", diff)
+	}
+	var output bytes.Buffer
+	f := mosh_output_filter{w: &output}
+	for _, x := range []string{"Password: ", "ok\r\n\r\nMO", "SH CONNECT 60001 abcd/efg+\r", "\nrest\r\n"} {
+		if _, err := f.Write([]byte(x)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if diff := cmp.Diff("Password: ok\r\n\r\nrest\r\n", output.String()); diff != "" {
+		t.Fatalf("Incorrect output from mosh-server:\n%s", diff)
+	}
+	if f.port != "60001" || f.key != "abcd/efg+" {
+		t.Fatalf("Incorrect port and key: %#v %#v", f.port, f.key)
+	}
+}
+
+func TestSSHAskEnv(t *testing.T) {
+	vars, err := ask_env_args([]string{"--ask-env", "A, B:visible", "--kitten", "x=y", "--ask-env", "A,C"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]ask_env_var{{"A", false}, {"B", true}, {"C", false}}, vars, cmp.AllowUnexported(ask_env_var{})); diff != "" {
+		t.Fatalf("Incorrect --ask-env args:\n%s", diff)
+	}
+	if _, err = ask_env_args([]string{"--ask-env", "A=1"}); err == nil {
+		t.Fatalf("Invalid variable name not rejected")
+	}
+	cd := basic_connection_data("bootstrap_via=sftp", "env=TOKEN=from-conf")
+	cd.asked_env = map[string]string{"TOKEN": "it's asked"}
+	cd.test_script = `printf "%s" "$TOKEN"; exit 0`
+	if err := get_remote_command(cd); err != nil {
+		t.Fatal(err)
+	}
+	home := t.TempDir()
+	if err := os.WriteFile(filepath.Join(home, cd.data_file), cd.data_file_contents, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := exec.Command("sh", "-c", strings.Join(cd.rcmd, " "))
+	c.Env = append(os.Environ(), "HOME="+home)
+	c.Stderr = os.Stderr
+	output, err := c.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("it's asked", string(output)); diff != "" {
+		t.Fatalf("The value entered by the user was not set:\n%s", diff)
+	}
+}
+
+func TestSSHUploadKitten(t *testing.T) {
+	for uname, expected := range map[string]string{"Linux x86_64\n": "linux-amd64", "Darwin arm64": "darwin-arm64", "Linux aarch64": "linux-arm64", "FreeBSD i386": "freebsd-386", "Plan9 x86_64": "", "Linux mips": ""} {
+		actual, err := platform_from_uname(uname)
+		if expected == "" {
+			if err == nil {
+				t.Fatalf("Unsupported platform not rejected: %#v", uname)
+			}
+		} else if err != nil || actual != expected {
+			t.Fatalf("Incorrect platform for %#v: %#v != %#v (%v)", uname, actual, expected, err)
+		}
+	}
+	binaries := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binaries, "kitten-netbsd-arm"), []byte("netbsd"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	kitten_path, err := kitten_for_platform("netbsd-arm", binaries)
+	if err != nil || kitten_path != filepath.Join(binaries, "kitten-netbsd-arm") {
+		t.Fatalf("Incorrect kitten binary: %#v (%v)", kitten_path, err)
+	}
+	data, digest, err := read_kitten_binary(kitten_path)
+	if err != nil || string(data) != "netbsd" || len(digest) != 64 {
+		t.Fatalf("Incorrect kitten binary: %#v %#v (%v)", string(data), digest, err)
+	}
+	// the recorded digest is used while the binary is unchanged
+	if _, d, _ := read_kitten_binary(kitten_path); d != digest {
+		t.Fatalf("Recorded digest of the kitten binary not used: %#v != %#v", d, digest)
+	}
+	if err = os.WriteFile(kitten_path, []byte("changed"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, d, _ := read_kitten_binary(kitten_path); d == digest {
+		t.Fatalf("Digest of the kitten binary not updated when it changed")
+	}
+	if _, err := kitten_for_platform("openbsd-arm", binaries); err == nil {
+		t.Fatalf("Missing kitten binary not reported")
+	}
+	if _, err := kitten_for_platform("openbsd-arm", ""); err == nil {
+		t.Fatalf("Missing kitten binaries directory not reported")
+	}
+
+	cd := basic_connection_data()
+	rd := strings.TrimRight(cd.host_opts.Remote_dir, "/")
+	installed := path.Join("home", rd, "kitty", "install-tool", "kitten")
+	version := remote_cache_version(remote_cache_files(cd, rd, ""))
+	cd.kitten_binary, cd.kitten_digest = []byte("kitten"), "digest"
+	files := remote_cache_files(cd, rd, "")
+	if !slices.ContainsFunc(files, func(f cached_file) bool { return f.arcname == installed && string(f.entry.Data) == "kitten" }) {
+		t.Fatalf("The kitten binary is not sent")
+	}
+	kversion := remote_cache_version(files)
+	if kversion == version {
+		t.Fatalf("The remote cache version does not change with the kitten binary")
+	}
+	// the version depends on the digest of the kitten binary, not its contents
+	cd.kitten_binary = []byte("other")
+	if remote_cache_version(remote_cache_files(cd, rd, "")) != kversion {
+		t.Fatalf("The remote cache version does not use the digest of the kitten binary")
+	}
+	cd.kitten_digest = "other"
+	if remote_cache_version(remote_cache_files(cd, rd, "")) == kversion {
+		t.Fatalf("The remote cache version does not change with the digest of the kitten binary")
+	}
+
+	// the platform of the remote host is read from the output of uname recorded by kitty
+	if _, err = recorded_remote_platform("kitty-test", "no-such-host", rd); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Missing platform record not reported: %v", err)
+	}
+}
+
+func TestSSHHealthMonitor(t *testing.T) {
+	if diff := cmp.Diff(
+		[]string{"ssh", "-O", "check", "-o", "ControlPath=/tmp/x", "--", "host"},
+		health_check_cmd([]string{"ssh", "-o", "ControlPath=/tmp/x", "--", "host"})); diff != "" {
+		t.Fatalf("Incorrect health check command:\n%s", diff)
+	}
+	// escape codes are not inserted into escape codes and characters in the output of the session
+	b := strings.Builder{}
+	out := session_output{dest: &b}
+	for _, x := range []string{"a\x1b[3", "1m", "\x1b]2;ti", "tle\x1b", "\\\xe2\x82", "\xac", "\x1b(", "B\x1bP@kitty", "\x07\x1b\\"} {
+		if _, err := out.Write([]byte(x)); err != nil {
+			t.Fatal(err)
+		}
+		if err := out.write_escape_code("|"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if diff := cmp.Diff("a\x1b[31m||\x1b]2;title\x1b\\\xe2\x82\xac||||\x1b(B\x1bP@kitty\x07\x1b\\|||", b.String()); diff != "" {
+		t.Fatalf("Incorrect session output:\n%s", diff)
+	}
+	results := []bool{true, false, false, true, false}
+	ctx, cancel := context.WithCancel(context.Background())
+	var titles []string
+	m := health_monitor{
+		unhealthy_title: "bad",
+		is_healthy: func(context.Context) bool {
+			if len(results) == 0 {
+				cancel()
+				return true
+			}
+			ans := results[0]
+			results = results[1:]
+			return ans
+		},
+		write: func(ec string) error {
+			titles = append(titles, utils.MustCompile(`"title":"[^"]*"`).FindString(ec))
+			return nil
+		},
+		interval: time.Millisecond, done: make(chan bool),
+	}
+	go m.run(ctx)
+	<-m.done
+	if diff := cmp.Diff([]string{`"title":"bad"`, "", `"title":"bad"`, ""}, titles); diff != "" {
+		t.Fatalf("Incorrect titles:\n%s", diff)
+	}
+}
+
+func TestSSHConnectionProxy(t *testing.T) {
+	p, err := parse_connection_proxy("gcloud-iap zone='us central'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("gcloud compute start-iap-tunnel %h %p --listen-on-stdin --verbosity=warning '--zone=us central'", p.proxy_command()); diff != "" {
+		t.Fatalf("Incorrect ProxyCommand:\n%s", diff)
+	}
+	if p, err = parse_connection_proxy("teleport proxy=tp.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"tsh", "login", "--proxy=tp.example.com"}, p.expand(p.typ.login)); diff != "" {
+		t.Fatalf("Incorrect login command:\n%s", diff)
+	}
+	for _, bad := range []string{"nosuchproxy", "aws-ssm zone=x"} {
+		if _, err = parse_connection_proxy(bad); err == nil {
+			t.Fatalf("Invalid connection_proxy not rejected: %#v", bad)
+		}
+	}
+	if p, err = parse_connection_proxy(""); p != nil || err != nil {
+		t.Fatalf("Empty connection_proxy not ignored")
+	}
+	p, _ = parse_connection_proxy("aws-ssm profile=kitty-test-no-such-profile")
+	if err = os.MkdirAll(proxy_auth_records_dir(), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	record := p.auth_record_path()
+	write_record := func(expires time.Time) {
+		if err = os.WriteFile(record, []byte(expires.Format(time.RFC3339Nano)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write_record(time.Now().Add(time.Minute))
+	if err = p.ensure_authenticated(time.Hour); err != nil {
+		t.Fatalf("The recorded check was not used: %s", err)
+	}
+	// expired records are not used and are removed
+	write_record(time.Now().Add(-time.Minute))
+	if is_auth_record_valid(record, time.Now()) {
+		t.Fatalf("An expired record was used")
+	}
+	if _, err = os.Stat(record); err == nil {
+		t.Fatalf("An expired record was not removed")
+	}
+	write_record(time.Now().Add(time.Minute))
+	prune_auth_records(time.Now().Add(2 * time.Minute))
+	if _, err = os.Stat(record); err == nil {
+		t.Fatalf("An expired record was not pruned")
+	}
+	expected := time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC)
+	for output, key := range map[string]string{
+		`{"credential": {"token_expiry": "2024-03-01T10:20:30Z"}}`:  "credential.token_expiry",
+		`{"Version": 1, "Expiration": "2024-03-01T10:20:30+00:00"}`: "Expiration",
+	} {
+		if actual := token_expiry([]byte(output), key); !actual.Equal(expected) {
+			t.Fatalf("Incorrect expiry from %s: %v", output, actual)
+		}
+	}
+	for _, output := range []string{`{"Version": 1}`, `{"Expiration": 1}`, `not json`} {
+		if actual := token_expiry([]byte(output), "Expiration"); !actual.IsZero() {
+			t.Fatalf("Expiry found in %s: %v", output, actual)
+		}
+	}
+	if _, err = connection_proxy_args(&Config{Connection_proxy: "aws-ssm"}, []string{"jump"}); err == nil {
+		t.Fatalf("Using jump hosts with connection_proxy not rejected")
+	}
+}
+
+func TestSSHChooseIdentity(t *testing.T) {
+	identities := parse_agent_identities(
+		"ssh-ed25519 AAAA1 me@laptop\nssh-rsa AAAA2 YubiKey\n",
+		"256 SHA256:one me@laptop (ED25519)\n4096 SHA256:two YubiKey (RSA)\n")
+	if diff := cmp.Diff([]agent_identity{{"ssh-ed25519 AAAA1 me@laptop", "256 SHA256:one me@laptop (ED25519)"}, {"ssh-rsa AAAA2 YubiKey", "4096 SHA256:two YubiKey (RSA)"}}, identities, cmp.AllowUnexported(agent_identity{})); diff != "" {
+		t.Fatalf("Incorrect identities:\n%s", diff)
+	}
+	path, err := identity_file_for(identities[1].public_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "ssh-rsa AAAA2 YubiKey\n" {
+		t.Fatalf("Incorrect identity file: %#v (%v)", string(data), err)
+	}
+}
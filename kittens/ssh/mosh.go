@@ -0,0 +1,145 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"kitty/tools/tty"
+	"kitty/tools/utils"
+
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+// With --mosh the bootstrap script sets up the remote host as usual and then
+// runs mosh-server instead of the login shell. mosh-server prints the port and
+// key for the session, which are used to connect to it with mosh-client, the
+// same way the mosh wrapper script does.
+
+func mosh_connect_pat() *regexp.Regexp {
+	return utils.MustCompile(mosh_connect_marker + `(\d+) (\S+)`)
+}
+
+// The command to run mosh-server, quoted for the remote shell
+func mosh_server_cmd(environ []string) []string {
+	ans := []string{"mosh-server", "new", "-s", "-c", "256"}
+	// mosh-server needs a UTF-8 locale, so use the local one, as mosh does
+	for _, x := range environ {
+		if key, _, found := strings.Cut(x, "="); found && (key == "LANG" || key == "LANGUAGE" || strings.HasPrefix(key, "LC_")) {
+			ans = append(ans, "-l", x)
+		}
+	}
+	for i, x := range ans {
+		ans[i] = utils.QuoteStringForSH(x)
+	}
+	return ans
+}
+
+// Passes through the output of the bootstrap script and mosh-server, except
+// for the line with the port and key for the session, which is recorded
+type mosh_output_filter struct {
+	w         io.Writer
+	pending   []byte
+	port, key string
+}
+
+const mosh_connect_marker = "MOSH CONNECT "
+
+// The number of bytes at the end of the partial line that could be the start
+// of the line with the key
+func mosh_held_back(partial_line []byte) int {
+	if idx := bytes.Index(partial_line, []byte(mosh_connect_marker)); idx > -1 {
+		return len(partial_line) - idx
+	}
+	for n := min(len(partial_line), len(mosh_connect_marker)-1); n > 0; n-- {
+		if bytes.HasSuffix(partial_line, []byte(mosh_connect_marker[:n])) {
+			return n
+		}
+	}
+	return 0
+}
+
+func (self *mosh_output_filter) Write(data []byte) (int, error) {
+	self.pending = append(self.pending, data...)
+	for {
+		idx := bytes.IndexByte(self.pending, '\n')
+		if idx < 0 {
+			break
+		}
+		line := self.pending[:idx+1]
+		self.pending = self.pending[idx+1:]
+		if m := mosh_connect_pat().FindSubmatch(line); m != nil {
+			self.port, self.key = string(m[1]), string(m[2])
+			continue
+		}
+		if _, err := self.w.Write(line); err != nil {
+			return 0, err
+		}
+	}
+	// partial lines, such as prompts, are written immediately, except for
+	// anything that could be the start of the line with the key
+	if n := mosh_held_back(self.pending); n < len(self.pending) {
+		if _, err := self.w.Write(self.pending[:len(self.pending)-n]); err != nil {
+			return 0, err
+		}
+		self.pending = append(self.pending[:0], self.pending[len(self.pending)-n:]...)
+	}
+	return len(data), nil
+}
+
+// The address of the remote host, as resolved locally, which is what
+// mosh-client connects to
+func mosh_remote_address(ssh_args []string, hostname string) (string, error) {
+	c := exec.Command(SSHExe(), utils.Concat([]string{"-G"}, slices.Clone(ssh_args), []string{"--", hostname})...)
+	output, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the address of %s from ssh with error: %w", hostname, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if key, val, found := strings.Cut(scanner.Text(), " "); found && key == "hostname" {
+			hostname = val
+			break
+		}
+	}
+	addrs, err := net.LookupHost(hostname)
+	if err != nil {
+		return "", fmt.Errorf("Failed to resolve the address of %s with error: %w", hostname, err)
+	}
+	return addrs[0], nil
+}
+
+// Connect to the session created by mosh-server with mosh-client, returning
+// the exit code of mosh-client
+func run_mosh_client(term *tty.Term, ssh_args []string, hostname string, output *mosh_output_filter) (rc int, err error) {
+	if output.port == "" {
+		return 1, fmt.Errorf("mosh-server did not start on %s", hostname)
+	}
+	addr, err := mosh_remote_address(ssh_args, hostname)
+	if err != nil {
+		return 1, err
+	}
+	c := exec.Command("mosh-client", addr, output.port)
+	c.Env = append(os.Environ(), "MOSH_KEY="+output.key)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// mosh-client needs the terminal in the state it was in originally
+	err = term.SuspendAndRun(func() error { return c.Run() })
+	if err != nil {
+		var exit_err *exec.ExitError
+		if !errors.As(err, &exit_err) {
+			return 1, err
+		}
+	}
+	return c.ProcessState.ExitCode(), nil
+}
@@ -0,0 +1,244 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/shlex"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+// Hosts behind the identity-aware proxies of cloud providers are connected to
+// with a ProxyCommand that runs the command line tool of the provider. Before
+// connecting, the tool is checked to be logged in, running its login command
+// if needed. Successful checks are recorded locally, with the time until
+// which they are valid, so they are not repeated for every connection. That is
+// at most the cache duration, and never beyond the expiry of the credentials
+// of the tool, where the tool can report it.
+
+type proxy_type struct {
+	settings []string
+	// the ProxyCommand, check and login commands, the placeholders {name} are
+	// replaced by the settings, dropping arguments with unset settings
+	proxy_command, check, login []string
+	// the command that outputs the credentials of the tool as JSON, and the
+	// dotted path to their expiry time in it
+	expiry     []string
+	expiry_key string
+}
+
+var proxy_types = map[string]proxy_type{
+	"gcloud-iap": {
+		settings:      []string{"project", "zone"},
+		proxy_command: []string{"gcloud", "compute", "start-iap-tunnel", "%h", "%p", "--listen-on-stdin", "--verbosity=warning", "--project={project}", "--zone={zone}"},
+		check:         []string{"gcloud", "auth", "print-access-token"},
+		login:         []string{"gcloud", "auth", "login"},
+		expiry:        []string{"gcloud", "config", "config-helper", "--format=json"},
+		expiry_key:    "credential.token_expiry",
+	},
+	"aws-ssm": {
+		settings:      []string{"profile", "region"},
+		proxy_command: []string{"aws", "ssm", "start-session", "--target", "%h", "--document-name", "AWS-StartSSHSession", "--parameters", "portNumber=%p", "--profile={profile}", "--region={region}"},
+		check:         []string{"aws", "sts", "get-caller-identity", "--profile={profile}", "--region={region}"},
+		login:         []string{"aws", "sso", "login", "--profile={profile}"},
+		expiry:        []string{"aws", "configure", "export-credentials", "--format=process", "--profile={profile}"},
+		expiry_key:    "Expiration",
+	},
+	"teleport": {
+		settings:      []string{"proxy", "cluster"},
+		proxy_command: []string{"tsh", "proxy", "ssh", "--proxy={proxy}", "--cluster={cluster}", "%r@%h:%p"},
+		check:         []string{"tsh", "status", "--proxy={proxy}"},
+		login:         []string{"tsh", "login", "--proxy={proxy}", "--cluster={cluster}"},
+		expiry:        []string{"tsh", "status", "--format=json", "--proxy={proxy}"},
+		expiry_key:    "active.valid_until",
+	},
+}
+
+type connection_proxy struct {
+	typ      proxy_type
+	settings map[string]string
+}
+
+// Parse the connection_proxy setting which is the type of proxy followed by
+// key=value settings
+func parse_connection_proxy(spec string) (*connection_proxy, error) {
+	parts, err := shlex.Split(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse connection_proxy: %#v with error: %w", spec, err)
+	}
+	if len(parts) == 0 {
+		return nil, nil
+	}
+	typ, found := proxy_types[parts[0]]
+	if !found {
+		return nil, fmt.Errorf("%#v is not a known type of connection proxy, choose from: %s", parts[0], strings.Join(utils.Sort(maps.Keys(proxy_types), strings.Compare), ", "))
+	}
+	ans := &connection_proxy{typ: typ, settings: make(map[string]string, len(parts)-1)}
+	for _, x := range parts[1:] {
+		key, val, _ := strings.Cut(x, "=")
+		if !slices.Contains(typ.settings, key) {
+			return nil, fmt.Errorf("%#v is not a valid setting for the %s connection proxy, choose from: %s", key, parts[0], strings.Join(typ.settings, ", "))
+		}
+		ans.settings[key] = val
+	}
+	return ans, nil
+}
+
+// Replace the placeholders in the arguments with the settings, dropping
+// arguments whose settings are not set
+func (self *connection_proxy) expand(args []string) []string {
+	ans := make([]string, 0, len(args))
+	for _, arg := range args {
+		missing := false
+		arg = utils.ReplaceAll(utils.MustCompile(`\{(?P<name>[a-z]+)\}`), arg, func(_ string, groupdict map[string]utils.SubMatch) string {
+			val := self.settings[groupdict["name"].Text]
+			missing = missing || val == ""
+			return val
+		})
+		if !missing {
+			ans = append(ans, arg)
+		}
+	}
+	return ans
+}
+
+// The ProxyCommand for ssh, run by ssh with the shell
+func (self *connection_proxy) proxy_command() string {
+	args := self.expand(self.typ.proxy_command)
+	for i, x := range args {
+		// the %h, %p and %r tokens are expanded by ssh and must remain unquoted
+		if strings.ContainsAny(x, " \t\n'\"\\$`;&|<>()*?[]#~!{}") {
+			args[i] = utils.QuoteStringForSH(x)
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+func proxy_auth_records_dir() string {
+	return filepath.Join(utils.CacheDir(), "ssh-proxy-auth")
+}
+
+func (self *connection_proxy) auth_record_path() string {
+	h := sha256.Sum256(utils.UnsafeStringToBytes(strings.Join(self.expand(self.typ.check), "\x00")))
+	return filepath.Join(proxy_auth_records_dir(), hex.EncodeToString(h[:16]))
+}
+
+// The expiry time at the dotted path key in the JSON output, zero if it is
+// not present
+func token_expiry(output []byte, key string) (ans time.Time) {
+	var val any
+	if json.Unmarshal(output, &val) != nil {
+		return
+	}
+	for _, k := range strings.Split(key, ".") {
+		m, ok := val.(map[string]any)
+		if !ok {
+			return
+		}
+		val = m[k]
+	}
+	if q, ok := val.(string); ok {
+		ans, _ = time.Parse(time.RFC3339, q)
+	}
+	return
+}
+
+// The expiry of the credentials of the tool, zero if it cannot be determined
+func (self *connection_proxy) credentials_expiry() time.Time {
+	cmd := self.expand(self.typ.expiry)
+	output, err := exec.Command(cmd[0], cmd[1:]...).Output()
+	if err != nil {
+		return time.Time{}
+	}
+	return token_expiry(output, self.typ.expiry_key)
+}
+
+// Whether the auth record is still valid, removing it if it has expired
+func is_auth_record_valid(path string, now time.Time) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	expires, err := time.Parse(time.RFC3339Nano, utils.UnsafeBytesToString(data))
+	if err == nil && now.Before(expires) {
+		return true
+	}
+	os.Remove(path)
+	return false
+}
+
+// Remove the auth records that have expired
+func prune_auth_records(now time.Time) {
+	entries, err := os.ReadDir(proxy_auth_records_dir())
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		is_auth_record_valid(filepath.Join(proxy_auth_records_dir(), e.Name()), now)
+	}
+}
+
+// Ensure the command line tool of the proxy is logged in, running its login
+// command if needed. Successful checks are trusted for cache_duration or until
+// the credentials of the tool expire, whichever is sooner.
+func (self *connection_proxy) ensure_authenticated(cache_duration time.Duration) error {
+	record := self.auth_record_path()
+	now := time.Now()
+	if is_auth_record_valid(record, now) {
+		return nil
+	}
+	prune_auth_records(now)
+	check := self.expand(self.typ.check)
+	if _, err := exec.LookPath(check[0]); err != nil {
+		return fmt.Errorf("The %s program needed for connection_proxy was not found", check[0])
+	}
+	if exec.Command(check[0], check[1:]...).Run() != nil {
+		login := self.expand(self.typ.login)
+		fmt.Fprintf(os.Stderr, "Logging in with: %s\n", strings.Join(login, " "))
+		c := exec.Command(login[0], login[1:]...)
+		c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := c.Run(); err != nil {
+			return fmt.Errorf("Failed to login with %s, with error: %w", login[0], err)
+		}
+	}
+	if cache_duration <= 0 {
+		return nil
+	}
+	expires := time.Now().Add(cache_duration)
+	if q := self.credentials_expiry(); !q.IsZero() && q.Before(expires) {
+		expires = q
+	}
+	if err := os.MkdirAll(proxy_auth_records_dir(), 0o700); err == nil {
+		_ = utils.AtomicWriteFile(record, utils.UnsafeStringToBytes(expires.Format(time.RFC3339Nano)), 0o600)
+	}
+	return nil
+}
+
+// The ssh options for the connection_proxy setting of the host, if any
+func connection_proxy_args(host_opts *Config, jump_hosts []string) ([]string, error) {
+	p, err := parse_connection_proxy(host_opts.Connection_proxy)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	if len(jump_hosts) > 0 {
+		return nil, fmt.Errorf("Cannot use connection_proxy together with jump hosts")
+	}
+	if err = p.ensure_authenticated(time.Duration(host_opts.Connection_proxy_auth_cache) * time.Second); err != nil {
+		return nil, err
+	}
+	return []string{"-o", "ProxyCommand=" + p.proxy_command()}, nil
+}
@@ -0,0 +1,223 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"kitty/tools/utils"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+// A proxy for the kitty remote control socket, forwarded to the remote host
+// over a UNIX socket. It allows only the remote control actions permitted for
+// the host to be performed.
+
+const rc_cmd_prefix = "@kitty-cmd"
+
+type rc_proxy struct {
+	listener net.Listener
+	path     string
+	// the kitty socket
+	network, address string
+	// glob patterns matching the allowed actions, all actions are allowed if nil
+	allowed_actions []string
+}
+
+func start_rc_proxy(listen_on string, allowed_actions string) (ans *rc_proxy, err error) {
+	ans = &rc_proxy{}
+	if ans.network, ans.address, err = utils.ParseSocketAddress(listen_on); err != nil {
+		return nil, err
+	}
+	if ans.network == "fd" {
+		return nil, fmt.Errorf("Cannot forward the kitty remote control socket as it is a file descriptor: %s", listen_on)
+	}
+	for _, x := range strings.Fields(allowed_actions) {
+		if x == "*" {
+			ans.allowed_actions = nil
+			break
+		}
+		if _, err = path.Match(x, ""); err != nil {
+			return nil, fmt.Errorf("The remote control action pattern %#v is invalid", x)
+		}
+		ans.allowed_actions = append(ans.allowed_actions, normalize_rc_action(x))
+	}
+	ans.path = filepath.Join(utils.RuntimeDir(), "kssh-rc-"+strconv.Itoa(os.Getpid())+".sock")
+	_ = os.Remove(ans.path)
+	if ans.listener, err = net.Listen("unix", ans.path); err != nil {
+		return nil, err
+	}
+	// the runtime directory is private, but be safe
+	if err = os.Chmod(ans.path, 0o600); err != nil {
+		ans.Close()
+		return nil, err
+	}
+	go ans.serve()
+	return
+}
+
+// The ssh commands to run a session with the remote control socket forwarded
+// as specified and to cancel the forward after the session. The forward only
+// needs to be cancelled when connections are shared, as it is then owned by the
+// ControlMaster, which outlives the session, otherwise cancel_cmd is nil.
+func rc_forward_cmds(cmd []string, insertion_point int, forward_spec string, share_connections bool) (session_cmd, cancel_cmd []string) {
+	if forward_spec == "" {
+		return cmd, nil
+	}
+	session_cmd = slices.Insert(slices.Clone(cmd), insertion_point, "-R", forward_spec)
+	if share_connections {
+		cancel_cmd = slices.Insert(slices.Clone(cmd), 1, "-O", "cancel", "-R", forward_spec)
+	}
+	return
+}
+
+func (self *rc_proxy) Close() {
+	self.listener.Close()
+	_ = os.Remove(self.path)
+}
+
+func (self *rc_proxy) serve() {
+	for {
+		conn, err := self.listener.Accept()
+		if err != nil {
+			return
+		}
+		go self.handle(conn)
+	}
+}
+
+var rc_command_keys = []string{"cmd", "encrypted", "no_response"}
+
+// kitty looks up the keys of remote control commands exactly and uses the last
+// of any duplicate keys, while Go matches JSON keys to struct fields case
+// insensitively, so the keys are decoded one by one, rejecting commands with
+// keys that differ only in case, which could be interpreted differently
+func decode_rc_command(cmd []byte) (ans map[string]json.RawMessage, err error) {
+	invalid := fmt.Errorf("Invalid remote control command")
+	dec := json.NewDecoder(bytes.NewReader(cmd))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, invalid
+	}
+	ans = make(map[string]json.RawMessage)
+	seen := utils.NewSet[string]()
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, invalid
+		}
+		key, ok := t.(string)
+		if !ok {
+			return nil, invalid
+		}
+		folded := strings.ToLower(key)
+		if seen.Has(folded) || (key != folded && slices.Contains(rc_command_keys, folded)) {
+			return nil, fmt.Errorf("Remote control commands with duplicate keys or keys that differ only in case are not allowed: %#v", key)
+		}
+		seen.Add(folded)
+		var val json.RawMessage
+		if err = dec.Decode(&val); err != nil {
+			return nil, invalid
+		}
+		ans[key] = val
+	}
+	if t, err := dec.Token(); err != nil || t != json.Delim('}') {
+		return nil, invalid
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, invalid
+	}
+	return ans, nil
+}
+
+// Action names use underscores and hyphens interchangeably
+func normalize_rc_action(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// Check if the command is allowed, returning an error message if it is not
+func (self *rc_proxy) check(cmd []byte) (errmsg string, no_response bool) {
+	rc, err := decode_rc_command(cmd)
+	if err != nil {
+		return err.Error(), false
+	}
+	if val, found := rc["no_response"]; found {
+		_ = json.Unmarshal(val, &no_response)
+	}
+	if _, found := rc["encrypted"]; found {
+		// the action of encrypted commands is unknown
+		return "Remote control commands with passwords cannot be used when forward_remote_control_actions restricts the allowed actions", no_response
+	}
+	var name string
+	if err = json.Unmarshal(rc["cmd"], &name); err != nil {
+		return "Invalid remote control command", no_response
+	}
+	action := normalize_rc_action(name)
+	for _, pat := range self.allowed_actions {
+		if matched, _ := path.Match(pat, action); matched {
+			return "", no_response
+		}
+	}
+	return fmt.Sprintf("The remote control action %#v is not allowed from this host by forward_remote_control_actions", name), no_response
+}
+
+func (self *rc_proxy) handle(conn net.Conn) {
+	defer conn.Close()
+	kitty, err := net.Dial(self.network, self.address)
+	if err != nil {
+		return
+	}
+	defer kitty.Close()
+	go func() {
+		_, _ = io.Copy(conn, kitty)
+		conn.Close()
+	}()
+	if self.allowed_actions == nil {
+		_, _ = io.Copy(kitty, conn)
+		return
+	}
+	var write_err error
+	write := func(w io.Writer, parts ...[]byte) {
+		// a single write so that it is not interleaved with responses from kitty
+		if write_err == nil {
+			_, write_err = w.Write(bytes.Join(parts, nil))
+		}
+	}
+	p := wcswidth.EscapeCodeParser{}
+	p.HandleDCS = func(data []byte) error {
+		if !bytes.HasPrefix(data, []byte(rc_cmd_prefix)) {
+			return nil
+		}
+		errmsg, no_response := self.check(data[len(rc_cmd_prefix):])
+		if errmsg == "" {
+			write(kitty, []byte("\x1bP"), data, []byte("\x1b\\"))
+		} else if !no_response {
+			response, _ := json.Marshal(map[string]any{"ok": false, "error": errmsg})
+			write(conn, []byte("\x1bP"+rc_cmd_prefix), response, []byte("\x1b\\"))
+		}
+		return write_err
+	}
+	buf := make([]byte, utils.DEFAULT_IO_BUFFER_SIZE)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if p.Parse(buf[:n]) != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
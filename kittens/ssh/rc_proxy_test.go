@@ -0,0 +1,110 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestSSHRemoteControlProxy(t *testing.T) {
+	kitty_path := filepath.Join(t.TempDir(), "kitty.sock")
+	l, err := net.Listen("unix", kitty_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// a fake kitty that echoes back the commands it receives, terminated by a newline
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\\')
+					if err != nil {
+						return
+					}
+					if _, err = conn.Write([]byte(line + "\n")); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	if _, err = start_rc_proxy("unix:"+kitty_path, "ls [bad"); err == nil {
+		t.Fatalf("An invalid action pattern was not rejected")
+	}
+	proxy, err := start_rc_proxy("unix:"+kitty_path, "ls get-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	conn, err := net.Dial("unix", proxy.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	send := func(payload string) string {
+		if _, err := conn.Write([]byte("\x1bP@kitty-cmd" + payload + "\x1b\\")); err != nil {
+			t.Fatal(err)
+		}
+		ans := ""
+		for !strings.HasSuffix(ans, "\x1b\\") {
+			b, err := r.ReadByte()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ans += string(b)
+		}
+		return strings.TrimLeft(ans, "\n")
+	}
+	for _, cmd := range []string{"ls", "get-colors", "get_text"} {
+		payload := fmt.Sprintf(`{"cmd":%#v,"version":[0,30,0]}`, cmd)
+		if ans := send(payload); ans != "\x1bP@kitty-cmd"+payload+"\x1b\\" {
+			t.Fatalf("The allowed command %s was not forwarded, got: %#v", cmd, ans)
+		}
+	}
+	for _, payload := range []string{
+		`{"cmd":"close-window"}`, `{"encrypted":"xxx"}`, `{"cmd":"ls","encrypted":""}`, `not json`, `{"cmd":"ls"} {}`,
+		// kitty uses only the exact keys, and the last of duplicate keys
+		`{"cmd":"close-window","Cmd":"ls"}`, `{"CMD":"ls"}`, `{"cmd":"ls","cmd":"close-window"}`, `{"cmd":"ls","Encrypted":"xxx"}`,
+	} {
+		if ans := send(payload); !strings.Contains(ans, `"ok":false`) {
+			t.Fatalf("The command %s was not denied, got: %#v", payload, ans)
+		}
+	}
+}
+
+func TestSSHRemoteControlForwardCmds(t *testing.T) {
+	cmd := []string{"ssh", "-t", "--", "host"}
+	spec := "/tmp/kssh-rc-x.sock:/run/kssh-rc-1.sock"
+	session_cmd, cancel_cmd := rc_forward_cmds(cmd, 2, spec, true)
+	if diff := cmp.Diff([]string{"ssh", "-t", "-R", spec, "--", "host"}, session_cmd); diff != "" {
+		t.Fatalf("Incorrect session command:\n%s", diff)
+	}
+	// the forward is owned by the ControlMaster when sharing connections
+	if diff := cmp.Diff([]string{"ssh", "-O", "cancel", "-R", spec, "-t", "--", "host"}, cancel_cmd); diff != "" {
+		t.Fatalf("Incorrect cancel command:\n%s", diff)
+	}
+	if _, cancel_cmd = rc_forward_cmds(cmd, 2, spec, false); cancel_cmd != nil {
+		t.Fatalf("Forward cancelled without sharing connections: %#v", cancel_cmd)
+	}
+	if session_cmd, cancel_cmd = rc_forward_cmds(cmd, 2, "", true); cancel_cmd != nil || len(session_cmd) != len(cmd) {
+		t.Fatalf("Forward added when not forwarding: %#v %#v", session_cmd, cancel_cmd)
+	}
+}
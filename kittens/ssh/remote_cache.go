@@ -0,0 +1,171 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kitty"
+	"kitty/tools/tui/shell_integration"
+	"kitty/tools/utils"
+
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+// The files that are the same for every connection, such as the shell
+// integration scripts and the kitty terminfo, are cached on the remote host in
+// remote_dir, versioned by a hash of their contents. The hosts known to have
+// an up to date cache are recorded locally, so the files are not sent to them
+// again. The record is written by kitty, once the bootstrap script reports
+// that it has installed the files. If the bootstrap script finds the cached
+// files are missing or out of date, it asks kitty for them instead.
+
+const remote_cache_version_file = "cache-version"
+
+type cached_file struct {
+	arcname string
+	entry   shell_integration.Entry
+	// used instead of the data for the version of the cache, if not empty
+	digest string
+}
+
+func remote_cache_files(cd *connection_data, rd, ksi string) (ans []cached_file) {
+	add := func(prefix string, items ...shell_integration.Entry) {
+		for _, item := range items {
+			ans = append(ans, cached_file{arcname: path.Join(prefix, path.Base(item.Metadata.Name)), entry: item})
+		}
+	}
+	if ksi != "" {
+		for _, fname := range shell_integration.Data().FilesMatching(
+			"shell-integration/",
+			"shell-integration/ssh/.+",        // bootstrap files are sent as command line args
+			"shell-integration/zsh/kitty.zsh", // backward compat file not needed by ssh kitten
+		) {
+			add(path.Join("home/", rd, "/", path.Dir(fname)), shell_integration.Data()[fname])
+		}
+	}
+	if cd.host_opts.Remote_kitty != Remote_kitty_no {
+		arcname := path.Join("home/", rd, "/kitty")
+		now := time.Now()
+		add(arcname, shell_integration.Entry{
+			Metadata: &tar.Header{Typeflag: tar.TypeReg, Name: "version", Mode: 0o644, ModTime: now, ChangeTime: now, AccessTime: now},
+			Data:     utils.UnsafeStringToBytes(kitty.VersionString),
+		})
+		for _, x := range []string{"kitty", "kitten"} {
+			add(path.Join(arcname, "bin"), shell_integration.Data()[path.Join("shell-integration", "ssh", x)])
+		}
+		if cd.kitten_binary != nil {
+			// where the kitten bootstrap script installs the downloaded kitten
+			add(path.Join(arcname, "install-tool"), shell_integration.Entry{
+				Metadata: &tar.Header{Typeflag: tar.TypeReg, Name: "kitten", Mode: 0o755, ModTime: now, ChangeTime: now, AccessTime: now},
+				Data:     cd.kitten_binary,
+			})
+			ans[len(ans)-1].digest = cd.kitten_digest
+		}
+	}
+	add(path.Join("home", ".terminfo"), shell_integration.Data()["terminfo/kitty.terminfo"])
+	add(path.Join("home", ".terminfo", "x"), shell_integration.Data()["terminfo/x/"+kitty.DefaultTermName])
+	return
+}
+
+func remote_cache_version(files []cached_file) string {
+	files = slices.Clone(files)
+	slices.SortFunc(files, func(a, b cached_file) int { return strings.Compare(a.arcname, b.arcname) })
+	h := sha256.New()
+	for _, f := range files {
+		h.Write(utils.UnsafeStringToBytes(f.arcname))
+		h.Write([]byte{0})
+		if f.digest != "" {
+			h.Write(utils.UnsafeStringToBytes(f.digest))
+		} else {
+			h.Write(f.entry.Data)
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+func remote_cache_records_dir() string {
+	return filepath.Join(utils.CacheDir(), "ssh-remote-cache")
+}
+
+func remote_cache_record_path(username, hostname, remote_dir string) string {
+	h := sha256.Sum256(utils.UnsafeStringToBytes(username + "@" + hostname + ":" + remote_dir))
+	return filepath.Join(remote_cache_records_dir(), hex.EncodeToString(h[:16]))
+}
+
+// The version of the files last cached on the remote host or an empty string
+// if unknown
+func cached_version_on_remote(username, hostname, remote_dir string) string {
+	data, err := os.ReadFile(remote_cache_record_path(username, hostname, remote_dir))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func write_cached_files(tw *tar.Writer, files []cached_file, rd, version string) error {
+	for _, f := range files {
+		m := f.entry.Metadata
+		h := &tar.Header{
+			Typeflag: m.Typeflag, Name: f.arcname, Format: tar.FormatPAX, Size: int64(len(f.entry.Data)), Mode: m.Mode | 0o600,
+			ModTime: m.ModTime, AccessTime: m.AccessTime, ChangeTime: m.ChangeTime,
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.entry.Data); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	data := utils.UnsafeStringToBytes(version)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg, Name: path.Join("home", rd, remote_cache_version_file), Format: tar.FormatPAX, Size: int64(len(data)),
+		Mode: 0o644, ModTime: now, ChangeTime: now, AccessTime: now,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// The cached files as a separate tarfile, sent by kitty when the bootstrap
+// script asks for them
+func make_remote_cache_tarfile(files []cached_file, rd, version string) ([]byte, error) {
+	w := bytes.Buffer{}
+	gw, err := gzip.NewWriterLevel(&w, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(gw)
+	if err = write_cached_files(tw, files, rd, version); err == nil {
+		if err = tw.Close(); err == nil {
+			err = gw.Close()
+		}
+	}
+	return w.Bytes(), err
+}
+
+// Forget the caches on all remote hosts, so that the cached files are sent
+// again on the next connection to every host
+func forget_remote_caches() error {
+	if err := os.RemoveAll(remote_cache_records_dir()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
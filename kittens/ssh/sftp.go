@@ -0,0 +1,92 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"kitty/tools/cli"
+	"kitty/tools/utils"
+
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
+)
+
+var _ = fmt.Print
+
+// For hosts that do not allow the bootstrap script to read its data from the
+// TTY, the data is uploaded with sftp into the home directory on the remote
+// host, from where the bootstrap script reads it. sftp is told to use the
+// kitten as its ssh program, so that the connection uses the same ssh options
+// as the session, including any shared connection.
+
+const sftp_ssh_cmd_env_var = "KITTY_SFTP_SSH_CMD"
+
+// Run by sftp as its ssh program, ignores the arguments from sftp and runs
+// the sftp subsystem with the ssh command from the kitten instead
+func RunSFTPProxy() {
+	var cmd []string
+	if err := json.Unmarshal(utils.UnsafeStringToBytes(os.Getenv(sftp_ssh_cmd_env_var)), &cmd); err != nil || len(cmd) == 0 {
+		cli.ShowError(fmt.Errorf("The %s environment variable is not set correctly", sftp_ssh_cmd_env_var))
+		os.Exit(1)
+	}
+	os.Unsetenv(sftp_ssh_cmd_env_var)
+	err := unix.Exec(utils.FindExe(cmd[0]), cmd, os.Environ())
+	cli.ShowError(err)
+	os.Exit(1)
+}
+
+// The ssh command to run the sftp subsystem, from the ssh command of the
+// session, which ends with -- hostname
+func sftp_ssh_cmd(session_cmd []string) []string {
+	n := len(session_cmd)
+	return utils.Concat(slices.Clone(session_cmd[:n-2]), []string{"-T", "-o", "ClearAllForwardings=yes", "-s", "--", session_cmd[n-1], "sftp"})
+}
+
+func quote_for_sftp(x string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(x) + `"`
+}
+
+// Upload the data to the specified file in the home directory on the remote
+// host
+func upload_via_sftp(session_cmd []string, data []byte, remote_name string) error {
+	sftp, err := exec.LookPath("sftp")
+	if err != nil {
+		return fmt.Errorf("The sftp program was not found, it is needed to send data to the remote host with bootstrap_via sftp")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "kssh-data-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	// sftp creates the remote file with the permissions of the local file,
+	// which are 0600
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	ssh_cmd, err := json.Marshal(sftp_ssh_cmd(session_cmd))
+	if err != nil {
+		return err
+	}
+	c := exec.Command(sftp, "-q", "-b", "-", "-S", exe, "kitty-sftp-host")
+	c.Env = append(os.Environ(), "KITTY_KITTEN_RUN_MODULE=ssh_sftp_proxy", sftp_ssh_cmd_env_var+"="+string(ssh_cmd))
+	c.Stdin = strings.NewReader(fmt.Sprintf("put %s %s\n", quote_for_sftp(f.Name()), quote_for_sftp(remote_name)))
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	if err = c.Run(); err != nil {
+		return fmt.Errorf("Failed to upload data to the remote host with sftp, with error: %w\n%s", err, stderr.String())
+	}
+	return nil
+}
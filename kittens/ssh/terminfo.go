@@ -0,0 +1,107 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"kitty/tools/utils"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+// Additional terminfo entries, from the terminfo option in ssh.conf, for
+// programs such as tmux that set their own TERM. They are sent as source to be
+// compiled on the remote host and also pre-compiled for hosts without tic.
+
+const extra_terminfo_name = "extra.terminfo"
+
+// Get the terminfo source for the specified entries, which are either names
+// of entries in the local terminfo database or paths to terminfo source files
+func extra_terminfo_source(spec string) (ans []byte, err error) {
+	for _, x := range strings.Fields(spec) {
+		var data []byte
+		if strings.Contains(x, "/") || strings.HasSuffix(x, ".terminfo") {
+			if data, err = os.ReadFile(utils.ResolveConfPath(x)); err != nil {
+				return nil, fmt.Errorf("Failed to read the terminfo file %s with error: %w", x, err)
+			}
+		} else {
+			// -x is needed for the extended capabilities used by tmux, etc.
+			c := exec.Command("infocmp", "-x", "-a", x)
+			if data, err = c.Output(); err != nil {
+				return nil, fmt.Errorf("Failed to get the terminfo entry %s using infocmp with error: %w", x, err)
+			}
+		}
+		ans = append(ans, data...)
+		ans = append(ans, '\n')
+	}
+	return
+}
+
+// Compile the terminfo source locally, returning the compiled entries keyed
+// by name. Returns nil if compilation is not possible.
+func compile_terminfo_locally(src []byte) (ans map[string][]byte) {
+	tic, err := exec.LookPath("tic")
+	if err != nil {
+		return nil
+	}
+	tdir, err := os.MkdirTemp("", "kssh-terminfo-")
+	if err != nil {
+		return nil
+	}
+	defer os.RemoveAll(tdir)
+	srcpath := filepath.Join(tdir, extra_terminfo_name)
+	if err = os.WriteFile(srcpath, src, 0o600); err != nil {
+		return nil
+	}
+	output_dir := filepath.Join(tdir, "db")
+	if err = exec.Command(tic, "-x", "-o", output_dir, srcpath).Run(); err != nil {
+		return nil
+	}
+	ans = make(map[string][]byte)
+	_ = filepath.WalkDir(output_dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if data, rerr := os.ReadFile(p); rerr == nil {
+				ans[d.Name()] = data
+			}
+		}
+		return nil
+	})
+	return
+}
+
+type terminfo_file struct {
+	arcname string
+	data    []byte
+}
+
+// The files to add to the .terminfo directory on the remote host for the
+// specified entries
+func extra_terminfo_files(spec string) (ans []terminfo_file, err error) {
+	src, err := extra_terminfo_source(spec)
+	if err != nil || len(src) == 0 {
+		return nil, err
+	}
+	ans = append(ans, terminfo_file{extra_terminfo_name, src})
+	compiled := compile_terminfo_locally(src)
+	names := maps.Keys(compiled)
+	slices.Sort(names)
+	for _, name := range names {
+		// the database directory is named by either the first letter or its
+		// hex code, depending on the system
+		ans = append(ans,
+			terminfo_file{path.Join(name[:1], name), compiled[name]},
+			terminfo_file{path.Join(fmt.Sprintf("%x", name[0]), name), compiled[name]},
+		)
+	}
+	return
+}
@@ -0,0 +1,129 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// With upload_kitten the kitten binary matching the platform of the remote
+// host is sent along with the other cached files and installed where the
+// kitten bootstrap script looks for a downloaded kitten. The platform of the
+// remote host is reported by the bootstrap script, with the output of uname,
+// when it installs the cached files and is recorded by kitty next to the
+// record of the remote cache. So the kitten is uploaded from the second
+// connection to a host. The digest of the kitten binary, used for the version
+// of the remote cache, is recorded locally, keyed by the path, size and
+// modification time of the binary, so it is computed only once per binary.
+
+// Convert the output of uname -sm into the platform names used for the
+// pre-compiled kitten binaries, this must match shell-integration/ssh/kitten
+func platform_from_uname(output string) (string, error) {
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return "", fmt.Errorf("Could not parse the output of uname: %#v", output)
+	}
+	var goos, goarch string
+	switch fields[0] {
+	case "Linux":
+		goos = "linux"
+	case "Darwin":
+		goos = "darwin"
+	case "FreeBSD":
+		goos = "freebsd"
+	case "NetBSD":
+		goos = "netbsd"
+	case "OpenBSD":
+		goos = "openbsd"
+	case "DragonFlyBSD":
+		goos = "dragonfly"
+	default:
+		return "", fmt.Errorf("kitten binaries are not available for the %s operating system", fields[0])
+	}
+	m := fields[1]
+	switch {
+	case m == "amd64" || m == "x86_64":
+		goarch = "amd64"
+	case m == "arm64" || strings.HasPrefix(m, "aarch64") || strings.HasPrefix(m, "armv8"):
+		goarch = "arm64"
+	case m == "arm" || m == "armv7l":
+		goarch = "arm"
+	case m == "i386" || m == "i686":
+		goarch = "386"
+	default:
+		return "", fmt.Errorf("kitten binaries are not available for the %s CPU architecture", m)
+	}
+	return goos + "-" + goarch, nil
+}
+
+func remote_platform_record_path(username, hostname, remote_dir string) string {
+	return remote_cache_record_path(username, hostname, remote_dir) + ".platform"
+}
+
+// The platform of the remote host, from the local record of the output of
+// uname on it, fs.ErrNotExist if it has not been recorded yet
+func recorded_remote_platform(username, hostname, remote_dir string) (string, error) {
+	data, err := os.ReadFile(remote_platform_record_path(username, hostname, remote_dir))
+	if err != nil {
+		return "", err
+	}
+	return platform_from_uname(utils.UnsafeBytesToString(data))
+}
+
+// The path to the kitten binary for the specified platform
+func kitten_for_platform(platform, binaries_dir string) (string, error) {
+	if platform == runtime.GOOS+"-"+runtime.GOARCH {
+		return os.Executable()
+	}
+	if binaries_dir == "" {
+		return "", fmt.Errorf("No kitten binary for %s, set kitten_binaries in ssh.conf to a directory containing kitten-%s", platform, platform)
+	}
+	dirs, err := resolve_file_spec(binaries_dir, false)
+	if err != nil {
+		return "", err
+	}
+	ans := filepath.Join(dirs[0], "kitten-"+platform)
+	if _, err = os.Stat(ans); err != nil {
+		return "", fmt.Errorf("No kitten binary for %s in %s", platform, binaries_dir)
+	}
+	return ans, nil
+}
+
+// The contents of the kitten binary and their digest, from the local record
+// if the binary is unchanged since it was computed
+func read_kitten_binary(path string) (data []byte, digest string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	s, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if data, err = io.ReadAll(f); err != nil {
+		return
+	}
+	key := sha256.Sum256(utils.UnsafeStringToBytes(fmt.Sprintf("%s\x00%d\x00%d", path, s.Size(), s.ModTime().UnixNano())))
+	record := filepath.Join(remote_cache_records_dir(), hex.EncodeToString(key[:16])+".digest")
+	if q, rerr := os.ReadFile(record); rerr == nil && len(q) == 64 {
+		return data, string(q), nil
+	}
+	h := sha256.Sum256(data)
+	digest = hex.EncodeToString(h[:])
+	if os.MkdirAll(remote_cache_records_dir(), 0o700) == nil {
+		_ = utils.AtomicWriteFile(record, utils.UnsafeStringToBytes(digest), 0o600)
+	}
+	return
+}
@@ -3,10 +3,11 @@
 
 
 import os
+import re
 import subprocess
 import traceback
 from contextlib import suppress
-from typing import Any, Dict, Iterator, List, Optional, Sequence, Set, Tuple
+from typing import Any, Callable, Dict, Iterator, List, Optional, Sequence, Set, Tuple
 
 from kitty.types import run_once
 from kitty.utils import SSHConnectionData
@@ -68,6 +69,18 @@ def is_kitten_cmdline(q: Sequence[str]) -> bool:
     return q[1:3] == ['+runpy', 'from kittens.runner import main; main()'] and len(q) >= 6 and q[5] == 'ssh'
 
 
+# Options of the kitten that take no value and must come before all ssh options
+kitten_flags = {'--refresh-remote-cache', '--mosh', '--choose-identity'}
+
+
+def index_of_ssh(argv: Sequence[str]) -> int:
+    # the index after which options can be inserted, which is after any kitten flags
+    idx = argv.index('ssh')
+    while idx + 1 < len(argv) and argv[idx + 1] in kitten_flags:
+        idx += 1
+    return idx
+
+
 def patch_cmdline(key: str, val: str, argv: List[str]) -> None:
     for i, arg in enumerate(tuple(argv)):
         if arg.startswith(f'--kitten={key}='):
@@ -76,7 +89,7 @@ def patch_cmdline(key: str, val: str, argv: List[str]) -> None:
         elif i > 0 and argv[i-1] == '--kitten' and (arg.startswith(f'{key}=') or arg.startswith(f'{key} ')):
             argv[i] = val
             return
-    idx = argv.index('ssh')
+    idx = index_of_ssh(argv)
     argv.insert(idx + 1, f'--kitten={key}={val}')
 
 
@@ -112,8 +125,59 @@ def read_data_from_shared_memory(shm_name: str) -> Any:
         return json.loads(shm.read_data_with_size())
 
 
-def get_ssh_data(msgb: memoryview, request_id: str) -> Iterator[bytes]:
-    from base64 import standard_b64decode
+def yield_base64_data(encoded: str) -> Iterator[bytes]:
+    encoded_data = memoryview(encoded.encode('ascii'))
+    # macOS has a 255 byte limit on its input queue as per man stty.
+    # Not clear if that applies to canonical mode input as well, but
+    # better to be safe.
+    line_sz = 254
+    while encoded_data:
+        yield encoded_data[:line_sz]
+        yield b'\n'
+        encoded_data = encoded_data[line_sz:]
+    yield b'KITTY_DATA_END\n'
+
+
+def record_remote_cache(record_path: str, version: str) -> None:
+    from kitty.config import atomic_save
+    os.makedirs(os.path.dirname(record_path), mode=0o700, exist_ok=True)
+    atomic_save(version.encode('utf-8'), record_path)
+
+
+def handle_remote_cache_request(md: Dict[str, str], remote_cache: Dict[str, str]) -> Iterator[bytes]:
+    # The bootstrap script either asks for the files cached on the remote host,
+    # when they are missing, or reports that it has installed them, along with
+    # the output of uname -sm. Neither needs the password as the cached files
+    # contain nothing private.
+    if 'cached' in md:
+        if md['cached'] == remote_cache.get('cache_version') and remote_cache.get('cache_record'):
+            try:
+                record_remote_cache(remote_cache.pop('cache_record'), md['cached'])
+                # the platform of the remote host, needed to upload the kitten to it
+                uname = md.get('uname', '')
+                if remote_cache.get('platform_record') and re.fullmatch(r'[a-zA-Z0-9_.-]+ [a-zA-Z0-9_.-]+', uname):
+                    record_remote_cache(remote_cache.pop('platform_record'), uname)
+            except OSError:
+                traceback.print_exc()
+        return
+    yield b'\nKITTY_DATA_START\n'
+    if md['cache'] != remote_cache.get('cache_version') or not remote_cache.get('cache_tarfile'):
+        yield b'No cached files available for this connection, run: kitten ssh --refresh-remote-cache to send them again\n'
+        return
+    yield b'OK\n'
+    yield from yield_base64_data(remote_cache.pop('cache_tarfile'))
+
+
+def get_ssh_data(
+    msgb: memoryview, request_id: str, remote_cwd: Callable[[], str] = lambda: '', remote_cache: Optional[Dict[str, str]] = None
+) -> Iterator[bytes]:
+    from base64 import standard_b64decode, standard_b64encode
+    md: Dict[str, str] = {}
+    with suppress(Exception):
+        md = dict(x.split('=', 1) for x in standard_b64decode(msgb).decode('utf-8').split(':'))
+    if 'cache' in md or 'cached' in md:
+        yield from handle_remote_cache_request(md, {} if remote_cache is None else remote_cache)
+        return
     yield b'\nKITTY_DATA_START\n'  # to discard leading data
     try:
         msg = standard_b64decode(msgb).decode('utf-8')
@@ -135,17 +199,16 @@ def get_ssh_data(msgb: memoryview, request_id: str) -> Iterator[bytes]:
             traceback.print_exc()
             yield f'{e}\n'.encode('utf-8')
         else:
+            if env_data.get('restore_cwd') == '1':
+                # the ssh kitten is reconnecting, restore the previous working directory
+                cwd = remote_cwd()
+                if cwd:
+                    yield b'KITTY_RESTORE_CWD:' + standard_b64encode(cwd.encode('utf-8')) + b'\n'
+            if remote_cache is not None:
+                remote_cache.clear()
+                remote_cache.update({k: env_data[k] for k in ('cache_version', 'cache_tarfile', 'cache_record', 'platform_record') if k in env_data})
             yield b'OK\n'
-            encoded_data = memoryview(env_data['tarfile'].encode('ascii'))
-            # macOS has a 255 byte limit on its input queue as per man stty.
-            # Not clear if that applies to canonical mode input as well, but
-            # better to be safe.
-            line_sz = 254
-            while encoded_data:
-                yield encoded_data[:line_sz]
-                yield b'\n'
-                encoded_data = encoded_data[line_sz:]
-            yield b'KITTY_DATA_END\n'
+            yield from yield_base64_data(env_data['tarfile'])
 
 
 def set_env_in_cmdline(env: Dict[str, str], argv: List[str], clone: bool = True) -> None:
@@ -153,7 +216,7 @@ def set_env_in_cmdline(env: Dict[str, str], argv: List[str], clone: bool = True)
     if clone:
         patch_cmdline('clone_env', create_shared_memory(env, 'ksse-'), argv)
         return
-    idx = argv.index('ssh')
+    idx = index_of_ssh(argv)
     for i in range(idx, len(argv)):
         if argv[i] == '--kitten':
             idx = i + 1
@@ -193,7 +256,7 @@ def is_extra_arg(arg: str, extra_args: Tuple[str, ...]) -> str:
 
 def set_server_args_in_cmdline(
     server_args: List[str], argv: List[str],
-    extra_args: Tuple[str, ...] = ('--kitten',),
+    extra_args: Tuple[str, ...] = ('--kitten', '--via', '--ask-env'),
     allocate_tty: bool = False
 ) -> None:
     boolean_ssh_args, other_ssh_args = get_ssh_cli()
@@ -208,6 +271,8 @@ def set_server_args_in_cmdline(
             found_ssh = argument == 'ssh'
             continue
         if argument.startswith('-') and not expecting_option_val:
+            if argument in kitten_flags:
+                continue
             if argument == '--':
                 del ans[i+2:]
                 if allocate_tty and ans[i-1] != '-t':
@@ -274,7 +339,7 @@ def get_connection_data(args: List[str], cwd: str = '', extra_args: Tuple[str, .
             host_name = arg
             continue
         if arg.startswith('-') and not expecting_option_val:
-            if arg in boolean_ssh_args:
+            if arg in boolean_ssh_args or arg in kitten_flags:
                 continue
             if arg == '--':
                 expecting_hostname = True
@@ -35,7 +35,7 @@ func TestParseSSHArgs(t *testing.T) {
 	}
 
 	p := func(args, expected_ssh_args, expected_server_args, expected_extra_args string, expected_passthrough bool) {
-		ssh_args, server_args, passthrough, extra_args, err := ParseSSHArgs(split(args), "--kitten")
+		ssh_args, server_args, passthrough, extra_args, err := ParseSSHArgs(split(args), "--kitten", "--via")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -55,6 +55,7 @@ func TestParseSSHArgs(t *testing.T) {
 	p(`-46p23 localhost sh -c "a b"`, `-4 -6 -p 23`, `localhost sh -c "a b"`, ``, false)
 	p(`-46p23 -S/moose -W x:6 -- localhost sh -c "a b"`, `-4 -6 -p 23 -S /moose -W x:6`, `localhost sh -c "a b"`, ``, false)
 	p(`--kitten=abc -np23 --kitten xyz host`, `-n -p 23`, `host`, `--kitten abc --kitten xyz`, true)
+	p(`--via j1 -p23 --kitten=abc --via=j2 host cmd`, `-p 23`, `host cmd`, `--via j1 --kitten abc --via j2`, false)
 }
 
 func TestRelevantKittyOpts(t *testing.T) {
@@ -0,0 +1,169 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package themes
+
+import (
+	"fmt"
+	"strings"
+
+	"kitty/tools/themes"
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+	"kitty/tools/wcswidth"
+
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+// Mark or unmark the current theme for comparison, at most two themes can be
+// marked, marking a third unmarks the oldest
+func (self *handler) toggle_mark() {
+	t := self.themes_list.CurrentTheme()
+	if t == nil {
+		self.lp.Beep()
+		return
+	}
+	if slices.Contains(self.marked, t.Name()) {
+		self.marked = utils.Remove(self.marked, t.Name())
+	} else {
+		self.marked = append(self.marked, t.Name())
+		if len(self.marked) > 2 {
+			self.marked = self.marked[1:]
+		}
+	}
+	self.draw_screen()
+}
+
+// The themes to compare are the two marked themes or the marked theme and the
+// current theme
+func (self *handler) themes_to_compare() (a, b *themes.Theme) {
+	names := self.marked
+	if len(names) == 1 {
+		if t := self.themes_list.CurrentTheme(); t != nil && t.Name() != names[0] {
+			names = append(names, t.Name())
+		}
+	}
+	if len(names) == 2 {
+		a, b = self.all_themes.ThemeByName(names[0]), self.all_themes.ThemeByName(names[1])
+	}
+	return
+}
+
+func (self *handler) start_comparing() {
+	if a, b := self.themes_to_compare(); a == nil || b == nil {
+		self.lp.Beep()
+		return
+	}
+	self.state = COMPARING
+	self.draw_screen()
+}
+
+func (self *handler) on_comparing_key_event(ev *loop.KeyEvent) error {
+	if ev.MatchesPressOrRepeat("esc") || ev.MatchesPressOrRepeat("q") || ev.MatchesPressOrRepeat("v") {
+		ev.Handled = true
+		self.state = BROWSING
+		self.draw_screen()
+	}
+	return nil
+}
+
+// Render sample content using the colors from settings directly, so that it
+// does not depend on the current colors of the terminal
+func (self *handler) render_theme_sample(name string, settings map[string]string, width int) []string {
+	color := func(key string) string {
+		c, _ := themes.ColorWithDefault(settings, key)
+		return c.AsRGBSharp()
+	}
+	bg := color("background")
+	line := func(parts ...string) string {
+		// parts are alternating pairs of style and text
+		buf := strings.Builder{}
+		w := 0
+		for i := 0; i+1 < len(parts); i += 2 {
+			text, _ := wcswidth.TruncateToVisualLengthWithWidth(parts[i+1], width-w)
+			w += wcswidth.Stringwidth(text)
+			buf.WriteString(self.lp.SprintStyled(parts[i]+" bg="+bg, text))
+		}
+		buf.WriteString(self.lp.SprintStyled("bg="+bg, strings.Repeat(" ", utils.Max(0, width-w))))
+		return buf.String()
+	}
+	fg := "fg=" + color("foreground")
+	ans := []string{
+		line(fg+" bold", " "+name),
+		line(fg, ""),
+		line("fg="+color("color2"), " user@host", fg, ":", "fg="+color("color4"), "~/src", fg, "$ ls", "fg="+color("cursor")+" reverse", " "),
+		line("fg="+color("color4")+" bold", " docs", fg, "  README.md  ", "fg="+color("color2")+" bold", "build.sh"),
+		line(fg, " Some text with a ", "fg="+color("selection_foreground")+" bg="+color("selection_background"), "selection", fg, " in it"),
+		line(fg, ""),
+	}
+	names := [8]string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+	trunc := utils.Max(1, width/8-1)
+	for _, intense := range []int{0, 8} {
+		parts := []string{}
+		for i, cname := range names {
+			if intense > 0 {
+				cname = "bright-" + cname
+			}
+			if len(cname) > trunc {
+				cname = cname[:trunc]
+			}
+			parts = append(parts, fmt.Sprintf("fg=%s", color(fmt.Sprintf("color%d", i+intense))), " "+cname)
+		}
+		ans = append(ans, line(parts...))
+	}
+	ans = append(ans, line(fg, ""))
+	return ans
+}
+
+func (self *handler) draw_comparing_screen() {
+	sz, err := self.lp.ScreenSize()
+	if err != nil {
+		return
+	}
+	a, b := self.themes_to_compare()
+	if a == nil || b == nil {
+		return
+	}
+	sa, err := a.Settings()
+	if err != nil {
+		return
+	}
+	sb, err := b.Settings()
+	if err != nil {
+		return
+	}
+	width := (int(sz.WidthCells) - 1) / 2
+	left, right := self.render_theme_sample(a.Name(), sa, width), self.render_theme_sample(b.Name(), sb, width)
+	for i, l := range left {
+		self.lp.QueueWriteString(l + SEPARATOR + right[i])
+		self.lp.Println()
+	}
+	self.lp.Println()
+	swatch := func(val string) string {
+		return self.lp.SprintStyled("bg="+val, "  ") + " " + val
+	}
+	differing := 0
+	available_rows := int(sz.HeightCells) - len(left) - 2
+	key_width := utils.Max(0, utils.Map(func(x string) int { return len(x) }, editable_colors)...)
+	for _, key := range editable_colors {
+		ca, _ := themes.ColorWithDefault(sa, key)
+		cb, _ := themes.ColorWithDefault(sb, key)
+		if ca == cb {
+			continue
+		}
+		differing++
+		if differing <= available_rows {
+			self.lp.Printf(" %-*s  %s  %s", key_width, key, swatch(ca.AsRGBSharp()), swatch(cb.AsRGBSharp()))
+			self.lp.Println()
+		}
+	}
+	if differing == 0 {
+		self.lp.Println(" The colors of these themes are identical")
+	}
+	self.lp.MoveCursorTo(1, int(sz.HeightCells))
+	self.lp.PrintStyled("reverse", strings.Repeat(" ", int(sz.WidthCells)))
+	self.lp.QueueWriteString("\r")
+	self.lp.PrintStyled("reverse", fmt.Sprintf(" %d of %d colors differ. Press Esc to return to the list of themes", differing, len(editable_colors)))
+	self.lp.QueueWriteString("\x1b[m")
+}
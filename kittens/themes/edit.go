@@ -0,0 +1,387 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package themes
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"kitty/tools/themes"
+	"kitty/tools/tui/loop"
+	"kitty/tools/tui/readline"
+	"kitty/tools/utils"
+	"kitty/tools/utils/style"
+
+	"golang.org/x/exp/maps"
+)
+
+var _ = fmt.Print
+
+var editable_colors = []string{
+	"foreground", "background", "cursor", "selection_foreground", "selection_background",
+	"color0", "color1", "color2", "color3", "color4", "color5", "color6", "color7",
+	"color8", "color9", "color10", "color11", "color12", "color13", "color14", "color15",
+}
+
+type color_channel int
+
+const (
+	RED_CHANNEL color_channel = iota
+	GREEN_CHANNEL
+	BLUE_CHANNEL
+	HUE_CHANNEL
+	SATURATION_CHANNEL
+	LIGHTNESS_CHANNEL
+	NUM_OF_CHANNELS
+)
+
+var channel_names = [NUM_OF_CHANNELS]string{"Red", "Green", "Blue", "Hue", "Saturation", "Lightness"}
+
+type editor_input int
+
+const (
+	NO_INPUT editor_input = iota
+	COLOR_INPUT
+	NAME_INPUT
+)
+
+type theme_editor struct {
+	base_name   string
+	settings    map[string]string
+	current     int
+	channel     color_channel
+	input       editor_input
+	rl          *readline.Readline
+	err_msg     string
+	is_modified bool
+}
+
+func new_theme_editor(lp *loop.Loop, t *themes.Theme) (*theme_editor, error) {
+	settings, err := t.Settings()
+	if err != nil {
+		return nil, err
+	}
+	ans := &theme_editor{base_name: t.Name(), settings: maps.Clone(settings)}
+	if ans.settings == nil {
+		ans.settings = make(map[string]string, len(editable_colors))
+	}
+	ans.rl = readline.New(lp, readline.RlInit{DontMarkPrompts: true})
+	return ans, nil
+}
+
+func (self *theme_editor) current_key() string { return editable_colors[self.current] }
+
+// The current value of the specified color, falling back to kitty's defaults
+// for colors not set by the theme
+func (self *theme_editor) color(key string) (style.RGBA, bool) {
+	return themes.ColorWithDefault(self.settings, key)
+}
+
+func (self *theme_editor) set_color(key string, c style.RGBA) {
+	self.settings[key] = c.AsRGBSharp()
+	self.is_modified = true
+}
+
+func (self *theme_editor) channel_value(c style.RGBA) float64 {
+	h, s, l := c.AsHSL()
+	switch self.channel {
+	case RED_CHANNEL:
+		return float64(c.Red)
+	case GREEN_CHANNEL:
+		return float64(c.Green)
+	case BLUE_CHANNEL:
+		return float64(c.Blue)
+	case HUE_CHANNEL:
+		return h
+	case SATURATION_CHANNEL:
+		return s * 100
+	}
+	return l * 100
+}
+
+func (self *theme_editor) nudge(delta int) bool {
+	key := self.current_key()
+	c, ok := self.color(key)
+	if !ok {
+		return false
+	}
+	clamp := func(x int) uint8 { return uint8(utils.Max(0, utils.Min(x, 255))) }
+	h, s, l := c.AsHSL()
+	switch self.channel {
+	case RED_CHANNEL:
+		c.Red = clamp(int(c.Red) + delta)
+	case GREEN_CHANNEL:
+		c.Green = clamp(int(c.Green) + delta)
+	case BLUE_CHANNEL:
+		c.Blue = clamp(int(c.Blue) + delta)
+	case HUE_CHANNEL:
+		c = style.RGBAFromHSL(h+float64(delta), s, l)
+	case SATURATION_CHANNEL:
+		c = style.RGBAFromHSL(h, s+float64(delta)/100, l)
+	case LIGHTNESS_CHANNEL:
+		c = style.RGBAFromHSL(h, s, l+float64(delta)/100)
+	}
+	if existing, _ := self.color(key); existing == c {
+		return false
+	}
+	self.set_color(key, c)
+	return true
+}
+
+// Parse a color specified as either a kitty color or hsl(h, s%, l%)
+func parse_color_input(text string) (style.RGBA, error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if m := utils.MustCompile(`^hsl\(\s*([0-9.]+)\s*,\s*([0-9.]+)%?\s*,\s*([0-9.]+)%?\s*\)$`).FindStringSubmatch(text); m != nil {
+		h, _ := strconv.ParseFloat(m[1], 64)
+		s, _ := strconv.ParseFloat(m[2], 64)
+		l, _ := strconv.ParseFloat(m[3], 64)
+		return style.RGBAFromHSL(h, s/100, l/100), nil
+	}
+	if len(text) == 6 && !strings.HasPrefix(text, "#") {
+		if c, err := style.ParseColor("#" + text); err == nil {
+			return c, nil
+		}
+	}
+	return style.ParseColor(text)
+}
+
+func (self *theme_editor) save(name string) (path string, err error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utils.MustCompile(`[/\\:*?"<>|\x00-\x1f]`).MatchString(name) {
+		return "", fmt.Errorf("Invalid theme name: %#v", name)
+	}
+	dir := filepath.Join(utils.ConfigDir(), "themes")
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return
+	}
+	path = filepath.Join(dir, name+".conf")
+	err = utils.AtomicUpdateFile(path, utils.UnsafeStringToBytes(themes.SettingsAsConf(name, "Created with the kitty themes kitten, based on "+self.base_name, self.settings)), 0o644)
+	return
+}
+
+// handler integration {{{
+
+func (self *handler) start_editing() {
+	t := self.themes_list.CurrentTheme()
+	if t == nil {
+		self.lp.Beep()
+		return
+	}
+	ed, err := new_theme_editor(self.lp, t)
+	if err != nil {
+		self.lp.Beep()
+		return
+	}
+	self.editor = ed
+	self.state = EDITING
+	self.apply_edited_colors()
+	self.draw_screen()
+}
+
+func (self *handler) apply_edited_colors() {
+	self.lp.QueueWriteString(themes.ColorSettingsAsEscapeCodes(self.editor.settings))
+	if self.opts.LivePreview {
+		self.live_preview_colors(themes.ColorSettingsAsRCColors(self.editor.settings))
+	}
+}
+
+func (self *handler) stop_editing() {
+	self.editor = nil
+	self.state = BROWSING
+	self.set_colors_to_current_theme()
+	self.draw_screen()
+}
+
+func (self *handler) start_editor_input(which editor_input) {
+	ed := self.editor
+	ed.input = which
+	ed.err_msg = ""
+	switch which {
+	case COLOR_INPUT:
+		ed.rl.SetPrompt(ed.current_key() + ": ")
+		c, _ := ed.color(ed.current_key())
+		ed.rl.SetText(c.AsRGBSharp())
+	case NAME_INPUT:
+		ed.rl.SetPrompt("Save theme as: ")
+		ed.rl.SetText(ed.base_name + " (edited)")
+	}
+	self.draw_screen()
+}
+
+func (self *handler) finish_editor_input() {
+	ed := self.editor
+	text := ed.rl.AllText()
+	which := ed.input
+	ed.input = NO_INPUT
+	switch which {
+	case COLOR_INPUT:
+		c, err := parse_color_input(text)
+		if err != nil {
+			ed.err_msg = err.Error()
+		} else {
+			ed.set_color(ed.current_key(), c)
+			self.apply_edited_colors()
+		}
+	case NAME_INPUT:
+		path, err := ed.save(text)
+		if err != nil {
+			ed.err_msg = err.Error()
+			break
+		}
+		t, err := self.all_themes.AddFromFile(path)
+		if err != nil {
+			ed.err_msg = err.Error()
+			break
+		}
+		self.editor = nil
+		self.state = BROWSING
+		self.set_current_category("user")
+		self.themes_list.UpdateSearch("")
+		self.themes_list.UpdateThemes(self.all_themes.Filtered(self.category_filters[self.current_category()]))
+		self.themes_list.SelectTheme(t.Name())
+		self.set_colors_to_current_theme()
+	}
+	self.draw_screen()
+}
+
+func (self *handler) on_editing_key_event(ev *loop.KeyEvent) error {
+	ed := self.editor
+	if ed.input != NO_INPUT {
+		if ev.MatchesPressOrRepeat("enter") {
+			ev.Handled = true
+			self.finish_editor_input()
+			return nil
+		}
+		if ev.MatchesPressOrRepeat("esc") {
+			ev.Handled = true
+			ed.input = NO_INPUT
+			self.draw_screen()
+			return nil
+		}
+		err := ed.rl.OnKeyEvent(ev)
+		if err != nil {
+			return err
+		}
+		if ev.Handled {
+			self.draw_screen()
+		}
+		return nil
+	}
+	nudge := func(delta int) {
+		if ed.nudge(delta) {
+			self.apply_edited_colors()
+			self.draw_screen()
+		} else {
+			self.lp.Beep()
+		}
+	}
+	move := func(delta int) {
+		ed.current = (ed.current + delta + len(editable_colors)) % len(editable_colors)
+		self.draw_screen()
+	}
+	ev.Handled = true
+	switch {
+	case ev.MatchesPressOrRepeat("esc") || ev.MatchesPressOrRepeat("q"):
+		self.stop_editing()
+	case ev.MatchesPressOrRepeat("j") || ev.MatchesPressOrRepeat("down"):
+		move(1)
+	case ev.MatchesPressOrRepeat("k") || ev.MatchesPressOrRepeat("up"):
+		move(-1)
+	case ev.MatchesPressOrRepeat("l") || ev.MatchesPressOrRepeat("right"):
+		nudge(1)
+	case ev.MatchesPressOrRepeat("h") || ev.MatchesPressOrRepeat("left"):
+		nudge(-1)
+	case ev.MatchesPressOrRepeat("shift+l") || ev.MatchesPressOrRepeat("shift+right"):
+		nudge(10)
+	case ev.MatchesPressOrRepeat("shift+h") || ev.MatchesPressOrRepeat("shift+left"):
+		nudge(-10)
+	case ev.MatchesPressOrRepeat("tab"):
+		ed.channel = (ed.channel + 1) % NUM_OF_CHANNELS
+		self.draw_screen()
+	case ev.MatchesPressOrRepeat("shift+tab"):
+		ed.channel = (ed.channel + NUM_OF_CHANNELS - 1) % NUM_OF_CHANNELS
+		self.draw_screen()
+	case ev.MatchesPressOrRepeat("enter") || ev.MatchesPressOrRepeat("i"):
+		self.start_editor_input(COLOR_INPUT)
+	case ev.MatchesPressOrRepeat("s"):
+		self.start_editor_input(NAME_INPUT)
+	default:
+		ev.Handled = false
+	}
+	return nil
+}
+
+func (self *handler) draw_editing_screen() {
+	ed := self.editor
+	sz, err := self.lp.ScreenSize()
+	if err != nil {
+		return
+	}
+	title := "Editing: " + ed.base_name
+	if ed.is_modified {
+		title += " [modified]"
+	}
+	self.lp.PrintStyled("fg=green bold", title)
+	self.lp.Println()
+	self.lp.Println()
+	name_width := utils.Max(0, utils.Map(func(x string) int { return len(x) }, editable_colors)...)
+	bar_width := utils.Max(8, utils.Min(32, int(sz.WidthCells)-name_width-48))
+	for i, key := range editable_colors {
+		c, _ := ed.color(key)
+		h, s, l := c.AsHSL()
+		marker := " "
+		if i == ed.current {
+			marker = self.lp.SprintStyled("fg=green", ">")
+		}
+		swatch := self.lp.SprintStyled("bg="+c.AsRGBSharp(), "    ")
+		name := fmt.Sprintf("%-*s", name_width, key)
+		if i == ed.current {
+			name = self.lp.SprintStyled("bold", name)
+		}
+		line := fmt.Sprintf("%s %s %s %s  rgb(%3d, %3d, %3d)  hsl(%3.0f, %3.0f%%, %3.0f%%)", marker, name, swatch, c.AsRGBSharp(), c.Red, c.Green, c.Blue, h, s*100, l*100)
+		if i == ed.current {
+			maxval := 255.
+			switch ed.channel {
+			case HUE_CHANNEL:
+				maxval = 360
+			case SATURATION_CHANNEL, LIGHTNESS_CHANNEL:
+				maxval = 100
+			}
+			filled := int(math.Round(ed.channel_value(c) / maxval * float64(bar_width)))
+			filled = utils.Max(0, utils.Min(filled, bar_width))
+			line += fmt.Sprintf("  %s %s%s", channel_names[ed.channel][:1], strings.Repeat("█", filled), strings.Repeat("░", bar_width-filled))
+		}
+		self.lp.QueueWriteString(line)
+		self.lp.Println()
+	}
+	self.lp.Println()
+	sample := strings.Builder{}
+	for i := 0; i < 16; i++ {
+		sample.WriteString(self.lp.SprintStyled(fmt.Sprintf("fg=%d", i), fmt.Sprintf(" %2d", i)))
+	}
+	self.lp.QueueWriteString(sample.String())
+	self.lp.Println()
+	if ed.err_msg != "" {
+		self.lp.Println()
+		self.lp.PrintStyled("fg=red", ed.err_msg)
+		self.lp.Println()
+	}
+	self.lp.MoveCursorTo(1, int(sz.HeightCells))
+	if ed.input != NO_INPUT {
+		self.lp.SetCursorVisible(true)
+		ed.rl.RedrawNonAtomic()
+		return
+	}
+	self.lp.PrintStyled("reverse", strings.Repeat(" ", int(sz.WidthCells)))
+	self.lp.QueueWriteString("\r")
+	for _, x := range []string{"←→ adjust " + channel_names[ed.channel], "Tab channel", "⏎ enter color", "S save", "Esc discard"} {
+		self.lp.PrintStyled("reverse", " "+x+" ")
+	}
+	self.lp.QueueWriteString("\x1b[m")
+}
+
+// }}}
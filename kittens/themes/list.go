@@ -8,6 +8,8 @@ import (
 	"kitty/tools/themes"
 	"kitty/tools/utils"
 	"kitty/tools/wcswidth"
+
+	"golang.org/x/exp/slices"
 )
 
 var _ = fmt.Print
@@ -73,7 +75,7 @@ func (self *ThemesList) UpdateSearch(query string) bool {
 }
 
 type Line struct {
-	text       string
+	text, name string
 	width      int
 	is_current bool
 }
@@ -86,11 +88,21 @@ func (self *ThemesList) Lines(num_rows int) []Line {
 	before_num := utils.Min(self.current_idx, num_rows-1)
 	start := self.current_idx - before_num
 	for i := start; i < utils.Min(start+num_rows, len(self.display_strings)); i++ {
-		ans = append(ans, Line{self.display_strings[i], self.widths[i], i == self.current_idx})
+		ans = append(ans, Line{self.display_strings[i], self.themes.Names()[i], self.widths[i], i == self.current_idx})
 	}
 	return ans
 }
 
+func (self *ThemesList) SelectTheme(name string) bool {
+	if self.themes != nil {
+		if idx := slices.Index(self.themes.Names(), name); idx > -1 {
+			self.current_idx = idx
+			return true
+		}
+	}
+	return false
+}
+
 func (self *ThemesList) CurrentTheme() *themes.Theme {
 	if self.themes == nil {
 		return nil
@@ -4,8 +4,11 @@ package themes
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
@@ -13,8 +16,10 @@ import (
 
 	"kitty/tools/cli"
 	"kitty/tools/themes"
+	"kitty/tools/tty"
 	"kitty/tools/tui/loop"
 	"kitty/tools/utils"
+	"kitty/tools/utils/humanize"
 )
 
 var _ = fmt.Print
@@ -24,11 +29,14 @@ func complete_themes(completions *cli.Completions, word string, arg_num int) {
 }
 
 func non_interactive(opts *Options, theme_name string) (rc int, err error) {
-	themes, closer, err := themes.LoadThemes(time.Duration(opts.CacheAge * float64(time.Hour*24)))
+	themes, closer, err := themes.LoadThemes(time.Duration(opts.CacheAge*float64(time.Hour*24)), opts.ExtraThemesDir...)
 	if err != nil {
 		return 1, err
 	}
 	defer closer.Close()
+	if sc := themes.StaleCache(); sc != nil {
+		fmt.Fprintln(os.Stderr, sc)
+	}
 	theme := themes.ThemeByName(theme_name)
 	if theme == nil {
 		theme_name = strings.ReplaceAll(theme_name, `\`, ``)
@@ -37,12 +45,26 @@ func non_interactive(opts *Options, theme_name string) (rc int, err error) {
 			return 1, fmt.Errorf("No theme named: %s", theme_name)
 		}
 	}
-	if opts.DumpTheme {
+	return act_on_theme(opts, theme)
+}
+
+func act_on_theme(opts *Options, theme *themes.Theme) (rc int, err error) {
+	if opts.ExportTo != "none" {
+		output, err := theme.Export(opts.ExportTo)
+		if err != nil {
+			return 1, err
+		}
+		fmt.Print(output)
+	} else if opts.DumpTheme {
 		code, err := theme.Code()
 		if err != nil {
 			return 1, err
 		}
 		fmt.Println(code)
+	} else if opts.ThisWindow {
+		if err = apply_to_this_window(theme); err != nil {
+			return 1, err
+		}
 	} else {
 		err = theme.SaveInConf(utils.ConfigDir(), opts.ReloadIn, opts.ConfigFileName)
 		if err != nil {
@@ -52,19 +74,122 @@ func non_interactive(opts *Options, theme_name string) (rc int, err error) {
 	return
 }
 
+// Change the colors of only the kitty window we are running in
+func apply_to_this_window(theme *themes.Theme) error {
+	codes, err := theme.AsEscapeCodes()
+	if err != nil {
+		return err
+	}
+	term, err := tty.OpenControllingTerm()
+	if err != nil {
+		return err
+	}
+	defer term.Close()
+	return term.WriteAllString(codes)
+}
+
+func random_theme(opts *Options) (rc int, err error) {
+	if opts.Dark && opts.Light {
+		return 1, fmt.Errorf("Cannot specify both --dark and --light")
+	}
+	all_themes, closer, err := themes.LoadThemes(time.Duration(opts.CacheAge*float64(time.Hour*24)), opts.ExtraThemesDir...)
+	if err != nil {
+		return 1, err
+	}
+	defer closer.Close()
+	if sc := all_themes.StaleCache(); sc != nil {
+		fmt.Fprintln(os.Stderr, sc)
+	}
+	candidates := all_themes.Filtered(func(t *themes.Theme) bool {
+		return (!opts.Dark || t.IsDark()) && (!opts.Light || !t.IsDark())
+	})
+	if candidates.Len() == 0 {
+		return 1, fmt.Errorf("No themes match the specified filters")
+	}
+	theme := candidates.At(rand.Intn(candidates.Len()))
+	if opts.Apply || opts.DumpTheme || opts.ThisWindow || opts.ExportTo != "none" {
+		return act_on_theme(opts, theme)
+	}
+	fmt.Println(theme.Name())
+	return
+}
+
+func print_cache_info() (rc int, err error) {
+	ci, err := themes.ReadCacheInfo()
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			fmt.Println("There is no locally cached copy of the themes collection")
+			return 0, nil
+		}
+		return 1, err
+	}
+	fmt.Println("Cache file:  ", ci.Path)
+	fmt.Println("Last updated:", ci.LastUpdated.Local().Format(time.RFC1123), "("+humanize.Time(ci.LastUpdated)+")")
+	fmt.Println("Size:        ", humanize.Bytes(uint64(ci.Size)))
+	fmt.Println("Themes:      ", ci.NumThemes)
+	if ci.Etag != "" {
+		fmt.Println("ETag:        ", ci.Etag)
+	}
+	return
+}
+
+func refresh_cache() (rc int, err error) {
+	if _, err = themes.FetchCached(0); err != nil {
+		var sc *themes.StaleCacheError
+		if errors.As(err, &sc) {
+			err = sc.Err
+		}
+		return 1, err
+	}
+	fmt.Println("The themes collection has been updated")
+	return print_cache_info()
+}
+
 func main(_ *cli.Command, opts *Options, args []string) (rc int, err error) {
+	if opts.CacheInfo {
+		return print_cache_info()
+	}
+	if opts.RefreshCache {
+		return refresh_cache()
+	}
+	var image_theme *image_theme_data
+	if opts.FromImage != "" {
+		m, settings, err := themes.SettingsFromImage(opts.FromImage)
+		if err != nil {
+			return 1, err
+		}
+		if opts.DumpTheme {
+			fmt.Print(themes.SettingsAsConf(m.Name, m.Blurb, settings))
+			return 0, nil
+		}
+		image_theme = &image_theme_data{m, settings}
+	}
+	if opts.Random {
+		if len(args) > 0 {
+			return 1, fmt.Errorf("Cannot specify a theme name with --random")
+		}
+		return random_theme(opts)
+	}
 	if len(args) > 1 {
 		args = []string{strings.Join(args, ` `)}
 	}
 	if len(args) == 1 {
 		return non_interactive(opts, args[0])
 	}
+	if opts.ExportTo != "none" {
+		return 1, fmt.Errorf("You must specify the name of the theme to export")
+	}
 	lp, err := loop.New()
 	if err != nil {
 		return 1, err
 	}
 	cv := utils.NewCachedValues("unicode-input", &CachedData{Category: "All"})
-	h := &handler{lp: lp, opts: opts, cached_data: cv.Load()}
+	h := &handler{lp: lp, opts: opts, cached_data: cv.Load(), image_theme: image_theme}
+	if opts.PreviewFile != "" {
+		if h.preview_lines, err = load_preview(opts.PreviewFile); err != nil {
+			return 1, err
+		}
+	}
 	defer cv.Save()
 	lp.OnInitialize = func() (string, error) {
 		lp.AllowLineWrapping(false)
@@ -88,6 +213,12 @@ func main(_ *cli.Command, opts *Options, args []string) (rc int, err error) {
 	if err != nil {
 		return 1, err
 	}
+	if h.apply_to_this_window != nil {
+		// done after the loop has finished as it restores the original colors on exit
+		if err = apply_to_this_window(h.apply_to_this_window); err != nil {
+			return 1, err
+		}
+	}
 	ds := lp.DeathSignalName()
 	if ds != "" {
 		fmt.Println("Killed by signal: ", ds)
@@ -21,6 +21,71 @@
 is not available.
 
 
+--this-window
+type=bool-set
+Instead of changing kitty.conf, apply the theme only to the kitty window the
+kitten is running in, using escape codes. This is useful, for instance, to
+visually distinguish a window connected to a production server. The colors
+last until the window is closed or they are changed by some other program.
+
+
+--from-image
+completion=type:file mime:image/* group:Images
+Generate a theme from the colors of the specified image, such as your desktop
+wallpaper. The generated theme is opened in the theme editor where you can
+preview it, tweak its colors and save it as a named theme. If
+:option:`--dump-theme` is also specified, the generated theme is printed to
+STDOUT instead.
+
+
+--preview-file
+completion=type:file group:Files
+Show the contents of the specified file in the preview pane, instead of the
+builtin sample, so you can see how the themes look with content you actually
+use. Source code is syntax highlighted using the colors of the theme being
+previewed. Files that already contain formatting escape codes, such as a
+captured shell session, are shown as is. Use :code:`-` to read from STDIN.
+
+
+--random
+type=bool-set
+Choose a random theme instead of specifying a theme name. The name of the chosen
+theme is printed, use :option:`--apply` to also change to it. Useful to get a
+new theme every day via cron or a keyboard shortcut, for example::
+
+    map f1 launch --type=background kitten themes --random --dark --apply --reload-in=all
+
+
+--dark
+type=bool-set
+When choosing a random theme, only choose from dark themes.
+
+
+--light
+type=bool-set
+When choosing a random theme, only choose from light themes.
+
+
+--apply
+type=bool-set
+Change to the theme chosen by :option:`--random`, instead of just printing its name.
+
+
+--cache-info
+type=bool-set
+Print information about the locally cached copy of the theme collection, such
+as when it was last updated, and exit. Use :option:`--refresh-cache` to update
+it. Note that if downloading new themes fails, for instance, because there is no
+network connection, the kitten falls back to using the cached copy, regardless
+of its age, indicating how old it is.
+
+
+--refresh-cache
+type=bool-set
+Download the latest version of the theme collection, regardless of the age of
+the locally cached copy, and exit.
+
+
 --reload-in
 default=parent
 choices=none,parent,all
@@ -30,6 +95,24 @@
 kitty instances.
 
 
+--extra-themes-dir
+type=list
+An additional directory to search for user defined themes, in addition to the
+:file:`themes` sub-directory of the kitty config directory. Can be specified
+multiple times. Themes in directories specified later override themes with the
+same name in earlier directories. While the kitten is running interactively,
+changes to theme files in all these directories are detected and loaded
+automatically.
+
+
+--live-preview
+type=bool-set
+Apply the currently highlighted theme to all windows in kitty while browsing,
+not just to the window the kitten is running in. The colors are reverted if
+you quit without modifying the config file. This works using remote control, so
+it requires :opt:`allow_remote_control` to be enabled.
+
+
 --dump-theme
 type=bool-set
 default=false
@@ -37,6 +120,15 @@
 instead of changing kitty.conf.
 
 
+--export-to
+choices=none,alacritty,wezterm,iterm2,windows-terminal
+default=none
+When running non-interactively, instead of changing kitty.conf, output the
+colors of the specified theme to STDOUT in the format used by the specified
+terminal emulator. Colors not set by the theme are output with their kitty
+default values.
+
+
 --config-file-name
 default=kitty.conf
 The name or path to the config file to edit. Relative paths are interpreted
@@ -0,0 +1,145 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package themes
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/style"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/lexers"
+)
+
+var _ = fmt.Print
+
+const MAX_PREVIEW_LINES = 500
+
+// Map token types to the basic terminal colors, so that the preview uses the
+// colors of the theme being previewed. Lookups fall back to the sub-category
+// and then the category of the token type.
+var token_styles = map[chroma.TokenType]string{
+	chroma.Keyword:         "fg=magenta",
+	chroma.KeywordConstant: "fg=yellow",
+	chroma.KeywordType:     "fg=yellow",
+	chroma.Name:            "",
+	chroma.NameBuiltin:     "fg=cyan",
+	chroma.NameClass:       "fg=yellow",
+	chroma.NameDecorator:   "fg=cyan",
+	chroma.NameException:   "fg=red",
+	chroma.NameFunction:    "fg=blue",
+	chroma.NameTag:         "fg=red",
+	chroma.NameAttribute:   "fg=yellow",
+	chroma.NameVariable:    "fg=red",
+	chroma.LiteralString:   "fg=green",
+	chroma.LiteralNumber:   "fg=yellow",
+	chroma.Operator:        "fg=cyan",
+	chroma.Comment:         "fg=bright-black italic",
+	chroma.GenericDeleted:  "fg=red",
+	chroma.GenericInserted: "fg=green",
+	chroma.GenericHeading:  "bold",
+	chroma.GenericPrompt:   "fg=green bold",
+	chroma.GenericError:    "fg=red",
+	chroma.Error:           "fg=red",
+}
+
+func style_for_token(t chroma.TokenType) string {
+	for _, q := range []chroma.TokenType{t, t.SubCategory(), t.Category()} {
+		if s, found := token_styles[q]; found {
+			return s
+		}
+	}
+	return ""
+}
+
+func highlight_preview(name, text string) []string {
+	var lexer chroma.Lexer
+	if name != "" {
+		lexer = lexers.Match(filepath.Base(name))
+	}
+	if lexer == nil {
+		lexer = lexers.Analyse(text)
+	}
+	if lexer == nil {
+		return utils.Splitlines(text)
+	}
+	it, err := chroma.Coalesce(lexer).Tokenise(nil, text)
+	if err != nil {
+		return utils.Splitlines(text)
+	}
+	ctx := style.Context{AllowEscapeCodes: true}
+	lines := []string{}
+	current := strings.Builder{}
+	write := func(spec, text string) {
+		if spec == "" || text == "" {
+			current.WriteString(text)
+		} else {
+			current.WriteString(ctx.SprintFunc(spec)(text))
+		}
+	}
+	for token := it(); token != chroma.EOF; token = it() {
+		spec := style_for_token(token.Type)
+		// format each line of a multiline token independently
+		for text := token.Value; ; {
+			idx := strings.IndexByte(text, '\n')
+			if idx < 0 {
+				write(spec, text)
+				break
+			}
+			write(spec, text[:idx])
+			lines = append(lines, current.String())
+			current.Reset()
+			text = text[idx+1:]
+		}
+	}
+	if current.Len() > 0 {
+		lines = append(lines, current.String())
+	}
+	return lines
+}
+
+// Remove all escape codes other than SGR formatting, so that pre-formatted
+// content, such as a captured shell prompt, cannot mess up the screen
+func sanitize_preformatted(text string) string {
+	return utils.MustCompile(`\x1b(?:\[[0-9;:?<>=]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|.)`).ReplaceAllStringFunc(text, func(x string) string {
+		if len(x) > 2 && x[1] == '[' && x[len(x)-1] == 'm' {
+			return x
+		}
+		return ""
+	})
+}
+
+// Load the content to show in the preview pane from the specified file, or
+// STDIN if path is -. Plain text is syntax highlighted based on the file name
+// or content, while content that already has formatting escape codes is used
+// as is.
+func load_preview(path string) ([]string, error) {
+	var raw []byte
+	var err error
+	if path == "-" {
+		raw, err = io.ReadAll(os.Stdin)
+		path = ""
+	} else {
+		raw, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	text := strings.ReplaceAll(utils.UnsafeBytesToString(raw), "\t", "    ")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	var lines []string
+	if strings.Contains(text, "\x1b") {
+		lines = utils.Splitlines(sanitize_preformatted(text))
+	} else {
+		lines = highlight_preview(path, text)
+	}
+	if len(lines) > MAX_PREVIEW_LINES {
+		lines = lines[:MAX_PREVIEW_LINES]
+	}
+	return lines, nil
+}
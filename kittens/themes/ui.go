@@ -5,6 +5,7 @@ package themes
 import (
 	"fmt"
 	"io"
+	"math/rand"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -12,9 +13,11 @@ import (
 
 	"kitty/tools/config"
 	"kitty/tools/themes"
+	"kitty/tools/tui"
 	"kitty/tools/tui/loop"
 	"kitty/tools/tui/readline"
 	"kitty/tools/utils"
+	"kitty/tools/utils/humanize"
 	"kitty/tools/wcswidth"
 
 	"golang.org/x/exp/maps"
@@ -30,6 +33,8 @@ const (
 	BROWSING
 	SEARCHING
 	ACCEPTING
+	EDITING
+	COMPARING
 )
 const SEPARATOR = "║"
 
@@ -38,6 +43,11 @@ type CachedData struct {
 	Category string   `json:"category"`
 }
 
+type image_theme_data struct {
+	metadata *themes.ThemeMetadata
+	settings map[string]string
+}
+
 type fetch_data struct {
 	themes *themes.Themes
 	err    error
@@ -45,10 +55,15 @@ type fetch_data struct {
 }
 
 var category_filters = map[string]func(*themes.Theme) bool{
-	"all":   func(*themes.Theme) bool { return true },
-	"dark":  func(t *themes.Theme) bool { return t.IsDark() },
-	"light": func(t *themes.Theme) bool { return !t.IsDark() },
-	"user":  func(t *themes.Theme) bool { return t.IsUserDefined() },
+	"all":      func(*themes.Theme) bool { return true },
+	"dark":     func(t *themes.Theme) bool { return t.IsDark() },
+	"light":    func(t *themes.Theme) bool { return !t.IsDark() },
+	"user":     func(t *themes.Theme) bool { return t.IsUserDefined() },
+	"imported": func(t *themes.Theme) bool { return t.IsImported() },
+	"high-contrast": func(t *themes.Theme) bool {
+		r, err := t.ContrastReport()
+		return err == nil && r.IsHighContrast()
+	},
 }
 
 func recent_filter(items []string) func(*themes.Theme) bool {
@@ -70,14 +85,25 @@ type handler struct {
 	themes_list      *ThemesList
 	category_filters map[string]func(*themes.Theme) bool
 	colors_set_once  bool
+	live_previewing  bool
 	tabs             []string
 	rl               *readline.Readline
+	editor           *theme_editor
+	themes_signature string
+	// a theme generated from an image, to be opened in the editor on startup
+	image_theme *image_theme_data
+	// user supplied content for the preview pane
+	preview_lines []string
+	// names of the themes marked for comparison
+	marked []string
+	// the theme to apply to the current window only, after the kitten exits
+	apply_to_this_window *themes.Theme
 }
 
 // fetching {{{
 func (self *handler) fetch_themes() {
 	r := fetch_data{}
-	r.themes, r.closer, r.err = themes.LoadThemes(time.Duration(self.opts.CacheAge * float64(time.Hour*24)))
+	r.themes, r.closer, r.err = themes.LoadThemes(time.Duration(self.opts.CacheAge*float64(time.Hour*24)), self.opts.ExtraThemesDir...)
 	self.lp.WakeupMainThread()
 	self.fetch_result <- r
 }
@@ -92,16 +118,65 @@ func (self *handler) on_fetching_key_event(ev *loop.KeyEvent) error {
 
 func (self *handler) on_wakeup() error {
 	r := <-self.fetch_result
+	if self.state != FETCHING {
+		return self.on_themes_reloaded(r)
+	}
 	if r.err != nil {
 		return r.err
 	}
 	self.state = BROWSING
 	self.all_themes = r.themes
 	self.themes_closer = r.closer
+	self.themes_signature = themes.UserThemesSignature(themes.UserThemeDirs(self.opts.ExtraThemesDir...)...)
+	if _, err := self.lp.AddTimer(2*time.Second, true, self.check_for_changed_themes); err != nil {
+		return err
+	}
+	if self.image_theme != nil {
+		t := self.all_themes.AddFromSettings(self.image_theme.metadata, self.image_theme.settings)
+		self.set_current_category("user")
+		self.themes_list.UpdateThemes(self.all_themes.Filtered(self.category_filters[self.current_category()]))
+		self.themes_list.SelectTheme(t.Name())
+		self.start_editing()
+		return nil
+	}
 	self.redraw_after_category_change()
 	return nil
 }
 
+func (self *handler) check_for_changed_themes(loop.IdType) error {
+	if self.state != BROWSING && self.state != SEARCHING {
+		return nil
+	}
+	sig := themes.UserThemesSignature(themes.UserThemeDirs(self.opts.ExtraThemesDir...)...)
+	if sig != self.themes_signature {
+		self.themes_signature = sig
+		go self.fetch_themes()
+	}
+	return nil
+}
+
+func (self *handler) on_themes_reloaded(r fetch_data) error {
+	if r.err != nil {
+		// keep using the previously loaded themes
+		return nil
+	}
+	if self.themes_closer != nil {
+		self.themes_closer.Close()
+	}
+	self.all_themes, self.themes_closer = r.themes, r.closer
+	current := ""
+	if t := self.themes_list.CurrentTheme(); t != nil {
+		current = t.Name()
+	}
+	self.themes_list.UpdateThemes(self.all_themes.Filtered(self.category_filters[self.current_category()]))
+	self.themes_list.SelectTheme(current)
+	if self.state == BROWSING || self.state == SEARCHING {
+		self.set_colors_to_current_theme()
+		self.draw_screen()
+	}
+	return nil
+}
+
 func (self *handler) draw_fetching_screen() {
 	self.lp.Println("Downloading themes from repository, please wait...")
 }
@@ -109,6 +184,7 @@ func (self *handler) draw_fetching_screen() {
 // }}}
 
 func (self *handler) finalize() {
+	self.revert_live_preview()
 	t := self.themes_closer
 	if t != nil {
 		t.Close()
@@ -117,7 +193,7 @@ func (self *handler) finalize() {
 }
 
 func (self *handler) initialize() {
-	self.tabs = strings.Split("all dark light recent user", " ")
+	self.tabs = strings.Split("all dark light recent user imported high-contrast", " ")
 	self.rl = readline.New(self.lp, readline.RlInit{DontMarkPrompts: true, Prompt: "/"})
 	self.themes_list = &ThemesList{}
 	self.fetch_result = make(chan fetch_data)
@@ -144,6 +220,10 @@ func (self *handler) draw_screen() {
 		self.draw_browsing_screen()
 	case ACCEPTING:
 		self.draw_accepting_screen()
+	case EDITING:
+		self.draw_editing_screen()
+	case COMPARING:
+		self.draw_comparing_screen()
 	}
 }
 
@@ -186,14 +266,55 @@ func (self *handler) set_colors_to_current_theme() bool {
 			raw, err := t.AsEscapeCodes()
 			if err == nil {
 				self.lp.QueueWriteString(raw)
+				self.live_preview(t)
 				return true
 			}
 		}
 	}
 	self.lp.QueueWriteString(themes.ColorSettingsAsEscapeCodes(ReadKittyColorSettings()))
+	self.revert_live_preview()
+	return true
+}
+
+func (self *handler) send_rc_command(cmd string, payload any) bool {
+	raw, err := tui.RemoteControlEscapeCode(cmd, payload)
+	if err != nil {
+		return false
+	}
+	self.lp.QueueWriteString(raw)
 	return true
 }
 
+type set_colors_payload struct {
+	Colors     map[string]any `json:"colors"`
+	All        bool           `json:"all,omitempty"`
+	Configured bool           `json:"configured,omitempty"`
+	Reset      bool           `json:"reset,omitempty"`
+}
+
+// Apply the theme to all kitty windows, first resetting colors so that
+// no settings from the previously previewed theme linger
+func (self *handler) live_preview(t *themes.Theme) {
+	if !self.opts.LivePreview {
+		return
+	}
+	if colors, err := t.AsRCColors(); err == nil {
+		self.live_preview_colors(colors)
+	}
+}
+
+func (self *handler) live_preview_colors(colors map[string]any) {
+	self.send_rc_command("set-colors", set_colors_payload{Colors: map[string]any{}, All: true, Configured: true, Reset: true})
+	self.live_previewing = self.send_rc_command("set-colors", set_colors_payload{Colors: colors, All: true})
+}
+
+func (self *handler) revert_live_preview() {
+	if self.live_previewing {
+		self.send_rc_command("set-colors", set_colors_payload{Colors: map[string]any{}, All: true, Configured: true, Reset: true})
+		self.live_previewing = false
+	}
+}
+
 func (self *handler) redraw_after_category_change() {
 	self.themes_list.UpdateThemes(self.all_themes.Filtered(self.category_filters[self.current_category()]))
 	self.set_colors_to_current_theme()
@@ -210,6 +331,10 @@ func (self *handler) on_key_event(ev *loop.KeyEvent) error {
 		return self.on_searching_key_event(ev)
 	case ACCEPTING:
 		return self.on_accepting_key_event(ev)
+	case EDITING:
+		return self.on_editing_key_event(ev)
+	case COMPARING:
+		return self.on_comparing_key_event(ev)
 	}
 	return nil
 }
@@ -288,6 +413,31 @@ func (self *handler) on_browsing_key_event(ev *loop.KeyEvent) error {
 		self.start_search()
 		return nil
 	}
+	if ev.MatchesPressOrRepeat("e") {
+		ev.Handled = true
+		self.start_editing()
+		return nil
+	}
+	if ev.MatchesPressOrRepeat("m") {
+		ev.Handled = true
+		self.toggle_mark()
+		return nil
+	}
+	if ev.MatchesPressOrRepeat("v") {
+		ev.Handled = true
+		self.start_comparing()
+		return nil
+	}
+	if ev.MatchesPressOrRepeat("shift+r") {
+		ev.Handled = true
+		if n := self.themes_list.Len(); n > 1 {
+			// jump to a random theme other than the current one
+			self.next(1+rand.Intn(n-1), true)
+		} else {
+			self.lp.Beep()
+		}
+		return nil
+	}
 	if ev.MatchesPressOrRepeat("c") || ev.MatchesPressOrRepeat("enter") {
 		ev.Handled = true
 		if self.themes_list == nil || self.themes_list.Len() == 0 {
@@ -322,7 +472,11 @@ func (self *handler) draw_browsing_screen() {
 			self.lp.PrintStyled("fg=green", ">")
 			self.lp.PrintStyled("fg=green bold", line)
 		} else {
-			self.lp.PrintStyled("fg=green", " ")
+			if slices.Contains(self.marked, l.name) {
+				self.lp.PrintStyled("fg=yellow", "*")
+			} else {
+				self.lp.PrintStyled("fg=green", " ")
+			}
 			self.lp.QueueWriteString(line)
 		}
 		self.lp.MoveCursorHorizontally(mw - l.width)
@@ -352,7 +506,21 @@ func (self *handler) draw_bottom_bar() {
 		self.lp.PrintStyled("reverse", " "+text+" ")
 	}
 	draw_tab("search (/)", "s")
+	draw_tab("edit", "e")
+	draw_tab("random (R)", "R")
+	draw_tab("mark", "m")
+	if len(self.marked) > 0 {
+		draw_tab("compare (v)", "v")
+	}
 	draw_tab("accept (⏎)", "c")
+	if sc := self.all_themes.StaleCache(); sc != nil {
+		// indicate that the themes could not be updated
+		text := "Offline, themes from " + humanize.Time(sc.LastUpdated) + " "
+		if x := int(sz.WidthCells) - wcswidth.Stringwidth(text); x > 40 {
+			self.lp.MoveCursorTo(x+1, int(sz.HeightCells))
+			self.lp.PrintStyled("reverse fg=red", text)
+		}
+	}
 	self.lp.QueueWriteString("\x1b[m")
 }
 
@@ -480,12 +648,44 @@ func (self *handler) draw_theme_demo() {
 		write_para(theme.Blurb())
 		next_line()
 	}
+	if report, err := theme.ContrastReport(); err == nil {
+		self.draw_contrast_summary(report, sz)
+		next_line()
+		next_line()
+	}
+	if self.preview_lines != nil {
+		for _, line := range self.preview_lines {
+			if y >= int(ssz.HeightCells)-2 {
+				break
+			}
+			line, _ = wcswidth.TruncateToVisualLengthWithWidth(line, sz)
+			self.lp.QueueWriteString(line + "\x1b[m")
+			next_line()
+		}
+		return
+	}
 	write_colors("")
 	for _, bg := range colors {
 		write_colors(bg)
 	}
 }
 
+func (self *handler) draw_contrast_summary(report themes.ContrastReport, width int) {
+	verdict := func(pass bool) string {
+		if pass {
+			return self.lp.SprintStyled("fg=green", "pass")
+		}
+		return self.lp.SprintStyled("fg=yellow", "warn")
+	}
+	low := report.Low(themes.CONTRAST_AA_LARGE)
+	prefix := fmt.Sprintf("Contrast: %.1f:1 %s ", report.Foreground, themes.ContrastLevel(report.Foreground))
+	self.lp.QueueWriteString(prefix + verdict(report.Foreground >= themes.CONTRAST_AA) + "  Palette: " + verdict(len(low) == 0))
+	if len(low) > 0 {
+		details, _ := wcswidth.TruncateToVisualLengthWithWidth(" low: "+strings.Join(low, " "), utils.Max(0, width-wcswidth.Stringwidth(prefix)-19))
+		self.lp.QueueWriteString(details)
+	}
+}
+
 // }}}
 
 // accepting {{{
@@ -504,14 +704,39 @@ func (self *handler) on_accepting_key_event(ev *loop.KeyEvent) error {
 	}
 	if ev.MatchesPressOrRepeat("p") || ev.MatchesPressOrRepeat("shift+p") {
 		ev.Handled = true
-		self.themes_list.CurrentTheme().SaveInDir(utils.ConfigDir())
+		if err := self.themes_list.CurrentTheme().SaveInDir(utils.ConfigDir()); err != nil {
+			return fmt.Errorf("Failed to save the theme with error: %w", err)
+		}
+		self.update_recent()
+		self.lp.Quit(0)
+		return nil
+	}
+	for _, cs := range []string{"dark", "light", "no-preference"} {
+		if ev.MatchesPressOrRepeat(cs[:1]) || ev.MatchesPressOrRepeat("shift+"+cs[:1]) {
+			ev.Handled = true
+			if err := self.themes_list.CurrentTheme().SaveAsAutoTheme(utils.ConfigDir(), cs, self.opts.ReloadIn); err != nil {
+				return fmt.Errorf("Failed to save the theme for the %s color scheme with error: %w", cs, err)
+			}
+			self.live_previewing = false
+			self.update_recent()
+			self.lp.Quit(0)
+			return nil
+		}
+	}
+	if ev.MatchesPressOrRepeat("w") || ev.MatchesPressOrRepeat("shift+w") {
+		ev.Handled = true
+		self.apply_to_this_window = self.themes_list.CurrentTheme()
 		self.update_recent()
 		self.lp.Quit(0)
 		return nil
 	}
 	if ev.MatchesPressOrRepeat("m") || ev.MatchesPressOrRepeat("shift+m") {
 		ev.Handled = true
-		self.themes_list.CurrentTheme().SaveInConf(utils.ConfigDir(), self.opts.ReloadIn, self.opts.ConfigFileName)
+		if err := self.themes_list.CurrentTheme().SaveInConf(utils.ConfigDir(), self.opts.ReloadIn, self.opts.ConfigFileName); err != nil {
+			return fmt.Errorf("Failed to modify kitty.conf with error: %w", err)
+		}
+		// the config has been changed so the colors must not be reverted on exit
+		self.live_previewing = false
 		self.update_recent()
 		self.lp.Quit(0)
 		return nil
@@ -553,6 +778,12 @@ func (self *handler) draw_accepting_screen() {
 	self.lp.Printf(` %slace the theme file in %s but do not modify %s`, ac("P"), utils.ConfigDir(), kc)
 	self.lp.Println()
 	self.lp.Println()
+	self.lp.Printf(` Apply the theme to this %sindow only, without changing any config`, ac("W"))
+	self.lp.Println()
+	self.lp.Println()
+	self.lp.Printf(` Use as the theme when the OS is in: %sark mode, %sight mode or has %so preference`, ac("D"), ac("L"), ac("N"))
+	self.lp.Println()
+	self.lp.Println()
 	self.lp.Printf(` %sbort and return to list of themes`, ac("A"))
 	self.lp.Println()
 	self.lp.Println()
@@ -581,6 +812,12 @@ func (self *handler) on_text(text string, a, b bool) error {
 			return err
 		}
 		self.update_search()
+	} else if self.state == EDITING && self.editor.input != NO_INPUT {
+		err := self.editor.rl.OnText(text, a, b)
+		if err != nil {
+			return err
+		}
+		self.draw_screen()
 	}
 	return nil
 }
@@ -25,6 +25,7 @@ typedef bool(*update_hash_t)(void*, const void *input, size_t length);
 typedef void(*digest_hash_t)(const void*, void *output);
 typedef uint64_t(*digest_hash64_t)(const void*);
 typedef uint64_t(*oneshot_hash64_t)(const void*, size_t);
+typedef void(*oneshot_hash_t)(const void*, size_t, void *output);
 
 typedef struct hasher_t {
     size_t hash_size, block_size;
@@ -36,6 +37,7 @@ typedef struct hasher_t {
     digest_hash_t digest;
     digest_hash64_t digest64;
     oneshot_hash64_t oneshot64;
+    oneshot_hash_t oneshot;
 } hasher_t;
 
 static void xxh64_delete(void* s) { XXH3_freeState(s); }
@@ -44,6 +46,8 @@ static void* xxh64_create(void) { void *ans = XXH3_createState(); if (ans != NUL
 static bool xxh64_update(void* s, const void *input, size_t length) { return XXH3_64bits_update(s, input, length) == XXH_OK; }
 static uint64_t xxh64_digest64(const void* s) { return XXH3_64bits_digest(s); }
 static uint64_t xxh64_oneshot64(const void* s, size_t len) { return XXH3_64bits(s, len); }
+// the 64 bit strong hash of blocks is serialized in little endian byte order
+static void xxh64_oneshot(const void* s, size_t len, void *output) { le64enc(output, XXH3_64bits(s, len)); }
 static void xxh64_digest(const void* s, void *output) {
     XXH64_hash_t ans = XXH3_64bits_digest(s);
     XXH64_canonical_t c;
@@ -56,7 +60,7 @@ xxh64_hasher(void) {
     hasher_t ans = {
         .hash_size=sizeof(XXH64_hash_t), .block_size = 64,
         .new=xxh64_create, .delete=xxh64_delete, .reset=xxh64_reset, .update=xxh64_update, .digest=xxh64_digest,
-        .digest64=xxh64_digest64, .oneshot64=xxh64_oneshot64
+        .digest64=xxh64_digest64, .oneshot64=xxh64_oneshot64, .oneshot=xxh64_oneshot
     };
     return ans;
 }
@@ -70,12 +74,19 @@ static void xxh128_digest(const void* s, void *output) {
     XXH128_canonicalFromHash(&c, ans);
     memcpy(output, c.digest, sizeof(c.digest));
 }
+static void xxh128_oneshot(const void* s, size_t len, void *output) {
+    XXH128_hash_t ans = XXH3_128bits(s, len);
+    XXH128_canonical_t c;
+    XXH128_canonicalFromHash(&c, ans);
+    memcpy(output, c.digest, sizeof(c.digest));
+}
 
 static hasher_t
 xxh128_hasher(void) {
     hasher_t ans = {
         .hash_size=sizeof(XXH128_hash_t), .block_size = 64,
         .new=xxh128_create, .delete=xxh64_delete, .reset=xxh128_reset, .update=xxh128_update, .digest=xxh128_digest,
+        .oneshot=xxh128_oneshot,
     };
     return ans;
 }
@@ -104,6 +115,7 @@ init_rsync(Rsync *ans, size_t block_size, int strong_hash_type, int checksum_typ
     memset(ans, 0, sizeof(*ans));
     ans->block_size = block_size;
     if (strong_hash_type == 0) ans->hasher_constructor = xxh64_hasher;
+    else if (strong_hash_type == 1) ans->hasher_constructor = xxh128_hasher;
     if (checksum_type == 0) ans->checksummer_constructor = xxh128_hasher;
     if (ans->hasher_constructor == NULL) { free_rsync(ans); return "Unknown strong hash type"; }
     if (ans->checksummer_constructor == NULL) { free_rsync(ans); return "Unknown checksum type"; }
@@ -431,7 +443,8 @@ PyTypeObject Patcher_Type = {
 // }}} Patcher
 
 // Differ {{{
-typedef struct Signature { uint64_t index, strong_hash; } Signature;
+#define MAX_STRONG_HASH_SIZE 16
+typedef struct Signature { uint64_t index; uint8_t strong_hash[MAX_STRONG_HASH_SIZE]; } Signature;
 
 typedef struct SignatureMap {
     int weak_hash;
@@ -496,13 +509,16 @@ parse_signature_header(Differ *self) {
     if ((x = le16dec(p)) != 0) {
         PyErr_Format(RsyncError, "Invalid checksum type in signature header: %u", x); return;
     } p += 2;
-    if ((x = le16dec(p)) != 0) {
-        PyErr_Format(RsyncError, "Invalid strong hash type in signature header: %u", x); return;
+    // strong hash types: 0 is xxh3-64 and 1 is xxh3-128
+    const uint32_t strong_hash_type = le16dec(p);
+    if (strong_hash_type > 1) {
+        PyErr_Format(RsyncError, "Invalid strong hash type in signature header: %u", strong_hash_type); return;
     } p += 2;
     if ((x = le16dec(p)) != 0) {
         PyErr_Format(RsyncError, "Invalid weak hash type in signature header: %u", x); return;
     } p += 2;
-    const char *err = init_rsync(&self->rsync, le32dec(p), 0, 0);
+    free_rsync(&self->rsync);
+    const char *err = init_rsync(&self->rsync, le32dec(p), strong_hash_type, 0);
     if (err != NULL) { PyErr_SetString(RsyncError, err); return; }
     p += 4;
     shift_left(&self->buf, p - self->buf.data);
@@ -523,21 +539,23 @@ add_collision(SignatureMap *sm, Signature s) {
 
 static size_t
 parse_signature_block(Differ *self, uint8_t *data, size_t len) {
-    if (len < 20) return 0;
+    const size_t hash_size = self->rsync.hasher.hash_size, block_size = 12 + hash_size;
+    if (len < block_size) return 0;
     int weak_hash = le32dec(data + 8);
+    Signature sig = {.index=le64dec(data)};
+    memcpy(sig.strong_hash, data + 12, hash_size);
     SignatureMap *sm = NULL;
     HASH_FIND_INT(self->signature_map, &weak_hash, sm);
     if (sm == NULL) {
         sm = calloc(1, sizeof(SignatureMap));
         if (sm == NULL) { PyErr_NoMemory(); return 0; }
         sm->weak_hash = weak_hash;
-        sm->sig.index = le64dec(data);
-        sm->sig.strong_hash = le64dec(data+12);
+        sm->sig = sig;
         HASH_ADD_INT(self->signature_map, weak_hash, sm);
     } else {
-        if (!add_collision(sm, (Signature){.index=le64dec(data), .strong_hash=le64dec(data+12)})) return 0;
+        if (!add_collision(sm, sig)) return 0;
     }
-    return 20;
+    return block_size;
 }
 
 static PyObject*
@@ -659,10 +677,10 @@ ensure_idx_valid(Differ *self, size_t idx) {
 }
 
 static bool
-find_strong_hash(SignatureMap *sm, uint64_t q, uint64_t *block_index) {
-    if (sm->sig.strong_hash == q) { *block_index = sm->sig.index; return true; }
+find_strong_hash(SignatureMap *sm, const uint8_t *q, size_t hash_size, uint64_t *block_index) {
+    if (memcmp(sm->sig.strong_hash, q, hash_size) == 0) { *block_index = sm->sig.index; return true; }
     for (size_t i = 0; i < sm->len; i++) {
-        if (sm->weak_hash_collisions[i].strong_hash == q) { *block_index = sm->weak_hash_collisions[i].index; return true; }
+        if (memcmp(sm->weak_hash_collisions[i].strong_hash, q, hash_size) == 0) { *block_index = sm->weak_hash_collisions[i].index; return true; }
     }
     return false;
 }
@@ -737,8 +755,10 @@ read_next(Differ *self) {
     SignatureMap *sm = NULL;
     int weak_hash = self->rc.val;
     uint64_t block_index = 0;
+    uint8_t strong_hash[MAX_STRONG_HASH_SIZE];
     HASH_FIND_INT(self->signature_map, &weak_hash, sm);
-    if (sm != NULL && find_strong_hash(sm, self->rsync.hasher.oneshot64(self->buf.data + self->window.pos, self->window.sz), &block_index)) {
+    if (sm != NULL) self->rsync.hasher.oneshot(self->buf.data + self->window.pos, self->window.sz, strong_hash);
+    if (sm != NULL && find_strong_hash(sm, strong_hash, self->rsync.hasher.hash_size, &block_index)) {
         if (!send_data(self)) return false;
         if (!enqueue(self, (Operation){.type=OpBlock, .block_index=block_index})) return false;
 		self->window.pos += self->window.sz;
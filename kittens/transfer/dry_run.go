@@ -0,0 +1,200 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"kitty/tools/cli/markup"
+	"kitty/tools/utils"
+	"kitty/tools/utils/humanize"
+)
+
+var _ = fmt.Print
+
+// With --dry-run, permission for the transfer is requested and the files to be
+// transferred are found as usual, but instead of being transferred, a report of
+// the changes the transfer would make on the receiving computer is printed and
+// nothing is written. When receiving, the report is made by comparing the
+// metadata sent by the terminal to the files on this computer. When sending,
+// the terminal is instead asked for the metadata of the destinations of the
+// files with a receive command, which modifies nothing. How much data is sent
+// to update a file with the rsync algorithm depends on how much of it has
+// changed, which is not known without reading both files, so it is reported as
+// a range, from the growth in the size of the file, if any, to its full size.
+
+type dry_run_action int
+
+const (
+	dry_run_create dry_run_action = iota
+	dry_run_update
+	dry_run_unchanged
+	dry_run_delete
+)
+
+type dry_run_entry struct {
+	action              dry_run_action
+	ftype               FileType
+	path                string
+	size, existing_size int64
+	rsync               bool
+}
+
+// The range of the number of bytes of file data that would be sent
+func (self *dry_run_entry) transfer_size() (lo, hi int64) {
+	if self.ftype != FileType_regular || self.action == dry_run_unchanged || self.action == dry_run_delete {
+		return 0, 0
+	}
+	if self.action == dry_run_update && self.rsync {
+		return utils.Max(0, self.size-self.existing_size), self.size
+	}
+	return self.size, self.size
+}
+
+type dry_run_report struct {
+	entries []*dry_run_entry
+}
+
+func (self *dry_run_report) add(action dry_run_action, ftype FileType, path string, size, existing_size int64, rsync bool) {
+	self.entries = append(self.entries, &dry_run_entry{action: action, ftype: ftype, path: path, size: size, existing_size: existing_size, rsync: rsync})
+}
+
+func format_transfer_size(lo, hi int64) string {
+	if lo == hi {
+		return humanize.Size(hi)
+	}
+	return humanize.Size(lo) + " to " + humanize.Size(hi)
+}
+
+func (self *dry_run_report) print(w io.Writer, ctx *markup.Context) {
+	fmt.Fprintln(w, "Dry run, nothing was transferred. The transfer would make the following changes:")
+	counts := make(map[dry_run_action]int, 4)
+	var total_lo, total_hi int64
+	for _, e := range self.entries {
+		counts[e.action]++
+		lo, hi := e.transfer_size()
+		total_lo += lo
+		total_hi += hi
+		ftype := ctx.Prettify(fmt.Sprintf(":%s:`%s`", e.ftype.Color(), e.ftype.ShortText()))
+		switch e.action {
+		case dry_run_create:
+			if e.ftype == FileType_regular {
+				fmt.Fprintln(w, " ", ctx.Green("create"), ftype, e.path, fmt.Sprintf("(%s)", humanize.Size(e.size)))
+			} else {
+				fmt.Fprintln(w, " ", ctx.Green("create"), ftype, e.path)
+			}
+		case dry_run_update:
+			if e.ftype == FileType_regular {
+				fmt.Fprintln(w, " ", ctx.Yellow("update"), ftype, e.path, fmt.Sprintf("(sending %s)", format_transfer_size(lo, hi)))
+			} else {
+				fmt.Fprintln(w, " ", ctx.Yellow("update"), ftype, e.path)
+			}
+		case dry_run_delete:
+			fmt.Fprintln(w, " ", ctx.BrightRed("delete"), e.path)
+		}
+	}
+	fmt.Fprintf(w, "Creating %d, updating %d and deleting %d file(s), %d file(s) are unchanged, sending %s of data\n",
+		counts[dry_run_create], counts[dry_run_update], counts[dry_run_delete], counts[dry_run_unchanged], format_transfer_size(total_lo, total_hi))
+}
+
+// The changes receiving the files collected by the manager would make
+func receive_dry_run_report(m *manager) *dry_run_report {
+	ans := &dry_run_report{}
+	for _, f := range m.files {
+		s, err := os.Lstat(f.expanded_local_path)
+		switch {
+		case err != nil:
+			ans.add(dry_run_create, f.ftype, f.expanded_local_path, f.expected_size, 0, false)
+		case f.already_transferred || (f.ftype == FileType_directory && s.IsDir()):
+			ans.add(dry_run_unchanged, f.ftype, f.expanded_local_path, f.expected_size, s.Size(), false)
+		default:
+			// see request_files() for when the rsync algorithm is used
+			rsync := m.use_rsync && f.ftype == FileType_regular && s.Mode().IsRegular() && s.Size() > 4096
+			ans.add(dry_run_update, f.ftype, f.expanded_local_path, f.expected_size, s.Size(), rsync)
+		}
+	}
+	for _, path := range m.files_to_delete {
+		ans.add(dry_run_delete, FileType_regular, path, 0, 0, false)
+	}
+	return ans
+}
+
+// The paths for which to ask the terminal for metadata to find the
+// destinations of the files being sent, which are the remote paths of the top
+// level files, and the index of the path for each file
+func destination_specs(files []*File) (specs []string, spec_ids []int) {
+	spec_ids = make([]int, len(files))
+	spec_for_path := make(map[string]int, len(files))
+	for i, f := range files {
+		// files are ordered with directories before their contents
+		spec_id, found := spec_for_path[path.Dir(f.remote_path)]
+		if !found {
+			spec_id = len(specs)
+			specs = append(specs, f.remote_path)
+		}
+		spec_ids[i] = spec_id
+		spec_for_path[f.remote_path] = spec_id
+	}
+	return
+}
+
+// The changes sending files would make, given the metadata of their
+// destinations received from the terminal by the manager
+func send_dry_run_report(m *manager, files []*File, spec_ids []int, use_rsync bool) (*dry_run_report, error) {
+	for spec_id, msg := range m.failed_specs {
+		if !strings.HasPrefix(msg, `ENOENT:`) {
+			return nil, fmt.Errorf("Failed to read the destination %s with error: %s", m.spec[spec_id], msg)
+		}
+	}
+	// the terminal resolves the top level paths, the names of the files in
+	// directories are relative to them
+	spec_roots := make(map[int]string, len(m.spec))
+	existing := make(map[string]*remote_file, len(m.files))
+	for _, rf := range m.files {
+		if rf.parent == "" {
+			spec_roots[rf.spec_id] = rf.remote_path
+		}
+		existing[rf.remote_path] = rf
+	}
+	ans := &dry_run_report{}
+	for i, f := range files {
+		spec_id := spec_ids[i]
+		dest := f.remote_path
+		var rf *remote_file
+		if root, found := spec_roots[spec_id]; found {
+			dest = root + strings.TrimPrefix(f.remote_path, m.spec[spec_id])
+			rf = existing[dest]
+		}
+		switch {
+		case rf == nil:
+			ans.add(dry_run_create, f.file_type, dest, f.file_size, 0, false)
+		case f.file_type == FileType_directory && rf.ftype == FileType_directory:
+			ans.add(dry_run_unchanged, f.file_type, dest, f.file_size, rf.expected_size, false)
+		default:
+			// see metadata_command() for when the rsync algorithm is used
+			rsync := use_rsync && f.rsync_capable && rf.ftype == FileType_regular
+			ans.add(dry_run_update, f.file_type, dest, f.file_size, rf.expected_size, rsync)
+		}
+	}
+	return ans, nil
+}
+
+// The files being sent, when the terminal is only asked for the metadata of
+// their destinations
+type destination_query struct {
+	files    []*File
+	spec_ids []int
+}
+
+func (self *destination_query) report(m *manager, opts *Options) (*dry_run_report, error) {
+	return send_dry_run_report(m, self.files, self.spec_ids, opts.TransmitDeltas || opts.Resume)
+}
+
+func send_dry_run(opts *Options, files []*File) (err error, rc int) {
+	specs, spec_ids := destination_specs(files)
+	return receive_loop(opts, specs, "", nil, nil, &destination_query{files: files, spec_ids: spec_ids})
+}
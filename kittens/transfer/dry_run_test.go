@@ -0,0 +1,83 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kitty/tools/cli/markup"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestDryRun(t *testing.T) {
+	summary := func(r *dry_run_report) (ans []string) {
+		for _, e := range r.entries {
+			lo, hi := e.transfer_size()
+			ans = append(ans, fmt.Sprintf("%d:%s:%d-%d", e.action, filepath.Base(e.path), lo, hi))
+		}
+		return
+	}
+
+	// receiving
+	tdir := t.TempDir()
+	os.WriteFile(filepath.Join(tdir, "small"), []byte("small"), 0o600)
+	os.WriteFile(filepath.Join(tdir, "big"), make([]byte, 6000), 0o600)
+	os.Mkdir(filepath.Join(tdir, "d"), 0o700)
+	m := manager{use_rsync: true, files: []*remote_file{
+		{ftype: FileType_directory, expanded_local_path: filepath.Join(tdir, "d")},
+		{ftype: FileType_regular, expanded_local_path: filepath.Join(tdir, "new"), expected_size: 10},
+		{ftype: FileType_regular, expanded_local_path: filepath.Join(tdir, "small"), expected_size: 10},
+		{ftype: FileType_regular, expanded_local_path: filepath.Join(tdir, "big"), expected_size: 10000},
+		{ftype: FileType_regular, expanded_local_path: filepath.Join(tdir, "big"), expected_size: 10000, already_transferred: true},
+	}, files_to_delete: []string{filepath.Join(tdir, "extra")}}
+	r := receive_dry_run_report(&m)
+	expected := []string{"2:d:0-0", "0:new:10-10", "1:small:10-10", "1:big:4000-10000", "2:big:0-0", "3:extra:0-0"}
+	if diff := cmp.Diff(expected, summary(r)); diff != "" {
+		t.Fatalf("Incorrect report for receiving:\n%s", diff)
+	}
+	var b bytes.Buffer
+	r.print(&b, markup.New(false))
+	if !strings.Contains(b.String(), "Creating 1, updating 2 and deleting 1 file(s), 2 file(s) are unchanged, sending 4.0 kB to 10 kB of data") {
+		t.Fatalf("Incorrect printed report:\n%s", b.String())
+	}
+
+	// sending
+	files := []*File{
+		{file_type: FileType_directory, remote_path: "dest/d"},
+		{file_type: FileType_regular, remote_path: "dest/d/a", file_size: 10},
+		{file_type: FileType_regular, remote_path: "dest/d/b", file_size: 10000, rsync_capable: true},
+		{file_type: FileType_regular, remote_path: "~/other", file_size: 20},
+		{file_type: FileType_regular, remote_path: "/missing", file_size: 30},
+	}
+	specs, spec_ids := destination_specs(files)
+	if diff := cmp.Diff([]string{"dest/d", "~/other", "/missing"}, specs); diff != "" {
+		t.Fatalf("Incorrect destination specs:\n%s", diff)
+	}
+	if diff := cmp.Diff([]int{0, 0, 0, 1, 2}, spec_ids); diff != "" {
+		t.Fatalf("Incorrect spec ids:\n%s", diff)
+	}
+	m = manager{spec: specs, failed_specs: map[int]string{2: "ENOENT: no such file"}, files: []*remote_file{
+		{ftype: FileType_directory, remote_path: "/home/dest/d", spec_id: 0},
+		{ftype: FileType_regular, remote_path: "/home/dest/d/b", spec_id: 0, parent: "0", expected_size: 4000},
+		{ftype: FileType_regular, remote_path: "/home/other", spec_id: 1, expected_size: 20},
+	}}
+	if r, err := send_dry_run_report(&m, files, spec_ids, true); err != nil {
+		t.Fatal(err)
+	} else if diff := cmp.Diff([]string{"2:d:0-0", "0:a:10-10", "1:b:6000-10000", "1:other:20-20", "0:missing:30-30"}, summary(r)); diff != "" {
+		t.Fatalf("Incorrect report for sending:\n%s", diff)
+	} else if r.entries[1].path != "/home/dest/d/a" {
+		t.Fatalf("Incorrect destination path: %s", r.entries[1].path)
+	}
+	m.failed_specs[2] = "EPERM: permission denied"
+	if _, err := send_dry_run_report(&m, files, spec_ids, true); err == nil {
+		t.Fatalf("Failure to read a destination did not fail the dry run")
+	}
+}
@@ -0,0 +1,170 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"os"
+
+	"kitty/tools/crypto"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// With --encrypt, the data of the files being transferred is encrypted end to
+// end, so that it stays confidential even if it is relayed through programs
+// that can see it, such as terminal multiplexers or logging proxies. This
+// kitten creates a new X25519 key pair for each transfer and sends its public
+// key to the terminal in the send or receive command. The terminal and this
+// kitten then both derive the same AES-256 key from their private key and the
+// public key of the other, the public key of the terminal being read from the
+// KITTY_PUBLIC_KEY environment variable. The data of every data and end_data
+// command, in both directions, is encrypted with AES-256-GCM as the random
+// 12 byte nonce followed by the ciphertext and 16 byte authentication tag,
+// even when it is empty. The direction, the file id, the sequence number of
+// the data in the file and whether it is the end of the file are
+// authenticated along with it, so that data cannot be reordered, replayed,
+// moved to another file or truncated without detection. The terminal
+// acknowledges that it will encrypt the transfer by sending back its public
+// key when granting permission, along with the public key of this kitten
+// encrypted with the derived key, which proves that the public key was not
+// replaced on its way to the terminal. This is not the age format, which is
+// designed for encrypting files at rest by a sender that knows the public
+// key of the recipient, rather than a stream of chunks with a key agreed by
+// both ends, instead it uses the same X25519 and AES-256-GCM primitives the
+// terminal already uses for remote control, so that the terminal needs no
+// additional cryptography.
+
+const (
+	transfer_encryption_protocol = "1"
+	gcm_nonce_size               = 12
+	gcm_tag_size                 = 16
+)
+
+type transfer_cipher struct {
+	aead                      cipher.AEAD
+	public_key, terminal_pkey []byte
+	// the number of chunks of data encrypted and decrypted for every file id
+	encrypted_chunks, decrypted_chunks map[string]uint64
+	// the directions of the data encrypted and decrypted, swapped for the
+	// terminal in tests
+	encrypt_direction, decrypt_direction string
+}
+
+// The cipher used to encrypt the transfer, nil if it is not to be encrypted
+func new_transfer_cipher(opts *Options) (*transfer_cipher, error) {
+	if !opts.Encrypt {
+		return nil, nil
+	}
+	pkey_encoded := os.Getenv("KITTY_PUBLIC_KEY")
+	if pkey_encoded == "" {
+		return nil, fmt.Errorf("The KITTY_PUBLIC_KEY env var is not set, cannot encrypt the transfer")
+	}
+	protocol, terminal_pkey, err := crypto.DecodePublicKey(pkey_encoded)
+	if err != nil {
+		return nil, err
+	}
+	if protocol != transfer_encryption_protocol {
+		return nil, fmt.Errorf("The terminal uses an unsupported encryption protocol: %s", protocol)
+	}
+	private_key, public_key, err := crypto.KeyPair(protocol)
+	if err != nil {
+		return nil, err
+	}
+	return new_transfer_cipher_from_keys(private_key, public_key, terminal_pkey)
+}
+
+func new_transfer_cipher_from_keys(private_key, public_key, terminal_pkey []byte) (*transfer_cipher, error) {
+	secret, err := crypto.SharedSecret(private_key, terminal_pkey, transfer_encryption_protocol)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &transfer_cipher{
+		aead: aead, public_key: public_key, terminal_pkey: terminal_pkey,
+		encrypted_chunks: make(map[string]uint64), decrypted_chunks: make(map[string]uint64),
+		encrypt_direction: "kt", decrypt_direction: "tk",
+	}, nil
+}
+
+func transfer_data_aad(direction string, ftc *FileTransmissionCommand, seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s:%s:%d:%d", direction, ftc.File_id, seq, utils.IfElse(ftc.Action == Action_end_data, 1, 0)))
+}
+
+// The public key to send to the terminal, nil if the transfer is not encrypted
+func (self *transfer_cipher) pubkey() []byte {
+	if self == nil {
+		return nil
+	}
+	return self.public_key
+}
+
+// Check that the terminal will encrypt the transfer, given the command with
+// which it granted permission for it
+func (self *transfer_cipher) check_permission_granted(ftc *FileTransmissionCommand) error {
+	if self == nil {
+		return nil
+	}
+	if len(ftc.Pubkey) == 0 {
+		return fmt.Errorf("The terminal does not support encrypted transfers")
+	}
+	if !bytes.Equal(ftc.Pubkey, self.terminal_pkey) {
+		return fmt.Errorf("The public key of the terminal does not match the one in the KITTY_PUBLIC_KEY env var")
+	}
+	if pkey, err := self.decrypt(ftc.Data, []byte("tk:pubkey")); err != nil || !bytes.Equal(pkey, self.public_key) {
+		return fmt.Errorf("The terminal did not receive the public key of this transfer, it may have been tampered with")
+	}
+	return nil
+}
+
+func (self *transfer_cipher) encrypt(data, aad []byte) []byte {
+	ans := make([]byte, gcm_nonce_size, gcm_nonce_size+len(data)+gcm_tag_size)
+	if _, err := rand.Read(ans); err != nil {
+		panic(fmt.Sprintf("Failed to generate random nonce with error: %s", err))
+	}
+	return self.aead.Seal(ans, ans, data, aad)
+}
+
+func (self *transfer_cipher) decrypt(data, aad []byte) ([]byte, error) {
+	if len(data) < gcm_nonce_size+gcm_tag_size {
+		return nil, fmt.Errorf("Encrypted data received from the terminal is too short")
+	}
+	ans, err := self.aead.Open(nil, data[:gcm_nonce_size], data[gcm_nonce_size:], aad)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt data received from the terminal, it may have been tampered with: %w", err)
+	}
+	return ans, nil
+}
+
+// Encrypt the data of data and end_data commands
+func (self *transfer_cipher) encrypt_command(ftc *FileTransmissionCommand) *FileTransmissionCommand {
+	if self != nil && (ftc.Action == Action_data || ftc.Action == Action_end_data) {
+		seq := self.encrypted_chunks[ftc.File_id]
+		self.encrypted_chunks[ftc.File_id]++
+		ftc.Data = self.encrypt(ftc.Data, transfer_data_aad(self.encrypt_direction, ftc, seq))
+	}
+	return ftc
+}
+
+// Decrypt the data of data and end_data commands received from the terminal
+func (self *transfer_cipher) decrypt_command(ftc *FileTransmissionCommand) (err error) {
+	if self != nil && (ftc.Action == Action_data || ftc.Action == Action_end_data) {
+		seq := self.decrypted_chunks[ftc.File_id]
+		if ftc.Data, err = self.decrypt(ftc.Data, transfer_data_aad(self.decrypt_direction, ftc, seq)); err == nil {
+			self.decrypted_chunks[ftc.File_id]++
+		}
+	}
+	return
+}
@@ -0,0 +1,137 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"kitty/tools/crypto"
+)
+
+var _ = fmt.Print
+
+func TestTransferEncryption(t *testing.T) {
+	key_pair := func() ([]byte, []byte) {
+		private_key, public_key, err := crypto.KeyPair(transfer_encryption_protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return private_key, public_key
+	}
+	kitten_private, kitten_public := key_pair()
+	terminal_private, terminal_public := key_pair()
+	kitten, err := new_transfer_cipher_from_keys(kitten_private, kitten_public, terminal_public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the terminal derives the same key from its private key and the public key of the kitten
+	terminal, err := new_transfer_cipher_from_keys(terminal_private, terminal_public, kitten_public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	terminal.encrypt_direction, terminal.decrypt_direction = "tk", "kt"
+	data_cmd := func(action Action, file_id, data string) *FileTransmissionCommand {
+		return &FileTransmissionCommand{Action: action, File_id: file_id, Data: []byte(data)}
+	}
+
+	data := []byte("some data to transfer")
+	ftc := kitten.encrypt_command(&FileTransmissionCommand{Action: Action_data, File_id: "1", Data: bytes.Clone(data)})
+	if bytes.Contains(ftc.Data, data) || len(ftc.Data) != len(data)+gcm_nonce_size+gcm_tag_size {
+		t.Fatalf("Data not encrypted: %#v", ftc.Data)
+	}
+	if again := kitten.encrypt(data, nil); bytes.Equal(again, ftc.Data) {
+		t.Fatalf("Nonce was re-used")
+	}
+	if err = terminal.decrypt_command(ftc); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ftc.Data, data) {
+		t.Fatalf("Data not decrypted correctly: %#v", string(ftc.Data))
+	}
+	tampered := kitten.encrypt(data, nil)
+	tampered[gcm_nonce_size] ^= 1
+	if _, err = terminal.decrypt(tampered, nil); err == nil {
+		t.Fatalf("Tampered data was decrypted")
+	}
+	if _, err = terminal.decrypt([]byte("short"), nil); err == nil {
+		t.Fatalf("Truncated data was decrypted")
+	}
+
+	// data cannot be reordered, replayed, moved to another file, sent back or truncated
+	first, second := kitten.encrypt_command(data_cmd(Action_data, "1", "a")), kitten.encrypt_command(data_cmd(Action_data, "1", "b"))
+	if err = terminal.decrypt_command(second); err == nil {
+		t.Fatalf("Reordered data was decrypted")
+	}
+	if err = terminal.decrypt_command(first); err != nil || string(first.Data) != "a" {
+		t.Fatalf("Data was not decrypted after a reordered chunk: %v", err)
+	}
+	replayed := kitten.encrypt_command(data_cmd(Action_data, "2", "c"))
+	replayed_data := bytes.Clone(replayed.Data)
+	if err = terminal.decrypt_command(replayed); err != nil {
+		t.Fatal(err)
+	}
+	if err = terminal.decrypt_command(data_cmd(Action_data, "2", string(replayed_data))); err == nil {
+		t.Fatalf("Replayed data was decrypted")
+	}
+	if err = terminal.decrypt_command(data_cmd(Action_data, "3", string(replayed_data))); err == nil {
+		t.Fatalf("Data moved to another file was decrypted")
+	}
+	if err = kitten.decrypt_command(kitten.encrypt_command(data_cmd(Action_data, "4", "d"))); err == nil {
+		t.Fatalf("Data sent back to its sender was decrypted")
+	}
+	last := kitten.encrypt_command(data_cmd(Action_data, "5", "e"))
+	if err = terminal.decrypt_command(data_cmd(Action_end_data, "5", string(last.Data))); err == nil {
+		t.Fatalf("Data turned into the end of a file was decrypted")
+	}
+	if err = terminal.decrypt_command(data_cmd(Action_end_data, "5", "")); err == nil {
+		t.Fatalf("Unencrypted end of a file was accepted")
+	}
+
+	// only the data of data commands is encrypted
+	ftc = kitten.encrypt_command(&FileTransmissionCommand{Action: Action_file, Data: bytes.Clone(data)})
+	if !bytes.Equal(ftc.Data, data) {
+		t.Fatalf("Data of file command was encrypted")
+	}
+	ftc = kitten.encrypt_command(&FileTransmissionCommand{Action: Action_end_data})
+	if len(ftc.Data) != gcm_nonce_size+gcm_tag_size {
+		t.Fatalf("Empty data was not encrypted")
+	}
+
+	if err = kitten.check_permission_granted(&FileTransmissionCommand{Action: Action_status, Status: "OK"}); err == nil {
+		t.Fatalf("Permission without the public key of the terminal was accepted")
+	}
+	if err = kitten.check_permission_granted(&FileTransmissionCommand{Action: Action_status, Status: "OK", Pubkey: kitten_public}); err == nil {
+		t.Fatalf("Permission with the wrong public key was accepted")
+	}
+	if err = kitten.check_permission_granted(&FileTransmissionCommand{Action: Action_status, Status: "OK", Pubkey: terminal_public}); err == nil {
+		t.Fatalf("Permission without confirmation of the public key of the kitten was accepted")
+	}
+	// the terminal encrypts the public key of the kitten it received
+	_, other_public := key_pair()
+	for _, x := range []struct {
+		pkey []byte
+		ok   bool
+	}{{kitten_public, true}, {other_public, false}} {
+		confirmation := terminal.encrypt(x.pkey, []byte("tk:pubkey"))
+		err = kitten.check_permission_granted(&FileTransmissionCommand{Action: Action_status, Status: "OK", Pubkey: terminal_public, Data: confirmation})
+		if x.ok && err != nil {
+			t.Fatal(err)
+		} else if !x.ok && err == nil {
+			t.Fatalf("Permission for a replaced public key was accepted")
+		}
+	}
+
+	var unencrypted *transfer_cipher
+	ftc = unencrypted.encrypt_command(&FileTransmissionCommand{Action: Action_data, Data: bytes.Clone(data)})
+	if err = unencrypted.decrypt_command(ftc); err != nil || !bytes.Equal(ftc.Data, data) || unencrypted.pubkey() != nil {
+		t.Fatalf("Unencrypted transfer modified data")
+	}
+	if err = unencrypted.check_permission_granted(&FileTransmissionCommand{}); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := new_transfer_cipher(&Options{}); c != nil || err != nil {
+		t.Fatalf("Cipher created without --encrypt")
+	}
+}
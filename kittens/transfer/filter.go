@@ -0,0 +1,195 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Filter rules decide which of the files found in the directories being
+// transferred are skipped. They work like the filter rules of rsync: the
+// rules are checked in order and the first rule whose pattern matches the
+// path of a file, relative to the directory containing the top level path
+// being transferred, decides whether it is included or excluded. Files
+// matching no rule are included. Excluding a directory excludes everything
+// in it, without walking it.
+//
+// A pattern starting with / is matched against the whole relative path,
+// otherwise against its trailing path components. A pattern ending with / only
+// matches directories. * matches anything except /, ** matches anything, **/
+// matches zero or more directories and ? matches any single character except /.
+
+type filter_rule struct {
+	include, dir_only bool
+	pattern           *regexp.Regexp
+}
+
+type file_filter struct {
+	rules []filter_rule
+}
+
+func glob_to_regexp(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch ch := pattern[i]; ch {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**/") {
+				b.WriteString(`(.*/)?`)
+				i += 2
+			} else if strings.HasPrefix(pattern[i:], "**") {
+				b.WriteString(`.*`)
+				i++
+			} else {
+				b.WriteString(`[^/]*`)
+			}
+		case '?':
+			b.WriteString(`[^/]`)
+		case '[':
+			if end := strings.IndexByte(pattern[i+1:], ']'); end > 0 {
+				class := pattern[i+1 : i+1+end]
+				if class[0] == '!' {
+					class = "^" + class[1:]
+				}
+				b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+				i += end + 1
+			} else {
+				b.WriteString(`\[`)
+			}
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return b.String()
+}
+
+func new_filter_rule(pattern string, include bool) (ans filter_rule, err error) {
+	if pattern == "" || pattern == "/" {
+		return ans, fmt.Errorf("Empty filter pattern")
+	}
+	ans.include = include
+	if strings.HasSuffix(pattern, "/") {
+		ans.dir_only = true
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	expr := glob_to_regexp(strings.TrimPrefix(pattern, "/"))
+	if strings.HasPrefix(pattern, "/") {
+		expr = `^` + expr + `$`
+	} else {
+		expr = `(^|/)` + expr + `$`
+	}
+	if ans.pattern, err = regexp.Compile(expr); err != nil {
+		return ans, fmt.Errorf("The filter pattern %#v is invalid with error: %w", pattern, err)
+	}
+	return
+}
+
+// Parse a filter file with one rule per line, either "+ pattern" or
+// "include pattern" to include or "- pattern" or "exclude pattern" to exclude.
+// Blank lines and lines starting with # are ignored.
+func parse_filter_file(raw string) (ans []filter_rule, err error) {
+	for i, line := range utils.Splitlines(raw) {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		action, pattern, found := strings.Cut(line, " ")
+		if !found {
+			return nil, fmt.Errorf("Line %d of the filter file has no pattern: %s", i+1, line)
+		}
+		var include bool
+		switch action {
+		case "+", "include":
+			include = true
+		case "-", "exclude":
+		default:
+			return nil, fmt.Errorf("Line %d of the filter file has an unknown rule type: %s", i+1, action)
+		}
+		r, err := new_filter_rule(pattern, include)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d of the filter file is invalid: %w", i+1, err)
+		}
+		ans = append(ans, r)
+	}
+	return
+}
+
+// The filter specified on the command line, nil if no filter rules were
+// specified. The --include rules are checked first, then the --exclude rules
+// and finally the rules from the filter file.
+func new_file_filter(opts *Options) (*file_filter, error) {
+	ans := file_filter{}
+	for _, x := range opts.Include {
+		r, err := new_filter_rule(x, true)
+		if err != nil {
+			return nil, err
+		}
+		ans.rules = append(ans.rules, r)
+	}
+	for _, x := range opts.Exclude {
+		r, err := new_filter_rule(x, false)
+		if err != nil {
+			return nil, err
+		}
+		ans.rules = append(ans.rules, r)
+	}
+	if opts.FilterFrom != "" {
+		raw, err := os.ReadFile(utils.Expanduser(opts.FilterFrom))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the filter file %s with error: %w", opts.FilterFrom, err)
+		}
+		rules, err := parse_filter_file(utils.UnsafeBytesToString(raw))
+		if err != nil {
+			return nil, err
+		}
+		ans.rules = append(ans.rules, rules...)
+	}
+	if len(ans.rules) == 0 {
+		return nil, nil
+	}
+	return &ans, nil
+}
+
+// Whether the file with the specified relative path, using / as the separator,
+// is excluded
+func (self *file_filter) is_excluded(rel_path string, is_dir bool) bool {
+	if self == nil {
+		return false
+	}
+	rel_path = strings.Trim(filepath.ToSlash(rel_path), "/")
+	for _, r := range self.rules {
+		if (!r.dir_only || is_dir) && r.pattern.MatchString(rel_path) {
+			return !r.include
+		}
+	}
+	return false
+}
+
+// Links whose targets were excluded are received as what they point to, hard
+// links as regular files and symbolic links with their original values
+func detach_links_to_excluded_files(files []*remote_file) {
+	received := utils.NewSet[string](len(files))
+	for _, f := range files {
+		received.Add(f.remote_id)
+	}
+	for _, f := range files {
+		if f.remote_target != "" && !received.Has(f.remote_target) {
+			if f.ftype == FileType_link {
+				f.ftype = FileType_regular
+			}
+			f.remote_target = ""
+		}
+	}
+}
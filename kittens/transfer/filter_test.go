@@ -0,0 +1,61 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestFileFilter(t *testing.T) {
+	tdir := t.TempDir()
+	filter_file := filepath.Join(tdir, "filters")
+	os.WriteFile(filter_file, []byte("# comment\n\n+ keep.o\n- /src/build/\ninclude src/**/*.c\n- *.c\n"), 0o600)
+	opts := &Options{Mode: "normal", Exclude: []string{"*.o", "cache/"}, Include: []string{"important.*"}, FilterFrom: filter_file}
+	f, err := new_file_filter(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]bool{
+		"src/a.o": true, "src/important.o": false, "src/keep.o": true, "src/cache": true, "src/build": true,
+		"other/src/build": false, "src/x/y.c": false, "other/y.c": true, "src/a.txt": false,
+	} {
+		if actual := f.is_excluded(path, path != "src/a.o" && path != "src/keep.o" && filepath.Ext(path) == ""); actual != expected {
+			t.Fatalf("Incorrect exclusion for %s: %v", path, actual)
+		}
+	}
+	if f.is_excluded("src/cache", false) {
+		t.Fatalf("A directory only rule matched a file")
+	}
+	if _, err = parse_filter_file("* x"); err == nil {
+		t.Fatalf("An invalid filter rule was accepted")
+	}
+
+	// filtering while walking the directories being sent
+	for _, x := range []string{"src/build", "src/sub", "src/cache"} {
+		os.MkdirAll(filepath.Join(tdir, x), 0o700)
+	}
+	for _, x := range []string{"src/a.o", "src/a.c", "src/build/b.c", "src/sub/c.c", "src/cache/d", "src/important.o"} {
+		os.WriteFile(filepath.Join(tdir, x), []byte(x), 0o600)
+	}
+	var files []*File
+	run_with_paths(tdir, tdir, func() {
+		files, err = files_for_send(opts, []string{"src", "dest/"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := make([]string, len(files))
+	for i, x := range files {
+		actual[i] = x.remote_path
+	}
+	if diff := cmp.Diff([]string{"dest/src", "dest/src/a.c", "dest/src/important.o", "dest/src/sub", "dest/src/sub/c.c"}, actual); diff != "" {
+		t.Fatalf("Incorrect files sent:\n%s", diff)
+	}
+}
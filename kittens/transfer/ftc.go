@@ -44,6 +44,7 @@ const (
 	Action_cancel
 	Action_status
 	Action_finish
+	Action_verify
 )
 
 type Compression int // enum
@@ -54,6 +55,7 @@ var _ Unserializable = (*Compression)(nil)
 const (
 	Compression_none Compression = iota
 	Compression_zlib
+	Compression_zstd
 )
 
 type FileType int // enum
@@ -124,15 +126,20 @@ type FileTransmissionCommand struct {
 	Ttype       TransmissionType `json:"tt,omitempty"`
 	Quiet       QuietLevel       `json:"q,omitempty"`
 
-	Id          string        `json:"id,omitempty"`
-	File_id     string        `json:"fid,omitempty"`
-	Bypass      string        `json:"pw,omitempty" encoding:"base64"`
-	Name        string        `json:"n,omitempty" encoding:"base64"`
-	Status      string        `json:"st,omitempty" encoding:"base64"`
-	Parent      string        `json:"pr,omitempty"`
-	Mtime       time.Duration `json:"mod,omitempty"`
-	Permissions fs.FileMode   `json:"prm,omitempty"`
-	Size        int64         `json:"sz,omitempty" default:"-1"`
+	Id              string        `json:"id,omitempty"`
+	File_id         string        `json:"fid,omitempty"`
+	Bypass          string        `json:"pw,omitempty" encoding:"base64"`
+	Name            string        `json:"n,omitempty" encoding:"base64"`
+	Status          string        `json:"st,omitempty" encoding:"base64"`
+	Parent          string        `json:"pr,omitempty"`
+	Mtime           time.Duration `json:"mod,omitempty"`
+	Permissions     fs.FileMode   `json:"prm,omitempty"`
+	Size            int64         `json:"sz,omitempty" default:"-1"`
+	Xattrs          string        `json:"xa,omitempty" encoding:"base64"`
+	Sparse          int64         `json:"sp,omitempty"`
+	Pubkey          []byte        `json:"pk,omitempty"`
+	Follow_symlinks int64         `json:"fl,omitempty"`
+	Relay           string        `json:"rl,omitempty" encoding:"base64"`
 
 	Data []byte `json:"d,omitempty"`
 }
@@ -0,0 +1,113 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"kitty/tools/utils"
+
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+// The --links option controls how symbolic links are transferred:
+//
+// preserve: symbolic links are recreated, pointing to the same paths.
+// follow: symbolic links are replaced by what they point to. When receiving,
+// the terminal is asked to dereference them, with the follow_symlinks key of
+// the receive command.
+// skip: symbolic links are not transferred, with a warning.
+// munge: symbolic links whose targets are absolute or point outside the
+// destination root, that is the directory into which the top level paths are
+// transferred, are rewritten to point to the same relative location inside
+// it, as though the destination root were the root of the filesystem.
+//
+// Regardless of policy, when receiving, files are never written to paths that
+// go through symbolic links created by the same transfer, as a malicious
+// sender could use such links to write outside the destination root.
+// Symbolic links already present in the destination are trusted.
+
+const (
+	links_preserve = "preserve"
+	links_follow   = "follow"
+	links_skip     = "skip"
+	links_munge    = "munge"
+)
+
+// Resolve the link target lexically, as though root were the root of the
+// filesystem, returning the rewritten target, relative to the directory
+// containing the link
+func munge_symlink_target(root, link_path, target string) string {
+	root = filepath.Clean(root)
+	link_dir := filepath.Dir(link_path)
+	rel_dir, err := filepath.Rel(root, link_dir)
+	if err != nil || rel_dir == ".." || strings.HasPrefix(rel_dir, ".."+string(filepath.Separator)) {
+		// the link is not inside root, nothing to rewrite relative to
+		return target
+	}
+	var components []string
+	if !filepath.IsAbs(target) && rel_dir != "." {
+		components = strings.Split(rel_dir, string(filepath.Separator))
+	}
+	for _, c := range strings.Split(filepath.ToSlash(target), "/") {
+		switch c {
+		case "", ".":
+		case "..":
+			// cannot go above root, like .. in the root of the filesystem
+			if len(components) > 0 {
+				components = components[:len(components)-1]
+			}
+		default:
+			components = append(components, c)
+		}
+	}
+	ans, err := filepath.Rel(link_dir, filepath.Join(append([]string{root}, components...)...))
+	if err != nil {
+		return target
+	}
+	return ans
+}
+
+// Whether the directory s is one of the directories being traversed, in which
+// case following a symbolic link to it would never terminate
+func is_symlink_loop(s fs.FileInfo, ancestors []FileHash) bool {
+	stat, ok := s.Sys().(*syscall.Stat_t)
+	return ok && slices.Contains(ancestors, FileHash{uint64(stat.Dev), stat.Ino})
+}
+
+// Refuse to write to path if it is outside root or reached through one of the
+// symbolic links created by this transfer. An empty root means the destination
+// was specified explicitly, so only the created links are checked.
+func check_for_symlink_escape(root, path string, created_links *utils.Set[string]) error {
+	if root != "" {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("Refusing to write %s as it is outside the destination %s", path, root)
+		}
+	}
+	for current := filepath.Dir(path); created_links.Len() > 0 && current != filepath.Dir(current); current = filepath.Dir(current) {
+		if created_links.Has(current) {
+			return fmt.Errorf("Refusing to write %s as %s is a symbolic link created by this transfer, which could point outside the destination", path, current)
+		}
+	}
+	return nil
+}
+
+// Remove the received symbolic links, returning the paths of the removed links
+func skip_symlinks(files []*remote_file) (ans []*remote_file, skipped []string) {
+	ans = utils.Filter(files, func(f *remote_file) bool {
+		if f.ftype == FileType_symlink {
+			skipped = append(skipped, f.expanded_local_path)
+			return false
+		}
+		return true
+	})
+	detach_links_to_excluded_files(ans)
+	return
+}
@@ -0,0 +1,118 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"kitty/tools/utils"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestSymlinkPolicies(t *testing.T) {
+	for _, x := range []struct{ link, target, expected string }{
+		{"/r/a/link", "b", "b"},
+		{"/r/a/link", "../b", "../b"},
+		{"/r/a/link", "../../b", "../b"},
+		{"/r/a/link", "../../../x/../b", "../b"},
+		{"/r/a/link", "/etc/passwd", "../etc/passwd"},
+		{"/r/link", "/", "."},
+		{"/r/a/b/link", "/a/c", "../c"},
+		{"/elsewhere/link", "/etc/passwd", "/etc/passwd"},
+	} {
+		if actual := munge_symlink_target("/r", x.link, x.target); actual != x.expected {
+			t.Fatalf("Incorrect munging of %s → %s: %#v != %#v", x.link, x.target, x.expected, actual)
+		}
+	}
+
+	tdir := t.TempDir()
+	root := filepath.Join(tdir, "root")
+	os.MkdirAll(filepath.Join(root, "d", "sub"), 0o700)
+	os.MkdirAll(filepath.Join(tdir, "outside"), 0o700)
+	os.Symlink(filepath.Join(tdir, "outside"), filepath.Join(root, "d", "escape"))
+	os.Symlink("..", filepath.Join(root, "d", "sub", "loop"))
+	os.WriteFile(filepath.Join(root, "d", "file"), []byte("file"), 0o600)
+	os.Symlink("file", filepath.Join(root, "d", "link"))
+	os.Symlink("missing", filepath.Join(root, "d", "broken"))
+
+	created := utils.NewSetWithItems(filepath.Join(root, "d", "escape"))
+	for _, x := range []struct {
+		path string
+		ok   bool
+	}{
+		{"d/file", true},
+		{"d/new/file", true},
+		{"d/escape", true},
+		{"d/escape/file", false},
+		{"d/escape/x/file", false},
+		{"../file", false},
+		{".", false},
+	} {
+		err := check_for_symlink_escape(root, filepath.Join(root, x.path), created)
+		if (err == nil) != x.ok {
+			t.Fatalf("Incorrect escape check for %s: %v", x.path, err)
+		}
+	}
+	// symbolic links already present in the destination are trusted
+	if err := check_for_symlink_escape(root, filepath.Join(root, "d/escape/file"), utils.NewSet[string]()); err != nil {
+		t.Fatalf("Existing symbolic link was refused: %s", err)
+	}
+	if err := check_for_symlink_escape("", filepath.Join(root, "d/escape/file"), created); err == nil {
+		t.Fatalf("Created symbolic link not refused with an explicit destination")
+	}
+	stat := func(path string) fs.FileInfo {
+		s, err := os.Stat(filepath.Join(root, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	ancestors := []FileHash{}
+	for _, x := range []string{"d", "d/sub"} {
+		s := stat(x).Sys().(*syscall.Stat_t)
+		ancestors = append(ancestors, FileHash{uint64(s.Dev), s.Ino})
+	}
+	if !is_symlink_loop(stat("d/sub/loop"), ancestors) || is_symlink_loop(stat("d/escape"), ancestors) {
+		t.Fatalf("Incorrect detection of symlink loops")
+	}
+
+	names := func(opts *Options) (ans []string) {
+		counter := 0
+		files, err := process(opts, []string{filepath.Join(root, "d")}, "", &counter, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			rel, _ := filepath.Rel(root, f.expanded_local_path)
+			ans = append(ans, fmt.Sprintf("%s:%s", rel, f.file_type))
+		}
+		return
+	}
+	preserved := names(&Options{Links: links_preserve})
+	if diff := cmp.Diff([]string{"d:directory", "d/broken:symlink", "d/escape:symlink", "d/file:regular", "d/link:symlink", "d/sub:directory", "d/sub/loop:symlink"}, preserved); diff != "" {
+		t.Fatalf("Incorrect files with preserve:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"d:directory", "d/file:regular", "d/sub:directory"}, names(&Options{Links: links_skip})); diff != "" {
+		t.Fatalf("Incorrect files with skip:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"d:directory", "d/escape:directory", "d/file:regular", "d/link:regular", "d/sub:directory"}, names(&Options{Links: links_follow})); diff != "" {
+		t.Fatalf("Incorrect files with follow:\n%s", diff)
+	}
+
+	files, skipped := skip_symlinks([]*remote_file{
+		{ftype: FileType_regular, expanded_local_path: "a", remote_id: "1"},
+		{ftype: FileType_symlink, expanded_local_path: "b", remote_id: "2"},
+		{ftype: FileType_link, expanded_local_path: "c", remote_id: "3", remote_target: "2"},
+	})
+	if len(files) != 2 || files[1].ftype != FileType_regular || files[1].remote_target != "" || !cmp.Equal(skipped, []string{"b"}) {
+		t.Fatalf("Symlinks not skipped correctly: %v", skipped)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"kitty/tools/cli"
+	"kitty/tools/rsync"
 	"kitty/tools/utils"
 )
 
@@ -44,6 +45,48 @@ func read_bypass(loc string) (string, error) {
 }
 
 func main(cmd *cli.Command, opts *Options, args []string) (rc int, err error) {
+	if opts.RunQueue {
+		if len(args) > 0 {
+			return 1, fmt.Errorf("No files must be specified with --run-queue")
+		}
+		return run_transfer_queue(transfer_queue_path(), transfer)
+	}
+	return transfer(opts, args)
+}
+
+func transfer(opts *Options, args []string) (rc int, err error) {
+	if len(args) == 0 {
+		return 1, fmt.Errorf("Must specify at least one file to transfer")
+	}
+	if opts.Delete && !opts.Sync {
+		return 1, fmt.Errorf("The --delete option can only be used together with --sync")
+	}
+	if opts.DryRun && (opts.Queue || opts.RunQueue) {
+		return 1, fmt.Errorf("The --dry-run option cannot be used with the transfer queue")
+	}
+	is_send := opts.Direction == "send" || opts.Direction == "download"
+	if err = check_relay_options(opts, is_send, args); err != nil {
+		return 1, err
+	}
+	if is_send {
+		if opts.Sync {
+			return 1, fmt.Errorf("The --sync option can only be used when receiving files, with --direction=upload")
+		}
+		if opts.RsyncBlockSize != "" || opts.RsyncHash != rsync.XXH3.String() {
+			return 1, fmt.Errorf("The --rsync-block-size and --rsync-hash options can only be used when receiving files, with --direction=upload")
+		}
+	} else if opts.LimitRate != "" {
+		return 1, fmt.Errorf("The --limit-rate option can only be used when sending files, with --direction=download")
+	}
+	if opts.Queue {
+		// the password is read only when the queued transfer is run
+		q, err := add_to_transfer_queue(transfer_queue_path(), opts, args)
+		if err != nil {
+			return 1, err
+		}
+		fmt.Printf("Added the transfer to the queue, which now has %d transfers, run them with --run-queue\n", len(q.Transfers))
+		return 0, nil
+	}
 	if opts.PermissionsBypass != "" {
 		val, err := read_bypass(opts.PermissionsBypass)
 		if err != nil {
@@ -51,13 +94,9 @@ func main(cmd *cli.Command, opts *Options, args []string) (rc int, err error) {
 		}
 		opts.PermissionsBypass = strings.TrimSpace(val)
 	}
-	if len(args) == 0 {
-		return 1, fmt.Errorf("Must specify at least one file to transfer")
-	}
-	switch opts.Direction {
-	case "send", "download":
+	if is_send {
 		err, rc = send_main(opts, args)
-	default:
+	} else {
 		err, rc = receive_main(opts, args)
 	}
 	if err != nil {
@@ -112,12 +112,180 @@ def option_text() -> str:
 file names and ask for confirmation.
 
 
+--dry-run -n
+type=bool-set
+Do not transfer anything, instead show the changes the transfer would make on
+the receiving computer: the files that would be created, updated and deleted, with
+an estimate of the amount of data that would be sent to update each file. Useful
+to review the effects of :option:`--sync` and :option:`--delete` before running
+them. Permission is still requested from the terminal, as it is needed to read the
+metadata of the files on the computer running the terminal.
+
+
+--relay
+Transfer files between two remote computers, through the terminal, which
+relays the data of the files from one to the other without writing it anywhere.
+Run the kitten sending the files with this option and the files to send, in one
+window and the kitten receiving them with this option, :code:`--direction=upload`
+and the destination, in another, using the same arbitrary name for the relay in
+both.
+
+
 --transmit-deltas -x
 type=bool-set
 If a file on the receiving side already exists, use the rsync algorithm to
 update it to match the file on the sending side, potentially saving lots of
 bandwidth and also automatically resuming partial transfers. Note that this will
 actually degrade performance on fast links or with small files, so use with care.
+
+
+--rsync-block-size
+The block size to use for the rsync algorithm when transferring deltas. Larger
+blocks mean less data is needed to describe the existing files, which is better
+for large files with few changes, smaller blocks mean less data is sent for files
+with many small, scattered changes. The suffixes :code:`K` and :code:`M` can be
+used. By default, the square root of the file size is used. Can only be used when
+receiving files, that is with :code:`--direction=upload`.
+
+
+--rsync-hash
+choices=xxh3-64,xxh3-128
+default=xxh3-64
+The hash used by the rsync algorithm to identify unchanged blocks when
+transferring deltas. Larger hashes make it less likely that changed blocks are
+mistaken for unchanged ones, at the cost of more data being sent. Can only be used
+when receiving files, that is with :code:`--direction=upload`.
+
+
+--streams
+type=int
+default=4
+The number of files to send simultaneously, with their data interleaved. This
+allows small files to be transferred while large files are still being sent
+and files that are waiting for their rsync signatures not to hold up others.
+
+
+--limit-rate
+Limit the rate at which data is sent to the specified number of bytes per
+second, so that a large transfer does not starve other programs using the same
+connection, for example, an interactive SSH session. The suffixes :code:`K`,
+:code:`M`, :code:`G` and :code:`T` can be used for kibibytes, mebibytes, etc.,
+for example, :code:`--limit-rate 5M`. Can only be used when sending files, that
+is with :code:`--direction=download`.
+
+
+--exclude
+type=list
+Skip the files and directories found in the directories being transferred that
+match the specified pattern, for example, :code:`--exclude '*.o'`. Can be specified
+multiple times. See :ref:`transfer_filters` for the syntax of patterns.
+
+
+--include
+type=list
+Do not skip the files and directories matching the specified pattern, even if they
+match an :option:`--exclude` pattern. Can be specified multiple times.
+
+
+--filter-from
+Read filter rules from the specified file. Every line in the file is a rule, either
+:code:`+ pattern` to include or :code:`- pattern` to exclude matching files. The first
+matching rule wins. The rules from this file are checked after the :option:`--include`
+and :option:`--exclude` rules.
+
+
+--verify
+type=bool-set
+After all files have been transferred, verify that they were transferred
+correctly by comparing the SHA-256 digests of the files on both computers. A
+report of the verification of every file is printed and the kitten exits with
+a non-zero exit code if any file fails verification.
+
+
+--links
+choices=preserve,follow,skip,munge
+default=preserve
+How to transfer symbolic links. :code:`preserve` recreates them, pointing to the
+same paths. :code:`follow` transfers what they point to instead. :code:`skip` does
+not transfer them, printing a warning. :code:`munge` recreates them, but links
+with absolute targets or targets outside the destination are rewritten to point
+to the same relative location inside the destination, as though the destination
+were the root of the filesystem. Regardless of this option, when receiving, files
+are never written through symbolic links inside the destination.
+
+
+--encrypt
+type=bool-set
+Encrypt the data of the transferred files end to end, between this kitten and
+the terminal, so that it remains confidential even when relayed through
+untrusted programs such as terminal multiplexers or logging proxies. The
+encryption key is negotiated afresh for every transfer, using the public key of
+the terminal from the :envvar:`KITTY_PUBLIC_KEY` environment variable. Note that
+the names, sizes and other metadata of files are not encrypted.
+
+
+--xattrs
+type=bool-set
+Preserve the extended attributes of files. Only attributes that can be set by
+normal users are transferred, which on Linux means the attributes in the
+:code:`user` namespace. Attributes that cannot be set on the receiving computer,
+for example because its filesystem does not support them, are ignored.
+
+
+--acls
+type=bool-set
+Preserve the POSIX Access Control Lists (ACLs) of files. ACLs are transferred
+as extended attributes and so are only preserved where both computers store them
+that way, as Linux does.
+
+
+--sparse
+type=bool-set
+Preserve the holes in sparse files, that is, files with large regions of zeros,
+such as disk images, that take up less space on disk than their size. Blocks of
+zeros in such files are not written on the receiving computer, so that they
+become holes, and the received file takes up as little space as the original.
+
+
+--resume -r
+type=bool-set
+Continue a transfer that was interrupted, for example, by the connection being
+dropped or by pressing :kbd:`Ctrl+C`. Run the same command as for the interrupted
+transfer, in the same directory, adding this option. Files that were completely
+transferred are skipped and the rest are transferred using the rsync algorithm,
+so that the data that was already transferred is re-used instead of being sent
+again.
+
+
+--sync -s
+type=bool-set
+Synchronize the received files with the files already present on the receiving
+computer. Files whose size and modification time are unchanged are skipped and
+the rest are transferred using the rsync algorithm, so only the changed parts of
+files are sent. The contents of skipped files are not compared, nor are they
+checked by :option:`--verify`. A summary of the changes is shown and
+confirmation asked for before any changes are made. Can only be used when
+receiving files, that is with :code:`--direction=upload`.
+
+
+--delete
+type=bool-set
+When used with :option:`--sync`, delete files present in the received directories
+on the receiving computer that do not exist on the sending computer.
+
+
+--queue -q
+type=bool-set
+Instead of running the transfer, add it to the queue of transfers, to be run
+later with :option:`--run-queue`.
+
+
+--run-queue
+type=bool-set
+Run the queued transfers, one after the other, in the order they were queued. A
+transfer is removed from the queue once it succeeds. If a transfer fails or is
+interrupted, running the queue again resumes it. No file arguments must be
+specified with this option.
 '''
 
 
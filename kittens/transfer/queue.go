@@ -0,0 +1,265 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slices"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// While sending, the files waiting to be sent form a queue that can be
+// managed from the file list: files can be paused, so that they are not sent
+// until resumed, skipped, if their data has not started to be sent, and moved
+// up and down the queue to change the order in which they are sent. The state
+// of the queue is saved in the record kept for --resume, so that resuming an
+// interrupted transfer restores it.
+//
+// Whole transfers can also be queued: with --queue, the transfer is added to
+// a queue in the cache directory instead of being run and --run-queue runs
+// the queued transfers, one after the other. A transfer is removed from the
+// queue once it succeeds, so running the queue again after an interruption
+// continues from the interrupted transfer, resuming it.
+
+// Hard links can only be created if the file they link to is sent
+func (self *SendManager) is_link_target(f *File) bool {
+	for _, x := range self.files {
+		if x.file_type == FileType_link && x.hard_link_target == "fid:"+f.file_id {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *SendManager) can_skip(f *File) error {
+	switch {
+	case f.file_type == FileType_directory:
+		return fmt.Errorf("Directories cannot be skipped")
+	case f.data_sent || f.state == FINISHED || f.state == ACKNOWLEDGED:
+		return fmt.Errorf("The data of %s has already been sent", f.display_name)
+	case self.is_link_target(f):
+		return fmt.Errorf("%s cannot be skipped as other files are hard links to it", f.display_name)
+	}
+	return nil
+}
+
+// Skip a file whose data has not started to be sent, it is then not
+// created on the receiving computer
+func (self *SendManager) skip_file(f *File) (err error) {
+	if err = self.can_skip(f); err != nil {
+		return
+	}
+	f.skipped = true
+	f.paused = false
+	f.state = ACKNOWLEDGED
+	self.deactivate_file(f)
+	if f.actual_file != nil {
+		f.actual_file.Close()
+		f.actual_file = nil
+	}
+	f.delta_loader, f.deltabuf = nil, nil
+	if f.file_type == FileType_regular && f.file_size > 0 {
+		self.progress_tracker.total_bytes_to_transfer -= f.file_size
+	}
+	self.progress_tracker.on_file_done(f)
+	self.update_collective_statuses()
+	self.save_queue_state()
+	return self.file_done(f)
+}
+
+// Pause a file that has not been completely sent or resume a paused file
+func (self *SendManager) toggle_pause(f *File) {
+	if f.state == FINISHED || f.state == ACKNOWLEDGED {
+		return
+	}
+	f.paused = !f.paused
+	if f.paused {
+		self.deactivate_file(f)
+	}
+	self.save_queue_state()
+}
+
+// Exchange the positions of two files in the queue
+func (self *SendManager) swap_files(a, b *File) {
+	i, j := slices.Index(self.files, a), slices.Index(self.files, b)
+	if i > -1 && j > -1 {
+		self.files[i], self.files[j] = b, a
+		self.save_queue_state()
+	}
+}
+
+func (self *SendManager) save_queue_state() {
+	self.resume.set_queue_state(self.files)
+}
+
+// Record the order of the files and which files are paused or skipped.
+// Files skipped in a previous attempt at the transfer remain skipped.
+func (self *resume_manifest) set_queue_state(files []*File) {
+	if self == nil {
+		return
+	}
+	present := utils.NewSet[string](len(files))
+	for _, f := range files {
+		present.Add(f.expanded_local_path)
+	}
+	self.Skipped = utils.Filter(self.Skipped, func(path string) bool { return !present.Has(path) })
+	self.Queue, self.Paused = make([]string, 0, len(files)), nil
+	for _, f := range files {
+		self.Queue = append(self.Queue, f.expanded_local_path)
+		if f.paused {
+			self.Paused = append(self.Paused, f.expanded_local_path)
+		}
+		if f.skipped {
+			self.Skipped = append(self.Skipped, f.expanded_local_path)
+		}
+	}
+	_ = self.save()
+}
+
+// Restore the state of the queue from the interrupted transfer, removing the
+// files that were skipped. Directories are kept first, in their original order.
+func (self *resume_manifest) restore_queue_state(files []*File) (ans []*File, num_skipped int) {
+	if self == nil || (len(self.Queue) == 0 && len(self.Skipped) == 0) {
+		return files, 0
+	}
+	skipped := utils.NewSetWithItems(self.Skipped...)
+	paused := utils.NewSetWithItems(self.Paused...)
+	pos := make(map[string]int, len(self.Queue))
+	for i, path := range self.Queue {
+		pos[path] = i
+	}
+	key := func(f *File) int {
+		if f.file_type == FileType_directory {
+			return -1
+		}
+		if i, found := pos[f.expanded_local_path]; found {
+			return i
+		}
+		return len(self.Queue)
+	}
+	ans = make([]*File, 0, len(files))
+	for _, f := range files {
+		if skipped.Has(f.expanded_local_path) && f.file_type != FileType_directory {
+			num_skipped++
+			continue
+		}
+		f.paused = paused.Has(f.expanded_local_path)
+		ans = append(ans, f)
+	}
+	return utils.StableSortWithKey(ans, key), num_skipped
+}
+
+type queued_transfer struct {
+	Id   string   `json:"id"`
+	Cwd  string   `json:"cwd"`
+	Args []string `json:"args"`
+	Opts Options  `json:"opts"`
+}
+
+type transfer_queue struct {
+	Transfers []*queued_transfer `json:"transfers"`
+
+	path string
+}
+
+func transfer_queue_path() string {
+	return filepath.Join(utils.CacheDir(), "transfer-queue.json")
+}
+
+func load_transfer_queue(path string) (*transfer_queue, error) {
+	ans := &transfer_queue{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ans, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, ans); err != nil {
+		return nil, fmt.Errorf("The queue of transfers at %s is invalid with error: %w", path, err)
+	}
+	return ans, nil
+}
+
+func (self *transfer_queue) save() error {
+	if len(self.Transfers) == 0 {
+		if err := os.Remove(self.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(self.path), 0o700); err != nil {
+		return err
+	}
+	return utils.AtomicWriteFile(self.path, data, 0o600)
+}
+
+func add_to_transfer_queue(path string, opts *Options, args []string) (*transfer_queue, error) {
+	if slices.Contains(args, stream_path) {
+		return nil, fmt.Errorf("Transfers that stream data cannot be queued")
+	}
+	q, err := load_transfer_queue(path)
+	if err != nil {
+		return nil, err
+	}
+	o := *opts
+	o.Queue = false
+	q.Transfers = append(q.Transfers, &queued_transfer{Id: random_id(), Cwd: cwd_path(), Args: args, Opts: o})
+	return q, q.save()
+}
+
+// Remove the transfer from the queue, re-reading the queue first to keep
+// transfers queued while it was running
+func remove_from_transfer_queue(path string, id string) error {
+	q, err := load_transfer_queue(path)
+	if err != nil {
+		return err
+	}
+	q.Transfers = utils.Filter(q.Transfers, func(t *queued_transfer) bool { return t.Id != id })
+	return q.save()
+}
+
+// Run the queued transfers in order, stopping at the first one that fails
+func run_transfer_queue(path string, run func(opts *Options, args []string) (int, error)) (rc int, err error) {
+	q, err := load_transfer_queue(path)
+	if err != nil {
+		return 1, err
+	}
+	if len(q.Transfers) == 0 {
+		fmt.Println("There are no queued transfers")
+		return 0, nil
+	}
+	for i, t := range q.Transfers {
+		fmt.Printf("Running queued transfer %d of %d: %s\n", i+1, len(q.Transfers), strings.Join(t.Args, " "))
+		if err = os.Chdir(t.Cwd); err != nil {
+			return 1, fmt.Errorf("Failed to change to the directory of the queued transfer with error: %w", err)
+		}
+		opts := t.Opts
+		if _, serr := os.Stat(resume_manifest_path(&opts, t.Args)); serr == nil {
+			// continue the transfer from where it was interrupted
+			opts.Resume = true
+		}
+		if rc, err = run(&opts, t.Args); err != nil || rc != 0 {
+			fmt.Fprintln(os.Stderr, "The queued transfer failed, run the queue again to retry it")
+			return utils.IfElse(rc == 0, 1, rc), err
+		}
+		if err = remove_from_transfer_queue(path, t.Id); err != nil {
+			return 1, err
+		}
+	}
+	return 0, nil
+}
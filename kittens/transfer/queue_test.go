@@ -0,0 +1,151 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+func TestSendQueue(t *testing.T) {
+	opts := &Options{Mode: "normal"}
+	tdir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		os.WriteFile(filepath.Join(tdir, name), []byte(name), 0o600)
+	}
+	os.Link(filepath.Join(tdir, "c"), filepath.Join(tdir, "l"))
+	args := []string{"a", "b", "c", "l", "dest/"}
+	var files []*File
+	var err error
+	run_with_paths(tdir, tdir, func() {
+		files, err = files_for_send(opts, args)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpath := filepath.Join(tdir, "manifest.json")
+	resume, _ := new_resume_manifest(mpath, false)
+	done := []string{}
+	m := SendManager{files: files, resume: resume, num_streams: 1, file_done: func(f *File) error {
+		done = append(done, filepath.Base(f.local_path))
+		return nil
+	}}
+	m.initialize()
+	names := func(files []*File) (ans []string) {
+		for _, f := range files {
+			ans = append(ans, filepath.Base(f.local_path))
+		}
+		return
+	}
+	for _, f := range m.files {
+		f.state = TRANSMITTING
+	}
+	by_name := func(name string) *File { return m.files[slices.Index(names(m.files), name)] }
+	// c is the target of the hard link l so it cannot be skipped
+	if err = m.skip_file(by_name("c")); err == nil {
+		t.Fatalf("Skipping the target of a hard link did not fail")
+	}
+	if err = m.skip_file(by_name("b")); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"b"}, done); diff != "" || m.progress_tracker.total_bytes_to_transfer != 3 {
+		t.Fatalf("Skipped file not done (total: %d):\n%s", m.progress_tracker.total_bytes_to_transfer, diff)
+	}
+	m.toggle_pause(by_name("a"))
+	m.swap_files(by_name("a"), by_name("c"))
+	m.activate_ready_files()
+	if diff := cmp.Diff([]string{"c"}, names(m.active_files)); diff != "" {
+		t.Fatalf("Incorrect active files:\n%s", diff)
+	}
+	by_name("l").data_sent = true
+	if err = m.skip_file(by_name("l")); err == nil {
+		t.Fatalf("Skipping a file whose data was sent did not fail")
+	}
+
+	// the state of the queue is restored when resuming
+	if resume, err = new_resume_manifest(mpath, true); err != nil {
+		t.Fatal(err)
+	}
+	run_with_paths(tdir, tdir, func() {
+		files, err = files_for_send(opts, args)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, num_skipped := resume.restore_queue_state(files)
+	if diff := cmp.Diff([]string{"c", "a", "l"}, names(files)); diff != "" || num_skipped != 1 {
+		t.Fatalf("Queue not restored (%d skipped):\n%s", num_skipped, diff)
+	}
+	if !files[1].paused || files[0].paused {
+		t.Fatalf("Paused files not restored")
+	}
+	// skipped files remain skipped after being resumed again
+	resume.set_queue_state(files)
+	if diff := cmp.Diff([]string{filepath.Join(tdir, "b")}, resume.Skipped); diff != "" {
+		t.Fatalf("Skipped files not preserved:\n%s", diff)
+	}
+}
+
+func TestTransferQueue(t *testing.T) {
+	tdir := t.TempDir()
+	qpath := filepath.Join(tdir, "queue.json")
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	for _, name := range []string{"one", "two", "three"} {
+		if _, err := add_to_transfer_queue(qpath, &Options{Queue: true, Direction: "send"}, []string{name, "dest/"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := add_to_transfer_queue(qpath, &Options{}, []string{"-", "dest/"}); err == nil {
+		t.Fatalf("Queueing a stream did not fail")
+	}
+	ran := []string{}
+	run := func(opts *Options, args []string) (int, error) {
+		if opts.Queue || opts.Direction != "send" {
+			t.Fatalf("Incorrect options for queued transfer: %#v", opts)
+		}
+		ran = append(ran, args[0])
+		if args[0] == "two" {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	if rc, _ := run_transfer_queue(qpath, run); rc != 1 {
+		t.Fatalf("Failed transfer did not stop the queue")
+	}
+	q, err := load_transfer_queue(qpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining := []string{}
+	for _, x := range q.Transfers {
+		remaining = append(remaining, x.Args[0])
+		if x.Cwd != cwd {
+			t.Fatalf("Incorrect working directory for queued transfer: %s", x.Cwd)
+		}
+	}
+	if diff := cmp.Diff([]string{"one", "two"}, ran); diff != "" {
+		t.Fatalf("Incorrect transfers run:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"two", "three"}, remaining); diff != "" {
+		t.Fatalf("Incorrect transfers remaining:\n%s", diff)
+	}
+	ran = nil
+	run = func(opts *Options, args []string) (int, error) {
+		ran = append(ran, args[0])
+		return 0, nil
+	}
+	if rc, err := run_transfer_queue(qpath, run); rc != 0 || err != nil {
+		t.Fatalf("Running the queue failed: %d %v", rc, err)
+	}
+	if _, err = os.Stat(qpath); err == nil {
+		t.Fatalf("The queue was not removed after all transfers succeeded")
+	}
+}
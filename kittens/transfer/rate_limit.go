@@ -0,0 +1,63 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"time"
+
+	"kitty/tools/utils/humanize"
+)
+
+var _ = fmt.Print
+
+// The rate at which data is sent is limited with a token bucket. Tokens, one
+// per byte, accumulate at the configured rate up to a maximum of one second's
+// worth. Sending a chunk consumes tokens, and when the bucket goes into debt
+// the next chunk is sent only after enough time has passed to repay it.
+
+type rate_limiter struct {
+	rate, capacity, tokens float64
+	last_refill            time.Time
+}
+
+func new_rate_limiter(spec string) (*rate_limiter, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	rate, err := humanize.ParseBytes(spec)
+	if err != nil {
+		return nil, err
+	}
+	if rate == 0 {
+		return nil, nil
+	}
+	return &rate_limiter{rate: float64(rate), capacity: float64(rate), tokens: float64(rate)}, nil
+}
+
+func (self *rate_limiter) refill(now time.Time) {
+	if !self.last_refill.IsZero() {
+		self.tokens = min(self.capacity, self.tokens+now.Sub(self.last_refill).Seconds()*self.rate)
+	}
+	self.last_refill = now
+}
+
+func (self *rate_limiter) consume(num_bytes int, now time.Time) {
+	if self == nil {
+		return
+	}
+	self.refill(now)
+	self.tokens -= float64(num_bytes)
+}
+
+// How long to wait before sending more data
+func (self *rate_limiter) wait_time(now time.Time) time.Duration {
+	if self == nil {
+		return 0
+	}
+	self.refill(now)
+	if self.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-self.tokens / self.rate * float64(time.Second))
+}
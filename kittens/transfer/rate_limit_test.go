@@ -0,0 +1,42 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+var _ = fmt.Print
+
+func TestRateLimiter(t *testing.T) {
+	if r, err := new_rate_limiter(""); r != nil || err != nil {
+		t.Fatalf("A rate limiter was created without a rate")
+	}
+	if _, err := new_rate_limiter("5X"); err == nil {
+		t.Fatalf("An invalid rate was accepted")
+	}
+	r, err := new_rate_limiter("1K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	assert_wait := func(expected time.Duration) {
+		t.Helper()
+		if actual := r.wait_time(now); actual != expected {
+			t.Fatalf("Incorrect wait time: %s != %s", expected, actual)
+		}
+	}
+	// a full bucket allows a burst of one second's worth of data
+	r.consume(1024, now)
+	assert_wait(0)
+	r.consume(512, now)
+	assert_wait(500 * time.Millisecond)
+	now = now.Add(500 * time.Millisecond)
+	assert_wait(0)
+	// tokens do not accumulate beyond the capacity of the bucket
+	now = now.Add(time.Hour)
+	r.consume(2048, now)
+	assert_wait(time.Second)
+}
@@ -5,8 +5,10 @@ package transfer
 import (
 	"bytes"
 	"compress/zlib"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"os"
@@ -25,6 +27,7 @@ import (
 	"kitty/tools/utils/humanize"
 	"kitty/tools/wcswidth"
 
+	"github.com/klauspost/compress/zstd"
 	"golang.org/x/exp/slices"
 	"golang.org/x/sys/unix"
 )
@@ -47,7 +50,8 @@ type output_file interface {
 }
 
 type filesystem_file struct {
-	f *os.File
+	f      *os.File
+	sparse bool
 }
 
 func (ff *filesystem_file) tell() (int64, error) {
@@ -55,10 +59,19 @@ func (ff *filesystem_file) tell() (int64, error) {
 }
 
 func (ff *filesystem_file) close() error {
+	if ff.sparse {
+		if err := finish_sparse_write(ff.f); err != nil {
+			ff.f.Close()
+			return err
+		}
+	}
 	return ff.f.Close()
 }
 
 func (ff *filesystem_file) write(data []byte) (int, error) {
+	if ff.sparse {
+		return sparse_write(ff.f, data)
+	}
 	n, err := ff.f.Write(data)
 	if err == nil && n < len(data) {
 		err = io.ErrShortWrite
@@ -89,6 +102,9 @@ func (pf *patch_file) close() (err error) {
 	pf.temp.Close()
 	if err == nil {
 		err = os.Rename(pf.temp.Name(), pf.src.Name())
+	} else {
+		// leave the original file as it was, for resuming the transfer
+		os.Remove(pf.temp.Name())
 	}
 	pf.src = nil
 	pf.temp = nil
@@ -144,6 +160,14 @@ type remote_file struct {
 	compression_type             Compression
 	remote_symlink_value         string
 	actual_file                  output_file
+	already_transferred          bool
+	rel_path                     string
+	is_stream, sparse            bool
+	xattrs                       string
+	// the directory into which the top level paths are received, empty if
+	// the destination was specified explicitly
+	dest_root     string
+	stream_digest hash.Hash
 }
 
 func (self *remote_file) close() (err error) {
@@ -171,7 +195,15 @@ func (self *remote_file) Write(data []byte) (n int, err error) {
 		self.remote_symlink_value += string(data)
 		return len(data), nil
 	case FileType_regular:
+		if self.actual_file == nil && self.is_stream {
+			self.stream_digest = sha256.New()
+			self.actual_file = &stream_file{w: io.MultiWriter(os.Stdout, self.stream_digest)}
+		}
 		if self.actual_file == nil {
+			// symbolic links are created only once all data has been received
+			if err = check_for_symlink_escape(self.dest_root, self.expanded_local_path, utils.NewSet[string]()); err != nil {
+				return 0, err
+			}
 			parent := filepath.Dir(self.expanded_local_path)
 			if parent != "" {
 				if err = os.MkdirAll(parent, 0o755); err != nil {
@@ -188,7 +220,7 @@ func (self *remote_file) Write(data []byte) (n int, err error) {
 				if ff, err := os.Create(self.expanded_local_path); err != nil {
 					return 0, err
 				} else {
-					f := filesystem_file{f: ff}
+					f := filesystem_file{f: ff, sparse: self.sparse}
 					self.actual_file = &f
 				}
 			}
@@ -249,7 +281,10 @@ func syscall_mode(i os.FileMode) (o uint32) {
 	return
 }
 
-func (self *remote_file) apply_metadata() {
+func (self *remote_file) apply_metadata(xattr_kinds string) {
+	if self.is_stream {
+		return
+	}
 	t := unix.NsecToTimespec(int64(self.mtime))
 	for {
 		if err := unix.UtimesNanoAt(unix.AT_FDCWD, self.expanded_local_path, []unix.Timespec{t, t}, unix.AT_SYMLINK_NOFOLLOW); err == nil || !(errors.Is(err, unix.EINTR) || errors.Is(err, unix.EAGAIN)) {
@@ -265,9 +300,20 @@ func (self *remote_file) apply_metadata() {
 	} else {
 		_ = os.Chmod(self.expanded_local_path, self.permissions)
 	}
+	if self.xattrs != "" {
+		apply_xattrs(self.expanded_local_path, self.xattrs, xattr_kinds)
+	}
+}
+
+func new_zstd_reader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
 }
 
-func new_remote_file(opts *Options, ftc *FileTransmissionCommand, file_id uint64) (*remote_file, error) {
+func new_remote_file(opts *Options, ftc *FileTransmissionCommand, file_id uint64, compression Compression) (*remote_file, error) {
 	spec_id, err := strconv.Atoi(ftc.File_id)
 	if err != nil {
 		return nil, err
@@ -276,9 +322,13 @@ func new_remote_file(opts *Options, ftc *FileTransmissionCommand, file_id uint64
 		expected_size: ftc.Size, ftype: ftc.Ftype, mtime: ftc.Mtime, spec_id: spec_id, file_id: strconv.FormatUint(file_id, 10),
 		permissions: ftc.Permissions, remote_path: ftc.Name, display_name: wcswidth.StripEscapeCodes(ftc.Name),
 		remote_id: ftc.Status, remote_target: string(ftc.Data), parent: ftc.Parent,
+		xattrs: ftc.Xattrs, sparse: ftc.Sparse != 0 && ftc.Ftype == FileType_regular,
 	}
 	compression_capable := ftc.Ftype == FileType_regular && ftc.Size > 4096 && should_be_compressed(ftc.Name, opts.Compress)
-	if compression_capable {
+	if compression_capable && compression == Compression_zstd {
+		ans.decompressor = utils.NewStreamDecompressor(new_zstd_reader, ans)
+		ans.compression_type = Compression_zstd
+	} else if compression_capable {
 		ans.decompressor = utils.NewStreamDecompressor(zlib.NewReader, ans)
 		ans.compression_type = Compression_zlib
 	} else {
@@ -351,6 +401,13 @@ type manager struct {
 	files_to_be_transferred map[string]*remote_file
 	state                   state
 	progress_tracker        receive_progress_tracker
+	resume                  *resume_manifest
+	num_up_to_date          int
+	files_to_delete         []string
+	compression             Compression
+	rsync_options           *rsync_options
+	cipher                  *transfer_cipher
+	skipped_links           []string
 }
 
 type transmit_iterator = func(queue_write func(string) loop.IdType) (loop.IdType, error)
@@ -359,6 +416,7 @@ type sigwriter struct {
 	wid                     loop.IdType
 	file_id, prefix, suffix string
 	q                       func(string) loop.IdType
+	cipher                  *transfer_cipher
 	amt                     int64
 	b                       bytes.Buffer
 }
@@ -375,7 +433,7 @@ func (self *sigwriter) flush() {
 	frame := len(self.prefix) + len(self.suffix)
 	split_for_transfer(self.b.Bytes(), self.file_id, false, func(ftc *FileTransmissionCommand) {
 		self.q(self.prefix)
-		data := ftc.Serialize(false)
+		data := self.cipher.encrypt_command(ftc).Serialize(false)
 		self.q(data)
 		self.wid = self.q(self.suffix)
 		self.amt += int64(frame + len(data))
@@ -392,7 +450,7 @@ func (self *manager) request_files() transmit_iterator {
 		for pos < len(self.files) {
 			f = self.files[pos]
 			pos++
-			if f.ftype == FileType_directory || (f.ftype == FileType_link && f.remote_target != "") {
+			if f.ftype == FileType_directory || (f.ftype == FileType_link && f.remote_target != "") || f.already_transferred {
 				f = nil
 			} else {
 				break
@@ -420,8 +478,8 @@ func (self *manager) request_files() transmit_iterator {
 			}
 			defer fsf.Close()
 			f.expect_diff = true
-			f.patcher = rsync.NewPatcher(f.expected_size)
-			output := sigwriter{q: queue_write, file_id: f.file_id, prefix: self.prefix, suffix: self.suffix}
+			f.patcher = self.rsync_options.new_patcher(f.expected_size)
+			output := sigwriter{q: queue_write, file_id: f.file_id, prefix: self.prefix, suffix: self.suffix, cipher: self.cipher}
 			s_it := f.patcher.CreateSignatureIterator(fsf, &output)
 			for {
 				err = s_it()
@@ -453,16 +511,23 @@ type handler struct {
 	max_name_length       int
 	transmit_iterator     transmit_iterator
 	last_data_write_id    loop.IdType
+	verifier              *verifier
+	destination_query     *destination_query
+	dry_run               *dry_run_report
 }
 
 func (self *manager) send(c FileTransmissionCommand, send func(string) loop.IdType) loop.IdType {
 	send(self.prefix)
-	send(c.Serialize(false))
+	send(self.cipher.encrypt_command(&c).Serialize(false))
 	return send(self.suffix)
 }
 
 func (self *manager) start_transfer(send func(string) loop.IdType) {
-	self.send(FileTransmissionCommand{Action: Action_receive, Bypass: self.bypass, Size: int64(len(self.spec))}, send)
+	self.send(FileTransmissionCommand{
+		Action: Action_receive, Bypass: self.bypass, Size: int64(len(self.spec)),
+		Xattrs: xattr_kinds(self.cli_opts), Sparse: utils.IfElse(self.cli_opts.Sparse, int64(1), 0), Pubkey: self.cipher.pubkey(),
+		Follow_symlinks: utils.IfElse(self.cli_opts.Links == links_follow, int64(1), 0), Relay: self.cli_opts.Relay,
+	}, send)
 	for i, x := range self.spec {
 		self.send(FileTransmissionCommand{Action: Action_file, File_id: strconv.Itoa(i), Name: x}, send)
 	}
@@ -498,7 +563,11 @@ func (self *manager) finalize_transfer() (err error) {
 	for _, f := range self.files {
 		rid_map[f.remote_id] = f
 	}
+	created_links := utils.NewSet[string]()
 	for _, f := range self.files {
+		if err = check_for_symlink_escape(f.dest_root, f.expanded_local_path, created_links); err != nil {
+			return err
+		}
 		switch f.ftype {
 		case FileType_directory:
 			if err = os.MkdirAll(f.expanded_local_path, 0o755); err != nil {
@@ -524,7 +593,7 @@ func (self *manager) finalize_transfer() (err error) {
 					return fmt.Errorf(`Symbolic link with remote id: {%s} not found`, f.remote_target)
 				}
 				lt = tgt.expanded_local_path
-				if !strings.HasPrefix(f.remote_symlink_value, "/") {
+				if !strings.HasPrefix(f.remote_symlink_value, "/") || self.cli_opts.Links == links_munge {
 					if lt, err = filepath.Rel(filepath.Dir(f.expanded_local_path), lt); err != nil {
 						return fmt.Errorf(`Could not make symlink relative with error: %w`, err)
 					}
@@ -533,6 +602,9 @@ func (self *manager) finalize_transfer() (err error) {
 			if lt == "" {
 				return fmt.Errorf("Symlink %s sent without target", f.expanded_local_path)
 			}
+			if f.remote_target == "" && f.dest_root != "" && self.cli_opts.Links == links_munge {
+				lt = munge_symlink_target(f.dest_root, f.expanded_local_path, lt)
+			}
 			os.Remove(f.expanded_local_path)
 			if err = os.MkdirAll(filepath.Dir(f.expanded_local_path), 0o755); err != nil {
 				return fmt.Errorf("Failed to create directory with error: %w", err)
@@ -540,18 +612,29 @@ func (self *manager) finalize_transfer() (err error) {
 			if err = os.Symlink(lt, f.expanded_local_path); err != nil {
 				return fmt.Errorf(`Failed to create symlink with error: %w`, err)
 			}
+			created_links.Add(filepath.Clean(f.expanded_local_path))
 		}
-		f.apply_metadata()
+		f.apply_metadata(xattr_kinds(self.cli_opts))
 	}
 	return
 }
 
 func (self *manager) on_file_transfer_response(ftc *FileTransmissionCommand) (err error) {
+	if err = self.cipher.decrypt_command(ftc); err != nil {
+		return err
+	}
 	switch self.state {
 	case state_waiting_for_permission:
 		if ftc.Action == Action_status {
 			if ftc.Status == `OK` {
+				if err = self.cipher.check_permission_granted(ftc); err != nil {
+					return err
+				}
 				self.state = state_waiting_for_file_metadata
+				// terminals that support zstd say so when granting permission
+				if ftc.Compression == Compression_zstd {
+					self.compression = Compression_zstd
+				}
 			} else {
 				return unicode_input.ErrCanceledByUser
 			}
@@ -588,7 +671,7 @@ func (self *manager) on_file_transfer_response(ftc *FileTransmissionCommand) (er
 			}
 			self.spec_counts[fid] += 1
 			self.file_id_counter++
-			if rf, err := new_remote_file(self.cli_opts, ftc, self.file_id_counter); err == nil {
+			if rf, err := new_remote_file(self.cli_opts, ftc, self.file_id_counter, self.compression); err == nil {
 				self.files = append(self.files, rf)
 			} else {
 				return err
@@ -608,6 +691,9 @@ func (self *manager) on_file_transfer_response(ftc *FileTransmissionCommand) (er
 			} else {
 				self.progress_tracker.file_written(f, amt_written, is_last)
 			}
+			if f.ftype == FileType_regular {
+				self.resume.update(f.expanded_local_path, f.expected_size, int64(f.mtime), f.written_bytes, is_last)
+			}
 			if is_last {
 				delete(self.files_to_be_transferred, ftc.File_id)
 				if len(self.files_to_be_transferred) == 0 {
@@ -635,12 +721,20 @@ func (self *tree_node) add_child(f *remote_file) *tree_node {
 	return &c
 }
 
-func walk_tree(root *tree_node, cb func(*tree_node) error) error {
+// rel_dir is the path of root relative to the directory containing the top
+// level path, empty for the top level, whose children are never filtered.
+// Children excluded by filter are skipped along with their descendants.
+func walk_tree(root *tree_node, filter *file_filter, rel_dir string, cb func(*tree_node) error) error {
 	for _, c := range root.added_files {
+		rel_path := rel_dir + filepath.Base(c.entry.remote_path)
+		if rel_dir != "" && filter.is_excluded(rel_path, c.entry.ftype == FileType_directory) {
+			continue
+		}
+		c.entry.rel_path = rel_path
 		if err := cb(c); err != nil {
 			return err
 		}
-		if err := walk_tree(c, cb); err != nil {
+		if err := walk_tree(c, filter, rel_path+"/", cb); err != nil {
 			return err
 		}
 	}
@@ -686,6 +780,10 @@ func isdir(path string) bool {
 }
 
 func files_for_receive(opts *Options, dest string, files []*remote_file, remote_home string, specs []string) (ans []*remote_file, err error) {
+	filter, err := new_file_filter(opts)
+	if err != nil {
+		return nil, err
+	}
 	spec_map := make(map[int][]*remote_file)
 	for _, f := range files {
 		spec_map[f.spec_id] = append(spec_map[f.spec_id], f)
@@ -711,7 +809,8 @@ func files_for_receive(opts *Options, dest string, files []*remote_file, remote_
 		for spec_id, files_for_spec := range spec_map {
 			spec := spec_paths[spec_id]
 			tree := make_tree(files_for_spec, filepath.Dir(expand_home(spec)))
-			if err = walk_tree(tree, func(x *tree_node) error {
+			if err = walk_tree(tree, filter, "", func(x *tree_node) error {
+				x.entry.dest_root = tree.entry.expanded_local_path
 				ans = append(ans, x.entry)
 				return nil
 			}); err != nil {
@@ -723,12 +822,21 @@ func files_for_receive(opts *Options, dest string, files []*remote_file, remote_
 		for _, x := range spec_map {
 			number_of_source_files += len(x)
 		}
+		if dest == stream_path {
+			f := files[0]
+			if number_of_source_files != 1 || f.ftype != FileType_regular {
+				return nil, fmt.Errorf("Only a single file can be written to STDOUT")
+			}
+			f.is_stream, f.expanded_local_path, f.display_name = true, stream_path, f.display_name+" (to STDOUT)"
+			return []*remote_file{f}, nil
+		}
 		dest_is_dir := strings.HasSuffix(dest, "/") || number_of_source_files > 1 || isdir(dest)
 		for _, files_for_spec := range spec_map {
 			if dest_is_dir {
 				dest_path := filepath.Join(dest, filepath.Base(files_for_spec[0].remote_path))
 				tree := make_tree(files_for_spec, filepath.Dir(expand_home(dest_path)))
-				if err = walk_tree(tree, func(x *tree_node) error {
+				if err = walk_tree(tree, filter, "", func(x *tree_node) error {
+					x.entry.dest_root = tree.entry.expanded_local_path
 					ans = append(ans, x.entry)
 					return nil
 				}); err != nil {
@@ -741,6 +849,9 @@ func files_for_receive(opts *Options, dest string, files []*remote_file, remote_
 			}
 		}
 	}
+	if filter != nil {
+		detach_links_to_excluded_files(ans)
+	}
 	return
 }
 
@@ -748,14 +859,35 @@ func (self *manager) collect_files() (err error) {
 	if self.files, err = files_for_receive(self.cli_opts, self.dest, self.files, self.remote_home, self.spec); err != nil {
 		return err
 	}
+	if self.cli_opts.Links == links_skip {
+		self.files, self.skipped_links = skip_symlinks(self.files)
+	}
 	self.progress_tracker.total_size_of_all_files = 0
 	for _, f := range self.files {
 		if f.ftype != FileType_directory && f.ftype != FileType_link {
+			if f.ftype == FileType_regular {
+				if self.cli_opts.Sync && f.is_up_to_date() {
+					f.already_transferred = true
+					self.num_up_to_date++
+					continue
+				}
+				if self.resume.is_done(f.expanded_local_path, f.expected_size, int64(f.mtime)) {
+					if s, err := os.Stat(f.expanded_local_path); err == nil && s.Size() == f.expected_size {
+						f.already_transferred = true
+						continue
+					}
+				}
+			}
 			self.files_to_be_transferred[f.file_id] = f
 			self.progress_tracker.total_size_of_all_files += utils.Max(0, f.expected_size)
 		}
 	}
 	self.progress_tracker.total_bytes_to_transfer = self.progress_tracker.total_size_of_all_files
+	if self.cli_opts.Sync && self.cli_opts.Delete {
+		// the filter is valid as it was used by files_for_receive() above
+		filter, _ := new_file_filter(self.cli_opts)
+		self.files_to_delete = extraneous_files(self.files, filter)
+	}
 	return nil
 }
 
@@ -787,8 +919,34 @@ func (self *handler) print_check_paths() {
 	self.print_continue_msg()
 }
 
+func (self *handler) print_sync_summary() {
+	if self.check_paths_printed {
+		return
+	}
+	self.check_paths_printed = true
+	self.lp.Println(`The following changes will be made:`)
+	for _, df := range self.manager.files {
+		if df.ftype == FileType_directory || df.already_transferred {
+			continue
+		}
+		self.lp.QueueWriteString(self.ctx.Prettify(fmt.Sprintf(":%s:`%s` ", df.ftype.Color(), df.ftype.ShortText())))
+		self.lp.Println("", df.display_name, "→", df.expanded_local_path)
+	}
+	for _, path := range self.manager.files_to_delete {
+		self.lp.Println(self.ctx.BrightRed(`del`), "", path)
+	}
+	self.lp.Println(fmt.Sprintf(`Transferring %d file(s) of total size: %s, %d file(s) are unchanged, deleting %d file(s)`,
+		len(self.manager.files_to_be_transferred), humanize.Size(self.manager.progress_tracker.total_size_of_all_files),
+		self.manager.num_up_to_date, len(self.manager.files_to_delete)))
+	self.print_continue_msg()
+}
+
 func (self *handler) confirm_paths() {
-	self.print_check_paths()
+	if self.cli_opts.Sync {
+		self.print_sync_summary()
+	} else {
+		self.print_check_paths()
+	}
 }
 
 func (self *handler) transmit_one() {
@@ -810,6 +968,18 @@ func (self *handler) transmit_one() {
 
 func (self *handler) start_transfer() {
 	self.transmit_started = true
+	if len(self.manager.files_to_delete) > 0 {
+		if err := delete_files(self.manager.files_to_delete); err != nil {
+			self.abort_with_error(err)
+			return
+		}
+	}
+	if len(self.manager.files_to_be_transferred) == 0 {
+		if err := self.manager.finalize_transfer(); err != nil {
+			self.abort_with_error(err)
+		}
+		return
+	}
 	n := len(self.manager.files)
 	msg := `Transmitting signature of`
 	if self.manager.use_rsync {
@@ -841,6 +1011,13 @@ func (self *handler) on_file_transfer_response(ftc *FileTransmissionCommand) (er
 	if self.quit_after_write_code > -1 || self.manager.state == state_canceled {
 		return
 	}
+	if ftc.Action == Action_verify {
+		if self.verifier != nil {
+			self.verifier.on_response(ftc)
+			return self.finish_transfer()
+		}
+		return
+	}
 	transfer_started := self.manager.state == state_transferring
 	if merr := self.manager.on_file_transfer_response(ftc); merr != nil {
 		if merr == unicode_input.ErrCanceledByUser {
@@ -851,6 +1028,15 @@ func (self *handler) on_file_transfer_response(ftc *FileTransmissionCommand) (er
 		return
 	}
 	if !transfer_started && self.manager.state == state_transferring {
+		if self.destination_query != nil {
+			report, qerr := self.destination_query.report(&self.manager, self.cli_opts)
+			if qerr != nil {
+				self.abort_with_error(qerr)
+				return
+			}
+			self.dry_run = report
+			return self.finish_dry_run()
+		}
 		if len(self.manager.failed_specs) > 0 {
 			self.print_err(fmt.Errorf(`Failed to process some sources:`))
 			for spec_id, msg := range self.manager.failed_specs {
@@ -877,18 +1063,21 @@ func (self *handler) on_file_transfer_response(ftc *FileTransmissionCommand) (er
 			self.abort_with_error(merr)
 			return
 		}
-		if self.cli_opts.ConfirmPaths {
+		for _, x := range self.manager.skipped_links {
+			self.lp.Println(self.ctx.Yellow("Skipping symbolic link:"), x)
+		}
+		if self.cli_opts.DryRun {
+			self.dry_run = receive_dry_run_report(&self.manager)
+			return self.finish_dry_run()
+		}
+		if self.cli_opts.ConfirmPaths || self.cli_opts.Sync {
 			self.confirm_paths()
 		} else {
 			self.start_transfer()
 		}
 	}
 	if self.manager.transfer_done {
-		self.manager.send(FileTransmissionCommand{Action: Action_finish}, self.lp.QueueWriteString)
-		self.quit_after_write_code = 0
-		if err = self.refresh_progress(0); err != nil {
-			return err
-		}
+		return self.finish_transfer()
 	} else if self.transmit_started {
 		if err = self.refresh_progress(0); err != nil {
 			return err
@@ -897,6 +1086,48 @@ func (self *handler) on_file_transfer_response(ftc *FileTransmissionCommand) (er
 	return
 }
 
+func (self *handler) start_verification() {
+	self.verifier = new_verifier()
+	for _, f := range self.manager.files {
+		if f.ftype == FileType_regular && !f.already_transferred {
+			var digest []byte
+			if f.stream_digest != nil {
+				digest = f.stream_digest.Sum(nil)
+			}
+			self.verifier.add(f.file_id, f.display_name, f.expanded_local_path, digest)
+		}
+	}
+	for _, ftc := range self.verifier.requests() {
+		self.manager.send(*ftc, self.lp.QueueWriteString)
+	}
+	self.verifier.compute_local_digests(self.lp.WakeupMainThread)
+}
+
+func (self *handler) finish_transfer() error {
+	if self.quit_after_write_code > -1 || self.manager.state == state_canceled {
+		return nil
+	}
+	if self.cli_opts.Verify {
+		// the transfer must be finished only after the terminal has responded to all verify commands
+		if self.verifier == nil {
+			self.start_verification()
+		}
+		if !self.verifier.is_complete() {
+			return self.refresh_progress(0)
+		}
+	}
+	self.manager.send(FileTransmissionCommand{Action: Action_finish}, self.lp.QueueWriteString)
+	self.quit_after_write_code = 0
+	return self.refresh_progress(0)
+}
+
+// End the transfer without having transferred anything
+func (self *handler) finish_dry_run() error {
+	self.manager.send(FileTransmissionCommand{Action: Action_finish}, self.lp.QueueWriteString)
+	self.quit_after_write_code = 0
+	return nil
+}
+
 func (self *handler) on_writing_finished(msg_id loop.IdType, has_pending_writes bool) (err error) {
 	if self.quit_after_write_code > -1 {
 		self.lp.Quit(self.quit_after_write_code)
@@ -1037,6 +1268,9 @@ func (self *handler) on_text(text string, from_key_event, in_bracketed_paste boo
 		switch strings.ToLower(text) {
 		case "y":
 			self.start_transfer()
+			if self.manager.transfer_done {
+				return self.finish_transfer()
+			}
 			return nil
 		case "n":
 			self.abort_with_error(fmt.Errorf(`Canceled by user`))
@@ -1068,7 +1302,7 @@ func (self *handler) on_key_event(ev *loop.KeyEvent) error {
 	return nil
 }
 
-func receive_loop(opts *Options, spec []string, dest string) (err error, rc int) {
+func receive_loop(opts *Options, spec []string, dest string, resume *resume_manifest, ro *rsync_options, dq *destination_query) (err error, rc int) {
 	lp, err := loop.New(loop.NoAlternateScreen, loop.NoRestoreColors)
 	if err != nil {
 		return err, 1
@@ -1076,17 +1310,21 @@ func receive_loop(opts *Options, spec []string, dest string) (err error, rc int)
 
 	handler := handler{
 		lp: lp, quit_after_write_code: -1, cli_opts: opts, spinner: tui.NewSpinner("dots"),
-		ctx: markup.New(true),
+		ctx: markup.New(true), destination_query: dq,
 		manager: manager{
-			request_id: random_id(), spec: spec, dest: dest, bypass: opts.PermissionsBypass, use_rsync: opts.TransmitDeltas,
+			request_id: random_id(), spec: spec, dest: dest, bypass: opts.PermissionsBypass, use_rsync: opts.TransmitDeltas || opts.Resume || opts.Sync,
 			failed_specs: make(map[int]string, len(spec)), spec_counts: make(map[int]int, len(spec)),
-			suffix: "\x1b\\", cli_opts: opts, files_to_be_transferred: make(map[string]*remote_file),
+			suffix: "\x1b\\", cli_opts: opts, files_to_be_transferred: make(map[string]*remote_file), resume: resume,
+			rsync_options: ro,
 		},
 	}
 	for i := range spec {
 		handler.manager.spec_counts[i] = 0
 	}
 	handler.manager.prefix = fmt.Sprintf("\x1b]%d;id=%s;", kitty.FileTransferCode, handler.manager.request_id)
+	if handler.manager.cipher, err = new_transfer_cipher(opts); err != nil {
+		return err, 1
+	}
 	if handler.manager.bypass != `` {
 		if handler.manager.bypass, err = encode_bypass(handler.manager.request_id, handler.manager.bypass); err != nil {
 			return err, 1
@@ -1108,6 +1346,13 @@ func receive_loop(opts *Options, spec []string, dest string) (err error, rc int)
 	lp.OnSIGINT = handler.on_interrupt
 	lp.OnSIGTERM = handler.on_sigterm
 	lp.OnWriteComplete = handler.on_writing_finished
+	lp.OnWakeup = func() error {
+		// the local digests of the files being verified have been computed
+		if handler.verifier != nil {
+			return handler.finish_transfer()
+		}
+		return nil
+	}
 	lp.OnText = handler.on_text
 	lp.OnKeyEvent = handler.on_key_event
 	lp.OnResize = func(old_sz, new_sz loop.ScreenSize) error {
@@ -1140,6 +1385,9 @@ func receive_loop(opts *Options, spec []string, dest string) (err error, rc int)
 		}
 	}()
 
+	if !opts.DryRun {
+		resume.finish(err == nil && lp.ExitCode() == 0 && handler.manager.transfer_done)
+	}
 	if err != nil {
 		return err, 1
 	}
@@ -1167,23 +1415,61 @@ func receive_loop(opts *Options, spec []string, dest string) (err error, rc int)
 	if tsf > 0 && dsz+ssz > 0 && rc == 0 {
 		print_rsync_stats(tsf, dsz, ssz)
 	}
+	if handler.dry_run != nil && rc == 0 {
+		handler.dry_run.print(os.Stdout, handler.ctx)
+	}
+	if handler.verifier != nil && handler.verifier.is_complete() && rc == 0 {
+		// STDOUT might be carrying the received data
+		if handler.verifier.print_report(utils.IfElse(dest == stream_path, os.Stderr, os.Stdout), handler.ctx) > 0 {
+			rc = 1
+		}
+	}
 	return
 }
 
 func receive_main(opts *Options, args []string) (err error, rc int) {
 	spec := args
 	var dest string
-	switch opts.Mode {
-	case "mirror":
+	switch {
+	case opts.Relay != "":
+		// the terminal offers all the relayed files as the result of a single spec
+		spec, dest = []string{opts.Relay}, args[0]
+	case opts.Mode == "mirror":
 		if len(args) < 1 {
 			return fmt.Errorf("Must specify at least one file to transfer"), 1
 		}
-	case "normal":
+		if slices.Contains(args, stream_path) {
+			return fmt.Errorf("Cannot use %s to stream data in mirror mode", stream_path), 1
+		}
+	case opts.Mode == "normal":
 		if len(args) < 2 {
 			return fmt.Errorf("Must specify at least one source and a destination file to transfer"), 1
 		}
 		dest = args[len(args)-1]
 		spec = args[:len(args)-1]
 	}
-	return receive_loop(opts, spec, dest)
+	if slices.Contains(spec, stream_path) {
+		return fmt.Errorf("Reading from STDIN is only possible when sending files"), 1
+	}
+	if dest == stream_path {
+		if len(spec) != 1 {
+			return fmt.Errorf("When writing to STDOUT, only a single file can be received"), 1
+		}
+		if err = check_stream_options(opts); err != nil {
+			return err, 1
+		}
+	}
+	ro, err := new_rsync_options(opts)
+	if err != nil {
+		return err, 1
+	}
+	resume, err := new_resume_manifest(resume_manifest_path(opts, args), opts.Resume)
+	if err != nil {
+		return err, 1
+	}
+	if dest == stream_path {
+		// streams cannot be resumed
+		resume = nil
+	}
+	return receive_loop(opts, spec, dest, resume, ro, nil)
 }
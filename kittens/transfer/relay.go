@@ -0,0 +1,91 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+
+	"kitty/tools/utils"
+
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+// With --relay, files are copied between two computers that cannot connect to
+// each other, through the terminal, which is connected to both. The kitten
+// sending the files runs in one window and the kitten receiving them in
+// another, both with the same relay name, in the relay key of their send and
+// receive commands. The terminal forwards the data of the files from the
+// sender to the receiver as it arrives, without writing anything. The sender
+// includes the number of files in its send command and the sizes of files and
+// the targets of links in their metadata, so that once the terminal has the
+// metadata of all the files, it can offer them to the receiver, as though they
+// were the result of the single file spec the receiver sends, the relay name.
+
+func check_relay_options(opts *Options, is_send bool, args []string) error {
+	if opts.Relay == "" {
+		return nil
+	}
+	name := ""
+	switch {
+	case opts.Mode == "mirror":
+		name = "--mode=mirror"
+	case opts.Sync:
+		name = "--sync"
+	case opts.Resume:
+		name = "--resume"
+	case opts.TransmitDeltas:
+		name = "--transmit-deltas"
+	case opts.Verify:
+		name = "--verify"
+	case opts.DryRun:
+		name = "--dry-run"
+	case opts.Queue || opts.RunQueue:
+		name = "--queue"
+	case opts.ConfirmPaths && is_send:
+		// files are started only when the receiver asks for them
+		name = "--confirm-paths"
+	}
+	if name != "" {
+		return fmt.Errorf("The %s option cannot be used with --relay", name)
+	}
+	if slices.Contains(args, stream_path) {
+		return fmt.Errorf("Cannot use %s to stream data with --relay", stream_path)
+	}
+	if !is_send && len(args) != 1 {
+		return fmt.Errorf("When receiving relayed files, only the destination must be specified")
+	}
+	return nil
+}
+
+// The relayed files are named by their paths on this computer, as only the
+// structure of the names matters to the receiver
+func process_relayed_files(opts *Options, args []string, filter *file_filter) (ans []*File, err error) {
+	counter := 0
+	paths := utils.Map(func(x string) string { return abspath(expand_home(x)) }, args)
+	return process(opts, paths, "", &counter, filter, "")
+}
+
+// Add the metadata the terminal needs to offer the file to the receiver
+func add_relay_metadata(f *File, ftc *FileTransmissionCommand) {
+	switch f.file_type {
+	case FileType_regular:
+		ftc.Size = f.file_size
+	case FileType_symlink:
+		ftc.Data = []byte(f.symbolic_link_target)
+	case FileType_link:
+		ftc.Data = []byte(f.hard_link_target)
+	}
+}
+
+// The terminal acknowledges relayed data only once it has been passed on to
+// the receiver, so the sender stops sending while too much of it is
+// unacknowledged, instead of letting it pile up in the terminal when the
+// receiver is slower than the sender.
+const max_unacknowledged_relay_bytes = 4 * 1024 * 1024
+
+func (self *SendManager) relay_is_backed_up() bool {
+	p := &self.progress_tracker
+	return self.relay != "" && p.total_transferred-p.total_reported_progress >= max_unacknowledged_relay_bytes
+}
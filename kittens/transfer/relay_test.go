@@ -0,0 +1,76 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestRelay(t *testing.T) {
+	opts := &Options{Relay: "r", Mode: "normal"}
+	if err := check_relay_options(opts, true, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := check_relay_options(opts, false, []string{"a", "b"}); err == nil {
+		t.Fatalf("Receiving relayed files with more than one argument did not fail")
+	}
+	if err := check_relay_options(opts, true, []string{"a", stream_path}); err == nil {
+		t.Fatalf("Relaying a stream did not fail")
+	}
+	opts.ConfirmPaths = true
+	if err := check_relay_options(opts, true, []string{"a"}); err == nil {
+		t.Fatalf("Sending relayed files with --confirm-paths did not fail")
+	}
+	if err := check_relay_options(opts, false, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	opts.Sync = true
+	if err := check_relay_options(opts, false, []string{"a"}); err == nil {
+		t.Fatalf("Receiving relayed files with --sync did not fail")
+	}
+
+	tdir := t.TempDir()
+	os.Mkdir(filepath.Join(tdir, "d"), 0o700)
+	os.WriteFile(filepath.Join(tdir, "d", "f"), []byte("hello"), 0o600)
+	os.Link(filepath.Join(tdir, "d", "f"), filepath.Join(tdir, "d", "h"))
+	os.Symlink("f", filepath.Join(tdir, "d", "s"))
+	opts = &Options{Relay: "r", Mode: "normal", Links: links_preserve}
+	files, err := files_for_send(opts, []string{filepath.Join(tdir, "d") + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := map[string]string{}
+	for _, f := range files {
+		ftc := f.metadata_command(false, Compression_zlib)
+		add_relay_metadata(f, ftc)
+		actual[filepath.Base(ftc.Name)] = fmt.Sprintf("%s:%d:%s", ftc.Ftype, ftc.Size, ftc.Data)
+	}
+	fid := files[1].file_id
+	expected := map[string]string{
+		"d": "directory:0:", "f": "regular:5:", "h": "link:0:fid:" + fid, "s": "symlink:0:fid:" + fid,
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Fatalf("Incorrect metadata for relayed files:\n%s", diff)
+	}
+
+	m := SendManager{relay: "r"}
+	m.progress_tracker.total_transferred = max_unacknowledged_relay_bytes
+	if !m.relay_is_backed_up() {
+		t.Fatalf("Unacknowledged relayed data did not stop the sender")
+	}
+	m.progress_tracker.total_reported_progress = 1
+	if m.relay_is_backed_up() {
+		t.Fatalf("Acknowledged relayed data did not restart the sender")
+	}
+	m.relay, m.progress_tracker.total_reported_progress = "", 0
+	if m.relay_is_backed_up() {
+		t.Fatalf("Sending without a relay waited for acknowledgements")
+	}
+}
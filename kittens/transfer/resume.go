@@ -0,0 +1,146 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The progress of every transfer is recorded in a manifest in the cache
+// directory, keyed by the command line of the transfer, so that an
+// interrupted transfer can be continued with --resume. Files that were
+// completely transferred are skipped and the rest are transferred with the
+// rsync algorithm so that the data already present on the receiving side is
+// re-used. The manifest is removed once the transfer succeeds.
+
+type resume_entry struct {
+	// the size and modification time, in nanoseconds, of the source file
+	Size        int64 `json:"size"`
+	Mtime       int64 `json:"mtime"`
+	Transferred int64 `json:"transferred"`
+	Done        bool  `json:"done"`
+}
+
+type resume_manifest struct {
+	Files map[string]*resume_entry `json:"files"`
+	// the order of the files in the queue and the files that were paused or skipped
+	Queue   []string `json:"queue,omitempty"`
+	Paused  []string `json:"paused,omitempty"`
+	Skipped []string `json:"skipped,omitempty"`
+
+	path       string
+	last_saved time.Time
+}
+
+const resume_manifest_save_interval = time.Second
+
+func resume_manifest_path(opts *Options, args []string) string {
+	direction := utils.IfElse(opts.Direction == "send" || opts.Direction == "download", "send", "receive")
+	h := sha256.Sum256(utils.UnsafeStringToBytes(strings.Join(append([]string{direction, opts.Mode, cwd_path()}, args...), "\x00")))
+	return filepath.Join(utils.CacheDir(), "transfer-resume", hex.EncodeToString(h[:16])+".json")
+}
+
+// The manifest for the transfer, with the progress of the previous attempt at
+// it when resuming
+func new_resume_manifest(path string, resume bool) (*resume_manifest, error) {
+	ans := &resume_manifest{path: path, Files: make(map[string]*resume_entry)}
+	if !resume {
+		return ans, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			fmt.Println("No interrupted transfer found to resume, transferring all files")
+			return ans, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, ans); err != nil {
+		return nil, fmt.Errorf("The record of the interrupted transfer at %s is invalid with error: %w", path, err)
+	}
+	if ans.Files == nil {
+		ans.Files = make(map[string]*resume_entry)
+	}
+	return ans, nil
+}
+
+// Whether the file was completely transferred and has not changed since
+func (self *resume_manifest) is_done(path string, size int64, mtime int64) bool {
+	if self == nil {
+		return false
+	}
+	e := self.Files[path]
+	return e != nil && e.Done && e.Size == size && e.Mtime == mtime
+}
+
+func (self *resume_manifest) update(path string, size int64, mtime int64, transferred int64, done bool) {
+	if self == nil {
+		return
+	}
+	self.Files[path] = &resume_entry{Size: size, Mtime: mtime, Transferred: transferred, Done: done}
+	if time.Since(self.last_saved) >= resume_manifest_save_interval {
+		_ = self.save()
+	}
+}
+
+func (self *resume_manifest) save() error {
+	self.last_saved = time.Now()
+	data, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(self.path), 0o700); err != nil {
+		return err
+	}
+	return utils.AtomicWriteFile(self.path, data, 0o600)
+}
+
+// Remove the manifest if the transfer succeeded, otherwise save it so that
+// the transfer can be resumed
+func (self *resume_manifest) finish(succeeded bool) {
+	if self == nil {
+		return
+	}
+	if succeeded {
+		os.Remove(self.path)
+		return
+	}
+	if (len(self.Files) > 0 || len(self.Queue) > 0) && self.save() == nil {
+		fmt.Fprintln(os.Stderr, "Run the same command with the --resume option to continue the transfer")
+	}
+}
+
+// Remove the files that were completely transferred by a previous attempt,
+// keeping files that are the targets of links
+func (self *resume_manifest) remove_done_files(files []*File) (ans []*File, num_done int) {
+	link_targets := utils.NewSet[string]()
+	for _, f := range files {
+		for _, tgt := range []string{f.hard_link_target, f.symbolic_link_target} {
+			if typ, fid, found := strings.Cut(tgt, ":"); found && strings.HasPrefix(typ, "fid") {
+				link_targets.Add(fid)
+			}
+		}
+	}
+	ans = make([]*File, 0, len(files))
+	for _, f := range files {
+		if f.file_type == FileType_regular && !link_targets.Has(f.file_id) && self.is_done(f.expanded_local_path, f.file_size, f.mtime.UnixNano()) {
+			num_done++
+		} else {
+			ans = append(ans, f)
+		}
+	}
+	return
+}
@@ -0,0 +1,73 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestResumeTransfer(t *testing.T) {
+	opts := &Options{Mode: "normal"}
+	tdir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		os.WriteFile(filepath.Join(tdir, name), []byte(name), 0o600)
+	}
+	os.Link(filepath.Join(tdir, "c"), filepath.Join(tdir, "l"))
+	args := []string{"a", "b", "c", "l", "dest/"}
+	var files []*File
+	var err error
+	run_with_paths(tdir, tdir, func() {
+		files, err = files_for_send(opts, args)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpath := filepath.Join(tdir, "manifest.json")
+	m, err := new_resume_manifest(mpath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		m.update(f.expanded_local_path, f.file_size, f.mtime.UnixNano(), f.file_size, filepath.Base(f.local_path) != "b")
+	}
+	if err = m.save(); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = new_resume_manifest(mpath, true); err != nil {
+		t.Fatal(err)
+	}
+	if e := m.Files[filepath.Join(tdir, "a")]; e == nil || !e.Done || e.Size != 1 {
+		t.Fatalf("The manifest was not saved correctly: %#v", m.Files)
+	}
+	remaining, num_done := m.remove_done_files(files)
+	// c is the target of the hard link so it must be sent even though it is done
+	actual := make([]string, 0, len(remaining))
+	for _, f := range remaining {
+		actual = append(actual, filepath.Base(f.local_path))
+	}
+	if diff := cmp.Diff([]string{"b", "c", "l"}, actual); diff != "" || num_done != 1 {
+		t.Fatalf("Incorrect files remaining to be sent (%d done):\n%s", num_done, diff)
+	}
+	// a modified file must be sent again
+	os.WriteFile(filepath.Join(tdir, "a"), []byte("changed"), 0o600)
+	run_with_paths(tdir, tdir, func() {
+		files, err = files_for_send(opts, args)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, num_done = m.remove_done_files(files); num_done != 0 {
+		t.Fatalf("A modified file was skipped")
+	}
+	m.finish(true)
+	if _, err = os.Stat(mpath); err == nil {
+		t.Fatalf("The manifest was not removed after a successful transfer")
+	}
+}
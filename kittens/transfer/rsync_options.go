@@ -0,0 +1,61 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+
+	"kitty/tools/rsync"
+	"kitty/tools/utils/humanize"
+)
+
+var _ = fmt.Print
+
+// When receiving files with the rsync algorithm, the signatures of the local
+// files are created by this kitten, so their block size and strong hash can be
+// chosen with --rsync-block-size and --rsync-hash. Larger blocks make for
+// smaller signatures, which suits large binaries with few changes, smaller
+// blocks make for smaller deltas when there are many scattered changes.
+
+type rsync_options struct {
+	block_size  int
+	strong_hash rsync.StrongHashType
+}
+
+// The rsync options specified on the command line, nil if the defaults are to
+// be used
+func new_rsync_options(opts *Options) (*rsync_options, error) {
+	ans := rsync_options{strong_hash: rsync.XXH3}
+	if opts.RsyncBlockSize != "" {
+		bs, err := humanize.ParseBytes(opts.RsyncBlockSize)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for --rsync-block-size: %w", err)
+		}
+		if bs > uint64(rsync.MaxBlockSize) {
+			return nil, fmt.Errorf("The value for --rsync-block-size must not be larger than %s", humanize.Bytes(uint64(rsync.MaxBlockSize)))
+		}
+		ans.block_size = int(bs)
+	}
+	if opts.RsyncHash != "" {
+		sht, err := rsync.StrongHashTypeFromName(opts.RsyncHash)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for --rsync-hash: %w", err)
+		}
+		ans.strong_hash = sht
+	}
+	if ans.block_size == 0 && ans.strong_hash == rsync.XXH3 {
+		return nil, nil
+	}
+	return &ans, nil
+}
+
+func (self *rsync_options) new_patcher(expected_size int64) *rsync.Patcher {
+	ans := rsync.NewPatcher(expected_size)
+	if self != nil {
+		if self.block_size > 0 {
+			_ = ans.SetBlockSize(self.block_size)
+		}
+		_ = ans.SetStrongHashType(self.strong_hash)
+	}
+	return ans
+}
@@ -0,0 +1,33 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"testing"
+
+	"kitty/tools/rsync"
+)
+
+var _ = fmt.Print
+
+func TestRsyncOptions(t *testing.T) {
+	ro, err := new_rsync_options(&Options{RsyncHash: "xxh3-64"})
+	if err != nil || ro != nil {
+		t.Fatalf("Default rsync options were not nil: %#v %v", ro, err)
+	}
+	if p := ro.new_patcher(1024 * 1024); p.BlockSize() != 1024 || p.Strong_hash_type != rsync.XXH3 {
+		t.Fatalf("Incorrect default patcher: %d %s", p.BlockSize(), p.Strong_hash_type)
+	}
+	for _, bad := range []Options{{RsyncHash: "md5"}, {RsyncBlockSize: "1x"}, {RsyncBlockSize: "2M"}} {
+		if _, err = new_rsync_options(&bad); err == nil {
+			t.Fatalf("No error for invalid options: %#v", bad)
+		}
+	}
+	if ro, err = new_rsync_options(&Options{RsyncHash: "xxh3-128", RsyncBlockSize: "64K"}); err != nil {
+		t.Fatal(err)
+	}
+	if p := ro.new_patcher(1024 * 1024); p.BlockSize() != 64*1024 || p.Strong_hash_type != rsync.XXH3_128 {
+		t.Fatalf("Incorrect patcher: %d %s", p.BlockSize(), p.Strong_hash_type)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"compress/zlib"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"os"
@@ -17,6 +18,7 @@ import (
 	"time"
 	"unicode/utf8"
 
+	"github.com/klauspost/compress/zstd"
 	"golang.org/x/exp/constraints"
 	"golang.org/x/exp/slices"
 
@@ -80,6 +82,37 @@ func (self *ZlibCompressor) Flush() []byte {
 	return self.b.Bytes()
 }
 
+type ZstdCompressor struct {
+	b bytes.Buffer
+	w *zstd.Encoder
+}
+
+func NewZstdCompressor() *ZstdCompressor {
+	ans := ZstdCompressor{}
+	ans.b.Grow(4096)
+	// with a concurrency of one, compressed data is written synchronously
+	w, err := zstd.NewWriter(&ans.b, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		panic(err)
+	}
+	ans.w = w
+	return &ans
+}
+
+func (self *ZstdCompressor) Compress(data []byte) []byte {
+	_, err := self.w.Write(data)
+	if err != nil {
+		panic(err)
+	}
+	defer self.b.Reset()
+	return utils.UnsafeStringToBytes(self.b.String())
+}
+
+func (self *ZstdCompressor) Flush() []byte {
+	self.w.Close()
+	return self.b.Bytes()
+}
+
 type File struct {
 	file_hash                                             FileHash
 	ttype                                                 TransmissionType
@@ -100,11 +133,17 @@ type File struct {
 	remote_initial_size                                   int64
 	err_msg                                               string
 	actual_file                                           *os.File
-	transmitted_bytes, reported_progress                  int64
-	transmit_started_at, transmit_ended_at, done_at       time.Time
-	differ                                                *rsync.Differ
-	delta_loader                                          func() error
-	deltabuf                                              *bytes.Buffer
+	is_stream, paused, skipped, data_sent, sparse         bool
+	xattrs                                                string
+	// the directory containing the top level path being transferred
+	root                                            string
+	hasher                                          hash.Hash
+	transmitted_bytes, reported_progress            int64
+	transmit_started_at, transmit_ended_at, done_at time.Time
+	differ                                          *rsync.Differ
+	delta_loader                                    func() error
+	deltabuf                                        *bytes.Buffer
+	stream_chunks                                   chan stream_chunk
 }
 
 func get_remote_path(local_path string, remote_base string) string {
@@ -131,20 +170,54 @@ func NewFile(opts *Options, local_path, expanded_local_path string, file_id int,
 		rsync_capable:       file_type == FileType_regular && stat_result.Size() > 4096,
 		compression_capable: file_type == FileType_regular && stat_result.Size() > 4096 && should_be_compressed(expanded_local_path, opts.Compress),
 		remote_initial_size: -1,
+		sparse:              opts.Sparse && file_type == FileType_regular && is_sparse(stat_result),
+		xattrs:              read_xattrs(expanded_local_path, xattr_kinds(opts)),
 	}
 	return &ans
 }
 
-func process(opts *Options, paths []string, remote_base string, counter *int) (ans []*File, err error) {
+// rel_dir is the path of the directory containing paths relative to the
+// directory containing the top level path being transferred, used for
+// filtering. It is empty for the top level paths, which are never filtered.
+func process(opts *Options, paths []string, remote_base string, counter *int, filter *file_filter, rel_dir string) (ans []*File, err error) {
+	return process_paths(opts, paths, remote_base, counter, filter, rel_dir, nil)
+}
+
+// ancestors are the identities of the directories containing paths, used to
+// detect symbolic links to them
+func process_paths(opts *Options, paths []string, remote_base string, counter *int, filter *file_filter, rel_dir string, ancestors []FileHash) (ans []*File, err error) {
 	for _, x := range paths {
 		expanded := expand_home(x)
 		s, err := os.Lstat(expanded)
 		if err != nil {
 			return ans, fmt.Errorf("Failed to stat %s with error: %w", x, err)
 		}
+		if s.Mode()&fs.ModeSymlink == fs.ModeSymlink {
+			switch opts.Links {
+			case links_skip:
+				fmt.Println("Skipping symbolic link:", x)
+				continue
+			case links_follow:
+				ts, err := os.Stat(expanded)
+				if err != nil {
+					fmt.Println("Skipping broken symbolic link:", x)
+					continue
+				}
+				if ts.IsDir() && is_symlink_loop(ts, ancestors) {
+					fmt.Println("Skipping symbolic link to a directory containing it:", x)
+					continue
+				}
+				s = ts
+			}
+		}
+		rel_path := rel_dir + filepath.Base(x)
+		if rel_dir != "" && filter.is_excluded(rel_path, s.IsDir()) {
+			continue
+		}
 		if s.IsDir() {
 			*counter += 1
-			ans = append(ans, NewFile(opts, x, expanded, *counter, s, remote_base, FileType_directory))
+			f := NewFile(opts, x, expanded, *counter, s, remote_base, FileType_directory)
+			ans = append(ans, f)
 			new_remote_base := remote_base
 			if new_remote_base != "" {
 				new_remote_base = strings.TrimRight(new_remote_base, "/") + "/" + filepath.Base(x) + "/"
@@ -159,14 +232,16 @@ func process(opts *Options, paths []string, remote_base string, counter *int) (a
 			for i, y := range contents {
 				new_paths[i] = filepath.Join(x, y.Name())
 			}
-			new_ans, err := process(opts, new_paths, new_remote_base, counter)
+			new_ans, err := process_paths(opts, new_paths, new_remote_base, counter, filter, rel_path+"/", append(slices.Clip(ancestors), f.file_hash))
 			if err != nil {
 				return ans, err
 			}
 			ans = append(ans, new_ans...)
 		} else if s.Mode()&fs.ModeSymlink == fs.ModeSymlink {
 			*counter += 1
-			ans = append(ans, NewFile(opts, x, expanded, *counter, s, remote_base, FileType_symlink))
+			f := NewFile(opts, x, expanded, *counter, s, remote_base, FileType_symlink)
+			f.root = strings.TrimSuffix(expanded, string(filepath.Separator)+filepath.FromSlash(rel_path))
+			ans = append(ans, f)
 		} else if s.Mode().IsRegular() {
 			*counter += 1
 			ans = append(ans, NewFile(opts, x, expanded, *counter, s, remote_base, FileType_regular))
@@ -175,7 +250,10 @@ func process(opts *Options, paths []string, remote_base string, counter *int) (a
 	return
 }
 
-func process_mirrored_files(opts *Options, args []string) (ans []*File, err error) {
+func process_mirrored_files(opts *Options, args []string, filter *file_filter) (ans []*File, err error) {
+	if slices.Contains(args, stream_path) {
+		return nil, fmt.Errorf("Cannot use %s to stream data in mirror mode", stream_path)
+	}
 	paths := utils.Map(func(x string) string { return abspath(expand_home(x)) }, args)
 	home := strings.TrimRight(home_path(), string(filepath.Separator)) + string(filepath.Separator)
 	paths = utils.Map(func(path string) string {
@@ -186,13 +264,20 @@ func process_mirrored_files(opts *Options, args []string) (ans []*File, err erro
 		return path
 	}, paths)
 	counter := 0
-	return process(opts, paths, "", &counter)
+	return process(opts, paths, "", &counter, filter, "")
 }
 
-func process_normal_files(opts *Options, args []string) (ans []*File, err error) {
+func process_normal_files(opts *Options, args []string, filter *file_filter) (ans []*File, err error) {
 	if len(args) < 2 {
 		return ans, fmt.Errorf("Must specify at least one local path and one remote path")
 	}
+	if slices.Contains(args, stream_path) {
+		f, err := stdin_file(opts, args)
+		if err != nil {
+			return nil, err
+		}
+		return []*File{f}, nil
+	}
 	args = slices.Clone(args)
 	remote_base := filepath.ToSlash(args[len(args)-1])
 	args = args[:len(args)-1]
@@ -201,14 +286,20 @@ func process_normal_files(opts *Options, args []string) (ans []*File, err error)
 	}
 	paths := utils.Map(func(x string) string { return abspath(expand_home(x)) }, args)
 	counter := 0
-	return process(opts, paths, remote_base, &counter)
+	return process(opts, paths, remote_base, &counter, filter, "")
 }
 
 func files_for_send(opts *Options, args []string) (files []*File, err error) {
-	if opts.Mode == "mirror" {
-		files, err = process_mirrored_files(opts, args)
+	filter, err := new_file_filter(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Relay != "" {
+		files, err = process_relayed_files(opts, args, filter)
+	} else if opts.Mode == "mirror" {
+		files, err = process_mirrored_files(opts, args, filter)
 	} else {
-		files, err = process_normal_files(opts, args)
+		files, err = process_normal_files(opts, args, filter)
 	}
 	if err != nil {
 		return files, err
@@ -238,6 +329,9 @@ func files_for_send(opts *Options, args []string) (files []*File, err error) {
 				continue
 			}
 			f.symbolic_link_target = "path:" + link_dest
+			if opts.Links == links_munge {
+				f.symbolic_link_target = "path:" + munge_symlink_target(f.root, f.expanded_local_path, link_dest)
+			}
 			is_abs := filepath.IsAbs(link_dest)
 			q := link_dest
 			if !is_abs {
@@ -255,7 +349,7 @@ func files_for_send(opts *Options, args []string) (files []*File, err error) {
 						})
 						if len(g) > 0 {
 							f.symbolic_link_target = "fid"
-							if is_abs {
+							if is_abs && opts.Links != links_munge {
 								f.symbolic_link_target = "fid_abs"
 							}
 							f.symbolic_link_target += ":" + g[0].file_id
@@ -294,7 +388,6 @@ func (self *Transfer) is_too_old(now time.Time) bool {
 
 type ProgressTracker struct {
 	total_size_of_all_files, total_bytes_to_transfer int64
-	active_file                                      *File
 	total_transferred                                int64
 	transfers                                        []*Transfer
 	transfered_stats_amt                             int64
@@ -304,10 +397,8 @@ type ProgressTracker struct {
 	total_reported_progress                          int64
 }
 
-func (self *ProgressTracker) change_active_file(nf *File) {
-	now := time.Now()
-	self.active_file = nf
-	nf.transmit_started_at = now
+func (self *ProgressTracker) on_file_activated(nf *File) {
+	nf.transmit_started_at = time.Now()
 }
 
 func (self *ProgressTracker) start_transfer() {
@@ -351,17 +442,31 @@ type SendManager struct {
 	file_done                                                  func(*File) error
 	fid_map                                                    map[string]*File
 	all_acknowledged, all_started, has_transmitting, has_rsync bool
-	active_idx                                                 int
+	active_files                                               []*File
+	num_streams, next_stream                                   int
 	prefix, suffix                                             string
-	last_progress_file                                         *File
 	progress_tracker                                           ProgressTracker
 	current_chunk_uncompressed_sz                              int64
 	current_chunk_write_id                                     loop.IdType
 	current_chunk_for_file_id                                  string
+	resume                                                     *resume_manifest
+	cipher                                                     *transfer_cipher
+	relay                                                      string
+	// the kinds of extended attributes the terminal may set
+	xattr_kinds string
+	// the best compression supported by the terminal
+	compression Compression
+	// wakes up the event loop when data from STDIN is available
+	wakeup func() bool
+	// no data from STDIN is available yet
+	waiting_for_stream bool
 }
 
 func (self *SendManager) start_transfer() string {
-	return FileTransmissionCommand{Action: Action_send, Bypass: self.bypass}.Serialize()
+	return FileTransmissionCommand{
+		Action: Action_send, Bypass: self.bypass, Pubkey: self.cipher.pubkey(),
+		Relay: self.relay, Size: utils.IfElse(self.relay != "", int64(len(self.files)), -1), Xattrs: self.xattr_kinds,
+	}.Serialize()
 }
 
 func (self *SendManager) initialize() {
@@ -378,7 +483,9 @@ func (self *SendManager) initialize() {
 	for _, f := range self.files {
 		self.fid_map[f.file_id] = f
 	}
-	self.active_idx = -1
+	self.active_files = nil
+	self.compression = Compression_zlib
+	self.num_streams = utils.Max(1, self.num_streams)
 	self.current_chunk_uncompressed_sz = -1
 	self.current_chunk_for_file_id = ""
 	self.prefix = fmt.Sprintf("\x1b]%d;id=%s;", kitty.FileTransferCode, self.request_id)
@@ -404,11 +511,20 @@ type SendHandler struct {
 	transfer_finish_sent                 bool
 	max_name_length                      int
 	progress_drawn                       bool
+	progress_lines                       int
 	failed_files, done_files             []*File
+	completed_files                      []*File
 	done_file_ids                        *utils.Set[string]
 	transmit_ok_checked                  bool
 	progress_update_timer                loop.IdType
 	spinner                              *tui.Spinner
+	file_list_offset, file_list_selected int
+	file_list_shows_completed            bool
+	file_list_msg                        string
+	rate_limiter                         *rate_limiter
+	throttle_timer                       loop.IdType
+	verifier                             *verifier
+	waiting_for_relay                    bool
 }
 
 func safe_divide[A constraints.Integer | constraints.Float, B constraints.Integer | constraints.Float](a A, b B) float64 {
@@ -527,15 +643,23 @@ func (self *SendHandler) draw_progress() {
 		if df.err_msg != "" {
 			sc = self.ctx.Err(`✘`)
 		}
-		if df.file_type == FileType_regular {
+		if df.skipped {
+			self.lp.QueueWriteString(self.ctx.Yellow(`↷`) + ` ` + df.display_name + ` ` + self.ctx.Dim(self.ctx.Italic(`skipped`)))
+		} else if df.file_type == FileType_regular {
 			self.draw_progress_for_current_file(df, sc, true)
 		} else {
 			self.lp.QueueWriteString(sc + ` ` + df.display_name + ` ` + self.ctx.Dim(self.ctx.Italic(df.file_type.String())))
 		}
 		self.lp.Println()
 		self.done_file_ids.Add(df.file_id)
+		self.completed_files = append(self.completed_files, df)
 	}
 	self.done_files = nil
+	self.progress_lines = 0
+	println := func() {
+		self.lp.Println()
+		self.progress_lines++
+	}
 	is_complete := self.quit_after_write_code > -1
 	if is_complete {
 		sc = self.ctx.Green(`✔`)
@@ -549,9 +673,10 @@ func (self *SendHandler) draw_progress() {
 	if is_complete {
 		sz, _ := self.lp.ScreenSize()
 		self.lp.QueueWriteString(tui.RepeatChar(`─`, int(sz.WidthCells)))
+		println()
 	} else {
-		af := self.manager.last_progress_file
-		if af == nil || self.done_file_ids.Has(af.file_id) {
+		in_flight := self.in_flight_files()
+		if len(in_flight) == 0 {
 			if !self.manager.has_transmitting && self.done_file_ids.Len() == 0 {
 				if self.manager.has_rsync {
 					self.lp.QueueWriteString(sc + ` Transferring rsync signatures...`)
@@ -559,13 +684,16 @@ func (self *SendHandler) draw_progress() {
 					self.lp.QueueWriteString(sc + ` Transferring metadata...`)
 				}
 			}
-		} else {
+			println()
+		}
+		for _, af := range in_flight {
 			self.draw_progress_for_current_file(af, sc, false)
+			println()
 		}
+		self.draw_file_list(len(in_flight), println)
 	}
-	self.lp.Println()
 	if p := self.manager.progress_tracker; p.total_reported_progress > 0 {
-		self.render_progress(`Total`, Progress{
+		self.render_progress(fmt.Sprintf(`Total (%d/%d files)`, self.done_file_ids.Len(), len(self.manager.files)), Progress{
 			spinner_char: sc, bytes_so_far: p.total_reported_progress, total_bytes: p.total_bytes_to_transfer,
 			secs_so_far: now.Sub(p.started_at).Seconds(), is_complete: is_complete,
 			bytes_per_sec: safe_divide(p.transfered_stats_amt, p.transfered_stats_interval.Abs().Seconds()),
@@ -573,13 +701,141 @@ func (self *SendHandler) draw_progress() {
 	} else {
 		self.lp.QueueWriteString(`File data transfer has not yet started`)
 	}
-	self.lp.Println()
+	println()
 	self.schedule_progress_update(self.spinner.Interval())
 	self.progress_drawn = true
 }
 
+// The files whose data is being sent or is waiting to be written by the
+// terminal, in the order in which they are written
+func (self *SendHandler) in_flight_files() (ans []*File) {
+	for _, f := range self.manager.files {
+		if len(ans) >= self.manager.num_streams {
+			break
+		}
+		if f.file_type == FileType_regular && (f.state == FINISHED || slices.Contains(self.manager.active_files, f)) {
+			ans = append(ans, f)
+		}
+	}
+	return
+}
+
+const file_list_height = 5
+
+// The files that are pending or, after pressing Tab, completed, with the most
+// recently completed files first
+func (self *SendHandler) file_list_items() (ans []*File) {
+	if self.file_list_shows_completed {
+		return utils.Reversed(self.completed_files)
+	}
+	for _, f := range self.manager.files {
+		if f.file_type != FileType_directory && !f.skipped && (f.state == WAITING_FOR_START || f.state == WAITING_FOR_DATA || f.state == TRANSMITTING) {
+			ans = append(ans, f)
+		}
+	}
+	return
+}
+
+func (self *SendHandler) on_file_list_key(ev *loop.KeyEvent) (handled bool, err error) {
+	items := self.file_list_items()
+	var selected *File
+	if self.file_list_selected < len(items) && !self.file_list_shows_completed {
+		selected = items[self.file_list_selected]
+	}
+	self.file_list_msg = ""
+	switch {
+	case ev.MatchesPressOrRepeat("up"):
+		self.file_list_selected--
+	case ev.MatchesPressOrRepeat("down"):
+		self.file_list_selected++
+	case ev.MatchesPressOrRepeat("page_up"):
+		self.file_list_selected -= file_list_height
+	case ev.MatchesPressOrRepeat("page_down"):
+		self.file_list_selected += file_list_height
+	case ev.MatchesPressOrRepeat("tab"):
+		self.file_list_shows_completed = !self.file_list_shows_completed
+		self.file_list_offset, self.file_list_selected = 0, 0
+	case ev.MatchesPressOrRepeat("shift+up") || ev.MatchesPressOrRepeat("shift+down"):
+		j := self.file_list_selected + utils.IfElse(ev.MatchesPressOrRepeat("shift+up"), -1, 1)
+		if selected != nil && j > -1 && j < len(items) {
+			self.manager.swap_files(selected, items[j])
+			self.file_list_selected = j
+		}
+	case ev.MatchesPressOrRepeat("p"):
+		if selected != nil {
+			self.manager.toggle_pause(selected)
+			err = self.restart_transmission()
+		}
+	case ev.MatchesPressOrRepeat("s"):
+		if selected != nil {
+			if serr := self.manager.skip_file(selected); serr != nil {
+				self.file_list_msg = serr.Error()
+			} else {
+				err = self.restart_transmission()
+			}
+		}
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// Sending data stops when all files ready to be sent are paused, so restart
+// it when a file is resumed or skipped
+func (self *SendHandler) restart_transmission() error {
+	if self.manager.current_chunk_write_id == 0 {
+		return self.transmit_next_chunk()
+	}
+	return nil
+}
+
+// A scrollable list of the files that are pending or completed, in which the
+// pending files can be paused, skipped and reordered
+func (self *SendHandler) draw_file_list(num_in_flight int, println func()) {
+	items := self.file_list_items()
+	if len(items) == 0 && !self.file_list_shows_completed {
+		return
+	}
+	sz, _ := self.lp.ScreenSize()
+	height := utils.Max(0, utils.Min(file_list_height, len(items), int(sz.HeightCells)-num_in_flight-5))
+	if height == 0 && len(items) > 0 {
+		return
+	}
+	self.file_list_selected = utils.Max(0, utils.Min(self.file_list_selected, len(items)-1))
+	self.file_list_offset = utils.Max(self.file_list_selected-height+1, utils.Min(self.file_list_offset, self.file_list_selected))
+	self.file_list_offset = utils.Max(0, utils.Min(self.file_list_offset, len(items)-height))
+	if self.file_list_shows_completed {
+		self.lp.QueueWriteString(self.ctx.Dim(fmt.Sprintf(`Completed files: %d (↑ ↓ to scroll, Tab for pending files)`, len(items))))
+	} else {
+		self.lp.QueueWriteString(self.ctx.Dim(fmt.Sprintf(
+			`Pending files: %d (↑ ↓ to select, p to pause, s to skip, Shift+↑ ↓ to reorder, Tab for completed files)`, len(items))))
+	}
+	println()
+	if self.file_list_msg != "" {
+		self.lp.QueueWriteString(self.ctx.Err(self.file_list_msg))
+		println()
+	}
+	for i, f := range items[self.file_list_offset : self.file_list_offset+height] {
+		var mark, suffix string
+		switch {
+		case self.file_list_shows_completed && f.skipped:
+			mark = self.ctx.Yellow(`↷`)
+		case self.file_list_shows_completed:
+			mark = utils.IfElse(f.err_msg == "", self.ctx.Green(`✔`), self.ctx.Err(`✘`))
+		case f.paused:
+			mark, suffix = self.ctx.Yellow(`‖`), self.ctx.Dim(self.ctx.Italic(` paused`))
+		case slices.Contains(self.manager.active_files, f):
+			mark = self.ctx.Green(`▸`)
+		default:
+			mark = self.ctx.Dim(`·`)
+		}
+		cursor := utils.IfElse(i+self.file_list_offset == self.file_list_selected, `❯`, ` `)
+		self.lp.QueueWriteString(cursor + ` ` + mark + ` ` + render_path_in_width(f.display_name, int(sz.WidthCells)-13) + suffix)
+		println()
+	}
+}
+
 func (self *SendHandler) draw_progress_for_current_file(af *File, spinner_char string, is_complete bool) {
-	p := self.manager.progress_tracker
 	var secs_so_far time.Duration
 	empty := File{}
 	if af.done_at == empty.done_at {
@@ -590,14 +846,14 @@ func (self *SendHandler) draw_progress_for_current_file(af *File, spinner_char s
 	self.render_progress(af.display_name, Progress{
 		spinner_char: spinner_char, is_complete: is_complete,
 		bytes_so_far: af.reported_progress, total_bytes: af.bytes_to_transmit,
-		secs_so_far: secs_so_far.Seconds(), bytes_per_sec: safe_divide(p.transfered_stats_amt, p.transfered_stats_interval.Abs().Seconds()),
+		secs_so_far: secs_so_far.Seconds(), bytes_per_sec: safe_divide(af.reported_progress, secs_so_far.Seconds()),
 	})
 }
 
 func (self *SendHandler) erase_progress() {
 	if self.progress_drawn {
 		self.progress_drawn = false
-		self.lp.MoveCursorVertically(-2)
+		self.lp.MoveCursorVertically(-self.progress_lines)
 		self.lp.QueueWriteString("\r")
 		self.lp.ClearToEndOfScreen()
 	}
@@ -610,7 +866,7 @@ func (self *SendHandler) refresh_progress(timer_id loop.IdType) (err error) {
 	if timer_id == self.progress_update_timer {
 		self.progress_update_timer = 0
 	}
-	if self.manager.active_file() == nil && !self.manager.all_acknowledged && self.done_file_ids.Len() != 0 && self.done_file_ids.Len() < len(self.manager.files) {
+	if len(self.manager.active_files) == 0 && !self.manager.all_acknowledged && self.done_file_ids.Len() != 0 && self.done_file_ids.Len() < len(self.manager.files) {
 		if err = self.transmit_next_chunk(); err != nil {
 			return err
 		}
@@ -649,26 +905,33 @@ func (self *SendHandler) send_payload(payload string) loop.IdType {
 	return self.lp.QueueWriteString(self.manager.suffix)
 }
 
-func (self *File) metadata_command(use_rsync bool) *FileTransmissionCommand {
+func (self *File) metadata_command(use_rsync bool, compression Compression) *FileTransmissionCommand {
 	if use_rsync && self.rsync_capable {
 		self.ttype = TransmissionType_rsync
 	}
 	if self.compression_capable {
-		self.compression = Compression_zlib
-		self.compressor = NewZlibCompressor()
+		self.compression = compression
+		if compression == Compression_zstd {
+			self.compressor = NewZstdCompressor()
+		} else {
+			self.compressor = NewZlibCompressor()
+		}
 	} else {
 		self.compressor = &IdentityCompressor{}
 	}
 	return &FileTransmissionCommand{
 		Action: Action_file, Compression: self.compression, Ftype: self.file_type,
 		Name: self.remote_path, Permissions: self.permissions, Mtime: time.Duration(self.mtime.UnixNano()),
-		File_id: self.file_id, Ttype: self.ttype,
+		File_id: self.file_id, Ttype: self.ttype, Xattrs: self.xattrs, Sparse: utils.IfElse(self.sparse, int64(1), 0),
 	}
 }
 
 func (self *SendManager) send_file_metadata(send func(string) loop.IdType) {
 	for _, f := range self.files {
-		ftc := f.metadata_command(self.use_rsync)
+		ftc := f.metadata_command(self.use_rsync, self.compression)
+		if self.relay != "" {
+			add_relay_metadata(f, ftc)
+		}
 		send(ftc.Serialize())
 	}
 }
@@ -724,11 +987,13 @@ func (self *SendManager) on_file_status_update(ftc *FileTransmissionCommand) err
 			self.update_collective_statuses()
 		}
 	case `PROGRESS`:
-		self.last_progress_file = file
 		change := int64(ftc.Size) - file.reported_progress
 		file.reported_progress = int64(ftc.Size)
 		self.progress_tracker.on_file_progress(file, change)
 		self.file_progress(file, int(change))
+		if file.file_type == FileType_regular {
+			self.resume.update(file.expanded_local_path, file.file_size, file.mtime.UnixNano(), file.reported_progress, false)
+		}
 	default:
 		if ftc.Name != "" && file.remote_final_path == "" {
 			file.remote_final_path = ftc.Name
@@ -741,6 +1006,9 @@ func (self *SendManager) on_file_status_update(ftc *FileTransmissionCommand) err
 				self.progress_tracker.on_file_progress(file, change)
 				self.file_progress(file, int(change))
 			}
+			if file.file_type == FileType_regular {
+				self.resume.update(file.expanded_local_path, file.file_size, file.mtime.UnixNano(), file.file_size, true)
+			}
 		} else {
 			file.err_msg = ftc.Status
 		}
@@ -748,9 +1016,7 @@ func (self *SendManager) on_file_status_update(ftc *FileTransmissionCommand) err
 		if err := self.file_done(file); err != nil {
 			return err
 		}
-		if self.active_idx > -1 && file == self.files[self.active_idx] {
-			self.active_idx = -1
-		}
+		self.deactivate_file(file)
 		self.update_collective_statuses()
 	}
 	return nil
@@ -791,13 +1057,23 @@ func (self *SendManager) on_signature_data_received(ftc *FileTransmissionCommand
 }
 
 func (self *SendManager) on_file_transfer_response(ftc *FileTransmissionCommand) error {
+	if err := self.cipher.decrypt_command(ftc); err != nil {
+		return err
+	}
 	switch ftc.Action {
 	case Action_status:
 		if ftc.File_id != "" {
 			return self.on_file_status_update(ftc)
 		}
 		if ftc.Status == "OK" {
+			if err := self.cipher.check_permission_granted(ftc); err != nil {
+				return err
+			}
 			self.state = SEND_PERMISSION_GRANTED
+			// terminals that support zstd say so when granting permission
+			if ftc.Compression == Compression_zstd {
+				self.compression = Compression_zstd
+			}
 		} else {
 			self.state = SEND_PERMISSION_DENIED
 		}
@@ -820,6 +1096,13 @@ func (self *SendHandler) on_file_transfer_response(ftc *FileTransmissionCommand)
 	if self.quit_after_write_code > -1 || self.manager.state == SEND_CANCELED {
 		return nil
 	}
+	if ftc.Action == Action_verify {
+		if self.verifier != nil {
+			self.verifier.on_response(ftc)
+			self.transfer_finished()
+		}
+		return nil
+	}
 	before := self.manager.state
 	err := self.manager.on_file_transfer_response(ftc)
 	if err != nil {
@@ -837,12 +1120,25 @@ func (self *SendHandler) on_file_transfer_response(ftc *FileTransmissionCommand)
 		}
 	}
 	if !self.transmit_started {
+		if self.manager.all_acknowledged {
+			// no file needed its data sent, for example, when the receiver of
+			// relayed files did not want any of them
+			self.transfer_finished()
+			return nil
+		}
 		return self.check_for_transmit_ok()
 	}
 	if self.manager.all_acknowledged {
 		self.transfer_finished()
 	} else if ftc.Action == Action_end_data && ftc.File_id != "" {
 		return self.transmit_next_chunk()
+	} else if ftc.Action == Action_status && ftc.Status == "STARTED" && self.manager.current_chunk_write_id == 0 {
+		// relayed files are started when the receiver asks for them, after
+		// the transmission of the other files may have stopped
+		return self.transmit_next_chunk()
+	} else if self.waiting_for_relay && !self.manager.relay_is_backed_up() {
+		self.waiting_for_relay = false
+		return self.transmit_next_chunk()
 	}
 	return nil
 }
@@ -888,31 +1184,45 @@ func (self *SendHandler) print_check_paths() {
 	self.print_continue_msg()
 }
 
-func (self *SendManager) activate_next_ready_file() *File {
-	if self.active_idx > -1 && self.active_idx < len(self.files) {
-		self.files[self.active_idx].transmit_ended_at = time.Now()
+// Hard links can only be created once the file they link to has been sent
+func (self *SendManager) is_ready_for_transmission(f *File) bool {
+	if f.state != TRANSMITTING || f.paused {
+		return false
 	}
-	for i, f := range self.files {
-		if f.state == TRANSMITTING {
-			self.active_idx = i
-			self.update_collective_statuses()
-			self.progress_tracker.change_active_file(f)
-			return f
+	if f.file_type == FileType_link {
+		if tgt := self.fid_map[strings.TrimPrefix(f.hard_link_target, "fid:")]; tgt != nil {
+			return tgt.state == FINISHED || tgt.state == ACKNOWLEDGED
+		}
+	}
+	return true
+}
+
+// Activate files that are ready for transmission, up to the number of streams.
+// The data of the active files is sent interleaved.
+func (self *SendManager) activate_ready_files() {
+	for _, f := range self.files {
+		if len(self.active_files) >= self.num_streams {
+			break
+		}
+		if self.is_ready_for_transmission(f) && !slices.Contains(self.active_files, f) {
+			self.active_files = append(self.active_files, f)
+			self.progress_tracker.on_file_activated(f)
 		}
 	}
-	self.active_idx = -1
 	self.update_collective_statuses()
-	return nil
 }
 
-func (self *SendManager) active_file() *File {
-	if self.active_idx > -1 && self.active_idx < len(self.files) {
-		return self.files[self.active_idx]
+func (self *SendManager) deactivate_file(f *File) {
+	if idx := slices.Index(self.active_files, f); idx > -1 {
+		f.transmit_ended_at = time.Now()
+		self.active_files = slices.Delete(self.active_files, idx, idx+1)
+		if self.next_stream > idx {
+			self.next_stream--
+		}
 	}
-	return nil
 }
 
-func (self *File) next_chunk() (ans string, asz int, err error) {
+func (self *File) next_chunk(wakeup func() bool) (ans string, asz int, err error) {
 	const sz = 1024 * 1024
 	switch self.file_type {
 	case FileType_symlink:
@@ -938,6 +1248,14 @@ func (self *File) next_chunk() (ans string, asz int, err error) {
 		}
 		chunk = slices.Clone(self.deltabuf.Bytes())
 		self.deltabuf.Reset()
+	} else if self.is_stream {
+		if chunk, err = self.next_stream_chunk(sz, wakeup); err != nil {
+			return
+		}
+		is_last = len(chunk) == 0
+		if self.hasher != nil {
+			self.hasher.Write(chunk)
+		}
 	} else {
 		if self.actual_file == nil {
 			self.actual_file, err = os.Open(self.expanded_local_path)
@@ -957,6 +1275,9 @@ func (self *File) next_chunk() (ans string, asz int, err error) {
 			is_last = true
 		}
 		chunk = chunk[:n]
+		if self.hasher != nil {
+			self.hasher.Write(chunk)
+		}
 	}
 	uncompressed_sz := len(chunk)
 	cchunk := self.compressor.Compress(chunk)
@@ -981,18 +1302,26 @@ func (self *File) next_chunk() (ans string, asz int, err error) {
 }
 
 func (self *SendManager) next_chunks(callback func(string) loop.IdType) error {
-	if self.active_file() == nil {
-		self.activate_next_ready_file()
-	}
-	af := self.active_file()
-	if af == nil {
+	self.activate_ready_files()
+	if len(self.active_files) == 0 {
 		return nil
 	}
+	// send a chunk from each active file in turn
+	if self.next_stream >= len(self.active_files) {
+		self.next_stream = 0
+	}
+	af := self.active_files[self.next_stream]
+	self.next_stream++
 	chunk := ""
 	self.current_chunk_uncompressed_sz = 0
 	for af.state != FINISHED && len(chunk) == 0 {
-		c, usz, err := af.next_chunk()
+		c, usz, err := af.next_chunk(self.wakeup)
 		if err != nil {
+			if errors.Is(err, stream_data_pending) {
+				// restarted by the wakeup when data is available
+				self.waiting_for_stream = true
+				return nil
+			}
 			return err
 		}
 		self.current_chunk_uncompressed_sz += int64(usz)
@@ -1000,38 +1329,59 @@ func (self *SendManager) next_chunks(callback func(string) loop.IdType) error {
 		chunk = c
 	}
 	is_last := af.state == FINISHED
+	af.data_sent = true
 	if len(chunk) > 0 {
 		split_for_transfer(utils.UnsafeStringToBytes(chunk), af.file_id, is_last, func(ftc *FileTransmissionCommand) {
-			self.current_chunk_write_id = callback(ftc.Serialize())
+			self.current_chunk_write_id = callback(self.cipher.encrypt_command(ftc).Serialize())
 		})
 	} else if is_last {
-		self.current_chunk_write_id = callback(FileTransmissionCommand{Action: Action_end_data, File_id: af.file_id}.Serialize())
+		self.current_chunk_write_id = callback(self.cipher.encrypt_command(&FileTransmissionCommand{Action: Action_end_data, File_id: af.file_id}).Serialize())
 	}
 	if is_last {
-		self.activate_next_ready_file()
-		if self.active_file() == nil {
-			return nil
-		}
+		self.deactivate_file(af)
+		self.activate_ready_files()
 	}
 	return nil
 }
 
 func (self *SendHandler) transmit_next_chunk() (err error) {
+	if self.throttle_timer != 0 {
+		return
+	}
+	if d := self.rate_limiter.wait_time(time.Now()); d > 0 {
+		self.throttle_timer, err = self.lp.AddTimer(d, false, func(loop.IdType) error {
+			self.throttle_timer = 0
+			if self.manager.state == SEND_CANCELED {
+				return nil
+			}
+			return self.transmit_next_chunk()
+		})
+		return
+	}
+	if self.manager.relay_is_backed_up() {
+		// restarted by the acknowledgements from the terminal
+		self.waiting_for_relay = true
+		return
+	}
 	found_chunk := false
 	for !found_chunk {
 		if err = self.manager.next_chunks(func(chunk string) loop.IdType {
 			found_chunk = true
+			self.rate_limiter.consume(len(chunk), time.Now())
 			return self.send_payload(chunk)
 		}); err != nil {
 			return err
 		}
 		if !found_chunk {
+			if self.manager.waiting_for_stream {
+				return
+			}
 			if self.manager.all_acknowledged {
 				self.transfer_finished()
 				return
 			}
-			self.manager.update_collective_statuses()
-			if !self.manager.has_transmitting {
+			if len(self.manager.active_files) == 0 {
+				// the remaining files are waiting for signatures or for the files they link to
 				return
 			}
 		}
@@ -1040,10 +1390,8 @@ func (self *SendHandler) transmit_next_chunk() (err error) {
 }
 
 func (self *SendHandler) start_transfer() (err error) {
-	if self.manager.active_file() == nil {
-		self.manager.activate_next_ready_file()
-	}
-	if self.manager.active_file() != nil {
+	self.manager.activate_ready_files()
+	if len(self.manager.active_files) > 0 {
 		self.transmit_started = true
 		self.manager.progress_tracker.start_transfer()
 		if err = self.transmit_next_chunk(); err != nil {
@@ -1060,16 +1408,43 @@ func (self *SendHandler) initialize() error {
 	self.ctx = markup.New(true)
 	self.send_payload(self.manager.start_transfer())
 	if self.opts.PermissionsBypass != "" {
-		// dont wait for permission, not needed with a bypass and avoids a roundtrip
+		// dont wait for permission, not needed with a bypass and avoids a
+		// roundtrip, at the cost of using zlib as support for zstd is not yet known
 		self.send_file_metadata()
 	}
 	return nil
 }
 
+func (self *SendHandler) start_verification() {
+	self.verifier = new_verifier()
+	for _, f := range self.manager.files {
+		if f.file_type == FileType_regular && f.err_msg == "" && !f.skipped {
+			var digest []byte
+			if f.hasher != nil {
+				digest = f.hasher.Sum(nil)
+			}
+			self.verifier.add(f.file_id, f.display_name, f.expanded_local_path, digest)
+		}
+	}
+	for _, ftc := range self.verifier.requests() {
+		self.send_payload(ftc.Serialize())
+	}
+	self.verifier.compute_local_digests(self.lp.WakeupMainThread)
+}
+
 func (self *SendHandler) transfer_finished() {
 	if self.transfer_finish_sent {
 		return
 	}
+	if self.opts.Verify {
+		// the transfer must be finished only after the terminal has responded to all verify commands
+		if self.verifier == nil {
+			self.start_verification()
+		}
+		if !self.verifier.is_complete() {
+			return
+		}
+	}
 	self.transfer_finish_sent = true
 	self.finish_cmd_write_id = self.send_payload(FileTransmissionCommand{Action: Action_finish}.Serialize())
 }
@@ -1145,6 +1520,15 @@ func (self *SendHandler) on_key_event(ev *loop.KeyEvent) error {
 	} else if ev.MatchesPressOrRepeat("ctrl+c") {
 		self.on_interrupt()
 		ev.Handled = true
+	} else if self.transmit_started {
+		handled, err := self.on_file_list_key(ev)
+		if err != nil {
+			return err
+		}
+		if handled {
+			ev.Handled = true
+			return self.refresh_progress(0)
+		}
 	}
 	return nil
 }
@@ -1195,7 +1579,7 @@ func (self *SendHandler) on_interrupt() {
 	self.abort_transfer()
 }
 
-func send_loop(opts *Options, files []*File) (err error, rc int) {
+func send_loop(opts *Options, files []*File, resume *resume_manifest, limiter *rate_limiter) (err error, rc int) {
 	lp, err := loop.New(loop.NoAlternateScreen, loop.NoRestoreColors)
 	if err != nil {
 		return err, 1
@@ -1204,13 +1588,17 @@ func send_loop(opts *Options, files []*File) (err error, rc int) {
 	handler := &SendHandler{
 		opts: opts, files: files, lp: lp, quit_after_write_code: -1,
 		max_name_length: utils.Max(0, utils.Map(func(f *File) int { return wcswidth.Stringwidth(f.display_name) }, files)...),
-		progress_drawn:  true, done_file_ids: utils.NewSet[string](),
+		progress_drawn:  true, progress_lines: 2, done_file_ids: utils.NewSet[string](), rate_limiter: limiter,
 		manager: &SendManager{
-			request_id: random_id(), files: files, bypass: opts.PermissionsBypass, use_rsync: opts.TransmitDeltas,
+			request_id: random_id(), files: files, bypass: opts.PermissionsBypass, use_rsync: opts.TransmitDeltas || opts.Resume,
+			resume: resume, num_streams: opts.Streams, relay: opts.Relay, xattr_kinds: xattr_kinds(opts),
 		},
 	}
 	handler.manager.file_progress = handler.on_file_progress
 	handler.manager.file_done = handler.on_file_done
+	if handler.manager.cipher, err = new_transfer_cipher(opts); err != nil {
+		return err, 1
+	}
 
 	lp.OnInitialize = func() (string, error) {
 		lp.SetCursorVisible(false)
@@ -1239,8 +1627,28 @@ func send_loop(opts *Options, files []*File) (err error, rc int) {
 	lp.OnKeyEvent = handler.on_key_event
 	lp.OnResize = handler.on_resize
 	lp.OnWriteComplete = handler.on_writing_finished
+	handler.manager.wakeup = lp.WakeupMainThread
+	lp.OnWakeup = func() error {
+		if handler.manager.state == SEND_CANCELED {
+			return nil
+		}
+		if handler.manager.waiting_for_stream {
+			// data from STDIN is available
+			handler.manager.waiting_for_stream = false
+			if handler.manager.current_chunk_write_id == 0 {
+				return handler.transmit_next_chunk()
+			}
+			return nil
+		}
+		// the local digests of the files being verified have been computed
+		if handler.verifier != nil {
+			handler.transfer_finished()
+		}
+		return nil
+	}
 
 	err = lp.Run()
+	resume.finish(err == nil && lp.ExitCode() == 0 && len(handler.failed_files) == 0)
 	if err != nil {
 		return err, 1
 	}
@@ -1268,6 +1676,11 @@ func send_loop(opts *Options, files []*File) (err error, rc int) {
 		}
 		rc = 1
 	}
+	if handler.verifier != nil && handler.transfer_finish_sent {
+		if handler.verifier.print_report(os.Stdout, handler.ctx) > 0 {
+			rc = 1
+		}
+	}
 	if lp.ExitCode() != 0 {
 		rc = lp.ExitCode()
 	}
@@ -1275,14 +1688,46 @@ func send_loop(opts *Options, files []*File) (err error, rc int) {
 }
 
 func send_main(opts *Options, args []string) (err error, rc int) {
+	limiter, err := new_rate_limiter(opts.LimitRate)
+	if err != nil {
+		return fmt.Errorf("Invalid value for --limit-rate: %w", err), 1
+	}
 	fmt.Println("Scanning files…")
 	files, err := files_for_send(opts, args)
 	if err != nil {
 		return err, 1
 	}
+	resume, err := new_resume_manifest(resume_manifest_path(opts, args), opts.Resume)
+	if err != nil {
+		return err, 1
+	}
+	if len(files) == 1 && files[0].is_stream {
+		// streams cannot be resumed
+		resume = nil
+	}
+	if opts.Resume {
+		var num_done, num_skipped int
+		if files, num_done = resume.remove_done_files(files); num_done > 0 {
+			fmt.Printf("Skipping %d files that were already transferred\n", num_done)
+		}
+		if files, num_skipped = resume.restore_queue_state(files); num_skipped > 0 {
+			fmt.Printf("Skipping %d files that were skipped in the interrupted transfer\n", num_skipped)
+		}
+		if len(files) == 0 {
+			if !opts.DryRun {
+				resume.finish(true)
+			}
+			return
+		}
+	}
+	if opts.DryRun {
+		fmt.Printf("Found %d files and directories, requesting permission to read their destinations…", len(files))
+		fmt.Println()
+		return send_dry_run(opts, files)
+	}
 	fmt.Printf("Found %d files and directories, requesting transfer permission…", len(files))
 	fmt.Println()
-	err, rc = send_loop(opts, files)
+	err, rc = send_loop(opts, files, resume, limiter)
 
 	return
 }
@@ -3,12 +3,16 @@
 package transfer
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"kitty/tools/tui/loop"
+
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -100,3 +104,69 @@ func TestPathMappingSend(t *testing.T) {
 		ae(f.file_type, FileType_link)
 	})
 }
+
+func TestInterleavedSend(t *testing.T) {
+	opts := &Options{Mode: "normal", Compress: "never"}
+	tdir := t.TempDir()
+	data := bytes.Repeat([]byte{'x'}, 5*1024*1024/2)
+	for _, name := range []string{"a", "b", "c"} {
+		os.WriteFile(filepath.Join(tdir, name), data, 0o600)
+	}
+	os.Link(filepath.Join(tdir, "c"), filepath.Join(tdir, "l"))
+	var files []*File
+	var err error
+	run_with_paths(tdir, tdir, func() {
+		files, err = files_for_send(opts, []string{"a", "b", "c", "l", "dest/"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := SendManager{files: files, num_streams: 2}
+	m.initialize()
+	names := make(map[string]string, len(files))
+	for _, f := range files {
+		f.metadata_command(false, Compression_zlib)
+		f.state = TRANSMITTING
+		names[f.file_id] = filepath.Base(f.local_path)
+	}
+	actual := []string{}
+	for {
+		found := false
+		if err = m.next_chunks(func(string) loop.IdType { found = true; return 0 }); err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			break
+		}
+		actual = append(actual, names[m.current_chunk_for_file_id])
+	}
+	// the hard link must be sent only after the file it links to
+	if diff := cmp.Diff(strings.Split("a b a b a b c c c l", " "), actual); diff != "" {
+		t.Fatalf("Incorrect order of chunks:\n%s", diff)
+	}
+}
+
+func TestZstdCompression(t *testing.T) {
+	data := bytes.Repeat([]byte("some compressible data "), 4096)
+	c := NewZstdCompressor()
+	var compressed []byte
+	for i := 0; i < len(data); i += 1000 {
+		compressed = append(compressed, c.Compress(data[i:min(i+1000, len(data))])...)
+	}
+	compressed = append(compressed, c.Flush()...)
+	if len(compressed) >= len(data) {
+		t.Fatalf("Data was not compressed: %d >= %d", len(compressed), len(data))
+	}
+	r, err := new_zstd_reader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	actual, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, actual) {
+		t.Fatalf("Decompressed data does not match the original")
+	}
+}
@@ -0,0 +1,135 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+var _ = fmt.Print
+
+// A path of - means STDIN when sending and STDOUT when receiving, so that
+// data can be transferred to and from other programs in a pipeline without
+// temporary files. As the size of streamed data is not known in advance, it
+// cannot use the rsync algorithm or be resumed. The TTY is used for the
+// transfer protocol, so STDIN and STDOUT are free to carry the data.
+
+const stream_path = "-"
+
+func check_stream_options(opts *Options) error {
+	name := ""
+	switch {
+	case opts.Resume:
+		name = "--resume"
+	case opts.Sync:
+		name = "--sync"
+	case opts.TransmitDeltas:
+		name = "--transmit-deltas"
+	case opts.DryRun:
+		name = "--dry-run"
+	default:
+		return nil
+	}
+	return fmt.Errorf("The %s option cannot be used when streaming data with %s", name, stream_path)
+}
+
+// The file to send the data read from STDIN as
+func stdin_file(opts *Options, args []string) (*File, error) {
+	remote_path := args[len(args)-1]
+	if remote_path == stream_path {
+		return nil, fmt.Errorf("Writing to STDOUT is only possible when receiving files")
+	}
+	if len(args) != 2 {
+		return nil, fmt.Errorf("When sending data from STDIN, it must be the only source")
+	}
+	if strings.HasSuffix(remote_path, "/") {
+		return nil, fmt.Errorf("When sending data from STDIN, the destination must be a file name, not %s", remote_path)
+	}
+	if err := check_stream_options(opts); err != nil {
+		return nil, err
+	}
+	s, err := os.Stdin.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to stat STDIN with error: %w", err)
+	}
+	ans := NewFile(opts, stream_path, stream_path, 1, s, remote_path, FileType_regular)
+	ans.is_stream, ans.actual_file, ans.display_name = true, os.Stdin, "STDIN"
+	ans.file_size, ans.bytes_to_transmit, ans.mtime, ans.permissions = 0, 0, time.Now(), 0o644
+	ans.rsync_capable, ans.compression_capable = false, opts.Compress != "never"
+	if opts.Verify {
+		ans.hasher = sha256.New()
+	}
+	return ans, nil
+}
+
+// STDIN is read in a goroutine, so that the event loop is not blocked while a
+// slow producer is writing, which would prevent the transfer from being
+// interrupted. The chunks are passed to the event loop through a channel,
+// with a wakeup when one is available. The capacity of the channel limits
+// how much is read ahead of the transfer.
+
+type stream_chunk struct {
+	data []byte
+	err  error
+}
+
+var stream_data_pending = errors.New("no data is available from the stream yet")
+
+func read_stream(r io.Reader, chunk_size int, chunks chan<- stream_chunk, wakeup func() bool) {
+	for {
+		buf := make([]byte, chunk_size)
+		n, err := r.Read(buf)
+		if n > 0 || err != nil {
+			if errors.Is(err, io.EOF) {
+				// the end of a stream is known only when reading returns no data
+				err = nil
+				n = 0
+			}
+			chunks <- stream_chunk{data: buf[:n], err: err}
+			wakeup()
+			if n == 0 || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// The next chunk read from the stream, returning stream_data_pending if none
+// is available yet. An empty chunk marks the end of the stream.
+func (self *File) next_stream_chunk(chunk_size int, wakeup func() bool) ([]byte, error) {
+	if self.stream_chunks == nil {
+		self.stream_chunks = make(chan stream_chunk, 2)
+		go read_stream(self.actual_file, chunk_size, self.stream_chunks, wakeup)
+	}
+	select {
+	case c := <-self.stream_chunks:
+		return c.data, c.err
+	default:
+		return nil, stream_data_pending
+	}
+}
+
+type stream_file struct {
+	w   io.Writer
+	pos int64
+}
+
+func (sf *stream_file) tell() (int64, error) {
+	return sf.pos, nil
+}
+
+func (sf *stream_file) close() error {
+	return nil
+}
+
+func (sf *stream_file) write(data []byte) (n int, err error) {
+	n, err = sf.w.Write(data)
+	sf.pos += int64(n)
+	return
+}
@@ -0,0 +1,70 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+var _ = fmt.Print
+
+func TestStreamTransfer(t *testing.T) {
+	opts := &Options{Mode: "normal", Compress: "auto"}
+	for _, args := range [][]string{{"-", "dest/"}, {"-", "a", "dest"}, {"a", "-"}} {
+		if _, err := files_for_send(opts, args); err == nil {
+			t.Fatalf("Sending %#v did not fail", args)
+		}
+	}
+	opts.Resume = true
+	if _, err := files_for_send(opts, []string{"-", "dest"}); err == nil {
+		t.Fatalf("Resuming a stream did not fail")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data := []byte("some streamed data")
+	wakeups := make(chan bool, 8)
+	wakeup := func() bool { wakeups <- true; return true }
+	f := &File{file_type: FileType_regular, is_stream: true, actual_file: r, compressor: &IdentityCompressor{}}
+	// reading does not block while the producer has not written anything
+	if _, _, err = f.next_chunk(wakeup); !errors.Is(err, stream_data_pending) {
+		t.Fatalf("Reading from a stream with no data available did not return immediately: %v", err)
+	}
+	go func() {
+		w.Write(data)
+		w.Close()
+	}()
+	var received []byte
+	for f.state != FINISHED {
+		chunk, _, err := f.next_chunk(wakeup)
+		if errors.Is(err, stream_data_pending) {
+			select {
+			case <-wakeups:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("No wakeup when data was available from the stream")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, chunk...)
+	}
+	if !bytes.Equal(data, received) {
+		t.Fatalf("Incorrect data read from stream: %#v", string(received))
+	}
+
+	sf := &stream_file{w: &bytes.Buffer{}}
+	sf.write(data)
+	if pos, _ := sf.tell(); pos != int64(len(data)) {
+		t.Fatalf("Incorrect position in stream: %d", pos)
+	}
+}
@@ -0,0 +1,62 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// In sync mode the files being received are compared with the files already
+// present on the receiving computer. Files with the same size and modification
+// time are skipped and the rest are transferred with the rsync algorithm so
+// that only the changed blocks are sent. With --delete, files present in the
+// received directories that do not exist on the sending computer are deleted.
+
+// Whether the local file has the same size and modification time as the remote file
+func (self *remote_file) is_up_to_date() bool {
+	s, err := os.Lstat(self.expanded_local_path)
+	return err == nil && s.Mode().IsRegular() && s.Size() == self.expected_size && s.ModTime().UnixNano() == int64(self.mtime)
+}
+
+// The local files in the received directories that are not being received,
+// except those excluded by the filter, which are left alone
+func extraneous_files(files []*remote_file, filter *file_filter) (ans []string) {
+	expected := utils.NewSet[string](len(files))
+	for _, f := range files {
+		expected.Add(f.expanded_local_path)
+	}
+	for _, f := range files {
+		if f.ftype != FileType_directory {
+			continue
+		}
+		entries, err := os.ReadDir(f.expanded_local_path)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if filter.is_excluded(f.rel_path+"/"+e.Name(), e.IsDir()) {
+				continue
+			}
+			if path := filepath.Join(f.expanded_local_path, e.Name()); !expected.Has(path) {
+				ans = append(ans, path)
+			}
+		}
+	}
+	return utils.Sort(ans, strings.Compare)
+}
+
+func delete_files(paths []string) error {
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("Failed to delete %s with error: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestSyncReceive(t *testing.T) {
+	tdir := t.TempDir()
+	d := filepath.Join(tdir, "d")
+	os.MkdirAll(filepath.Join(d, "extra-dir"), 0o700)
+	for _, name := range []string{"same", "changed", "extra"} {
+		os.WriteFile(filepath.Join(d, name), []byte(name), 0o600)
+	}
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 123, time.UTC)
+	os.Chtimes(filepath.Join(d, "same"), mtime, mtime)
+	os.Chtimes(filepath.Join(d, "changed"), mtime, mtime)
+
+	rf := func(name string, ftype FileType, size int64) *remote_file {
+		return &remote_file{expanded_local_path: filepath.Join(tdir, name), ftype: ftype, expected_size: size, mtime: time.Duration(mtime.UnixNano())}
+	}
+	files := []*remote_file{rf("d", FileType_directory, 0), rf("d/same", FileType_regular, 4), rf("d/changed", FileType_regular, 3), rf("d/new", FileType_regular, 3)}
+	for i, expected := range []bool{false, true, false, false} {
+		if actual := files[i].is_up_to_date(); actual != expected {
+			t.Fatalf("Incorrect up to date status for %s: %v", files[i].expanded_local_path, actual)
+		}
+	}
+	extra := extraneous_files(files, nil)
+	if diff := cmp.Diff([]string{filepath.Join(d, "extra"), filepath.Join(d, "extra-dir")}, extra); diff != "" {
+		t.Fatalf("Incorrect extraneous files:\n%s", diff)
+	}
+	if err := delete_files(extra); err != nil {
+		t.Fatal(err)
+	}
+	if extra = extraneous_files(files, nil); len(extra) != 0 {
+		t.Fatalf("Extraneous files were not deleted: %#v", extra)
+	}
+}
@@ -95,12 +95,12 @@ func should_be_compressed(path, strategy string) bool {
 	ext := strings.ToLower(filepath.Ext(path))
 	if ext != "" {
 		switch ext[1:] {
-		case "zip", "odt", "odp", "pptx", "docx", "gz", "bz2", "xz", "svgz":
+		case "zip", "odt", "odp", "pptx", "docx", "xlsx", "jar", "apk", "whl", "gz", "tgz", "bz2", "xz", "zst", "lz4", "lzma", "7z", "rar", "br", "svgz":
 			return false
 		}
 	}
 	mt := utils.GuessMimeType(path)
-	if strings.HasSuffix(mt, "+zip") || (strings.HasPrefix(mt, "image/") && mt != "image/svg+xml") || strings.HasPrefix(mt, "video/") {
+	if strings.HasSuffix(mt, "+zip") || (strings.HasPrefix(mt, "image/") && mt != "image/svg+xml") || strings.HasPrefix(mt, "video/") || strings.HasPrefix(mt, "audio/") {
 		return false
 	}
 	return true
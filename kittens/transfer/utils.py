@@ -3,7 +3,9 @@
 
 import os
 from contextlib import contextmanager
-from typing import Generator
+from typing import Any, Generator
+
+from kitty.types import run_once
 
 _cwd = _home = ''
 
@@ -58,3 +60,52 @@ def compress(self, data: bytes) -> bytes:
 
     def flush(self) -> bytes:
         return self.c.flush()
+
+
+@run_once
+def zstd_implementation() -> str:
+    # zstd is in the stdlib since Python 3.14, otherwise use the zstandard package if present
+    try:
+        from compression import zstd  # type: ignore # noqa
+        return 'stdlib'
+    except ImportError:
+        pass
+    try:
+        import zstandard  # type: ignore # noqa
+        return 'zstandard'
+    except ImportError:
+        return ''
+
+
+class ZstdCompressor:
+
+    def __init__(self) -> None:
+        self.c: Any = None
+        if zstd_implementation() == 'stdlib':
+            from compression import zstd
+            self.c = zstd.ZstdCompressor()
+        else:
+            import zstandard
+            self.c = zstandard.ZstdCompressor().compressobj()
+
+    def compress(self, data: bytes) -> bytes:
+        return bytes(self.c.compress(data))
+
+    def flush(self) -> bytes:
+        # ends the frame for both implementations
+        return bytes(self.c.flush())
+
+
+class ZstdDecompressor:
+
+    def __init__(self) -> None:
+        self.d: Any = None
+        if zstd_implementation() == 'stdlib':
+            from compression import zstd
+            self.d = zstd.ZstdDecompressor()
+        else:
+            import zstandard
+            self.d = zstandard.ZstdDecompressor().decompressobj()
+
+    def __call__(self, data: bytes, is_last: bool = False) -> bytes:
+        return bytes(self.d.decompress(data)) if data else b''
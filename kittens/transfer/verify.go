@@ -0,0 +1,152 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"kitty/tools/cli/markup"
+)
+
+var _ = fmt.Print
+
+// With --verify, once all files have been transferred and before the transfer
+// is finished, the SHA-256 digest of every transferred regular file is
+// computed on this computer and requested from the terminal with a verify
+// command, to detect any corruption of the transferred data. Streamed data
+// cannot be read again, so its digest is computed while it is transferred.
+// The digests of the local files are computed in a worker goroutine, so as not
+// to block the event loop while reading large files, while the terminal
+// computes the digests of the remote files.
+
+type verify_result struct {
+	file_id, display_name, local_path string
+	local_digest, remote_digest       []byte
+	// local_err is set by the worker goroutine and err by the event loop
+	local_err, err string
+	received       bool
+}
+
+func (self *verify_result) ok() bool {
+	return self.local_err == "" && self.err == "" && bytes.Equal(self.local_digest, self.remote_digest)
+}
+
+type verifier struct {
+	results              []*verify_result
+	pending              map[string]*verify_result
+	num_pending          int
+	local_digests_needed []*verify_result
+	local_digests_done   atomic.Bool
+}
+
+func file_digest(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func new_verifier() *verifier {
+	return &verifier{pending: make(map[string]*verify_result)}
+}
+
+// Add a file to be verified, using digest as its local digest if not nil,
+// otherwise computing it from the file at local_path
+func (self *verifier) add(file_id, display_name, local_path string, digest []byte) {
+	r := &verify_result{file_id: file_id, display_name: display_name, local_path: local_path, local_digest: digest}
+	self.results = append(self.results, r)
+	if r.local_digest == nil {
+		self.local_digests_needed = append(self.local_digests_needed, r)
+	}
+	self.pending[file_id] = r
+	self.num_pending++
+}
+
+// Compute the digests of the local files in a worker goroutine, calling
+// wakeup from it once they have all been computed
+func (self *verifier) compute_local_digests(wakeup func() bool) {
+	needed := self.local_digests_needed
+	self.local_digests_needed = nil
+	if len(needed) == 0 {
+		self.local_digests_done.Store(true)
+		return
+	}
+	go func() {
+		for _, r := range needed {
+			var err error
+			if r.local_digest, err = file_digest(r.local_path); err != nil {
+				r.local_err = fmt.Sprintf("Failed to read local file with error: %s", err)
+			}
+		}
+		self.local_digests_done.Store(true)
+		wakeup()
+	}()
+}
+
+// The verify commands to send to the terminal
+func (self *verifier) requests() (ans []*FileTransmissionCommand) {
+	for _, r := range self.results {
+		if self.pending[r.file_id] != nil {
+			ans = append(ans, &FileTransmissionCommand{Action: Action_verify, File_id: r.file_id})
+		}
+	}
+	return
+}
+
+func (self *verifier) on_response(ftc *FileTransmissionCommand) {
+	r := self.pending[ftc.File_id]
+	if r == nil || r.received {
+		return
+	}
+	r.received = true
+	self.num_pending--
+	if ftc.Status == "OK" {
+		r.remote_digest = ftc.Data
+	} else {
+		_, msg, _ := strings.Cut(ftc.Status, ":")
+		r.err = fmt.Sprintf("Failed to verify remote file with error: %s", msg)
+	}
+}
+
+func (self *verifier) is_complete() bool {
+	return self.num_pending <= 0 && self.local_digests_done.Load()
+}
+
+// Print the verification report, returning the number of files that failed
+// verification
+func (self *verifier) print_report(w io.Writer, ctx *markup.Context) (num_failed int) {
+	fmt.Fprintln(w, "Verification of transferred files:")
+	for _, r := range self.results {
+		switch {
+		case r.ok():
+			fmt.Fprintln(w, " ", ctx.Green("✔"), r.display_name)
+		case r.local_err != "":
+			num_failed++
+			fmt.Fprintln(w, " ", ctx.BrightRed("✘"), r.display_name+":", r.local_err)
+		case r.err != "":
+			num_failed++
+			fmt.Fprintln(w, " ", ctx.BrightRed("✘"), r.display_name+":", r.err)
+		default:
+			num_failed++
+			fmt.Fprintln(w, " ", ctx.BrightRed("✘"), r.display_name+":", "Contents differ after transfer")
+		}
+	}
+	if num_failed > 0 {
+		fmt.Fprintln(w, ctx.BrightRed(fmt.Sprintf("%d out of %d files failed verification", num_failed, len(self.results))))
+	} else {
+		fmt.Fprintln(w, ctx.Green(fmt.Sprintf("All %d files verified successfully", len(self.results))))
+	}
+	return
+}
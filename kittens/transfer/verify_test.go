@@ -0,0 +1,66 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kitty/tools/cli/markup"
+)
+
+var _ = fmt.Print
+
+func TestVerifyTransfer(t *testing.T) {
+	tdir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		os.WriteFile(filepath.Join(tdir, name), []byte(name), 0o600)
+	}
+	digest := func(data string) []byte {
+		h := sha256.Sum256([]byte(data))
+		return h[:]
+	}
+	v := new_verifier()
+	for _, name := range []string{"a", "b", "c", "missing"} {
+		v.add(name, name, filepath.Join(tdir, name), nil)
+	}
+	v.add("stream", "STDIN", "", digest("streamed"))
+	actual := []string{}
+	for _, ftc := range v.requests() {
+		actual = append(actual, ftc.File_id)
+	}
+	if strings.Join(actual, " ") != "a b c missing stream" {
+		t.Fatalf("Incorrect verify requests: %#v", actual)
+	}
+	v.on_response(&FileTransmissionCommand{Action: Action_verify, File_id: "a", Status: "OK", Data: digest("a")})
+	v.on_response(&FileTransmissionCommand{Action: Action_verify, File_id: "b", Status: "OK", Data: digest("corrupted")})
+	v.on_response(&FileTransmissionCommand{Action: Action_verify, File_id: "c", Status: "ENOENT:No such file"})
+	if v.is_complete() {
+		t.Fatalf("Verification complete before all responses were received")
+	}
+	v.on_response(&FileTransmissionCommand{Action: Action_verify, File_id: "missing", Status: "OK", Data: digest("missing")})
+	v.on_response(&FileTransmissionCommand{Action: Action_verify, File_id: "stream", Status: "OK", Data: digest("streamed")})
+	if v.is_complete() {
+		t.Fatalf("Verification complete before the local digests were computed")
+	}
+	done := make(chan bool)
+	v.compute_local_digests(func() bool { done <- true; return true })
+	<-done
+	if !v.is_complete() {
+		t.Fatalf("Verification not complete after all responses were received")
+	}
+	var output bytes.Buffer
+	if num_failed := v.print_report(&output, markup.New(false)); num_failed != 3 {
+		t.Fatalf("Incorrect number of failures: %d\n%s", num_failed, output.String())
+	}
+	for _, r := range v.results {
+		if expected := r.file_id == "a" || r.file_id == "stream"; r.ok() != expected {
+			t.Fatalf("Incorrect verification result for %s: %v", r.file_id, r.ok())
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// With --xattrs and --acls the extended attributes of files and their POSIX
+// ACLs, which are stored as extended attributes, are carried in the metadata
+// of the files as a JSON object mapping attribute names to their base64
+// encoded values. The kinds of attributes wanted are sent to the terminal in
+// the receive and send commands and the receiving end sets only attributes of
+// those kinds, so that a sender cannot set, for example, security attributes.
+// Attributes that cannot be set on the receiving computer, for instance
+// because the filesystem does not support them, are ignored.
+//
+// With --sparse, regular files that have holes are marked as sparse in their
+// metadata and the receiving end skips over blocks of zeros instead of writing
+// them, so that they become holes in the received file.
+
+const (
+	xattr_kind_xattrs = "xattrs"
+	xattr_kind_acls   = "acls"
+	sparse_block_size = 4096
+)
+
+var acl_xattr_names = []string{"system.posix_acl_access", "system.posix_acl_default"}
+
+// The comma separated kinds of extended attributes to transfer
+func xattr_kinds(opts *Options) string {
+	ans := make([]string, 0, 2)
+	if opts.Xattrs {
+		ans = append(ans, xattr_kind_xattrs)
+	}
+	if opts.Acls {
+		ans = append(ans, xattr_kind_acls)
+	}
+	return strings.Join(ans, ",")
+}
+
+// Whether the attribute with the specified name is to be transferred. Only
+// attributes that can be set by unprivileged users are transferred as
+// extended attributes, ACLs are transferred only with --acls.
+func xattr_wanted(name string, kinds string) bool {
+	has := func(kind string) bool {
+		for _, x := range strings.Split(kinds, ",") {
+			if strings.TrimSpace(x) == kind {
+				return true
+			}
+		}
+		return false
+	}
+	for _, x := range acl_xattr_names {
+		if name == x {
+			return has(xattr_kind_acls)
+		}
+	}
+	for _, prefix := range []string{"system.", "security.", "trusted."} {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	return has(xattr_kind_xattrs)
+}
+
+func encode_xattrs(attrs map[string][]byte) string {
+	if len(attrs) == 0 {
+		return ""
+	}
+	m := make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		m[k] = base64.StdEncoding.EncodeToString(v)
+	}
+	data, _ := json.Marshal(m)
+	return utils.UnsafeBytesToString(data)
+}
+
+func decode_xattrs(raw string) (map[string][]byte, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	m := make(map[string]string)
+	if err := json.Unmarshal(utils.UnsafeStringToBytes(raw), &m); err != nil {
+		return nil, fmt.Errorf("Invalid extended attributes with error: %w", err)
+	}
+	ans := make(map[string][]byte, len(m))
+	for k, v := range m {
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("The extended attribute %#v has invalid value with error: %w", k, err)
+		}
+		ans[k] = b
+	}
+	return ans, nil
+}
+
+// The encoded extended attributes of the file at path, of the specified
+// kinds. Attributes that cannot be read are ignored.
+func read_xattrs(path string, kinds string) string {
+	if kinds == "" {
+		return ""
+	}
+	names, err := list_xattrs(path)
+	if err != nil {
+		return ""
+	}
+	attrs := make(map[string][]byte, len(names))
+	for _, name := range names {
+		if xattr_wanted(name, kinds) {
+			if val, err := get_xattr(path, name); err == nil {
+				attrs[name] = val
+			}
+		}
+	}
+	return encode_xattrs(attrs)
+}
+
+// Set the encoded extended attributes of the specified kinds on the file at
+// path, ignoring the ones that cannot be set
+func apply_xattrs(path string, raw string, kinds string) {
+	if kinds == "" {
+		return
+	}
+	if attrs, err := decode_xattrs(raw); err == nil {
+		for name, val := range attrs {
+			if xattr_wanted(name, kinds) {
+				_ = set_xattr(path, name, val)
+			}
+		}
+	}
+}
+
+// Whether the file has holes, that is fewer blocks are allocated for it than
+// are needed for its size
+func is_sparse(s fs.FileInfo) bool {
+	if st, ok := s.Sys().(*syscall.Stat_t); ok && s.Mode().IsRegular() {
+		return int64(st.Blocks)*512 < s.Size()
+	}
+	return false
+}
+
+var zero_block = make([]byte, sparse_block_size)
+
+// Write data to the file skipping over blocks of zeros so that they become
+// holes. The file must be truncated to its final size once all data has been
+// written, see finish_sparse_write().
+func sparse_write(f io.WriteSeeker, data []byte) (n int, err error) {
+	for len(data) > 0 {
+		chunk := data[:utils.Min(len(data), sparse_block_size)]
+		if bytes.Equal(chunk, zero_block[:len(chunk)]) {
+			_, err = f.Seek(int64(len(chunk)), io.SeekCurrent)
+		} else {
+			var w int
+			w, err = f.Write(chunk)
+			if err == nil && w < len(chunk) {
+				err = io.ErrShortWrite
+			}
+		}
+		if err != nil {
+			return
+		}
+		n += len(chunk)
+		data = data[len(chunk):]
+	}
+	return
+}
+
+// Set the size of the file to the current position, creating the hole at the
+// end of the file if its data ended with blocks of zeros
+func finish_sparse_write(f *os.File) error {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return f.Truncate(pos)
+}
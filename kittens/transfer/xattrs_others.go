@@ -0,0 +1,24 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+//go:build !linux && !darwin
+
+package transfer
+
+import (
+	"errors"
+	"fmt"
+)
+
+var _ = fmt.Print
+
+func list_xattrs(path string) ([]string, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func get_xattr(path, name string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func set_xattr(path, name string, val []byte) error {
+	return errors.ErrUnsupported
+}
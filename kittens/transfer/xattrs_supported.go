@@ -0,0 +1,60 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+//go:build linux || darwin
+
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ = fmt.Print
+
+func list_xattrs(path string) ([]string, error) {
+	for {
+		sz, err := unix.Llistxattr(path, nil)
+		if err != nil || sz == 0 {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		if sz, err = unix.Llistxattr(path, buf); err != nil {
+			if errors.Is(err, unix.ERANGE) {
+				// the attributes changed since the size was queried
+				continue
+			}
+			return nil, err
+		}
+		ans := make([]string, 0, 8)
+		for _, x := range strings.Split(string(buf[:sz]), "\x00") {
+			if x != "" {
+				ans = append(ans, x)
+			}
+		}
+		return ans, nil
+	}
+}
+
+func get_xattr(path, name string) ([]byte, error) {
+	for {
+		sz, err := unix.Lgetxattr(path, name, nil)
+		if err != nil || sz == 0 {
+			return []byte{}, err
+		}
+		buf := make([]byte, sz)
+		if sz, err = unix.Lgetxattr(path, name, buf); err != nil {
+			if errors.Is(err, unix.ERANGE) {
+				continue
+			}
+			return nil, err
+		}
+		return buf[:sz], nil
+	}
+}
+
+func set_xattr(path, name string, val []byte) error {
+	return unix.Lsetxattr(path, name, val, 0)
+}
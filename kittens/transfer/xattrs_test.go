@@ -0,0 +1,104 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestXattrs(t *testing.T) {
+	for _, x := range []struct {
+		name, kinds string
+		expected    bool
+	}{
+		{"user.test", "xattrs", true},
+		{"user.test", "acls", false},
+		{"user.test", "", false},
+		{"system.posix_acl_access", "xattrs", false},
+		{"system.posix_acl_access", "xattrs,acls", true},
+		{"system.posix_acl_default", "acls", true},
+		{"security.selinux", "xattrs,acls", false},
+		{"trusted.x", "xattrs", false},
+		{"com.apple.quarantine", "xattrs", true},
+	} {
+		if actual := xattr_wanted(x.name, x.kinds); actual != x.expected {
+			t.Fatalf("Incorrect wanted status for %s with %#v: %v", x.name, x.kinds, actual)
+		}
+	}
+	attrs := map[string][]byte{"user.a": []byte("1"), "user.b": {0, 1, 2}, "user.empty": {}}
+	actual, err := decode_xattrs(encode_xattrs(attrs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(attrs, actual); diff != "" {
+		t.Fatalf("Extended attributes not roundtripped:\n%s", diff)
+	}
+	if encode_xattrs(nil) != "" {
+		t.Fatalf("Empty extended attributes not encoded as empty string")
+	}
+	if _, err = decode_xattrs("{"); err == nil {
+		t.Fatalf("Invalid extended attributes did not fail to decode")
+	}
+
+	tdir := t.TempDir()
+	src, dest := filepath.Join(tdir, "src"), filepath.Join(tdir, "dest")
+	os.WriteFile(src, nil, 0o600)
+	os.WriteFile(dest, nil, 0o600)
+	if err = set_xattr(src, "user.test", []byte("value")); err != nil {
+		t.Skipf("Extended attributes not supported: %s", err)
+	}
+	raw := read_xattrs(src, "xattrs")
+	if read_xattrs(src, "acls") != "" {
+		t.Fatalf("Extended attributes read when only ACLs were requested")
+	}
+	apply_xattrs(dest, raw, "acls")
+	if _, err := get_xattr(dest, "user.test"); err == nil {
+		t.Fatalf("Extended attribute applied when only ACLs were requested")
+	}
+	// attributes of kinds that were not requested are not applied
+	raw = encode_xattrs(map[string][]byte{"user.test": []byte("value"), "security.test": []byte("x"), "trusted.test": []byte("x")})
+	apply_xattrs(dest, raw, "xattrs")
+	if val, err := get_xattr(dest, "user.test"); err != nil || string(val) != "value" {
+		t.Fatalf("Extended attribute not applied: %#v %v", string(val), err)
+	}
+	for _, name := range []string{"security.test", "trusted.test"} {
+		if _, err := get_xattr(dest, name); err == nil {
+			t.Fatalf("Privileged extended attribute applied: %s", name)
+		}
+	}
+}
+
+func TestSparseWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sparse")
+	data := make([]byte, 5*sparse_block_size)
+	copy(data[sparse_block_size:], []byte("some data"))
+	data[len(data)-sparse_block_size-1] = 1
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range [][]byte{data[:3*sparse_block_size], data[3*sparse_block_size:]} {
+		if n, err := sparse_write(f, chunk); err != nil || n != len(chunk) {
+			t.Fatalf("Failed to write sparse data: %d %v", n, err)
+		}
+	}
+	if err = finish_sparse_write(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	actual, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, actual) {
+		t.Fatalf("Data not preserved by sparse writing")
+	}
+}
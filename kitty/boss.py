@@ -94,6 +94,7 @@
     global_font_size,
     last_focused_os_window_id,
     mark_os_window_for_close,
+    monitor_pid,
     monotonic,
     os_window_focus_counters,
     os_window_font_size,
@@ -336,10 +337,13 @@ def __init__(
         self.encryption_public_key = f'{RC_ENCRYPTION_PROTOCOL_VERSION}:{base64.b85encode(self.encryption_key.public).decode("ascii")}'
         self.clipboard_buffers: Dict[str, str] = {}
         self.update_check_process: Optional['PopenType[bytes]'] = None
+        self.monitored_pid_callbacks: Dict[int, Callable[[int], None]] = {}
         self.window_id_map: WeakValueDictionary[int, Window] = WeakValueDictionary()
         self.startup_colors = {k: opts[k] for k in opts if isinstance(opts[k], Color)}
         self.current_visual_select: Optional[VisualSelect] = None
         self.startup_cursor_text_color = opts.cursor_text_color
+        # The configured values of colors changed by the automatic theme
+        self.colors_before_auto_theme: Dict[str, Optional[int]] = {}
         # A list of events received so far that are potentially part of a sequence keybinding.
         self.cached_values = cached_values
         self.os_window_map: Dict[int, TabManager] = {}
@@ -378,6 +382,7 @@ def __init__(
             cocoa_set_notification_activated_callback(notification_activated)
 
     def startup_first_child(self, os_window_id: Optional[int], startup_sessions: Iterable[Session] = ()) -> None:
+        self.apply_system_color_scheme()
         si = startup_sessions or create_sessions(get_options(), self.args, default_session=get_options().startup_session)
         focused_os_window = wid = 0
         token = os.environ.pop('XDG_ACTIVATION_TOKEN', '')
@@ -2574,6 +2579,8 @@ def load_config_file(self, *paths: str, apply_overrides: bool = True, overrides:
         if bad_lines:
             self.show_bad_config_lines(bad_lines)
         self.apply_new_options(opts)
+        self.colors_before_auto_theme = {}
+        self.apply_system_color_scheme()
         from .open_actions import clear_caches
         clear_caches()
         from .guess_mime_type import clear_mime_cache
@@ -2594,7 +2601,20 @@ def set_update_check_process(self, process: Optional['PopenType[bytes]'] = None)
                     self.update_check_process.kill()
         self.update_check_process = process
 
+    def monitor_process(self, pid: int, callback: Callable[[int], None]) -> None:
+        ' Call the callback with the exit status of the child process when it exits '
+        self.monitored_pid_callbacks[pid] = callback
+        monitor_pid(pid)
+
     def on_monitored_pid_death(self, pid: int, exit_status: int) -> None:
+        callback = self.monitored_pid_callbacks.pop(pid, None)
+        if callback is not None:
+            try:
+                callback(exit_status)
+            except Exception:
+                import traceback
+                traceback.print_exc()
+            return
         update_check_process = self.update_check_process
         if update_check_process is not None and pid == update_check_process.pid:
             self.update_check_process = None
@@ -2935,7 +2955,46 @@ def sanitize_url_for_dispay_to_user(self, url: str) -> str:
         return sanitize_url_for_dispay_to_user(url)
 
     def on_system_color_scheme_change(self, appearance: int) -> None:
-        log_error('system color theme changed:', appearance)
+        self.apply_system_color_scheme(appearance)
+
+    def apply_system_color_scheme(self, appearance: Optional[int] = None) -> None:
+        # appearance is 0 for no preference, 1 for dark and 2 for light
+        from .fast_data_types import get_system_color_theme, patch_color_profiles
+        from .rc.set_colors import parse_colors
+        if appearance is None:
+            try:
+                appearance = get_system_color_theme()
+            except RuntimeError:
+                return
+        name = {1: 'dark', 2: 'light'}.get(appearance, 'no-preference')
+        path = os.path.join(config_dir, f'{name}-theme.auto.conf')
+        try:
+            colors = parse_colors((path,))
+        except FileNotFoundError:
+            # revert to the colors from kitty.conf
+            colors = {}
+        except Exception as e:
+            log_error(f'Failed to load colors from {path} with error: {e}')
+            return
+        opts = get_options()
+        saved = self.colors_before_auto_theme
+        revert = {k: v for k, v in saved.items() if k not in colors}
+        for k in colors:
+            if k not in saved:
+                v = getattr(opts, k, None)
+                saved[k] = None if v is None else int(v)
+        for k in revert:
+            del saved[k]
+        colors = {**revert, **colors}
+        if not colors:
+            return
+        windows = tuple(self.all_windows)
+        patch_color_profiles(colors, tuple(w.screen.color_profile for w in windows), True)
+        self.patch_colors(colors, True)
+        for w in windows:
+            if 'background' in colors:
+                self.default_bg_changed_for(w.id)
+            w.refresh()
 
     @ac('win', '''
         Toggle to the tab matching the specified expression
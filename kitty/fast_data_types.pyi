@@ -1574,4 +1574,5 @@ def replace_c0_codes_except_nl_space_tab(text: str) -> str:...
 def replace_c0_codes_except_nl_space_tab(text: Union[bytes, memoryview, bytearray]) -> bytes:...
 def terminfo_data() -> bytes:...
 def wayland_compositor_pid() -> int:...
+def get_system_color_theme() -> int: ...
 def monotonic() -> float: ...
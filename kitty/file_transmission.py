@@ -2,25 +2,47 @@
 # License: GPLv3 Copyright: 2021, Kovid Goyal <kovid at kovidgoyal.net>
 
 import errno
+import hashlib
 import io
 import json
 import os
 import re
 import stat
 import tempfile
-from base64 import b85decode
+from base64 import b85decode, standard_b64decode, standard_b64encode
 from collections import defaultdict, deque
 from contextlib import suppress
-from dataclasses import Field, dataclass, field, fields
+from dataclasses import Field, dataclass, field, fields, replace
 from enum import Enum, auto
 from functools import partial
 from gettext import gettext as _
 from itertools import count
 from time import time_ns
-from typing import IO, Any, Callable, DefaultDict, Deque, Dict, Iterable, Iterator, List, Optional, Tuple, Union
-
-from kittens.transfer.utils import IdentityCompressor, ZlibCompressor, abspath, expand_home, home_path
-from kitty.fast_data_types import ESC_OSC, FILE_TRANSFER_CODE, AES256GCMDecrypt, add_timer, base64_decode, base64_encode, get_boss, get_options, monotonic
+from typing import IO, Any, Callable, DefaultDict, Deque, Dict, FrozenSet, Iterable, Iterator, List, Optional, Tuple, Union
+
+from kittens.transfer.utils import (
+    IdentityCompressor,
+    ZlibCompressor,
+    ZstdCompressor,
+    ZstdDecompressor,
+    abspath,
+    expand_home,
+    home_path,
+    zstd_implementation,
+)
+from kitty.fast_data_types import (
+    ESC_OSC,
+    FILE_TRANSFER_CODE,
+    AES256GCMDecrypt,
+    AES256GCMEncrypt,
+    Secret,
+    add_timer,
+    base64_decode,
+    base64_encode,
+    get_boss,
+    get_options,
+    monotonic,
+)
 from kitty.types import run_once
 
 from .utils import log_error
@@ -67,16 +89,71 @@ def split_for_transfer(
         data = data[chunk_size:]
 
 
-def iter_file_metadata(file_specs: Iterable[Tuple[str, str]]) -> Iterator[Union['FileTransmissionCommand', 'TransmissionError']]:
+ACL_XATTR_NAMES = frozenset(('system.posix_acl_access', 'system.posix_acl_default'))
+
+
+def xattr_wanted(name: str, kinds: str) -> bool:
+    # kinds is a comma separated list of the kinds of attributes requested,
+    # xattrs for attributes settable by normal users and acls for POSIX ACLs
+    requested = {x.strip() for x in kinds.split(',')}
+    if name in ACL_XATTR_NAMES:
+        return 'acls' in requested
+    if name.startswith(('system.', 'security.', 'trusted.')):
+        return False
+    return 'xattrs' in requested
+
+
+def read_xattrs(path: str, kinds: str) -> str:
+    if not kinds or not hasattr(os, 'listxattr'):
+        return ''
+    ans = {}
+    with suppress(OSError):
+        for name in os.listxattr(path, follow_symlinks=False):
+            if xattr_wanted(name, kinds):
+                with suppress(OSError):
+                    ans[name] = standard_b64encode(os.getxattr(path, name, follow_symlinks=False)).decode('ascii')
+    return json.dumps(ans) if ans else ''
+
+
+def apply_xattrs(path: str, raw: str, kinds: str, follow_symlinks: bool = True) -> None:
+    if not raw or not kinds or not hasattr(os, 'setxattr'):
+        return
+    try:
+        attrs = json.loads(raw)
+    except Exception:
+        return
+    for name, val in attrs.items():
+        # the sender must not be able to set attributes it was not asked for
+        if not xattr_wanted(name, kinds):
+            continue
+        with suppress(Exception):
+            os.setxattr(path, name, standard_b64decode(val), follow_symlinks=follow_symlinks)
+
+
+def is_sparse(sr: os.stat_result) -> bool:
+    blocks = getattr(sr, 'st_blocks', None)
+    return blocks is not None and stat.S_ISREG(sr.st_mode) and blocks * 512 < sr.st_size
+
+
+def iter_file_metadata(
+    file_specs: Iterable[Tuple[str, str]], xattr_kinds: str = '', sparse: bool = False, follow_symlinks: bool = False,
+) -> Iterator[Union['FileTransmissionCommand', 'TransmissionError']]:
     file_map: DefaultDict[Tuple[int, int], List[FileTransmissionCommand]] = defaultdict(list)
     counter = count()
 
     def skey(sr: os.stat_result) -> Tuple[int, int]:
         return sr.st_dev, sr.st_ino
 
-    def make_ftc(path: str, spec_id: str, sr: Optional[os.stat_result] = None, parent: str = '') -> FileTransmissionCommand:
+    def make_ftc(
+        path: str, spec_id: str, sr: Optional[os.stat_result] = None, parent: str = '', ancestors: FrozenSet[Tuple[int, int]] = frozenset()
+    ) -> FileTransmissionCommand:
         if sr is None:
             sr = os.stat(path, follow_symlinks=False)
+            if follow_symlinks and stat.S_ISLNK(sr.st_mode):
+                sr = os.stat(path)
+                # ancestors are the directories being traversed
+                if stat.S_ISDIR(sr.st_mode) and skey(sr) in ancestors:
+                    raise ValueError('Symlink to a directory containing it')
         if stat.S_ISLNK(sr.st_mode):
             ftype = FileType.symlink
         elif stat.S_ISDIR(sr.st_mode):
@@ -87,23 +164,25 @@ def make_ftc(path: str, spec_id: str, sr: Optional[os.stat_result] = None, paren
             raise ValueError('Not an appropriate file type')
         ans = FileTransmissionCommand(
             action=Action.file, file_id=spec_id, mtime=sr.st_mtime_ns, permissions=stat.S_IMODE(sr.st_mode),
-            name=path, status=str(next(counter)), size=sr.st_size, ftype=ftype, parent=parent
+            name=path, status=str(next(counter)), size=sr.st_size, ftype=ftype, parent=parent,
+            xattrs=read_xattrs(path, xattr_kinds), sparse=int(sparse and is_sparse(sr)),
         )
         file_map[skey(sr)].append(ans)
         return ans
 
-    def add_dir(ftc: FileTransmissionCommand) -> None:
+    def add_dir(ftc: FileTransmissionCommand, ancestors: FrozenSet[Tuple[int, int]] = frozenset()) -> None:
         try:
             lr = os.listdir(ftc.name)
+            ancestors = ancestors | {skey(os.stat(ftc.name))}
         except OSError:
             return
         for entry in lr:
             try:
-                child_ftc = make_ftc(os.path.join(ftc.name, entry), spec_id, parent=ftc.status)
+                child_ftc = make_ftc(os.path.join(ftc.name, entry), spec_id, parent=ftc.status, ancestors=ancestors)
             except (ValueError, OSError):
                 continue
             if child_ftc.ftype is FileType.directory:
-                add_dir(child_ftc)
+                add_dir(child_ftc, ancestors)
 
     for spec_id, spec in file_specs:
         path = spec
@@ -112,8 +191,8 @@ def add_dir(ftc: FileTransmissionCommand) -> None:
             if not os.path.isabs(path):
                 path = abspath(path, use_home=True)
         try:
-            sr = os.stat(path, follow_symlinks=False)
-            read_ok = os.access(path, os.R_OK, follow_symlinks=False)
+            sr = os.stat(path, follow_symlinks=follow_symlinks)
+            read_ok = os.access(path, os.R_OK, follow_symlinks=follow_symlinks)
         except OSError as err:
             errname = errno.errorcode.get(err.errno, 'EFAIL')
             yield TransmissionError(file_id=spec_id, code=errname, msg='Failed to read spec')
@@ -173,11 +252,17 @@ class Action(NameReprEnum):
     cancel = auto()
     status = auto()
     finish = auto()
+    verify = auto()
 
 
 class Compression(NameReprEnum):
     zlib = auto()
     none = auto()
+    zstd = auto()
+
+
+def best_compression() -> 'Compression':
+    return Compression.zstd if zstd_implementation() else Compression.zlib
 
 
 class FileType(NameReprEnum):
@@ -213,6 +298,7 @@ def __init__(
         name: str = '',
         size: int = -1,
         ttype: TransmissionType = TransmissionType.simple,
+        compression: Compression = Compression.none,
     ) -> None:
         super().__init__(msg)
         self.transmit = transmit
@@ -222,13 +308,15 @@ def __init__(
         self.name = name
         self.size = size
         self.ttype = ttype
+        self.compression = compression
 
     def as_ftc(self, request_id: str) -> 'FileTransmissionCommand':
         name = self.code if isinstance(self.code, str) else self.code.name
         if self.human_msg:
             name += ':' + self.human_msg
         return FileTransmissionCommand(
-            action=Action.status, id=request_id, file_id=self.file_id, status=name, name=self.name, size=self.size, ttype=self.ttype
+            action=Action.status, id=request_id, file_id=self.file_id, status=name, name=self.name, size=self.size, ttype=self.ttype,
+            compression=self.compression,
         )
 
 
@@ -265,6 +353,11 @@ class FileTransmissionCommand:
     name: str = field(default='', metadata={'base64': True, 'sname': 'n'})
     status: str = field(default='', metadata={'base64': True, 'sname': 'st'})
     parent: str = field(default='', metadata={'sname': 'pr'})
+    xattrs: str = field(default='', metadata={'base64': True, 'sname': 'xa'})
+    sparse: int = field(default=0, metadata={'sname': 'sp'})
+    pubkey: bytes = field(default=b'', repr=False, metadata={'sname': 'pk'})
+    follow_symlinks: int = field(default=0, metadata={'sname': 'fl'})
+    relay: str = field(default='', metadata={'base64': True, 'sname': 'rl'})
     data: bytes = field(default=b'', repr=False, metadata={'sname': 'd'})
 
     def __repr__(self) -> str:
@@ -440,7 +533,7 @@ def next_signature_block(self, buf: memoryview) -> int:
 
 class DestFile:
 
-    def __init__(self, ftc: FileTransmissionCommand) -> None:
+    def __init__(self, ftc: FileTransmissionCommand, xattr_kinds: str = '') -> None:
         self.name = ftc.name
         if not os.path.isabs(self.name):
             self.name = expand_home(self.name)
@@ -458,9 +551,17 @@ def __init__(self, ftc: FileTransmissionCommand) -> None:
             self.permissions = stat.S_IMODE(self.permissions)
         self.ftype = ftc.ftype
         self.ttype = ftc.ttype
+        self.xattrs = ftc.xattrs
+        self.xattr_kinds = xattr_kinds
+        # holes are only created when the data is written as is, not patched
+        self.sparse = bool(ftc.sparse) and self.ftype is FileType.regular and self.ttype is TransmissionType.simple
         self.link_target = b''
         self.needs_data_sent = self.ttype is not TransmissionType.simple
-        self.decompressor: Union[ZlibDecompressor, IdentityDecompressor] = ZlibDecompressor() if ftc.compression is Compression.zlib else IdentityDecompressor()
+        self.decompressor: Union[ZlibDecompressor, ZstdDecompressor, IdentityDecompressor] = IdentityDecompressor()
+        if ftc.compression is Compression.zlib:
+            self.decompressor = ZlibDecompressor()
+        elif ftc.compression is Compression.zstd:
+            self.decompressor = ZstdDecompressor()
         self.closed = self.ftype is FileType.directory
         self.actual_file: Union[PatchFile, IO[bytes], None] = None
         self.failed = False
@@ -480,6 +581,19 @@ def close(self) -> None:
                 self.actual_file.close()
                 self.actual_file = None
 
+    def check_for_symlink_escape(self, all_files: Dict[str, 'DestFile']) -> None:
+        # refuse to write through a symbolic link created earlier in the same
+        # transfer, which a malicious sender could use to write to locations
+        # other than the ones the user agreed to
+        links = {os.path.normpath(f.name) for f in all_files.values() if f.ftype is FileType.symlink and f.closed and f is not self}
+        d = os.path.dirname(os.path.normpath(self.name))
+        while links and d != os.path.dirname(d):
+            if d in links:
+                raise TransmissionError(
+                    code=ErrorCode.EPERM, file_id=self.file_id,
+                    msg=f'Refusing to write {self.name} as {d} is a symbolic link created by this transfer')
+            d = os.path.dirname(d)
+
     def make_parent_dirs(self) -> str:
         d = os.path.dirname(self.name)
         if d:
@@ -499,6 +613,8 @@ def apply_metadata(self, is_symlink: bool = False) -> None:
                     os.utime(self.name, ns=(self.mtime, self.mtime), follow_symlinks=False)
             else:
                 os.utime(self.name, ns=(self.mtime, self.mtime))
+        if self.xattrs:
+            apply_xattrs(self.name, self.xattrs, self.xattr_kinds, follow_symlinks=not is_symlink)
 
     def unlink_existing_if_needed(self, force: bool = False) -> None:
         if force or self.needs_unlink:
@@ -516,6 +632,7 @@ def write_data(self, all_files: Dict[str, 'DestFile'], data: bytes, is_last: boo
             self.link_target += data
             self.bytes_written += len(data)
             if is_last:
+                self.check_for_symlink_escape(all_files)
                 lt = self.link_target.decode('utf-8', 'replace')
                 base = self.make_parent_dirs()
                 self.unlink_existing_if_needed(force=True)
@@ -541,19 +658,94 @@ def write_data(self, all_files: Dict[str, 'DestFile'], data: bytes, is_last: boo
         elif self.ftype is FileType.regular:
             decompressed = self.decompressor(data, is_last=is_last)
             if self.actual_file is None:
+                self.check_for_symlink_escape(all_files)
                 self.make_parent_dirs()
                 self.unlink_existing_if_needed()
                 flags = os.O_RDWR | os.O_CREAT | os.O_TRUNC | getattr(os, 'O_CLOEXEC', 0) | getattr(os, 'O_BINARY', 0)
                 self.actual_file = open(os.open(self.name, flags, self.permissions), mode='r+b', closefd=True)
             af = self.actual_file
             if decompressed or is_last:
-                af.write(decompressed)
+                if self.sparse:
+                    write_sparse(af, decompressed)
+                    if is_last:
+                        af.truncate()
+                else:
+                    af.write(decompressed)
                 self.bytes_written = af.tell()
             if is_last:
                 self.close()
                 self.apply_metadata()
 
 
+def write_sparse(f: IO[bytes], data: bytes, block_size: int = 4096) -> None:
+    # seek over blocks of zeros so that they become holes in the file, the
+    # file must be truncated at the end to give it its full size
+    mv = memoryview(data)
+    zeros = bytes(block_size)
+    while mv:
+        chunk = mv[:block_size]
+        if chunk == zeros[:len(chunk)]:
+            f.seek(len(chunk), os.SEEK_CUR)
+        else:
+            f.write(chunk)
+        mv = mv[len(chunk):]
+
+
+def encrypt_transfer_data(key: Secret, data: bytes, aad: bytes) -> bytes:
+    # the random nonce, followed by the ciphertext and the authentication tag
+    e = AES256GCMEncrypt(key)
+    e.add_authenticated_but_unencrypted_data(aad)
+    ciphertext = e.add_data_to_be_encrypted(data, True)
+    return e.iv + ciphertext + e.tag
+
+
+def decrypt_transfer_data(key: Secret, data: bytes, aad: bytes) -> bytes:
+    if len(data) < 28:
+        raise ValueError('Encrypted data too short')
+    d = AES256GCMDecrypt(key, data[:12], data[-16:])
+    d.add_data_to_be_authenticated_but_not_decrypted(aad)
+    return d.add_data_to_be_decrypted(data[12:-16], True)
+
+
+def transfer_data_aad(direction: str, ftc: FileTransmissionCommand, seq: int) -> bytes:
+    return f'{direction}:{ftc.file_id}:{seq}:{int(ftc.action is Action.end_data)}'.encode('utf-8')
+
+
+# The end to end encryption of the data of a session, with a key derived from
+# the public key sent by the client and the private key of the terminal. The
+# data of every data and end_data command is encrypted, even when empty, with
+# its direction, file and sequence number as associated data, so that it cannot
+# be reordered, replayed, moved to another file or truncated undetected.
+class TransferEncryption:
+
+    def __init__(self, client_pubkey: bytes) -> None:
+        self.client_pubkey = client_pubkey
+        self.key = get_boss().encryption_key.derive_secret(client_pubkey)
+        self.encrypted_chunks: DefaultDict[str, int] = defaultdict(int)
+        self.decrypted_chunks: DefaultDict[str, int] = defaultdict(int)
+
+    def encrypt(self, ftc: FileTransmissionCommand) -> bytes:
+        seq = self.encrypted_chunks[ftc.file_id]
+        self.encrypted_chunks[ftc.file_id] += 1
+        return encrypt_transfer_data(self.key, ftc.data, transfer_data_aad('tk', ftc, seq))
+
+    def rewind(self, ftc: FileTransmissionCommand) -> None:
+        # the data of ftc will be encrypted again
+        self.encrypted_chunks[ftc.file_id] -= 1
+
+    def decrypt(self, ftc: FileTransmissionCommand) -> bytes:
+        seq = self.decrypted_chunks[ftc.file_id]
+        ans = decrypt_transfer_data(self.key, ftc.data, transfer_data_aad('kt', ftc, seq))
+        self.decrypted_chunks[ftc.file_id] += 1
+        return ans
+
+    def key_confirmation(self) -> bytes:
+        # proves to the client that the key was derived from its public key, so
+        # that a public key replaced on the way to the terminal is detected
+        # before any data is sent
+        return encrypt_transfer_data(self.key, self.client_pubkey, b'tk:pubkey')
+
+
 def check_bypass(password: str, request_id: str, bypass_data: str) -> bool:
     protocol, sep, bypass_data = bypass_data.partition(':')
     if protocol == 'kitty-1':
@@ -585,8 +777,10 @@ class ActiveReceive:
     files: Dict[str, DestFile]
     accepted: bool = False
 
-    def __init__(self, request_id: str, quiet: int, bypass: str) -> None:
+    def __init__(self, request_id: str, quiet: int, bypass: str, pubkey: bytes = b'', xattr_kinds: str = '') -> None:
         self.id = request_id
+        self.xattr_kinds = xattr_kinds
+        self.encryption = TransferEncryption(pubkey) if pubkey else None
         self.bypass_ok: Optional[bool] = None
         if bypass:
             byp = get_options().file_transfer_confirmation_bypass
@@ -617,7 +811,9 @@ def start_file(self, ftc: FileTransmissionCommand) -> DestFile:
                 msg=f'The file_id {ftc.file_id} already exists',
                 file_id=ftc.file_id,
             )
-        self.files[ftc.file_id] = df = DestFile(ftc)
+        df = DestFile(ftc, self.xattr_kinds)
+        df.check_for_symlink_escape(self.files)
+        self.files[ftc.file_id] = df
         return df
 
     def add_data(self, ftc: FileTransmissionCommand) -> DestFile:
@@ -646,16 +842,16 @@ def commit(self, send_os_error: Callable[[OSError, str, 'ActiveReceive', str], N
 
 class SourceFile:
 
-    def __init__(self, ftc: FileTransmissionCommand):
+    def __init__(self, ftc: FileTransmissionCommand, follow_symlinks: bool = False):
         self.file_id = ftc.file_id
         self.path = ftc.name
         self.ttype = ftc.ttype
         self.waiting_for_signature = True if self.ttype is TransmissionType.rsync else False
         self.transmitted = False
-        self.stat = os.stat(self.path, follow_symlinks=False)
+        self.stat = os.stat(self.path, follow_symlinks=follow_symlinks)
         if stat.S_ISDIR(self.stat.st_mode):
             raise TransmissionError(ErrorCode.EINVAL, msg='Cannot send a directory', file_id=self.file_id)
-        self.compressor: Union[ZlibCompressor, IdentityCompressor] = IdentityCompressor()
+        self.compressor: Union[ZlibCompressor, ZstdCompressor, IdentityCompressor] = IdentityCompressor()
         self.target = b''
         self.open_file: Optional[io.BufferedReader] = None
         if stat.S_ISLNK(self.stat.st_mode):
@@ -664,6 +860,8 @@ def __init__(self, ftc: FileTransmissionCommand):
             self.open_file = open(self.path, 'rb')
             if ftc.compression is Compression.zlib:
                 self.compressor = ZlibCompressor()
+            elif ftc.compression is Compression.zstd:
+                self.compressor = ZstdCompressor()
         from kittens.transfer import rsync
         self.differ = rsync.Differ() if self.waiting_for_signature else None
         self.buf = bytearray()
@@ -713,9 +911,16 @@ def next_chunk(self, sz: int = 1024 * 1024) -> Tuple[bytes, int]:
 
 class ActiveSend:
 
-    def __init__(self, request_id: str, quiet: int, bypass: str, num_of_args: int) -> None:
+    def __init__(
+        self, request_id: str, quiet: int, bypass: str, num_of_args: int, xattr_kinds: str = '', sparse: bool = False, pubkey: bytes = b'',
+        follow_symlinks: bool = False,
+    ) -> None:
         self.id = request_id
+        self.encryption = TransferEncryption(pubkey) if pubkey else None
         self.expected_num_of_args = num_of_args
+        self.xattr_kinds = xattr_kinds
+        self.sparse = sparse
+        self.follow_symlinks = follow_symlinks
         self.bypass_ok: Optional[bool] = None
         if bypass:
             byp = get_options().file_transfer_confirmation_bypass
@@ -727,6 +932,7 @@ def __init__(self, request_id: str, quiet: int, bypass: str, num_of_args: int) -
         self.last_activity_at = monotonic()
         self.file_specs: List[Tuple[str, str]] = []
         self.queued_files_map: Dict[str, SourceFile] = {}
+        self.sent_file_paths: Dict[str, str] = {}
         self.active_file: Optional[SourceFile] = None
         self.pending_chunks: Deque[FileTransmissionCommand] = deque()
         self.metadata_sent = False
@@ -745,7 +951,8 @@ def add_send_file(self, cmd: FileTransmissionCommand) -> None:
         self.last_activity_at = monotonic()
         if len(self.queued_files_map) > 32768:
             raise TransmissionError(ErrorCode.EINVAL, 'Too many queued files')
-        self.queued_files_map[cmd.file_id] = SourceFile(cmd)
+        self.queued_files_map[cmd.file_id] = sf = SourceFile(cmd, self.follow_symlinks)
+        self.sent_file_paths[cmd.file_id] = sf.path
 
     def add_signature_data(self, cmd: FileTransmissionCommand) -> None:
         self.last_activity_at = monotonic()
@@ -800,6 +1007,257 @@ def return_chunk(self, ftc: FileTransmissionCommand) -> None:
         self.pending_chunks.insert(0, ftc)
 
 
+class RelayReceive(ActiveReceive):
+
+    def __init__(self, request_id: str, quiet: int, bypass: str, pubkey: bytes, num_of_files: int, xattr_kinds: str = '') -> None:
+        super().__init__(request_id, quiet, bypass, pubkey, xattr_kinds)
+        self.expected_num_of_files = num_of_files
+        self.relay: Optional[Relay] = None
+        self.finished = self.permission_requested = False
+
+    def close(self) -> None:
+        super().close()
+        relay, self.relay = self.relay, None
+        if relay is not None:
+            relay.sender_closed()
+
+
+class RelaySend(ActiveSend):
+
+    def __init__(self, request_id: str, quiet: int, bypass: str, num_of_args: int, pubkey: bytes) -> None:
+        super().__init__(request_id, quiet, bypass, num_of_args, pubkey=pubkey)
+        self.relay: Optional[Relay] = None
+        self.finished = self.permission_requested = False
+
+    def close(self) -> None:
+        super().close()
+        relay, self.relay = self.relay, None
+        if relay is not None:
+            relay.receiver_closed(self.finished)
+
+
+class RelayedFile:
+
+    def __init__(self, ftc: FileTransmissionCommand) -> None:
+        self.ftc = ftc
+        self.name = os.path.normpath(ftc.name)
+        self.link_data = ftc.data.decode('utf-8', 'replace')
+        self.receiver_file_id = ''
+        self.decompressor: Union[ZlibDecompressor, ZstdDecompressor, IdentityDecompressor] = IdentityDecompressor()
+        if ftc.compression is Compression.zlib:
+            self.decompressor = ZlibDecompressor()
+        elif ftc.compression is Compression.zstd:
+            self.decompressor = ZstdDecompressor()
+        self.compressor: Union[ZlibCompressor, ZstdCompressor, IdentityCompressor] = IdentityCompressor()
+        self.bytes_relayed = 0
+        # directories and links are created by the receiver from their metadata alone
+        self.done = ftc.ftype is not FileType.regular
+
+
+# Relays the files sent by a kitten in one window to a kitten receiving them in
+# another window, so that files can be copied between two computers that cannot
+# connect to each other. Nothing is written to this computer, the data of the
+# files is forwarded as it arrives, recompressed as the receiver asks. The
+# sender includes the targets of links in the metadata of the files, and its
+# files are offered to the receiver, once all their metadata has arrived, as
+# though they were the result of a single file spec. Unless a password is used,
+# permission is asked for only once both windows are known, so that the user can
+# see which window the files are relayed to or from. The sender is sent
+# acknowledgements only once the data has been passed on to the receiver, which
+# it uses to avoid sending data faster than the receiver can consume it.
+class Relay:
+
+    def __init__(self, name: str) -> None:
+        self.name = name
+        self.sender: Optional[Tuple['FileTransmission', RelayReceive]] = None
+        self.receiver: Optional[Tuple['FileTransmission', RelaySend]] = None
+        self.files: Dict[str, RelayedFile] = {}
+        self.file_ids_by_name: Dict[str, str] = {}
+        self.metadata_sent = False
+
+    def attach_sender(self, ft: 'FileTransmission', ar: RelayReceive) -> None:
+        if self.sender is not None or self.metadata_sent:
+            raise TransmissionError(msg=f'The relay {self.name} is already in use')
+        if not 0 <= ar.expected_num_of_files <= 32768:
+            raise TransmissionError(msg='Invalid number of files to relay')
+        self.sender = ft, ar
+        ar.relay = self
+
+    def attach_receiver(self, ft: 'FileTransmission', asd: RelaySend) -> None:
+        if self.receiver is not None or self.metadata_sent:
+            raise TransmissionError(msg=f'The relay {self.name} is already in use')
+        self.receiver = ft, asd
+        asd.relay = self
+
+    def peer_window_title(self, session: Union[RelayReceive, RelaySend]) -> str:
+        peer = self.receiver if isinstance(session, RelayReceive) else self.sender
+        window = None if peer is None else get_boss().window_id_map.get(peer[0].window_id)
+        return '' if window is None else window.title
+
+    def ask_for_permission(self) -> None:
+        if self.sender is None or self.receiver is None:
+            return
+        sft, ar = self.sender
+        if not ar.permission_requested:
+            ar.permission_requested = True
+            sft.start_receive(ar.id)
+        ft, asd = self.receiver
+        if not asd.permission_requested:
+            asd.permission_requested = True
+            ft.start_send(asd.id)
+
+    def discard_if_unused(self) -> None:
+        if self.sender is None and self.receiver is None and active_relays.get(self.name) is self:
+            del active_relays[self.name]
+
+    def add_file(self, ftc: FileTransmissionCommand) -> None:
+        if self.sender is None or len(self.files) >= self.sender[1].expected_num_of_files:
+            raise TransmissionError(file_id=ftc.file_id, msg='Too many files to relay')
+        if ftc.file_id in self.files:
+            raise TransmissionError(file_id=ftc.file_id, msg=f'The file_id {ftc.file_id} already exists')
+        self.files[ftc.file_id] = rf = RelayedFile(ftc)
+        self.file_ids_by_name[rf.name] = ftc.file_id
+
+    def link_target(self, rf: RelayedFile) -> Optional[RelayedFile]:
+        kind, _, file_id = rf.link_data.partition(':')
+        return self.files.get(file_id) if kind in ('fid', 'fid_abs') else None
+
+    def symlink_value(self, rf: RelayedFile) -> str:
+        if rf.link_data.startswith('path:'):
+            return rf.link_data[5:]
+        tgt = self.link_target(rf)
+        if tgt is None:
+            return ''
+        if rf.link_data.startswith('fid_abs:'):
+            # the receiver only needs to know the link is absolute, it
+            # resolves it to wherever it puts the target
+            return os.path.join('/', tgt.name)
+        return os.path.relpath(tgt.name, os.path.dirname(rf.name) or '.')
+
+    def start_if_ready(self) -> None:
+        if self.metadata_sent or self.sender is None or self.receiver is None:
+            return
+        ar = self.sender[1]
+        ft, asd = self.receiver
+        if len(self.files) < ar.expected_num_of_files or not asd.accepted or not asd.spec_complete:
+            return
+        self.metadata_sent = asd.metadata_sent = True
+        dir_ids = {rf.name: file_id for file_id, rf in self.files.items() if rf.ftc.ftype is FileType.directory}
+        for file_id, rf in self.files.items():
+            tgt = self.link_target(rf) if rf.ftc.ftype in (FileType.symlink, FileType.link) else None
+            ft.write_ftc_to_child(FileTransmissionCommand(
+                action=Action.file, id=asd.id, file_id=asd.file_specs[0][0] if asd.file_specs else '0', name=rf.name, status=file_id,
+                size=rf.ftc.size, mtime=rf.ftc.mtime, permissions=rf.ftc.permissions, ftype=rf.ftc.ftype,
+                parent=dir_ids.get(os.path.dirname(rf.name), ''), xattrs=rf.ftc.xattrs, sparse=rf.ftc.sparse,
+                data=b'' if tgt is None else tgt.ftc.file_id.encode('utf-8'),
+            ))
+        ft.send_status_response(code=ErrorCode.OK, request_id=asd.id, name=home_path())
+
+    def write_to_receiver(self, ftc: FileTransmissionCommand) -> None:
+        if self.receiver is not None:
+            self.receiver[0].write_ftc_to_child(ftc)
+
+    def cancel_receiver(self) -> None:
+        if self.receiver is not None:
+            ft, asd = self.receiver
+            ft.send_status_response(ErrorCode.CANCELED, request_id=asd.id)
+            ft.drop_send(asd.id)
+
+    def start_file(self, cmd: FileTransmissionCommand) -> None:
+        # the receiver requests the data of a file
+        if self.receiver is None:
+            return
+        asd = self.receiver[1]
+        rf = self.files.get(self.file_ids_by_name.get(cmd.name, ''))
+        if rf is None or rf.ftc.ftype is FileType.directory or (self.sender is None and rf.ftc.ftype is FileType.regular):
+            # the receiver cannot handle errors for individual files once it
+            # has started receiving them
+            log_error(f'Relayed file {cmd.name} requested that is not available, aborting')
+            self.cancel_receiver()
+            return
+        rf.receiver_file_id = cmd.file_id
+        if rf.ftc.ftype is FileType.regular:
+            if cmd.compression is Compression.zlib:
+                rf.compressor = ZlibCompressor()
+            elif cmd.compression is Compression.zstd:
+                rf.compressor = ZstdCompressor()
+            sft, ar = self.sender  # type: ignore
+            sft.send_status_response(code=ErrorCode.STARTED, request_id=ar.id, file_id=rf.ftc.file_id, name=rf.name, ttype=TransmissionType.simple)
+        else:
+            value = self.symlink_value(rf).encode('utf-8')
+            if value:
+                for ftc in split_for_transfer(value, session_id=asd.id, file_id=cmd.file_id, mark_last=True):
+                    self.write_to_receiver(ftc)
+            else:
+                self.write_to_receiver(FileTransmissionCommand(action=Action.end_data, id=asd.id, file_id=cmd.file_id))
+
+    def relay_data(self, cmd: FileTransmissionCommand) -> None:
+        # the sender sends the data of a file
+        if self.sender is None:
+            return
+        sft, ar = self.sender
+        rf = self.files.get(cmd.file_id)
+        if rf is None or not rf.receiver_file_id or rf.done or self.receiver is None:
+            raise TransmissionError(file_id=cmd.file_id, msg='Data received for a file the receiver has not requested')
+        asd = self.receiver[1]
+        is_last = cmd.action is Action.end_data
+        data = rf.decompressor(cmd.data, is_last=is_last)
+        rf.bytes_relayed += len(data)
+        cdata = rf.compressor.compress(data)
+        if is_last:
+            cdata += rf.compressor.flush()
+        if cdata:
+            for ftc in split_for_transfer(cdata, session_id=asd.id, file_id=rf.receiver_file_id, mark_last=is_last):
+                self.write_to_receiver(ftc)
+        elif is_last:
+            self.write_to_receiver(FileTransmissionCommand(action=Action.end_data, id=asd.id, file_id=rf.receiver_file_id))
+        if ar.send_acknowledgements and (is_last or data):
+            self.receiver[0].call_when_drained(partial(self.acknowledge, ar, rf, rf.bytes_relayed, is_last))
+        rf.done = is_last
+
+    def acknowledge(self, ar: RelayReceive, rf: RelayedFile, size: int, is_last: bool) -> None:
+        # called once the data has been written to the receiver
+        if self.sender is None or self.sender[1] is not ar:
+            return
+        sft = self.sender[0]
+        if is_last:
+            sft.send_status_response(code=ErrorCode.OK, request_id=ar.id, file_id=rf.ftc.file_id, name=rf.name, size=size)
+        else:
+            sft.send_status_response(code=ErrorCode.PROGRESS, request_id=ar.id, file_id=rf.ftc.file_id, size=size)
+
+    def sender_closed(self) -> None:
+        self.sender = None
+        if not self.metadata_sent or any(not rf.done for rf in self.files.values()):
+            self.cancel_receiver()
+        self.discard_if_unused()
+
+    def receiver_closed(self, finished: bool) -> None:
+        self.receiver = None
+        if self.sender is not None:
+            ft, ar = self.sender
+            if finished:
+                # the receiver did not want the remaining files
+                for rf in self.files.values():
+                    if not rf.done:
+                        rf.done = True
+                        if ar.send_acknowledgements:
+                            ft.send_status_response(code=ErrorCode.OK, request_id=ar.id, file_id=rf.ftc.file_id, name=rf.name)
+            else:
+                ft.send_status_response(ErrorCode.CANCELED, request_id=ar.id)
+                ft.drop_receive(ar.id)
+        self.discard_if_unused()
+
+
+active_relays: Dict[str, Relay] = {}
+
+
+def relay_named(name: str) -> Relay:
+    ans = active_relays.get(name)
+    if ans is None:
+        ans = active_relays[name] = Relay(name)
+    return ans
+
+
 class FileTransmission:
 
     def __init__(self, window_id: int):
@@ -808,6 +1266,7 @@ def __init__(self, window_id: int):
         self.active_sends: Dict[str, ActiveSend] = {}
         self.pending_receive_responses: Deque[FileTransmissionCommand] = deque()
         self.pending_timer: Optional[int] = None
+        self.drain_callbacks: List[Callable[[], None]] = []
 
     def callback_after(self, callback: Callable[[Optional[int]], None], timeout: float = 0) -> Optional[int]:
         return add_timer(callback, timeout, False)
@@ -816,16 +1275,28 @@ def start_pending_timer(self) -> None:
         if self.pending_timer is None:
             self.pending_timer = self.callback_after(self.try_pending, 0.2)
 
+    def call_when_drained(self, callback: Callable[[], None]) -> None:
+        # call the callback once everything written so far has been sent to the child
+        if self.pending_receive_responses:
+            self.drain_callbacks.append(callback)
+            self.start_pending_timer()
+        else:
+            callback()
+
     def try_pending(self, timer_id: Optional[int]) -> None:
         self.pending_timer = None
         while self.pending_receive_responses:
             payload = self.pending_receive_responses.popleft()
-            ar = self.active_receives.get(payload.id)
+            ar: Union[ActiveReceive, ActiveSend, None] = self.active_receives.get(payload.id) or self.active_sends.get(payload.id)
             if ar is None:
                 continue
-            if not self.write_ftc_to_child(payload, appendleft=True):
+            if not self.write_ftc_to_child(payload, appendleft=True, encrypted=True):
                 break
             ar.last_activity_at = monotonic()
+        if not self.pending_receive_responses:
+            callbacks, self.drain_callbacks = self.drain_callbacks, []
+            for callback in callbacks:
+                callback()
         self.prune_expired()
 
     def __del__(self) -> None:
@@ -873,11 +1344,39 @@ def handle_serialized_command(self, data: memoryview) -> None:
                 self.handle_send_cmd(cmd)
                 return
         self.prune_expired()
+        if cmd.action in (Action.data, Action.end_data):
+            enc = self.encryption_for(cmd.id)
+            if enc is not None:
+                try:
+                    cmd.data = enc.decrypt(cmd)
+                except Exception as err:
+                    log_error(f'Failed to decrypt file transmission data, aborting: {err}')
+                    self.drop_receive(cmd.id)
+                    self.drop_send(cmd.id)
+                    self.send_status_response(ErrorCode.EINVAL, request_id=cmd.id, msg='Failed to decrypt data')
+                    return
         if cmd.id in self.active_receives or cmd.action is Action.send:
             self.handle_receive_cmd(cmd)
         if cmd.id in self.active_sends or cmd.action is Action.receive:
             self.handle_send_cmd(cmd)
 
+    def encryption_for(self, request_id: str) -> Optional[TransferEncryption]:
+        session: Union[ActiveReceive, ActiveSend, None] = self.active_receives.get(request_id) or self.active_sends.get(request_id)
+        return None if session is None else session.encryption
+
+    def encrypted(self, payload: FileTransmissionCommand) -> FileTransmissionCommand:
+        if payload.action in (Action.data, Action.end_data):
+            enc = self.encryption_for(payload.id)
+            if enc is not None:
+                payload = replace(payload, data=enc.encrypt(payload))
+        return payload
+
+    def rewind_encryption(self, payload: FileTransmissionCommand) -> None:
+        if payload.action in (Action.data, Action.end_data):
+            enc = self.encryption_for(payload.id)
+            if enc is not None:
+                enc.rewind(payload)
+
     def handle_send_cmd(self, cmd: FileTransmissionCommand) -> None:
         if cmd.id in self.active_sends:
             asd = self.active_sends[cmd.id]
@@ -885,6 +1384,11 @@ def handle_send_cmd(self, cmd: FileTransmissionCommand) -> None:
                 log_error('File transmission receive received for already active id, aborting')
                 self.drop_send(cmd.id)
                 return
+            if cmd.action is Action.file and isinstance(asd, RelaySend) and asd.metadata_sent:
+                asd.last_activity_at = monotonic()
+                if asd.relay is not None:
+                    asd.relay.start_file(cmd)
+                return
             if cmd.action is Action.file:
                 try:
                     asd.add_send_file(cmd) if asd.metadata_sent else asd.add_file_spec(cmd)
@@ -913,6 +1417,8 @@ def handle_send_cmd(self, cmd: FileTransmissionCommand) -> None:
                 else:
                     self.pump_send_chunks(asd)
             elif cmd.action in (Action.status, Action.finish):
+                if isinstance(asd, RelaySend):
+                    asd.finished = cmd.action is Action.finish
                 self.drop_send(asd.id)
                 return
             if not asd.accepted:
@@ -927,17 +1433,44 @@ def handle_send_cmd(self, cmd: FileTransmissionCommand) -> None:
             if len(self.active_sends) >= MAX_ACTIVE_SENDS:
                 log_error('New File transmission send with too many active receives, ignoring')
                 return
-            asd = self.active_sends[cmd.id] = ActiveSend(cmd.id, cmd.quiet, cmd.bypass, cmd.size)
-            self.start_send(asd.id)
+            try:
+                if cmd.relay:
+                    asd = RelaySend(cmd.id, cmd.quiet, cmd.bypass, cmd.size, cmd.pubkey)
+                else:
+                    asd = ActiveSend(cmd.id, cmd.quiet, cmd.bypass, cmd.size, cmd.xattrs, bool(cmd.sparse), cmd.pubkey, bool(cmd.follow_symlinks))
+            except Exception as err:
+                log_error(f'File transmission receive with invalid public key, ignoring: {err}')
+                self.send_status_response(ErrorCode.EINVAL, request_id=cmd.id, msg='Invalid public key for encryption')
+                return
+            if isinstance(asd, RelaySend):
+                relay = relay_named(cmd.relay)
+                try:
+                    relay.attach_receiver(self, asd)
+                except TransmissionError as err:
+                    relay.discard_if_unused()
+                    self.send_transmission_error(asd.id, err)
+                    return
+            self.active_sends[cmd.id] = asd
+            if isinstance(asd, RelaySend) and asd.bypass_ok is None and asd.relay is not None:
+                asd.relay.ask_for_permission()
+            else:
+                self.start_send(asd.id)
             return
         if cmd.action is Action.cancel:
             self.drop_send(asd.id)
             if asd.send_acknowledgements:
                 self.send_status_response(ErrorCode.CANCELED, request_id=asd.id)
+        elif cmd.action is Action.verify:
+            self.send_verify_response(asd.id, cmd.file_id, asd.sent_file_paths.get(cmd.file_id, ''))
 
     def send_metadata_for_send_transfer(self, asd: ActiveSend) -> None:
+        if isinstance(asd, RelaySend):
+            # the metadata is sent once all of it has been received from the sender
+            if asd.relay is not None:
+                asd.relay.start_if_ready()
+            return
         sent = False
-        for ftc in iter_file_metadata(asd.file_specs):
+        for ftc in iter_file_metadata(asd.file_specs, asd.xattr_kinds, asd.sparse, asd.follow_symlinks):
             if isinstance(ftc, TransmissionError):
                 sent = True
                 if asd.send_errors:
@@ -994,14 +1527,36 @@ def handle_receive_cmd(self, cmd: FileTransmissionCommand) -> None:
             if len(self.active_receives) >= MAX_ACTIVE_RECEIVES:
                 log_error('New File transmission send with too many active receives, ignoring')
                 return
-            ar = self.active_receives[cmd.id] = ActiveReceive(cmd.id, cmd.quiet, cmd.bypass)
-            self.start_receive(ar.id)
+            try:
+                if cmd.relay:
+                    ar = RelayReceive(cmd.id, cmd.quiet, cmd.bypass, cmd.pubkey, cmd.size, cmd.xattrs)
+                else:
+                    ar = ActiveReceive(cmd.id, cmd.quiet, cmd.bypass, cmd.pubkey, cmd.xattrs)
+            except Exception as err:
+                log_error(f'File transmission send with invalid public key, ignoring: {err}')
+                self.send_status_response(ErrorCode.EINVAL, request_id=cmd.id, msg='Invalid public key for encryption')
+                return
+            if isinstance(ar, RelayReceive):
+                relay = relay_named(cmd.relay)
+                try:
+                    relay.attach_sender(self, ar)
+                except TransmissionError as err:
+                    relay.discard_if_unused()
+                    self.send_transmission_error(ar.id, err)
+                    return
+            self.active_receives[cmd.id] = ar
+            if isinstance(ar, RelayReceive) and ar.bypass_ok is None and ar.relay is not None:
+                ar.relay.ask_for_permission()
+            else:
+                self.start_receive(ar.id)
             return
 
         if cmd.action is Action.cancel:
             self.drop_receive(ar.id)
             if ar.send_acknowledgements:
                 self.send_status_response(ErrorCode.CANCELED, request_id=ar.id)
+        elif isinstance(ar, RelayReceive):
+            self.handle_relay_receive_cmd(ar, cmd)
         elif cmd.action is Action.file:
             try:
                 df = ar.start_file(cmd)
@@ -1075,9 +1630,41 @@ def handle_receive_cmd(self, cmd: FileTransmissionCommand) -> None:
                     self.send_transmission_error(ar.id, te)
             finally:
                 self.drop_receive(ar.id)
+        elif cmd.action is Action.verify:
+            df = ar.files.get(cmd.file_id)
+            path = df.name if df is not None and df.closed and df.ftype is FileType.regular else ''
+            self.send_verify_response(ar.id, cmd.file_id, path)
         else:
             log_error(f'Transmission receive command with unknown action: {cmd.action}, ignoring')
 
+    def handle_relay_receive_cmd(self, ar: RelayReceive, cmd: FileTransmissionCommand) -> None:
+        relay = ar.relay
+        if relay is None:
+            return
+        try:
+            if cmd.action is Action.file:
+                relay.add_file(cmd)
+                if cmd.ftype is not FileType.regular and ar.send_acknowledgements:
+                    self.send_status_response(ErrorCode.OK, ar.id, cmd.file_id, name=cmd.name)
+                relay.start_if_ready()
+            elif cmd.action in (Action.data, Action.end_data):
+                relay.relay_data(cmd)
+            elif cmd.action is Action.finish:
+                ar.finished = True
+                self.drop_receive(ar.id)
+            elif cmd.action is Action.verify:
+                # the relayed files are not on this computer
+                self.send_verify_response(ar.id, cmd.file_id, '')
+            else:
+                log_error(f'Transmission relay command with unknown action: {cmd.action}, ignoring')
+        except TransmissionError as err:
+            if ar.send_errors:
+                self.send_transmission_error(ar.id, err)
+        except Exception as err:
+            log_error(f'Transmission protocol failed to relay file with error: {err}')
+            if ar.send_errors:
+                self.send_transmission_error(ar.id, TransmissionError(file_id=cmd.file_id, msg=str(err)))
+
     def transmit_rsync_signature(self, receive_id: str, timer_id: Optional[int] = None) -> None:
         q = self.active_receives.get(receive_id)
         if q is None:
@@ -1133,19 +1720,67 @@ def send_status_response(
         request_id: str = '', file_id: str = '', msg: str = '',
         name: str = '', size: int = -1,
         ttype: TransmissionType = TransmissionType.simple,
+        compression: Compression = Compression.none,
+        pubkey: bytes = b'', data: bytes = b'',
     ) -> bool:
-        err = TransmissionError(code=code, msg=msg, file_id=file_id, name=name, size=size, ttype=ttype)
-        return self.write_ftc_to_child(err.as_ftc(request_id))
+        err = TransmissionError(code=code, msg=msg, file_id=file_id, name=name, size=size, ttype=ttype, compression=compression)
+        ftc = err.as_ftc(request_id)
+        ftc.pubkey, ftc.data = pubkey, data
+        return self.write_ftc_to_child(ftc)
+
+    def send_verify_response(self, request_id: str, file_id: str, path: str) -> None:
+        if not path:
+            self.write_ftc_to_child(FileTransmissionCommand(
+                action=Action.verify, id=request_id, file_id=file_id, status=f'{ErrorCode.EINVAL.name}:Cannot verify the file with file_id: {file_id}'))
+            return
+        try:
+            f = open(path, 'rb')
+        except OSError as err:
+            self.send_verify_failure(request_id, file_id, err)
+        else:
+            self.digest_file_for_verify(request_id, file_id, f, hashlib.sha256())
+
+    def digest_file_for_verify(self, request_id: str, file_id: str, f: IO[bytes], h: 'hashlib._Hash', timer_id: Optional[int] = None) -> None:
+        # the file is read a chunk at a time, so as not to block the main
+        # thread while computing the digest of large files
+        if request_id not in self.active_receives and request_id not in self.active_sends:
+            f.close()
+            return
+        try:
+            chunk = f.read(1024 * 1024)
+        except OSError as err:
+            f.close()
+            self.send_verify_failure(request_id, file_id, err)
+            return
+        if chunk:
+            h.update(chunk)
+            self.callback_after(partial(self.digest_file_for_verify, request_id, file_id, f, h))
+            return
+        f.close()
+        self.write_ftc_to_child(FileTransmissionCommand(action=Action.verify, id=request_id, file_id=file_id, status='OK', data=h.digest()))
+
+    def send_verify_failure(self, request_id: str, file_id: str, err: OSError) -> None:
+        status = errno.errorcode.get(err.errno or 0, 'EFAIL') + ':Failed to read file to verify'
+        self.write_ftc_to_child(FileTransmissionCommand(action=Action.verify, id=request_id, file_id=file_id, status=status))
 
     def send_transmission_error(self, request_id: str, err: TransmissionError) -> bool:
         if err.transmit:
             return self.write_ftc_to_child(err.as_ftc(request_id))
         return True
 
-    def write_ftc_to_child(self, payload: FileTransmissionCommand, appendleft: bool = False, use_pending: bool = True) -> bool:
+    def write_ftc_to_child(
+        self, payload: FileTransmissionCommand, appendleft: bool = False, use_pending: bool = True, encrypted: bool = False
+    ) -> bool:
         boss = get_boss()
         window = boss.window_id_map.get(self.window_id)
         if window is not None:
+            if not encrypted:
+                payload = self.encrypted(payload)
+            if use_pending and not appendleft and self.pending_receive_responses:
+                # preserve the order of the data, which decrypting it depends on
+                self.pending_receive_responses.append(payload)
+                self.start_pending_timer()
+                return False
             data = tuple(payload.get_serialized_fields(prefix_with_osc_code=True))
             queued = window.screen.send_escape_code_to_child(ESC_OSC, data)
             if not queued:
@@ -1155,6 +1790,9 @@ def write_ftc_to_child(self, payload: FileTransmissionCommand, appendleft: bool
                     else:
                         self.pending_receive_responses.append(payload)
                     self.start_pending_timer()
+                elif not encrypted:
+                    # the caller writes the unencrypted payload again later
+                    self.rewind_encryption(payload)
             return queued
         return False
 
@@ -1166,10 +1804,11 @@ def start_send(self, asd_id: str) -> None:
         boss = get_boss()
         window = boss.window_id_map.get(self.window_id)
         if window is not None:
-            boss.confirm(_(
-                'The remote machine wants to read some files from this computer. Do you want to allow the transfer?'),
-                self.handle_receive_confirmation, asd_id, window=window,
-            )
+            msg = _('The remote machine wants to read some files from this computer. Do you want to allow the transfer?')
+            if isinstance(asd, RelaySend):
+                title = '' if asd.relay is None else asd.relay.peer_window_title(asd)
+                msg = _('The remote machine wants to receive some files relayed from the window: {}. Do you want to allow the transfer?').format(title)
+            boss.confirm(msg, self.handle_receive_confirmation, asd_id, window=window)
 
     def handle_receive_confirmation(self, confirmed: bool, cmd_id: str) -> None:
         asd = self.active_sends.get(cmd_id)
@@ -1181,7 +1820,11 @@ def handle_receive_confirmation(self, confirmed: bool, cmd_id: str) -> None:
             self.drop_send(asd.id)
         if asd.accepted:
             if asd.send_acknowledgements:
-                self.send_status_response(code=ErrorCode.OK, request_id=asd.id)
+                # let the client know the best compression supported
+                # and confirm that the transfer will be encrypted
+                self.send_status_response(
+                    code=ErrorCode.OK, request_id=asd.id, compression=best_compression(),
+                    pubkey=self.terminal_public_key(asd), data=self.client_key_confirmation(asd))
             if asd.spec_complete:
                 self.send_metadata_for_send_transfer(asd)
         else:
@@ -1196,10 +1839,11 @@ def start_receive(self, ar_id: str) -> None:
         boss = get_boss()
         window = boss.window_id_map.get(self.window_id)
         if window is not None:
-            boss.confirm(_(
-                'The remote machine wants to send some files to this computer. Do you want to allow the transfer?'),
-                self.handle_send_confirmation, ar_id, window=window,
-            )
+            msg = _('The remote machine wants to send some files to this computer. Do you want to allow the transfer?')
+            if isinstance(ar, RelayReceive):
+                title = '' if ar.relay is None else ar.relay.peer_window_title(ar)
+                msg = _('The remote machine wants to relay some files to the window: {}. Do you want to allow the transfer?').format(title)
+            boss.confirm(msg, self.handle_send_confirmation, ar_id, window=window)
 
     def handle_send_confirmation(self, confirmed: bool, cmd_id: str) -> None:
         ar = self.active_receives.get(cmd_id)
@@ -1211,11 +1855,21 @@ def handle_send_confirmation(self, confirmed: bool, cmd_id: str) -> None:
             self.drop_receive(ar.id)
         if ar.accepted:
             if ar.send_acknowledgements:
-                self.send_status_response(code=ErrorCode.OK, request_id=ar.id)
+                # let the client know the best compression supported and
+                # confirm that the transfer will be encrypted
+                self.send_status_response(
+                    code=ErrorCode.OK, request_id=ar.id, compression=best_compression(), pubkey=self.terminal_public_key(ar),
+                    data=self.client_key_confirmation(ar))
         else:
             if ar.send_errors:
                 self.send_status_response(code=ErrorCode.EPERM, request_id=ar.id, msg='User refused the transfer')
 
+    def terminal_public_key(self, ar: Union[ActiveSend, ActiveReceive]) -> bytes:
+        return b'' if ar.encryption is None else get_boss().encryption_key.public
+
+    def client_key_confirmation(self, ar: Union[ActiveSend, ActiveReceive]) -> bytes:
+        return b'' if ar.encryption is None else ar.encryption.key_confirmation()
+
     def send_fail_on_os_error(self, err: OSError, msg: str, ar: Union[ActiveSend, ActiveReceive], file_id: str = '') -> None:
         if not ar.send_errors:
             return
@@ -1233,8 +1887,10 @@ def __init__(self, allow: bool = True) -> None:
         self.test_responses: List[Dict[str, Union[str, int, bytes]]] = []
         self.allow = allow
 
-    def write_ftc_to_child(self, payload: FileTransmissionCommand, appendleft: bool = False, use_pending: bool = True) -> bool:
-        self.test_responses.append(payload.asdict())
+    def write_ftc_to_child(
+        self, payload: FileTransmissionCommand, appendleft: bool = False, use_pending: bool = True, encrypted: bool = False
+    ) -> bool:
+        self.test_responses.append((payload if encrypted else self.encrypted(payload)).asdict())
         return True
 
     def start_receive(self, aid: str) -> None:
@@ -1853,6 +1853,14 @@ wayland_compositor_pid(PYNOARG) {
     return PyLong_FromLongLong(x);
 }
 
+static PyObject*
+get_system_color_theme(PYNOARG) {
+    if (!glfwGetCurrentSystemColorTheme) {
+        PyErr_SetString(PyExc_RuntimeError, "Failed to load glfwGetCurrentSystemColorTheme"); return NULL;
+    }
+    return PyLong_FromLong(glfwGetCurrentSystemColorTheme());
+}
+
 static PyObject*
 x11_window_id(PyObject UNUSED *self, PyObject *os_wid) {
     OSWindow *w = os_window_for_id(PyLong_AsUnsignedLongLong(os_wid));
@@ -2234,6 +2242,7 @@ static PyMethodDef module_methods[] = {
     METHODB(glfw_window_hint, METH_VARARGS),
     METHODB(x11_display, METH_NOARGS),
     METHODB(wayland_compositor_pid, METH_NOARGS),
+    METHODB(get_system_color_theme, METH_NOARGS),
     METHODB(get_click_interval, METH_NOARGS),
     METHODB(x11_window_id, METH_O),
     METHODB(make_x11_window_a_dock_window, METH_VARARGS),
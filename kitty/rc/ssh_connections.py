@@ -0,0 +1,103 @@
+#!/usr/bin/env python
+# License: GPLv3 Copyright: 2023, Kovid Goyal <kovid at kovidgoyal.net>
+
+from typing import TYPE_CHECKING, Dict, Optional
+
+from kitty.types import AsyncResponse
+from kitty.typing import PopenType
+
+from .base import (
+    ArgsType,
+    Boss,
+    PayloadGetType,
+    PayloadType,
+    RCOptions,
+    RemoteCommand,
+    RemoteControlErrorWithoutTraceback,
+    ResponseType,
+    Window,
+)
+
+if TYPE_CHECKING:
+    from kitty.cli_stub import SSHConnectionsRCOptions as CLIOptions
+
+
+class SSHConnections(RemoteCommand):
+
+    protocol_spec = __doc__ = '''
+    action/choices.list.close.refresh: What to do with the connections
+    connections/list.str: The connections to close or refresh, as process ids of ssh kitten sessions or hostnames
+    '''
+
+    short_desc = 'List and manage the connections of the ssh kitten'
+    desc = (
+        'List the active sessions of the ssh kitten in this kitty instance, with the SSH ControlMasters'
+        ' they use, their uptimes and forwarded sockets. Use :option:`kitten @ ssh-connections --action`'
+        ' to close or refresh the specified connections, identified by the process id of a session or'
+        ' a hostname. Closing a connection terminates all sessions using it. Refreshing a connection makes'
+        ' the next session create a new connection, without affecting existing sessions.'
+        ' The same can be done with :code:`kitten ssh --list-connections`.'
+    )
+    options_spec = '''\
+--action
+default=list
+choices=list,close,refresh
+What to do with the connections.
+'''
+    args = RemoteCommand.Args(spec='[CONNECTION ...]', json_field='connections')
+    is_asynchronous = True
+
+    def __init__(self) -> None:
+        super().__init__()
+        self.processes_in_flight: Dict[str, 'PopenType[bytes]'] = {}
+
+    def message_to_kitty(self, global_opts: RCOptions, opts: 'CLIOptions', args: ArgsType) -> PayloadType:
+        if opts.action != 'list' and not args:
+            self.fatal(f'Must specify the connections to {opts.action}')
+        return {'action': opts.action, 'connections': list(args)}
+
+    def response_from_kitty(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> ResponseType:
+        import os
+        import subprocess
+        import tempfile
+
+        from kitty.constants import clear_handled_signals, kitten_exe
+        action = payload_get('action') or 'list'
+        cmd = [kitten_exe(), 'ssh']
+        if action == 'list':
+            cmd.append('--list-connections')
+        else:
+            cmd.append(f'--{action}-connection')
+            cmd.extend(payload_get('connections') or ())
+        env = dict(os.environ)
+        env['KITTY_PID'] = str(os.getpid())
+        # The kitten runs ssh to query the ControlMasters, which can take a
+        # while, so it is run without blocking and the response is sent when
+        # it exits. Its output goes to a file so it cannot block on a full pipe.
+        output = tempfile.TemporaryFile()
+        try:
+            p = subprocess.Popen(cmd, env=env, stdin=subprocess.DEVNULL, stdout=output, stderr=subprocess.STDOUT, preexec_fn=clear_handled_signals)
+        except OSError as e:
+            output.close()
+            raise RemoteControlErrorWithoutTraceback(f'Failed to run the ssh kitten with error: {e}')
+        responder = self.create_async_responder(payload_get, window)
+
+        def on_exit(exit_status: int) -> None:
+            self.processes_in_flight.pop(responder.async_id, None)
+            with output:
+                output.seek(0)
+                text = output.read().decode('utf-8', 'replace').strip()
+            if os.WIFEXITED(exit_status) and os.WEXITSTATUS(exit_status) == 0:
+                responder.send_data(text)
+            else:
+                responder.send_error(text or 'The ssh kitten failed')
+        self.processes_in_flight[responder.async_id] = p
+        boss.monitor_process(p.pid, on_exit)
+        return AsyncResponse()
+
+    def cancel_async_request(self, boss: Boss, window: Optional[Window], payload_get: PayloadGetType) -> None:
+        p = self.processes_in_flight.pop(payload_get('async_id', missing=''), None)
+        if p is not None:
+            p.kill()
+
+ssh_connections = SSHConnections()
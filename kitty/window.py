@@ -546,6 +546,8 @@ def __init__(
         self.started_at = monotonic()
         self.created_at = time_ns()
         self.current_remote_data: List[str] = []
+        # state of the files cached on the remote host by the ssh kitten
+        self.ssh_remote_cache: Dict[str, str] = {}
         self.current_mouse_event_button = 0
         self.current_clipboard_read_ask: Optional[bool] = None
         self.prev_osc99_cmd = NotificationCommand()
@@ -1257,9 +1259,25 @@ def handle_remote_echo(self, msg: memoryview) -> None:
 
     def handle_remote_ssh(self, msg: memoryview) -> None:
         from kittens.ssh.utils import get_ssh_data
-        for line in get_ssh_data(msg, f'{os.getpid()}-{self.id}'):
+        for line in get_ssh_data(msg, f'{os.getpid()}-{self.id}', self.remote_cwd_for_ssh_reconnect, self.ssh_remote_cache):
             self.write_to_child(line)
 
+    def remote_cwd_for_ssh_reconnect(self) -> str:
+        # The working directory last reported by a shell on a remote host, used
+        # to restore it when the ssh kitten reconnects
+        url = self.screen.last_reported_cwd
+        if not url:
+            return ''
+        from socket import gethostname
+        from urllib.parse import urlparse
+        try:
+            host = urlparse(url.decode('utf-8', 'replace')).hostname or ''
+        except ValueError:
+            return ''
+        if not host or host.lower() in ('localhost', gethostname().lower()):
+            return ''
+        return path_from_osc7_url(url)
+
     def handle_kitten_result(self, msg: memoryview) -> None:
         import base64
         self.kitten_result = json.loads(base64.b85decode(msg))
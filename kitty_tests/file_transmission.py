@@ -2,6 +2,7 @@
 # License: GPLv3 Copyright: 2021, Kovid Goyal <kovid at kovidgoyal.net>
 
 
+import hashlib
 import os
 import shutil
 import stat
@@ -11,16 +12,29 @@
 from pathlib import Path
 
 from kittens.transfer.rsync import Differ, Hasher, Patcher, parse_ftc
-from kittens.transfer.utils import set_paths
+from kittens.transfer.utils import ZstdDecompressor, set_paths, zstd_implementation
 from kitty.constants import kitten_exe
-from kitty.file_transmission import Action, Compression, FileTransmissionCommand, FileType, TransmissionType, ZlibDecompressor
+from kitty.file_transmission import (
+    Action,
+    Compression,
+    DestFile,
+    FileTransmissionCommand,
+    FileType,
+    TransmissionError,
+    TransmissionType,
+    ZlibDecompressor,
+    best_compression,
+    iter_file_metadata,
+)
 from kitty.file_transmission import TestFileTransmission as FileTransmission
 
 from . import PTY, BaseTest
 
 
-def response(id='test', msg='', file_id='', name='', action='status', status='', size=-1):
+def response(id='test', msg='', file_id='', name='', action='status', status='', size=-1, compression=''):
     ans = {'action': 'status'}
+    if compression:
+        ans['compression'] = compression
     if id:
         ans['id'] = id
     if file_id:
@@ -164,7 +178,7 @@ def __init__(self, pty, allow=True):
         super().__init__(allow=allow)
         self.pty.callbacks.ftc = self
 
-    def write_ftc_to_child(self, payload: FileTransmissionCommand, appendleft: bool = False, use_pending: bool = True) -> bool:
+    def write_ftc_to_child(self, payload: FileTransmissionCommand, appendleft: bool = False, use_pending: bool = True, encrypted: bool = False) -> bool:
         # print('to kitten:', payload)
         self.pty.write_to_child('\x1b]' + payload.serialize(prefix_with_osc_code=True) + '\x1b\\', flush=False)
         return True
@@ -240,14 +254,14 @@ def test_file_get(self):
             ft = FileTransmission()
             self.responses = []
             ft.handle_serialized_command(serialized_cmd(action='receive', size=1))
-            self.assertResponses(ft, status='OK')
+            self.assertResponses(ft, status='OK', compression=best_compression().name)
             ft.handle_serialized_command(serialized_cmd(action='file', file_id='missing', name='XXX'))
             self.responses.append(response(status='ENOENT:Failed to read spec', file_id='missing'))
             self.assertResponses(ft, status='OK', name=home)
             ft = FileTransmission()
             self.responses = []
             ft.handle_serialized_command(serialized_cmd(action='receive', size=2))
-            self.assertResponses(ft, status='OK')
+            self.assertResponses(ft, status='OK', compression=best_compression().name)
             with open(os.path.join(home, 'a'), 'w') as f:
                 f.write('a')
             os.mkdir(f.name + 'd')
@@ -284,11 +298,11 @@ def test_file_get(self):
             f.write(data)
         sl = os.path.join(base, 'src.link')
         os.symlink(src, sl)
-        for compress in ('none', 'zlib'):
+        for compress in ('none', 'zlib') + (('zstd',) if zstd_implementation() else ()):
             ft = FileTransmission()
             self.responses = []
             ft.handle_serialized_command(serialized_cmd(action='receive', size=1))
-            self.assertResponses(ft, status='OK')
+            self.assertResponses(ft, status='OK', compression=best_compression().name)
             ft.handle_serialized_command(serialized_cmd(action='file', file_id='src', name=src))
             ft.active_sends['test'].metadata_sent = True
             ft.test_responses = []
@@ -296,11 +310,158 @@ def test_file_get(self):
             received = b''.join(x['data'] for x in ft.test_responses)
             if compress == 'zlib':
                 received = ZlibDecompressor()(received, True)
+            elif compress == 'zstd':
+                received = ZstdDecompressor()(received, True)
             self.ae(data, received)
             ft.test_responses = []
             ft.handle_serialized_command(serialized_cmd(action='file', file_id='sl', name=sl, compression=compress))
             received = b''.join(x['data'] for x in ft.test_responses)
             self.ae(received.decode('utf-8'), src)
+            ft.test_responses = []
+            ft.handle_serialized_command(serialized_cmd(action='verify', file_id='src'))
+            self.ae(ft.test_responses, [{'action': 'verify', 'id': 'test', 'file_id': 'src', 'status': 'OK', 'data': hashlib.sha256(data).digest()}])
+            ft.test_responses = []
+            ft.handle_serialized_command(serialized_cmd(action='verify', file_id='missing'))
+            self.assertTrue(ft.test_responses[0]['status'].startswith('EINVAL:'))
+
+    def test_symlinks(self):
+        # symlinks created by a transfer cannot be used to write outside the destination
+        dest, outside = os.path.join(self.tdir, 'dest'), os.path.join(self.tdir, 'outside')
+        os.mkdir(dest), os.mkdir(outside)
+        os.symlink(outside, os.path.join(dest, 'existing'))
+        files = {}
+
+        def df(file_id, name, ftype=FileType.regular):
+            files[file_id] = ans = DestFile(FileTransmissionCommand(file_id=file_id, name=os.path.join(dest, name), ftype=ftype))
+            return ans
+
+        df('s', 'escape', FileType.symlink).write_data(files, b'path:' + outside.encode(), True)
+        with self.assertRaises(TransmissionError):
+            df('e', 'escape/file').write_data(files, b'x', True)
+        with self.assertRaises(TransmissionError):
+            df('d', 'escape/sub/file').write_data(files, b'x', True)
+        self.ae(os.listdir(outside), [])
+        df('x', 'existing/file').write_data(files, b'x', True)
+        self.ae(os.listdir(outside), ['file'])
+        # symlinks to the directories being traversed are not followed
+        src = os.path.join(self.tdir, 'src')
+        os.makedirs(os.path.join(src, 'sub'))
+        os.symlink('..', os.path.join(src, 'sub', 'loop'))
+        os.symlink(outside, os.path.join(src, 'other'))
+        names = {os.path.relpath(ftc.name, src) for ftc in iter_file_metadata(((('s', src),)), follow_symlinks=True)}
+        self.ae(names, {'.', 'sub', 'other', 'other/file'})
+
+    def test_relay(self):
+        class RelayFileTransmission(FileTransmission):
+            blocked = False
+
+            def write_ftc_to_child(self, payload, appendleft=False, use_pending=True, encrypted=False):
+                if not self.blocked:
+                    return super().write_ftc_to_child(payload, appendleft, use_pending, encrypted)
+                if use_pending:
+                    payload = payload if encrypted else self.encrypted(payload)
+                    self.pending_receive_responses.appendleft(payload) if appendleft else self.pending_receive_responses.append(payload)
+                return False
+
+            def start_pending_timer(self):
+                pass
+
+        def statuses(ft):
+            ans = [(r.get('file_id', ''), r['status']) for r in ft.test_responses if r['action'] == 'status']
+            ft.test_responses = []
+            return ans
+
+        sender, receiver = RelayFileTransmission(), RelayFileTransmission()
+        sender.handle_serialized_command(serialized_cmd(action='send', id='s', relay='r', size=4))
+        # permission is asked for only once the window the files are relayed to is known
+        self.ae(statuses(sender), [])
+        receiver.handle_serialized_command(serialized_cmd(action='receive', id='r', relay='r', size=1))
+        self.ae(statuses(sender), [('', 'OK')])
+        self.ae(statuses(receiver), [('', 'OK')])
+        # a relay can be used by only one pair of windows
+        intruder = RelayFileTransmission()
+        intruder.handle_serialized_command(serialized_cmd(action='receive', id='i', relay='r', size=1))
+        self.assertNotIn('i', intruder.active_sends)
+        self.assertIn('already in use', intruder.test_responses[0]['status'])
+
+        receiver.handle_serialized_command(serialized_cmd(action='file', id='r', file_id='spec', name='r'))
+        data = os.urandom(16 * 1024)
+        sender.handle_serialized_command(serialized_cmd(action='file', id='s', file_id='d', name='/src/d', ftype='directory'))
+        sender.handle_serialized_command(serialized_cmd(action='file', id='s', file_id='f', name='/src/d/f', size=len(data)))
+        sender.handle_serialized_command(serialized_cmd(action='file', id='s', file_id='l', name='/src/d/l', ftype='symlink', data='fid:f'))
+        self.ae(receiver.test_responses, [])
+        sender.handle_serialized_command(serialized_cmd(action='file', id='s', file_id='u', name='/src/d/u', size=3))
+        self.ae(statuses(sender), [('d', 'OK'), ('l', 'OK')])
+        files = {r['name']: r for r in receiver.test_responses if r['action'] == 'file'}
+        self.ae(set(files), {'/src/d', '/src/d/f', '/src/d/l', '/src/d/u'})
+        self.ae(files['/src/d/f']['status'], 'f')
+        self.ae(files['/src/d/f']['size'], len(data))
+        self.ae(files['/src/d/f']['parent'], 'd')
+        self.ae(files['/src/d/l']['data'], b'f')
+        self.ae(statuses(receiver), [('', 'OK')])
+
+        # the receiver asks for the data of the files
+        receiver.handle_serialized_command(serialized_cmd(action='file', id='r', file_id='rl', name='/src/d/l'))
+        self.ae(b''.join(r['data'] for r in receiver.test_responses if r['file_id'] == 'rl'), b'f')
+        receiver.test_responses = []
+        receiver.handle_serialized_command(serialized_cmd(action='file', id='r', file_id='rf', name='/src/d/f', compression='zlib'))
+        self.ae(statuses(sender), [('f', 'STARTED')])
+        half = len(data) // 2
+        sender.handle_serialized_command(serialized_cmd(action='data', id='s', file_id='f', data=data[:half]))
+        self.ae(statuses(sender), [('f', 'PROGRESS')])
+        # the sender is acknowledged only once the receiver has been sent the data
+        receiver.blocked = True
+        sender.handle_serialized_command(serialized_cmd(action='end_data', id='s', file_id='f', data=data[half:]))
+        self.ae(statuses(sender), [])
+        receiver.blocked = False
+        receiver.try_pending(None)
+        self.ae(statuses(sender), [('f', 'OK')])
+        received = b''.join(r['data'] for r in receiver.test_responses if r['action'] in ('data', 'end_data'))
+        self.ae(ZlibDecompressor()(received, True), data)
+
+        # files the receiver does not want are acknowledged when it finishes
+        receiver.handle_serialized_command(serialized_cmd(action='finish', id='r'))
+        self.ae(statuses(sender), [('u', 'OK')])
+        sender.handle_serialized_command(serialized_cmd(action='finish', id='s'))
+        self.assertFalse(sender.active_receives)
+        self.assertFalse(receiver.active_sends)
+        # the relay can be used again once both sessions are done
+        receiver.handle_serialized_command(serialized_cmd(action='receive', id='r2', relay='r', size=1))
+        self.ae(statuses(receiver), [])
+        self.assertIn('r2', receiver.active_sends)
+        receiver.handle_serialized_command(serialized_cmd(action='cancel', id='r2'))
+
+        # canceling one session cancels the other
+        sender.handle_serialized_command(serialized_cmd(action='send', id='s3', relay='r3', size=1))
+        receiver.handle_serialized_command(serialized_cmd(action='receive', id='r3', relay='r3', size=1))
+        statuses(sender), statuses(receiver)
+        sender.handle_serialized_command(serialized_cmd(action='cancel', id='s3'))
+        self.assertIn(('', 'CANCELED'), statuses(receiver))
+        self.assertFalse(receiver.active_sends)
+
+    def test_transfer_encryption(self):
+        from dataclasses import replace
+
+        from kitty.fast_data_types import EllipticCurveKey
+        from kitty.file_transmission import decrypt_transfer_data, encrypt_transfer_data, transfer_data_aad
+
+        from .crypto import is_rlimit_memlock_too_low
+        if is_rlimit_memlock_too_low():
+            self.skipTest('RLIMIT_MEMLOCK is too low')
+        key = EllipticCurveKey().derive_secret(EllipticCurveKey().public)
+        chunk = FileTransmissionCommand(action=Action.data, file_id='f', data=b'abc')
+        encrypted = encrypt_transfer_data(key, chunk.data, transfer_data_aad('kt', chunk, 0))
+        self.ae(decrypt_transfer_data(key, encrypted, transfer_data_aad('kt', chunk, 0)), b'abc')
+        # data cannot be sent back, reordered, moved to another file or turned into the end of a file
+        for aad in (
+            transfer_data_aad('tk', chunk, 0), transfer_data_aad('kt', chunk, 1),
+            transfer_data_aad('kt', replace(chunk, file_id='g'), 0), transfer_data_aad('kt', replace(chunk, action=Action.end_data), 0),
+        ):
+            with self.assertRaises(Exception):
+                decrypt_transfer_data(key, encrypted, aad)
+        empty = encrypt_transfer_data(key, b'', b'x')
+        self.ae(len(empty), 28)
+        self.ae(decrypt_transfer_data(key, empty, b'x'), b'')
 
     def test_parse_ftc(self):
         def t(raw, *expected):
@@ -137,3 +137,48 @@ def ac(which=0):
                  " \\ blue")
         self.ae(opts.font_size, 12.35)
         self.ae(opts.color25, Color(0, 0, 255))
+
+    def test_auto_color_themes(self):
+        import os
+        import tempfile
+        from unittest.mock import patch
+
+        from kitty import boss, fast_data_types
+        from kitty.boss import Boss
+
+        opts = self.set_options()
+        configured = {'foreground': int(opts.foreground), 'background': int(opts.background)}
+
+        class FakeBoss:
+            all_windows = ()
+            apply_system_color_scheme = Boss.apply_system_color_scheme
+            on_system_color_scheme_change = Boss.on_system_color_scheme_change
+
+            def __init__(self):
+                self.colors_before_auto_theme = {}
+                self.patched = []
+
+            def patch_colors(self, colors, configured):
+                self.patched.append(colors)
+
+        with tempfile.TemporaryDirectory() as tdir, patch.object(boss, 'config_dir', tdir):
+            with open(os.path.join(tdir, 'dark-theme.auto.conf'), 'w') as f:
+                f.write('foreground #ff0000\nbackground #000011\n')
+            b = FakeBoss()
+            # the theme for the color scheme is applied when it changes
+            b.on_system_color_scheme_change(1)
+            self.ae(b.patched, [{'foreground': 0xff0000, 'background': 0x11}])
+            self.ae(b.colors_before_auto_theme, configured)
+            # the colors are restored when there is no theme for the color scheme
+            b.on_system_color_scheme_change(2)
+            self.ae(b.patched[-1], configured)
+            self.ae(b.colors_before_auto_theme, {})
+            b.on_system_color_scheme_change(0)
+            self.ae(len(b.patched), 2)
+            # the current color scheme is used at startup and when reloading the config
+            with patch.object(fast_data_types, 'get_system_color_theme', return_value=1):
+                b.apply_system_color_scheme()
+            self.ae(b.patched[-1], {'foreground': 0xff0000, 'background': 0x11})
+            with patch.object(fast_data_types, 'get_system_color_theme', side_effect=RuntimeError):
+                b.apply_system_color_scheme()
+            self.ae(len(b.patched), 3)
@@ -11,7 +11,7 @@
 from contextlib import suppress
 from functools import lru_cache
 
-from kittens.ssh.utils import get_connection_data
+from kittens.ssh.utils import get_connection_data, get_ssh_data, set_cwd_in_cmdline, set_server_args_in_cmdline
 from kitty.constants import is_macos, kitten_exe, runtime_dir
 from kitty.fast_data_types import CURSOR_BEAM, shm_unlink
 from kitty.utils import SSHConnectionData
@@ -56,13 +56,74 @@ def t(cmdline, binary='ssh', host='main', port=None, identity_file='', extra_arg
         t('ssh -p 33 main', port=33)
         t('ssh -p 34 ssh://un@ip:33/', host='un@ip', port=34)
         t('ssh --kitten=one -p 12 --kitten two -ix main', identity_file='x', port=12, extra_args=(('--kitten', 'one'), ('--kitten', 'two')))
+        t('ssh --via j1 --kitten=one --via=j2 main', extra_args=(('--via', 'j1'), ('--kitten', 'one'), ('--via', 'j2')))
+        t('ssh --refresh-remote-cache -p 12 main', port=12)
+        t('ssh --mosh main')
+        t('ssh --choose-identity --mosh -p 12 main', port=12)
         self.assertTrue(runtime_dir())
 
+    def test_ssh_server_args_in_cmdline(self):
+        def t(cmdline, expected, server_args=('ls',), allocate_tty=False, cwd=''):
+            argv = ['kitten'] + cmdline.split()
+            if cwd:
+                set_cwd_in_cmdline(cwd, argv)
+            set_server_args_in_cmdline(list(server_args), argv, allocate_tty=allocate_tty)
+            self.ae(argv, ['kitten'] + expected.split())
+
+        t('ssh main', 'ssh main ls')
+        t('ssh -p 12 main cmd', 'ssh -p 12 main ls')
+        t('ssh --kitten one --via=j1 main', 'ssh --kitten one --via=j1 main ls')
+        t('ssh main', 'ssh -t main ls', allocate_tty=True)
+        t('ssh --refresh-remote-cache -p 12 main', 'ssh --refresh-remote-cache -p 12 main ls')
+        t('ssh --refresh-remote-cache main', 'ssh --refresh-remote-cache --kitten=cwd=/x main ls', cwd='/x')
+        t('ssh --mosh --refresh-remote-cache main', 'ssh --mosh --refresh-remote-cache --kitten=cwd=/x main ls', cwd='/x')
+        t('ssh --mosh main', 'ssh --mosh -t main ls', allocate_tty=True)
+        t('ssh --ask-env A,B main', 'ssh --ask-env A,B main ls')
+        t('ssh --ask-env=A -p 12 main', 'ssh --ask-env=A -p 12 main ls')
+        t('ssh --choose-identity --mosh main', 'ssh --choose-identity --mosh --kitten=cwd=/x main ls', cwd='/x')
+
+    def test_ssh_remote_cache_requests(self):
+        from base64 import standard_b64encode
+
+        def request(msg, remote_cache):
+            return b''.join(get_ssh_data(memoryview(standard_b64encode(msg.encode())), 'testing', remote_cache=remote_cache)).decode()
+
+        with tempfile.TemporaryDirectory() as tdir:
+            record = os.path.join(tdir, 'records', 'x')
+            remote_cache = {'cache_version': '1', 'cache_record': record}
+            self.ae(request('cached=2', remote_cache), '')
+            self.assertFalse(os.path.exists(record))
+            self.ae(request('cached=1', remote_cache), '')
+            with open(record) as f:
+                self.ae(f.read(), '1')
+            self.assertNotIn('cache_record', remote_cache)
+            # the platform of the remote host is recorded only when requested and valid
+            platform_record = os.path.join(tdir, 'records', 'x.platform')
+            for uname, recorded in (('Linux x86_64', True), ('Linux x86_64 extra', False), ('../x y', False)):
+                remote_cache = {'cache_version': '1', 'cache_record': record, 'platform_record': platform_record}
+                self.ae(request(f'cached=1:uname={uname}', remote_cache), '')
+                self.ae(os.path.exists(platform_record), recorded)
+                if recorded:
+                    with open(platform_record) as f:
+                        self.ae(f.read(), uname)
+                    os.remove(platform_record)
+            remote_cache = {'cache_version': '1', 'cache_record': record}
+            self.ae(request('cached=1:uname=Linux x86_64', remote_cache), '')
+            self.assertFalse(os.path.exists(platform_record))
+        remote_cache = {'cache_version': '1', 'cache_tarfile': 'x' * 300}
+        self.assertIn('No cached files', request('cache=2', remote_cache))
+        self.ae(request('cache=1', remote_cache), '\nKITTY_DATA_START\nOK\n' + 'x' * 254 + '\n' + 'x' * 46 + '\nKITTY_DATA_END\n')
+        # the cached files are sent only once
+        self.assertIn('No cached files', request('cache=1', remote_cache))
+
     @property
     @lru_cache()
     def all_possible_sh(self):
         python = 'python3' if shutil.which('python3') else 'python'
-        return tuple(filter(shutil.which, ('dash', 'zsh', 'bash', 'posh', 'sh', python)))
+        ans = tuple(filter(shutil.which, ('dash', 'zsh', 'bash', 'posh', 'ksh', 'mksh', 'sh', python)))
+        if shutil.which('busybox'):
+            ans += ('busybox ash',)
+        return ans
 
     @retry_on_failure()
     def test_ssh_copy(self):
@@ -142,9 +203,37 @@ def test_ssh_env_vars(self):
                 pty.wait_till(lambda: '/cwd' in pty.screen_contents())
                 self.assertTrue(pty.is_echo_on())
 
+    @retry_on_failure()
+    def test_ssh_conditional_config(self):
+        arch = os.uname().machine
+        for sh in self.all_possible_sh:
+            with self.subTest(sh=sh), tempfile.TemporaryDirectory() as remote_home, tempfile.TemporaryDirectory() as local_home:
+                for x in ('yes', 'no'):
+                    with open(os.path.join(local_home, x), 'w') as f:
+                        f.write(x)
+                conf = f'''
+env A=unconditional
+if remote_arch == {arch}
+env A=matched
+copy yes
+if remote_arch != {arch}
+env B=unmatched
+copy no
+if remote_kernel matches .
+env C=kernel
+'''
+                pty = self.check_bootstrap(
+                    sh, remote_home, test_script='env; exit 0', SHELL_INTEGRATION_VALUE='', conf=conf, home=local_home
+                )
+                pty.wait_till(lambda: 'C=kernel' in pty.screen_contents())
+                self.assertIn('A=matched', pty.screen_contents())
+                self.assertNotIn('B=unmatched', pty.screen_contents())
+                self.assertTrue(os.path.exists(f'{remote_home}/yes'))
+                self.assertFalse(os.path.exists(f'{remote_home}/no'))
+
     @retry_on_failure()
     def test_ssh_bootstrap_with_different_launchers(self):
-        for launcher in self.all_possible_sh:
+        for launcher in self.all_possible_sh + ('tcsh',):
             if 'python' in launcher:
                 continue
             for sh in self.all_possible_sh:
@@ -224,6 +313,30 @@ def test_ssh_shell_integration(self):
                         self.assertEqual(pty.screen.cursor.shape, 0)
                         self.assertNotIn(b'\x1b]133;', pty.received_bytes)
 
+    @retry_on_failure()
+    def test_ssh_restricted_login_shells(self):
+        for login_shell in ('dash', 'ash', 'ksh', 'mksh', 'tcsh'):
+            if not shutil.which(login_shell):
+                continue
+            # only the prompt is marked as these shells have no hooks for commands
+            has_integration = login_shell != 'tcsh'
+            for sh in self.all_possible_sh:
+                with self.subTest(sh=sh, login_shell=login_shell), tempfile.TemporaryDirectory() as tdir:
+                    pty = self.check_bootstrap(sh, tdir, login_shell, 'enabled no-cursor')
+                    pty.send_cmd_to_child('echo "$TERM=fruity"')
+                    pty.wait_till(lambda: 'kitty=fruity' in pty.screen_contents(), timeout=30)
+                    if has_integration:
+                        self.assertIn(b'\x1b]133;A\x07', pty.received_bytes)
+                        self.assertIn(b'\x1b]7;kitty-shell-cwd://', pty.received_bytes)
+                        if login_shell == 'mksh':
+                            # the delimiters of the non-printing escape codes are not output
+                            self.assertNotIn(b'\x01', pty.received_bytes)
+                        # the integration must not be propagated to child shells
+                        pty.send_cmd_to_child('echo "ksi=[$KITTY_SHELL_INTEGRATION$KITTY_SH_INJECT]"')
+                        pty.wait_till(lambda: 'ksi=[]' in pty.screen_contents())
+                    else:
+                        self.assertNotIn(b'\x1b]133;', pty.received_bytes)
+
     def check_bootstrap(self, sh, home_dir, login_shell='', SHELL_INTEGRATION_VALUE='enabled', test_script='', pre_data='', conf='', launcher='sh', home=''):
         if login_shell:
             conf += f'\nlogin_shell {login_shell}'
@@ -0,0 +1,58 @@
+#!/bin/sh
+# Copyright (C) 2023 Kovid Goyal <kovid at kovidgoyal.net>
+# Distributed under terms of the GPLv3 license.
+
+# Shell integration for minimal POSIX shells such as dash, busybox ash and the
+# Korn shells. It is injected via the ENV variable by the ssh kitten. These shells have no hooks
+# to run code before and after commands, so only the prompt is modified, to
+# mark it and report the current working directory.
+
+if [ -n "$KITTY_SH_INJECT" ]; then
+    unset ENV; unset KITTY_SH_INJECT
+    if [ -n "$KITTY_SH_POSIX_ENV" ]; then
+        export ENV="$KITTY_SH_POSIX_ENV"
+        [ -f "$ENV" -a -r "$ENV" ] && . "$ENV"
+    fi
+    unset KITTY_SH_POSIX_ENV
+
+    _ksi_main() {
+        case "$-" in
+            *i*) ;;
+            *) return;;
+        esac
+        _ksi_esc=$(printf '\033'); _ksi_bel=$(printf '\007')
+        # busybox ash and mksh need non-printing characters in the prompt to be
+        # delimited, mksh uses the character before a carriage return at the
+        # start of the prompt as the delimiter
+        _ksi_np_start=""; _ksi_np_end=""; _ksi_np_leader=""
+        [ -n "$BB_ASH_VERSION" ] && { _ksi_np_start='\['; _ksi_np_end='\]'; }
+        case "$KSH_VERSION" in
+            *MIRBSD*)
+                _ksi_np_start=$(printf '\001'); _ksi_np_end="$_ksi_np_start"
+                _ksi_np_leader="${_ksi_np_start}$(printf '\r')"
+                # the prompt may already define the delimiter
+                case "$PS1" in "$_ksi_np_leader"*) PS1="${PS1#"$_ksi_np_leader"}";; esac
+                ;;
+        esac
+        _ksi_prefix=""
+        case " $KITTY_SHELL_INTEGRATION " in
+            *" no-cwd "*) ;;
+            # PWD is expanded by the shell every time the prompt is drawn
+            *) _ksi_prefix="${_ksi_esc}]7;kitty-shell-cwd://$(command hostname 2> /dev/null || command uname -n)"'$PWD'"${_ksi_bel}";;
+        esac
+        case " $KITTY_SHELL_INTEGRATION " in
+            *" no-prompt-mark "*) ;;
+            *)
+                _ksi_prefix="${_ksi_prefix}${_ksi_esc}]133;A${_ksi_bel}"
+                PS2="${_ksi_np_leader}${_ksi_np_start}${_ksi_esc}]133;A;k=s${_ksi_bel}${_ksi_np_end}${PS2-> }"
+                ;;
+        esac
+        [ -n "$_ksi_prefix" ] && PS1="${_ksi_np_leader}${_ksi_np_start}${_ksi_prefix}${_ksi_np_end}${PS1-\$ }"
+        unset _ksi_esc; unset _ksi_bel; unset _ksi_np_start; unset _ksi_np_end; unset _ksi_np_leader; unset _ksi_prefix
+    }
+    _ksi_main
+    unset -f _ksi_main
+fi
+# ensure manual sourcing of this file has no effect and the setting is not
+# propagated to child shells
+unset KITTY_SHELL_INTEGRATION
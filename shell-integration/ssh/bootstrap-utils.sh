@@ -15,10 +15,55 @@ mv_files_and_dirs() {
     cd "$cwd"
 }
 
+detect_remote() {
+    [ -n "$remote_os" ] && return 0
+    remote_os=$(command uname -s 2> /dev/null | command tr '[:upper:]' '[:lower:]')
+    remote_kernel=$(command uname -r 2> /dev/null)
+    remote_arch=$(command uname -m 2> /dev/null)
+    case "$remote_os" in
+        darwin) remote_os="macos";;
+        linux)
+            remote_os="linux-gnu"
+            for f in /lib/ld-musl-*; do
+                [ -e "$f" ] && remote_os="linux-musl"
+            done;;
+    esac
+}
+
+remote_matches() {
+    # used by the conditional blocks of ssh.conf, an OS matches its variants,
+    # so linux matches both linux-gnu and linux-musl
+    detect_remote
+    case "$1" in
+        remote_os) remote_val="$remote_os";;
+        remote_kernel) remote_val="$remote_kernel";;
+        remote_arch) remote_val="$remote_arch";;
+        *) return 1;;
+    esac
+    case "$2" in
+        matches) printf "%s" "$remote_val" | command grep -Eq -- "$3"; return $?;;
+        "==") case "$remote_val" in "$3"|"$3"-*) return 0;; esac; return 1;;
+        "!=") case "$remote_val" in "$3"|"$3"-*) return 1;; esac; return 0;;
+    esac
+    return 1
+}
+
+merge_conditional_files() {
+    for x in home root; do
+        if [ -e "$tdir/$1/$x" ]; then
+            command mkdir -p "$tdir/$x"
+            mv_files_and_dirs "$tdir/$1/$x" "$tdir/$x"
+        fi
+    done
+}
+
 compile_terminfo() {
     tname=".terminfo"
+    # the kitty terminfo is not sent if it is cached on this host
+    kitty_terminfo="n"
+    [ -f "$1/.terminfo/kitty.terminfo" ] && kitty_terminfo="y"
     # Ensure the 78 dir is present
-    if [ ! -f "$1/$tname/78/xterm-kitty" ]; then
+    if [ "$kitty_terminfo" = "y" -a ! -f "$1/$tname/78/xterm-kitty" ]; then
         command mkdir -p "$1/$tname/78"
         command ln -sf "../x/xterm-kitty" "$1/$tname/78/xterm-kitty"
     fi
@@ -27,10 +72,10 @@ compile_terminfo() {
         # NetBSD requires this file, see https://github.com/kovidgoyal/kitty/issues/4622
         # Also compile terminfo using tic installed via pkgsrc,
         # so that programs that depend on the new version of ncurses automatically fall back to this one.
-        if [ -x "/usr/pkg/bin/tic" ]; then
+        if [ "$kitty_terminfo" = "y" -a -x "/usr/pkg/bin/tic" ]; then
             /usr/pkg/bin/tic -x -o "$1/$tname" "$1/.terminfo/kitty.terminfo" 2>/dev/null
         fi
-        if [ ! -e "$1/$tname/x/xterm-kitty" ]; then
+        if [ "$kitty_terminfo" = "y" -a ! -e "$1/$tname/x/xterm-kitty" ]; then
             command ln -sf "../../.terminfo.cdb" "$1/$tname/x/xterm-kitty"
         fi
         tname=".terminfo.cdb"
@@ -41,8 +86,12 @@ compile_terminfo() {
 
     # compile terminfo for this system
     if [ -x "$(command -v tic)" ]; then
-        tic_out=$(command tic -x -o "$1/$tname" "$1/.terminfo/kitty.terminfo" 2>&1)
-        [ $? = 0 ] || die "Failed to compile terminfo with err: $tic_out"
+        if [ "$kitty_terminfo" = "y" ]; then
+            tic_out=$(command tic -x -o "$1/$tname" "$1/.terminfo/kitty.terminfo" 2>&1)
+            [ $? = 0 ] || die "Failed to compile terminfo with err: $tic_out"
+        fi
+        # entries from the terminfo option in ssh.conf, pre-compiled entries are used if this fails
+        [ -f "$1/.terminfo/extra.terminfo" ] && command tic -x -o "$1/$tname" "$1/.terminfo/extra.terminfo" > /dev/null 2> /dev/null
     fi
 }
 
@@ -135,6 +184,15 @@ exec_bash_with_integration() {
     exec "$login_shell" "--login" "--posix"
 }
 
+exec_posix_sh_with_integration() {
+    # older kitty versions did not send this file
+    [ -f "$shell_integration_dir/sh/kitty.sh" ] || return
+    [ -n "$ENV" ] && export KITTY_SH_POSIX_ENV="$ENV"
+    export ENV="$shell_integration_dir/sh/kitty.sh"
+    export KITTY_SH_INJECT="1"
+    exec "$login_shell" "-l"
+}
+
 exec_with_shell_integration() {
     [ -z "$shell_integration_dir" ] && return
     case "$shell_name" in
@@ -147,7 +205,12 @@ exec_with_shell_integration() {
         "bash")
             exec_bash_with_integration
             ;;
+        "dash"|"ash"|"ksh"|"ksh93"|"mksh"|"oksh")
+            exec_posix_sh_with_integration
+            ;;
     esac
+    # no integration is possible for other shells such as tcsh, they are
+    # executed as normal login shells
 }
 
 execute_sh_with_posix_env() {
@@ -226,7 +289,11 @@ exec_login_shell() {
             ;;
         (*)
             # not blank
-            printf "%s" "$KITTY_SHELL_INTEGRATION" | command grep -q '\bno-rc\b' || exec_with_shell_integration
+            # grep on busybox and BSD does not support \b so use case instead
+            case " $KITTY_SHELL_INTEGRATION " in
+                (*" no-rc "*) ;;
+                (*) exec_with_shell_integration;;
+            esac
             # either no-rc or exec failed
             unset KITTY_SHELL_INTEGRATION
             ;;
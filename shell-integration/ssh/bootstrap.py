@@ -5,10 +5,12 @@
 import base64
 import contextlib
 import errno
+import glob
 import io
 import json
 import os
 import pwd
+import re
 import shutil
 import subprocess
 import sys
@@ -21,11 +23,16 @@
 data_dir = shell_integration_dir = ''
 request_data = int('REQUEST_DATA')
 leading_data = b''
+restore_cwd = ''
 login_shell = os.environ.get('SHELL') or '/bin/sh'
 try:
     login_shell = pwd.getpwuid(os.geteuid()).pw_shell
 except KeyError:
     pass
+# the data uploaded with sftp, it is in the home directory the sftp server uses
+data_file = 'DATA_FILE'
+if data_file:
+    data_file = os.path.join(os.path.expanduser('~'), data_file)
 export_home_cmd = b'EXPORT_HOME_CMD'
 if export_home_cmd:
     HOME = base64.standard_b64decode(export_home_cmd).decode('utf-8')
@@ -34,6 +41,15 @@
     HOME = os.path.expanduser('~')
 
 
+def tty_unavailable(msg):
+    # the exit code tells the ssh kitten the data cannot be read from the TTY,
+    # so that it can upload it with sftp instead
+    cleanup()
+    sys.stderr.write(msg + '\n')
+    sys.stderr.flush()
+    raise SystemExit(97)
+
+
 def set_echo(fd, on=False):
     if fd < 0:
         fd = sys.stdin.fileno()
@@ -90,8 +106,30 @@ def debug(msg):
         write_all(tty_file_obj.fileno(), data)
 
 
+remote_info = {}
+
+
+def remote_matches(variable, op, value):
+    # used by the conditional blocks of ssh.conf, an OS matches its variants,
+    # so linux matches both linux-gnu and linux-musl
+    if not remote_info:
+        u = os.uname()
+        remote_os = u[0].lower()
+        if remote_os == 'darwin':
+            remote_os = 'macos'
+        elif remote_os == 'linux':
+            remote_os += '-musl' if glob.glob('/lib/ld-musl-*') else '-gnu'
+        remote_info.update(remote_os=remote_os, remote_kernel=u[2], remote_arch=u[4])
+    val = remote_info.get(variable, '')
+    if op == 'matches':
+        return re.search(value, val) is not None
+    matched = val == value or val.startswith(value + '-')
+    return matched if op == '==' else not matched
+
+
 def apply_env_vars(raw):
     global login_shell
+    conditional_dirs = []
 
     def process_defn(defn):
         parts = json.loads(defn)
@@ -104,12 +142,19 @@ def process_defn(defn):
         os.environ[key] = val
 
     for line in raw.splitlines():
+        if line.startswith('if '):
+            variable, op, value, line = json.loads(line[3:])
+            if not remote_matches(variable, op, value):
+                continue
         val = line.split(' ', 1)[-1]
         if line.startswith('export '):
             process_defn(val)
         elif line.startswith('unset '):
             os.environ.pop(json.loads(val)[0], None)
+        elif line.startswith('merge_conditional_files '):
+            conditional_dirs.append(val)
     login_shell = os.environ.pop('KITTY_LOGIN_SHELL', login_shell)
+    return conditional_dirs
 
 
 def move(src, base_dest):
@@ -145,6 +190,14 @@ def compile_terminfo(base):
     if not tic:
         return
     tname = '.terminfo'
+    kitty_terminfo = os.path.join(base, tname, 'kitty.terminfo')
+    if not os.path.exists(kitty_terminfo):
+        # the kitty terminfo is not sent if it is cached on this host
+        if os.path.exists('/usr/share/misc/terminfo.cdb'):
+            tname += '.cdb'
+        os.environ['TERMINFO'] = os.path.join(HOME, tname)
+        compile_extra_terminfo(tic, base, tname)
+        return
     q = os.path.join(base, tname, '78', 'xterm-kitty')
     if not os.path.exists(q):
         try:
@@ -159,7 +212,7 @@ def compile_terminfo(base):
         tname += '.cdb'
     os.environ['TERMINFO'] = os.path.join(HOME, tname)
     p = subprocess.Popen(
-        [tic, '-x', '-o', os.path.join(base, tname), os.path.join(base, '.terminfo', 'kitty.terminfo')],
+        [tic, '-x', '-o', os.path.join(base, tname), kitty_terminfo],
         stdout=subprocess.PIPE, stderr=subprocess.STDOUT
     )
     output = p.stdout.read()
@@ -167,13 +220,28 @@ def compile_terminfo(base):
     if rc != 0:
         getattr(sys.stderr, 'buffer', sys.stderr).write(output)
         raise SystemExit('Failed to compile the terminfo database')
+    compile_extra_terminfo(tic, base, tname)
+
+
+def compile_extra_terminfo(tic, base, tname):
+    extra = os.path.join(base, '.terminfo', 'extra.terminfo')
+    if os.path.exists(extra):
+        # entries from the terminfo option in ssh.conf, pre-compiled entries are used if this fails
+        p = subprocess.Popen([tic, '-x', '-o', os.path.join(base, tname), extra], stdout=subprocess.PIPE, stderr=subprocess.STDOUT)
+        p.stdout.read()
+        p.wait()
 
 
 def iter_base64_data(f):
-    global leading_data
+    global leading_data, restore_cwd
     started = 0
     while True:
-        line = f.readline().rstrip()
+        line = f.readline()
+        if not line:
+            if started == 0:
+                tty_unavailable('Failed to read SSH data from tty')
+            raise SystemExit('Failed to read SSH data from tty')
+        line = line.rstrip()
         if started == 0:
             if line == b'KITTY_DATA_START':
                 started = 1
@@ -182,6 +250,9 @@ def iter_base64_data(f):
         elif started == 1:
             if line == b'OK':
                 started = 2
+            elif line.startswith(b'KITTY_RESTORE_CWD:'):
+                # sent when the ssh kitten reconnects
+                restore_cwd = base64.standard_b64decode(line.partition(b':')[2]).decode('utf-8')
             else:
                 raise SystemExit(line.decode('utf-8', 'replace').rstrip())
         else:
@@ -202,28 +273,62 @@ def temporary_directory(dir, prefix):
 
 def get_data():
     global data_dir, shell_integration_dir, leading_data
-    data = []
-    data = b''.join(iter_base64_data(tty_file_obj))
-    if leading_data:
-        # clear current line as it might have things echoed on it from leading_data
-        # because we only turn off echo in this script whereas the leading bytes could
-        # have been sent before the script had a chance to run
-        sys.stdout.write('\r\033[K')
-    data = base64.standard_b64decode(data)
+    if data_file:
+        try:
+            with open(data_file, 'rb') as f:
+                data = f.read()
+        except EnvironmentError:
+            raise SystemExit('The data uploaded with sftp was not found at: ' + data_file)
+        os.remove(data_file)
+    else:
+        data = b''.join(iter_base64_data(tty_file_obj))
+        if leading_data:
+            # clear current line as it might have things echoed on it from leading_data
+            # because we only turn off echo in this script whereas the leading bytes could
+            # have been sent before the script had a chance to run
+            sys.stdout.write('\r\033[K')
+        data = base64.standard_b64decode(data)
     with temporary_directory(dir=HOME, prefix='.kitty-ssh-kitten-untar-') as tdir, tarfile.open(fileobj=io.BytesIO(data)) as tf:
         tf.extractall(tdir)
         with open(tdir + '/data.sh') as f:
             env_vars = f.read()
-        apply_env_vars(env_vars)
+        for cdir in apply_env_vars(env_vars):
+            for x in ('home', 'root'):
+                src = os.path.join(tdir, cdir, x)
+                if os.path.exists(src):
+                    if not os.path.exists(os.path.join(tdir, x)):
+                        os.makedirs(os.path.join(tdir, x))
+                    move(src, os.path.join(tdir, x))
         data_dir = os.environ.pop('KITTY_SSH_KITTEN_DATA_DIR')
         if not os.path.isabs(data_dir):
             data_dir = os.path.join(HOME, data_dir)
         data_dir = os.path.abspath(data_dir)
         shell_integration_dir = os.path.join(data_dir, 'shell-integration')
+        remote_cache = os.environ.pop('KITTY_SSH_REMOTE_CACHE', '')
+        if remote_cache:
+            # the files cached on this host were not sent, ensure they are present
+            try:
+                with open(os.path.join(data_dir, 'cache-version')) as f:
+                    cache_version = f.read()
+            except EnvironmentError:
+                cache_version = ''
+            if cache_version != remote_cache:
+                # ask kitty for the missing or out of date files
+                set_echo(tty_file_obj.fileno(), on=False)
+                write_all(tty_file_obj.fileno(), dcs_to_kitty('cache=' + remote_cache))
+                cached = base64.standard_b64decode(b''.join(iter_base64_data(tty_file_obj)))
+                with tarfile.open(fileobj=io.BytesIO(cached)) as ctf:
+                    ctf.extractall(tdir)
+        record_cache = os.environ.pop('KITTY_SSH_RECORD_CACHE', '')
         compile_terminfo(tdir + '/home')
         move(tdir + '/home', HOME)
         if os.path.exists(tdir + '/root'):
             move(tdir + '/root', '/')
+        if record_cache:
+            # tell kitty the files are now cached on this host, so they are not
+            # sent again, and the platform of this host, for uploading the kitten
+            u = os.uname()
+            write_all(tty_file_obj.fileno(), dcs_to_kitty('cached=' + record_cache + ':uname=' + u.sysname + ' ' + u.machine))
 
 
 def exec_zsh_with_integration():
@@ -259,6 +364,17 @@ def exec_bash_with_integration():
     os.execlp(login_shell, os.path.basename('login_shell'), '--posix')
 
 
+def exec_posix_sh_with_integration():
+    script = os.path.join(shell_integration_dir, 'sh', 'kitty.sh')
+    if not os.path.exists(script):
+        return
+    if os.environ.get('ENV'):
+        os.environ['KITTY_SH_POSIX_ENV'] = os.environ['ENV']
+    os.environ['ENV'] = script
+    os.environ['KITTY_SH_INJECT'] = '1'
+    os.execlp(login_shell, os.path.basename(login_shell), '-l')
+
+
 def exec_with_shell_integration():
     shell_name = os.path.basename(login_shell).lower()
     if shell_name == 'zsh':
@@ -267,6 +383,8 @@ def exec_with_shell_integration():
         exec_fish_with_integration()
     if shell_name == 'bash':
         exec_bash_with_integration()
+    if shell_name in ('dash', 'ash', 'ksh', 'ksh93', 'mksh', 'oksh'):
+        exec_posix_sh_with_integration()
 
 
 def install_kitty_bootstrap():
@@ -284,7 +402,11 @@ def main():
     global tty_file_obj, login_shell
     # the value of O_CLOEXEC below is on macOS which is most likely to not have
     # os.O_CLOEXEC being still stuck with python2
-    tty_file_obj = os.fdopen(os.open(os.ctermid(), os.O_RDWR | getattr(os, 'O_CLOEXEC', 16777216)), 'rb')
+    try:
+        tty_file_obj = os.fdopen(os.open(os.ctermid(), os.O_RDWR | getattr(os, 'O_CLOEXEC', 16777216)), 'rb')
+    except EnvironmentError:
+        if not data_file:
+            tty_unavailable('The TTY cannot be used to read SSH data')
     try:
         if request_data:
             set_echo(tty_file_obj.fileno(), on=False)
@@ -293,6 +415,8 @@ def main():
     finally:
         cleanup()
     cwd = os.environ.pop('KITTY_LOGIN_CWD', '')
+    if restore_cwd:
+        cwd = restore_cwd
     install_kitty_bootstrap()
     if cwd:
         try:
@@ -14,7 +14,7 @@ cleanup_on_bootstrap_exit() {
     tdir=""
 }
 
-die() {
+print_error() {
     if [ -e /dev/stderr ]; then
         printf "\033[31m%s\033[m\n\r" "$*" > /dev/stderr;
     elif [ -e /dev/fd/2 ]; then
@@ -22,10 +22,22 @@ die() {
     else
         printf "\033[31m%s\033[m\n\r" "$*";
     fi
+}
+
+die() {
+    print_error "$*";
     cleanup_on_bootstrap_exit;
     exit 1;
 }
 
+tty_unavailable() {
+    # the exit code tells the ssh kitten the data cannot be read from the TTY,
+    # so that it can upload it with sftp instead
+    print_error "$*";
+    cleanup_on_bootstrap_exit;
+    exit 97;
+}
+
 python_detected="0"
 detect_python() {
     if [ python_detected = "1" ]; then
@@ -75,6 +87,10 @@ fi
 dcs_to_kitty() { printf "\033P@kitty-$1|%s\033\134" "$(printf "%s" "$2" | base64_encode)" > /dev/tty; }
 debug() { dcs_to_kitty "print" "debug: $1"; }
 
+# the data uploaded with sftp, it is in the home directory the sftp server uses
+data_file="DATA_FILE"
+[ -n "$data_file" ] && data_file="$HOME/$data_file"
+
 # If $HOME is configured set it here
 EXPORT_HOME_CMD
 # ensure $HOME is set
@@ -86,9 +102,13 @@ EXPORT_HOME_CMD
 leading_data=""
 login_shell=""
 login_cwd=""
+restore_cwd=""
 
 request_data="REQUEST_DATA"
 trap "cleanup_on_bootstrap_exit" EXIT
+if [ -z "$data_file" ]; then
+    ( : < /dev/tty > /dev/tty ) 2> /dev/null || tty_unavailable "The TTY cannot be used to read SSH data"
+fi
 [ "$request_data" = "1" ] && {
     command stty "-echo" < /dev/tty
     dcs_to_kitty "ssh" "id="REQUEST_ID":pwfile="PASSWORD_FILENAME":pw="DATA_PASSWORD""
@@ -101,6 +121,24 @@ read_base64_from_tty() {
     done
 }
 
+read_cached_files() {
+    # the files cached on this host are missing or out of date, ask kitty for them
+    command stty "-echo" < /dev/tty
+    dcs_to_kitty "ssh" "cache=$1"
+    started="n"
+    while IFS= read -r line; do
+        if [ "$started" = "y" ]; then
+            [ "$line" = "OK" ] && break
+            die "$line"
+        fi
+        [ "$line" = "KITTY_DATA_START" ] && started="y"
+    done
+    old_umask=$(umask)
+    umask 000
+    read_base64_from_tty | base64_decode | command tar "xpzf" "-" "-C" "$tdir" 2> /dev/null
+    umask "$old_umask"
+}
+
 untar_and_read_env() {
     # extract the tar file atomically, in the sense that any file from the
     # tarfile is only put into place after it has been fully written to disk
@@ -110,7 +148,12 @@ untar_and_read_env() {
     # suppress STDERR for tar as tar prints various warnings if for instance, timestamps are in the future
     old_umask=$(umask)
     umask 000
-    read_base64_from_tty | base64_decode | command tar "xpzf" "-" "-C" "$tdir" 2> /dev/null
+    if [ -n "$data_file" ]; then
+        command tar "xpzf" "$data_file" "-C" "$tdir" 2> /dev/null
+        command rm -f "$data_file"
+    else
+        read_base64_from_tty | base64_decode | command tar "xpzf" "-" "-C" "$tdir" 2> /dev/null
+    fi
     umask "$old_umask"
     . "$tdir/bootstrap-utils.sh"
     . "$tdir/data.sh"
@@ -121,10 +164,18 @@ untar_and_read_env() {
     esac
     shell_integration_dir="$data_dir/shell-integration"
     unset KITTY_SSH_KITTEN_DATA_DIR
+    if [ -n "$KITTY_SSH_REMOTE_CACHE" ]; then
+        # the files cached on this host were not sent, ensure they are present
+        [ "$(command cat "$data_dir/cache-version" 2> /dev/null)" = "$KITTY_SSH_REMOTE_CACHE" ] || read_cached_files "$KITTY_SSH_REMOTE_CACHE"
+        unset KITTY_SSH_REMOTE_CACHE
+    fi
+    record_cache="$KITTY_SSH_RECORD_CACHE"
+    unset KITTY_SSH_RECORD_CACHE
     login_shell="$KITTY_LOGIN_SHELL"
     unset KITTY_LOGIN_SHELL
     login_cwd="$KITTY_LOGIN_CWD"
     unset KITTY_LOGIN_CWD
+    [ -n "$restore_cwd" ] && login_cwd="$restore_cwd"
     kitty_remote="$KITTY_REMOTE"
     unset KITTY_REMOTE
     compile_terminfo "$tdir/home"
@@ -132,6 +183,9 @@ untar_and_read_env() {
     [ -e "$tdir/root" ] && mv_files_and_dirs "$tdir/root" ""
     command rm -rf "$tdir"
     tdir=""
+    # tell kitty the files are now cached on this host, so they are not sent
+    # again, and the platform of this host, for uploading the kitten
+    [ -n "$record_cache" ] && dcs_to_kitty "ssh" "cached=$record_cache:uname=$(command uname -sm 2> /dev/null)"
 }
 
 get_data() {
@@ -139,6 +193,10 @@ get_data() {
     while IFS= read -r line; do
         if [ "$started" = "y" ]; then
             [ "$line" = "OK" ] && break
+            case "$line" in
+                # sent when the ssh kitten reconnects
+                KITTY_RESTORE_CWD:*) restore_cwd=$(printf "%s" "${line#KITTY_RESTORE_CWD:}" | base64_decode); continue;;
+            esac
             die "$line"
         else
             if [ "$line" = "KITTY_DATA_START" ]; then
@@ -148,11 +206,17 @@ get_data() {
             fi
         fi
     done
+    [ "$started" = "y" ] || tty_unavailable "Failed to read SSH data from tty"
     untar_and_read_env
 }
 
 # ask for the SSH data
-get_data
+if [ -n "$data_file" ]; then
+    [ -f "$data_file" ] || die "The data uploaded with sftp was not found at: $data_file"
+    untar_and_read_env
+else
+    get_data
+fi
 cleanup_on_bootstrap_exit
 prepare_for_exec
 # If a command was passed to SSH execute it here
@@ -30,7 +30,7 @@ import (
 
 const lowerhex = "0123456789abcdef"
 
-var ProtocolVersion [3]int = [3]int{0, 26, 0}
+var ProtocolVersion [3]int = tui.RCProtocolVersion
 
 type GlobalOptions struct {
 	to_network, to_address, password string
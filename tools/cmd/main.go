@@ -5,6 +5,7 @@ package main
 import (
 	"os"
 
+	"kitty/kittens/askpass"
 	"kitty/kittens/ssh"
 	"kitty/tools/cli"
 	"kitty/tools/cmd/completion"
@@ -16,7 +17,10 @@ func main() {
 	os.Unsetenv("KITTY_KITTEN_RUN_MODULE")
 	switch krm {
 	case "ssh_askpass":
-		ssh.RunSSHAskpass()
+		askpass.RunSSHAskpass()
+		return
+	case "ssh_sftp_proxy":
+		ssh.RunSFTPProxy()
 		return
 	}
 	root := cli.NewRootCommand()
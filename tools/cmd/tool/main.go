@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	"kitty/kittens/ask"
+	"kitty/kittens/askpass"
 	"kitty/kittens/clipboard"
 	"kitty/kittens/diff"
 	"kitty/kittens/hints"
@@ -65,6 +66,8 @@ func KittyToolEntryPoints(root *cli.Command) {
 	hyperlinked_grep.EntryPoint(root)
 	// ask
 	ask.EntryPoint(root)
+	// askpass
+	askpass.EntryPoint(root)
 	// hints
 	hints.EntryPoint(root)
 	// hints
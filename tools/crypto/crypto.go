@@ -59,12 +59,10 @@ func encrypt(plaintext []byte, alice_public_key []byte, encryption_protocol stri
 	if err != nil {
 		return
 	}
-	shared_secret_raw, err := curve25519_derive_shared_secret(bob_private_key, alice_public_key)
+	shared_secret, err := SharedSecret(bob_private_key, alice_public_key, encryption_protocol)
 	if err != nil {
 		return
 	}
-	shared_secret_hashed := sha256.Sum256(shared_secret_raw)
-	shared_secret := shared_secret_hashed[:]
 	block, err := aes.NewCipher(shared_secret)
 	if err != nil {
 		return
@@ -94,6 +92,24 @@ func KeyPair(encryption_protocol string) (private_key []byte, public_key []byte,
 	}
 }
 
+// The secret shared with the owner of public_key, suitable for use as an
+// AES-256 key. It is the same secret the terminal derives with its private key
+// and the public key corresponding to private_key.
+func SharedSecret(private_key []byte, public_key []byte, encryption_protocol string) (secret []byte, err error) {
+	switch encryption_protocol {
+	case "1":
+		raw, err := curve25519_derive_shared_secret(private_key, public_key)
+		if err != nil {
+			return nil, err
+		}
+		hashed := sha256.Sum256(raw)
+		return hashed[:], nil
+	default:
+		err = fmt.Errorf("Unknown encryption protocol: %s", encryption_protocol)
+		return
+	}
+}
+
 func EncodePublicKey(pubkey []byte, encryption_protocol string) (ans string, err error) {
 	switch encryption_protocol {
 	case "1":
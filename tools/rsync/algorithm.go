@@ -41,6 +41,8 @@ type xxh3_128 struct {
 	xxh3.Hasher
 }
 
+func (self *xxh3_128) Size() int { return 16 }
+
 func (self *xxh3_128) Sum(b []byte) []byte {
 	s := self.Sum128()
 	pos := len(b)
@@ -68,6 +70,19 @@ func new_xxh3_128() hash.Hash {
 	return ans
 }
 
+// The 64 bit strong hash of blocks is serialized in little endian byte order
+type le_xxh3_64 struct {
+	hash.Hash64
+}
+
+func (self le_xxh3_64) Sum(b []byte) []byte {
+	return bin.AppendUint64(b, self.Sum64())
+}
+
+func new_le_xxh3_64() hash.Hash {
+	return le_xxh3_64{new_xxh3_64()}
+}
+
 // Instruction to mutate target to align to source.
 type Operation struct {
 	Type          OpType
@@ -173,29 +188,44 @@ func (self *Operation) Unserialize(data []byte) (n int, err error) {
 	return
 }
 
-// Signature hash item generated from target.
+// The size of the largest supported strong hash
+const MaxStrongHashSize = 16
+
+// Signature hash item generated from target. Strong hashes smaller than
+// MaxStrongHashSize occupy the start of StrongHash with the rest zeroed.
 type BlockHash struct {
 	Index      uint64
 	WeakHash   uint32
-	StrongHash uint64
+	StrongHash [MaxStrongHashSize]byte
 }
 
+// The size of a serialized BlockHash with the default strong hash
 const BlockHashSize = 20
 
-// Put the serialization of this BlockHash to output
+// The size of a serialized BlockHash with the largest strong hash
+const MaxBlockHashSize = 12 + MaxStrongHashSize
+
+// Put the serialization of this BlockHash to output, the size of output
+// must be 12 + the size of the strong hash
 func (self BlockHash) Serialize(output []byte) {
 	bin.PutUint64(output, self.Index)
 	bin.PutUint32(output[8:], self.WeakHash)
-	bin.PutUint64(output[12:], self.StrongHash)
+	copy(output[12:], self.StrongHash[:])
 }
 
+// Read a serialized BlockHash, the size of data must be 12 + the size of the
+// strong hash
 func (self *BlockHash) Unserialize(data []byte) (err error) {
-	if len(data) < 20 {
-		return fmt.Errorf("record too small to be a BlockHash: %d < %d", len(data), 20)
+	if len(data) < BlockHashSize {
+		return fmt.Errorf("record too small to be a BlockHash: %d < %d", len(data), BlockHashSize)
+	}
+	if len(data) > MaxBlockHashSize {
+		return fmt.Errorf("record too large to be a BlockHash: %d > %d", len(data), MaxBlockHashSize)
 	}
 	self.Index = bin.Uint64(data)
 	self.WeakHash = bin.Uint32(data[8:])
-	self.StrongHash = bin.Uint64(data[12:])
+	self.StrongHash = [MaxStrongHashSize]byte{}
+	copy(self.StrongHash[:], data[12:])
 	return
 }
 
@@ -206,15 +236,15 @@ type rsync struct {
 	BlockSize int
 
 	// This must be non-nil before using any functions
-	hasher                  hash.Hash64
-	hasher_constructor      func() hash.Hash64
+	hasher                  hash.Hash
+	hasher_constructor      func() hash.Hash
 	checksummer_constructor func() hash.Hash
 	checksummer             hash.Hash
 	checksum_done           bool
 	buffer                  []byte
 }
 
-func (r *rsync) SetHasher(c func() hash.Hash64) {
+func (r *rsync) SetHasher(c func() hash.Hash) {
 	r.hasher_constructor = c
 	r.hasher = c()
 }
@@ -236,7 +266,7 @@ func (r *rsync) BlockHashCount(targetLength int64) (count int64) {
 }
 
 type signature_iterator struct {
-	hasher hash.Hash64
+	hasher hash.Hash
 	buffer []byte
 	src    io.Reader
 	rc     rolling_checksum
@@ -258,7 +288,8 @@ func (self *signature_iterator) next() (ans BlockHash, err error) {
 	b := self.buffer[:n]
 	self.hasher.Reset()
 	self.hasher.Write(b)
-	ans = BlockHash{Index: self.index, WeakHash: self.rc.full(b), StrongHash: self.hasher.Sum64()}
+	ans = BlockHash{Index: self.index, WeakHash: self.rc.full(b)}
+	self.hasher.Sum(ans.StrongHash[:0])
 	self.index++
 	return
 
@@ -365,7 +396,7 @@ type diff struct {
 	// A single β hash may correlate with many unique hashes.
 	hash_lookup map[uint32][]BlockHash
 	source      io.Reader
-	hasher      hash.Hash64
+	hasher      hash.Hash
 	checksummer hash.Hash
 	output      io.Writer
 
@@ -381,10 +412,11 @@ func (self *diff) Next() (err error) {
 	return self.pump_till_op_written()
 }
 
-func (self *diff) hash(b []byte) uint64 {
+func (self *diff) hash(b []byte) (ans [MaxStrongHashSize]byte) {
 	self.hasher.Reset()
 	self.hasher.Write(b)
-	return self.hasher.Sum64()
+	self.hasher.Sum(ans[:0])
+	return
 }
 
 // Combine OpBlock into OpBlockRange. To do this store the previous
@@ -626,19 +658,12 @@ func (r *rsync) CreateDiff(source io.Reader, signature []BlockHash, output io.Wr
 	return ans.Next
 }
 
-// Use a more unique way to identify a set of bytes.
-func (r *rsync) hash(v []byte) uint64 {
-	r.hasher.Reset()
-	r.hasher.Write(v)
-	return r.hasher.Sum64()
-}
-
 func (r *rsync) HashSize() int      { return r.hasher.Size() }
 func (r *rsync) HashBlockSize() int { return r.hasher.BlockSize() }
 func (r *rsync) HasHasher() bool    { return r.hasher != nil }
 
 // Searches for a given strong hash among all strong hashes in this bucket.
-func find_hash(hh []BlockHash, hv uint64) (uint64, bool) {
+func find_hash(hh []BlockHash, hv [MaxStrongHashSize]byte) (uint64, bool) {
 	for _, block := range hh {
 		if block.StrongHash == hv {
 			return block.Index, true
@@ -14,10 +14,15 @@
 // p.StartDelta(output_file, file_to_update)
 // p.UpdateDelta(...)
 // p.FinishDelta()
+// The block size and strong hash used for the signature can be changed with
+// p.SetBlockSize() and p.SetStrongHashType() before creating the signature.
+// They are recorded in the signature header, so the Differ needs no
+// configuration.
 package rsync
 
 import (
 	"fmt"
+	"hash"
 	"io"
 	"math"
 
@@ -34,7 +39,42 @@ type ChecksumType uint16
 
 const (
 	XXH3 StrongHashType = iota
+	XXH3_128
 )
+
+var strong_hash_names = []string{"xxh3-64", "xxh3-128"}
+
+func (self StrongHashType) String() string {
+	if int(self) < len(strong_hash_names) {
+		return strong_hash_names[self]
+	}
+	return fmt.Sprintf("StrongHashType(%d)", uint16(self))
+}
+
+func (self StrongHashType) hasher_constructor() func() hash.Hash {
+	switch self {
+	case XXH3:
+		return new_le_xxh3_64
+	case XXH3_128:
+		return new_xxh3_128
+	}
+	return nil
+}
+
+// The names of all supported strong hashes
+func StrongHashNames() []string {
+	return append([]string{}, strong_hash_names...)
+}
+
+func StrongHashTypeFromName(name string) (StrongHashType, error) {
+	for i, q := range strong_hash_names {
+		if q == name {
+			return StrongHashType(i), nil
+		}
+	}
+	return XXH3, fmt.Errorf("Unknown strong hash: %s", name)
+}
+
 const (
 	XXH3128Sum ChecksumType = iota
 )
@@ -82,11 +122,11 @@ func (self *Api) read_signature_header(data []byte) (consumed int, err error) {
 	default:
 		return consumed, fmt.Errorf("Invalid checksum_type in signature header: %d", csum)
 	}
-	switch strong_hash := StrongHashType(bin.Uint16(data[4:])); strong_hash {
-	case XXH3:
+	strong_hash := StrongHashType(bin.Uint16(data[4:]))
+	if c := strong_hash.hasher_constructor(); c != nil {
 		self.Strong_hash_type = strong_hash
-		self.rsync.SetHasher(new_xxh3_64)
-	default:
+		self.rsync.SetHasher(c)
+	} else {
 		return consumed, fmt.Errorf("Invalid strong_hash in signature header: %d", strong_hash)
 	}
 	switch weak_hash := WeakHashType(bin.Uint16(data[6:])); weak_hash {
@@ -195,7 +235,7 @@ func (self *Patcher) FinishDelta() (err error) {
 func (self *Patcher) CreateSignatureIterator(src io.Reader, output io.Writer) func() error {
 	var it func() (BlockHash, error)
 	finished := false
-	var b [BlockHashSize]byte
+	var b [MaxBlockHashSize]byte
 	return func() error {
 		if finished {
 			return io.EOF
@@ -217,8 +257,9 @@ func (self *Patcher) CreateSignatureIterator(src io.Reader, output io.Writer) fu
 			finished = true
 			return io.EOF
 		case nil:
-			bl.Serialize(b[:BlockHashSize])
-			_, err = output.Write(b[:BlockHashSize])
+			sz := 12 + self.rsync.HashSize()
+			bl.Serialize(b[:sz])
+			_, err = output.Write(b[:sz])
 			return err
 		default:
 			return err
@@ -275,7 +316,7 @@ func NewPatcher(expected_input_size int64) (ans *Patcher) {
 	}
 	ans = &Patcher{}
 	ans.rsync.BlockSize = min(bs, MaxBlockSize)
-	ans.rsync.SetHasher(new_xxh3_64)
+	ans.rsync.SetHasher(XXH3.hasher_constructor())
 	ans.rsync.SetChecksummer(new_xxh3_128)
 
 	if ans.rsync.HashBlockSize() > 0 && ans.rsync.HashBlockSize() < ans.rsync.BlockSize {
@@ -285,3 +326,30 @@ func NewPatcher(expected_input_size int64) (ans *Patcher) {
 	ans.expected_input_size_for_signature_generation = sz
 	return
 }
+
+// Set the block size used for the signature, must be called before
+// CreateSignatureIterator(). Larger blocks mean smaller signatures but larger
+// deltas when the data has many scattered changes.
+func (self *Patcher) SetBlockSize(block_size int) error {
+	if block_size < 1 || block_size > MaxBlockSize {
+		return fmt.Errorf("Invalid rsync block size %d, must be between 1 and %d", block_size, MaxBlockSize)
+	}
+	self.rsync.BlockSize = block_size
+	return nil
+}
+
+// Set the strong hash used for the signature, must be called before
+// CreateSignatureIterator()
+func (self *Patcher) SetStrongHashType(strong_hash StrongHashType) error {
+	c := strong_hash.hasher_constructor()
+	if c == nil {
+		return fmt.Errorf("Unknown strong hash type: %d", strong_hash)
+	}
+	self.Strong_hash_type = strong_hash
+	self.rsync.SetHasher(c)
+	return nil
+}
+
+func (self *Patcher) BlockSize() int {
+	return self.rsync.BlockSize
+}
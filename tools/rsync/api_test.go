@@ -20,7 +20,7 @@ import (
 var _ = fmt.Print
 var _ = cmp.Diff
 
-func run_roundtrip_test(t *testing.T, src_data, changed []byte, num_of_patches, total_patch_size int) {
+func run_roundtrip_test(t *testing.T, src_data, changed []byte, num_of_patches, total_patch_size int, configure ...func(*Patcher)) {
 	using_serialization := false
 	t.Helper()
 	prefix_msg := func() string {
@@ -44,7 +44,14 @@ func run_roundtrip_test(t *testing.T, src_data, changed []byte, num_of_patches,
 	}
 
 	// first try just the engine without serialization
-	p := NewPatcher(int64(len(src_data)))
+	new_patcher := func(sz int) *Patcher {
+		p := NewPatcher(int64(sz))
+		for _, c := range configure {
+			c(p)
+		}
+		return p
+	}
+	p := new_patcher(len(src_data))
 	signature := make([]BlockHash, 0, 128)
 	s_it := p.rsync.CreateSignatureIterator(bytes.NewReader(changed))
 	for {
@@ -85,7 +92,7 @@ func run_roundtrip_test(t *testing.T, src_data, changed []byte, num_of_patches,
 
 	// Now try with serialization
 	using_serialization = true
-	p = NewPatcher(int64(len(changed)))
+	p = new_patcher(len(changed))
 	signature_of_changed := bytes.Buffer{}
 	ss_it := p.CreateSignatureIterator(bytes.NewReader(changed), &signature_of_changed)
 	var err error
@@ -194,3 +201,54 @@ func TestRsyncHashers(t *testing.T) {
 		t.Fatalf(diff)
 	}
 }
+
+func TestRsyncStrongHashes(t *testing.T) {
+	block_size := 16
+	src_data := generate_data(block_size, 16)
+	changed := slices.Clone(src_data)
+	num_of_patches, total_patch_size := patch_data(changed, "3:patch1", "16:patch2", "130:ptch3", "176:patch4", "222:XXYY")
+	for _, name := range StrongHashNames() {
+		sht, err := StrongHashTypeFromName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sht.String() != name {
+			t.Fatalf("Incorrect name for strong hash type %d: %s != %s", sht, sht.String(), name)
+		}
+		for _, bs := range []int{7, 16, 64} {
+			configure := func(p *Patcher) {
+				if err := p.SetStrongHashType(sht); err != nil {
+					t.Fatal(err)
+				}
+				if err := p.SetBlockSize(bs); err != nil {
+					t.Fatal(err)
+				}
+			}
+			run_roundtrip_test(t, src_data, changed, num_of_patches, total_patch_size, configure)
+			run_roundtrip_test(t, src_data, changed[:len(changed)-3], num_of_patches, total_patch_size, configure)
+		}
+		p := NewPatcher(int64(len(src_data)))
+		p.SetStrongHashType(sht)
+		p.SetBlockSize(block_size)
+		sig := bytes.Buffer{}
+		it := p.CreateSignatureIterator(bytes.NewReader(src_data), &sig)
+		for it() == nil {
+		}
+		d := NewDiffer()
+		if err := d.AddSignatureData(sig.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.FinishSignatureData(); err != nil {
+			t.Fatal(err)
+		}
+		if d.Strong_hash_type != sht || d.BlockSize() != block_size || len(d.signature) != 16 {
+			t.Fatalf("The signature header was not read correctly for %s: %s %d %d", name, d.Strong_hash_type, d.BlockSize(), len(d.signature))
+		}
+	}
+	if _, err := StrongHashTypeFromName("md5"); err == nil {
+		t.Fatalf("No error for unknown strong hash")
+	}
+	if err := NewPatcher(0).SetBlockSize(MaxBlockSize + 1); err == nil {
+		t.Fatalf("No error for too large block size")
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"kitty/tools/tui/loop"
 	"kitty/tools/tui/subseq"
 	"kitty/tools/utils"
+	"kitty/tools/utils/humanize"
 	"kitty/tools/utils/style"
 
 	"github.com/shirou/gopsutil/v3/process"
@@ -328,6 +329,54 @@ type JSONMetadata struct {
 
 var ErrNoCacheFound = errors.New("No cache found and max cache age is negative")
 
+// StaleCacheError is returned along with the path to the cached copy when
+// updating the cache fails, for instance, because there is no network
+// connection
+type StaleCacheError struct {
+	LastUpdated time.Time
+	Err         error
+}
+
+func (self *StaleCacheError) Error() string {
+	return fmt.Sprintf("Using themes last updated %s as updating them failed with error: %s", humanize.Time(self.LastUpdated), self.Err)
+}
+
+func (self *StaleCacheError) Unwrap() error { return self.Err }
+
+// CacheInfo describes a cached copy of a themes collection
+type CacheInfo struct {
+	Path        string
+	Etag        string
+	LastUpdated time.Time
+	Size        int64
+	NumThemes   int
+}
+
+func read_cache_info(cache_path string) (*CacheInfo, error) {
+	zf, err := zip.OpenReader(cache_path)
+	if err != nil {
+		return nil, err
+	}
+	defer zf.Close()
+	var jm JSONMetadata
+	if err = json.Unmarshal(utils.UnsafeStringToBytes(zf.Comment), &jm); err != nil {
+		return nil, fmt.Errorf("The cache file %s has invalid metadata: %w", cache_path, err)
+	}
+	ans := &CacheInfo{Path: cache_path, Etag: jm.Etag}
+	if ans.LastUpdated, err = utils.ISO8601Parse(jm.Timestamp); err != nil {
+		return nil, fmt.Errorf("The cache file %s has an invalid timestamp: %w", cache_path, err)
+	}
+	if st, err := os.Stat(cache_path); err == nil {
+		ans.Size = st.Size()
+	}
+	for _, f := range zf.File {
+		if path.Ext(f.Name) == ".conf" {
+			ans.NumThemes++
+		}
+	}
+	return ans, nil
+}
+
 func set_comment_in_zip_file(path string, comment string) error {
 	src, err := zip.OpenReader(path)
 	if err != nil {
@@ -357,15 +406,17 @@ func fetch_cached(name, url, cache_path string, max_cache_age time.Duration) (st
 	}
 
 	var jm JSONMetadata
+	var last_updated time.Time
+	have_cache := false
 	if err == nil {
 		defer zf.Close()
 		if err = json.Unmarshal(utils.UnsafeStringToBytes(zf.Comment), &jm); err == nil {
 			if max_cache_age < 0 {
 				return cache_path, nil
 			}
-			cache_age, err := utils.ISO8601Parse(jm.Timestamp)
-			if err == nil {
-				if time.Now().Before(cache_age.Add(max_cache_age)) {
+			if last_updated, err = utils.ISO8601Parse(jm.Timestamp); err == nil {
+				have_cache = true
+				if time.Now().Before(last_updated.Add(max_cache_age)) {
 					return cache_path, nil
 				}
 			}
@@ -374,6 +425,13 @@ func fetch_cached(name, url, cache_path string, max_cache_age time.Duration) (st
 	if max_cache_age < 0 {
 		return "", ErrNoCacheFound
 	}
+	// fall back to the cached copy, if any, when the download fails
+	failed := func(err error) (string, error) {
+		if have_cache {
+			return cache_path, &StaleCacheError{LastUpdated: last_updated, Err: err}
+		}
+		return "", err
+	}
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return "", err
@@ -383,7 +441,7 @@ func fetch_cached(name, url, cache_path string, max_cache_age time.Duration) (st
 	}
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("Failed to download %s with error: %w", url, err)
+		return failed(fmt.Errorf("Failed to download %s with error: %w", url, err))
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
@@ -396,7 +454,7 @@ func fetch_cached(name, url, cache_path string, max_cache_age time.Duration) (st
 			}
 			return cache_path, nil
 		}
-		return "", fmt.Errorf("Failed to download %s with HTTP error: %s", url, resp.Status)
+		return failed(fmt.Errorf("Failed to download %s with HTTP error: %s", url, resp.Status))
 	}
 	var tf, tf2 *os.File
 	tf, err = os.CreateTemp(filepath.Dir(cache_path), name+".temp-*")
@@ -420,11 +478,11 @@ func fetch_cached(name, url, cache_path string, max_cache_age time.Duration) (st
 	}
 	_, err = io.Copy(tf, resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("Failed to download %s with error: %w", url, err)
+		return failed(fmt.Errorf("Failed to download %s with error: %w", url, err))
 	}
 	r, err := zip.OpenReader(tf.Name())
 	if err != nil {
-		return "", fmt.Errorf("Failed to open downloaded zip file with error: %w", err)
+		return failed(fmt.Errorf("Failed to open downloaded zip file with error: %w", err))
 	}
 	defer r.Close()
 	w := zip.NewWriter(tf2)
@@ -453,10 +511,21 @@ func fetch_cached(name, url, cache_path string, max_cache_age time.Duration) (st
 	return cache_path, nil
 }
 
+// FetchCached returns the path to a local copy of the kitty-themes
+// collection, downloading it if the cached copy is older than max_cache_age.
+// If the download fails but an older copy is available, its path is returned
+// along with a *StaleCacheError.
 func FetchCached(max_cache_age time.Duration) (string, error) {
 	return fetch_cached("kitty-themes", "https://codeload.github.com/kovidgoyal/kitty-themes/zip/master", utils.CacheDir(), max_cache_age)
 }
 
+// ReadCacheInfo returns information about the local copy of the
+// kitty-themes collection, returning an error wrapping fs.ErrNotExist if there
+// is no local copy
+func ReadCacheInfo() (*CacheInfo, error) {
+	return read_cache_info(filepath.Join(utils.CacheDir(), "kitty-themes.zip"))
+}
+
 type ThemeMetadata struct {
 	Name         string `json:"name"`
 	Filepath     string `json:"file"`
@@ -536,13 +605,20 @@ func ParseThemeMetadata(path string) (*ThemeMetadata, map[string]string, error)
 	return &ans, settings, nil
 }
 
+type parsed_color struct {
+	color style.RGBA
+	ok    bool
+}
+
 type Theme struct {
 	metadata *ThemeMetadata
 
 	code                        string
 	settings                    map[string]string
+	colors                      map[string]parsed_color
 	zip_reader                  *zip.File
 	is_user_defined             bool
+	is_imported                 bool
 	path_for_user_defined_theme string
 }
 
@@ -551,6 +627,7 @@ func (self *Theme) Author() string      { return self.metadata.Author }
 func (self *Theme) Blurb() string       { return self.metadata.Blurb }
 func (self *Theme) IsDark() bool        { return self.metadata.Is_dark }
 func (self *Theme) IsUserDefined() bool { return self.is_user_defined }
+func (self *Theme) IsImported() bool    { return self.is_imported }
 
 func (self *Theme) load_code() (string, error) {
 	if self.zip_reader != nil {
@@ -660,7 +737,9 @@ func (self *Theme) SaveInDir(dirpath string) (err error) {
 }
 
 func (self *Theme) SaveInConf(config_dir, reload_in, config_file_name string) (err error) {
-	_ = os.MkdirAll(config_dir, 0o755)
+	if err = os.MkdirAll(config_dir, 0o755); err != nil {
+		return err
+	}
 	path := filepath.Join(config_dir, `current-theme.conf`)
 	code, err := self.Code()
 	if err != nil {
@@ -693,8 +772,26 @@ func (self *Theme) SaveInConf(config_dir, reload_in, config_file_name string) (e
 	return
 }
 
+// SaveAsAutoTheme saves the theme as the one kitty uses automatically when
+// the OS color scheme is the specified one of dark, light or no-preference
+func (self *Theme) SaveAsAutoTheme(config_dir, color_scheme, reload_in string) (err error) {
+	if err = os.MkdirAll(config_dir, 0o755); err != nil {
+		return err
+	}
+	code, err := self.Code()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(config_dir, color_scheme+"-theme.auto.conf")
+	if err = utils.AtomicUpdateFile(path, utils.UnsafeStringToBytes(code), 0o644); err != nil {
+		return err
+	}
+	reload_config(ReloadDestination(reload_in))
+	return
+}
+
 func (self *Theme) Settings() (map[string]string, error) {
-	if self.zip_reader != nil {
+	if self.settings == nil {
 		code, err := self.load_code()
 		if err != nil {
 			return nil, err
@@ -714,6 +811,25 @@ func (self *Theme) Settings() (map[string]string, error) {
 	return self.settings, nil
 }
 
+// Color returns the value of the specified color setting, falling back to the
+// kitty default value if it is not set. Colors are parsed only once, as they
+// are used repeatedly when searching for themes by their colors.
+func (self *Theme) Color(key string) (style.RGBA, bool) {
+	if pc, found := self.colors[key]; found {
+		return pc.color, pc.ok
+	}
+	settings, err := self.Settings()
+	if err != nil {
+		return style.RGBA{}, false
+	}
+	if self.colors == nil {
+		self.colors = make(map[string]parsed_color, 32)
+	}
+	c, ok := ColorWithDefault(settings, key)
+	self.colors[key] = parsed_color{c, ok}
+	return c, ok
+}
+
 func (self *Theme) AsEscapeCodes() (string, error) {
 	settings, err := self.Settings()
 	if err != nil {
@@ -777,13 +893,43 @@ func ColorSettingsAsEscapeCodes(settings map[string]string) string {
 	return w.String()
 }
 
+func (self *Theme) AsRCColors() (map[string]any, error) {
+	settings, err := self.Settings()
+	if err != nil {
+		return nil, err
+	}
+	return ColorSettingsAsRCColors(settings), nil
+}
+
+// ColorSettingsAsRCColors converts color settings into the form used by the
+// set-colors remote control command
+func ColorSettingsAsRCColors(settings map[string]string) map[string]any {
+	ans := make(map[string]any, len(settings))
+	for key, val := range settings {
+		if !AllColorSettingNames[key] {
+			continue
+		}
+		if val == "none" {
+			ans[key] = nil
+		} else if rgba, err := style.ParseColor(val); err == nil {
+			ans[key] = rgba.AsRGB()
+		}
+	}
+	return ans
+}
+
 type Themes struct {
-	name_map  map[string]*Theme
-	index_map []string
+	name_map    map[string]*Theme
+	index_map   []string
+	stale_cache *StaleCacheError
 }
 
+// StaleCache returns a non-nil error if these themes were loaded from an
+// outdated cache because updating the cache failed
+func (self *Themes) StaleCache() *StaleCacheError { return self.stale_cache }
+
 func (self *Themes) Copy() *Themes {
-	ans := &Themes{name_map: make(map[string]*Theme, len(self.name_map)), index_map: slices.Clone(self.index_map)}
+	ans := &Themes{name_map: make(map[string]*Theme, len(self.name_map)), index_map: slices.Clone(self.index_map), stale_cache: self.stale_cache}
 	maps.Copy(ans.name_map, self.name_map)
 	return ans
 }
@@ -815,7 +961,7 @@ func (self *Themes) create_index_map() {
 
 func (self *Themes) Filtered(is_ok func(*Theme) bool) *Themes {
 	themes := utils.Filter(maps.Values(self.name_map), is_ok)
-	ans := Themes{name_map: make(map[string]*Theme, len(themes))}
+	ans := Themes{name_map: make(map[string]*Theme, len(themes)), stale_cache: self.stale_cache}
 	for _, theme := range themes {
 		ans.name_map[theme.metadata.Name] = theme
 	}
@@ -833,6 +979,9 @@ func (self *Themes) AddFromFile(path string) (*Theme, error) {
 	}
 	t := Theme{metadata: m, is_user_defined: true, settings: conf, path_for_user_defined_theme: path}
 	self.name_map[m.Name] = &t
+	if self.index_map != nil {
+		self.create_index_map()
+	}
 	return &t, nil
 
 }
@@ -856,6 +1005,10 @@ func (self *Themes) add_from_dir(dirpath string) error {
 			if _, err = self.AddFromFile(path); err != nil {
 				return err
 			}
+		} else if !e.IsDir() && is_importable_file(e.Name()) {
+			// ignore files that are not valid color schemes, as they could
+			// be any YAML file, for instance
+			_, _ = self.AddFromImportedFile(filepath.Join(dirpath, e.Name()))
 		}
 	}
 	return nil
@@ -934,11 +1087,22 @@ const (
 	MARK_AFTER  = "\033[39m"
 )
 
+// ApplySearch restricts this collection to themes matching expression,
+// returning their names with the matched characters marked. The expression can
+// contain terms such as bg:dark or saturation:<30 to filter themes by their
+// colors, the rest of the expression is matched against theme names.
 func (self *Themes) ApplySearch(expression string, marks ...string) []string {
 	mark_before, mark_after := MARK_BEFORE, MARK_AFTER
 	if len(marks) == 2 {
 		mark_before, mark_after = marks[0], marks[1]
 	}
+	filters, expression := parse_search_expression(expression)
+	if len(filters) > 0 {
+		self.apply_color_filters(filters)
+	}
+	if expression == "" {
+		return slices.Clone(self.index_map)
+	}
 	results := utils.Filter(match(expression, self.index_map), func(x *subseq.Match) bool { return x.Score > 0 })
 	name_map := make(map[string]*Theme, len(results))
 	for _, m := range results {
@@ -960,17 +1124,54 @@ func (self *Themes) ApplySearch(expression string, marks ...string) []string {
 	return ans
 }
 
-func LoadThemes(cache_age time.Duration) (ans *Themes, closer io.Closer, err error) {
+// UserThemeDirs returns the directories that are searched for user defined
+// themes. Themes in later directories override themes with the same name in
+// earlier ones.
+func UserThemeDirs(extra_dirs ...string) []string {
+	ans := []string{filepath.Join(utils.ConfigDir(), "themes")}
+	for _, x := range extra_dirs {
+		ans = append(ans, utils.Expanduser(x))
+	}
+	return ans
+}
+
+// UserThemesSignature returns a string that changes whenever a theme file in
+// any of the specified directories is added, removed or modified
+func UserThemesSignature(dirs ...string) string {
+	buf := strings.Builder{}
+	for _, dirpath := range dirs {
+		entries, err := os.ReadDir(dirpath)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if e.IsDir() || !(strings.HasSuffix(e.Name(), ".conf") || is_importable_file(e.Name())) {
+				continue
+			}
+			if info, err := e.Info(); err == nil {
+				fmt.Fprintf(&buf, "%s\x00%s\x00%d\x00%d\n", dirpath, e.Name(), info.Size(), info.ModTime().UnixNano())
+			}
+		}
+	}
+	return buf.String()
+}
+
+// LoadThemes loads the themes from the cached kitty-themes collection along
+// with user defined themes from the kitty config directory and extra_dirs
+func LoadThemes(cache_age time.Duration, extra_dirs ...string) (ans *Themes, closer io.Closer, err error) {
 	zip_path, err := FetchCached(cache_age)
 	ans = &Themes{name_map: make(map[string]*Theme)}
-	if err != nil {
+	if err != nil && !errors.As(err, &ans.stale_cache) {
 		return nil, nil, err
 	}
 	if closer, err = ans.add_from_zip_file(zip_path); err != nil {
 		return nil, nil, err
 	}
-	if err = ans.add_from_dir(filepath.Join(utils.ConfigDir(), "themes")); err != nil {
-		return nil, nil, err
+	for _, dirpath := range UserThemeDirs(extra_dirs...) {
+		if err = ans.add_from_dir(dirpath); err != nil {
+			closer.Close()
+			return nil, nil, err
+		}
 	}
 	ans.create_index_map()
 	return ans, closer, nil
@@ -6,6 +6,7 @@ import (
 	"archive/zip"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -54,6 +55,20 @@ func TestThemeCollections(t *testing.T) {
 	pt(ThemeMetadata{Name: "XYZ", Blurb: "a b", Author: "A", Num_settings: 2},
 		"# some crap", " ", "## ", "## author: A", "## name: XYZ", "## blurb: a", "## b", "", "color red", "background black", "include inc.conf")
 
+	sig := UserThemesSignature(tdir)
+	if err := os.WriteFile(filepath.Join(tdir, "ignored.txt"), []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if q := UserThemesSignature(tdir); q != sig {
+		t.Fatalf("Theme signature changed on adding a non-theme file")
+	}
+	if err := os.WriteFile(filepath.Join(tdir, "inc.conf"), []byte("background black"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if q := UserThemesSignature(tdir); q == sig {
+		t.Fatalf("Theme signature not changed on modifying a theme file")
+	}
+
 	buf := bytes.Buffer{}
 	zw := zip.NewWriter(&buf)
 	fw, _ := zw.Create("x/themes.json")
@@ -144,6 +159,21 @@ func TestThemeCollections(t *testing.T) {
 	if send_count != 2 {
 		t.Fatalf("Cached zip file was incorrectly not re-downloaded. %d", send_count)
 	}
+	ci, err := read_cache_info(filepath.Join(tdir, "test.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.Etag != `"xxx"` || ci.NumThemes != 2 || time.Since(ci.LastUpdated) > time.Minute {
+		t.Fatalf("Incorrect cache info: %#v", ci)
+	}
+	ts.Close()
+	var sc *StaleCacheError
+	if p, err := fetch_cached("test", ts.URL, tdir, 0); !errors.As(err, &sc) || p != filepath.Join(tdir, "test.zip") {
+		t.Fatalf("Did not fall back to the cached zip file when offline: %#v %s", p, err)
+	}
+	if _, err = fetch_cached("missing", ts.URL, tdir, 0); err == nil || errors.As(err, &sc) {
+		t.Fatalf("Did not fail when offline with no cached zip file: %s", err)
+	}
 	coll := Themes{name_map: map[string]*Theme{}}
 	closer, err := coll.add_from_zip_file(filepath.Join(tdir, "test.zip"))
 	if err != nil {
@@ -162,4 +192,28 @@ func TestThemeCollections(t *testing.T) {
 		}
 		t.Fatal("failed to load code for alabaster theme")
 	}
+	coll.stale_cache = &StaleCacheError{}
+	if coll.Copy().StaleCache() == nil || coll.Filtered(func(*Theme) bool { return true }).StaleCache() == nil {
+		t.Fatal("Copies of the collection do not indicate the cache is stale")
+	}
+}
+
+func TestThemeSaveAsAutoTheme(t *testing.T) {
+	tdir := t.TempDir()
+	theme := Theme{code: "foreground #ffffff"}
+	config_dir := filepath.Join(tdir, "kitty")
+	if err := theme.SaveAsAutoTheme(config_dir, "dark", "none"); err != nil {
+		t.Fatal(err)
+	}
+	if raw, err := os.ReadFile(filepath.Join(config_dir, "dark-theme.auto.conf")); err != nil || string(raw) != theme.code {
+		t.Fatalf("Auto theme not saved: %#v %v", string(raw), err)
+	}
+	// errors creating the config directory are reported
+	not_a_dir := filepath.Join(tdir, "file")
+	if err := os.WriteFile(not_a_dir, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := theme.SaveAsAutoTheme(filepath.Join(not_a_dir, "kitty"), "light", "none"); err == nil {
+		t.Fatalf("Failure to create the config directory not reported")
+	}
 }
@@ -0,0 +1,82 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package themes
+
+import (
+	"fmt"
+	"strconv"
+
+	"kitty/tools/utils/style"
+)
+
+var _ = fmt.Print
+
+// Minimum contrast ratios from WCAG 2 for normal text at levels AA and AAA
+// and for large text at level AA
+const (
+	CONTRAST_AAA      = 7.0
+	CONTRAST_AA       = 4.5
+	CONTRAST_AA_LARGE = 3.0
+)
+
+type ContrastReport struct {
+	// The contrast ratio between the foreground and background colors
+	Foreground float64
+	// The contrast ratio of each of the sixteen basic colors against the background
+	Palette [16]float64
+}
+
+// ContrastLevel returns a WCAG 2 compliance level for the specified contrast ratio
+func ContrastLevel(ratio float64) string {
+	switch {
+	case ratio >= CONTRAST_AAA:
+		return "AAA"
+	case ratio >= CONTRAST_AA:
+		return "AA"
+	case ratio >= CONTRAST_AA_LARGE:
+		return "AA large"
+	}
+	return "fail"
+}
+
+// Low returns the names of the basic colors whose contrast against the
+// background is less than the specified ratio. color0 and color8 are ignored
+// as they are commonly meant to be close to the background.
+func (self *ContrastReport) Low(ratio float64) (ans []string) {
+	for i, r := range self.Palette {
+		if i != 0 && i != 8 && r < ratio {
+			ans = append(ans, "color"+strconv.Itoa(i))
+		}
+	}
+	return
+}
+
+// IsHighContrast is true if the foreground meets WCAG AAA and all basic colors
+// other than color0 and color8 meet WCAG AA for large text
+func (self *ContrastReport) IsHighContrast() bool {
+	return self.Foreground >= CONTRAST_AAA && len(self.Low(CONTRAST_AA_LARGE)) == 0
+}
+
+func ContrastReportForSettings(settings map[string]string) (ans ContrastReport) {
+	return contrast_report(func(key string) (style.RGBA, bool) { return ColorWithDefault(settings, key) })
+}
+
+func contrast_report(color func(string) (style.RGBA, bool)) (ans ContrastReport) {
+	bg, _ := color("background")
+	fg, _ := color("foreground")
+	ans.Foreground = style.ContrastRatio(fg, bg)
+	for i := range ans.Palette {
+		c, _ := color("color" + strconv.Itoa(i))
+		ans.Palette[i] = style.ContrastRatio(c, bg)
+	}
+	return
+}
+
+// ContrastReport returns the WCAG 2 contrast ratios of the colors in this
+// theme, colors not set by the theme use the kitty defaults
+func (self *Theme) ContrastReport() (ContrastReport, error) {
+	if _, err := self.Settings(); err != nil {
+		return ContrastReport{}, err
+	}
+	return contrast_report(self.Color), nil
+}
@@ -0,0 +1,207 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package themes
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"kitty/tools/utils/style"
+
+	"howett.net/plist"
+)
+
+var _ = fmt.Print
+
+var ansi_color_names = [8]string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// ColorWithDefault returns the value of the specified color setting, falling
+// back to the kitty default value if it is not present in settings
+func ColorWithDefault(settings map[string]string, key string) (style.RGBA, bool) {
+	if val, found := settings[key]; found {
+		c, err := style.ParseColor(val)
+		return c, err == nil
+	}
+	var defval string
+	switch key {
+	case "foreground":
+		defval = style.DefaultColors.Foreground
+	case "background":
+		defval = style.DefaultColors.Background
+	case "cursor":
+		defval = style.DefaultColors.Cursor
+	case "selection_foreground":
+		defval = style.DefaultColors.SelectionFg
+	case "selection_background":
+		defval = style.DefaultColors.SelectionBg
+	case "cursor_text_color":
+		defval = "#111111"
+	default:
+		if idx, err := strconv.Atoi(strings.TrimPrefix(key, "color")); err == nil && idx >= 0 && idx < 256 {
+			ans := style.RGBA{}
+			ans.FromRGB(style.ColorTable[idx])
+			return ans, true
+		}
+	}
+	if c, err := style.ParseColor(defval); err == nil {
+		return c, true
+	}
+	return style.RGBA{}, false
+}
+
+// Colors that are not set to a color value, such as none, are empty and are
+// not exported, so that the exported theme uses the defaults of the target
+type export_colors struct {
+	foreground, background, cursor, cursor_text, selection_fg, selection_bg string
+	palette                                                                 [16]string
+}
+
+func resolve_export_colors(settings map[string]string) (ans export_colors) {
+	c := func(key string) string {
+		if col, ok := ColorWithDefault(settings, key); ok {
+			return col.AsRGBSharp()
+		}
+		return ""
+	}
+	ans.foreground, ans.background, ans.cursor = c("foreground"), c("background"), c("cursor")
+	ans.cursor_text, ans.selection_fg, ans.selection_bg = c("cursor_text_color"), c("selection_foreground"), c("selection_background")
+	for i := range ans.palette {
+		ans.palette[i] = c("color" + strconv.Itoa(i))
+	}
+	return
+}
+
+func export_alacritty(name string, c export_colors) (string, error) {
+	lines := []string{"# " + name, "", "[colors.primary]"}
+	a := func(key, val string) {
+		if val != "" {
+			lines = append(lines, fmt.Sprintf("%s = %#v", key, val))
+		}
+	}
+	a("background", c.background)
+	a("foreground", c.foreground)
+	lines = append(lines, "", "[colors.cursor]")
+	a("text", c.cursor_text)
+	a("cursor", c.cursor)
+	lines = append(lines, "", "[colors.selection]")
+	a("text", c.selection_fg)
+	a("background", c.selection_bg)
+	for i, section := range []string{"normal", "bright"} {
+		lines = append(lines, "", "[colors."+section+"]")
+		for j, cname := range ansi_color_names {
+			a(cname, c.palette[i*8+j])
+		}
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+func export_wezterm(name, author string, c export_colors) (string, error) {
+	lines := []string{"[colors]"}
+	a := func(key, val string) {
+		if val != "" {
+			lines = append(lines, fmt.Sprintf("%s = %#v", key, val))
+		}
+	}
+	a("foreground", c.foreground)
+	a("background", c.background)
+	a("cursor_bg", c.cursor)
+	a("cursor_border", c.cursor)
+	a("cursor_fg", c.cursor_text)
+	a("selection_bg", c.selection_bg)
+	a("selection_fg", c.selection_fg)
+	quoted := func(x []string) string {
+		q := make([]string, len(x))
+		for i, v := range x {
+			q[i] = fmt.Sprintf("%#v", v)
+		}
+		return "[" + strings.Join(q, ", ") + "]"
+	}
+	lines = append(lines, "ansi = "+quoted(c.palette[:8]), "brights = "+quoted(c.palette[8:]), "", "[metadata]")
+	a("name", name)
+	if author != "" {
+		a("author", author)
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+type iterm2_color struct {
+	ColorSpace string  `plist:"Color Space"`
+	Red        float64 `plist:"Red Component"`
+	Green      float64 `plist:"Green Component"`
+	Blue       float64 `plist:"Blue Component"`
+	Alpha      float64 `plist:"Alpha Component"`
+}
+
+func new_iterm2_color(sharp string) iterm2_color {
+	c, _ := style.ParseColor(sharp)
+	return iterm2_color{ColorSpace: "sRGB", Red: float64(c.Red) / 255, Green: float64(c.Green) / 255, Blue: float64(c.Blue) / 255, Alpha: 1}
+}
+
+func export_iterm2(c export_colors) (string, error) {
+	d := map[string]iterm2_color{}
+	a := func(key, val string) {
+		if val != "" {
+			d[key] = new_iterm2_color(val)
+		}
+	}
+	a("Foreground Color", c.foreground)
+	a("Background Color", c.background)
+	a("Bold Color", c.foreground)
+	a("Cursor Color", c.cursor)
+	a("Cursor Text Color", c.cursor_text)
+	a("Selected Text Color", c.selection_fg)
+	a("Selection Color", c.selection_bg)
+	for i, x := range c.palette {
+		a(fmt.Sprintf("Ansi %d Color", i), x)
+	}
+	raw, err := plist.MarshalIndent(d, plist.XMLFormat, "\t")
+	if err != nil {
+		return "", err
+	}
+	return string(raw) + "\n", nil
+}
+
+func export_windows_terminal(name string, c export_colors) (string, error) {
+	m := map[string]string{"name": name}
+	a := func(key, val string) {
+		if val != "" {
+			m[key] = val
+		}
+	}
+	a("background", c.background)
+	a("foreground", c.foreground)
+	a("cursorColor", c.cursor)
+	a("selectionBackground", c.selection_bg)
+	for i, cname := range [8]string{"black", "red", "green", "yellow", "blue", "purple", "cyan", "white"} {
+		a(cname, c.palette[i])
+		a("bright"+strings.ToUpper(cname[:1])+cname[1:], c.palette[i+8])
+	}
+	raw, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return "", err
+	}
+	return string(raw) + "\n", nil
+}
+
+// Export returns the colors of this theme in the format used by the specified
+// terminal emulator. Colors not set by the theme use the kitty defaults.
+func (self *Theme) Export(format string) (string, error) {
+	settings, err := self.Settings()
+	if err != nil {
+		return "", err
+	}
+	c := resolve_export_colors(settings)
+	switch format {
+	case "alacritty":
+		return export_alacritty(self.Name(), c)
+	case "wezterm":
+		return export_wezterm(self.Name(), self.Author(), c)
+	case "iterm2":
+		return export_iterm2(c)
+	case "windows-terminal":
+		return export_windows_terminal(self.Name(), c)
+	}
+	return "", fmt.Errorf("Unknown export format: %s", format)
+}
@@ -0,0 +1,65 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package themes
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"howett.net/plist"
+)
+
+var _ = fmt.Print
+
+func TestThemeExport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.conf")
+	if err := os.WriteFile(path, []byte("## name: Test\nforeground #eeeeee\nbackground #1e1e2e\ncolor1 #ff0000\ncolor12 #0000ff\nselection_foreground none\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	theme, err := ThemeFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := func(format string) string {
+		ans, err := theme.Export(format)
+		if err != nil {
+			t.Fatalf("Exporting to %s failed with error: %s", format, err)
+		}
+		return ans
+	}
+	for _, x := range []string{`background = "#1e1e2e"`, `red = "#ff0000"`, `blue = "#0000ff"`, "[colors.bright]"} {
+		if q := export("alacritty"); !strings.Contains(q, x) {
+			t.Fatalf("alacritty export does not contain %#v:\n%s", x, q)
+		}
+	}
+	if q := export("alacritty"); !strings.Contains(q, "[colors.selection]\nbackground = ") {
+		t.Fatalf("alacritty export contains the selection foreground color set to none:\n%s", q)
+	}
+	if q := export("wezterm"); !strings.Contains(q, `name = "Test"`) || !strings.Contains(q, `"#ff0000"`) {
+		t.Fatalf("Unexpected wezterm export:\n%s", q)
+	}
+	var wt map[string]string
+	if err = json.Unmarshal([]byte(export("windows-terminal")), &wt); err != nil {
+		t.Fatal(err)
+	}
+	if wt["name"] != "Test" || wt["red"] != "#ff0000" || wt["brightBlue"] != "#0000ff" || wt["foreground"] != "#eeeeee" {
+		t.Fatalf("Unexpected windows terminal export: %#v", wt)
+	}
+	var it map[string]map[string]any
+	if _, err = plist.Unmarshal([]byte(export("iterm2")), &it); err != nil {
+		t.Fatal(err)
+	}
+	if r := it["Ansi 1 Color"]["Red Component"]; r != 1.0 {
+		t.Fatalf("Unexpected iterm2 export: %#v", it["Ansi 1 Color"])
+	}
+	if _, found := it["Selected Text Color"]; found {
+		t.Fatalf("iterm2 export contains the selection foreground color set to none")
+	}
+	if _, err = theme.Export("xxx"); err == nil {
+		t.Fatalf("Exporting to unknown format did not fail")
+	}
+}
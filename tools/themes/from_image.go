@@ -0,0 +1,229 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package themes
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"path/filepath"
+	"strconv"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/images"
+	"kitty/tools/utils/style"
+
+	"github.com/kovidgoyal/imaging"
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+type color_cluster struct {
+	r, g, b float64
+	count   int
+}
+
+func (self color_cluster) rgba() style.RGBA {
+	return style.RGBA{Red: uint8(math.Round(self.r)), Green: uint8(math.Round(self.g)), Blue: uint8(math.Round(self.b))}
+}
+
+// Find the dominant colors in the image using k-means clustering. The
+// clusters are initialized from pixels evenly spaced by lightness so that the
+// result is deterministic.
+func dominant_colors(img image.Image, k int) []color_cluster {
+	img = imaging.Fit(img, 64, 64, imaging.Box)
+	b := img.Bounds()
+	pixels := make([][3]float64, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			// un-premultiply and convert to 8-bit
+			f := 255. / float64(a)
+			pixels = append(pixels, [3]float64{float64(r) * f, float64(g) * f, float64(bl) * f})
+		}
+	}
+	if len(pixels) == 0 {
+		return nil
+	}
+	lightness := func(p [3]float64) float64 { return 0.299*p[0] + 0.587*p[1] + 0.114*p[2] }
+	sorted := slices.Clone(pixels)
+	slices.SortStableFunc(sorted, func(a, b [3]float64) int {
+		la, lb := lightness(a), lightness(b)
+		switch {
+		case la < lb:
+			return -1
+		case la > lb:
+			return 1
+		}
+		return 0
+	})
+	k = utils.Min(k, len(pixels))
+	centers := make([][3]float64, k)
+	for i := range centers {
+		centers[i] = sorted[(2*i+1)*len(sorted)/(2*k)]
+	}
+	assignments := make([]int, len(pixels))
+	for iteration := 0; iteration < 16; iteration++ {
+		changed := false
+		for i, p := range pixels {
+			best, best_dist := 0, math.MaxFloat64
+			for c, center := range centers {
+				dr, dg, db := p[0]-center[0], p[1]-center[1], p[2]-center[2]
+				if d := dr*dr + dg*dg + db*db; d < best_dist {
+					best, best_dist = c, d
+				}
+			}
+			if assignments[i] != best || iteration == 0 {
+				assignments[i] = best
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+		sums := make([][4]float64, k)
+		for i, p := range pixels {
+			s := &sums[assignments[i]]
+			s[0] += p[0]
+			s[1] += p[1]
+			s[2] += p[2]
+			s[3]++
+		}
+		for c, s := range sums {
+			if s[3] > 0 {
+				centers[c] = [3]float64{s[0] / s[3], s[1] / s[3], s[2] / s[3]}
+			}
+		}
+	}
+	ans := make([]color_cluster, k)
+	for c, center := range centers {
+		ans[c] = color_cluster{r: center[0], g: center[1], b: center[2]}
+	}
+	for _, a := range assignments {
+		ans[a].count++
+	}
+	ans = slices.DeleteFunc(ans, func(c color_cluster) bool { return c.count == 0 })
+	slices.SortStableFunc(ans, func(a, b color_cluster) int { return b.count - a.count })
+	return ans
+}
+
+func hue_distance(a, b float64) float64 {
+	d := math.Abs(a - b)
+	return math.Min(d, 360-d)
+}
+
+// Adjust the lightness of c until it has at least the specified contrast
+// against bg
+func ensure_contrast(c, bg style.RGBA, ratio float64, is_dark bool) style.RGBA {
+	h, s, l := c.AsHSL()
+	for style.ContrastRatio(c, bg) < ratio && l > 0 && l < 1 {
+		if is_dark {
+			l += 0.02
+		} else {
+			l -= 0.02
+		}
+		c = style.RGBAFromHSL(h, s, l)
+	}
+	return c
+}
+
+func settings_from_dominant_colors(clusters []color_cluster) map[string]string {
+	total, mean_lightness := 0, 0.
+	for _, c := range clusters {
+		_, _, l := c.rgba().AsHSL()
+		mean_lightness += l * float64(c.count)
+		total += c.count
+	}
+	is_dark := total == 0 || mean_lightness/float64(total) < 0.5
+	// the background is the most common color of the right lightness, toned down
+	bg := style.RGBA{}
+	if !is_dark {
+		bg = style.RGBA{Red: 255, Green: 255, Blue: 255}
+	}
+	for _, c := range clusters {
+		if _, _, l := c.rgba().AsHSL(); (l < 0.5) == is_dark {
+			bg = c.rgba()
+			break
+		}
+	}
+	bh, bs, bl := bg.AsHSL()
+	bs = math.Min(bs, 0.4)
+	if is_dark {
+		bl = math.Min(bl, 0.12)
+	} else {
+		bl = math.Max(bl, 0.92)
+	}
+	bg = style.RGBAFromHSL(bh, bs, bl)
+	gray := func(l float64) string { return style.RGBAFromHSL(bh, math.Min(bs, 0.15), l).AsRGBSharp() }
+	ans := map[string]string{"background": bg.AsRGBSharp()}
+	if is_dark {
+		ans["foreground"] = gray(0.85)
+		ans["color0"], ans["color8"], ans["color7"], ans["color15"] = gray(0.2), gray(0.45), gray(0.75), gray(0.95)
+	} else {
+		ans["foreground"] = gray(0.2)
+		ans["color0"], ans["color8"], ans["color7"], ans["color15"] = gray(0.15), gray(0.4), gray(0.65), gray(0.85)
+	}
+	ans["cursor"] = ans["foreground"]
+	ans["selection_foreground"], ans["selection_background"] = ans["background"], ans["foreground"]
+
+	// map the saturated colors from the image onto the nearest ANSI hues,
+	// synthesizing the hues not present in the image
+	type hsl struct{ h, s float64 }
+	saturated := []hsl{}
+	mean_saturation := 0.
+	for _, c := range clusters {
+		if h, s, _ := c.rgba().AsHSL(); s > 0.25 {
+			saturated = append(saturated, hsl{h, s})
+			mean_saturation += s
+		}
+	}
+	if len(saturated) > 0 {
+		mean_saturation /= float64(len(saturated))
+	} else {
+		mean_saturation = 0.6
+	}
+	for i, target := range [6]float64{0, 120, 60, 240, 300, 180} {
+		h, s := target, mean_saturation
+		best := 30.
+		for _, c := range saturated {
+			if d := hue_distance(c.h, target); d <= best {
+				h, s, best = c.h, c.s, d
+			}
+		}
+		s = math.Max(0.35, math.Min(s, 0.85))
+		normal, bright := 0.62, 0.72
+		if !is_dark {
+			normal, bright = 0.4, 0.32
+		}
+		ans["color"+strconv.Itoa(i+1)] = ensure_contrast(style.RGBAFromHSL(h, s, normal), bg, CONTRAST_AA, is_dark).AsRGBSharp()
+		ans["color"+strconv.Itoa(i+9)] = ensure_contrast(style.RGBAFromHSL(h, s, bright), bg, CONTRAST_AA, is_dark).AsRGBSharp()
+	}
+	return ans
+}
+
+// SettingsFromImage generates a theme from the dominant colors of the
+// specified image, returning its metadata and color settings
+func SettingsFromImage(path string) (*ThemeMetadata, map[string]string, error) {
+	img, err := images.OpenImageFromPath(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(img.Frames) == 0 {
+		return nil, nil, fmt.Errorf("The image %s has no frames", path)
+	}
+	clusters := dominant_colors(img.Frames[0].Img, 12)
+	if len(clusters) == 0 {
+		return nil, nil, fmt.Errorf("The image %s has no opaque pixels", path)
+	}
+	settings := settings_from_dominant_colors(clusters)
+	bg, _ := style.ParseColor(settings["background"])
+	m := &ThemeMetadata{
+		Name: ThemeNameFromFileName(filepath.Base(path)), Is_dark: is_dark_color(bg), Num_settings: len(settings),
+		Blurb: "Generated from the image: " + filepath.Base(path),
+	}
+	return m, settings, nil
+}
@@ -0,0 +1,58 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package themes
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"testing"
+
+	"kitty/tools/utils/style"
+)
+
+var _ = fmt.Print
+
+func TestThemeFromImage(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.NRGBA{R: 0x10, G: 0x18, B: 0x30, A: 255}
+			switch {
+			case x < 4:
+				c = color.NRGBA{R: 0xe0, G: 0x30, B: 0x30, A: 255}
+			case x < 8:
+				c = color.NRGBA{R: 0x30, G: 0x40, B: 0xe0, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	clusters := dominant_colors(img, 4)
+	if len(clusters) != 3 {
+		t.Fatalf("Incorrect number of dominant colors: %d", len(clusters))
+	}
+	if c := clusters[0].rgba(); c != (style.RGBA{Red: 0x10, Green: 0x18, Blue: 0x30}) {
+		t.Fatalf("Incorrect most dominant color: %s", c.AsRGBSharp())
+	}
+	settings := settings_from_dominant_colors(clusters)
+	bg, _ := style.ParseColor(settings["background"])
+	if !is_dark_color(bg) {
+		t.Fatalf("Background is not dark: %s", bg.AsRGBSharp())
+	}
+	for _, key := range []string{"foreground", "color1", "color2", "color4", "color9"} {
+		c, _ := style.ParseColor(settings[key])
+		if r := style.ContrastRatio(c, bg); r < CONTRAST_AA {
+			t.Fatalf("Insufficient contrast for %s (%s): %f", key, c.AsRGBSharp(), r)
+		}
+	}
+	for i := 0; i < 16; i++ {
+		if settings["color"+strconv.Itoa(i)] == "" {
+			t.Fatalf("color%d not set", i)
+		}
+	}
+	red, _ := style.ParseColor(settings["color1"])
+	if h, _, _ := red.AsHSL(); hue_distance(h, 0) > 1 {
+		t.Fatalf("Red not taken from the image: %s", red.AsRGBSharp())
+	}
+}
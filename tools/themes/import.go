@@ -0,0 +1,239 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package themes
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/style"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"howett.net/plist"
+)
+
+var _ = fmt.Print
+
+func setting_sort_key(key string) string {
+	for i, x := range []string{"foreground", "background", "cursor", "cursor_text_color", "selection_foreground", "selection_background"} {
+		if key == x {
+			return fmt.Sprintf("0%d", i)
+		}
+	}
+	if n, err := strconv.Atoi(strings.TrimPrefix(key, "color")); err == nil {
+		return fmt.Sprintf("1%03d", n)
+	}
+	return "2" + key
+}
+
+// SettingsAsConf returns a kitty theme file with the specified metadata and
+// color settings
+func SettingsAsConf(name, blurb string, settings map[string]string) string {
+	lines := []string{"## name: " + name}
+	if blurb != "" {
+		lines = append(lines, "## blurb: "+blurb)
+	}
+	lines = append(lines, "")
+	keys := utils.SortWithKey(maps.Keys(settings), setting_sort_key)
+	for _, key := range keys {
+		lines = append(lines, key+" "+settings[key])
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+var import_extensions = []string{".itermcolors", ".yaml", ".yml", ".xresources"}
+
+func is_importable_file(name string) bool {
+	return slices.Contains(import_extensions, strings.ToLower(filepath.Ext(name))) || strings.EqualFold(name, "Xresources")
+}
+
+func import_iterm2(raw []byte) (name string, settings map[string]string, err error) {
+	var data map[string]struct {
+		Red   float64 `plist:"Red Component"`
+		Green float64 `plist:"Green Component"`
+		Blue  float64 `plist:"Blue Component"`
+	}
+	if _, err = plist.Unmarshal(raw, &data); err != nil {
+		return
+	}
+	keys := map[string]string{
+		"Foreground Color": "foreground", "Background Color": "background", "Cursor Color": "cursor",
+		"Cursor Text Color": "cursor_text_color", "Selected Text Color": "selection_foreground",
+		"Selection Color": "selection_background",
+	}
+	settings = make(map[string]string, len(data))
+	to_byte := func(x float64) uint8 { return uint8(math.Round(math.Max(0, math.Min(x, 1)) * 255)) }
+	for k, c := range data {
+		key := keys[k]
+		if key == "" {
+			var n int
+			if _, serr := fmt.Sscanf(k, "Ansi %d Color", &n); serr != nil || n < 0 || n > 255 {
+				continue
+			}
+			key = "color" + strconv.Itoa(n)
+		}
+		settings[key] = style.RGBA{Red: to_byte(c.Red), Green: to_byte(c.Green), Blue: to_byte(c.Blue)}.AsRGBSharp()
+	}
+	return
+}
+
+// The mapping used by the base16 kitty template
+var base16_mapping = map[string]string{
+	"background": "base00", "foreground": "base05", "cursor": "base05", "cursor_text_color": "base00",
+	"selection_background": "base05", "selection_foreground": "base00", "url_color": "base04",
+	"active_border_color": "base03", "inactive_border_color": "base01",
+	"active_tab_background": "base00", "active_tab_foreground": "base05",
+	"inactive_tab_background": "base01", "inactive_tab_foreground": "base04", "tab_bar_background": "base01",
+	"color0": "base00", "color1": "base08", "color2": "base0B", "color3": "base0A", "color4": "base0D",
+	"color5": "base0E", "color6": "base0C", "color7": "base05", "color8": "base03", "color9": "base08",
+	"color10": "base0B", "color11": "base0A", "color12": "base0D", "color13": "base0E", "color14": "base0C",
+	"color15": "base07", "color16": "base09", "color17": "base0F", "color18": "base01", "color19": "base02",
+	"color20": "base04", "color21": "base06",
+}
+
+// Parses both the legacy flat base16 format and the newer one with a palette
+// sub-key. Since the format is a trivial subset of YAML, no YAML parser is needed.
+func import_base16(raw []byte) (name string, settings map[string]string, err error) {
+	base := make(map[string]string, 16)
+	for _, line := range utils.Splitlines(utils.UnsafeBytesToString(raw)) {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		key, val, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		val, _, _ = strings.Cut(strings.TrimSpace(val), " #")
+		val = strings.Trim(strings.TrimSpace(val), `"'`)
+		switch {
+		case key == "scheme" || key == "name":
+			name = val
+		case len(key) == 6 && strings.HasPrefix(key, "base"):
+			if !strings.HasPrefix(val, "#") {
+				val = "#" + val
+			}
+			if c, perr := style.ParseColor(val); perr == nil {
+				base[strings.ToLower(key)] = c.AsRGBSharp()
+			}
+		}
+	}
+	if len(base) < 16 {
+		return "", nil, fmt.Errorf("Not a valid base16 color scheme, only %d of 16 base colors found", len(base))
+	}
+	settings = make(map[string]string, len(base16_mapping))
+	for k, b := range base16_mapping {
+		settings[k] = base[strings.ToLower(b)]
+	}
+	return
+}
+
+func import_xresources(raw []byte) (name string, settings map[string]string, err error) {
+	defines := map[string]string{}
+	settings = make(map[string]string, 32)
+	keys := map[string]string{"foreground": "foreground", "background": "background", "cursorcolor": "cursor"}
+	for _, line := range utils.Splitlines(utils.UnsafeBytesToString(raw)) {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#define") {
+			if fields := strings.Fields(line); len(fields) == 3 {
+				defines[fields[1]] = fields[2]
+			}
+			continue
+		}
+		if line == "" || line[0] == '!' || line[0] == '#' {
+			continue
+		}
+		key, val, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		// Strip resource class/name prefixes such as *, *. and URxvt.
+		if idx := strings.LastIndexAny(key, "*."); idx > -1 {
+			key = key[idx+1:]
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		val = strings.TrimSpace(val)
+		if d, found := defines[val]; found {
+			val = d
+		}
+		kkey := keys[key]
+		if kkey == "" {
+			if n, cerr := strconv.Atoi(strings.TrimPrefix(key, "color")); cerr == nil && strings.HasPrefix(key, "color") && n >= 0 && n < 256 {
+				kkey = key
+			} else {
+				continue
+			}
+		}
+		if c, perr := style.ParseColor(val); perr == nil {
+			settings[kkey] = c.AsRGBSharp()
+		}
+	}
+	if len(settings) == 0 {
+		return "", nil, fmt.Errorf("No colors found")
+	}
+	return
+}
+
+// ImportColorScheme converts a color scheme file from some other program into
+// kitty theme metadata and settings
+func ImportColorScheme(path string) (*ThemeMetadata, map[string]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var name string
+	var settings map[string]string
+	var format string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".itermcolors":
+		format = "iTerm2"
+		name, settings, err = import_iterm2(raw)
+	case ".yaml", ".yml":
+		format = "base16"
+		name, settings, err = import_base16(raw)
+	default:
+		format = "Xresources"
+		name, settings, err = import_xresources(raw)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to import the %s color scheme from %s with error: %w", format, path, err)
+	}
+	if name == "" {
+		name = ThemeNameFromFileName(filepath.Base(path))
+	}
+	m := &ThemeMetadata{Name: name, Is_dark: true, Num_settings: len(settings), Blurb: fmt.Sprintf("Imported from the %s color scheme: %s", format, filepath.Base(path))}
+	if bg, found := settings["background"]; found {
+		if c, err := style.ParseColor(bg); err == nil {
+			m.Is_dark = is_dark_color(c)
+		}
+	}
+	return m, settings, nil
+}
+
+func (self *Themes) AddFromImportedFile(path string) (*Theme, error) {
+	m, settings, err := ImportColorScheme(path)
+	if err != nil {
+		return nil, err
+	}
+	t := self.AddFromSettings(m, settings)
+	t.is_imported = true
+	return t, nil
+}
+
+// AddFromSettings adds a user defined theme that exists only in memory, with
+// the specified metadata and color settings
+func (self *Themes) AddFromSettings(m *ThemeMetadata, settings map[string]string) *Theme {
+	t := Theme{metadata: m, is_user_defined: true, settings: settings, code: SettingsAsConf(m.Name, m.Blurb, settings)}
+	self.name_map[m.Name] = &t
+	if self.index_map != nil {
+		self.create_index_map()
+	}
+	return &t
+}
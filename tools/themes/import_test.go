@@ -0,0 +1,74 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package themes
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestThemeImport(t *testing.T) {
+	tdir := t.TempDir()
+	write := func(name, text string) {
+		if err := os.WriteFile(filepath.Join(tdir, name), []byte(text), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base16 := []string{`scheme: "Test Scheme"`, `author: "Someone"`}
+	for i := 0; i < 16; i++ {
+		base16 = append(base16, fmt.Sprintf(`base%02X: "%02x%02x%02x" # comment`, i, i, i, i))
+	}
+	write("b16.yaml", strings.Join(base16, "\n"))
+	write("other.yaml", "some: yaml\n")
+	write("x.Xresources", "! comment\n#define bg #101010\n*.background: bg\n*foreground: #eeeeee\nURxvt.color1: #ff0000\n*.cursorColor: #00ff00\n")
+	write("iterm.itermcolors", `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Ansi 1 Color</key>
+	<dict>
+		<key>Blue Component</key><real>0</real>
+		<key>Green Component</key><real>0</real>
+		<key>Red Component</key><real>1</real>
+	</dict>
+	<key>Background Color</key>
+	<dict>
+		<key>Blue Component</key><real>1</real>
+		<key>Green Component</key><real>1</real>
+		<key>Red Component</key><real>1</real>
+	</dict>
+</dict>
+</plist>`)
+	themes := Themes{name_map: make(map[string]*Theme)}
+	if err := themes.add_from_dir(tdir); err != nil {
+		t.Fatal(err)
+	}
+	themes.create_index_map()
+	if diff := strings.Join(themes.Names(), ","); diff != "Iterm,Test Scheme,X" {
+		t.Fatalf("Unexpected imported themes: %s", diff)
+	}
+	check := func(name string, is_dark bool, expected map[string]string) {
+		theme := themes.ThemeByName(name)
+		if !theme.IsImported() || theme.IsDark() != is_dark {
+			t.Fatalf("Incorrect metadata for imported theme: %s", name)
+		}
+		settings, _ := theme.Settings()
+		code, _ := theme.Code()
+		for k, v := range expected {
+			if settings[k] != v {
+				t.Fatalf("Incorrect value for %s in %s: %#v != %#v", k, name, settings[k], v)
+			}
+			if !strings.Contains(code, k+" "+v+"\n") {
+				t.Fatalf("%s %s not present in code:\n%s", k, v, code)
+			}
+		}
+	}
+	check("Test Scheme", true, map[string]string{"background": "#000000", "color1": "#080808", "color15": "#070707", "foreground": "#050505"})
+	check("X", true, map[string]string{"background": "#101010", "color1": "#ff0000", "foreground": "#eeeeee", "cursor": "#00ff00"})
+	check("Iterm", false, map[string]string{"background": "#ffffff", "color1": "#ff0000"})
+}
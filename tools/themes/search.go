@@ -0,0 +1,158 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package themes
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/style"
+)
+
+var _ = fmt.Print
+
+type color_filter func(theme *Theme) bool
+
+func is_dark_color(c style.RGBA) bool {
+	return utils.Max(c.Red, c.Green, c.Blue) < 115
+}
+
+func color_distance(a, b style.RGBA) float64 {
+	dr, dg, db := float64(a.Red)-float64(b.Red), float64(a.Green)-float64(b.Green), float64(a.Blue)-float64(b.Blue)
+	return math.Sqrt(dr*dr + dg*dg + db*db)
+}
+
+// Matches values such as dark, light, #1e1e2e and #1e1e2e~10
+func color_value_filter(key, val string) color_filter {
+	var matches func(style.RGBA) bool
+	switch val {
+	case "dark":
+		matches = is_dark_color
+	case "light":
+		matches = func(c style.RGBA) bool { return !is_dark_color(c) }
+	default:
+		cval, tolerance, found := strings.Cut(val, "~")
+		q, err := style.ParseColor(cval)
+		if err != nil {
+			return nil
+		}
+		max_distance := 0.
+		if found {
+			if max_distance, err = strconv.ParseFloat(tolerance, 64); err != nil {
+				return nil
+			}
+		}
+		matches = func(c style.RGBA) bool { return color_distance(c, q) <= max_distance }
+	}
+	return func(theme *Theme) bool {
+		c, ok := theme.Color(key)
+		return ok && matches(c)
+	}
+}
+
+// Matches values such as <30, >=4.5 and =50%
+func numeric_filter(val string, compute func(*Theme) float64) color_filter {
+	op := "="
+	for _, x := range []string{"<=", ">=", "<", ">", "="} {
+		if strings.HasPrefix(val, x) {
+			op, val = x, val[len(x):]
+			break
+		}
+	}
+	q, err := strconv.ParseFloat(strings.TrimSuffix(val, "%"), 64)
+	if err != nil {
+		return nil
+	}
+	return func(theme *Theme) bool {
+		v := compute(theme)
+		switch op {
+		case "<=":
+			return v <= q
+		case ">=":
+			return v >= q
+		case "<":
+			return v < q
+		case ">":
+			return v > q
+		}
+		return math.Round(v) == math.Round(q)
+	}
+}
+
+// The mean saturation, as a percentage, of the non-gray basic colors: red,
+// green, yellow, blue, magenta and cyan and their bright variants
+func palette_saturation(theme *Theme) float64 {
+	total := 0.
+	for _, i := range []int{1, 2, 3, 4, 5, 6, 9, 10, 11, 12, 13, 14} {
+		c, _ := theme.Color("color" + strconv.Itoa(i))
+		_, s, _ := c.AsHSL()
+		total += s
+	}
+	return 100 * total / 12
+}
+
+func background_lightness(theme *Theme) float64 {
+	c, _ := theme.Color("background")
+	_, _, l := c.AsHSL()
+	return 100 * l
+}
+
+func foreground_contrast(theme *Theme) float64 {
+	bg, _ := theme.Color("background")
+	fg, _ := theme.Color("foreground")
+	return style.ContrastRatio(fg, bg)
+}
+
+func parse_color_filter(key, val string) color_filter {
+	switch key {
+	case "bg", "background":
+		return color_value_filter("background", val)
+	case "fg", "foreground":
+		return color_value_filter("foreground", val)
+	case "saturation":
+		return numeric_filter(val, palette_saturation)
+	case "lightness":
+		return numeric_filter(val, background_lightness)
+	case "contrast":
+		return numeric_filter(val, foreground_contrast)
+	}
+	return nil
+}
+
+// Split a search expression into filters on theme colors and the remaining
+// text to be matched against theme names. Terms of the form key:value with an
+// unknown key or an invalid value are ignored, so that partially typed queries
+// do not hide all themes.
+func parse_search_expression(expression string) (filters []color_filter, rest string) {
+	words := []string{}
+	for _, word := range strings.Fields(expression) {
+		key, val, found := strings.Cut(word, ":")
+		if !found {
+			words = append(words, word)
+			continue
+		}
+		if f := parse_color_filter(strings.ToLower(key), strings.ToLower(val)); f != nil {
+			filters = append(filters, f)
+		}
+	}
+	return filters, strings.Join(words, " ")
+}
+
+func (self *Themes) apply_color_filters(filters []color_filter) {
+	for name, theme := range self.name_map {
+		if _, err := theme.Settings(); err != nil {
+			delete(self.name_map, name)
+			continue
+		}
+		for _, f := range filters {
+			if !f(theme) {
+				delete(self.name_map, name)
+				break
+			}
+		}
+	}
+	self.create_index_map()
+}
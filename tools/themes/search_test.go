@@ -0,0 +1,52 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package themes
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestThemeSearch(t *testing.T) {
+	coll := Themes{name_map: map[string]*Theme{}}
+	add := func(name string, settings map[string]string) {
+		coll.name_map[name] = &Theme{metadata: &ThemeMetadata{Name: name}, settings: settings}
+	}
+	add("Mocha", map[string]string{"background": "#1e1e2e", "foreground": "#cdd6f4"})
+	add("Latte", map[string]string{"background": "#eff1f5", "foreground": "#4c4f69"})
+	add("Gray Dark", map[string]string{
+		"background": "#202020", "foreground": "#d0d0d0",
+		"color1": "#806060", "color2": "#608060", "color3": "#808060", "color4": "#606080", "color5": "#806080", "color6": "#608080",
+		"color9": "#907070", "color10": "#709070", "color11": "#909070", "color12": "#707090", "color13": "#907090", "color14": "#709090",
+	})
+	coll.create_index_map()
+
+	test := func(expression string, expected ...string) {
+		c := coll.Copy()
+		actual := c.ApplySearch(expression, "", "")
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Fatalf("Unexpected search results for %#v:\n%s", expression, diff)
+		}
+	}
+	test("bg:dark", "Gray Dark", "Mocha")
+	test("bg:light", "Latte")
+	test("bg:#1e1e2e", "Mocha")
+	test("bg:#1f1f2f~2", "Mocha")
+	test("bg:#202020~20", "Gray Dark", "Mocha")
+	test("bg:dark moc", "Mocha")
+	test("saturation:<30", "Gray Dark")
+	test("lightness:>50", "Latte")
+	test("contrast:>=7 bg:light", "Latte")
+	test("contrast:<7 bg:light", []string{}...)
+	test("fg:light", "Gray Dark", "Mocha")
+	test("bg:#zzz", "Gray Dark", "Latte", "Mocha")
+	test("unknown:x lat", "Latte")
+	// colors are parsed only once, not on every search
+	if _, found := coll.name_map["Mocha"].colors["background"]; !found {
+		t.Fatalf("The colors of the theme were not cached")
+	}
+}
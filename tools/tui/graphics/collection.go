@@ -71,6 +71,9 @@ type ImageCollection struct {
 	image_id_counter uint32
 
 	images map[string]*Image
+	// ids of transmitted images that have been removed from the collection
+	// and must be deleted from the terminal
+	removed_image_ids []uint32
 }
 
 var ErrNotFound = errors.New("not found")
@@ -118,6 +121,60 @@ func (self *ImageCollection) AddPaths(paths ...string) {
 	}
 }
 
+// Add an already loaded image, such as one generated in memory, with the
+// specified key
+func (self *ImageCollection) AddImage(key string, data *images.ImageData) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.images[key] == nil {
+		i := NewImage()
+		i.src.path = key
+		i.src.data, i.src.loaded = data, true
+		i.src.size.Width, i.src.size.Height = data.Width, data.Height
+		self.images[key] = i
+	}
+}
+
+// Remove the image with the specified key, the terminal is told to free it
+// the next time images are placed
+func (self *ImageCollection) RemoveImage(key string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if img := self.images[key]; img != nil {
+		for _, r := range img.renderings {
+			if r.image_id > 0 {
+				self.removed_image_ids = append(self.removed_image_ids, r.image_id)
+			}
+		}
+		delete(self.images, key)
+	}
+}
+
+func (self *ImageCollection) free_removed_images(lp *loop.Loop) {
+	for _, id := range self.removed_image_ids {
+		if tr := self.temp_file_map[id]; tr != nil {
+			tr.remove()
+			delete(self.temp_file_map, id)
+		}
+		g := self.new_graphics_command()
+		g.SetAction(GRT_action_delete).SetDelete(GRT_free_by_id).SetImageId(id)
+		_ = g.WriteWithPayloadToLoop(lp, nil)
+	}
+	self.removed_image_ids = nil
+}
+
+// The full size image data for the specified key, loaded is false if the
+// image has not been loaded yet
+func (self *ImageCollection) SourceImage(key string) (data *images.ImageData, loaded bool, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	img := self.images[key]
+	if img == nil {
+		return nil, false, ErrNotFound
+	}
+	return img.src.data, img.src.loaded, img.err
+}
+
 func (self *Image) ResizeForPageSize(width, height int) {
 	sz := Size{width, height}
 	if self.renderings[sz] != nil {
@@ -157,6 +214,7 @@ func (self *ImageCollection) DeleteAllVisiblePlacements(lp *loop.Loop) {
 func (self *ImageCollection) PlaceImageSubRect(lp *loop.Loop, key string, page_size Size, left, top, width, height int) {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
+	self.free_removed_images(lp)
 	img := self.images[key]
 	if img == nil {
 		return
@@ -215,6 +273,7 @@ func (self *ImageCollection) Initialize(lp *loop.Loop) {
 }
 
 func (self *ImageCollection) Finalize(lp *loop.Loop) {
+	self.free_removed_images(lp)
 	for _, tr := range self.temp_file_map {
 		tr.remove()
 	}
@@ -0,0 +1,35 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tui
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+var RCProtocolVersion = [3]int{0, 26, 0}
+
+// RemoteControlEscapeCode returns an escape code that when written to the
+// terminal will cause kitty to run the specified remote control command. No
+// response is requested, so this is suitable for fire and forget commands from
+// kittens. Note that kitty will only act on it if remote control is allowed
+// for the window the kitten is running in.
+func RemoteControlEscapeCode(cmd string, payload any) (string, error) {
+	rc := utils.RemoteControlCmd{Cmd: cmd, Version: RCProtocolVersion, NoResponse: true, Payload: payload}
+	data, err := json.Marshal(&rc)
+	if err != nil {
+		return "", err
+	}
+	ans := "\x1bP@kitty-cmd" + utils.UnsafeBytesToString(data)
+	if TmuxSocketAddress() != "" {
+		if err = TmuxAllowPassthrough(); err != nil {
+			return "", err
+		}
+		return "\033Ptmux;\033" + ans + "\033\033\\\033\\", nil
+	}
+	return ans + "\033\\", nil
+}
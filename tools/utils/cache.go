@@ -36,6 +36,20 @@ func (self *LRUCache[K, V]) Set(key K, val V) {
 	return
 }
 
+func (self *LRUCache[K, V]) Delete(key K) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, found := self.data[key]; found {
+		delete(self.data, key)
+		for e := self.lru.Front(); e != nil; e = e.Next() {
+			if e.Value.(K) == key {
+				self.lru.Remove(e)
+				break
+			}
+		}
+	}
+}
+
 func (self *LRUCache[K, V]) GetOrCreate(key K, create func(key K) (V, error)) (V, error) {
 	self.lock.RLock()
 	ans, found := self.data[key]
@@ -102,3 +102,32 @@ func FormatNumber[T constraints.Float](n T, max_num_of_decimals ...int) string {
 	ans := strconv.FormatFloat(float64(n), 'f', prec, 64)
 	return strings.TrimRight(strings.TrimRight(ans, "0"), ".")
 }
+
+// ParseBytes parses a human readable size such as 5M or 1.5KiB into a number
+// of bytes. The suffixes K, M, G and T are powers of 1024 and can optionally
+// be followed by B or iB. A number without a suffix is a number of bytes.
+func ParseBytes(s string) (uint64, error) {
+	q := strings.TrimSpace(s)
+	num := strings.TrimRight(q, "KkMmGgTtiB")
+	suffix := strings.ToUpper(strings.TrimSpace(q[len(num):]))
+	suffix = strings.TrimSuffix(strings.TrimSuffix(suffix, "B"), "I")
+	mult := float64(1)
+	switch suffix {
+	case "":
+	case "K":
+		mult = KiByte
+	case "M":
+		mult = MiByte
+	case "G":
+		mult = GiByte
+	case "T":
+		mult = TiByte
+	default:
+		return 0, fmt.Errorf("The size %#v has an unknown unit", s)
+	}
+	val, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("The size %#v is not a valid number", s)
+	}
+	return uint64(val * mult), nil
+}
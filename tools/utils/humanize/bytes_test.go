@@ -0,0 +1,29 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package humanize
+
+import (
+	"fmt"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestParseBytes(t *testing.T) {
+	for q, expected := range map[string]uint64{
+		"0": 0, "100": 100, "5M": 5 * MiByte, "5m": 5 * MiByte, "1.5K": 1536, "2KiB": 2048, "3 MB": 3 * MiByte, "1G": GiByte, "1t": TiByte,
+	} {
+		actual, err := ParseBytes(q)
+		if err != nil {
+			t.Fatalf("Failed to parse %#v with error: %s", q, err)
+		}
+		if actual != expected {
+			t.Fatalf("Incorrect value for %#v: %d != %d", q, expected, actual)
+		}
+	}
+	for _, q := range []string{"", "M", "5X", "-1K", "1KK", "abc"} {
+		if _, err := ParseBytes(q); err == nil {
+			t.Fatalf("Parsing %#v did not fail", q)
+		}
+	}
+}
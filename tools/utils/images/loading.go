@@ -270,6 +270,12 @@ var MagickExe = sync.OnceValue(func() string {
 	return utils.FindExe("magick")
 })
 
+// Whether ImageMagick is installed, either version 7 with its magick command or
+// earlier versions with separate commands
+var MagickIsAvailable = sync.OnceValue(func() bool {
+	return MagickExe() != "magick" || utils.FindExe("identify") != "identify"
+})
+
 func RunMagick(path string, cmd []string) ([]byte, error) {
 	if MagickExe() != "magick" {
 		cmd = append([]string{MagickExe()}, cmd...)
@@ -0,0 +1,1042 @@
+// License: GPLv3 Copyright: 2024, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/style"
+
+	"golang.org/x/image/colornames"
+	"golang.org/x/image/vector"
+)
+
+var _ = fmt.Print
+
+// A renderer for the commonly used subset of SVG: shapes, paths, groups, use
+// elements, transforms, solid colors and opacity. Gradients are approximated
+// by the average color of their stops and text, images, clipping, masks and
+// filters are ignored. Everything is flattened to polygons and filled with the
+// nonzero winding rule, strokes are drawn as one quad per segment with round
+// joins. UsesUnsupportedFeatures() reports documents that use the ignored
+// features, so that they can be rendered by other means instead. Since use
+// elements can reference each other, recursive references are ignored and the
+// total number of nodes rendered is limited.
+
+const svg_default_width, svg_default_height = 300, 150
+const svg_max_depth, svg_max_rendered_nodes = 64, 256 * 1024
+
+type svg_node struct {
+	name     string
+	attrs    map[string]string
+	children []*svg_node
+}
+
+type SVG struct {
+	root     *svg_node
+	ids      map[string]*svg_node
+	view_box struct{ x, y, width, height float64 }
+	// the intrinsic size in CSS pixels
+	width, height float64
+}
+
+// IsSVG returns true if data looks like the start of an SVG document
+func IsSVG(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return bytes.HasPrefix(data, []byte("<")) && bytes.Contains(data, []byte("<svg"))
+}
+
+func ParseSVG(r io.Reader) (*SVG, error) {
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	dec.AutoClose = xml.HTMLAutoClose
+	dec.Entity = xml.HTMLEntity
+	ans := SVG{ids: make(map[string]*svg_node)}
+	var stack []*svg_node
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("Failed to parse SVG with error: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &svg_node{name: t.Name.Local, attrs: make(map[string]string, len(t.Attr))}
+			for _, a := range t.Attr {
+				n.attrs[a.Name.Local] = a.Value
+			}
+			if id := n.attrs["id"]; id != "" {
+				ans.ids[id] = n
+			}
+			if len(stack) > 0 {
+				stack[len(stack)-1].children = append(stack[len(stack)-1].children, n)
+			} else if ans.root == nil {
+				ans.root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	if ans.root == nil || ans.root.name != "svg" {
+		return nil, fmt.Errorf("Not an SVG document")
+	}
+	vb := svg_numbers(ans.root.attrs["viewBox"])
+	has_view_box := len(vb) == 4 && vb[2] > 0 && vb[3] > 0
+	if has_view_box {
+		ans.view_box.x, ans.view_box.y, ans.view_box.width, ans.view_box.height = vb[0], vb[1], vb[2], vb[3]
+	}
+	w, w_ok := svg_absolute_length(ans.root.attrs["width"])
+	h, h_ok := svg_absolute_length(ans.root.attrs["height"])
+	switch {
+	case w_ok && h_ok:
+		ans.width, ans.height = w, h
+	case w_ok && has_view_box:
+		ans.width, ans.height = w, w*ans.view_box.height/ans.view_box.width
+	case h_ok && has_view_box:
+		ans.width, ans.height = h*ans.view_box.width/ans.view_box.height, h
+	case has_view_box:
+		ans.width, ans.height = ans.view_box.width, ans.view_box.height
+	default:
+		ans.width, ans.height = svg_default_width, svg_default_height
+	}
+	if !has_view_box {
+		ans.view_box.width, ans.view_box.height = ans.width, ans.height
+	}
+	return &ans, nil
+}
+
+// IntrinsicSize is the size of the image in CSS pixels
+func (self *SVG) IntrinsicSize() (width, height float64) {
+	return self.width, self.height
+}
+
+var svg_unsupported_elements = map[string]bool{
+	"text": true, "clipPath": true, "mask": true, "style": true, "linearGradient": true, "radialGradient": true,
+	"pattern": true, "filter": true, "image": true, "foreignObject": true,
+}
+
+// UsesUnsupportedFeatures returns true if the document has elements or
+// attributes that are not rendered or only approximated
+func (self *SVG) UsesUnsupportedFeatures() bool {
+	stack := []*svg_node{self.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if svg_unsupported_elements[n.name] {
+			return true
+		}
+		props := svg_properties(n, "clip-path", "mask", "filter")
+		for _, k := range []string{"clip-path", "mask", "filter"} {
+			if v := props[k]; v != "" && v != "none" {
+				return true
+			}
+		}
+		stack = append(stack, n.children...)
+	}
+	return false
+}
+
+// Render the image scaled to fit into the specified size in pixels, keeping its
+// aspect ratio, unless the SVG specifies otherwise
+func (self *SVG) Render(width, height int) *image.RGBA {
+	ans := image.NewRGBA(image.Rect(0, 0, width, height))
+	vb := self.view_box
+	sx, sy := float64(width)/vb.width, float64(height)/vb.height
+	tx, ty := -vb.x*sx, -vb.y*sy
+	if par := strings.Fields(self.root.attrs["preserveAspectRatio"]); len(par) == 0 || par[0] != "none" {
+		s := math.Min(sx, sy)
+		if len(par) > 1 && par[1] == "slice" {
+			s = math.Max(sx, sy)
+		}
+		align := "xMidYMid"
+		if len(par) > 0 {
+			align = par[0]
+		}
+		tx, ty = -vb.x*s, -vb.y*s
+		extra_x, extra_y := float64(width)-vb.width*s, float64(height)-vb.height*s
+		switch {
+		case strings.HasPrefix(align, "xMid"):
+			tx += extra_x / 2
+		case strings.HasPrefix(align, "xMax"):
+			tx += extra_x
+		}
+		switch {
+		case strings.HasSuffix(align, "YMid"):
+			ty += extra_y / 2
+		case strings.HasSuffix(align, "YMax"):
+			ty += extra_y
+		}
+		sx, sy = s, s
+	}
+	r := svg_renderer{svg: self, dest: ans, viewport: [2]float64{vb.width, vb.height}, rendering: make(map[*svg_node]bool)}
+	r.z.Reset(width, height)
+	state := svg_state{
+		ctm: svg_matrix{sx, 0, 0, sy, tx, ty}, fill: svg_paint{is_set: true, c: color.NRGBA{A: 255}},
+		stroke_width: 1, fill_opacity: 1, stroke_opacity: 1, opacity: 1, current_color: color.NRGBA{A: 255},
+	}
+	r.render_children(self.root, state, 0)
+	return ans
+}
+
+// Transforms {{{
+
+// an affine transform, mapping (x, y) to (a*x + c*y + e, b*x + d*y + f)
+type svg_matrix [6]float64
+
+func (m svg_matrix) apply(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+// returns the transform that applies o and then m
+func (m svg_matrix) multiply(o svg_matrix) svg_matrix {
+	return svg_matrix{
+		m[0]*o[0] + m[2]*o[1], m[1]*o[0] + m[3]*o[1],
+		m[0]*o[2] + m[2]*o[3], m[1]*o[2] + m[3]*o[3],
+		m[0]*o[4] + m[2]*o[5] + m[4], m[1]*o[4] + m[3]*o[5] + m[5],
+	}
+}
+
+// the factor by which the transform scales lengths, on average
+func (m svg_matrix) scale() float64 {
+	return math.Sqrt(math.Abs(m[0]*m[3] - m[1]*m[2]))
+}
+
+func parse_svg_transform(raw string) svg_matrix {
+	ans := svg_matrix{1, 0, 0, 1, 0, 0}
+	for raw != "" {
+		name, rest, found := strings.Cut(raw, "(")
+		if !found {
+			break
+		}
+		args, rest, _ := strings.Cut(rest, ")")
+		raw = rest
+		n := svg_numbers(args)
+		get := func(i int, def float64) float64 {
+			if i < len(n) {
+				return n[i]
+			}
+			return def
+		}
+		var m svg_matrix
+		switch strings.Trim(strings.TrimSpace(name), ",") {
+		case "matrix":
+			if len(n) != 6 {
+				continue
+			}
+			m = svg_matrix{n[0], n[1], n[2], n[3], n[4], n[5]}
+		case "translate":
+			m = svg_matrix{1, 0, 0, 1, get(0, 0), get(1, 0)}
+		case "scale":
+			sx := get(0, 1)
+			m = svg_matrix{sx, 0, 0, get(1, sx), 0, 0}
+		case "rotate":
+			a := get(0, 0) * math.Pi / 180
+			cx, cy := get(1, 0), get(2, 0)
+			s, c := math.Sincos(a)
+			m = svg_matrix{1, 0, 0, 1, cx, cy}.multiply(svg_matrix{c, s, -s, c, 0, 0}).multiply(svg_matrix{1, 0, 0, 1, -cx, -cy})
+		case "skewX":
+			m = svg_matrix{1, 0, math.Tan(get(0, 0) * math.Pi / 180), 1, 0, 0}
+		case "skewY":
+			m = svg_matrix{1, math.Tan(get(0, 0) * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			continue
+		}
+		ans = ans.multiply(m)
+	}
+	return ans
+}
+
+// }}}
+
+// Values {{{
+
+func svg_numbers(raw string) (ans []float64) {
+	p := svg_number_parser{src: raw}
+	for {
+		p.skip_separators()
+		if p.pos >= len(p.src) {
+			break
+		}
+		n, ok := p.number()
+		if !ok {
+			break
+		}
+		ans = append(ans, n)
+	}
+	return
+}
+
+var svg_units = map[string]float64{
+	"": 1, "px": 1, "pt": 96. / 72, "pc": 16, "mm": 96 / 25.4, "cm": 96 / 2.54, "in": 96, "em": 16, "ex": 8,
+}
+
+// parse a length, with percentages relative to ref
+func svg_length(raw string, ref float64) (float64, bool) {
+	raw = strings.TrimSpace(raw)
+	if strings.HasSuffix(raw, "%") {
+		v, err := strconv.ParseFloat(raw[:len(raw)-1], 64)
+		return v * ref / 100, err == nil
+	}
+	i := len(raw)
+	for i > 0 && raw[i-1] >= 'a' && raw[i-1] <= 'z' {
+		i--
+	}
+	mult, found := svg_units[raw[i:]]
+	if !found {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(raw[:i], 64)
+	return v * mult, err == nil
+}
+
+func svg_absolute_length(raw string) (float64, bool) {
+	if strings.HasSuffix(strings.TrimSpace(raw), "%") {
+		return 0, false
+	}
+	v, ok := svg_length(raw, 0)
+	return v, ok && v > 0
+}
+
+func parse_svg_color(raw string) (color.NRGBA, bool) {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	if c, found := colornames.Map[raw]; found {
+		return color.NRGBA{c.R, c.G, c.B, c.A}, true
+	}
+	if strings.HasPrefix(raw, "rgb") {
+		_, args, _ := strings.Cut(raw, "(")
+		args, _, _ = strings.Cut(args, ")")
+		parts := strings.FieldsFunc(args, func(r rune) bool { return r == ',' || r == ' ' || r == '/' })
+		if len(parts) < 3 {
+			return color.NRGBA{}, false
+		}
+		ans := color.NRGBA{A: 255}
+		for i, p := range parts[:utils.Min(4, len(parts))] {
+			v, ok := svg_length(p, 255)
+			if !ok {
+				return color.NRGBA{}, false
+			}
+			if i == 3 {
+				if !strings.HasSuffix(p, "%") {
+					v *= 255
+				}
+				ans.A = uint8(math.Max(0, math.Min(255, math.Round(v))))
+				continue
+			}
+			c := uint8(math.Max(0, math.Min(255, math.Round(v))))
+			switch i {
+			case 0:
+				ans.R = c
+			case 1:
+				ans.G = c
+			case 2:
+				ans.B = c
+			}
+		}
+		return ans, true
+	}
+	if strings.HasPrefix(raw, "#") && (len(raw) == 5 || len(raw) == 9) {
+		// colors with alpha, n is the number of hex digits per channel
+		n := (len(raw) - 1) / 4
+		a, err := strconv.ParseUint(raw[len(raw)-n:], 16, 8)
+		c, ok := parse_svg_color(raw[:len(raw)-n])
+		if err != nil || !ok {
+			return color.NRGBA{}, false
+		}
+		if n == 1 {
+			a *= 17
+		}
+		c.A = uint8(a)
+		return c, true
+	}
+	c, err := style.ParseColor(raw)
+	if err != nil {
+		return color.NRGBA{}, false
+	}
+	return color.NRGBA{c.Red, c.Green, c.Blue, 255}, true
+}
+
+// }}}
+
+// Path data {{{
+
+type svg_number_parser struct {
+	src string
+	pos int
+}
+
+func (self *svg_number_parser) skip_separators() {
+	for self.pos < len(self.src) {
+		switch self.src[self.pos] {
+		case ' ', '\t', '\n', '\r', ',':
+			self.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (self *svg_number_parser) number() (float64, bool) {
+	start, i := self.pos, self.pos
+	s := self.src
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		i++
+	}
+	seen_dot, seen_digit := false, false
+	for i < len(s) {
+		switch c := s[i]; {
+		case c >= '0' && c <= '9':
+			seen_digit = true
+		case c == '.' && !seen_dot:
+			seen_dot = true
+		default:
+			goto exponent
+		}
+		i++
+	}
+exponent:
+	if seen_digit && i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && s[j] >= '0' && s[j] <= '9' {
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			i = j
+		}
+	}
+	if !seen_digit {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(s[start:i], 64)
+	if err != nil {
+		return 0, false
+	}
+	self.pos = i
+	return v, true
+}
+
+// flags in arcs can be written without separators
+func (self *svg_number_parser) flag() (bool, bool) {
+	self.skip_separators()
+	if self.pos < len(self.src) && (self.src[self.pos] == '0' || self.src[self.pos] == '1') {
+		self.pos++
+		return self.src[self.pos-1] == '1', true
+	}
+	return false, false
+}
+
+type svg_point struct{ x, y float64 }
+
+type svg_subpath struct {
+	points []svg_point
+	closed bool
+}
+
+// builds flattened subpaths in device coordinates
+type svg_path_builder struct {
+	ctm      svg_matrix
+	subpaths []*svg_subpath
+	cur      svg_point // in user coordinates
+	start    svg_point
+}
+
+func (self *svg_path_builder) device(p svg_point) svg_point {
+	x, y := self.ctm.apply(p.x, p.y)
+	return svg_point{x, y}
+}
+
+func (self *svg_path_builder) move_to(p svg_point) {
+	self.cur, self.start = p, p
+	self.subpaths = append(self.subpaths, &svg_subpath{points: []svg_point{self.device(p)}})
+}
+
+func (self *svg_path_builder) current_subpath() *svg_subpath {
+	if len(self.subpaths) == 0 || self.subpaths[len(self.subpaths)-1].closed {
+		self.move_to(self.cur)
+	}
+	return self.subpaths[len(self.subpaths)-1]
+}
+
+func (self *svg_path_builder) line_to(p svg_point) {
+	sp := self.current_subpath()
+	sp.points = append(sp.points, self.device(p))
+	self.cur = p
+}
+
+func (self *svg_path_builder) close() {
+	if len(self.subpaths) > 0 {
+		self.subpaths[len(self.subpaths)-1].closed = true
+	}
+	self.cur = self.start
+}
+
+func (self *svg_path_builder) num_of_segments(length float64) int {
+	return int(math.Max(4, math.Min(256, math.Ceil(length*self.ctm.scale()/3))))
+}
+
+func (self *svg_path_builder) cubic_to(c1, c2, p svg_point) {
+	p0 := self.cur
+	length := math.Hypot(c1.x-p0.x, c1.y-p0.y) + math.Hypot(c2.x-c1.x, c2.y-c1.y) + math.Hypot(p.x-c2.x, p.y-c2.y)
+	n := self.num_of_segments(length)
+	for i := 1; i <= n; i++ {
+		t := float64(i) / float64(n)
+		mt := 1 - t
+		a, b, c, d := mt*mt*mt, 3*mt*mt*t, 3*mt*t*t, t*t*t
+		self.line_to(svg_point{a*p0.x + b*c1.x + c*c2.x + d*p.x, a*p0.y + b*c1.y + c*c2.y + d*p.y})
+	}
+}
+
+func (self *svg_path_builder) quad_to(c1, p svg_point) {
+	p0 := self.cur
+	self.cubic_to(svg_point{p0.x + 2*(c1.x-p0.x)/3, p0.y + 2*(c1.y-p0.y)/3}, svg_point{p.x + 2*(c1.x-p.x)/3, p.y + 2*(c1.y-p.y)/3}, p)
+}
+
+// an elliptical arc, as specified in the SVG spec, see
+// https://www.w3.org/TR/SVG11/implnote.html#ArcConversionEndpointToCenter
+func (self *svg_path_builder) arc_to(rx, ry, rotation float64, large_arc, sweep bool, p svg_point) {
+	p0 := self.cur
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 || p0 == p {
+		self.line_to(p)
+		return
+	}
+	sin_phi, cos_phi := math.Sincos(rotation * math.Pi / 180)
+	dx, dy := (p0.x-p.x)/2, (p0.y-p.y)/2
+	x1 := cos_phi*dx + sin_phi*dy
+	y1 := -sin_phi*dx + cos_phi*dy
+	if l := x1*x1/(rx*rx) + y1*y1/(ry*ry); l > 1 {
+		rx, ry = rx*math.Sqrt(l), ry*math.Sqrt(l)
+	}
+	num := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	den := rx*rx*y1*y1 + ry*ry*x1*x1
+	coef := math.Sqrt(math.Max(0, num/den))
+	if large_arc == sweep {
+		coef = -coef
+	}
+	cx1, cy1 := coef*rx*y1/ry, -coef*ry*x1/rx
+	cx := cos_phi*cx1 - sin_phi*cy1 + (p0.x+p.x)/2
+	cy := sin_phi*cx1 + cos_phi*cy1 + (p0.y+p.y)/2
+	angle := func(ux, uy, vx, vy float64) float64 {
+		return math.Atan2(ux*vy-uy*vx, ux*vx+uy*vy)
+	}
+	theta := angle(1, 0, (x1-cx1)/rx, (y1-cy1)/ry)
+	delta := angle((x1-cx1)/rx, (y1-cy1)/ry, (-x1-cx1)/rx, (-y1-cy1)/ry)
+	if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	} else if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	}
+	n := self.num_of_segments(math.Abs(delta) * math.Max(rx, ry))
+	for i := 1; i < n; i++ {
+		s, c := math.Sincos(theta + delta*float64(i)/float64(n))
+		self.line_to(svg_point{cx + rx*c*cos_phi - ry*s*sin_phi, cy + rx*c*sin_phi + ry*s*cos_phi})
+	}
+	self.line_to(p)
+}
+
+func (self *svg_path_builder) ellipse(cx, cy, rx, ry float64) {
+	self.move_to(svg_point{cx + rx, cy})
+	self.arc_to(rx, ry, 0, false, true, svg_point{cx - rx, cy})
+	self.arc_to(rx, ry, 0, false, true, svg_point{cx + rx, cy})
+	self.close()
+}
+
+func (self *svg_path_builder) path(d string) {
+	p := svg_number_parser{src: d}
+	var cmd byte
+	var last_control svg_point
+	last_cmd := byte(0)
+	for {
+		p.skip_separators()
+		if p.pos >= len(p.src) {
+			break
+		}
+		if c := p.src[p.pos]; (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			cmd = c
+			p.pos++
+		} else if cmd == 0 {
+			return
+		}
+		relative := cmd >= 'a' && cmd <= 'z'
+		nums := func(count int) ([]float64, bool) {
+			ans := make([]float64, count)
+			for i := range ans {
+				p.skip_separators()
+				v, ok := p.number()
+				if !ok {
+					return nil, false
+				}
+				ans[i] = v
+			}
+			return ans, true
+		}
+		pt := func(x, y float64) svg_point {
+			if relative {
+				return svg_point{self.cur.x + x, self.cur.y + y}
+			}
+			return svg_point{x, y}
+		}
+		// the reflection of the previous control point, for smooth curves
+		reflected := func(cmds string) svg_point {
+			if strings.IndexByte(cmds, last_cmd|0x20) > -1 {
+				return svg_point{2*self.cur.x - last_control.x, 2*self.cur.y - last_control.y}
+			}
+			return self.cur
+		}
+		switch cmd | 0x20 {
+		case 'z':
+			self.close()
+			last_cmd = 'z'
+			continue
+		case 'm':
+			n, ok := nums(2)
+			if !ok {
+				return
+			}
+			self.move_to(pt(n[0], n[1]))
+			// subsequent pairs are implicit line commands
+			cmd = utils.IfElse(relative, byte('l'), 'L')
+		case 'l':
+			n, ok := nums(2)
+			if !ok {
+				return
+			}
+			self.line_to(pt(n[0], n[1]))
+		case 'h':
+			n, ok := nums(1)
+			if !ok {
+				return
+			}
+			self.line_to(svg_point{utils.IfElse(relative, self.cur.x+n[0], n[0]), self.cur.y})
+		case 'v':
+			n, ok := nums(1)
+			if !ok {
+				return
+			}
+			self.line_to(svg_point{self.cur.x, utils.IfElse(relative, self.cur.y+n[0], n[0])})
+		case 'c':
+			n, ok := nums(6)
+			if !ok {
+				return
+			}
+			c1, c2, e := pt(n[0], n[1]), pt(n[2], n[3]), pt(n[4], n[5])
+			self.cubic_to(c1, c2, e)
+			last_control = c2
+		case 's':
+			n, ok := nums(4)
+			if !ok {
+				return
+			}
+			c1, c2, e := reflected("cs"), pt(n[0], n[1]), pt(n[2], n[3])
+			self.cubic_to(c1, c2, e)
+			last_control = c2
+		case 'q':
+			n, ok := nums(4)
+			if !ok {
+				return
+			}
+			c1, e := pt(n[0], n[1]), pt(n[2], n[3])
+			self.quad_to(c1, e)
+			last_control = c1
+		case 't':
+			n, ok := nums(2)
+			if !ok {
+				return
+			}
+			c1, e := reflected("qt"), pt(n[0], n[1])
+			self.quad_to(c1, e)
+			last_control = c1
+		case 'a':
+			n, ok := nums(3)
+			if !ok {
+				return
+			}
+			large_arc, ok := p.flag()
+			if !ok {
+				return
+			}
+			sweep, ok := p.flag()
+			if !ok {
+				return
+			}
+			e, ok := nums(2)
+			if !ok {
+				return
+			}
+			self.arc_to(n[0], n[1], n[2], large_arc, sweep, pt(e[0], e[1]))
+		default:
+			return
+		}
+		last_cmd = cmd
+	}
+}
+
+// }}}
+
+// Rendering {{{
+
+type svg_paint struct {
+	is_set bool
+	c      color.NRGBA
+}
+
+type svg_state struct {
+	ctm                                   svg_matrix
+	fill, stroke                          svg_paint
+	stroke_width                          float64
+	fill_opacity, stroke_opacity, opacity float64
+	current_color                         color.NRGBA
+}
+
+type svg_renderer struct {
+	svg      *SVG
+	dest     *image.RGBA
+	z        vector.Rasterizer
+	viewport [2]float64
+	// the nodes currently being rendered, to detect recursive references
+	rendering      map[*svg_node]bool
+	nodes_rendered int
+}
+
+var svg_presentation_attributes = []string{"fill", "stroke", "stroke-width", "opacity", "fill-opacity", "stroke-opacity", "color", "display"}
+
+// the style properties of a node, from the specified presentation attributes
+// and its style attribute, which takes precedence
+func svg_properties(n *svg_node, attributes ...string) map[string]string {
+	ans := make(map[string]string, 8)
+	for _, k := range attributes {
+		if v, found := n.attrs[k]; found {
+			ans[k] = strings.TrimSpace(v)
+		}
+	}
+	for _, decl := range strings.Split(n.attrs["style"], ";") {
+		if k, v, found := strings.Cut(decl, ":"); found {
+			v, _, _ = strings.Cut(v, "!important")
+			ans[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return ans
+}
+
+// the average color of the stops of a gradient
+func (self *svg_renderer) gradient_color(n *svg_node, depth int) (color.NRGBA, bool) {
+	var r, g, b, a, count float64
+	for _, stop := range n.children {
+		if stop.name != "stop" {
+			continue
+		}
+		props := svg_properties(stop, "stop-color", "stop-opacity")
+		c := color.NRGBA{A: 255}
+		if v, found := props["stop-color"]; found {
+			if pc, ok := parse_svg_color(v); ok {
+				c = pc
+			}
+		}
+		alpha := float64(c.A) / 255
+		if v, err := strconv.ParseFloat(props["stop-opacity"], 64); err == nil {
+			alpha *= math.Max(0, math.Min(1, v))
+		}
+		r, g, b, a = r+float64(c.R), g+float64(c.G), b+float64(c.B), a+alpha
+		count++
+	}
+	if count == 0 {
+		// gradients can inherit their stops from other gradients
+		href := n.attrs["href"]
+		if ref := self.svg.ids[strings.TrimPrefix(href, "#")]; depth < 8 && ref != nil && strings.HasPrefix(href, "#") {
+			return self.gradient_color(ref, depth+1)
+		}
+		return color.NRGBA{}, false
+	}
+	return color.NRGBA{uint8(r / count), uint8(g / count), uint8(b / count), uint8(255 * a / count)}, true
+}
+
+func (self *svg_renderer) parse_paint(raw string, current_color color.NRGBA) (svg_paint, bool) {
+	switch {
+	case raw == "none" || raw == "transparent":
+		return svg_paint{}, true
+	case raw == "currentColor" || raw == "currentcolor":
+		return svg_paint{is_set: true, c: current_color}, true
+	case strings.HasPrefix(raw, "url("):
+		id, fallback, _ := strings.Cut(strings.TrimPrefix(raw, "url("), ")")
+		id = strings.Trim(strings.TrimSpace(id), `"'`)
+		if n := self.svg.ids[strings.TrimPrefix(id, "#")]; n != nil {
+			if c, ok := self.gradient_color(n, 0); ok {
+				return svg_paint{is_set: true, c: c}, true
+			}
+		}
+		if fallback = strings.TrimSpace(fallback); fallback != "" {
+			return self.parse_paint(fallback, current_color)
+		}
+		return svg_paint{}, true
+	}
+	if c, ok := parse_svg_color(raw); ok {
+		return svg_paint{is_set: true, c: c}, true
+	}
+	return svg_paint{}, false
+}
+
+func parse_opacity(raw string, def float64) float64 {
+	raw = strings.TrimSpace(raw)
+	mult := 1.0
+	if strings.HasSuffix(raw, "%") {
+		raw, mult = raw[:len(raw)-1], 0.01
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return def
+	}
+	return math.Max(0, math.Min(1, v*mult))
+}
+
+// the state for the node, returns false if it is not displayed
+func (self *svg_renderer) state_for(n *svg_node, parent svg_state) (svg_state, bool) {
+	s := parent
+	props := svg_properties(n, svg_presentation_attributes...)
+	if props["display"] == "none" {
+		return s, false
+	}
+	if t := n.attrs["transform"]; t != "" {
+		s.ctm = s.ctm.multiply(parse_svg_transform(t))
+	}
+	if v, found := props["color"]; found {
+		if c, ok := parse_svg_color(v); ok {
+			s.current_color = c
+		}
+	}
+	if v, found := props["fill"]; found {
+		if p, ok := self.parse_paint(v, s.current_color); ok {
+			s.fill = p
+		}
+	}
+	if v, found := props["stroke"]; found {
+		if p, ok := self.parse_paint(v, s.current_color); ok {
+			s.stroke = p
+		}
+	}
+	if v, found := props["stroke-width"]; found {
+		if w, ok := svg_length(v, math.Hypot(self.viewport[0], self.viewport[1])/math.Sqrt2); ok && w >= 0 {
+			s.stroke_width = w
+		}
+	}
+	s.fill_opacity = parse_opacity(props["fill-opacity"], s.fill_opacity)
+	s.stroke_opacity = parse_opacity(props["stroke-opacity"], s.stroke_opacity)
+	// opacity applies to the whole element, it is approximated by applying it
+	// to the fill and stroke of its descendants
+	s.opacity *= parse_opacity(props["opacity"], 1)
+	return s, true
+}
+
+func (self *svg_renderer) render_children(n *svg_node, s svg_state, depth int) {
+	for _, child := range n.children {
+		self.render_node(child, s, depth)
+	}
+}
+
+func (self *svg_renderer) render_node(n *svg_node, parent svg_state, depth int) {
+	if depth > svg_max_depth || self.nodes_rendered >= svg_max_rendered_nodes || self.rendering[n] {
+		return
+	}
+	self.nodes_rendered++
+	self.rendering[n] = true
+	defer delete(self.rendering, n)
+	s, visible := self.state_for(n, parent)
+	if !visible {
+		return
+	}
+	vw, vh := self.viewport[0], self.viewport[1]
+	length := func(name string, ref float64) float64 {
+		v, _ := svg_length(n.attrs[name], ref)
+		return v
+	}
+	b := svg_path_builder{ctm: s.ctm}
+	switch n.name {
+	case "g", "a", "switch":
+		self.render_children(n, s, depth+1)
+		return
+	case "svg":
+		s.ctm = s.ctm.multiply(svg_matrix{1, 0, 0, 1, length("x", vw), length("y", vh)})
+		self.render_children(n, s, depth+1)
+		return
+	case "use":
+		href := n.attrs["href"]
+		if ref := self.svg.ids[strings.TrimPrefix(href, "#")]; ref != nil && strings.HasPrefix(href, "#") && !self.rendering[ref] {
+			s.ctm = s.ctm.multiply(svg_matrix{1, 0, 0, 1, length("x", vw), length("y", vh)})
+			if ref.name == "symbol" {
+				self.rendering[ref] = true
+				self.render_children(ref, s, depth+1)
+				delete(self.rendering, ref)
+			} else {
+				self.render_node(ref, s, depth+1)
+			}
+		}
+		return
+	case "rect":
+		x, y, w, h := length("x", vw), length("y", vh), length("width", vw), length("height", vh)
+		if w <= 0 || h <= 0 {
+			return
+		}
+		rx, has_rx := svg_length(n.attrs["rx"], vw)
+		ry, has_ry := svg_length(n.attrs["ry"], vh)
+		if !has_rx {
+			rx = ry
+		}
+		if !has_ry {
+			ry = rx
+		}
+		rx, ry = math.Max(0, math.Min(rx, w/2)), math.Max(0, math.Min(ry, h/2))
+		if rx > 0 && ry > 0 {
+			b.move_to(svg_point{x + rx, y})
+			b.line_to(svg_point{x + w - rx, y})
+			b.arc_to(rx, ry, 0, false, true, svg_point{x + w, y + ry})
+			b.line_to(svg_point{x + w, y + h - ry})
+			b.arc_to(rx, ry, 0, false, true, svg_point{x + w - rx, y + h})
+			b.line_to(svg_point{x + rx, y + h})
+			b.arc_to(rx, ry, 0, false, true, svg_point{x, y + h - ry})
+			b.line_to(svg_point{x, y + ry})
+			b.arc_to(rx, ry, 0, false, true, svg_point{x + rx, y})
+		} else {
+			b.move_to(svg_point{x, y})
+			b.line_to(svg_point{x + w, y})
+			b.line_to(svg_point{x + w, y + h})
+			b.line_to(svg_point{x, y + h})
+		}
+		b.close()
+	case "circle":
+		r := length("r", math.Hypot(vw, vh)/math.Sqrt2)
+		if r <= 0 {
+			return
+		}
+		b.ellipse(length("cx", vw), length("cy", vh), r, r)
+	case "ellipse":
+		rx, ry := length("rx", vw), length("ry", vh)
+		if rx <= 0 || ry <= 0 {
+			return
+		}
+		b.ellipse(length("cx", vw), length("cy", vh), rx, ry)
+	case "line":
+		b.move_to(svg_point{length("x1", vw), length("y1", vh)})
+		b.line_to(svg_point{length("x2", vw), length("y2", vh)})
+	case "polyline", "polygon":
+		pts := svg_numbers(n.attrs["points"])
+		for i := 0; i+1 < len(pts); i += 2 {
+			if i == 0 {
+				b.move_to(svg_point{pts[i], pts[i+1]})
+			} else {
+				b.line_to(svg_point{pts[i], pts[i+1]})
+			}
+		}
+		if n.name == "polygon" {
+			b.close()
+		}
+	case "path":
+		b.path(n.attrs["d"])
+	default:
+		// defs, symbol, text, image, clipPath, mask, style, etc. are not rendered
+		return
+	}
+	if len(b.subpaths) == 0 {
+		return
+	}
+	if s.fill.is_set && n.name != "line" {
+		self.fill(b.subpaths, s.fill.c, s.fill_opacity*s.opacity)
+	}
+	if s.stroke.is_set && s.stroke_width > 0 {
+		self.stroke(b.subpaths, s.stroke_width*s.ctm.scale()/2, s.stroke.c, s.stroke_opacity*s.opacity)
+	}
+}
+
+func (self *svg_renderer) draw(c color.NRGBA, opacity float64) {
+	c.A = uint8(math.Round(float64(c.A) * opacity))
+	if c.A > 0 {
+		self.z.Draw(self.dest, self.dest.Bounds(), image.NewUniform(c), image.Point{})
+	}
+	b := self.dest.Bounds()
+	self.z.Reset(b.Dx(), b.Dy())
+}
+
+func (self *svg_renderer) fill(subpaths []*svg_subpath, c color.NRGBA, opacity float64) {
+	for _, sp := range subpaths {
+		if len(sp.points) < 3 {
+			continue
+		}
+		self.z.MoveTo(float32(sp.points[0].x), float32(sp.points[0].y))
+		for _, p := range sp.points[1:] {
+			self.z.LineTo(float32(p.x), float32(p.y))
+		}
+		self.z.ClosePath()
+	}
+	self.draw(c, opacity)
+}
+
+// add a polygon to the rasterizer, always with the same orientation, so that
+// overlapping polygons do not cancel each other out
+func (self *svg_renderer) add_polygon(pts []svg_point) {
+	area := 0.
+	for i, p := range pts {
+		q := pts[(i+1)%len(pts)]
+		area += p.x*q.y - q.x*p.y
+	}
+	if area == 0 {
+		return
+	}
+	if area < 0 {
+		for i, j := 0, len(pts)-1; i < j; i, j = i+1, j-1 {
+			pts[i], pts[j] = pts[j], pts[i]
+		}
+	}
+	self.z.MoveTo(float32(pts[0].x), float32(pts[0].y))
+	for _, p := range pts[1:] {
+		self.z.LineTo(float32(p.x), float32(p.y))
+	}
+	self.z.ClosePath()
+}
+
+func (self *svg_renderer) stroke(subpaths []*svg_subpath, half_width float64, c color.NRGBA, opacity float64) {
+	join := func(p svg_point) {
+		n := int(math.Max(8, math.Min(64, math.Ceil(half_width*2))))
+		pts := make([]svg_point, n)
+		for i := range pts {
+			s, c := math.Sincos(2 * math.Pi * float64(i) / float64(n))
+			pts[i] = svg_point{p.x + half_width*c, p.y + half_width*s}
+		}
+		self.add_polygon(pts)
+	}
+	for _, sp := range subpaths {
+		pts := sp.points
+		if sp.closed && len(pts) > 1 && pts[0] != pts[len(pts)-1] {
+			pts = append(pts[:len(pts):len(pts)], pts[0])
+		}
+		for i := 0; i+1 < len(pts); i++ {
+			p, q := pts[i], pts[i+1]
+			l := math.Hypot(q.x-p.x, q.y-p.y)
+			if l == 0 {
+				continue
+			}
+			nx, ny := -(q.y-p.y)/l*half_width, (q.x-p.x)/l*half_width
+			self.add_polygon([]svg_point{{p.x + nx, p.y + ny}, {q.x + nx, q.y + ny}, {q.x - nx, q.y - ny}, {p.x - nx, p.y - ny}})
+			if i+2 < len(pts) || sp.closed {
+				join(q)
+			}
+		}
+	}
+	self.draw(c, opacity)
+}
+
+// }}}
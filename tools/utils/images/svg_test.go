@@ -0,0 +1,115 @@
+// License: GPLv3 Copyright: 2024, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestSVG(t *testing.T) {
+	parse := func(src string) *SVG {
+		s, err := ParseSVG(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	size := func(src string, ew, eh float64) {
+		w, h := parse(src).IntrinsicSize()
+		if w != ew || h != eh {
+			t.Fatalf("Incorrect size %vx%v != %vx%v for: %s", w, h, ew, eh, src)
+		}
+	}
+	size(`<svg width="10" height="20"/>`, 10, 20)
+	size(`<svg width="1in" height="3pt"/>`, 96, 4)
+	size(`<svg viewBox="0 0 40 10" width="20"/>`, 20, 5)
+	size(`<svg viewBox="0,0,40,10" height="100%"/>`, 40, 10)
+	size(`<?xml version="1.0"?><!-- c --><svg xmlns="http://www.w3.org/2000/svg"/>`, svg_default_width, svg_default_height)
+	if _, err := ParseSVG(strings.NewReader(`<html/>`)); err == nil {
+		t.Fatalf("Parsing a document that is not SVG did not fail")
+	}
+	if !IsSVG([]byte("\n<?xml version='1.0'?>\n<svg>")) || IsSVG([]byte("\x89PNG")) {
+		t.Fatalf("SVG detection failed")
+	}
+
+	for raw, expected := range map[string]color.NRGBA{
+		"red": {255, 0, 0, 255}, "#0f0": {0, 255, 0, 255}, "#0000ff80": {0, 0, 255, 128},
+		"rgb(1, 2, 3)": {1, 2, 3, 255}, "rgba(100%,0%,0%,0.5)": {255, 0, 0, 128}, "cornflowerblue": {100, 149, 237, 255},
+	} {
+		if c, ok := parse_svg_color(raw); !ok || c != expected {
+			t.Fatalf("Incorrect color for %s: %v != %v", raw, c, expected)
+		}
+	}
+
+	b := svg_path_builder{ctm: svg_matrix{2, 0, 0, 2, 1, 1}}
+	b.path("M0,0 10 0v10h-10z m 1-1 L2-2e0")
+	actual := [][]svg_point{}
+	for _, sp := range b.subpaths {
+		actual = append(actual, sp.points)
+	}
+	expected := [][]svg_point{{{1, 1}, {21, 1}, {21, 21}, {1, 21}}, {{3, -1}, {5, -3}}}
+	if diff := cmp.Diff(expected, actual, cmp.AllowUnexported(svg_point{})); diff != "" {
+		t.Fatalf("Incorrect path:\n%s", diff)
+	}
+	b = svg_path_builder{ctm: svg_matrix{1, 0, 0, 1, 0, 0}}
+	b.path("M0 0A10 10 0 0110 10")
+	pts := b.subpaths[0].points
+	last := pts[len(pts)-1]
+	if len(pts) < 5 || last != (svg_point{10, 10}) {
+		t.Fatalf("Incorrect arc: %v", pts)
+	}
+	for _, p := range pts {
+		// the center of the arc is (0, 10)
+		if r := (p.x*p.x + (p.y-10)*(p.y-10)); r < 99.9 || r > 100.1 {
+			t.Fatalf("Point of arc not on circle: %v", p)
+		}
+	}
+
+	img := parse(`<svg viewBox="0 0 10 10" width="5" height="5">
+	<rect width="10" height="10" fill="white"/>
+	<g transform="translate(5 0)" style="fill: blue">
+		<rect width="5" height="5"/>
+		<rect x="1" y="6" width="3" height="3" fill="none" stroke="red" stroke-width="2"/>
+	</g>
+	<circle cx="2.5" cy="7.5" r="2" display="none"/>
+	</svg>`).Render(10, 10)
+	for _, x := range []struct {
+		x, y     int
+		expected color.RGBA
+	}{{1, 1, color.RGBA{255, 255, 255, 255}}, {8, 1, color.RGBA{0, 0, 255, 255}}, {7, 6, color.RGBA{255, 0, 0, 255}}, {7, 7, color.RGBA{255, 255, 255, 255}}, {2, 8, color.RGBA{255, 255, 255, 255}}} {
+		if c := img.RGBAAt(x.x, x.y); c != x.expected {
+			t.Fatalf("Incorrect color at (%d, %d): %v != %v", x.x, x.y, c, x.expected)
+		}
+	}
+
+	if parse(`<svg><rect width="1" height="1"/></svg>`).UsesUnsupportedFeatures() {
+		t.Fatalf("Supported SVG reported as unsupported")
+	}
+	for _, src := range []string{
+		`<svg><text>x</text></svg>`, `<svg><g><rect clip-path="url(#c)"/></g></svg>`, `<svg><g style="mask: url(#m)"/></svg>`,
+		`<svg><defs><linearGradient id="g"/></defs></svg>`, `<svg><style>rect { fill: red }</style></svg>`,
+	} {
+		if !parse(src).UsesUnsupportedFeatures() {
+			t.Fatalf("Unsupported SVG not detected: %s", src)
+		}
+	}
+
+	// recursive and exponentially nested use elements must not hang
+	bomb := strings.Builder{}
+	bomb.WriteString(`<svg viewBox="0 0 10 10"><defs><rect id="l0" width="1" height="1"/>`)
+	for i := 1; i < 30; i++ {
+		fmt.Fprintf(&bomb, `<g id="l%d"><use href="#l%d"/><use href="#l%d"/></g>`, i, i-1, i-1)
+	}
+	bomb.WriteString(`</defs><use href="#l29"/><g id="a"><use href="#b"/></g><g id="b"><use href="#a"/></g>`)
+	bomb.WriteString(`<symbol id="s"><use href="#s"/></symbol><use href="#s"/></svg>`)
+	if img = parse(bomb.String()).Render(10, 10); img.RGBAAt(0, 0) != (color.RGBA{0, 0, 0, 255}) {
+		t.Fatalf("Incorrect color for nested use elements: %v", img.RGBAAt(0, 0))
+	}
+}
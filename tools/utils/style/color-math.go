@@ -0,0 +1,99 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package style
+
+import (
+	"fmt"
+	"math"
+)
+
+var _ = fmt.Print
+
+// AsHSL returns the hue in degrees [0, 360) and the saturation and lightness in [0, 1]
+func (self RGBA) AsHSL() (h, s, l float64) {
+	r, g, b := float64(self.Red)/255, float64(self.Green)/255, float64(self.Blue)/255
+	mx, mn := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+	l = (mx + mn) / 2
+	if mx == mn {
+		return 0, 0, l
+	}
+	d := mx - mn
+	if l > 0.5 {
+		s = d / (2 - mx - mn)
+	} else {
+		s = d / (mx + mn)
+	}
+	switch mx {
+	case r:
+		h = (g - b) / d
+		if g < b {
+			h += 6
+		}
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	return h * 60, s, l
+}
+
+// RGBAFromHSL is the inverse of RGBA.AsHSL(). Out of range values are clamped,
+// except for hue which wraps around.
+func RGBAFromHSL(h, s, l float64) RGBA {
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+	s, l = math.Max(0, math.Min(s, 1)), math.Max(0, math.Min(l, 1))
+	to_byte := func(x float64) uint8 { return uint8(math.Round(x * 255)) }
+	if s == 0 {
+		return RGBA{Red: to_byte(l), Green: to_byte(l), Blue: to_byte(l)}
+	}
+	var q float64
+	if l < 0.5 {
+		q = l * (1 + s)
+	} else {
+		q = l + s - l*s
+	}
+	p := 2*l - q
+	hue_to_rgb := func(t float64) float64 {
+		if t < 0 {
+			t += 1
+		}
+		if t > 1 {
+			t -= 1
+		}
+		switch {
+		case t < 1./6:
+			return p + (q-p)*6*t
+		case t < 1./2:
+			return q
+		case t < 2./3:
+			return p + (q-p)*(2./3-t)*6
+		}
+		return p
+	}
+	h /= 360
+	return RGBA{Red: to_byte(hue_to_rgb(h + 1./3)), Green: to_byte(hue_to_rgb(h)), Blue: to_byte(hue_to_rgb(h - 1./3))}
+}
+
+// RelativeLuminance as defined by WCAG 2
+func (self RGBA) RelativeLuminance() float64 {
+	lin := func(x uint8) float64 {
+		c := float64(x) / 255
+		if c <= 0.03928 {
+			return c / 12.92
+		}
+		return math.Pow((c+0.055)/1.055, 2.4)
+	}
+	return 0.2126*lin(self.Red) + 0.7152*lin(self.Green) + 0.0722*lin(self.Blue)
+}
+
+// ContrastRatio as defined by WCAG 2, ranges from 1 to 21
+func ContrastRatio(a, b RGBA) float64 {
+	la, lb := a.RelativeLuminance(), b.RelativeLuminance()
+	if la < lb {
+		la, lb = lb, la
+	}
+	return (la + 0.05) / (lb + 0.05)
+}
@@ -0,0 +1,49 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package style
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestHSLConversion(t *testing.T) {
+	test := func(c RGBA, eh, es, el float64) {
+		h, s, l := c.AsHSL()
+		if math.Abs(h-eh) > 0.5 || math.Abs(s-es) > 0.01 || math.Abs(l-el) > 0.01 {
+			t.Fatalf("Incorrect HSL for %s: (%f, %f, %f) != (%f, %f, %f)", c.AsRGBSharp(), h, s, l, eh, es, el)
+		}
+		if q := RGBAFromHSL(h, s, l); q != c {
+			t.Fatalf("HSL roundtrip failed for %s: %s", c.AsRGBSharp(), q.AsRGBSharp())
+		}
+	}
+	test(RGBA{}, 0, 0, 0)
+	test(RGBA{Red: 255, Green: 255, Blue: 255}, 0, 0, 1)
+	test(RGBA{Red: 255}, 0, 1, 0.5)
+	test(RGBA{Green: 255}, 120, 1, 0.5)
+	test(RGBA{Blue: 255}, 240, 1, 0.5)
+	test(RGBA{Red: 0x1e, Green: 0x1e, Blue: 0x2e}, 240, 0.21, 0.15)
+	for i := 0; i < 256; i += 7 {
+		c := RGBA{Red: uint8(i), Green: uint8(255 - i), Blue: uint8((i * 3) % 256)}
+		h, s, l := c.AsHSL()
+		if q := RGBAFromHSL(h, s, l); q != c {
+			t.Fatalf("HSL roundtrip failed for %s: %s", c.AsRGBSharp(), q.AsRGBSharp())
+		}
+	}
+}
+
+func TestContrastRatio(t *testing.T) {
+	test := func(a, b RGBA, expected float64) {
+		if actual := ContrastRatio(a, b); math.Abs(actual-expected) > 0.01 {
+			t.Fatalf("Incorrect contrast ratio between %s and %s: %f != %f", a.AsRGBSharp(), b.AsRGBSharp(), actual, expected)
+		}
+	}
+	white, black := RGBA{Red: 255, Green: 255, Blue: 255}, RGBA{}
+	test(white, black, 21)
+	test(black, white, 21)
+	test(white, white, 1)
+	test(RGBA{Red: 0x77, Green: 0x77, Blue: 0x77}, white, 4.48)
+}
@@ -48,6 +48,7 @@ func ExtractAllFromTar(tr *tar.Reader, dest_path string, optss ...TarExtractOpti
 		var hdr *tar.Header
 		hdr, err = tr.Next()
 		if errors.Is(err, io.EOF) {
+			err = nil
 			break
 		}
 		if err != nil {